@@ -0,0 +1,94 @@
+package aws
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the example request from the AWS Signature Version 4 documentation
+func TestSign(t *testing.T) {
+	c := &Client{
+		Region: "us-east-1",
+		Credentials: Credentials{
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		},
+		now: func() time.Time {
+			return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+		},
+	}
+	req, _ := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	c.sign(req, nil, "iam")
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if actual := req.Header.Get("Authorization"); actual != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, actual)
+	}
+}
+
+func TestCallError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "Kinesis_20131202.GetRecords" {
+			t.Errorf("unexpected target %s", target)
+		}
+		if !strings.HasPrefix(r.Header.Get("Authorization"), algorithm) {
+			t.Error("expected the request to be signed")
+		}
+		w.WriteHeader(400)
+		w.Write([]byte(`{"__type":"com.amazonaws.kinesis#ExpiredIteratorException","message":"Iterator expired"}`))
+	}))
+	defer server.Close()
+	c := &Client{
+		Region:      "us-east-1",
+		Credentials: Credentials{AccessKeyID: "a", SecretAccessKey: "b"},
+		HTTPClient:  http.DefaultClient,
+		endpoint:    server.URL,
+		now:         time.Now,
+	}
+	err := c.Call("kinesis", "Kinesis_20131202.GetRecords", map[string]string{}, nil)
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("expected an APIError, got %v", err)
+	}
+	if apiErr.Type != "ExpiredIteratorException" || apiErr.StatusCode != 400 {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch target := r.Header.Get("X-Amz-Target"); target {
+		case "secretsmanager.GetSecretValue":
+			if string(body) != `{"SecretId":"honeytail"}` {
+				t.Errorf("unexpected request %s", body)
+			}
+			w.Write([]byte(`{"Name":"honeytail","SecretString":"{\"writekey\":\"abc\"}"}`))
+		case "AmazonSSM.GetParameter":
+			if string(body) != `{"Name":"/honeytail/writekey","WithDecryption":true}` {
+				t.Errorf("unexpected request %s", body)
+			}
+			w.Write([]byte(`{"Parameter":{"Name":"/honeytail/writekey","Type":"SecureString","Value":"def"}}`))
+		default:
+			t.Errorf("unexpected target %s", target)
+		}
+	}))
+	defer server.Close()
+	c := &Client{
+		Region:      "us-east-1",
+		Credentials: Credentials{AccessKeyID: "a", SecretAccessKey: "b"},
+		HTTPClient:  http.DefaultClient,
+		endpoint:    server.URL,
+		now:         time.Now,
+	}
+	if secret, err := c.GetSecretValue("honeytail"); err != nil || secret != `{"writekey":"abc"}` {
+		t.Errorf("unexpected secret %q, %v", secret, err)
+	}
+	if value, err := c.GetParameter("/honeytail/writekey"); err != nil || value != "def" {
+		t.Errorf("unexpected parameter %q, %v", value, err)
+	}
+}
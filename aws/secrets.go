@@ -0,0 +1,32 @@
+package aws
+
+// GetSecretValue returns the string value of a Secrets Manager secret, by
+// its name or ARN
+func (c *Client) GetSecretValue(secretID string) (string, error) {
+	var out struct {
+		SecretString string
+	}
+	if err := c.Call("secretsmanager", "secretsmanager.GetSecretValue", map[string]string{
+		"SecretId": secretID,
+	}, &out); err != nil {
+		return "", err
+	}
+	return out.SecretString, nil
+}
+
+// GetParameter returns the value of an SSM Parameter Store parameter,
+// decrypted if it's a SecureString
+func (c *Client) GetParameter(name string) (string, error) {
+	var out struct {
+		Parameter struct {
+			Value string
+		}
+	}
+	if err := c.Call("ssm", "AmazonSSM.GetParameter", map[string]interface{}{
+		"Name":           name,
+		"WithDecryption": true,
+	}, &out); err != nil {
+		return "", err
+	}
+	return out.Parameter.Value, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/honeycombio/honeytail/leash"
+)
+
+// benchmark reads the files options give once, from the start, through the
+// whole pipeline but sending, which goes nowhere, and prints how fast that
+// went: lines and MB a second, the parse error rate and the CPU seconds
+// taken per million lines. Where the files have been read up to isn't
+// saved.
+func benchmark(options leash.Config, out io.Writer) error {
+	stateDir, err := ioutil.TempDir("", "honeytail-benchmark")
+	if err != nil {
+		return fmt.Errorf("can't make a directory for state files: %s", err)
+	}
+	defer os.RemoveAll(stateDir)
+	options = benchmarkInput(options, stateDir)
+	for i, input := range options.Inputs {
+		options.Inputs[i] = benchmarkInput(input, stateDir)
+	}
+
+	start, startCPU := time.Now(), cpuTime()
+	stats, err := leash.Run(context.Background(), options)
+	if err != nil && err != leash.ErrSendFailures && err != leash.ErrParseErrors {
+		return err
+	}
+	elapsed, cpu := time.Since(start).Seconds(), (cpuTime() - startCPU).Seconds()
+
+	megabytes := float64(stats.Bytes) / (1024 * 1024)
+	fmt.Fprintf(out, "lines:                 %d\n", stats.Lines)
+	fmt.Fprintf(out, "MB:                    %.1f\n", megabytes)
+	fmt.Fprintf(out, "events:                %d\n", stats.Events)
+	fmt.Fprintf(out, "seconds:               %.2f\n", elapsed)
+	if elapsed > 0 {
+		fmt.Fprintf(out, "lines/sec:             %.0f\n", float64(stats.Lines)/elapsed)
+		fmt.Fprintf(out, "MB/sec:                %.1f\n", megabytes/elapsed)
+	}
+	if stats.Lines > 0 {
+		fmt.Fprintf(out, "parse errors:          %d (%.2f%%)\n", stats.ParseErrors, 100*float64(stats.ParseErrors)/float64(stats.Lines))
+		if cpu > 0 {
+			fmt.Fprintf(out, "CPU sec/million lines: %.2f\n", cpu*1e6/float64(stats.Lines))
+		}
+	}
+	return nil
+}
+
+// benchmarkInput sets up options to read their files once, from the start
+// unless another place is given, with state saved to stateDir
+func benchmarkInput(options leash.Config, stateDir string) leash.Config {
+	options.Modes.Benchmark = true
+	options.Tail.Stop = true
+	if options.Tail.ReadFrom == "last" || options.Tail.ReadFrom == "end" {
+		options.Tail.ReadFrom = "beginning"
+	}
+	options.Tail.StateFile = ""
+	options.Tail.StateDir = stateDir
+	return options
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime returns how much CPU time honeytail has used, user and kernel
+func cpuTime() time.Duration {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(process, &creation, &exit, &kernel, &user); err != nil {
+		return 0
+	}
+	// Filetimes count 100ns intervals
+	ticks := func(t syscall.Filetime) int64 {
+		return int64(t.HighDateTime)<<32 | int64(t.LowDateTime)
+	}
+	return time.Duration(ticks(kernel)+ticks(user)) * 100
+}
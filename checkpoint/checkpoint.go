@@ -0,0 +1,255 @@
+// Package checkpoint tracks events through the sending pipeline so that
+// inputs can tell when the events made from the lines they've handed out
+// have been sent, and only then record their position as done.
+package checkpoint
+
+import (
+	"sync"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// Tracker counts events as they enter the pipeline and as they leave it.
+//
+// Events flow through the pipeline in order, so each has a position: the
+// first event received is 1, the next 2 and so on. They're sent in batches
+// that may finish in any order, so the tracker keeps track of how far along
+// the positions every event has been sent. Once that reaches the count
+// received at some earlier moment, every event received before that moment
+// has been sent.
+type Tracker struct {
+	lock     sync.Mutex
+	received uint64
+	// sent is the position up to which every event has been sent
+	sent uint64
+	// later holds the positions past sent that have been sent
+	later map[uint64]bool
+	// failed is the first position that couldn't be sent, or 0
+	failed uint64
+	// abandoned is set when the pipeline stopped before sending anything
+	abandoned bool
+
+	requests chan chan uint64
+	done     chan struct{}
+
+	// forwarders are the stages between parsers and Watch that may be
+	// holding an event
+	forwarders map[*forwarder]bool
+
+	finishLock sync.Mutex
+	finishers  []func()
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		later:      make(map[uint64]bool),
+		requests:   make(chan chan uint64),
+		done:       make(chan struct{}),
+		forwarders: make(map[*forwarder]bool),
+	}
+}
+
+// forwarder is a stage started by Forward
+type forwarder struct {
+	// flush asks the forwarder to pass on any event it's holding, and to
+	// close the channel sent once it has
+	flush chan chan struct{}
+	done  chan struct{}
+}
+
+// Forward passes the events from in to out until in is closed, calling
+// modify on each first and dropping those it returns false for. It's for
+// stages between parsers and Watch: Mark waits for an event it's holding to
+// be passed on, so that events parsers have finished sending are still
+// included.
+func (t *Tracker) Forward(in chan event.Event, out chan event.Event, modify func(ev *event.Event) bool) {
+	f := &forwarder{flush: make(chan chan struct{}), done: make(chan struct{})}
+	t.lock.Lock()
+	t.forwarders[f] = true
+	t.lock.Unlock()
+	defer func() {
+		t.lock.Lock()
+		delete(t.forwarders, f)
+		t.lock.Unlock()
+		close(f.done)
+	}()
+	for {
+		select {
+		case ev, ok := <-in:
+			if !ok {
+				return
+			}
+			if !modify(&ev) {
+				continue
+			}
+			select {
+			case out <- ev:
+			case flushed := <-f.flush:
+				out <- ev
+				close(flushed)
+			}
+		case flushed := <-f.flush:
+			// holding nothing
+			close(flushed)
+		}
+	}
+}
+
+// flush waits for the events held by forwarders to be passed on
+func (t *Tracker) flush() {
+	t.lock.Lock()
+	forwarders := make([]*forwarder, 0, len(t.forwarders))
+	for f := range t.forwarders {
+		forwarders = append(forwarders, f)
+	}
+	t.lock.Unlock()
+	for _, f := range forwarders {
+		flushed := make(chan struct{})
+		select {
+		case f.flush <- flushed:
+			<-flushed
+		case <-f.done:
+		}
+	}
+}
+
+// Watch passes the events from in through to the returned channel, counting
+// each one. Parsers should send to in. Everything downstream must pass events
+// on in order, and whatever finally sends them must call Sent or Failed for
+// each one by its position, including any it intentionally doesn't send.
+func (t *Tracker) Watch(in chan event.Event) chan event.Event {
+	return t.WatchBuffered(in, nil)
+}
+
+// WatchBuffered is Watch for when there's a buffer between the parsers and
+// in. buffered is called in between events to find out how many the parsers
+// have handed to the buffer that haven't come out of it yet, so that marks
+// include them. Counting events the buffer later drops only means marks are
+// reached later.
+func (t *Tracker) WatchBuffered(in chan event.Event, buffered func() uint64) chan event.Event {
+	out := make(chan event.Event)
+	go func() {
+		defer close(t.done)
+		defer close(out)
+		for {
+			select {
+			case ev, ok := <-in:
+				if !ok {
+					return
+				}
+				t.lock.Lock()
+				t.received++
+				t.lock.Unlock()
+				out <- ev
+			case reply := <-t.requests:
+				count := t.count()
+				if buffered != nil {
+					count += buffered()
+				}
+				reply <- count
+			}
+		}
+	}()
+	return out
+}
+
+// Mark returns a position covering every event the pipeline has received
+// from parsers so far. Because Watch answers in between events, and
+// forwarders pass on what they're holding first, an event a parser finished
+// sending before Mark was called is always included.
+func (t *Tracker) Mark() uint64 {
+	if t.isAbandoned() {
+		return 0
+	}
+	t.flush()
+	reply := make(chan uint64, 1)
+	select {
+	case t.requests <- reply:
+		return <-reply
+	case <-t.done:
+		return t.count()
+	}
+}
+
+// Reached reports whether every event up to mark has been sent
+func (t *Tracker) Reached(mark uint64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return !t.abandoned && t.sent >= mark
+}
+
+// Sent records that the event at position has been sent, or intentionally
+// not sent (eg sampled out)
+func (t *Tracker) Sent(position uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.failed != 0 && position > t.failed {
+		// sent can never move past the failure, so there's no need to
+		// remember anything after it
+		return
+	}
+	t.later[position] = true
+	for t.later[t.sent+1] {
+		delete(t.later, t.sent+1)
+		t.sent++
+	}
+}
+
+// Failed records that the event at position couldn't be sent. No mark past
+// it will be reached, so that inputs don't record it as done and read it
+// again after a restart.
+func (t *Tracker) Failed(position uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.failed == 0 || position < t.failed {
+		t.failed = position
+		for later := range t.later {
+			if later > position {
+				delete(t.later, later)
+			}
+		}
+	}
+}
+
+// OnFinish registers f to be called by Finish. Inputs use it to record their
+// final positions.
+func (t *Tracker) OnFinish(f func()) {
+	t.finishLock.Lock()
+	t.finishers = append(t.finishers, f)
+	t.finishLock.Unlock()
+}
+
+// Finish is called once the pipeline is closed and the outcome of sending
+// every event is known. It calls the functions registered with OnFinish.
+func (t *Tracker) Finish() {
+	t.finishLock.Lock()
+	finishers := t.finishers
+	t.finishers = nil
+	t.finishLock.Unlock()
+	for _, f := range finishers {
+		f()
+	}
+}
+
+// Abandon is Finish for a pipeline that stopped before it started sending.
+// No mark is reached from then on, so inputs don't record anything they
+// read as done, but the functions registered with OnFinish are still
+// called, so they let go of what they hold.
+func (t *Tracker) Abandon() {
+	t.lock.Lock()
+	t.abandoned = true
+	t.lock.Unlock()
+	t.Finish()
+}
+
+func (t *Tracker) isAbandoned() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.abandoned
+}
+
+func (t *Tracker) count() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.received
+}
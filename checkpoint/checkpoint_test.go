@@ -0,0 +1,156 @@
+package checkpoint
+
+import (
+	"testing"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestTracker(t *testing.T) {
+	tracker := NewTracker()
+	in := make(chan event.Event)
+	out := tracker.Watch(in)
+
+	if mark := tracker.Mark(); mark != 0 || !tracker.Reached(mark) {
+		t.Errorf("expected an empty pipeline to have reached mark 0, got %d", mark)
+	}
+
+	// two events go in; until they come out the other side the mark isn't
+	// reached
+	go func() {
+		in <- event.Event{}
+		in <- event.Event{}
+	}()
+	<-out
+	<-out
+	mark := tracker.Mark()
+	if mark != 2 {
+		t.Errorf("expected mark 2, got %d", mark)
+	}
+	if tracker.Reached(mark) {
+		t.Error("expected mark not to be reached before anything was sent")
+	}
+	// the second batch finishes first
+	tracker.Sent(2)
+	if tracker.Reached(mark) {
+		t.Error("expected mark not to be reached after one of two events was sent")
+	}
+	tracker.Sent(1)
+	if !tracker.Reached(mark) {
+		t.Error("expected mark to be reached after both events were sent")
+	}
+
+	// marks still work once the pipeline has shut down
+	close(in)
+	for range out {
+	}
+	if mark := tracker.Mark(); mark != 2 {
+		t.Errorf("expected mark 2 after close, got %d", mark)
+	}
+}
+
+func TestTrackerFailed(t *testing.T) {
+	tracker := NewTracker()
+	in := make(chan event.Event)
+	out := tracker.Watch(in)
+	go func() {
+		for i := 0; i < 4; i++ {
+			in <- event.Event{}
+		}
+		close(in)
+	}()
+	for range out {
+	}
+	tracker.Sent(1)
+	tracker.Failed(2)
+	tracker.Sent(3)
+	tracker.Sent(4)
+	if !tracker.Reached(1) {
+		t.Error("expected the event before the failure to be reached")
+	}
+	if tracker.Reached(2) || tracker.Reached(tracker.Mark()) {
+		t.Error("expected nothing from the failure on to be reached")
+	}
+
+	finished := 0
+	tracker.OnFinish(func() { finished++ })
+	tracker.Finish()
+	if finished != 1 {
+		t.Errorf("expected the finisher to be called once, got %d", finished)
+	}
+}
+
+func TestTrackerBuffered(t *testing.T) {
+	tracker := NewTracker()
+	in := make(chan event.Event)
+	var buffered uint64 = 3
+	out := tracker.WatchBuffered(in, func() uint64 { return buffered })
+
+	// marks include what the buffer's holding, even before it comes through
+	if mark := tracker.Mark(); mark != 3 {
+		t.Errorf("expected mark 3 with 3 events buffered, got %d", mark)
+	}
+	go func() { in <- event.Event{} }()
+	<-out
+	buffered = 2
+	if mark := tracker.Mark(); mark != 3 {
+		t.Errorf("expected mark 3 with 1 event received and 2 buffered, got %d", mark)
+	}
+	close(in)
+	for range out {
+	}
+}
+
+func TestTrackerForward(t *testing.T) {
+	tracker := NewTracker()
+	parsed := make(chan event.Event)
+	in := make(chan event.Event)
+	out := tracker.Watch(in)
+	forwarded := make(chan struct{})
+	go func() {
+		tracker.Forward(parsed, in, func(ev *event.Event) bool {
+			return ev.Dataset != "skip"
+		})
+		close(in)
+		close(forwarded)
+	}()
+
+	// an idle forwarder doesn't hold up marks
+	if mark := tracker.Mark(); mark != 0 {
+		t.Errorf("expected mark 0 before anything was parsed, got %d", mark)
+	}
+	parsed <- event.Event{Dataset: "skip"}
+	parsed <- event.Event{}
+	// the event the forwarder's holding is passed on before the mark is
+	// taken, so it's included
+	marked := make(chan uint64)
+	go func() { marked <- tracker.Mark() }()
+	<-out
+	if mark := <-marked; mark != 1 {
+		t.Errorf("expected mark 1 with the event forwarded, got %d", mark)
+	}
+	close(parsed)
+	<-forwarded
+	for range out {
+	}
+	if mark := tracker.Mark(); mark != 1 {
+		t.Errorf("expected mark 1 once forwarding stopped, got %d", mark)
+	}
+}
+
+func TestTrackerAbandon(t *testing.T) {
+	tracker := NewTracker()
+	finished := false
+	tracker.OnFinish(func() {
+		// nothing was sent, so nothing's reached, and marks don't wait for
+		// a pipeline that never started
+		if tracker.Reached(tracker.Mark()) {
+			t.Error("expected nothing to be reached once abandoned")
+		}
+		finished = true
+	})
+	tracker.Abandon()
+	if !finished {
+		t.Error("expected the finisher to be called")
+	}
+}
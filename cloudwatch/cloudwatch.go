@@ -0,0 +1,184 @@
+// Package cloudwatch implements reading log lines from an AWS CloudWatch Logs
+// log group.
+//
+// cloudwatch polls a log group for new events and provides a channel on
+// which each event's message will be sent as a string, the same way the tail
+// package does for lines of a file.
+package cloudwatch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/aws"
+)
+
+const (
+	scheme = "cloudwatch://"
+	target = "Logs_20140328.FilterLogEvents"
+)
+
+type Options struct {
+	FilterPattern string `long:"filter_pattern" description:"Only read events matching this CloudWatch Logs filter pattern"`
+	StreamPrefix  string `long:"stream_prefix" description:"Only read events from log streams whose names start with this prefix"`
+	StartFrom     string `long:"start_from" description:"Where to start reading the log group. Values: oldest, newest" default:"newest"`
+	PollInterval  int    `long:"poll_interval" description:"Seconds to wait between polls of the log group" default:"10"`
+	Lookback      int    `long:"lookback" description:"Seconds before the newest event seen to keep re-reading on each poll, to catch events that are ingested late" default:"60"`
+}
+
+// IsCloudWatchURL returns true if path names a log group rather than a file
+func IsCloudWatchURL(path string) bool {
+	return strings.HasPrefix(path, scheme)
+}
+
+type filteredEvent struct {
+	EventID   string `json:"eventId"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+type filterOutput struct {
+	Events    []filteredEvent `json:"events"`
+	NextToken string          `json:"nextToken"`
+}
+
+// GetEntries starts polling the log group named in url (eg
+// cloudwatch:///aws/lambda/my-function). It sends one event message at a
+// time down the returned channel, until ctx is done, when it closes the
+// channel.
+func GetEntries(ctx context.Context, url string, options Options, awsOptions aws.Options) (chan string, error) {
+	group := strings.TrimPrefix(url, scheme)
+	if group == "" {
+		return nil, fmt.Errorf("cloudwatch url must name a log group, eg cloudwatch:///aws/lambda/my-function")
+	}
+	var start int64
+	switch options.StartFrom {
+	case "oldest":
+		start = 0
+	case "newest":
+		start = toMillis(time.Now())
+	default:
+		return nil, fmt.Errorf("unknown option to --cloudwatch.start_from: %s", options.StartFrom)
+	}
+	client, err := aws.NewClient(awsOptions)
+	if err != nil {
+		return nil, err
+	}
+	p := &poller{
+		ctx:     ctx,
+		client:  client,
+		group:   group,
+		options: options,
+		newest:  start,
+		seen:    make(map[string]int64),
+	}
+	// make sure we can read the group before we claim to be reading it
+	events, err := p.poll()
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"log_group": group}).Info("reading from cloudwatch logs")
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			for _, ev := range events {
+				select {
+				case lines <- ev.Message:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-time.After(time.Duration(options.PollInterval) * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			events, err = p.poll()
+			if err != nil && ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{
+					"log_group": group,
+					"err":       err,
+				}).Warn("failed to read cloudwatch log events")
+			}
+		}
+	}()
+	return lines, nil
+}
+
+// poller remembers which events it has already returned
+type poller struct {
+	ctx     context.Context
+	client  *aws.Client
+	group   string
+	options Options
+	// newest is the timestamp of the newest event seen, in milliseconds
+	newest int64
+	// seen maps the ids of events inside the lookback window to their
+	// timestamps
+	seen map[string]int64
+}
+
+// poll returns the events that have appeared since the last poll
+func (p *poller) poll() ([]filteredEvent, error) {
+	lookback := int64(p.options.Lookback) * 1000
+	in := map[string]interface{}{
+		"logGroupName": p.group,
+		"startTime":    maxInt64(p.newest-lookback, 0),
+		"interleaved":  true,
+	}
+	if p.options.FilterPattern != "" {
+		in["filterPattern"] = p.options.FilterPattern
+	}
+	if p.options.StreamPrefix != "" {
+		in["logStreamNamePrefix"] = p.options.StreamPrefix
+	}
+	var fresh []filteredEvent
+	for {
+		var out filterOutput
+		if err := p.client.CallContext(p.ctx, "logs", target, in, &out); err != nil {
+			return fresh, err
+		}
+		fresh = append(fresh, p.unseen(out.Events)...)
+		if out.NextToken == "" {
+			break
+		}
+		in["nextToken"] = out.NextToken
+	}
+	// forget events that have fallen out of the window
+	for id, ts := range p.seen {
+		if ts < p.newest-lookback {
+			delete(p.seen, id)
+		}
+	}
+	return fresh, nil
+}
+
+func (p *poller) unseen(events []filteredEvent) []filteredEvent {
+	var fresh []filteredEvent
+	for _, ev := range events {
+		if _, ok := p.seen[ev.EventID]; ok {
+			continue
+		}
+		p.seen[ev.EventID] = ev.Timestamp
+		if ev.Timestamp > p.newest {
+			p.newest = ev.Timestamp
+		}
+		fresh = append(fresh, ev)
+	}
+	return fresh
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func maxInt64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
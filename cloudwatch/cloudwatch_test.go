@@ -0,0 +1,34 @@
+package cloudwatch
+
+import (
+	"testing"
+)
+
+func TestUnseen(t *testing.T) {
+	p := &poller{
+		options: Options{Lookback: 60},
+		seen:    make(map[string]int64),
+	}
+	first := p.unseen([]filteredEvent{
+		{EventID: "a", Timestamp: 1000, Message: "one"},
+		{EventID: "b", Timestamp: 2000, Message: "two"},
+	})
+	if len(first) != 2 {
+		t.Fatalf("expected 2 new events, got %d", len(first))
+	}
+	if p.newest != 2000 {
+		t.Errorf("expected newest to be 2000, got %d", p.newest)
+	}
+	// the next poll overlaps the last one and finds a late arrival
+	second := p.unseen([]filteredEvent{
+		{EventID: "b", Timestamp: 2000, Message: "two"},
+		{EventID: "c", Timestamp: 1500, Message: "late"},
+		{EventID: "d", Timestamp: 3000, Message: "three"},
+	})
+	if len(second) != 2 || second[0].Message != "late" || second[1].Message != "three" {
+		t.Errorf("expected only the late and new events, got %+v", second)
+	}
+	if p.newest != 3000 {
+		t.Errorf("expected newest to be 3000, got %d", p.newest)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/honeycombio/honeytail/leash"
+	flag "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+// parseArgs parses args into options, the options fp was made for. If they
+// give a --config file its contents are parsed as well, before args are
+// parsed again so that they take precedence over it. Flags given more than
+// once, like --drop_field, are taken from args instead of the file rather
+// than added to them. Each of the file's inputs is parsed into its own
+// options in options.Inputs, from the rest of the file, args and then its
+// own flags, which take precedence over both.
+func parseArgs(fp *flag.Parser, options *leash.Config, args []string) ([]string, error) {
+	extraArgs, err := fp.ParseArgs(args)
+	if err != nil || options.ConfigFile == "" {
+		return extraArgs, err
+	}
+	configFile := options.ConfigFile
+	configArgs, inputArgs, err := readConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseConfigArgs(fp, configFile, configArgs); err != nil {
+		return nil, err
+	}
+	if extraArgs, err = fp.ParseArgs(args); err != nil {
+		return nil, err
+	}
+	for i, input := range inputArgs {
+		var inputOptions leash.Config
+		ifp := flag.NewParser(&inputOptions, flag.None)
+		name := fmt.Sprintf("%s input %d", configFile, i+1)
+		if err := parseConfigArgs(ifp, configFile, configArgs); err != nil {
+			return nil, err
+		}
+		if _, err := ifp.ParseArgs(args); err != nil {
+			return nil, err
+		}
+		if err := parseConfigArgs(ifp, name, input); err != nil {
+			return nil, err
+		}
+		options.Inputs = append(options.Inputs, inputOptions)
+	}
+	return extraArgs, nil
+}
+
+// parseConfigArgs parses the flags read from a config file, naming it in
+// any error
+func parseConfigArgs(fp *flag.Parser, name string, args []string) error {
+	if extra, err := fp.ParseArgs(args); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	} else if len(extra) != 0 {
+		return fmt.Errorf("%s: unexpected values %v", name, extra)
+	}
+	return nil
+}
+
+// readConfigFile reads a YAML config file into the command line flags it
+// stands for. Its keys are the flags' long names, and the flags in a group
+// with a namespace can be given either with their full name or in a map
+// under the namespace:
+//
+//	parser: nginx
+//	dataset: nginx-access
+//	file:
+//	  - /var/log/nginx/access.log
+//	nginx:
+//	  conf: /etc/nginx/nginx.conf
+//	  format: main
+//	tail.read_from: end
+//	drop_field: [cookie, authorization]
+//
+// Lists are given as the flag once for each value, and booleans as the flag
+// if they're true.
+//
+// An inputs list runs several inputs side by side in one honeytail, each
+// with the flags in its item as well as the rest of the file's:
+//
+//	inputs:
+//	  - parser: nginx
+//	    file: /var/log/nginx/access.log
+//	    dataset: nginx-access
+//	  - parser: json
+//	    file: /var/log/app/app.log
+//	    dataset: app
+//	    samplerate: 10
+//
+// They're returned as the flags of each input.
+func readConfigFile(path string) ([]string, [][]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal(contents, &config); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	var inputs [][]string
+	for i := 0; i < len(config); i++ {
+		if config[i].Key != "inputs" {
+			continue
+		}
+		items, ok := config[i].Value.([]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: inputs must be a list", path)
+		}
+		for n, item := range items {
+			input, ok := item.(yaml.MapSlice)
+			if !ok {
+				return nil, nil, fmt.Errorf("%s: input %d must be a map of flags", path, n+1)
+			}
+			args, err := configArgs("", input)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s input %d: %s", path, n+1, err)
+			}
+			inputs = append(inputs, args)
+		}
+		config = append(config[:i], config[i+1:]...)
+		i--
+	}
+	args, err := configArgs("", config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return args, inputs, nil
+}
+
+// configArgs returns the flags for the items in config, naming them with
+// prefix, the namespace they're nested in
+func configArgs(prefix string, config yaml.MapSlice) ([]string, error) {
+	var args []string
+	for _, item := range config {
+		name := prefix + fmt.Sprintf("%v", item.Key)
+		switch name {
+		case "config":
+			return nil, fmt.Errorf("config files can't include other config files")
+		case "inputs":
+			return nil, fmt.Errorf("inputs can only be given at the top of the file")
+		}
+		switch v := item.Value.(type) {
+		case yaml.MapSlice:
+			nested, err := configArgs(name+".", v)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, nested...)
+		case []interface{}:
+			for _, elem := range v {
+				arg, err := configArg(name, elem)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg...)
+			}
+		default:
+			arg, err := configArg(name, v)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg...)
+		}
+	}
+	return args, nil
+}
+
+// configArg returns the flag setting name to a single value
+func configArg(name string, val interface{}) ([]string, error) {
+	switch v := val.(type) {
+	case nil:
+		return nil, nil
+	case bool:
+		if !v {
+			return nil, nil
+		}
+		return []string{"--" + name}, nil
+	case yaml.MapSlice, map[interface{}]interface{}, []interface{}:
+		return nil, fmt.Errorf("%s can't be a list of lists or maps", name)
+	}
+	return []string{fmt.Sprintf("--%s=%v", name, val)}, nil
+}
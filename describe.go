@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/honeycombio/honeytail/leash"
+	flag "github.com/jessevdk/go-flags"
+)
+
+// parserNamespaces are the namespaces of the options of the parsers whose
+// names don't match them
+var parserNamespaces = map[string]string{
+	"mongodb": "mongo",
+	"php-fpm": "phpfpm",
+}
+
+// describeParser prints what the parser called name says about the logs it
+// reads, and its options from fp, for honeytail parsers describe
+func describeParser(fp *flag.Parser, name string, out io.Writer) error {
+	description, err := leash.DescribeParser(name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s: %s\n", name, description.Summary)
+	for _, section := range []struct {
+		title string
+		lines []string
+	}{
+		{"Examples", description.Examples},
+		{"Timestamps", description.Timestamps},
+	} {
+		if len(section.lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\n%s:\n", section.title)
+		for _, line := range section.lines {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+
+	namespace := name
+	if ns, ok := parserNamespaces[name]; ok {
+		namespace = ns
+	}
+	var opts []*flag.Option
+	for _, group := range fp.Groups() {
+		for _, nested := range append([]*flag.Group{group}, group.Groups()...) {
+			if nested.Namespace == namespace {
+				opts = append(opts, nested.Options()...)
+			}
+		}
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	width := 0
+	for _, opt := range opts {
+		if n := len(opt.LongNameWithNamespace()); n > width {
+			width = n
+		}
+	}
+	fmt.Fprintf(out, "\nOptions:\n")
+	for _, opt := range opts {
+		description := opt.Description
+		if len(opt.Default) > 0 {
+			description += fmt.Sprintf(" (default: %s)", strings.Join(opt.Default, ", "))
+		}
+		fmt.Fprintf(out, "  --%-*s  %s\n", width, opt.LongNameWithNamespace(), description)
+	}
+	return nil
+}
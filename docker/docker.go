@@ -0,0 +1,332 @@
+// Package docker implements reading the logs of running Docker containers.
+//
+// docker talks to the Docker Engine API, finds the containers matching the
+// configured filters and provides a channel of their log streams, one per
+// container, each with the container's name, image and labels attached as
+// fields. Containers that start later are picked up as they appear.
+package docker
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+type Options struct {
+	Host         string   `long:"host" description:"Docker daemon to connect to, as unix:///path/to/socket or tcp://host:port" default:"unix:///var/run/docker.sock"`
+	Labels       []string `long:"label" description:"Only read containers with this label (key or key=value). May be specified multiple times"`
+	Names        []string `long:"name" description:"Only read containers whose name contains this. May be specified multiple times"`
+	StartFrom    string   `long:"start_from" description:"Where to start reading containers already running when honeytail starts. Values: oldest, newest. Containers started later are always read from the beginning" default:"newest"`
+	PollInterval int      `long:"poll_interval" description:"Seconds between checks for new containers" default:"10"`
+}
+
+// container is the part of the container list we use
+type container struct {
+	ID     string
+	Names  []string
+	Image  string
+	Labels map[string]string
+}
+
+// client makes Docker Engine API calls
+type client struct {
+	http    *http.Client
+	baseURL string
+}
+
+func newClient(host string) (*client, error) {
+	switch {
+	case strings.HasPrefix(host, "unix://"):
+		socket := strings.TrimPrefix(host, "unix://")
+		return &client{
+			http: &http.Client{Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			}},
+			// the host is ignored when dialing the socket
+			baseURL: "http://docker",
+		}, nil
+	case strings.HasPrefix(host, "tcp://"):
+		return &client{
+			http:    &http.Client{},
+			baseURL: "http://" + strings.TrimPrefix(host, "tcp://"),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown docker host %s; use unix:// or tcp://", host)
+}
+
+func (c *client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("docker API %s returned %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (c *client) getJSON(ctx context.Context, path string, query url.Values, out interface{}) error {
+	resp, err := c.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// GetEntries starts watching for containers matching the filters. It sends
+// the log stream of each one down the returned channel as it's found. When
+// ctx is done the log streams are closed, and then the returned channel.
+func GetEntries(ctx context.Context, options Options) (chan tail.FileEntries, error) {
+	if options.StartFrom != "oldest" && options.StartFrom != "newest" {
+		return nil, fmt.Errorf("unknown option to --docker.start_from: %s", options.StartFrom)
+	}
+	c, err := newClient(options.Host)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		ctx:     ctx,
+		client:  c,
+		options: options,
+		reading: make(map[string]bool),
+		stopped: make(map[string]time.Time),
+		streams: make(chan tail.FileEntries),
+	}
+	// make sure we can talk to the daemon before we claim to be reading it
+	containers, err := w.list()
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"host":       options.Host,
+		"containers": len(containers),
+	}).Info("reading docker container logs")
+	go func() {
+		defer close(w.streams)
+		// start is only called from here, so no more readers are added once
+		// this returns
+		defer w.readers.Wait()
+		w.start(containers, options.StartFrom == "newest")
+		ticker := time.NewTicker(time.Duration(options.PollInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			containers, err := w.list()
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.WithFields(logrus.Fields{"err": err}).Warn("failed to list docker containers")
+				}
+				continue
+			}
+			w.start(containers, false)
+		}
+	}()
+	return w.streams, nil
+}
+
+// watcher tracks which containers we're reading
+type watcher struct {
+	ctx     context.Context
+	client  *client
+	options Options
+	streams chan tail.FileEntries
+	// readers waits for the containers' log streams to close
+	readers sync.WaitGroup
+
+	lock    sync.Mutex
+	reading map[string]bool
+	// stopped remembers when we stopped reading a container, so that if it
+	// starts again we don't reread what we've already sent
+	stopped map[string]time.Time
+}
+
+func (w *watcher) list() ([]container, error) {
+	filters := map[string][]string{}
+	if len(w.options.Labels) > 0 {
+		filters["label"] = w.options.Labels
+	}
+	if len(w.options.Names) > 0 {
+		filters["name"] = w.options.Names
+	}
+	query := url.Values{}
+	if len(filters) > 0 {
+		encoded, _ := json.Marshal(filters)
+		query.Set("filters", string(encoded))
+	}
+	var containers []container
+	err := w.client.getJSON(w.ctx, "/containers/json", query, &containers)
+	return containers, err
+}
+
+// start begins reading any containers we aren't already reading
+func (w *watcher) start(containers []container, fromEnd bool) {
+	for _, ctr := range containers {
+		w.lock.Lock()
+		if w.reading[ctr.ID] {
+			w.lock.Unlock()
+			continue
+		}
+		w.reading[ctr.ID] = true
+		since, restarted := w.stopped[ctr.ID]
+		w.lock.Unlock()
+
+		query := url.Values{}
+		query.Set("follow", "1")
+		query.Set("stdout", "1")
+		query.Set("stderr", "1")
+		switch {
+		case restarted:
+			query.Set("since", fmt.Sprintf("%d", since.Unix()))
+		case fromEnd:
+			query.Set("tail", "0")
+		}
+		lines, err := w.read(ctr, query)
+		if err != nil {
+			if w.ctx.Err() != nil {
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"container": ctr.ID,
+				"err":       err,
+			}).Warn("failed to read docker container logs")
+			w.lock.Lock()
+			delete(w.reading, ctr.ID)
+			w.lock.Unlock()
+			continue
+		}
+		select {
+		case w.streams <- tail.FileEntries{
+			Path:   "docker://" + containerName(ctr),
+			Lines:  lines,
+			Fields: containerFields(ctr),
+		}:
+		case <-w.ctx.Done():
+			// the stream's reader stops on its own
+			return
+		}
+	}
+}
+
+// read streams the logs of a container, one line at a time
+func (w *watcher) read(ctr container, query url.Values) (chan string, error) {
+	var inspect struct {
+		Config struct {
+			Tty bool
+		}
+	}
+	if err := w.client.getJSON(w.ctx, "/containers/"+ctr.ID+"/json", nil, &inspect); err != nil {
+		return nil, err
+	}
+	resp, err := w.client.get(w.ctx, "/containers/"+ctr.ID+"/logs", query)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader = resp.Body
+	// without a TTY, stdout and stderr are multiplexed into one stream
+	if !inspect.Config.Tty {
+		body = &demuxReader{r: bufio.NewReader(resp.Body)}
+	}
+	lines := make(chan string)
+	w.readers.Add(1)
+	go func() {
+		defer w.readers.Done()
+		defer close(lines)
+		// the body's reads fail once ctx is done
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			select {
+			case lines <- strings.TrimRight(scanner.Text(), "\r"):
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		if w.ctx.Err() != nil {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"container": containerName(ctr),
+		}).Info("docker container log stream ended")
+		w.lock.Lock()
+		delete(w.reading, ctr.ID)
+		w.stopped[ctr.ID] = time.Now()
+		w.lock.Unlock()
+	}()
+	return lines, nil
+}
+
+// containerFields returns the fields added to every event from a container
+func containerFields(ctr container) map[string]interface{} {
+	fields := map[string]interface{}{
+		"container_id":    ctr.ID,
+		"container_name":  containerName(ctr),
+		"container_image": ctr.Image,
+	}
+	for k, v := range ctr.Labels {
+		fields["container_label."+k] = v
+	}
+	return fields
+}
+
+func containerName(ctr container) string {
+	if len(ctr.Names) == 0 {
+		return ctr.ID
+	}
+	return strings.TrimPrefix(ctr.Names[0], "/")
+}
+
+// demuxReader strips the 8 byte frame headers Docker puts in front of each
+// chunk of stdout or stderr output
+type demuxReader struct {
+	r         *bufio.Reader
+	remaining uint32
+}
+
+func (d *demuxReader) Read(p []byte) (int, error) {
+	for d.remaining == 0 {
+		var header [8]byte
+		if _, err := io.ReadFull(d.r, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return 0, errors.New("truncated docker log frame header")
+			}
+			return 0, err
+		}
+		d.remaining = binary.BigEndian.Uint32(header[4:])
+	}
+	if uint32(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.r.Read(p)
+	d.remaining -= uint32(n)
+	return n, err
+}
@@ -0,0 +1,50 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func frame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestDemuxReader(t *testing.T) {
+	var muxed []byte
+	muxed = append(muxed, frame(1, "first li")...)
+	muxed = append(muxed, frame(2, "ne\nsecond line\n")...)
+	muxed = append(muxed, frame(1, "third")...)
+	out, err := ioutil.ReadAll(&demuxReader{r: bufio.NewReader(bytes.NewReader(muxed))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "first line\nsecond line\nthird"
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestContainerFields(t *testing.T) {
+	ctr := container{
+		ID:     "abc123",
+		Names:  []string{"/web"},
+		Image:  "nginx:1.11",
+		Labels: map[string]string{"com.docker.compose.service": "web"},
+	}
+	expected := map[string]interface{}{
+		"container_id":    "abc123",
+		"container_name":  "web",
+		"container_image": "nginx:1.11",
+		"container_label.com.docker.compose.service": "web",
+	}
+	if actual := containerFields(ctr); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
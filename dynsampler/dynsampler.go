@@ -0,0 +1,112 @@
+// Package dynsampler works out sample rates per key, so that rare keys, such
+// as errors or unusual endpoints, are kept at full fidelity while the common
+// ones are sampled heavily, with the sample rate averaging out at a goal.
+//
+// Rates are worked out from the number of events seen for each key in the
+// previous window, spread by the logarithm of each key's count: a key with
+// ten times the events gets a rate that's more than ten times higher. Keys
+// not seen in the previous window are kept.
+package dynsampler
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dynamic gives each key a sample rate, aiming for an average of its goal
+type Dynamic struct {
+	goal   uint
+	window time.Duration
+	// now is replaced in tests
+	now func() time.Time
+
+	lock        sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+	rates       map[string]uint
+}
+
+// NewDynamic returns a sampler aiming for an average sample rate of goal,
+// working out the rates from each window's counts
+func NewDynamic(goal uint, window time.Duration) *Dynamic {
+	return &Dynamic{
+		goal:   goal,
+		window: window,
+		now:    time.Now,
+		counts: make(map[string]int),
+		rates:  make(map[string]uint),
+	}
+}
+
+// SampleRate counts an event for key and returns the rate to sample it at
+func (d *Dynamic) SampleRate(key string) uint {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := d.now()
+	if d.windowStart.IsZero() {
+		d.windowStart = now
+	}
+	if now.Sub(d.windowStart) >= d.window {
+		d.rates = rates(d.counts, d.goal)
+		d.counts = make(map[string]int)
+		d.windowStart = now
+	}
+	d.counts[key]++
+	if rate, ok := d.rates[key]; ok {
+		return rate
+	}
+	return 1
+}
+
+// rates works out the rate for each key in counts, so that the average over
+// all the events is goal
+func rates(counts map[string]int, goal uint) map[string]uint {
+	rates := make(map[string]uint, len(counts))
+	if len(counts) == 0 || goal <= 1 {
+		return rates
+	}
+	keys := make([]string, 0, len(counts))
+	var sum, logSum float64
+	for key, count := range counts {
+		keys = append(keys, key)
+		sum += float64(count)
+		logSum += math.Log10(float64(count))
+	}
+	if logSum == 0 {
+		// every key was seen once, so there's nothing to spread by
+		for _, key := range keys {
+			rates[key] = goal
+		}
+		return rates
+	}
+	goalRatio := sum / float64(goal) / logSum
+	// the rarest keys first, so what they don't use of their share of the
+	// events sent goes to the more common ones
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] < counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	extra := 0.0
+	keysRemaining := len(keys)
+	for _, key := range keys {
+		count := float64(counts[key])
+		goalForKey := math.Max(1, math.Log10(count)*goalRatio)
+		extraForKey := extra / float64(keysRemaining)
+		goalForKey += extraForKey
+		extra -= extraForKey
+		keysRemaining--
+		if count <= goalForKey {
+			rates[key] = 1
+			extra += goalForKey - count
+		} else {
+			rate := math.Ceil(count / goalForKey)
+			rates[key] = uint(rate)
+			extra += goalForKey - count/rate
+		}
+	}
+	return rates
+}
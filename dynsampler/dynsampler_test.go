@@ -0,0 +1,57 @@
+package dynsampler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDynamic(t *testing.T) {
+	now := time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDynamic(10, 30*time.Second)
+	d.now = func() time.Time { return now }
+	// nothing's been seen yet, so everything's kept
+	if rate := d.SampleRate("200"); rate != 1 {
+		t.Errorf("expected a rate of 1 before the first window, got %d", rate)
+	}
+	for i := 1; i < 10000; i++ {
+		d.SampleRate("200")
+	}
+	for i := 0; i < 10; i++ {
+		d.SampleRate("500")
+	}
+	now = now.Add(30 * time.Second)
+	common := d.SampleRate("200")
+	rare := d.SampleRate("500")
+	if rare != 1 {
+		t.Errorf("expected the rare key to be kept, got a rate of %d", rare)
+	}
+	if common <= 10 {
+		t.Errorf("expected the common key to be sampled more than the goal, got a rate of %d", common)
+	}
+	if rate := d.SampleRate("404"); rate != 1 {
+		t.Errorf("expected an unseen key to be kept, got a rate of %d", rate)
+	}
+}
+
+func TestRatesAverageToGoal(t *testing.T) {
+	counts := map[string]int{}
+	total := 0
+	for i := 0; i < 20; i++ {
+		counts[fmt.Sprintf("key%d", i)] = (i + 1) * (i + 1) * 50
+		total += counts[fmt.Sprintf("key%d", i)]
+	}
+	var sent float64
+	for key, rate := range rates(counts, 20) {
+		sent += float64(counts[key]) / float64(rate)
+	}
+	// ceiling the rates means slightly fewer are sent than the goal allows
+	if avg := float64(total) / sent; avg < 18 || avg > 24 {
+		t.Errorf("expected the average rate to be close to 20, got %f", avg)
+	}
+	for key, rate := range rates(map[string]int{"a": 1, "b": 1}, 5) {
+		if rate != 5 {
+			t.Errorf("expected keys seen once to get the goal, got %d for %s", rate, key)
+		}
+	}
+}
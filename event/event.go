@@ -11,4 +11,10 @@ type Event struct {
 	// Data is a map[string]interface{} containing key/value pairs for all the
 	// metrics to submit in this event
 	Data map[string]interface{}
+	// Dataset is the dataset the event is to be sent to, if it's been routed
+	// somewhere other than the output's own
+	Dataset string
+	// Drop is set when the event is to be dropped rather than sent, eg by a
+	// --script, so it can be counted as done with once it comes to sending
+	Drop bool
 }
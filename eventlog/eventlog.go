@@ -0,0 +1,155 @@
+// Package eventlog implements reading events from a Windows Event Log
+// channel.
+//
+// eventlog subscribes to a channel (eg Application, System or
+// Microsoft-Windows-IIS-Logging/Logs) and provides a channel on which each
+// event will be sent as a line of JSON, the same way the tail package does for
+// lines of a file. The lines are meant for the json parser, with
+// --json.timefield=timestamp.
+package eventlog
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const scheme = "eventlog://"
+
+type Options struct {
+	Levels    []string `long:"level" description:"Only read events of this level. Values: critical, error, warning, information, verbose. May be specified multiple times. Defaults to all levels"`
+	EventIDs  []int    `long:"event_id" description:"Only read events with this event ID. May be specified multiple times"`
+	Query     string   `long:"query" description:"An XPath query selecting the events to read, used instead of --eventlog.level and --eventlog.event_id"`
+	StartFrom string   `long:"start_from" description:"Where to start reading the channel. Values: oldest, newest" default:"newest"`
+}
+
+// IsEventLogURL returns true if path names an event log channel rather than
+// a file
+func IsEventLogURL(path string) bool {
+	return strings.HasPrefix(path, scheme)
+}
+
+// levels maps the names of event levels to their numbers. Events logged
+// without a level (LogAlways) are treated as information.
+var levels = map[string][]int{
+	"critical":    {1},
+	"error":       {2},
+	"warning":     {3},
+	"information": {0, 4},
+	"verbose":     {5},
+}
+
+var levelNames = map[int]string{
+	0: "information",
+	1: "critical",
+	2: "error",
+	3: "warning",
+	4: "information",
+	5: "verbose",
+}
+
+// buildQuery returns the XPath query selecting the events described by
+// options
+func buildQuery(options Options) (string, error) {
+	if options.Query != "" {
+		return options.Query, nil
+	}
+	var conditions []string
+	var levelTerms []string
+	for _, name := range options.Levels {
+		nums, ok := levels[strings.ToLower(name)]
+		if !ok {
+			return "", fmt.Errorf("unknown option to --eventlog.level: %s", name)
+		}
+		for _, num := range nums {
+			levelTerms = append(levelTerms, fmt.Sprintf("Level=%d", num))
+		}
+	}
+	if len(levelTerms) > 0 {
+		conditions = append(conditions, "("+strings.Join(levelTerms, " or ")+")")
+	}
+	var idTerms []string
+	for _, id := range options.EventIDs {
+		idTerms = append(idTerms, fmt.Sprintf("EventID=%d", id))
+	}
+	if len(idTerms) > 0 {
+		conditions = append(conditions, "("+strings.Join(idTerms, " or ")+")")
+	}
+	if len(conditions) == 0 {
+		return "*", nil
+	}
+	return "*[System[" + strings.Join(conditions, " and ") + "]]", nil
+}
+
+// eventXML is the rendered form of an event
+type eventXML struct {
+	System struct {
+		Provider struct {
+			Name string `xml:"Name,attr"`
+		}
+		EventID     int
+		Level       int
+		Task        int
+		Keywords    string
+		TimeCreated struct {
+			SystemTime string `xml:"SystemTime,attr"`
+		}
+		EventRecordID uint64
+		Execution     struct {
+			ProcessID int `xml:"ProcessID,attr"`
+			ThreadID  int `xml:"ThreadID,attr"`
+		}
+		Channel  string
+		Computer string
+		Security struct {
+			UserID string `xml:"UserID,attr"`
+		}
+	}
+	EventData struct {
+		Data []struct {
+			Name  string `xml:"Name,attr"`
+			Value string `xml:",chardata"`
+		}
+	}
+}
+
+// eventToJSON turns the XML rendering of an event and its formatted message
+// (which may be empty if the provider's message file couldn't be found) into
+// a line of JSON
+func eventToJSON(rendered []byte, message string) (string, error) {
+	var ev eventXML
+	if err := xml.Unmarshal(rendered, &ev); err != nil {
+		return "", err
+	}
+	fields := map[string]interface{}{
+		"provider":   ev.System.Provider.Name,
+		"event_id":   ev.System.EventID,
+		"level":      ev.System.Level,
+		"level_name": levelNames[ev.System.Level],
+		"task":       ev.System.Task,
+		"keywords":   ev.System.Keywords,
+		"timestamp":  ev.System.TimeCreated.SystemTime,
+		"record_id":  ev.System.EventRecordID,
+		"process_id": ev.System.Execution.ProcessID,
+		"thread_id":  ev.System.Execution.ThreadID,
+		"channel":    ev.System.Channel,
+		"computer":   ev.System.Computer,
+	}
+	if ev.System.Security.UserID != "" {
+		fields["user_id"] = ev.System.Security.UserID
+	}
+	if message != "" {
+		fields["message"] = strings.TrimSpace(message)
+	}
+	for i, data := range ev.EventData.Data {
+		name := data.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		fields["event_data."+name] = data.Value
+	}
+	out, err := json.Marshal(fields)
+	return string(out), err
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package eventlog
+
+import (
+	"context"
+	"errors"
+)
+
+// GetEntries is only available on Windows
+func GetEntries(ctx context.Context, url string, options Options) (chan string, error) {
+	return nil, errors.New("the event log can only be read on Windows")
+}
@@ -0,0 +1,72 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestBuildQuery(t *testing.T) {
+	tsts := []struct {
+		options  Options
+		expected string
+	}{
+		{Options{}, "*"},
+		{Options{Levels: []string{"Error", "critical"}}, "*[System[(Level=2 or Level=1)]]"},
+		{Options{Levels: []string{"information"}, EventIDs: []int{1000, 1001}},
+			"*[System[(Level=0 or Level=4) and (EventID=1000 or EventID=1001)]]"},
+		{Options{Levels: []string{"error"}, Query: "*[System[Provider[@Name='W3SVC']]]"},
+			"*[System[Provider[@Name='W3SVC']]]"},
+	}
+	for _, tt := range tsts {
+		query, err := buildQuery(tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != tt.expected {
+			t.Errorf("options %+v: expected %s, got %s", tt.options, tt.expected, query)
+		}
+	}
+	if _, err := buildQuery(Options{Levels: []string{"fatal"}}); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
+
+const renderedEvent = `<Event xmlns='http://schemas.microsoft.com/win/2004/08/events/event'>
+<System><Provider Name='.NET Runtime'/><EventID Qualifiers='0'>1026</EventID><Level>2</Level>
+<Task>0</Task><Keywords>0x80000000000000</Keywords><TimeCreated SystemTime='2017-03-02T22:14:10.123456700Z'/>
+<EventRecordID>48213</EventRecordID><Channel>Application</Channel><Computer>web-01</Computer>
+<Execution ProcessID='1280' ThreadID='0'/><Security/></System>
+<EventData><Data>Application: Orders.exe</Data><Data Name='Exception'>System.NullReferenceException</Data></EventData>
+</Event>`
+
+func TestEventToJSON(t *testing.T) {
+	line, err := eventToJSON([]byte(renderedEvent), "Application: Orders.exe\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"provider":             ".NET Runtime",
+		"event_id":             float64(1026),
+		"level":                float64(2),
+		"level_name":           "error",
+		"task":                 float64(0),
+		"keywords":             "0x80000000000000",
+		"timestamp":            "2017-03-02T22:14:10.123456700Z",
+		"record_id":            float64(48213),
+		"process_id":           float64(1280),
+		"thread_id":            float64(0),
+		"channel":              "Application",
+		"computer":             "web-01",
+		"message":              "Application: Orders.exe",
+		"event_data.0":         "Application: Orders.exe",
+		"event_data.Exception": "System.NullReferenceException",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
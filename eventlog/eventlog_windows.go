@@ -0,0 +1,249 @@
+//go:build windows
+// +build windows
+
+package eventlog
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/windows"
+)
+
+var (
+	wevtapi                  = windows.NewLazySystemDLL("wevtapi.dll")
+	procEvtSubscribe         = wevtapi.NewProc("EvtSubscribe")
+	procEvtNext              = wevtapi.NewProc("EvtNext")
+	procEvtRender            = wevtapi.NewProc("EvtRender")
+	procEvtFormatMessage     = wevtapi.NewProc("EvtFormatMessage")
+	procEvtOpenPublisherMeta = wevtapi.NewProc("EvtOpenPublisherMetadata")
+	procEvtClose             = wevtapi.NewProc("EvtClose")
+)
+
+// constants from winevt.h
+const (
+	evtSubscribeToFutureEvents      = 1
+	evtSubscribeStartAtOldestRecord = 2
+	evtRenderEventXML               = 1
+	evtFormatMessageEvent           = 1
+
+	errorNoMoreItems        = syscall.Errno(259)
+	errorInsufficientBuffer = syscall.Errno(122)
+
+	// how many events to fetch at a time
+	batchSize = 64
+)
+
+type evtHandle uintptr
+
+// GetEntries subscribes to the channel named in url (eg
+// eventlog://Application). It sends one event at a time, as JSON, down the
+// returned channel, until ctx is done, when it unsubscribes and closes the
+// channel.
+func GetEntries(ctx context.Context, url string, options Options) (chan string, error) {
+	channel := strings.TrimPrefix(url, scheme)
+	if channel == "" {
+		return nil, fmt.Errorf("eventlog url must name a channel, eg eventlog://Application")
+	}
+	query, err := buildQuery(options)
+	if err != nil {
+		return nil, err
+	}
+	var flags uintptr
+	switch options.StartFrom {
+	case "oldest":
+		flags = evtSubscribeStartAtOldestRecord
+	case "newest":
+		flags = evtSubscribeToFutureEvents
+	default:
+		return nil, fmt.Errorf("unknown option to --eventlog.start_from: %s", options.StartFrom)
+	}
+	signal, err := windows.CreateEvent(nil, 1, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	channelPtr, err := syscall.UTF16PtrFromString(channel)
+	if err != nil {
+		return nil, err
+	}
+	queryPtr, err := syscall.UTF16PtrFromString(query)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := procEvtSubscribe.Call(0, uintptr(signal),
+		uintptr(unsafe.Pointer(channelPtr)), uintptr(unsafe.Pointer(queryPtr)),
+		0, 0, 0, flags)
+	if r == 0 {
+		windows.CloseHandle(signal)
+		return nil, fmt.Errorf("failed to subscribe to event log channel %s: %s", channel, err)
+	}
+	s := &subscription{
+		handle:     evtHandle(r),
+		signal:     signal,
+		publishers: make(map[string]evtHandle),
+	}
+	logrus.WithFields(logrus.Fields{
+		"channel": channel,
+		"query":   query,
+	}).Info("reading from the windows event log")
+	lines := make(chan string)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// wake read up so it sees ctx is done
+			windows.SetEvent(signal)
+		case <-stopped:
+		}
+	}()
+	go func() {
+		s.read(ctx, channel, lines)
+		close(stopped)
+		s.close()
+		close(lines)
+	}()
+	return lines, nil
+}
+
+type subscription struct {
+	handle evtHandle
+	signal windows.Handle
+	// publishers caches the metadata handles used to format messages
+	publishers map[string]evtHandle
+}
+
+// read waits for the subscription to signal that events are ready, then sends
+// them all down lines, until ctx is done
+func (s *subscription) read(ctx context.Context, channel string, lines chan string) {
+	events := make([]evtHandle, batchSize)
+	for {
+		if _, err := windows.WaitForSingleObject(s.signal, windows.INFINITE); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("failed waiting for windows events")
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// reset before draining so that events arriving meanwhile signal again
+		windows.ResetEvent(s.signal)
+		for {
+			var returned uint32
+			r, _, err := procEvtNext.Call(uintptr(s.handle), batchSize,
+				uintptr(unsafe.Pointer(&events[0])), windows.INFINITE, 0,
+				uintptr(unsafe.Pointer(&returned)))
+			if r == 0 {
+				if err != errorNoMoreItems {
+					logrus.WithFields(logrus.Fields{
+						"channel": channel,
+						"err":     err,
+					}).Warn("failed to fetch windows events")
+				}
+				break
+			}
+			for i, ev := range events[:returned] {
+				if line, err := s.render(ev); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"channel": channel,
+						"err":     err,
+					}).Debug("failed to render windows event")
+				} else {
+					select {
+					case lines <- line:
+					case <-ctx.Done():
+						for _, rest := range events[i:returned] {
+							evtClose(rest)
+						}
+						return
+					}
+				}
+				evtClose(ev)
+			}
+		}
+	}
+}
+
+// close unsubscribes and lets go of the publishers' metadata
+func (s *subscription) close() {
+	for _, meta := range s.publishers {
+		if meta != 0 {
+			evtClose(meta)
+		}
+	}
+	evtClose(s.handle)
+	windows.CloseHandle(s.signal)
+}
+
+// render turns an event into a line of JSON
+func (s *subscription) render(ev evtHandle) (string, error) {
+	buf := make([]uint16, 4096)
+	for {
+		var used, props uint32
+		r, _, err := procEvtRender.Call(0, uintptr(ev), evtRenderEventXML,
+			uintptr(len(buf)*2), uintptr(unsafe.Pointer(&buf[0])),
+			uintptr(unsafe.Pointer(&used)), uintptr(unsafe.Pointer(&props)))
+		if r != 0 {
+			break
+		}
+		if err != errorInsufficientBuffer {
+			return "", err
+		}
+		// used is in bytes
+		buf = make([]uint16, used/2+1)
+	}
+	rendered := []byte(windows.UTF16ToString(buf))
+	var provider struct {
+		System struct {
+			Provider struct {
+				Name string `xml:"Name,attr"`
+			}
+		}
+	}
+	// the message lives in the provider's message file, so it needs the
+	// provider's name from the event first
+	if err := xml.Unmarshal(rendered, &provider); err != nil {
+		return "", err
+	}
+	return eventToJSON(rendered, s.message(ev, provider.System.Provider.Name))
+}
+
+// message returns the event's message, or "" if it can't be formatted
+func (s *subscription) message(ev evtHandle, provider string) string {
+	meta, ok := s.publishers[provider]
+	if !ok {
+		name, err := syscall.UTF16PtrFromString(provider)
+		if err != nil {
+			return ""
+		}
+		r, _, _ := procEvtOpenPublisherMeta.Call(0, uintptr(unsafe.Pointer(name)), 0, 0, 0)
+		// remember failures too, so we don't try again for every event
+		meta = evtHandle(r)
+		s.publishers[provider] = meta
+	}
+	if meta == 0 {
+		return ""
+	}
+	buf := make([]uint16, 1024)
+	for {
+		var used uint32
+		r, _, err := procEvtFormatMessage.Call(uintptr(meta), uintptr(ev), 0, 0, 0,
+			evtFormatMessageEvent, uintptr(len(buf)), uintptr(unsafe.Pointer(&buf[0])),
+			uintptr(unsafe.Pointer(&used)))
+		if r != 0 {
+			return windows.UTF16ToString(buf)
+		}
+		if err != errorInsufficientBuffer {
+			return ""
+		}
+		// used is in characters
+		buf = make([]uint16, used)
+	}
+}
+
+func evtClose(h evtHandle) {
+	procEvtClose.Call(uintptr(h))
+}
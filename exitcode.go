@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/leash"
+)
+
+// the codes honeytail exits with once it's read everything it was given, as
+// in a backfill, so whatever runs it can tell how it went. Fatal errors exit
+// with 1, as they always have.
+const (
+	exitCompleted    = 0
+	exitParseErrors  = 2
+	exitSendFailures = 3
+)
+
+// exitCode returns the code to exit with after a run that went as result and
+// err say: exitSendFailures if any events weren't sent, exitParseErrors if
+// more of the lines than --fail_on_error_rate allows didn't parse, and
+// exitCompleted otherwise. Any other error is fatal.
+func exitCode(options leash.Config, result leash.Result, err error) int {
+	fields := logrus.Fields{
+		"lines":         result.Lines,
+		"parse_errors":  result.ParseErrors,
+		"send_failures": result.SendFailures,
+	}
+	switch err {
+	case nil:
+		logrus.WithFields(fields).Info("Finished")
+		return exitCompleted
+	case leash.ErrSendFailures:
+		logrus.WithFields(fields).Error("Finished, but some events weren't sent")
+		return exitSendFailures
+	case leash.ErrParseErrors:
+		logrus.WithFields(fields).Errorf("Finished, but more than %s of the lines failed to parse", options.FailOnErrorRate)
+		return exitParseErrors
+	}
+	logrus.Fatal(err)
+	return 1
+}
@@ -0,0 +1,500 @@
+// Package expr evaluates small expressions over an event's fields, for
+// computing new fields from the ones a parser found, eg total_ms - upstream_ms
+// or status >= 500 ? "error" : "ok".
+//
+// Expressions have numbers, "strings", true, false and null, field names
+// (which may have dots, eg request.method), the arithmetic operators + - * /
+// and %, where + joins strings if either side is one, comparisons with == !=
+// < <= > and >=, && || and !, parentheses and cond ? a : b. A field the event
+// doesn't have is null, and arithmetic with null is null.
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a parsed expression
+type Expr struct {
+	src  string
+	root node
+}
+
+// node is a part of an expression that can be evaluated
+type node interface {
+	eval(fields map[string]interface{}) (interface{}, error)
+}
+
+// Parse parses src into an expression
+func Parse(src string) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression over fields. The result is a float64,
+// string, bool or nil.
+func (e *Expr) Eval(fields map[string]interface{}) (interface{}, error) {
+	return e.root.eval(fields)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators are the operator tokens, longest first so that <= isn't taken
+// for <
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")"}
+
+// lex splits src into tokens
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' ||
+				src[i] == 'e' || src[i] == 'E' || (src[i] == '-' || src[i] == '+') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, src[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			for i < len(src) && rune(src[i]) != c {
+				if src[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", start)
+			}
+			i++
+			text := src[start:i]
+			if c == '\'' {
+				// unquote single quoted strings as if they were double quoted
+				text = `"` + strings.Replace(strings.Replace(text[1:len(text)-1], `\'`, `'`, -1), `"`, `\"`, -1) + `"`
+			}
+			s, err := strconv.Unquote(text)
+			if err != nil {
+				return nil, fmt.Errorf("bad string at %d: %s", start, err)
+			}
+			tokens = append(tokens, token{tokString, s, start})
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '.' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, src[start:i], start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{tokOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{tokEOF, "end of expression", len(src)}), nil
+}
+
+// parser is a recursive descent parser over tokens, with a method for each
+// level of precedence, loosest first
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it's one of ops
+func (p *parser) accept(ops ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) ternary() (node, error) {
+	cond, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("?"); !ok {
+		return cond, nil
+	}
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept(":"); !ok {
+		tok := p.peek()
+		return nil, fmt.Errorf("expected : at %d, found %q", tok.pos, tok.text)
+	}
+	otherwise, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return &ternaryNode{cond, then, otherwise}, nil
+}
+
+// precedence are the binary operators, loosest binding first
+var precedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) binary(level int) (node, error) {
+	if level == len(precedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept(precedence[level]...)
+		if !ok {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if op, ok := p.accept("-", "!"); ok {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op, operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %d", tok.text, tok.pos)
+		}
+		return literalNode{f}, nil
+	case tokString:
+		return literalNode{tok.text}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		}
+		return fieldNode(tok.text), nil
+	case tokOp:
+		if tok.text == "(" {
+			inner, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := p.accept(")"); !ok {
+				tok := p.peek()
+				return nil, fmt.Errorf("expected ) at %d, found %q", tok.pos, tok.text)
+			}
+			return inner, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+}
+
+type literalNode struct {
+	val interface{}
+}
+
+func (n literalNode) eval(map[string]interface{}) (interface{}, error) {
+	return n.val, nil
+}
+
+// fieldNode is the value of a field, normalized to a float64, string, bool or
+// nil
+type fieldNode string
+
+func (n fieldNode) eval(fields map[string]interface{}) (interface{}, error) {
+	switch v := fields[string(n)].(type) {
+	case nil, string, bool, float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	default:
+		return fmt.Sprintf("%v", v), nil
+	}
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) eval(fields map[string]interface{}) (interface{}, error) {
+	v, err := n.operand.eval(fields)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !truthy(v), nil
+	}
+	f, ok := number(v)
+	if !ok {
+		return nil, fmt.Errorf("can't negate %q", v)
+	}
+	return -f, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) eval(fields map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	// && and || only evaluate the right when they need to
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(fields)
+		return truthy(right), err
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(fields)
+		return truthy(right), err
+	}
+	right, err := n.right.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(n.op, left, right), nil
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+	if n.op == "+" {
+		_, leftString := left.(string)
+		_, rightString := right.(string)
+		if leftString || rightString {
+			return format(left) + format(right), nil
+		}
+	}
+	l, lok := number(left)
+	r, rok := number(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("can't do %s %s %s", format(left), n.op, format(right))
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return l / r, nil
+	default:
+		if r == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+type ternaryNode struct {
+	cond, then, otherwise node
+}
+
+func (n *ternaryNode) eval(fields map[string]interface{}) (interface{}, error) {
+	cond, err := n.cond.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(cond) {
+		return n.then.eval(fields)
+	}
+	return n.otherwise.eval(fields)
+}
+
+// truthy returns whether v counts as true: nil, false, 0 and "" don't
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+// number returns v as a float64, parsing strings that are numbers, as
+// parsers that match regexes find them
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// format returns v as it's joined onto a string
+func format(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// equal compares as numbers if both sides are numbers, or numeric strings
+// against numbers, and otherwise as they are
+func equal(left, right interface{}) bool {
+	if left == nil || right == nil {
+		return left == right
+	}
+	_, leftNumber := left.(float64)
+	_, rightNumber := right.(float64)
+	if leftNumber || rightNumber {
+		l, lok := number(left)
+		r, rok := number(right)
+		return lok && rok && l == r
+	}
+	return left == right
+}
+
+// compare orders numbers, or numeric strings, as numbers and other strings
+// alphabetically. Anything else, or null, compares false.
+func compare(op string, left, right interface{}) bool {
+	var c int
+	l, lok := number(left)
+	r, rok := number(right)
+	if lok && rok {
+		switch {
+		case l < r:
+			c = -1
+		case l > r:
+			c = 1
+		}
+	} else {
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if !lok || !rok {
+			return false
+		}
+		c = strings.Compare(ls, rs)
+	}
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
@@ -0,0 +1,80 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	fields := map[string]interface{}{
+		"total_ms":       float64(120),
+		"upstream_ms":    int64(100),
+		"status":         float64(503),
+		"code":           "404",
+		"method":         "GET",
+		"request.path":   "/orders",
+		"cached":         true,
+		"empty":          "",
+		"request_bytes":  "2048",
+		"response_bytes": 1024,
+	}
+	testCases := []struct {
+		src      string
+		expected interface{}
+	}{
+		{`total_ms - upstream_ms`, float64(20)},
+		{`1 + 2 * 3`, float64(7)},
+		{`(1 + 2) * 3`, float64(9)},
+		{`-total_ms / 4 % 7`, float64(-2)},
+		{`request_bytes + response_bytes`, "20481024"},
+		{`request_bytes * 1 + response_bytes`, float64(3072)},
+		{`method + " " + request.path`, "GET /orders"},
+		{`'it\'s' == "it's"`, true},
+		{`'say "hi"'`, `say "hi"`},
+		{`status >= 500 ? "error" : "ok"`, "error"},
+		{`code >= 500 ? "error" : code >= 400 ? "client" : "ok"`, "client"},
+		{`code == 404 && method == "GET"`, true},
+		{`missing == null`, true},
+		{`missing + 1`, nil},
+		{`!cached || empty`, false},
+		{`empty ? 1 : 2`, float64(2)},
+		{`method < "POST"`, true},
+		{`1.5e3`, float64(1500)},
+	}
+	for _, tc := range testCases {
+		e, err := Parse(tc.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", tc.src, err)
+			continue
+		}
+		actual, err := e.Eval(fields)
+		if err != nil {
+			t.Errorf("Eval(%q): %s", tc.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("Eval(%q) = %#v, expected %#v", tc.src, actual, tc.expected)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	for _, src := range []string{`1 / 0`, `method * 2`, `-method`} {
+		e, err := Parse(src)
+		if err != nil {
+			t.Errorf("Parse(%q): %s", src, err)
+			continue
+		}
+		if _, err := e.Eval(map[string]interface{}{"method": "GET"}); err == nil {
+			t.Errorf("expected an error evaluating %q", src)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, src := range []string{``, `1 +`, `(1`, `a ? b`, `"open`, `a # b`, `1 2`} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("expected an error parsing %q", src)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+// Package gcp makes authenticated calls to Google Cloud REST APIs, such as
+// Pub/Sub.
+//
+// It implements just enough of what the Google client libraries do (OAuth2
+// access tokens from a service account key, gcloud's application default
+// credentials or the metadata server) for honeytail's inputs.
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	scope            = "https://www.googleapis.com/auth/cloud-platform"
+	defaultTokenURI  = "https://oauth2.googleapis.com/token"
+	metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	// tokens are refreshed this long before they expire
+	expiryMargin = time.Minute
+)
+
+type Options struct {
+	Credentials string `long:"credentials" description:"Path to a service account key file. Defaults to $GOOGLE_APPLICATION_CREDENTIALS, then gcloud's application default credentials, then the metadata server when running on GCP"`
+}
+
+// credentialsFile is the JSON in a service account key or gcloud's
+// application_default_credentials.json
+type credentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// APIError is an error response from a Google API
+type APIError struct {
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("gcp: %s (%d): %s", e.Status, e.StatusCode, e.Message)
+}
+
+// Client calls Google APIs with an access token it keeps fresh
+type Client struct {
+	HTTPClient *http.Client
+
+	creds credentialsFile
+	// metadata is true when tokens come from the metadata server
+	metadata bool
+	// metadataURL overrides metadataTokenURL in tests
+	metadataURL string
+	now         func() time.Time
+
+	lock    sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewClient returns a client using the first credentials it finds, in the
+// same order as the Google client libraries
+func NewClient(options Options) (*Client, error) {
+	c := &Client{
+		HTTPClient:  &http.Client{Timeout: time.Minute},
+		metadataURL: metadataTokenURL,
+		now:         time.Now,
+	}
+	path := options.Credentials
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		if wellKnown := wellKnownCredentials(); wellKnown != "" {
+			if _, err := os.Stat(wellKnown); err == nil {
+				path = wellKnown
+			}
+		}
+	}
+	if path == "" {
+		c.metadata = true
+		return c, nil
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, &c.creds); err != nil {
+		return nil, fmt.Errorf("failed to parse GCP credentials in %s: %s", path, err)
+	}
+	switch c.creds.Type {
+	case "service_account":
+		if _, err := parseKey(c.creds.PrivateKey); err != nil {
+			return nil, fmt.Errorf("bad private key in %s: %s", path, err)
+		}
+	case "authorized_user":
+	default:
+		return nil, fmt.Errorf("unsupported GCP credentials type %q in %s", c.creds.Type, path)
+	}
+	if c.creds.TokenURI == "" {
+		c.creds.TokenURI = defaultTokenURI
+	}
+	return c, nil
+}
+
+// wellKnownCredentials is where `gcloud auth application-default login`
+// leaves credentials
+func wellKnownCredentials() string {
+	if dir := os.Getenv("APPDATA"); dir != "" {
+		return filepath.Join(dir, "gcloud", "application_default_credentials.json")
+	}
+	if home := os.Getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	}
+	return ""
+}
+
+// Call sends in (if not nil) as JSON to url with the given method and
+// decodes the response into out (if not nil)
+func (c *Client) Call(method, url string, in, out interface{}) error {
+	return c.CallContext(context.Background(), method, url, in, out)
+}
+
+// CallContext is Call, giving up when ctx is done
+func (c *Client) CallContext(ctx context.Context, method, url string, in, out interface{}) error {
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if in != nil {
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errBody struct {
+			Error struct {
+				Message string `json:"message"`
+				Status  string `json:"status"`
+			} `json:"error"`
+		}
+		json.Unmarshal(respBody, &errBody)
+		return &APIError{
+			StatusCode: resp.StatusCode,
+			Status:     errBody.Error.Status,
+			Message:    errBody.Error.Message,
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
+
+// accessToken returns the current token, fetching a new one if it's about
+// to expire
+func (c *Client) accessToken() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.token != "" && c.now().Add(expiryMargin).Before(c.expires) {
+		return c.token, nil
+	}
+	var tok tokenResponse
+	var err error
+	switch {
+	case c.metadata:
+		tok, err = c.metadataToken()
+	case c.creds.Type == "authorized_user":
+		tok, err = c.exchange(url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.creds.ClientID},
+			"client_secret": {c.creds.ClientSecret},
+			"refresh_token": {c.creds.RefreshToken},
+		})
+	default:
+		var assertion string
+		if assertion, err = c.signedJWT(); err == nil {
+			tok, err = c.exchange(url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get a GCP access token: %s", err)
+	}
+	c.token = tok.AccessToken
+	c.expires = c.now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// exchange posts form to the token URI
+func (c *Client) exchange(form url.Values) (tokenResponse, error) {
+	resp, err := c.HTTPClient.PostForm(c.creds.TokenURI, form)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	defer resp.Body.Close()
+	return decodeToken(resp)
+}
+
+func (c *Client) metadataToken() (tokenResponse, error) {
+	var tok tokenResponse
+	req, err := http.NewRequest("GET", c.metadataURL, nil)
+	if err != nil {
+		return tok, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return tok, fmt.Errorf("no credentials configured and the metadata server is unreachable: %s", err)
+	}
+	defer resp.Body.Close()
+	return decodeToken(resp)
+}
+
+func decodeToken(resp *http.Response) (tokenResponse, error) {
+	var tok tokenResponse
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tok, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tok, fmt.Errorf("token request failed (%d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return tok, err
+	}
+	if tok.AccessToken == "" {
+		return tok, errors.New("token response had no access_token")
+	}
+	return tok, nil
+}
+
+// signedJWT returns the assertion a service account trades for an access
+// token
+func (c *Client) signedJWT() (string, error) {
+	key, err := parseKey(c.creds.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	now := c.now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   c.creds.ClientEmail,
+		"scope": scope,
+		"aud":   c.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parseKey reads the PEM encoded key in a service account key file
+func parseKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return key, nil
+}
@@ -0,0 +1,122 @@
+package gcp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchanges := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			exchanges++
+			parts := strings.Split(r.FormValue("assertion"), ".")
+			if len(parts) != 3 {
+				t.Fatalf("expected a JWT, got %q", r.FormValue("assertion"))
+			}
+			sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig); err != nil {
+				t.Errorf("bad JWT signature: %s", err)
+			}
+			claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			var claims map[string]interface{}
+			json.Unmarshal(claimsJSON, &claims)
+			if claims["iss"] != "honeytail@p.iam.gserviceaccount.com" || claims["scope"] != scope {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+			w.Write([]byte(`{"access_token":"tok","expires_in":3600}`))
+		case "/api":
+			if auth := r.Header.Get("Authorization"); auth != "Bearer tok" {
+				t.Errorf("unexpected Authorization %q", auth)
+			}
+			w.WriteHeader(404)
+			w.Write([]byte(`{"error":{"code":404,"message":"Resource not found","status":"NOT_FOUND"}}`))
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "gcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	creds, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "honeytail@p.iam.gserviceaccount.com",
+		"private_key":  string(keyPEM),
+		"token_uri":    server.URL + "/token",
+	})
+	path := filepath.Join(dir, "key.json")
+	if err := ioutil.WriteFile(path, creds, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(Options{Credentials: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err = c.Call("GET", server.URL+"/api", nil, nil)
+		apiErr, ok := err.(*APIError)
+		if !ok {
+			t.Fatalf("expected an APIError, got %v", err)
+		}
+		if apiErr.Status != "NOT_FOUND" || apiErr.StatusCode != 404 {
+			t.Errorf("unexpected error %+v", apiErr)
+		}
+	}
+	if exchanges != 1 {
+		t.Errorf("expected the token to be reused, got %d exchanges", exchanges)
+	}
+	// a token about to expire is replaced
+	c.now = func() time.Time { return time.Now().Add(time.Hour) }
+	c.Call("GET", server.URL+"/api", nil, nil)
+	if exchanges != 2 {
+		t.Errorf("expected an expiring token to be refreshed, got %d exchanges", exchanges)
+	}
+}
+
+func TestMetadataToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(403)
+			return
+		}
+		w.Write([]byte(`{"access_token":"meta","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+	c := &Client{
+		HTTPClient:  http.DefaultClient,
+		metadata:    true,
+		metadataURL: server.URL,
+		now:         time.Now,
+	}
+	token, err := c.accessToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "meta" {
+		t.Errorf("expected the metadata server's token, got %q", token)
+	}
+}
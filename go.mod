@@ -0,0 +1,34 @@
+module github.com/honeycombio/honeytail
+
+go 1.22
+
+require (
+	github.com/Sirupsen/logrus v0.10.0
+	github.com/honeycombio/gonx v1.3.1-0.20171118020637-f9b2468e9ef8
+	github.com/honeycombio/libhoney-go v1.16.0
+	github.com/jessevdk/go-flags v1.5.0
+	github.com/klauspost/compress v1.18.0
+	github.com/oschwald/maxminddb-golang v1.12.0
+	github.com/segmentio/kafka-go v0.3.5
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/yuin/gopher-lua v1.1.1
+	go.opentelemetry.io/proto/otlp v1.3.1
+	golang.org/x/sys v0.30.0
+	golang.org/x/text v0.22.0
+	google.golang.org/grpc v1.64.0
+	google.golang.org/protobuf v1.34.1
+	gopkg.in/fsnotify.v1 v1.4.7
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/facebookgo/clock v0.0.0-20150410010913-600d898af40a // indirect
+	github.com/facebookgo/limitgroup v0.0.0-20150612190941-6abd8d71ec01 // indirect
+	github.com/facebookgo/muster v0.0.0-20150708232844-fd3d7953fd52 // indirect
+	github.com/grpc-ecosystem/grpc-gateway/v2 v2.20.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20240513163218-0867130af1f8 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240513163218-0867130af1f8 // indirect
+	gopkg.in/alexcesaro/statsd.v2 v2.0.0 // indirect
+)
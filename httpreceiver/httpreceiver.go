@@ -0,0 +1,190 @@
+// Package httpreceiver implements receiving log lines POSTed over HTTP.
+//
+// httpreceiver runs an HTTP server that accepts request bodies of
+// newline-separated log lines (which includes NDJSON) or JSON arrays, and
+// provides a channel on which each line will be sent as a string, the same
+// way the tail package does for lines of a file. It lets things that can only
+// ship logs over HTTP use honeytail as a local gateway.
+package httpreceiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+type Options struct {
+	Path         string `long:"path" description:"URL path to accept log lines on" default:"/"`
+	Token        string `long:"token" description:"If set, requests must carry this token in an Authorization: Bearer header or X-Honeytail-Token header"`
+	MaxBodyBytes int64  `long:"max_body_bytes" description:"Largest request body accepted, after decompression" default:"10485760"`
+}
+
+// GetEntries starts an HTTP server listening on addr (eg :8080). It sends one
+// line at a time down the returned channel. Once ctx is done, the server is
+// closed, requests still waiting to hand on their lines fail, and the channel
+// is closed once they've all returned.
+func GetEntries(ctx context.Context, addr string, options Options) (chan string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(chan string)
+	handler := &Handler{Options: options, Lines: lines}
+	// handling counts the requests that may send lines, so the channel is
+	// only closed once they've stopped
+	var lock sync.Mutex
+	var handling sync.WaitGroup
+	stopped := false
+	mux := http.NewServeMux()
+	mux.HandleFunc(options.Path, func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		if stopped {
+			lock.Unlock()
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		handling.Add(1)
+		lock.Unlock()
+		defer handling.Done()
+		handler.ServeHTTP(w, r)
+	})
+	logrus.WithFields(logrus.Fields{
+		"addr": listener.Addr(),
+		"path": options.Path,
+	}).Info("listening for log lines over HTTP")
+	server := &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		lock.Lock()
+		stopped = true
+		lock.Unlock()
+		handling.Wait()
+		close(lines)
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if err != http.ErrServerClosed {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("HTTP receiver stopped")
+		}
+	}()
+	return lines, nil
+}
+
+// Handler accepts POSTed log lines and sends them down Lines. It replies once
+// every line in the request has been handed on.
+type Handler struct {
+	Options Options
+	Lines   chan<- string
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST is accepted", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.Options.Token != "" && requestToken(r) != h.Options.Token {
+		http.Error(w, "missing or incorrect token", http.StatusUnauthorized)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "bad gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	if h.Options.MaxBodyBytes > 0 {
+		// read one byte past the limit so we can tell it was exceeded
+		body = io.LimitReader(body, h.Options.MaxBodyBytes+1)
+	}
+	lines, err := readLines(body, h.Options.MaxBodyBytes)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	for i, line := range lines {
+		select {
+		case h.Lines <- line:
+		case <-r.Context().Done():
+			// the lines already handed on will be sent
+			logrus.WithFields(logrus.Fields{
+				"remote": r.RemoteAddr,
+				"lines":  len(lines) - i,
+			}).Warn("stopped receiving lines over HTTP before all of a request's were handed on")
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"remote": r.RemoteAddr,
+		"lines":  len(lines),
+	}).Debug("received lines over HTTP")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+var errTooLarge = errors.New("request body too large")
+
+// readLines splits a body into lines. A body that is a JSON array is treated
+// as a batch with one line per element; anything else is split on newlines.
+func readLines(r io.Reader, limit int64) ([]string, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && n > limit {
+		return nil, errTooLarge
+	}
+	trimmed := bytes.TrimSpace(buf.Bytes())
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return nil, fmt.Errorf("body looks like a JSON array but failed to parse: %s", err)
+		}
+		lines := make([]string, 0, len(batch))
+		for _, elem := range batch {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, elem); err != nil {
+				return nil, err
+			}
+			lines = append(lines, compact.String())
+		}
+		return lines, nil
+	}
+	var lines []string
+	for _, line := range strings.Split(string(trimmed), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("X-Honeytail-Token")
+}
@@ -0,0 +1,126 @@
+package httpreceiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLines(t *testing.T) {
+	tsts := []struct {
+		body     string
+		expected []string
+	}{
+		{
+			"first line\r\nsecond line\n\nthird line",
+			[]string{"first line", "second line", "third line"},
+		},
+		{
+			"{\"a\":1}\n{\"b\":2}\n",
+			[]string{`{"a":1}`, `{"b":2}`},
+		},
+		{
+			"[{\"a\": 1},\n {\"b\": [2, 3]}]",
+			[]string{`{"a":1}`, `{"b":[2,3]}`},
+		},
+	}
+	for _, tt := range tsts {
+		lines, err := readLines(strings.NewReader(tt.body), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lines, tt.expected) {
+			t.Errorf("body %q: expected %q, got %q", tt.body, tt.expected, lines)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	lines := make(chan string, 10)
+	h := &Handler{Options: Options{Token: "secret", MaxBodyBytes: 64}, Lines: lines}
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("one\ntwo\n"))
+	gz.Close()
+
+	tsts := []struct {
+		method   string
+		token    string
+		encoding string
+		body     []byte
+		expected int
+	}{
+		{"GET", "secret", "", nil, http.StatusMethodNotAllowed},
+		{"POST", "wrong", "", []byte("one\n"), http.StatusUnauthorized},
+		{"POST", "secret", "", []byte(strings.Repeat("x", 65)), http.StatusRequestEntityTooLarge},
+		{"POST", "secret", "", []byte("[{\"a\":"), http.StatusBadRequest},
+		{"POST", "secret", "gzip", gzipped.Bytes(), http.StatusAccepted},
+	}
+	for _, tt := range tsts {
+		req := httptest.NewRequest(tt.method, "/", bytes.NewReader(tt.body))
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.expected {
+			t.Errorf("%s %q: expected status %d, got %d", tt.method, tt.body, tt.expected, rec.Code)
+		}
+	}
+	close(lines)
+	var received []string
+	for line := range lines {
+		received = append(received, line)
+	}
+	if expected := []string{"one", "two"}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected %q to be sent, got %q", expected, received)
+	}
+}
+
+func TestGetEntriesStops(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := GetEntries(ctx, addr, Options{Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	// once ctx is done, the address can be listened on again, as a second
+	// run in the same process does
+	cancel()
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := GetEntries(ctx, addr, Options{Path: "/"})
+		cancel()
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected to listen again once ctx was done, got %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a request waiting to hand on its lines gives up once ctx is done
+	ctx, cancel = context.WithCancel(context.Background())
+	h := &Handler{Options: Options{}, Lines: make(chan string)}
+	req := httptest.NewRequest("POST", "/", strings.NewReader("one\n")).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	cancel()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d once shutting down, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+}
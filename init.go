@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/honeycombio/honeytail/leash"
+	"github.com/honeycombio/honeytail/tail"
+	flag "github.com/jessevdk/go-flags"
+	"gopkg.in/yaml.v2"
+)
+
+// initSampleLines is how many lines of the log honeytail init looks at to
+// suggest a parser and timestamp field
+const initSampleLines = 50
+
+// initOptions are the flags honeytail init takes
+type initOptions struct {
+	Config string `long:"config" description:"Where to write the config file" default:"/etc/honeytail/honeytail.conf"`
+	Unit   string `long:"unit" description:"Where to write the systemd unit running honeytail with the config file" default:"/etc/systemd/system/honeytail.service"`
+}
+
+// systemdUnit runs honeytail with a config file. It's filled in with the log
+// file, the honeytail binary and the config file.
+const systemdUnit = `[Unit]
+Description=Honeytail, sending %s to Honeycomb
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+ExecStart=%s --config %s
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// runInit is honeytail init, which sets honeytail up to send a log file: it
+// asks for the write key and dataset, suggests a parser and timestamp field
+// from the first lines of the log, and writes a config file and a systemd
+// unit running honeytail with it. It reads answers from in and asks its
+// questions on out.
+func runInit(args []string, in io.Reader, out io.Writer) error {
+	var opts initOptions
+	fp := flag.NewParser(&opts, flag.Default)
+	fp.Usage = "init [--config <path>] [--unit <path>] </path/to/logfile>"
+	rest, err := fp.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 {
+		return errors.New("init needs the log file to set up, eg honeytail init /var/log/app.log")
+	}
+	path, err := filepath.Abs(rest[0])
+	if err != nil {
+		return err
+	}
+
+	// the flags' defaults, for the parsers to be tried with
+	var defaults leash.Config
+	if _, err := flag.NewParser(&defaults, flag.None).ParseArgs(nil); err != nil {
+		return err
+	}
+	lines, err := tail.FirstLines(path, initSampleLines, defaults.Tail)
+	if err != nil {
+		return err
+	}
+	parser := leash.DetectParser(defaults, lines)
+	if parser == "" {
+		fmt.Fprintf(out, "None of the parsers understand the first lines of %s, so you'll need to choose one. Run honeytail --list to see them.\n", path)
+	} else {
+		fmt.Fprintf(out, "The first lines of %s look like the %s parser's.\n", path, parser)
+	}
+
+	p := &prompter{in: bufio.NewReader(in), out: out}
+	writeKey, err := p.ask("Write key", "", true)
+	if err != nil {
+		return err
+	}
+	dataset, err := p.ask("Dataset", strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), true)
+	if err != nil {
+		return err
+	}
+	if parser, err = p.ask("Parser", parser, true); err != nil {
+		return err
+	}
+	config := yaml.MapSlice{
+		{Key: "writekey", Value: writeKey},
+		{Key: "dataset", Value: dataset},
+		{Key: "parser", Value: parser},
+		{Key: "file", Value: []string{path}},
+	}
+	if parser == "json" {
+		timeField, err := p.ask("Timestamp field, or blank to look in time, timestamp, date and the like",
+			leash.SuggestTimeField(defaults, lines), false)
+		if err != nil {
+			return err
+		}
+		if timeField != "" {
+			config = append(config, yaml.MapItem{Key: "json.timefield", Value: timeField})
+		}
+	}
+
+	contents, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	contents = append([]byte("# written by honeytail init\n"), contents...)
+	// the config file has the write key in it, so only its owner reads it
+	if err := p.writeFile(opts.Config, contents, 0600); err != nil {
+		return err
+	}
+	honeytail, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	unit := fmt.Sprintf(systemdUnit, path, honeytail, opts.Config)
+	if err := p.writeFile(opts.Unit, []byte(unit), 0644); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\nWrote %s and %s. To check what will be sent, and then start sending:\n\n", opts.Config, opts.Unit)
+	fmt.Fprintf(out, "  %s --config %s --sample_lines 10\n", honeytail, opts.Config)
+	fmt.Fprintf(out, "  systemctl daemon-reload && systemctl enable --now %s\n", filepath.Base(opts.Unit))
+	return nil
+}
+
+// prompter asks the questions for honeytail init
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask asks question, offering def, and returns the answer, or def if none is
+// given. Required questions are asked until they're answered.
+func (p *prompter) ask(question, def string, required bool) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		answer, err := p.in.ReadString('\n')
+		answer = strings.TrimSpace(answer)
+		if answer == "" {
+			answer = def
+		}
+		if answer != "" || !required {
+			return answer, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("no answer for %s: %s", strings.ToLower(question), err)
+		}
+	}
+}
+
+// writeFile writes contents to path, creating its directory, after checking
+// it's alright to replace the file if there already is one
+func (p *prompter) writeFile(path string, contents []byte, perm os.FileMode) error {
+	if _, err := os.Stat(path); err == nil {
+		answer, err := p.ask(path+" already exists. Replace it? (y/n)", "n", true)
+		if err != nil {
+			return err
+		}
+		if answer != "y" && answer != "yes" {
+			return fmt.Errorf("not replacing %s", path)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, perm)
+}
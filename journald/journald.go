@@ -0,0 +1,358 @@
+// Package journald implements reading log entries from the systemd journal.
+//
+// journald runs journalctl and provides a channel on which each journal
+// entry will be sent as a string, the same way the tail package does for
+// lines of a file. The cursor of the last entry read is kept in a state file
+// so that honeytail can pick up where it left off.
+package journald
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+// URL accepted as a --file argument
+const url = "journald://"
+
+// stateFileName is the name of the state file when --journald.statefile
+// isn't given
+const stateFileName = "honeytail-journald.leash.state"
+
+// maxEntryBytes is the longest journal entry read. Entries can carry large
+// binary-ish messages.
+const maxEntryBytes = 16 * 1024 * 1024
+
+// formats entries can be sent on as
+const (
+	formatJSON  = "json"
+	formatShort = "short"
+)
+
+type Options struct {
+	Units     []string `long:"unit" description:"Only read entries for this systemd unit. May be specified multiple times"`
+	Priority  string   `long:"priority" description:"Only read entries at or more important than this priority (eg err, warning, 0-7) or in this range (eg 3..5)"`
+	Matches   []string `long:"match" description:"Only read entries where FIELD=VALUE, eg _COMM=sshd. May be specified multiple times"`
+	Format    string   `long:"format" description:"How entries are handed to the parser. json: the journal's JSON export of the entry. short: a syslog style line (timestamp host identifier[pid]: message)" default:"json"`
+	StateFile string   `long:"statefile" description:"File in which to store the journal cursor of the last entry whose events have been sent. Defaults to honeytail-journald.leash.state in the --tail.statedir, or next to the --tail.statefile, or failing those in the temp directory"`
+	Command   string   `long:"journalctl" description:"Path to the journalctl command" default:"journalctl"`
+}
+
+// State is what's stored in the statefile
+type State struct {
+	Cursor string
+}
+
+// entry is the subset of the journal's JSON export we need to look at
+type entry struct {
+	Cursor     string `json:"__CURSOR"`
+	Realtime   string `json:"__REALTIME_TIMESTAMP"`
+	Hostname   string `json:"_HOSTNAME"`
+	Identifier string `json:"SYSLOG_IDENTIFIER"`
+	PID        string `json:"_PID"`
+	Message    interface{}
+}
+
+// IsJournaldURL returns true if path asks for the systemd journal rather
+// than a file
+func IsJournaldURL(path string) bool {
+	return path == url
+}
+
+// GetEntries starts journalctl, sending one journal entry at a time down the
+// returned channel. The read_from and stop tail options have the same meaning
+// as they do for files. When ctx is done journalctl is killed, and the
+// channel is closed once it has exited. The cursor of an entry is only saved
+// once progress says the events made from it have been sent.
+func GetEntries(ctx context.Context, options Options, tailOptions tail.TailOptions, progress Progress) (chan string, error) {
+	if options.Format != formatJSON && options.Format != formatShort {
+		return nil, fmt.Errorf("unknown option to --journald.format: %s", options.Format)
+	}
+	stateFile := stateFilePath(options, tailOptions)
+	args, err := buildArgs(options, tailOptions, readCursor(stateFile))
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, options.Command, args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"command": options.Command,
+		"args":    args,
+	}).Debug("starting journalctl")
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	cursor := &cursorState{progress: progress, done: make(chan struct{})}
+	go cursor.updateStateFile(stateFile)
+	// prev is the cursor of the last entry handed out. Its events may not
+	// have been made until the parser finished, so it's only saved once
+	// they've all been sent.
+	var prev string
+	read := make(chan struct{})
+	progress.OnFinish(func() {
+		<-read
+		close(cursor.done)
+		if prev != "" {
+			cursor.add(prev)
+		}
+		cursor.write(stateFile)
+	})
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		defer close(read)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 64*1024), maxEntryBytes)
+		for scanner.Scan() {
+			raw := scanner.Text()
+			var ent entry
+			if err := json.Unmarshal([]byte(raw), &ent); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"line": raw,
+					"err":  err,
+				}).Debug("skipping unparseable journal entry")
+				continue
+			}
+			line := raw
+			if options.Format == formatShort {
+				line = formatEntry(ent)
+			}
+			select {
+			case lines <- line:
+				// the parser only asks for this entry once it's done with
+				// the previous one, so the previous entry's events have all
+				// been made by now
+				if prev != "" {
+					cursor.add(prev)
+				}
+				prev = ent.Cursor
+				continue
+			case <-ctx.Done():
+			}
+			// journalctl is being killed
+			break
+		}
+		if err := scanner.Err(); err != nil && ctx.Err() == nil {
+			// journalctl would otherwise block writing to the pipe no
+			// one's reading, and never exit
+			logrus.WithFields(logrus.Fields{
+				"err":          err,
+				"max_bytes":    maxEntryBytes,
+				"after_cursor": prev,
+			}).Error("Failed to read from journalctl; stopping it")
+			cmd.Process.Kill()
+		}
+		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("journalctl exited")
+		}
+	}()
+	return lines, nil
+}
+
+// stateFilePath returns where to keep the journal cursor: the
+// --journald.statefile if it's given, otherwise in the --tail.statedir or
+// next to the --tail.statefile, and failing those in the temp directory
+func stateFilePath(options Options, tailOptions tail.TailOptions) string {
+	switch {
+	case options.StateFile != "":
+		return options.StateFile
+	case tailOptions.StateDir != "":
+		return filepath.Join(tailOptions.StateDir, stateFileName)
+	case tailOptions.StateFile != "":
+		return filepath.Join(filepath.Dir(tailOptions.StateFile), stateFileName)
+	}
+	return filepath.Join(os.TempDir(), stateFileName)
+}
+
+// buildArgs turns our options into journalctl arguments
+func buildArgs(options Options, tailOptions tail.TailOptions, cursor string) ([]string, error) {
+	args := []string{"--output=json", "--no-pager"}
+	switch tailOptions.ReadFrom {
+	case "start", "beginning":
+		// journalctl starts at the beginning when not told otherwise
+	case "end":
+		args = append(args, "--lines=0")
+	case "last":
+		if cursor != "" {
+			args = append(args, "--after-cursor="+cursor)
+		} else {
+			args = append(args, "--lines=0")
+		}
+	default:
+		lastLines, err := tail.LastLines(tailOptions)
+		if err != nil {
+			return nil, err
+		}
+		if lastLines == 0 {
+			return nil, fmt.Errorf("unknown option to --read_from: %s", tailOptions.ReadFrom)
+		}
+		args = append(args, "--lines="+strconv.Itoa(lastLines))
+	}
+	if !tailOptions.Stop {
+		args = append(args, "--follow")
+	}
+	for _, unit := range options.Units {
+		args = append(args, "--unit="+unit)
+	}
+	if options.Priority != "" {
+		args = append(args, "--priority="+options.Priority)
+	}
+	for _, match := range options.Matches {
+		if !strings.Contains(match, "=") {
+			return nil, errors.New("journald matches must be FIELD=VALUE, got " + match)
+		}
+		args = append(args, match)
+	}
+	return args, nil
+}
+
+// formatEntry renders an entry as a syslog style line, with an RFC3339
+// timestamp
+func formatEntry(ent entry) string {
+	ts := time.Now().UTC()
+	if usec, err := strconv.ParseInt(ent.Realtime, 10, 64); err == nil {
+		ts = time.Unix(usec/1e6, (usec%1e6)*1e3).UTC()
+	}
+	ident := ent.Identifier
+	if ent.PID != "" {
+		ident += "[" + ent.PID + "]"
+	}
+	return fmt.Sprintf("%s %s %s: %s", ts.Format(time.RFC3339Nano), ent.Hostname, ident, message(ent.Message))
+}
+
+// message handles the journal exporting non-UTF8 messages as arrays of bytes
+func message(m interface{}) string {
+	switch typedVal := m.(type) {
+	case string:
+		return typedVal
+	case []interface{}:
+		b := make([]byte, 0, len(typedVal))
+		for _, v := range typedVal {
+			if f, ok := v.(float64); ok {
+				b = append(b, byte(f))
+			}
+		}
+		return string(b)
+	}
+	return ""
+}
+
+// readCursor returns the cursor saved in stateFile, or "" if there isn't one
+func readCursor(stateFile string) string {
+	content, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"statefile": stateFile, "error": err,
+		}).Debug("failed to read the journald statefile")
+		return ""
+	}
+	state := State{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"statefile": stateFile, "error": err,
+		}).Debug("failed to json decode the journald statefile")
+		return ""
+	}
+	return state.Cursor
+}
+
+// Progress lets journald find out when the events made from the entries it
+// has handed out have been sent. checkpoint.Tracker implements it.
+type Progress interface {
+	// Mark returns a position covering every event made so far
+	Mark() uint64
+	// Reached reports whether every event up to mark has been sent
+	Reached(mark uint64) bool
+	// OnFinish registers f to be called once every event has been sent
+	OnFinish(f func())
+}
+
+// pendingCursor is an entry waiting for its events to be sent
+type pendingCursor struct {
+	cursor string
+	mark   uint64
+}
+
+// cursorState holds the cursors of entries that have been parsed, in the
+// order they were handed out, until their events have been sent
+type cursorState struct {
+	sync.Mutex
+	progress Progress
+	pending  []pendingCursor
+	// cursor is that of the last entry whose events have all been sent
+	cursor  string
+	written string
+	// done is closed once every event has been sent
+	done chan struct{}
+}
+
+func (c *cursorState) add(cursor string) {
+	mark := c.progress.Mark()
+	c.Lock()
+	c.pending = append(c.pending, pendingCursor{cursor: cursor, mark: mark})
+	c.Unlock()
+}
+
+// reached moves the cursor past the entries whose events have all been
+// sent. c must be locked.
+func (c *cursorState) reached() {
+	for len(c.pending) > 0 && c.progress.Reached(c.pending[0].mark) {
+		c.cursor = c.pending[0].cursor
+		c.pending = c.pending[1:]
+	}
+}
+
+// updateStateFile writes the cursor to the state file once per second when
+// it has changed, until every event has been sent
+func (c *cursorState) updateStateFile(stateFile string) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.write(stateFile)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *cursorState) write(stateFile string) {
+	c.Lock()
+	defer c.Unlock()
+	c.reached()
+	if c.cursor == "" || c.cursor == c.written {
+		return
+	}
+	out, err := json.Marshal(State{Cursor: c.cursor})
+	if err != nil {
+		return
+	}
+	out = append(out, '\n')
+	if err := ioutil.WriteFile(stateFile, out, 0644); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"statefile": stateFile,
+			"error":     err,
+		}).Warn("Failed to write journald statefile. Journal position will not be saved.")
+		return
+	}
+	c.written = c.cursor
+}
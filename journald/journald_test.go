@@ -0,0 +1,167 @@
+package journald
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/tail"
+)
+
+func TestBuildArgs(t *testing.T) {
+	testCases := []struct {
+		options  Options
+		tail     tail.TailOptions
+		cursor   string
+		expected []string
+	}{
+		{
+			options:  Options{},
+			tail:     tail.TailOptions{ReadFrom: "last"},
+			cursor:   "s=abc;i=1",
+			expected: []string{"--output=json", "--no-pager", "--after-cursor=s=abc;i=1", "--follow"},
+		},
+		{
+			options:  Options{Units: []string{"sshd.service", "nginx.service"}, Priority: "warning"},
+			tail:     tail.TailOptions{ReadFrom: "last"},
+			expected: []string{"--output=json", "--no-pager", "--lines=0", "--follow", "--unit=sshd.service", "--unit=nginx.service", "--priority=warning"},
+		},
+		{
+			options:  Options{Matches: []string{"_COMM=sshd"}},
+			tail:     tail.TailOptions{ReadFrom: "beginning", Stop: true},
+			expected: []string{"--output=json", "--no-pager", "_COMM=sshd"},
+		},
+		{
+			options:  Options{},
+			tail:     tail.TailOptions{ReadFrom: "last:100"},
+			cursor:   "s=abc;i=1",
+			expected: []string{"--output=json", "--no-pager", "--lines=100", "--follow"},
+		},
+	}
+	for _, tc := range testCases {
+		args, err := buildArgs(tc.options, tc.tail, tc.cursor)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("expected %q, got %q", tc.expected, args)
+		}
+	}
+	if _, err := buildArgs(Options{Matches: []string{"nope"}}, tail.TailOptions{ReadFrom: "end"}, ""); err == nil {
+		t.Error("expected an error for a match without a value")
+	}
+}
+
+func TestFormatEntry(t *testing.T) {
+	ent := entry{
+		Realtime:   "1470052800123456",
+		Hostname:   "web1",
+		Identifier: "sshd",
+		PID:        "1234",
+		Message:    "Accepted publickey for bob",
+	}
+	expected := "2016-08-01T12:00:00.123456Z web1 sshd[1234]: Accepted publickey for bob"
+	if actual := formatEntry(ent); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	ent.Message = []interface{}{float64('h'), float64('i')}
+	ent.PID = ""
+	expected = "2016-08-01T12:00:00.123456Z web1 sshd: hi"
+	if actual := formatEntry(ent); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestStateFilePath(t *testing.T) {
+	tsts := []struct {
+		options     Options
+		tailOptions tail.TailOptions
+		expected    string
+	}{
+		{Options{StateFile: "/var/lib/journal.state"}, tail.TailOptions{StateDir: "/var/lib/honeytail"}, "/var/lib/journal.state"},
+		{Options{}, tail.TailOptions{StateDir: "/var/lib/honeytail"}, "/var/lib/honeytail/" + stateFileName},
+		{Options{}, tail.TailOptions{StateFile: "/var/lib/honeytail/tail.state"}, "/var/lib/honeytail/" + stateFileName},
+		{Options{}, tail.TailOptions{}, filepath.Join(os.TempDir(), stateFileName)},
+	}
+	for _, tt := range tsts {
+		if actual := stateFilePath(tt.options, tt.tailOptions); actual != tt.expected {
+			t.Errorf("%+v, %+v: expected %s, got %s", tt.options, tt.tailOptions, tt.expected, actual)
+		}
+	}
+}
+
+// fakeProgress says every event has been sent, once finish is called
+type fakeProgress struct {
+	lock      sync.Mutex
+	finished  bool
+	finishers []func()
+}
+
+func (f *fakeProgress) Mark() uint64 { return 0 }
+func (f *fakeProgress) Reached(mark uint64) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.finished
+}
+func (f *fakeProgress) OnFinish(fn func()) { f.finishers = append(f.finishers, fn) }
+
+func (f *fakeProgress) finish() {
+	f.lock.Lock()
+	f.finished = true
+	f.lock.Unlock()
+	for _, fn := range f.finishers {
+		fn()
+	}
+}
+
+func TestGetEntriesTooLong(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journald")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a journalctl that writes an entry too long to read, then waits
+	journalctl := filepath.Join(dir, "journalctl")
+	script := fmt.Sprintf("#!/bin/sh\necho '{\"__CURSOR\":\"c1\",\"MESSAGE\":\"hi\"}'\nhead -c %d /dev/zero | tr '\\0' a\necho\nexec sleep 60\n", maxEntryBytes+1)
+	if err := ioutil.WriteFile(journalctl, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	options := Options{Format: formatJSON, Command: journalctl, StateFile: filepath.Join(dir, "state")}
+	progress := &fakeProgress{}
+	lines, err := GetEntries(context.Background(), options, tail.TailOptions{ReadFrom: "start", Stop: true}, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(10 * time.Second)
+	var received []string
+	for {
+		select {
+		case line, ok := <-lines:
+			if ok {
+				received = append(received, line)
+				continue
+			}
+		case <-timeout:
+			t.Fatal("expected reading to stop after an entry too long to read")
+		}
+		break
+	}
+	if len(received) != 1 {
+		t.Errorf("expected the entry before the long one, got %d", len(received))
+	}
+	// nothing has been sent yet
+	if cursor := readCursor(options.StateFile); cursor != "" {
+		t.Errorf("expected no cursor to be saved before the entry's events were sent, got %q", cursor)
+	}
+	progress.finish()
+	if cursor := readCursor(options.StateFile); cursor != "c1" {
+		t.Errorf("expected the cursor of the entry read to be saved, got %q", cursor)
+	}
+}
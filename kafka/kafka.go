@@ -0,0 +1,186 @@
+// Package kafka implements consuming log lines from a Kafka topic.
+//
+// kafka joins a consumer group and provides a channel on which each message
+// will be sent as a string, the same way the tail package does for lines of
+// a file. Offsets are only committed once the events made from a message
+// have been sent.
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+type Options struct {
+	Brokers   []string `long:"brokers" description:"Kafka broker (host:port) to connect to. May be specified multiple times"`
+	Topic     string   `long:"topic" description:"Kafka topic to consume log lines from. Each message is treated as one line"`
+	Group     string   `long:"group" description:"Kafka consumer group to join. Offsets are committed for this group" default:"honeytail"`
+	StartFrom string   `long:"start_from" description:"Where to start reading partitions the group has no committed offset for. Values: oldest, newest" default:"newest"`
+}
+
+// Progress lets the consumer find out when the events made from the
+// messages it has handed out have been sent. checkpoint.Tracker implements
+// it.
+type Progress interface {
+	// Mark returns a position covering every event made so far
+	Mark() uint64
+	// Reached reports whether every event up to mark has been sent
+	Reached(mark uint64) bool
+	// OnFinish registers f to be called once every event has been sent
+	OnFinish(f func())
+}
+
+// commitInterval is how often finished messages are committed when no new
+// messages are arriving
+const commitInterval = time.Second
+
+// GetEntries joins the consumer group and starts reading the topic. It sends
+// one message at a time down the returned channel, until ctx is done, when it
+// closes the channel. The last offsets are committed, and the group left, once
+// progress finishes.
+func GetEntries(ctx context.Context, options Options, progress Progress) (chan string, error) {
+	if len(options.Brokers) == 0 {
+		return nil, errors.New("at least one --kafka.brokers is required to read from kafka")
+	}
+	if options.Topic == "" {
+		return nil, errors.New("--kafka.topic is required to read from kafka")
+	}
+	var startOffset int64
+	switch options.StartFrom {
+	case "oldest":
+		startOffset = kafkago.FirstOffset
+	case "newest":
+		startOffset = kafkago.LastOffset
+	default:
+		return nil, fmt.Errorf("unknown option to --kafka.start_from: %s", options.StartFrom)
+	}
+	reader := kafkago.NewReader(kafkago.ReaderConfig{
+		Brokers:     options.Brokers,
+		Topic:       options.Topic,
+		GroupID:     options.Group,
+		StartOffset: startOffset,
+	})
+	logrus.WithFields(logrus.Fields{
+		"brokers": options.Brokers,
+		"topic":   options.Topic,
+		"group":   options.Group,
+	}).Info("consuming from kafka")
+
+	lines := make(chan string)
+	commits := &pendingCommits{progress: progress}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go commits.commitPeriodically(reader, stop, stopped)
+	// prev is the last message handed out. Its events may not have been made
+	// until the parser finished, so it's only committed once they've all
+	// been sent.
+	var prev *kafkago.Message
+	read := make(chan struct{})
+	progress.OnFinish(func() {
+		<-read
+		if prev != nil {
+			commits.add(*prev)
+		}
+		commits.commitReached(reader)
+		reader.Close()
+	})
+	go func() {
+		defer close(lines)
+		defer close(read)
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+		for {
+			msg, err := reader.FetchMessage(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.WithFields(logrus.Fields{"err": err}).Error("kafka consumer failed")
+				}
+				return
+			}
+			select {
+			case lines <- string(msg.Value):
+			case <-ctx.Done():
+				return
+			}
+			// the parser only asks for this message once it's done with the
+			// previous one, so the previous message's events have all been
+			// made by now
+			if prev != nil {
+				commits.add(*prev)
+			}
+			prev = &msg
+			commits.commitReached(reader)
+		}
+	}()
+	return lines, nil
+}
+
+// pendingCommit is a message waiting for its events to be sent
+type pendingCommit struct {
+	msg  kafkago.Message
+	mark uint64
+}
+
+// pendingCommits holds messages that have been parsed, in the order they
+// were handed out, until their events have been sent
+type pendingCommits struct {
+	sync.Mutex
+	progress Progress
+	pending  []pendingCommit
+}
+
+func (p *pendingCommits) add(msg kafkago.Message) {
+	mark := p.progress.Mark()
+	p.Lock()
+	p.pending = append(p.pending, pendingCommit{msg: msg, mark: mark})
+	p.Unlock()
+}
+
+// reached removes and returns the messages whose events have all been sent
+func (p *pendingCommits) reached() []kafkago.Message {
+	p.Lock()
+	defer p.Unlock()
+	var done []kafkago.Message
+	for len(p.pending) > 0 && p.progress.Reached(p.pending[0].mark) {
+		done = append(done, p.pending[0].msg)
+		p.pending = p.pending[1:]
+	}
+	return done
+}
+
+func (p *pendingCommits) commitReached(reader *kafkago.Reader) {
+	done := p.reached()
+	if len(done) == 0 {
+		return
+	}
+	if err := reader.CommitMessages(context.Background(), done...); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err":      err,
+			"messages": len(done),
+		}).Warn("failed to commit kafka offsets. Messages may be read again after a restart.")
+	}
+}
+
+// commitPeriodically commits finished messages until stop is closed, then
+// closes stopped
+func (p *pendingCommits) commitPeriodically(reader *kafkago.Reader, stop, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(commitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.commitReached(reader)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+type fakeProgress struct {
+	made, sent uint64
+}
+
+func (f *fakeProgress) Mark() uint64             { return f.made }
+func (f *fakeProgress) Reached(mark uint64) bool { return f.sent >= mark }
+func (f *fakeProgress) OnFinish(func())          {}
+
+func TestPendingCommits(t *testing.T) {
+	progress := &fakeProgress{}
+	commits := &pendingCommits{progress: progress}
+
+	// message 1 made two events, message 2 made one
+	progress.made = 2
+	commits.add(kafkago.Message{Offset: 1})
+	progress.made = 3
+	commits.add(kafkago.Message{Offset: 2})
+
+	if done := commits.reached(); len(done) != 0 {
+		t.Errorf("expected nothing to commit before events were sent, got %d", len(done))
+	}
+	progress.sent = 2
+	done := commits.reached()
+	if len(done) != 1 || done[0].Offset != 1 {
+		t.Errorf("expected only offset 1 to be committable, got %+v", done)
+	}
+	progress.sent = 3
+	done = commits.reached()
+	if len(done) != 1 || done[0].Offset != 2 {
+		t.Errorf("expected offset 2 to be committable, got %+v", done)
+	}
+	if done := commits.reached(); len(done) != 0 {
+		t.Errorf("expected messages to only be committed once, got %+v", done)
+	}
+}
+
+func TestCommitPeriodicallyStops(t *testing.T) {
+	commits := &pendingCommits{progress: &fakeProgress{}}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	// with nothing pending the reader is never used
+	go commits.commitPeriodically(nil, stop, stopped)
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected committing to stop")
+	}
+}
@@ -0,0 +1,318 @@
+// Package kinesis implements consuming log lines from an AWS Kinesis stream.
+//
+// kinesis reads every shard of a stream and provides a channel on which
+// each log line will be sent as a string, the same way the tail package
+// does for lines of a file. Records delivered by a CloudWatch Logs
+// subscription (gzipped JSON batches of log events) are unwrapped into the
+// individual log messages; any other record is split into lines.
+package kinesis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/aws"
+)
+
+const (
+	scheme        = "kinesis://"
+	targetPrefix  = "Kinesis_20131202."
+	listInterval  = time.Minute
+	maxRecordsGet = 1000
+)
+
+type Options struct {
+	StartFrom    string `long:"start_from" description:"Where to start reading each shard. Values: oldest, newest" default:"newest"`
+	PollInterval int    `long:"poll_interval" description:"Milliseconds to wait between reads of a shard that had no new records" default:"1000"`
+}
+
+// IsKinesisURL returns true if path names a kinesis stream rather than a
+// file
+func IsKinesisURL(path string) bool {
+	return strings.HasPrefix(path, scheme)
+}
+
+type shard struct {
+	ShardId string
+}
+
+type listShardsOutput struct {
+	Shards    []shard
+	NextToken string
+}
+
+type record struct {
+	Data           []byte
+	SequenceNumber string
+}
+
+type getRecordsOutput struct {
+	Records            []record
+	NextShardIterator  *string
+	MillisBehindLatest int64
+}
+
+// subscriptionPayload is what CloudWatch Logs puts in each record
+type subscriptionPayload struct {
+	MessageType string `json:"messageType"`
+	LogEvents   []struct {
+		Message string `json:"message"`
+	} `json:"logEvents"`
+}
+
+// GetEntries starts reading every shard of the stream named in url (eg
+// kinesis://my-stream). It sends one line at a time down the returned
+// channel, until ctx is done, when it closes the channel once every shard
+// has stopped being read.
+func GetEntries(ctx context.Context, url string, options Options, awsOptions aws.Options) (chan string, error) {
+	stream := strings.TrimPrefix(url, scheme)
+	if stream == "" {
+		return nil, fmt.Errorf("kinesis url must name a stream, eg kinesis://my-stream")
+	}
+	var iteratorType string
+	switch options.StartFrom {
+	case "oldest":
+		iteratorType = "TRIM_HORIZON"
+	case "newest":
+		iteratorType = "LATEST"
+	default:
+		return nil, fmt.Errorf("unknown option to --kinesis.start_from: %s", options.StartFrom)
+	}
+	client, err := aws.NewClient(awsOptions)
+	if err != nil {
+		return nil, err
+	}
+	r := &reader{
+		ctx:          ctx,
+		client:       client,
+		stream:       stream,
+		pollInterval: time.Duration(options.PollInterval) * time.Millisecond,
+		lines:        make(chan string),
+		reading:      make(map[string]bool),
+	}
+	// make sure we can see the stream before we claim to be reading it
+	shards, err := r.listShards()
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"stream": stream,
+		"shards": len(shards),
+	}).Info("reading from kinesis")
+	r.startShards(shards, iteratorType)
+	// shards split and merge over time; children of shards we were reading
+	// are read from their start so nothing is skipped
+	go func() {
+		ticker := time.NewTicker(listInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				// startShards is only called from here, so no more shards
+				// are added to the wait group
+				r.shards.Wait()
+				close(r.lines)
+				return
+			}
+			shards, err := r.listShards()
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.WithFields(logrus.Fields{"err": err}).Warn("failed to list kinesis shards")
+				}
+				continue
+			}
+			r.startShards(shards, "TRIM_HORIZON")
+		}
+	}()
+	return r.lines, nil
+}
+
+type reader struct {
+	ctx          context.Context
+	client       *aws.Client
+	stream       string
+	pollInterval time.Duration
+	lines        chan string
+
+	lock    sync.Mutex
+	reading map[string]bool
+	// shards waits for the shards being read
+	shards sync.WaitGroup
+}
+
+// sleep waits for the poll interval, returning false if ctx is done first
+func (r *reader) sleep() bool {
+	select {
+	case <-time.After(r.pollInterval):
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+func (r *reader) listShards() ([]shard, error) {
+	var shards []shard
+	in := map[string]interface{}{"StreamName": r.stream}
+	for {
+		var out listShardsOutput
+		if err := r.client.CallContext(r.ctx, "kinesis", targetPrefix+"ListShards", in, &out); err != nil {
+			return nil, err
+		}
+		shards = append(shards, out.Shards...)
+		if out.NextToken == "" {
+			return shards, nil
+		}
+		// the stream name can't be given along with a token
+		in = map[string]interface{}{"NextToken": out.NextToken}
+	}
+}
+
+// startShards starts reading any shards we aren't already reading
+func (r *reader) startShards(shards []shard, iteratorType string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, s := range shards {
+		if r.reading[s.ShardId] {
+			continue
+		}
+		r.reading[s.ShardId] = true
+		r.shards.Add(1)
+		go r.readShard(s.ShardId, iteratorType)
+	}
+}
+
+func (r *reader) readShard(shardID, iteratorType string) {
+	defer r.shards.Done()
+	next, err := r.getIterator(shardID, iteratorType, "")
+	if r.ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"shard": shardID,
+			"err":   err,
+		}).Error("failed to get kinesis shard iterator; not reading shard")
+		return
+	}
+	var lastSequence string
+	for next != nil && *next != "" {
+		var out getRecordsOutput
+		err := r.client.CallContext(r.ctx, "kinesis", targetPrefix+"GetRecords", map[string]interface{}{
+			"ShardIterator": *next,
+			"Limit":         maxRecordsGet,
+		}, &out)
+		if apiErr, ok := err.(*aws.APIError); ok && apiErr.Type == "ExpiredIteratorException" {
+			// iterators only last five minutes; pick up after the last
+			// record we saw
+			var fresh *string
+			if lastSequence != "" {
+				fresh, err = r.getIterator(shardID, "AFTER_SEQUENCE_NUMBER", lastSequence)
+			} else {
+				fresh, err = r.getIterator(shardID, iteratorType, "")
+			}
+			if err == nil {
+				next = fresh
+				continue
+			}
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// throttling and transient failures are retried after a pause
+			logrus.WithFields(logrus.Fields{
+				"shard": shardID,
+				"err":   err,
+			}).Warn("failed to get kinesis records")
+			if !r.sleep() {
+				return
+			}
+			continue
+		}
+		for _, rec := range out.Records {
+			for _, line := range RecordLines(rec.Data) {
+				select {
+				case r.lines <- line:
+				case <-r.ctx.Done():
+					return
+				}
+			}
+			lastSequence = rec.SequenceNumber
+		}
+		next = out.NextShardIterator
+		if len(out.Records) == 0 || out.MillisBehindLatest == 0 {
+			if !r.sleep() {
+				return
+			}
+		}
+	}
+	logrus.WithFields(logrus.Fields{"shard": shardID}).Info("kinesis shard closed")
+}
+
+func (r *reader) getIterator(shardID, iteratorType, sequence string) (*string, error) {
+	in := map[string]interface{}{
+		"StreamName":        r.stream,
+		"ShardId":           shardID,
+		"ShardIteratorType": iteratorType,
+	}
+	if sequence != "" {
+		in["StartingSequenceNumber"] = sequence
+	}
+	var out struct {
+		ShardIterator string
+	}
+	if err := r.client.CallContext(r.ctx, "kinesis", targetPrefix+"GetShardIterator", in, &out); err != nil {
+		return nil, err
+	}
+	return &out.ShardIterator, nil
+}
+
+// RecordLines returns the log lines in a record, unwrapping CloudWatch Logs
+// subscription payloads
+func RecordLines(data []byte) []string {
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		if lines, ok := subscriptionLines(data); ok {
+			return lines
+		}
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func subscriptionLines(data []byte) ([]string, bool) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	unzipped, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, false
+	}
+	var payload subscriptionPayload
+	if err := json.Unmarshal(unzipped, &payload); err != nil {
+		return nil, false
+	}
+	// CONTROL_MESSAGEs only check that the destination is reachable
+	if payload.MessageType != "DATA_MESSAGE" {
+		return []string{}, true
+	}
+	lines := make([]string, 0, len(payload.LogEvents))
+	for _, ev := range payload.LogEvents {
+		lines = append(lines, ev.Message)
+	}
+	return lines, true
+}
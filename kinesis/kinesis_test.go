@@ -0,0 +1,42 @@
+package kinesis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(s))
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestRecordLines(t *testing.T) {
+	testCases := []struct {
+		data     []byte
+		expected []string
+	}{
+		{
+			data:     []byte("first line\nsecond line\n"),
+			expected: []string{"first line", "second line"},
+		},
+		{
+			data:     gzipped(`{"messageType":"DATA_MESSAGE","owner":"123456789012","logGroup":"/aws/lambda/fn","logStream":"2016/08/01/[$LATEST]abc","subscriptionFilters":["all"],"logEvents":[{"id":"1","timestamp":1470052800000,"message":"{\"a\":1}"},{"id":"2","timestamp":1470052800001,"message":"START RequestId: abc"}]}`),
+			expected: []string{`{"a":1}`, "START RequestId: abc"},
+		},
+		{
+			data:     gzipped(`{"messageType":"CONTROL_MESSAGE","logEvents":[{"id":"","timestamp":1470052800000,"message":"CWL CONTROL MESSAGE: Checking health of destination Kinesis stream."}]}`),
+			expected: []string{},
+		},
+	}
+	for _, tc := range testCases {
+		actual := RecordLines(tc.data)
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("expected %q, got %q", tc.expected, actual)
+		}
+	}
+}
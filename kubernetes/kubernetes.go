@@ -0,0 +1,469 @@
+// Package kubernetes implements reading the logs of pods running in a
+// Kubernetes cluster.
+//
+// kubernetes talks to the cluster's API server, finds the running pods
+// matching the configured namespace and label selector and provides a
+// channel of their log streams, one per container, each with the pod's
+// name, namespace, node and labels attached as fields. Pods that start later
+// are picked up as they appear.
+package kubernetes
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/tail"
+	"gopkg.in/yaml.v2"
+)
+
+// serviceAccountDir is where kubernetes mounts the credentials of the pod's
+// service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type Options struct {
+	Kubeconfig   string `long:"kubeconfig" description:"Path to a kubeconfig file. Defaults to the pod's service account when running in a cluster, otherwise $KUBECONFIG or ~/.kube/config"`
+	Context      string `long:"context" description:"Kubeconfig context to use. Defaults to the current context"`
+	Namespace    string `long:"namespace" description:"Only read pods in this namespace. Defaults to all namespaces"`
+	Selector     string `long:"selector" description:"Only read pods matching this label selector, eg app=web,tier!=cache"`
+	Container    string `long:"container" description:"Only read containers with this name"`
+	StartFrom    string `long:"start_from" description:"Where to start reading pods already running when honeytail starts. Values: oldest, newest. Pods started later are always read from the beginning" default:"newest"`
+	PollInterval int    `long:"poll_interval" description:"Seconds between checks for new pods" default:"10"`
+}
+
+// pod is the part of the pod list we use
+type pod struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		UID       string            `json:"uid"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name string `json:"name"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+type podList struct {
+	Items []pod `json:"items"`
+}
+
+// client makes Kubernetes API calls
+type client struct {
+	http   *http.Client
+	server string
+	token  string
+}
+
+// newClient uses the kubeconfig if one is given or the service account if
+// we're running inside a cluster, falling back to the default kubeconfig
+func newClient(options Options) (*client, error) {
+	if options.Kubeconfig == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return inClusterClient()
+	}
+	path := options.Kubeconfig
+	if path == "" {
+		path = os.Getenv("KUBECONFIG")
+	}
+	if path == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			// windows
+			home = os.Getenv("USERPROFILE")
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	return kubeconfigClient(path, options.Context)
+}
+
+func inClusterClient() (*client, error) {
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s/ca.crt", serviceAccountDir)
+	}
+	host := net.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	return &client{
+		http:   &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+		server: "https://" + host,
+		token:  strings.TrimSpace(string(token)),
+	}, nil
+}
+
+// kubeconfig is the part of a kubeconfig file we use
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+func kubeconfigClient(path, contextName string) (*client, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig %s: %s", path, err)
+	}
+	if contextName == "" {
+		contextName = config.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range config.Contexts {
+		if c.Name == contextName {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("context %q not found in kubeconfig %s", contextName, path)
+	}
+	c := &client{}
+	tlsConfig := &tls.Config{}
+	found = false
+	for _, cl := range config.Clusters {
+		if cl.Name != clusterName {
+			continue
+		}
+		found = true
+		c.server = strings.TrimRight(cl.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = cl.Cluster.InsecureSkipTLSVerify
+		ca, err := fileOrData(cl.Cluster.CertificateAuthority, cl.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in the certificate authority for cluster %s", clusterName)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig %s", clusterName, path)
+	}
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		c.token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(u.User.TokenFile)
+			if err != nil {
+				return nil, err
+			}
+			c.token = strings.TrimSpace(string(token))
+		}
+		cert, err := fileOrData(u.User.ClientCertificate, u.User.ClientCertificateData)
+		if err != nil {
+			return nil, err
+		}
+		key, err := fileOrData(u.User.ClientKey, u.User.ClientKeyData)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	c.http = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return c, nil
+}
+
+// fileOrData returns the contents of a kubeconfig setting that can either
+// name a file or be given inline as base64
+func fileOrData(path, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	return nil, nil
+}
+
+func (c *client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes API %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// GetEntries starts watching for pods matching the filters. It sends the log
+// stream of each of their containers down the returned channel as it's found.
+// When ctx is done the log streams are closed, and then the returned channel.
+func GetEntries(ctx context.Context, options Options) (chan tail.FileEntries, error) {
+	if options.StartFrom != "oldest" && options.StartFrom != "newest" {
+		return nil, fmt.Errorf("unknown option to --kubernetes.start_from: %s", options.StartFrom)
+	}
+	c, err := newClient(options)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{
+		ctx:     ctx,
+		client:  c,
+		options: options,
+		reading: make(map[string]bool),
+		stopped: make(map[string]time.Time),
+		streams: make(chan tail.FileEntries),
+	}
+	// make sure we can talk to the API server before we claim to be reading it
+	pods, err := w.list()
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"server": c.server,
+		"pods":   len(pods),
+	}).Info("reading kubernetes pod logs")
+	go func() {
+		defer close(w.streams)
+		// start is only called from here, so no more readers are added once
+		// this returns
+		defer w.readers.Wait()
+		w.start(pods, options.StartFrom == "newest")
+		ticker := time.NewTicker(time.Duration(options.PollInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			pods, err := w.list()
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.WithFields(logrus.Fields{"err": err}).Warn("failed to list kubernetes pods")
+				}
+				continue
+			}
+			w.start(pods, false)
+		}
+	}()
+	return w.streams, nil
+}
+
+// watcher tracks which containers we're reading
+type watcher struct {
+	ctx     context.Context
+	client  *client
+	options Options
+	streams chan tail.FileEntries
+	// readers waits for the containers' log streams to close
+	readers sync.WaitGroup
+
+	lock sync.Mutex
+	// reading and stopped are keyed by pod uid and container name
+	reading map[string]bool
+	// stopped remembers when we stopped reading a container, so that if it
+	// restarts we don't reread what we've already sent
+	stopped map[string]time.Time
+}
+
+func (w *watcher) list() ([]pod, error) {
+	path := "/api/v1/pods"
+	if w.options.Namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(w.options.Namespace) + "/pods"
+	}
+	query := url.Values{}
+	if w.options.Selector != "" {
+		query.Set("labelSelector", w.options.Selector)
+	}
+	resp, err := w.client.get(w.ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var pods podList
+	if err := json.NewDecoder(resp.Body).Decode(&pods); err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// start begins reading any containers we aren't already reading
+func (w *watcher) start(pods []pod, fromEnd bool) {
+	for _, p := range pods {
+		// pending pods have no logs yet and finished ones have no more
+		if p.Status.Phase != "Running" {
+			continue
+		}
+		for _, ctr := range p.Spec.Containers {
+			if w.options.Container != "" && ctr.Name != w.options.Container {
+				continue
+			}
+			key := p.Metadata.UID + "/" + ctr.Name
+			w.lock.Lock()
+			if w.reading[key] {
+				w.lock.Unlock()
+				continue
+			}
+			w.reading[key] = true
+			since, restarted := w.stopped[key]
+			w.lock.Unlock()
+
+			query := url.Values{}
+			query.Set("container", ctr.Name)
+			query.Set("follow", "true")
+			switch {
+			case restarted:
+				query.Set("sinceTime", since.UTC().Format(time.RFC3339))
+			case fromEnd:
+				query.Set("tailLines", "0")
+			}
+			lines, err := w.read(p, key, query)
+			if err != nil {
+				if w.ctx.Err() != nil {
+					return
+				}
+				logrus.WithFields(logrus.Fields{
+					"pod":       p.Metadata.Namespace + "/" + p.Metadata.Name,
+					"container": ctr.Name,
+					"err":       err,
+				}).Warn("failed to read kubernetes pod logs")
+				w.lock.Lock()
+				delete(w.reading, key)
+				w.lock.Unlock()
+				continue
+			}
+			select {
+			case w.streams <- tail.FileEntries{
+				Path:   "kubernetes://" + p.Metadata.Namespace + "/" + p.Metadata.Name + "/" + ctr.Name,
+				Lines:  lines,
+				Fields: podFields(p, ctr.Name),
+			}:
+			case <-w.ctx.Done():
+				// the stream's reader stops on its own
+				return
+			}
+		}
+	}
+}
+
+// read streams the logs of a container, one line at a time
+func (w *watcher) read(p pod, key string, query url.Values) (chan string, error) {
+	path := "/api/v1/namespaces/" + url.PathEscape(p.Metadata.Namespace) +
+		"/pods/" + url.PathEscape(p.Metadata.Name) + "/log"
+	resp, err := w.client.get(w.ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(chan string)
+	w.readers.Add(1)
+	go func() {
+		defer w.readers.Done()
+		defer close(lines)
+		// the body's reads fail once ctx is done
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			select {
+			case lines <- strings.TrimRight(scanner.Text(), "\r"):
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		if w.ctx.Err() != nil {
+			return
+		}
+		logrus.WithFields(logrus.Fields{
+			"pod":       p.Metadata.Namespace + "/" + p.Metadata.Name,
+			"container": query.Get("container"),
+		}).Info("kubernetes pod log stream ended")
+		w.lock.Lock()
+		delete(w.reading, key)
+		w.stopped[key] = time.Now()
+		w.lock.Unlock()
+	}()
+	return lines, nil
+}
+
+// podFields returns the fields added to every event from a pod's container
+func podFields(p pod, container string) map[string]interface{} {
+	fields := map[string]interface{}{
+		"pod_name":       p.Metadata.Name,
+		"pod_namespace":  p.Metadata.Namespace,
+		"pod_node":       p.Spec.NodeName,
+		"container_name": container,
+	}
+	for k, v := range p.Metadata.Labels {
+		fields["pod_label."+k] = v
+	}
+	return fields
+}
@@ -0,0 +1,91 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev-cluster
+  cluster:
+    server: https://dev.example.com:6443/
+    insecure-skip-tls-verify: true
+- name: prod-cluster
+  cluster:
+    server: https://prod.example.com
+users:
+- name: dev-user
+  user:
+    token: dev-token
+- name: prod-user
+  user:
+    token: prod-token
+contexts:
+- name: dev
+  context:
+    cluster: dev-cluster
+    user: dev-user
+- name: prod
+  context:
+    cluster: prod-cluster
+    user: prod-user
+`
+
+func TestKubeconfigClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tsts := []struct {
+		context        string
+		expectedServer string
+		expectedToken  string
+	}{
+		{"", "https://dev.example.com:6443", "dev-token"},
+		{"prod", "https://prod.example.com", "prod-token"},
+	}
+	for _, tt := range tsts {
+		c, err := kubeconfigClient(path, tt.context)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.server != tt.expectedServer || c.token != tt.expectedToken {
+			t.Errorf("context %q: expected %s with %s, got %s with %s",
+				tt.context, tt.expectedServer, tt.expectedToken, c.server, c.token)
+		}
+	}
+	if _, err := kubeconfigClient(path, "staging"); err == nil {
+		t.Error("expected an error for a context that doesn't exist")
+	}
+}
+
+func TestPodFields(t *testing.T) {
+	var p pod
+	p.Metadata.Name = "web-1234"
+	p.Metadata.Namespace = "default"
+	p.Metadata.Labels = map[string]string{"app": "web"}
+	p.Spec.NodeName = "node-a"
+	expected := map[string]interface{}{
+		"pod_name":       "web-1234",
+		"pod_namespace":  "default",
+		"pod_node":       "node-a",
+		"container_name": "nginx",
+		"pod_label.app":  "web",
+	}
+	if actual := podFields(p, "nginx"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
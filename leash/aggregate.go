@@ -0,0 +1,209 @@
+package leash
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// aggregateSamples is how many values of each --aggregate_field a bucket
+// keeps to work out its p95 from. Past that they're sampled, so that a busy
+// bucket doesn't hold on to every value it's seen.
+const aggregateSamples = 10000
+
+// aggregateStats summarises the values of an --aggregate_field in a bucket
+type aggregateStats struct {
+	sum, min, max float64
+	// seen is how many values there have been, of which samples holds up
+	// to aggregateSamples
+	seen    int
+	samples []float64
+}
+
+// add counts val, weighted by the rate it was sampled at in the sum
+func (s *aggregateStats) add(val float64, sampleRate uint) {
+	if s.seen == 0 || val < s.min {
+		s.min = val
+	}
+	if s.seen == 0 || val > s.max {
+		s.max = val
+	}
+	s.sum += val * float64(sampleRate)
+	s.seen++
+	if len(s.samples) < aggregateSamples {
+		s.samples = append(s.samples, val)
+	} else if i := rand.Intn(s.seen); i < aggregateSamples {
+		s.samples[i] = val
+	}
+}
+
+// p95 returns the 95th percentile of the samples, by nearest rank
+func (s *aggregateStats) p95() float64 {
+	return s.percentile(95)
+}
+
+// percentile returns the pth percentile of the samples, by nearest rank, or
+// 0 if there aren't any
+func (s *aggregateStats) percentile(p float64) float64 {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	sort.Float64s(s.samples)
+	return s.samples[int(math.Ceil(p/100*float64(len(s.samples))))-1]
+}
+
+// aggregateBucket is the summary of the events with the same values for the
+// --aggregate_by fields in a flush interval
+type aggregateBucket struct {
+	// first is the first event in the bucket, which the summary takes its
+	// key fields, timestamp and dataset from
+	first event.Event
+	md    eventMetadata
+	// count is how many events the bucket stands for, counting each as the
+	// number it was sampled at
+	count uint
+	stats map[string]*aggregateStats
+}
+
+// aggregator sends a summary of each bucket of events with the same values
+// for the --aggregate_by fields every --aggregate_interval, instead of the
+// events themselves. It's only used by one goroutine at a time.
+type aggregator struct {
+	keyFields   []string
+	valueFields []string
+	interval    time.Duration
+	buckets     map[string]*aggregateBucket
+	// order is the keys of the buckets, so they're sent in the order they
+	// were started
+	order []string
+}
+
+// newAggregator returns an aggregator bucketing by keyFields and summarising
+// valueFields, or nil if there are no keyFields, for no aggregation
+func newAggregator(keyFields, valueFields []string, interval time.Duration) *aggregator {
+	if len(keyFields) == 0 {
+		return nil
+	}
+	return &aggregator{
+		keyFields:   keyFields,
+		valueFields: valueFields,
+		interval:    interval,
+		buckets:     make(map[string]*aggregateBucket),
+	}
+}
+
+// key joins the dataset ev is going to and the values it has for the
+// keyFields, telling a missing field apart from an empty one
+func (a *aggregator) key(ev event.Event) string {
+	parts := []string{ev.Dataset}
+	for _, field := range a.keyFields {
+		part := ""
+		if val, ok := ev.Data[field]; ok {
+			part = fmt.Sprintf("%T:%v", val, val)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// add counts ev, sampled at sampleRate, in its bucket. It returns true if ev
+// started the bucket, whose summary is sent as md once it's flushed, and
+// false if ev was only counted and is done with.
+func (a *aggregator) add(ev event.Event, sampleRate uint, md eventMetadata) bool {
+	key := a.key(ev)
+	bucket, counted := a.buckets[key]
+	if !counted {
+		bucket = &aggregateBucket{first: ev, md: md, stats: make(map[string]*aggregateStats)}
+		a.buckets[key] = bucket
+		a.order = append(a.order, key)
+	}
+	bucket.count += sampleRate
+	for _, field := range a.valueFields {
+		val, ok := aggregateValue(ev.Data[field])
+		if !ok {
+			continue
+		}
+		stats, ok := bucket.stats[field]
+		if !ok {
+			stats = &aggregateStats{}
+			bucket.stats[field] = stats
+		}
+		stats.add(val, sampleRate)
+	}
+	return !counted
+}
+
+// flush returns a summary of each bucket, in the order they were started,
+// and starts over with none. Each has the bucket's key fields, its count and,
+// for each --aggregate_field it saw numbers for, <field>_sum, _min, _max and
+// _p95.
+func (a *aggregator) flush() []aggregateSummary {
+	if a == nil {
+		return nil
+	}
+	summaries := make([]aggregateSummary, 0, len(a.order))
+	for _, key := range a.order {
+		bucket := a.buckets[key]
+		data := map[string]interface{}{"count": bucket.count}
+		for _, field := range a.keyFields {
+			if val, ok := bucket.first.Data[field]; ok {
+				data[field] = val
+			}
+		}
+		for field, stats := range bucket.stats {
+			data[field+"_sum"] = stats.sum
+			data[field+"_min"] = stats.min
+			data[field+"_max"] = stats.max
+			data[field+"_p95"] = stats.p95()
+		}
+		summaries = append(summaries, aggregateSummary{
+			ev: event.Event{
+				Timestamp: bucket.first.Timestamp,
+				Data:      data,
+				Dataset:   bucket.first.Dataset,
+			},
+			md: bucket.md,
+		})
+	}
+	a.buckets = make(map[string]*aggregateBucket)
+	a.order = nil
+	return summaries
+}
+
+// tick returns a channel that fires every interval, or nil if there's no
+// aggregation
+func (a *aggregator) tick() (<-chan time.Time, func()) {
+	if a == nil {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(a.interval)
+	return ticker.C, ticker.Stop
+}
+
+// aggregateSummary is the event summarising a bucket, to be sent as md
+type aggregateSummary struct {
+	ev event.Event
+	md eventMetadata
+}
+
+// aggregateValue returns val as a number, if it is one or is a string of one
+func aggregateValue(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,124 @@
+package leash
+
+import (
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// backfillBatchLines is how many lines are handed to a --backfill_workers
+// parser at a time
+const backfillBatchLines = 512
+
+// independentParsers are the parsers that make each event from one line
+// alone, without anything from the lines before it, so lines can be parsed
+// side by side
+var independentParsers = map[string]bool{
+	"json":          true,
+	"nginx":         true,
+	"authlog":       true,
+	"elasticsearch": true,
+	"gelf":          true,
+	"cloudflare":    true,
+	"fastly":        true,
+}
+
+// parsesInParallel reports whether lines are to be parsed with
+// --backfill_workers: when they're read once to the end with --tail.stop, by
+// a parser that can have them in any order
+func parsesInParallel(options Config) bool {
+	return options.Tail.Stop && options.BackfillWorkers > 1 && independentParsers[options.Reqs.ParserName]
+}
+
+// lineProcessor makes events from a stream's lines: a parsers.Parser, or a
+// parallelParser
+type lineProcessor interface {
+	ProcessLines(lines <-chan string, send chan<- event.Event)
+}
+
+// parallelParser parses batches of lines with a parser each of its workers,
+// side by side, sending the events from each batch in the order the lines
+// were read
+type parallelParser struct {
+	workers []parsers.Parser
+}
+
+// lineBatch is lines being parsed by a worker, whose events are sent down
+// parsed once it's done with them
+type lineBatch struct {
+	lines  []string
+	parsed chan []event.Event
+}
+
+// newParallelParser returns a parser parsing the lines from path with
+// --backfill_workers parsers
+func newParallelParser(options Config, path string) (*parallelParser, error) {
+	p := &parallelParser{}
+	for i := uint(0); i < options.BackfillWorkers; i++ {
+		worker, err := newParser(options, path)
+		if err != nil {
+			for _, started := range p.workers {
+				closeParser(started)
+			}
+			return nil, err
+		}
+		p.workers = append(p.workers, worker)
+	}
+	return p, nil
+}
+
+// ProcessLines parses lines as the parsers.Parser of the same name does
+func (p *parallelParser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	work := make(chan *lineBatch)
+	// batches are queued in the order they were read, with room for every
+	// worker to have one and another to be waiting on each
+	ordered := make(chan *lineBatch, 2*len(p.workers))
+	for _, worker := range p.workers {
+		go parseBatches(worker, work)
+	}
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		batch := &lineBatch{}
+		for line := range lines {
+			batch.lines = append(batch.lines, line)
+			if len(batch.lines) < backfillBatchLines {
+				continue
+			}
+			batch.parsed = make(chan []event.Event, 1)
+			ordered <- batch
+			work <- batch
+			batch = &lineBatch{}
+		}
+		if len(batch.lines) > 0 {
+			batch.parsed = make(chan []event.Event, 1)
+			ordered <- batch
+			work <- batch
+		}
+	}()
+	for batch := range ordered {
+		for _, ev := range <-batch.parsed {
+			send <- ev
+		}
+	}
+}
+
+// parseBatches parses the batches from work with parser until work is closed
+func parseBatches(parser parsers.Parser, work chan *lineBatch) {
+	for batch := range work {
+		lines := make(chan string, len(batch.lines))
+		for _, line := range batch.lines {
+			lines <- line
+		}
+		close(lines)
+		events := make(chan event.Event, len(batch.lines))
+		go func() {
+			parser.ProcessLines(lines, events)
+			close(events)
+		}()
+		var parsed []event.Event
+		for ev := range events {
+			parsed = append(parsed, ev)
+		}
+		batch.parsed <- parsed
+	}
+}
@@ -0,0 +1,159 @@
+package leash
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// coerceTypes are the types a --coerce_field can turn a field into
+var coerceTypes = []string{"int", "float", "bool", "string"}
+
+// unitMultipliers are the suffixes a number may have when it's coerced to an
+// int or float, with what they multiply it by. Each may be followed by a B,
+// eg 3.4kB, 2MiB or 512B.
+var unitMultipliers = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"K":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+}
+
+// isCoerceType returns true if typ is one of coerceTypes
+func isCoerceType(typ string) bool {
+	for _, t := range coerceTypes {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// coerceValue converts val to typ, one of coerceTypes. Strings coerced to an
+// int or float may have a unit: durations like 12ms or 1.5s become a number
+// of milliseconds, and sizes like 3.4k or 2MiB are multiplied out. Ints are
+// rounded to the nearest whole number.
+func coerceValue(val interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case "string":
+		switch v := val.(type) {
+		case string:
+			return v, nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		}
+		return fmt.Sprintf("%v", val), nil
+	case "bool":
+		switch v := val.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return parseBool(v)
+		case float64:
+			return v != 0, nil
+		case int:
+			return v != 0, nil
+		case int64:
+			return v != 0, nil
+		}
+	case "int", "float":
+		// keep ints that are already ints exact
+		if typ == "int" {
+			switch v := val.(type) {
+			case int64:
+				return v, nil
+			case int:
+				return int64(v), nil
+			}
+		}
+		var f float64
+		switch v := val.(type) {
+		case string:
+			n, err := parseUnitNumber(v)
+			if err != nil {
+				return nil, err
+			}
+			f = n
+		case float64:
+			f = v
+		case int:
+			f = float64(v)
+		case int64:
+			f = float64(v)
+		case bool:
+			if v {
+				f = 1
+			}
+		default:
+			return nil, fmt.Errorf("can't make a number of %v", val)
+		}
+		if typ == "float" {
+			return f, nil
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > math.MaxInt64 {
+			return nil, fmt.Errorf("%v is out of range for an int", val)
+		}
+		return int64(math.Round(f)), nil
+	}
+	return nil, fmt.Errorf("can't make a %s of %v", typ, val)
+}
+
+// parseBool is strconv.ParseBool, also taking yes, no, on and off
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+	return strconv.ParseBool(strings.TrimSpace(s))
+}
+
+// parseUnitNumber parses a number that may have one of the unitMultipliers
+// or be a duration, which is returned in milliseconds
+func parseUnitNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	if f, ok := parseSize(s); ok {
+		return f, nil
+	}
+	if f, ok := parseDurationMS(s); ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("%q isn't a number, a size like 3.4k or a duration like 12ms", s)
+}
+
+// parseSize parses a number with one of the unitMultipliers, eg 3.4k or 2MiB,
+// returning it multiplied out
+func parseSize(s string) (float64, bool) {
+	unit := strings.TrimSuffix(strings.TrimLeft(s, "+-.0123456789eE"), "B")
+	multiplier, ok := unitMultipliers[unit]
+	if !ok {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSuffix(s, "B"), unit), 64)
+	if err != nil {
+		return 0, false
+	}
+	return f * multiplier, true
+}
+
+// parseDurationMS parses a duration like 12ms or 1m30s, returning it in
+// milliseconds
+func parseDurationMS(s string) (float64, bool) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, false
+	}
+	return float64(d) / float64(time.Millisecond), true
+}
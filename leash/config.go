@@ -0,0 +1,516 @@
+package leash
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeytail/aws"
+	"github.com/honeycombio/honeytail/cloudwatch"
+	"github.com/honeycombio/honeytail/docker"
+	"github.com/honeycombio/honeytail/eventlog"
+	"github.com/honeycombio/honeytail/gcp"
+	"github.com/honeycombio/honeytail/httpreceiver"
+	"github.com/honeycombio/honeytail/journald"
+	"github.com/honeycombio/honeytail/kafka"
+	"github.com/honeycombio/honeytail/kinesis"
+	"github.com/honeycombio/honeytail/kubernetes"
+	"github.com/honeycombio/honeytail/output"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/authlog"
+	"github.com/honeycombio/honeytail/parsers/auto"
+	"github.com/honeycombio/honeytail/parsers/cassandra"
+	"github.com/honeycombio/honeytail/parsers/clickhouse"
+	"github.com/honeycombio/honeytail/parsers/cloudflare"
+	"github.com/honeycombio/honeytail/parsers/elasticsearch"
+	"github.com/honeycombio/honeytail/parsers/epoch"
+	"github.com/honeycombio/honeytail/parsers/exec"
+	"github.com/honeycombio/honeytail/parsers/fastly"
+	"github.com/honeycombio/honeytail/parsers/gelf"
+	"github.com/honeycombio/honeytail/parsers/htjson"
+	"github.com/honeycombio/honeytail/parsers/mongodb"
+	"github.com/honeycombio/honeytail/parsers/mysql"
+	"github.com/honeycombio/honeytail/parsers/nginx"
+	"github.com/honeycombio/honeytail/parsers/phpfpm"
+	"github.com/honeycombio/honeytail/parsers/postfix"
+	"github.com/honeycombio/honeytail/parsers/rails"
+	"github.com/honeycombio/honeytail/parsers/stacktrace"
+	"github.com/honeycombio/honeytail/pubsub"
+	"github.com/honeycombio/honeytail/statsd"
+	"github.com/honeycombio/honeytail/syslog"
+	"github.com/honeycombio/honeytail/tail"
+	"github.com/honeycombio/honeytail/unixsocket"
+	flag "github.com/jessevdk/go-flags"
+)
+
+// Parsers are the names of the parsers honeytail has
+var Parsers = []string{
+	"auto",
+	"nginx",
+	"mongo",
+	"json",
+	"mysql",
+	"rails",
+	"stacktrace",
+	"authlog",
+	"postfix",
+	"phpfpm",
+	"elasticsearch",
+	"cassandra",
+	"clickhouse",
+	"gelf",
+	"cloudflare",
+	"fastly",
+	"exec",
+}
+
+// Config is everything a run of honeytail is told: all the top level CLI
+// flags it supports, which go-flags can parse straight into it
+type Config struct {
+	APIHost    string `hidden:"true" long:"api_host" description:"Host for the Honeycomb API" default:"https://api.honeycomb.io/"`
+	ConfigFile string `short:"c" long:"config" description:"YAML file of flags to use, eg /etc/honeytail/honeytail.conf, keyed by their long names, eg writekey or tail.read_from, with lists for flags that may be given more than once. Flags on the command line take precedence over it. An inputs list in it runs several inputs side by side, each with its own flags, eg parser, file, dataset and samplerate"`
+
+	// Inputs are the options for each of the inputs in the --config file,
+	// if it has any, in which case they're run instead
+	Inputs []Config `no-flag:"true"`
+
+	Plugins       []string `long:"plugin" description:"Go plugin to load parsers and outputs from, eg /usr/lib/honeytail/acme.so, built with -buildmode=plugin against this version of honeytail. Its parsers can then be given to --parser, and its outputs to --output. Linux, macOS and FreeBSD only. May be specified multiple times"`
+	PluginOptions []string `long:"plugin_option" description:"setting for a parser from a --plugin, as name=value. May be specified multiple times"`
+
+	WriteKeyFile    string `long:"writekey_file" description:"read the write key from this file, eg one a secret is mounted as, instead of giving it with --writekey"`
+	WriteKeyCommand string `long:"writekey_command" description:"run this command with the shell and use what it prints as the write key, instead of giving it with --writekey"`
+	WriteKeySecret  string `long:"writekey_secret" description:"fetch the write key from a secret store instead of giving it with --writekey: aws-secretsmanager://name or aws-ssm:///parameter/name, using --aws.region and the AWS credentials from the environment, or vault://secret/data/honeytail from $VAULT_ADDR with $VAULT_TOKEN. Add #field to take a field from a JSON secret; Vault's defaults to writekey"`
+
+	SampleRate         uint    `short:"r" long:"samplerate" description:"Only send 1 / N log lines" default:"1"`
+	NumSenders         uint    `short:"P" long:"poolsize" description:"Number of concurrent connections to open to Honeycomb" default:"10"`
+	BatchSize          uint    `long:"batch_size" description:"Most events to send to Honeycomb in one request" default:"50"`
+	BatchFrequency     uint    `long:"batch_frequency" description:"Milliseconds to wait for a batch to fill before sending what's in it" default:"100"`
+	PendingWork        uint    `long:"pending_work_capacity" description:"How many events to queue up waiting to be sent to Honeycomb. When it's full, reading waits for room, unless --drop_when_full is set" default:"10000"`
+	Msgpack            bool    `long:"msgpack" description:"Send events to the Honeycomb API encoded as msgpack rather than JSON, which takes less CPU and bandwidth. If the API won't take msgpack, sending falls back to JSON"`
+	DropWhenFull       bool    `long:"drop_when_full" description:"Drop events rather than slowing down reading when the queue to Honeycomb is full. How many were dropped is logged with the summary every --status_interval"`
+	MaxEventsPerSecond uint    `long:"max_events_per_second" description:"Most events to send each second, after sampling, with bursts of up to a second's worth. Reading slows down to keep to it. 0 for no limit"`
+	ReplaySpeed        float64 `long:"replay_speed" description:"Pace sending by the events' timestamps, as they happened, at this many times real time, eg 1 or 10, rather than sending as fast as they're read. For replaying a backfill, eg as a demo or to load test triggers"`
+	SkipPreflight      bool    `long:"skip_preflight" description:"Don't check the write key with the Honeycomb API at startup. By default, honeytail stops straight away if the key is rejected or can't send events"`
+	BackfillMarkers    bool    `long:"backfill_markers" description:"With --tail.stop, create Honeycomb markers at the start and end of the time the events read cover, labelled with the files read, once they've been sent"`
+	BackfillWorkers    uint    `long:"backfill_workers" description:"With --tail.stop, parse each file with this many parsers side by side, eg the number of CPUs, in batches of lines, sending the events in the order the lines were read. For the json, nginx, authlog, elasticsearch, gelf, cloudflare and fastly parsers, which make each event from one line; the rest parse as usual. A --tail.statefile position is then only saved once the whole file has been sent"`
+	FailOnErrorRate    string  `long:"fail_on_error_rate" description:"Once everything's been read, as in a backfill, exit with 2 if more than this percentage of the lines failed to parse, eg 5%. Whether or not it's given, honeytail exits with 3 if any events couldn't be sent, and 0 if everything went"`
+	ParseErrorLog      string  `long:"parse_error_log" description:"Write lines that fail to parse to this file, eg /var/log/honeytail/errors.log, as they were read, with why they failed, as one JSON object per line"`
+	ParseErrorLogRate  uint    `long:"parse_error_log_rate" description:"Most lines to write to the --parse_error_log each second; past that they're counted, and how many were left out is written along with the next line to fail after that second, or when honeytail exits. 0 for no limit" default:"10"`
+	Debug              bool    `long:"debug" description:"Print debugging output"`
+	StatusInterval     uint    `long:"status_interval" description:"how frequently, in seconds, to print out summary info" default:"60"`
+	StatusFormat       string  `long:"status_format" description:"How to print the summary info: text, logged with everything else, or json, printed to stdout as one object per line with how far through each file reading and sending are, and how far behind the end of the file sending is, in bytes and by the lines' timestamps, lines and events and their rates, errors and send latency percentiles. It's printed as well, without starting a new interval, whenever honeytail gets a SIGUSR1" default:"text"`
+	MaxRetries         uint    `long:"max_retries" description:"How many times to try sending events again after a network error, 5xx or 429 before giving up on them" default:"3"`
+	RetryBackoff       uint    `long:"retry_backoff" description:"Milliseconds to wait before trying to send events again, doubling with each retry up to 30 seconds. After a 429, sending waits as long as its Retry-After asks, holding back reading until then" default:"100"`
+	Proxy              string  `long:"proxy" description:"Proxy to send to the Honeycomb API through, as http://host:port, https://host:port or socks5://host:port, with user:password@ before the host if it needs them. Without it, HTTPS_PROXY and NO_PROXY from the environment are used"`
+	TLSCA              string  `long:"tls_ca" description:"PEM file of certificate authorities to trust for the Honeycomb API, or a proxy, instead of the system's"`
+	TLSCert            string  `long:"tls_cert" description:"PEM file of a client certificate to present to the Honeycomb API, along with --tls_key"`
+	TLSKey             string  `long:"tls_key" description:"PEM file of the private key for --tls_cert"`
+	TLSInsecure        bool    `long:"tls_insecure_skip_verify" description:"Don't check the Honeycomb API's certificate. Only for testing"`
+	StatusListen       string  `long:"status_listen" description:"Serve /healthz and /readyz on this address, eg :9090, for liveness and readiness probes. Each replies with JSON giving how many files are being read, when the last event was sent and whether that went, and lag_seconds, how far behind now the newest event sent was. /healthz is a 503 while nothing's being read, and /readyz also while the last event failed to send"`
+	MaxMemoryMB        uint    `long:"max_memory_mb" description:"Most memory, in MB, for honeytail to use, eg when it's running next to a database. The garbage collector works harder as it nears the limit, and past 90% of it reading is held back, or with --pipeline.when_full spill, events are spilled to disk, until it's down to 80%. 0 for no limit"`
+	MaxProcs           int     `long:"max_procs" description:"Most CPUs to run on at once, as GOMAXPROCS. By default, every CPU"`
+	Nice               int     `long:"nice" description:"Scheduling priority to run at, from -20 to 19, as nice, eg 10 to give way to a database on the same host. On Windows, 10 and up is idle priority, 1 to 9 below normal and below 0 above normal"`
+	ShutdownTimeout    uint    `long:"shutdown_timeout" description:"On SIGTERM or SIGINT, honeytail stops reading and sends the events it's already read. How long, in seconds, to wait for them to be sent before exiting anyway" default:"30"`
+
+	Deadline time.Duration `long:"deadline" description:"Stop reading after this long, eg 1h, and exit once what's been read has been sent, as on SIGTERM. With --tail.statefile, a backfill bounded this way carries on from where it stopped the next time it's run"`
+
+	TelemetryDataset  string        `long:"telemetry_dataset" description:"Send an event of honeytail's own stats to this Honeycomb dataset every --telemetry_interval: lines read and events sent, and their rates, parse errors and events that couldn't be sent, and their rates, how far behind the files sending is, memory use and goroutines. Sent with --writekey, whatever --output is"`
+	TelemetryInterval time.Duration `long:"telemetry_interval" description:"How often to send an event to the --telemetry_dataset, eg 60s" default:"60s"`
+
+	Timezone           string        `long:"timezone" description:"take timestamps without a zone to be in this timezone, eg America/New_York or UTC. By default syslog style timestamps are taken to be in local time and the rest in UTC"`
+	EpochUnit          string        `long:"epoch_unit" description:"what timestamps given as a count since the unix epoch count: s, ms, us or ns. By default the unit is guessed from the size of the count" default:"auto"`
+	MaxTimestampPast   time.Duration `long:"max_timestamp_past" description:"events with timestamps further in the past than this, eg 720h, are sent with the current time instead, and the time they had in a timestamp_clamped field. By default they're sent as they are"`
+	MaxTimestampFuture time.Duration `long:"max_timestamp_future" description:"events with timestamps further in the future than this, eg 1h, are sent with the current time instead, and the time they had in a timestamp_clamped field. By default they're sent as they are"`
+
+	SampleRules           []string      `long:"sample_rule" description:"sample events whose field compares to a value at a rate of their own, as field<op>value:rate, where op is one of = != > >= < <=, eg 'status>=500:1' to keep every error or 'path=/healthz:1000'. A rate of 0 drops them all. The first rule an event matches wins over --samplerate and --dynsampling. May be specified multiple times"`
+	DynSample             []string      `long:"dynsampling" description:"sample dynamically by the values of this field, giving each combination of the values of the --dynsampling fields, eg status_code and url_shape, its own sample rate so rare ones are kept and common ones sampled more heavily, averaging out at --samplerate. May be specified multiple times"`
+	DynWindowSec          uint          `long:"dynsample_window" description:"how often, in seconds, the --dynsampling rates are worked out again from the events seen since" default:"30"`
+	PreSampled            string        `long:"presampled_field" description:"the field holding the rate events were already sampled at before they were logged, eg samplerate. It's removed from the event and multiplied by honeytail's own sample rate to give the rate the event is sent with"`
+	OverloadMaxSampleRate uint          `long:"overload_max_samplerate" description:"When honeytail can't keep up, because the files are further behind than --overload_lag and falling further behind, or the --pipeline.event_buffer is nearly full, sample events more heavily rather than falling ever further behind, multiplying their sample rates by up to 2, 4, 8 and so on, but not past this rate, then back down once it's caught up. The rate each event was sent at is in its samplerate as usual. 0 to never do so"`
+	OverloadLag           time.Duration `long:"overload_lag" description:"how far behind the files' timestamps, eg 60s, honeytail can fall before --overload_max_samplerate raises sample rates" default:"60s"`
+	SampleField           string        `long:"sample_on_field" description:"decide which events are kept by a hash of this field, eg request_id or trace_id, rather than at random, so that every honeytail, and any other sampler hashing it the same way, keeps the same ones. Events without the field are sampled at random"`
+
+	DedupFields []string      `long:"dedup_field" description:"collapse events with the same values for this field, and the others given with --dedup_field, seen within --dedup_window of each other into the first of them, which is sent at the end of the window with a dedup_count of how many there were. For apps that log the same error over and over. May be specified multiple times"`
+	DedupWindow time.Duration `long:"dedup_window" description:"how long after the first of a run of duplicates, eg 10s, --dedup_field counts the rest against it before sending it" default:"10s"`
+
+	AggregateBy       []string      `long:"aggregate_by" description:"instead of an event for each line, send a summary of the lines with the same values for this field, and the others given with --aggregate_by, eg status_code and endpoint, every --aggregate_interval. Each has the fields' values and a count of the lines, counting each as the rate it was sampled at. May be specified multiple times"`
+	AggregateFields   []string      `long:"aggregate_field" description:"add <field>_sum, _min, _max and _p95 of the numbers in this field, eg duration_ms, to each --aggregate_by summary. May be specified multiple times"`
+	AggregateInterval time.Duration `long:"aggregate_interval" description:"how often, eg 60s, the --aggregate_by summaries are sent" default:"60s"`
+
+	ScrubFields            []string `long:"scrub_field" description:"for the field listed, apply a one-way hash to the field content. Nested fields are named with dots, eg request.headers.authorization, and * matches any name, eg *.password. May be specified multiple times"`
+	DropFields             []string `long:"drop_field" description:"do not send the field to Honeycomb. Nested fields are named with dots, eg request.headers.cookie, and * matches any name, eg *.password. May be specified multiple times"`
+	AllowFields            []string `long:"allow_field" description:"only send this field and the others given with --allow_field, dropping the rest. Fields added with --add_field are still sent. May be specified multiple times"`
+	RedactPatterns         []string `long:"redact_pattern" description:"mask whatever matches this in any string value of any field before sending it, as [REDACTED:name] for the built in email, credit_card, ssn and bearer_token patterns, or [REDACTED] for a regular expression. May be specified multiple times"`
+	AddFields              []string `long:"add_field" description:"add the field to every event. Field should be key=val. A dotted key, eg request.region=us, goes inside the nested request object if there is one. May be specified multiple times"`
+	HostMetadata           []string `long:"host_metadata" description:"add fields about where honeytail's running to every event: host for hostname and host_ip, ec2 for ec2_instance_id, ec2_instance_type, ec2_availability_zone and ec2_region, gce for gce_instance_id, gce_instance_name, gce_machine_type, gce_zone and gce_project_id, or kubernetes for a k8s_<name> field for each file in --podinfo_dir. Looked up once at startup. May be specified multiple times"`
+	PodInfoDir             string   `long:"podinfo_dir" description:"where the Kubernetes downward API volume is mounted, for --host_metadata kubernetes. Labels and annotations files become a k8s_labels.<key> or k8s_annotations.<key> field for each one" default:"/etc/podinfo"`
+	PathPattern            string   `long:"path_pattern" description:"Regular expression matched against the path of each file read. --dataset and --add_field may use {{path}}, {{dirname}} (the directory the file is in), {{basename}} (its name without the extension) and {{filename}}, along with this pattern's capture groups as {{1}}, {{2}} and so on, or {{name}} for (?P<name>...) groups, eg --path_pattern '/var/log/(?P<service>[^/]+)/' --add_field service={{service}}"`
+	DatasetField           string   `long:"dataset_field" description:"Send each event to the dataset named by the value of this field, eg service or vhost, rather than to --dataset. Events without the field go to --dataset. This applies to every --output, including honeycomb://dataset ones. The field can still be dropped with --drop_field"`
+	DatasetRoutes          []string `long:"dataset_route" description:"With --dataset_field, send events whose field has this value to this dataset, as value=dataset. Once any are given, events with values that have no route go to --dataset. May be specified multiple times"`
+	LowercaseFields        bool     `long:"lowercase_fields" description:"lowercase the name of every field, after parsing and before any other changes to the event, so the options that name fields use the new names"`
+	UnderscoreFields       bool     `long:"underscore_fields" description:"replace the spaces and dashes in the name of every field with underscores, eg X-Request-Id becomes X_Request_Id, after parsing and before any other changes to the event"`
+	StripFieldPrefixes     []string `long:"strip_field_prefix" description:"strip this prefix from the name of any field that has it, eg nginx_, before --lowercase_fields and --underscore_fields. Only the first prefix a field has is stripped. May be specified multiple times"`
+	RenameFields           []string `long:"rename_field" description:"rename a field, after parsing and before any other changes to the event. Specify as old=new, eg body_bytes_sent=bytes. May be specified multiple times"`
+	ExtractFields          []string `long:"extract_field" description:"match a regular expression against the contents of a field, adding what each named group captures as a field of the group's name. Specify as field:regex, eg path:/orders/(?P<order_id>[0-9]+). May be specified multiple times"`
+	RequestShape           string   `long:"request_shape" description:"break down the request in this field, eg nginx's request or a JSON path, into url_path, url_query and url_shape fields, where the shape has ids and query values replaced with ?. See the --request_* options"`
+	RequestPatterns        []string `long:"request_pattern" description:"path pattern for --request_shape, with :name for the segments that vary, eg /orders/:id. Paths matching it have it as their url_shape, and a url_path_<name> field for each :name. May be specified multiple times"`
+	RequestQueryParams     []string `long:"request_query_param" description:"query parameter to add as a url_query_<name> field with --request_shape, or * for all of them. May be specified multiple times"`
+	RequestDropQueryParams []string `long:"request_drop_query_param" description:"query parameter to leave out of everything --request_shape adds, eg a token. May be specified multiple times"`
+	CoerceFields           []string `long:"coerce_field" description:"convert a field to a real int, float, bool or string, eg so a regex parser's strings can be graphed as numbers. Specify as field:type, eg status:int. Numbers may have a unit: durations like 12ms or 1.5s become milliseconds, and sizes like 3.4k or 2MiB are multiplied out. Values that can't be converted are left as they are. May be specified multiple times"`
+	NormalizeFields        []string `long:"normalize_field" description:"add a <field>_ms or <field>_bytes field with the duration or size in a field, eg 1.2s or 3MB, as a number. Specify as field:duration or field:size, with an optional unit for numbers without one, eg request_time:duration:s. Otherwise they're taken to be milliseconds or bytes. May be specified multiple times"`
+	DeriveFields           []string `long:"derive_field" description:"set a field to the result of an expression over the event's other fields, as name=expr, eg 'backend_ms=total_ms - upstream_ms' or 'tier=status >= 500 ? \"error\" : \"ok\"'. Expressions may use numbers, quoted strings, field names, + - * / %, comparisons, && || !, parentheses and cond ? a : b, where + joins strings. Runs after the --coerce_field and --normalize_field changes, and fields derived earlier can be used. May be specified multiple times"`
+	GeoIPField             string   `long:"geoip_field" description:"look up the client IP address in this field, eg remote_addr, in the --geoip_db databases, adding geo_country, geo_region, geo_city, geo_asn and geo_as_org fields. A port or X-Forwarded-For list in the field is fine"`
+	GeoIPDBs               []string `long:"geoip_db" description:"path to a MaxMind database for --geoip_field, eg GeoLite2-City.mmdb. ASNs are in a separate database, eg GeoLite2-ASN.mmdb, so may be specified multiple times"`
+	Script                 string   `long:"script" description:"Lua file defining a transform(fields) function to run on each event, after every other change to it. It's given the event's fields as a table it can change, and returns false to drop the event, a table of fields to send instead, or nothing to send the fields it was given. An event it fails on is sent unchanged, and the failures are counted in a warning at most once a minute"`
+	ParseFields            []string `long:"parse_field" description:"run the contents of a field through a second parser and merge the fields it finds into the event. Specify as field:parser, eg message:json. Options for the second parser come from its usual flags. May be specified multiple times"`
+
+	Docker     bool     `long:"docker" description:"Read the logs of running docker containers, as filtered by the --docker.* options"`
+	Kubernetes bool     `long:"kubernetes" description:"Read the logs of running kubernetes pods, as filtered by the --kubernetes.* options"`
+	ListenHTTP string   `long:"listen-http" description:"Accept log lines POSTed to this address, eg :8080. Bodies may be newline separated lines, NDJSON or a JSON array. See the --http.* options"`
+	Output     []string `long:"output" description:"Where to send events instead of the Honeycomb API. May be specified multiple times to send every event to each of them, eg to keep a file copy of what's sent to Honeycomb; an event only counts as sent once every output has it. Use honeycomb:// for the Honeycomb API with --dataset, or honeycomb://dataset for another dataset, or file://path/to/events.ndjson to write them to a file as newline delimited JSON, one {\"time\", \"dataset\", \"samplerate\", \"data\"} object per line, kafka://broker1:9092,broker2:9092/topic to produce the same objects to a kafka topic, an http:// or https:// URL to POST them to in batches, or otlp://collector:4317 to export them as OpenTelemetry logs over gRPC (otlps:// for TLS; otlp+http://collector:4318 or otlp+https:// for OTLP/HTTP). See the --output.* options"`
+
+	Reqs  RequiredOptions `group:"Required Options"`
+	Modes OtherModes      `group:"Other Modes"`
+
+	OutputOptions     output.Options       `group:"Output Options" namespace:"output"`
+	Tail              tail.TailOptions     `group:"Tail Options" namespace:"tail"`
+	Syslog            syslog.Options       `group:"Syslog Listener Options" namespace:"syslog"`
+	Unix              unixsocket.Options   `group:"Unix Socket Options" namespace:"unix"`
+	EventLog          eventlog.Options     `group:"Windows Event Log Options" namespace:"eventlog"`
+	Journald          journald.Options     `group:"Journald Options" namespace:"journald"`
+	Kafka             kafka.Options        `group:"Kafka Input Options" namespace:"kafka"`
+	DockerOptions     docker.Options       `group:"Docker Input Options" namespace:"docker"`
+	KubernetesOptions kubernetes.Options   `group:"Kubernetes Input Options" namespace:"kubernetes"`
+	HTTP              httpreceiver.Options `group:"HTTP Receiver Options" namespace:"http"`
+	AWS               aws.Options          `group:"AWS Options" namespace:"aws"`
+	Kinesis           kinesis.Options      `group:"Kinesis Input Options" namespace:"kinesis"`
+	CloudWatch        cloudwatch.Options   `group:"CloudWatch Logs Input Options" namespace:"cloudwatch"`
+	GCP               gcp.Options          `group:"GCP Options" namespace:"gcp"`
+	PubSub            pubsub.Options       `group:"Pub/Sub Input Options" namespace:"pubsub"`
+	Statsd            statsd.Options       `group:"StatsD Metrics Options" namespace:"statsd"`
+	Pipeline          PipelineOptions      `group:"Pipeline Options" namespace:"pipeline"`
+
+	Auto          auto.Options          `group:"Auto Detection Options" namespace:"auto"`
+	Nginx         nginx.Options         `group:"Nginx Parser Options" namespace:"nginx"`
+	JSON          htjson.Options        `group:"JSON Parser Options" namespace:"json"`
+	MySQL         mysql.Options         `group:"MySQL Parser Options" namespace:"mysql"`
+	Mongo         mongodb.Options       `group:"MongoDB Parser Options" namespace:"mongo"`
+	Rails         rails.Options         `group:"Rails Parser Options" namespace:"rails"`
+	StackTrace    stacktrace.Options    `group:"Stack Trace Parser Options" namespace:"stacktrace"`
+	AuthLog       authlog.Options       `group:"Auth Log Parser Options" namespace:"authlog"`
+	Postfix       postfix.Options       `group:"Postfix Parser Options" namespace:"postfix"`
+	PHPFPM        phpfpm.Options        `group:"PHP-FPM Parser Options" namespace:"phpfpm"`
+	Elasticsearch elasticsearch.Options `group:"Elasticsearch Parser Options" namespace:"elasticsearch"`
+	Cassandra     cassandra.Options     `group:"Cassandra Parser Options" namespace:"cassandra"`
+	ClickHouse    clickhouse.Options    `group:"ClickHouse Parser Options" namespace:"clickhouse"`
+	GELF          gelf.Options          `group:"GELF Parser Options" namespace:"gelf"`
+	Cloudflare    cloudflare.Options    `group:"Cloudflare Logpush Parser Options" namespace:"cloudflare"`
+	Fastly        fastly.Options        `group:"Fastly Parser Options" namespace:"fastly"`
+	Exec          exec.Options          `group:"Exec Parser Options" namespace:"exec"`
+
+	// parseErrors counts the lines the run's parsers couldn't parse. run
+	// sets it.
+	parseErrors *parsers.ErrorCounter
+}
+
+type RequiredOptions struct {
+	ParserName string   `short:"p" long:"parser" description:"Parser module to use. Use --list to list available options."`
+	WriteKey   string   `short:"k" long:"writekey" description:"Team write key"`
+	LogFiles   []string `short:"f" long:"file" description:"Log file(s) to parse. Use '-' for STDIN, use this flag multiple times to tail multiple files, or use a glob (/path/to/foo-*.log). Use syslog://host:port (or syslog+udp://, syslog+tcp://) to receive syslog messages over the network, journald:// to read the systemd journal, kinesis://stream to read a Kinesis stream, cloudwatch://log-group to poll a CloudWatch Logs group, pubsub://project/subscription to pull from a Pub/Sub subscription (unwrapping Cloud Logging entries), or unix:///path/to/socket (unixgram:// for datagrams) to listen on a unix socket. On Windows, use eventlog://channel (eg eventlog://Application) to read the event log as JSON. Named pipes are reopened each time their writer closes them. Gzip, bzip2 and zstd compressed files are decompressed and read once from the start"`
+	Dataset    string   `short:"d" long:"dataset" description:"Name of the dataset. May be a template filled in from the path of each file read, eg {{dirname}}; see --path_pattern"`
+}
+
+type OtherModes struct {
+	Help        bool `short:"h" long:"help" description:"Show this help message"`
+	ListParsers bool `short:"l" long:"list" description:"List available parsers"`
+	Version     bool `short:"V" long:"version" description:"Show version"`
+	Validate    bool `long:"validate" description:"Check the flags and --config file, that the parsers and transforms can be set up, eg that their regexes compile and nginx formats are found, that state files can be written and, unless --skip_preflight is given, the write key, then exit. Exits non-zero with the first problem found"`
+	SampleLines uint `long:"sample_lines" description:"Read the first N lines of the first file, or stdin, and print the events they're parsed into, where each one's timestamp came from, the lines that didn't parse and what the transforms would drop or change, then exit without sending anything"`
+	Benchmark   bool `long:"benchmark" description:"Read the files once from the start, through the parser and transforms as usual, but send the events nowhere, then print how fast that went: lines and MB a second, the parse error rate and CPU seconds per million lines, to size hosts and compare parser configurations. Where the files were read up to isn't saved"`
+
+	DescribeParser string `long:"describe_parser" description:"Show what a parser's logs look like, the timestamp formats it reads and its options"`
+
+	WriteManPage bool `hidden:"true" long:"write-man-page" description:"Write out a man page"`
+}
+
+// DefaultConfig returns a Config with every flag at its default, to fill in
+// with the rest. Flags left empty in a Config made otherwise are taken as
+// their defaults where that's what honeytail did before it had any.
+func DefaultConfig() Config {
+	var cfg Config
+	flag.NewParser(&cfg, flag.None).ParseArgs(nil)
+	return cfg
+}
+
+// CheckConfig returns the first problem with cfg that can be found without
+// starting up, checking each of the --config file's inputs, if it has any,
+// instead of cfg itself
+func CheckConfig(cfg Config) error {
+	if len(cfg.Inputs) == 0 {
+		return checkInput(cfg)
+	}
+	for i, input := range cfg.Inputs {
+		if err := checkInput(input); err != nil {
+			return fmt.Errorf("input %d: %s", i+1, err)
+		}
+		if shared := sharedInputOption(cfg, input); shared != "" {
+			return fmt.Errorf("--%s is shared by every input, so input %d can't set its own", shared, i+1)
+		}
+	}
+	return nil
+}
+
+// sharedInputOption returns the first of the flags shared by every --config
+// input that input gives differently from options, or "" if there isn't one.
+// libhoney and the parsers' timestamp settings are set up once for them all.
+func sharedInputOption(options, input Config) string {
+	switch {
+	case input.Reqs.WriteKey != options.Reqs.WriteKey:
+		return "writekey"
+	case input.APIHost != options.APIHost:
+		return "api_host"
+	case input.Timezone != options.Timezone:
+		return "timezone"
+	case input.EpochUnit != options.EpochUnit:
+		return "epoch_unit"
+	case input.MaxMemoryMB != options.MaxMemoryMB:
+		return "max_memory_mb"
+	case input.MaxProcs != options.MaxProcs:
+		return "max_procs"
+	case input.Nice != options.Nice:
+		return "nice"
+	case strings.Join(input.Plugins, "\n") != strings.Join(options.Plugins, "\n"):
+		return "plugin"
+	}
+	return ""
+}
+
+// checkInput returns the first problem with the flags of one input that can
+// be found without starting it up
+func checkInput(options Config) error {
+	switch {
+	case options.Reqs.ParserName == "":
+		return errors.New("parser required")
+	case options.Reqs.ParserName == "exec" && options.Exec.Command == "":
+		return errors.New("the exec parser needs --exec.command to run")
+	case !validOutputs(options.Output):
+		return errors.New("--output must be a honeycomb://, file://, kafka://, http://, https://, otlp://, otlps://, otlp+http:// or otlp+https:// URL, or one for an output from a --plugin")
+	case sendsToHoneycomb(options.Output) && !options.Modes.Benchmark && (options.Reqs.WriteKey == "" || options.Reqs.WriteKey == "NULL"):
+		return errors.New("write key required")
+	case len(options.Reqs.LogFiles) == 0 && options.Kafka.Topic == "" && !options.Docker && !options.Kubernetes && options.ListenHTTP == "":
+		return errors.New("log file name, '-', a kafka topic, --docker, --kubernetes or --listen-http required")
+	case !validPluginOptions(options.PluginOptions):
+		return errors.New("--plugin_option must be name=value")
+	case len(options.DatasetRoutes) > 0 && options.DatasetField == "":
+		return errors.New("--dataset_route needs --dataset_field to say which field to route by")
+	case needsDataset(options.Output) && !options.Modes.Benchmark && options.Reqs.Dataset == "":
+		return errors.New("dataset name required")
+	case options.Tail.ReadFrom == "end" && options.Tail.Stop:
+		return errors.New("Reading from the end and stopping when we get there. Zero lines to process. Ok, all done! ;)")
+	case options.RequestShape == "" && len(options.RequestPatterns)+len(options.RequestQueryParams)+len(options.RequestDropQueryParams) > 0:
+		return errors.New("the --request_* options need --request_shape to say which field has the request")
+	case (options.GeoIPField == "") != (len(options.GeoIPDBs) == 0):
+		return errors.New("--geoip_field and --geoip_db must be given together")
+	case !validHostMetadata(options.HostMetadata):
+		return errors.New("--host_metadata must be one of " + strings.Join(hostMetadataSources, ", "))
+	case !splitsAddFields(options.AddFields):
+		return errors.New("--add_field must be key=val")
+	case addsWildcardField(options.AddFields):
+		return errors.New("--add_field needs a field name without wildcards")
+	case len(options.DynSample) > 0 && options.SampleRate <= 1:
+		return errors.New("--dynsampling needs a --samplerate above 1 to aim for")
+	case len(options.DynSample) > 0 && options.DynWindowSec == 0:
+		return errors.New("--dynsample_window must be at least a second")
+	case options.OverloadMaxSampleRate > 1 && options.OverloadLag <= 0:
+		return errors.New("--overload_lag must be longer than 0")
+	case len(options.DedupFields) > 0 && options.DedupWindow <= 0:
+		return errors.New("--dedup_window must be longer than 0")
+	case len(options.AggregateFields) > 0 && len(options.AggregateBy) == 0:
+		return errors.New("--aggregate_field needs --aggregate_by to summarise the events by")
+	case len(options.AggregateBy) > 0 && options.AggregateInterval <= 0:
+		return errors.New("--aggregate_interval must be longer than 0")
+	case len(options.AggregateBy) > 0 && len(options.DedupFields) > 0:
+		return errors.New("--aggregate_by already collapses events, so can't be used with --dedup_field")
+	case options.TelemetryDataset != "" && (options.Reqs.WriteKey == "" || options.Reqs.WriteKey == "NULL"):
+		return errors.New("--telemetry_dataset needs a write key to send with")
+	case options.TelemetryDataset != "" && options.TelemetryInterval <= 0:
+		return errors.New("--telemetry_interval must be longer than 0")
+	case options.StatusFormat != "" && options.StatusFormat != "text" && options.StatusFormat != "json":
+		return errors.New("--status_format must be text or json")
+	case options.Pipeline.LineBuffer < 0 || options.Pipeline.EventBuffer < 0:
+		return errors.New("--pipeline.line_buffer and --pipeline.event_buffer can't be negative")
+	case options.Pipeline.WhenFull != "" && options.Pipeline.WhenFull != whenFullBlock && options.Pipeline.WhenFull != whenFullDropOldest && options.Pipeline.WhenFull != whenFullSpill:
+		return errors.New("--pipeline.when_full must be block, drop_oldest or spill")
+	case options.Pipeline.WhenFull != "" && options.Pipeline.WhenFull != whenFullBlock && options.Pipeline.EventBuffer == 0:
+		return fmt.Errorf("--pipeline.when_full %s needs a --pipeline.event_buffer to be full", options.Pipeline.WhenFull)
+	case options.Pipeline.WhenFull == whenFullSpill && options.Pipeline.SpillDir == "":
+		return errors.New("--pipeline.when_full spill needs a --pipeline.spill_dir to spill to")
+	case options.ReplaySpeed < 0:
+		return errors.New("--replay_speed can't be negative")
+	case options.Deadline < 0:
+		return errors.New("--deadline can't be negative")
+	case (options.TLSCert == "") != (options.TLSKey == ""):
+		return errors.New("--tls_cert and --tls_key must be given together")
+	case options.Tail.StateFile != "" && options.Tail.StateDir != "":
+		return errors.New("Only one of --tail.statefile and --tail.statedir may be set")
+	}
+	if _, _, err := timestampSettings(options); err != nil {
+		return err
+	}
+	if options.FailOnErrorRate != "" {
+		if _, err := parseErrorRate(options.FailOnErrorRate); err != nil {
+			return err
+		}
+	}
+	if _, _, err := tail.TimeWindow(options.Tail); err != nil {
+		return err
+	}
+	if _, err := tail.LastLines(options.Tail); err != nil {
+		return err
+	}
+	if err := checkTransformSpecs(options); err != nil {
+		return err
+	}
+	pattern, err := pathPattern(options)
+	if err != nil {
+		return err
+	}
+	for _, tmpl := range append([]string{options.Reqs.Dataset}, options.AddFields...) {
+		if err := checkPathTemplate(tmpl, pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTransformSpecs returns the first of the transform flags that can't be
+// separated into its parts, or whose regex or expression doesn't compile
+func checkTransformSpecs(options Config) error {
+	for _, spec := range options.ParseFields {
+		if _, _, err := parseParseFieldSpec(spec, options); err != nil {
+			return err
+		}
+	}
+	for _, spec := range options.RenameFields {
+		if _, _, err := parseRenameSpec(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range options.ExtractFields {
+		if _, _, err := parseExtractSpec(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range options.CoerceFields {
+		if _, _, err := parseCoerceSpec(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range options.NormalizeFields {
+		if _, err := newUnitNormalizer(spec); err != nil {
+			return fmt.Errorf("unable to use provided --normalize_field: %s", err)
+		}
+	}
+	for _, spec := range options.DeriveFields {
+		if _, _, err := parseDeriveSpec(spec); err != nil {
+			return err
+		}
+	}
+	for _, spec := range options.RedactPatterns {
+		if _, err := newRedactor(spec); err != nil {
+			return fmt.Errorf("unable to use provided --redact_pattern: %s", err)
+		}
+	}
+	return nil
+}
+
+// pathPattern returns the compiled --path_pattern, or nil if it isn't set
+func pathPattern(options Config) (*regexp.Regexp, error) {
+	if options.PathPattern == "" {
+		return nil, nil
+	}
+	pattern, err := regexp.Compile(options.PathPattern)
+	if err != nil {
+		return nil, fmt.Errorf("--path_pattern %q isn't a valid regular expression: %s", options.PathPattern, err)
+	}
+	return pattern, nil
+}
+
+// validOutputs returns true if each --output is a URL for an output we have
+func validOutputs(urls []string) bool {
+	for _, url := range urls {
+		if !output.IsHoneycombURL(url) && !output.IsFileURL(url) && !output.IsKafkaURL(url) &&
+			!output.IsHTTPURL(url) && !output.IsOTLPURL(url) && pluginOutput(url) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// sendsToHoneycomb returns true if events go to the Honeycomb API, which is
+// where they go when there's no --output
+func sendsToHoneycomb(urls []string) bool {
+	if len(urls) == 0 {
+		return true
+	}
+	for _, url := range urls {
+		if output.IsHoneycombURL(url) {
+			return true
+		}
+	}
+	return false
+}
+
+// needsDataset returns true if events are sent to Honeycomb without a
+// dataset of their own in the --output, so --dataset is needed
+func needsDataset(urls []string) bool {
+	if len(urls) == 0 {
+		return true
+	}
+	for _, url := range urls {
+		if output.IsHoneycombURL(url) && output.HoneycombDataset(url, "") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// splitsAddFields returns true if every --add_field is a key=val pair
+func splitsAddFields(fields []string) bool {
+	for _, field := range fields {
+		if !strings.Contains(field, "=") {
+			return false
+		}
+	}
+	return true
+}
+
+// addsWildcardField returns true if any --add_field has a wildcard in its
+// name, so there's no telling what to add
+func addsWildcardField(fields []string) bool {
+	for _, field := range fields {
+		if newFieldPath(strings.SplitN(field, "=", 2)[0]).hasWildcards() {
+			return true
+		}
+	}
+	return false
+}
+
+// timestampSettings returns the location of --timezone, or nil if it isn't
+// given, and the --epoch_unit
+func timestampSettings(options Config) (*time.Location, epoch.Unit, error) {
+	var loc *time.Location
+	if options.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(options.Timezone); err != nil {
+			return nil, epoch.Auto, fmt.Errorf("unknown --timezone %q: %s", options.Timezone, err)
+		}
+	}
+	unit, err := epoch.ParseUnit(options.EpochUnit)
+	if err != nil {
+		return nil, epoch.Auto, fmt.Errorf("bad --epoch_unit: %s", err)
+	}
+	return loc, unit, nil
+}
@@ -0,0 +1,106 @@
+package leash
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// dedupEvent is the first of a run of duplicate events, held until the
+// --dedup_window is up so it's sent with how many there were
+type dedupEvent struct {
+	ev         event.Event
+	sampleRate uint
+	md         eventMetadata
+	count      int
+	first      time.Time
+}
+
+// deduper collapses events with the same values for the --dedup_field fields
+// seen within --dedup_window of each other into the first of them, which is
+// sent with a dedup_count. It's only used by one goroutine at a time.
+type deduper struct {
+	fields []string
+	window time.Duration
+	held   map[uint64]*dedupEvent
+	// order is the keys of the held events, oldest first, which with a
+	// single window is also the order they're due out in
+	order []uint64
+}
+
+// newDeduper returns a deduper keyed by fields, or nil if there are none,
+// for no deduplication
+func newDeduper(fields []string, window time.Duration) *deduper {
+	if len(fields) == 0 {
+		return nil
+	}
+	return &deduper{
+		fields: fields,
+		window: window,
+		held:   make(map[uint64]*dedupEvent),
+	}
+}
+
+// key hashes the values ev has for the fields, telling a missing field apart
+// from an empty one
+func (d *deduper) key(ev event.Event) uint64 {
+	h := fnv.New64a()
+	for _, field := range d.fields {
+		if val, ok := ev.Data[field]; ok {
+			fmt.Fprintf(h, "%T:%v", val, val)
+		}
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+// add holds ev, seen at now, if it's the first of its key in the window and
+// returns true. Otherwise it counts ev against the one held and returns false,
+// and ev can be dropped.
+func (d *deduper) add(ev event.Event, sampleRate uint, md eventMetadata, now time.Time) bool {
+	key := d.key(ev)
+	if held, ok := d.held[key]; ok {
+		held.count++
+		return false
+	}
+	d.held[key] = &dedupEvent{ev: ev, sampleRate: sampleRate, md: md, count: 1, first: now}
+	d.order = append(d.order, key)
+	return true
+}
+
+// expired returns the held events whose window was up by now, oldest first,
+// with their dedup_count set. They're no longer held, so the next event with
+// the same key starts a new window. A zero now returns every held event.
+func (d *deduper) expired(now time.Time) []*dedupEvent {
+	if d == nil {
+		return nil
+	}
+	var due []*dedupEvent
+	for len(d.order) > 0 {
+		held := d.held[d.order[0]]
+		if !now.IsZero() && now.Sub(held.first) < d.window {
+			break
+		}
+		held.ev.Data["dedup_count"] = held.count
+		due = append(due, held)
+		delete(d.held, d.order[0])
+		d.order = d.order[1:]
+	}
+	return due
+}
+
+// tick returns a channel that fires often enough to send held events soon
+// after their window's up, or nil if there's no deduplication
+func (d *deduper) tick() (<-chan time.Time, func()) {
+	if d == nil {
+		return nil, func() {}
+	}
+	interval := d.window / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
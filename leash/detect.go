@@ -0,0 +1,85 @@
+package leash
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/auto"
+)
+
+// DetectParser returns the name of the parser --parser auto would choose for
+// lines, or "" if none of them understand them, trying each with its options
+// from cfg
+func DetectParser(cfg Config, lines []string) string {
+	return (&auto.Parser{Candidates: autoCandidates(cfg)}).Detect(lines)
+}
+
+// SuggestTimeField returns the field the json parser finds timestamps in for
+// the most of lines, if it doesn't find them by itself, or "" if it does or
+// no field has them, for honeytail init
+func SuggestTimeField(options Config, lines []string) string {
+	options.Reqs.ParserName = "json"
+	parse := func(timeField string) []previewEvent {
+		options.JSON.TimeFieldName = timeField
+		parser, err := newParser(options, "")
+		if err != nil {
+			return nil
+		}
+		return parsePreviewLines(parser, lines)
+	}
+	events := parse("")
+	if loggedTimestamps(events) > 0 {
+		return ""
+	}
+	seen := make(map[string]bool)
+	var fields []string
+	for _, p := range events {
+		for field := range p.ev.Data {
+			if !seen[field] {
+				seen[field] = true
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	best, bestCount := "", 0
+	for _, field := range fields {
+		if count := loggedTimestamps(parse(field)); count > bestCount {
+			best, bestCount = field, count
+		}
+	}
+	return best
+}
+
+// loggedTimestamps counts the events with a timestamp taken from their line,
+// rather than the time they were read. Years before 2000 are more likely to
+// be numbers read as a time since the epoch than timestamps.
+func loggedTimestamps(events []previewEvent) int {
+	now := time.Now()
+	count := 0
+	for _, p := range events {
+		ts := p.ev.Timestamp
+		if ts.Year() >= 2000 && (ts.Sub(now) < -time.Minute || ts.Sub(now) > time.Minute) {
+			count++
+		}
+	}
+	return count
+}
+
+// DescribeParser returns what the parser called name says about the logs it
+// reads, for honeytail parsers describe
+func DescribeParser(name string) (parsers.Description, error) {
+	var options Config
+	options.Reqs.ParserName = name
+	parser, _ := getParserAndOptions(options)
+	if parser == nil {
+		return parsers.Description{}, fmt.Errorf("there's no %s parser. Use honeytail parsers list to show them", name)
+	}
+	describer, ok := parser.(parsers.Describer)
+	if !ok {
+		return parsers.Description{}, fmt.Errorf("the %s parser can't describe itself", name)
+	}
+	return describer.Describe(), nil
+}
@@ -0,0 +1,76 @@
+package leash
+
+import (
+	"path"
+	"strings"
+)
+
+// fieldPath is a field named by --drop_field, --scrub_field or --add_field,
+// split on its dots, eg request.headers.authorization. Each part may be a
+// wildcard, as in path.Match, so *.password is the password in any object.
+type fieldPath []string
+
+// newFieldPath splits a field name on its dots
+func newFieldPath(name string) fieldPath {
+	return fieldPath(strings.Split(name, "."))
+}
+
+// hasWildcards returns true if any part of p is a pattern
+func (p fieldPath) hasWildcards() bool {
+	for _, part := range p {
+		if strings.ContainsAny(part, `*?[\`) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPart returns true if name matches part of a fieldPath, either exactly or
+// as a pattern
+func matchPart(part, name string) bool {
+	if part == name {
+		return true
+	}
+	matched, err := path.Match(part, name)
+	return err == nil && matched
+}
+
+// walk calls fn with each map in data, or in the maps nested in it, and the
+// key in that map of each field p matches. Fields may be nested, eg from the
+// JSON parser, or flattened into dotted names like request.headers.host, or
+// a mix of the two. fn may delete or replace the field.
+func (p fieldPath) walk(data map[string]interface{}, fn func(m map[string]interface{}, key string)) {
+	for key, val := range data {
+		parts := strings.Split(key, ".")
+		if len(parts) > len(p) {
+			continue
+		}
+		matched := true
+		for i, part := range parts {
+			if !matchPart(p[i], part) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if len(parts) == len(p) {
+			fn(data, key)
+		} else if nested, ok := val.(map[string]interface{}); ok {
+			p[len(parts):].walk(nested, fn)
+		}
+	}
+}
+
+// set puts val in data at p, which has no wildcards, inside the maps already
+// nested in data along the way, or otherwise as a dotted name
+func (p fieldPath) set(data map[string]interface{}, val interface{}) {
+	for i := 1; i < len(p); i++ {
+		if nested, ok := data[strings.Join(p[:i], ".")].(map[string]interface{}); ok {
+			p[i:].set(nested, val)
+			return
+		}
+	}
+	data[strings.Join(p, ".")] = val
+}
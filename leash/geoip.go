@@ -0,0 +1,97 @@
+package leash
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoipRecord is what's looked up in each --geoip_db. City databases fill in
+// the location and ASN databases the autonomous system, so one struct does
+// for both.
+type geoipRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoipDBs are the MaxMind databases given with --geoip_db
+type geoipDBs []*maxminddb.Reader
+
+// openGeoIP opens each of the MaxMind databases at paths
+func openGeoIP(paths []string) (geoipDBs, error) {
+	var dbs geoipDBs
+	for _, path := range paths {
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			dbs.Close()
+			return nil, err
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, nil
+}
+
+// lookup returns the geo_country, geo_region, geo_city, geo_asn and geo_as_org
+// fields for ip, leaving out any the databases don't know
+func (dbs geoipDBs) lookup(ip net.IP) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	for _, db := range dbs {
+		var rec geoipRecord
+		if err := db.Lookup(ip, &rec); err != nil {
+			return nil, err
+		}
+		if rec.Country.IsoCode != "" {
+			fields["geo_country"] = rec.Country.IsoCode
+		}
+		if len(rec.Subdivisions) > 0 {
+			if name := rec.Subdivisions[0].Names["en"]; name != "" {
+				fields["geo_region"] = name
+			} else if rec.Subdivisions[0].IsoCode != "" {
+				fields["geo_region"] = rec.Subdivisions[0].IsoCode
+			}
+		}
+		if name := rec.City.Names["en"]; name != "" {
+			fields["geo_city"] = name
+		}
+		if rec.ASN != 0 {
+			fields["geo_asn"] = rec.ASN
+		}
+		if rec.ASOrg != "" {
+			fields["geo_as_org"] = rec.ASOrg
+		}
+	}
+	return fields, nil
+}
+
+// Close closes each of the databases
+func (dbs geoipDBs) Close() {
+	for _, db := range dbs {
+		db.Close()
+	}
+}
+
+// parseClientIP finds the IP address in a field's value, which may have a
+// port, eg 1.2.3.4:5678 or [::1]:80, or be an X-Forwarded-For list, in which
+// case the first address is the client's. It returns nil if there's no
+// address.
+func parseClientIP(val string) net.IP {
+	if i := strings.Index(val, ","); i >= 0 {
+		val = val[:i]
+	}
+	val = strings.TrimSpace(val)
+	if host, _, err := net.SplitHostPort(val); err == nil {
+		val = host
+	}
+	return net.ParseIP(strings.Trim(val, "[]"))
+}
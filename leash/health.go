@@ -0,0 +1,141 @@
+package leash
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/output"
+)
+
+// health is what's reported at /healthz and /readyz on --status_listen: how
+// many files are being read, how the last send went and how far behind the
+// events being sent are. It's shared by the inputs. A nil health keeps track
+// of nothing.
+type health struct {
+	lock sync.Mutex
+
+	// reading is how many files, or other streams of lines, are open
+	reading int
+	// lastSend is when the last response came back, and lastSendErr why it
+	// failed, if it did
+	lastSend    time.Time
+	lastSendErr string
+	// newest is the timestamp of the newest event sent
+	newest time.Time
+}
+
+// healthStatus is the body of the replies to /healthz and /readyz
+type healthStatus struct {
+	FilesReading  int        `json:"files_reading"`
+	LastSend      *time.Time `json:"last_send,omitempty"`
+	LastSendOK    bool       `json:"last_send_ok"`
+	LastSendError string     `json:"last_send_error,omitempty"`
+	LagSeconds    float64    `json:"lag_seconds"`
+}
+
+// newHealth returns a health to report on addr, or nil if there's no addr
+func newHealth(addr string) *health {
+	if addr == "" {
+		return nil
+	}
+	return &health{}
+}
+
+// serve answers /healthz and /readyz on addr until the returned func is
+// called
+func (h *health) serve(addr string) (func(), error) {
+	if h == nil {
+		return func() {}, nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.handle(false))
+	mux.HandleFunc("/readyz", h.handle(true))
+	logrus.WithFields(logrus.Fields{"addr": listener.Addr()}).Info("Serving /healthz and /readyz")
+	go http.Serve(listener, mux)
+	return func() { listener.Close() }, nil
+}
+
+// handle replies with the status, with a 503 if nothing's being read, or if
+// ready is set and the last send failed
+func (h *health) handle(ready bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := h.status(time.Now())
+		code := http.StatusOK
+		if status.FilesReading == 0 || ready && !status.LastSendOK {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// status returns the state of things as of now
+func (h *health) status(now time.Time) healthStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	status := healthStatus{
+		FilesReading:  h.reading,
+		LastSendOK:    h.lastSendErr == "",
+		LastSendError: h.lastSendErr,
+	}
+	if !h.lastSend.IsZero() {
+		lastSend := h.lastSend
+		status.LastSend = &lastSend
+	}
+	if !h.newest.IsZero() {
+		status.LagSeconds = now.Sub(h.newest).Seconds()
+	}
+	return status
+}
+
+// watchReading passes on lines, counting them as being read until they're
+// closed
+func (h *health) watchReading(lines chan string) chan string {
+	if h == nil {
+		return lines
+	}
+	h.lock.Lock()
+	h.reading++
+	h.lock.Unlock()
+	watched := make(chan string)
+	go func() {
+		defer close(watched)
+		for line := range lines {
+			watched <- line
+		}
+		h.lock.Lock()
+		h.reading--
+		h.lock.Unlock()
+	}()
+	return watched
+}
+
+// sent records how sending the event with timestamp went
+func (h *health) sent(rsp output.Result, timestamp time.Time) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastSend = time.Now()
+	h.lastSendErr = ""
+	if sendFailed(rsp) {
+		h.lastSendErr = http.StatusText(rsp.StatusCode)
+		if rsp.Err != nil {
+			h.lastSendErr = rsp.Err.Error()
+		}
+		return
+	}
+	if timestamp.After(h.newest) {
+		h.newest = timestamp
+	}
+}
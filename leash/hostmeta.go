@@ -0,0 +1,235 @@
+package leash
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// hostMetadataSources are what --host_metadata can add fields from
+var hostMetadataSources = []string{"host", "ec2", "gce", "kubernetes"}
+
+// where the EC2 and GCE metadata services are, overridden in tests
+var (
+	ec2MetadataURL = "http://169.254.169.254/latest"
+	gceMetadataURL = "http://metadata.google.internal/computeMetadata/v1"
+)
+
+// metadataTimeout is how long to wait for a metadata service, which won't be
+// there at all when not running in its cloud
+const metadataTimeout = 2 * time.Second
+
+// validHostMetadata returns true if each --host_metadata is one of
+// hostMetadataSources
+func validHostMetadata(sources []string) bool {
+	for _, source := range sources {
+		valid := false
+		for _, known := range hostMetadataSources {
+			valid = valid || source == known
+		}
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+// hostMetadata looks up the fields to add to every event from each
+// --host_metadata source. A source that can't be reached is warned about and
+// skipped, so that honeytail still sends events.
+func hostMetadata(options Config) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, source := range options.HostMetadata {
+		var found map[string]string
+		var err error
+		switch source {
+		case "host":
+			found, err = localHostMetadata()
+		case "ec2":
+			found, err = ec2Metadata()
+		case "gce":
+			found, err = gceMetadata()
+		case "kubernetes":
+			found, err = podInfoMetadata(options.PodInfoDir)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"host_metadata": source,
+				"err":           err,
+			}).Warn("Couldn't look up host metadata, sending events without it")
+		}
+		for k, v := range found {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// localHostMetadata returns the hostname and host_ip, the first address that
+// isn't a loopback one
+func localHostMetadata() (map[string]string, error) {
+	fields := make(map[string]string)
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	fields["hostname"] = hostname
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fields, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				fields["host_ip"] = ip4.String()
+				break
+			}
+			if fields["host_ip"] == "" {
+				fields["host_ip"] = ipnet.IP.String()
+			}
+		}
+	}
+	return fields, nil
+}
+
+// ec2Metadata returns the instance's id, type, availability zone and region
+// from the EC2 instance metadata service, with an IMDSv2 token if it hands
+// one out
+func ec2Metadata() (map[string]string, error) {
+	client := &http.Client{Timeout: metadataTimeout}
+	var token string
+	req, err := http.NewRequest("PUT", ec2MetadataURL+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	if resp, err := client.Do(req); err == nil {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			token = string(body)
+		}
+	}
+	headers := map[string]string{}
+	if token != "" {
+		headers["X-aws-ec2-metadata-token"] = token
+	}
+	return fetchMetadata(client, ec2MetadataURL+"/meta-data/", headers, map[string]string{
+		"ec2_instance_id":       "instance-id",
+		"ec2_instance_type":     "instance-type",
+		"ec2_availability_zone": "placement/availability-zone",
+		"ec2_region":            "placement/region",
+	})
+}
+
+// gceMetadata returns the instance's id, name, machine type, zone and project
+// from the GCE metadata server
+func gceMetadata() (map[string]string, error) {
+	client := &http.Client{Timeout: metadataTimeout}
+	fields, err := fetchMetadata(client, gceMetadataURL+"/", map[string]string{"Metadata-Flavor": "Google"}, map[string]string{
+		"gce_instance_id":   "instance/id",
+		"gce_instance_name": "instance/name",
+		"gce_machine_type":  "instance/machine-type",
+		"gce_zone":          "instance/zone",
+		"gce_project_id":    "project/project-id",
+	})
+	// the machine type and zone are given as projects/<number>/zones/<zone>
+	for _, field := range []string{"gce_machine_type", "gce_zone"} {
+		if v, ok := fields[field]; ok {
+			fields[field] = path.Base(v)
+		}
+	}
+	return fields, err
+}
+
+// fetchMetadata GETs each of paths from base, returning them as the fields
+// they're keyed by. It stops at the first that fails.
+func fetchMetadata(client *http.Client, base string, headers map[string]string, paths map[string]string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for field, p := range paths {
+		req, err := http.NewRequest("GET", base+p, nil)
+		if err != nil {
+			return fields, err
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fields, err
+		}
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fields, fmt.Errorf("%s returned %d", base+p, resp.StatusCode)
+		}
+		fields[field] = strings.TrimSpace(string(body))
+	}
+	return fields, nil
+}
+
+// podInfoMetadata reads the files the Kubernetes downward API mounts in dir,
+// adding each as a k8s_<name> field. Files of key="value" lines, like labels
+// and annotations, are added as a k8s_<name>.<key> field for each line.
+func podInfoMetadata(dir string) (map[string]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	for _, info := range files {
+		// the downward API's files are symlinks into a ..data directory,
+		// which is skipped along with the rest of its dot files
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			// a directory, or a file that's gone
+			continue
+		}
+		name := "k8s_" + info.Name()
+		if pairs, ok := parsePodInfoPairs(string(contents)); ok {
+			for k, v := range pairs {
+				fields[name+"."+k] = v
+			}
+			continue
+		}
+		fields[name] = strings.TrimSpace(string(contents))
+	}
+	return fields, nil
+}
+
+// parsePodInfoPairs parses the key="value" lines the downward API writes
+// labels and annotations as, returning false if s isn't all such lines
+func parsePodInfoPairs(s string) (map[string]string, bool) {
+	pairs := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, false
+		}
+		v, err := strconv.Unquote(line[i+1:])
+		if err != nil {
+			return nil, false
+		}
+		pairs[line[:i]] = v
+	}
+	return pairs, len(pairs) > 0
+}
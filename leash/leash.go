@@ -0,0 +1,1758 @@
+// Package leash is honeytail's pipeline: it tails the inputs a Config names,
+// parses their lines into events and sends them on, the same way the
+// honeytail binary does. Programs can embed it with Run instead of running
+// honeytail.
+package leash
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/checkpoint"
+	"github.com/honeycombio/honeytail/cloudwatch"
+	"github.com/honeycombio/honeytail/docker"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/eventlog"
+	"github.com/honeycombio/honeytail/expr"
+	"github.com/honeycombio/honeytail/httpreceiver"
+	"github.com/honeycombio/honeytail/journald"
+	"github.com/honeycombio/honeytail/kafka"
+	"github.com/honeycombio/honeytail/kinesis"
+	"github.com/honeycombio/honeytail/kubernetes"
+	"github.com/honeycombio/honeytail/output"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/authlog"
+	"github.com/honeycombio/honeytail/parsers/auto"
+	"github.com/honeycombio/honeytail/parsers/cassandra"
+	"github.com/honeycombio/honeytail/parsers/clickhouse"
+	"github.com/honeycombio/honeytail/parsers/cloudflare"
+	"github.com/honeycombio/honeytail/parsers/elasticsearch"
+	"github.com/honeycombio/honeytail/parsers/exec"
+	"github.com/honeycombio/honeytail/parsers/fastly"
+	"github.com/honeycombio/honeytail/parsers/gelf"
+	"github.com/honeycombio/honeytail/parsers/htjson"
+	"github.com/honeycombio/honeytail/parsers/mongodb"
+	"github.com/honeycombio/honeytail/parsers/mysql"
+	"github.com/honeycombio/honeytail/parsers/nginx"
+	"github.com/honeycombio/honeytail/parsers/phpfpm"
+	"github.com/honeycombio/honeytail/parsers/postfix"
+	"github.com/honeycombio/honeytail/parsers/rails"
+	"github.com/honeycombio/honeytail/parsers/stacktrace"
+	"github.com/honeycombio/honeytail/pubsub"
+	"github.com/honeycombio/honeytail/statsd"
+	"github.com/honeycombio/honeytail/syslog"
+	"github.com/honeycombio/honeytail/tail"
+	"github.com/honeycombio/honeytail/unixsocket"
+	"github.com/honeycombio/honeytail/urlshape"
+	"github.com/honeycombio/libhoney-go"
+)
+
+// Version is the version of honeytail, sent with --telemetry_dataset events
+var Version = "dev"
+
+// Run reads, parses and sends the events cfg says to, and returns once
+// they've all been sent, with what happened to the lines read. When ctx is
+// done, reading stops, and the events already read are sent before Run
+// returns, as on SIGTERM; the same happens once --deadline, if it's set,
+// passes. Listeners are closed then too, so a later Run can listen on the
+// same addresses. Parsers don't see ctx; they stop once the lines they're
+// reading end. Each of the --config file's inputs, if cfg has any, is run
+// side by side; a problem starting one stops the others. Run returns
+// ErrSendFailures if any events couldn't be sent, and ErrParseErrors if more
+// lines than --fail_on_error_rate allows failed to parse, along with the
+// Result. Runs don't share any state, so several may go at once.
+func Run(ctx context.Context, cfg Config) (Result, error) {
+	if err := CheckConfig(cfg); err != nil {
+		return Result{}, err
+	}
+	if cfg.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Deadline)
+		defer cancel()
+		go func() {
+			<-ctx.Done()
+			if ctx.Err() == context.DeadlineExceeded {
+				logrus.WithField("deadline", cfg.Deadline).Info("--deadline passed; sending what's been read and stopping")
+			}
+		}()
+	}
+	stats, err := run(ctx, cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	return stats.result(cfg)
+}
+
+// actually go and be leashy, returning what happened to the lines read once
+// they've all been sent
+func run(ctx context.Context, options Config) (*runStats, error) {
+	logrus.Info("Starting leash")
+
+	// honeytail's own metrics go to --statsd.address, if it's given
+	metrics, err := statsd.New(options.Statsd)
+	if err != nil {
+		return nil, err
+	}
+	defer metrics.Close()
+	// lines that fail to parse are written to --parse_error_log, if it's given
+	errorLog, err := newParseErrorLog(options.ParseErrorLog, options.ParseErrorLogRate)
+	if err != nil {
+		return nil, err
+	}
+	var onParseError func(line string, err error)
+	if errorLog != nil {
+		onParseError = errorLog.write
+		defer errorLog.Close()
+	}
+
+	stats := &runStats{metrics: metrics, health: newHealth(options.StatusListen), memory: newMemoryGuard(options.MaxMemoryMB)}
+	// the run's parsers count their errors in stats
+	stats.parseErrors = parsers.NewErrorCounter(onParseError)
+	options.parseErrors = stats.parseErrors
+	stopGuarding := stats.memory.watch()
+	defer stopGuarding()
+	stopServing, err := stats.health.serve(options.StatusListen)
+	if err != nil {
+		return nil, fmt.Errorf("can't listen on --status_listen: %s", err)
+	}
+	defer stopServing()
+	// the summary of what's been sent covers every input
+	stats.responses = newResponseStats(stats, options.StatusFormat)
+	stopLogging := logStats(stats.responses, options.StatusInterval)
+	defer stopLogging()
+	stopDumping := dumpStatsOnSignal(stats.responses)
+	defer stopDumping()
+	stopReporting := stats.reportMetrics(options.Statsd.Interval)
+	stopTelemetry := startTelemetry(options, stats)
+	if len(options.Inputs) == 0 {
+		err = runInput(ctx, options, stats)
+	} else {
+		// each of the --config file's inputs has a pipeline of its own
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		var inputsWG sync.WaitGroup
+		var once sync.Once
+		for i, input := range options.Inputs {
+			inputsWG.Add(1)
+			input.parseErrors = stats.parseErrors
+			go func(i int, input Config) {
+				defer inputsWG.Done()
+				if inputErr := runInput(ctx, input, stats); inputErr != nil {
+					once.Do(func() {
+						err = fmt.Errorf("input %d: %s", i+1, inputErr)
+						cancel()
+					})
+				}
+			}(i, input)
+		}
+		inputsWG.Wait()
+	}
+	stopReporting()
+	stopTelemetry()
+	return stats, err
+}
+
+// runInput reads, parses and sends the events from the input options give,
+// counting them in stats, and returns once they've all been sent, or with
+// the problem that stopped it starting up
+func runInput(ctx context.Context, options Config, stats *runStats) error {
+	sampler, err := newSampler(options)
+	if err != nil {
+		return fmt.Errorf("unable to use provided --sample_rule: %s", err)
+	}
+
+	// set up the parser and the transforms first, so a flag they can't use
+	// stops the input before anything's started
+	parser, err := newParser(options, "")
+	if err != nil {
+		return err
+	}
+	closeParser(parser)
+	stages, err := newEventStages(options)
+	if err != nil {
+		return err
+	}
+
+	// create a channel for sending events to the output, buffered as
+	// --pipeline.event_buffer says
+	toBeSent := make(chan event.Event)
+	doneSending := make(chan bool)
+	buffer, err := newEventBuffer(options.Pipeline, stats)
+	if err != nil {
+		discardEventStages(stages)
+		return fmt.Errorf("couldn't set up --pipeline.event_buffer: %s", err)
+	}
+
+	// track events through the pipeline so inputs that checkpoint can tell
+	// when the events made from what they've read have been sent
+	tracker := checkpoint.NewTracker()
+
+	// once ctx is done, stop reading and send what's already been read
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// files being followed only save positions from before the lines the
+	// stages below may be holding
+	options.Tail.HeldLines = stats.heldLines(options)
+
+	// get our lines channels from which to read log lines, one per file
+	streams, err := getEntries(ctx, options, tracker)
+	if err != nil {
+		// the inputs that started have stopped, but may be waiting to hear
+		// that nothing they read will be sent
+		tracker.Abandon()
+		buffer.discard()
+		discardEventStages(stages)
+		return fmt.Errorf("can't read the input: %s", err)
+	}
+
+	// events go to each --output if any are set, otherwise to Honeycomb.
+	// Outputs share libhoney, so it's set up last, once nothing else can
+	// stop this input from starting and closing it under the other inputs.
+	out, err := newOutput(options)
+	if err != nil {
+		// stop the inputs, which have already started, without sending
+		// anything they read
+		cancel()
+		drainStreams(streams)
+		tracker.Abandon()
+		buffer.discard()
+		discardEventStages(stages)
+		return fmt.Errorf("can't set up the output: %s", err)
+	}
+
+	buffered := tracker.WatchBuffered(buffer.pass(toBeSent), buffer.buffered)
+
+	// apply any filters to the events before they get sent
+	modifiedToBeSent := modifyEventContents(buffered, stages)
+
+	// note the time a backfill covers, to mark it in Honeycomb at the end
+	var backfill *backfillRanges
+	if options.BackfillMarkers && options.Tail.Stop && sendsToHoneycomb(options.Output) {
+		backfill = newBackfillRanges()
+		modifiedToBeSent = backfill.watch(modifiedToBeSent)
+	}
+
+	// start up the sender
+	limiter := newRateLimiter(options.MaxEventsPerSecond)
+	replay := newReplayPacer(options.ReplaySpeed)
+	dedup := newDeduper(options.DedupFields, options.DedupWindow)
+	agg := newAggregator(options.AggregateBy, options.AggregateFields, options.AggregateInterval)
+	overload := newOverloadSampler(options, buffer, stats)
+	stopWatchingOverload := overload.watch()
+	defer stopWatchingOverload()
+	go sendEvents(ctx, modifiedToBeSent, out, tracker, sampler, overload, dedup, agg, limiter, replay, doneSending)
+
+	// start a goroutine that reads from responses and logs.
+	doneResponding := make(chan struct{})
+	go handleResponses(out.Results(), tracker, options, stats, doneResponding)
+
+	// only events inside --tail.read_from and --tail.stop_at, if they're
+	// times, are sent
+	from, to, _ := tail.TimeWindow(options.Tail)
+	windowed := !from.IsZero() || !to.IsZero()
+
+	// --dataset and --add_field may be filled in from each file's path
+	pattern, _ := pathPattern(options)
+
+	// get a parser for each file, so that parsers that keep state between
+	// lines don't mix up lines from different files
+	var parsersWG sync.WaitGroup
+	for stream := range streams {
+		var parser lineProcessor
+		var err error
+		if parsesInParallel(options) {
+			parser, err = newParallelParser(options, stream.Path)
+		} else {
+			parser, err = newParser(options, stream.Path)
+		}
+		if err != nil {
+			// the parser was set up for the input already, so something's
+			// changed since, eg the --nginx.conf was edited. The stream's
+			// lines are read and skipped, as the auto parser does with a
+			// file it doesn't understand, so the other streams carry on.
+			logrus.WithFields(logrus.Fields{
+				"file": stream.Path,
+				"err":  err,
+			}).Error("Unable to set up a parser for this input. Skipping it.")
+			parsersWG.Add(1)
+			go func(lines chan string) {
+				defer parsersWG.Done()
+				for range lines {
+				}
+			}(stream.Lines)
+			continue
+		}
+		if backfill != nil {
+			backfill.addFile(stream.Path)
+		}
+		dataset, pathFields := pathTemplates(options, stream.Path, pattern)
+		// each of these holds a line; heldLines counts them
+		if stats.countsLines(options) {
+			stream.Lines = stats.countLines(stream.Lines)
+		}
+		stream.Lines = stats.health.watchReading(stream.Lines)
+		if !spills(options.Pipeline) {
+			// events are spilled to disk instead
+			stream.Lines = stats.memory.holdBack(stream.Lines)
+		}
+		parsersWG.Add(1)
+		go func(stream tail.FileEntries) {
+			defer parsersWG.Done()
+			if len(stream.Fields) == 0 && !windowed && dataset == "" && len(pathFields) == 0 {
+				// ProcessLines won't return until lines is closed
+				parser.ProcessLines(stream.Lines, toBeSent)
+				return
+			}
+			parsed := make(chan event.Event)
+			go func() {
+				parser.ProcessLines(stream.Lines, parsed)
+				close(parsed)
+			}()
+			// the tracker passes on an event held here before taking a
+			// mark, so files being followed don't save a position past it
+			tracker.Forward(parsed, toBeSent, func(ev *event.Event) bool {
+				if windowed && !inTimeWindow(from, to, *ev) {
+					return false
+				}
+				addPathTemplates(dataset, pathFields, ev)
+				addStreamFields(stream.Fields, ev)
+				return true
+			})
+		}(stream)
+	}
+	parsersWG.Wait()
+
+	// trigger the sending goroutine to finish up
+	close(toBeSent)
+	// wait for all the events in toBeSent to be handed to the output
+	<-doneSending
+
+	// tell the output to finish up sending events
+	out.Close()
+	// once every response is in, let inputs record how far they got
+	<-doneResponding
+	tracker.Finish()
+
+	if backfill != nil {
+		backfill.createMarkers(options)
+	}
+
+	// Nothing bad happened, yay
+	return nil
+}
+
+// newOutput returns where events are to be sent: each --output, or Honeycomb
+// if none were given. Several outputs are sent to together, with each event
+// only counted as sent once all of them have it. With --output.spool_dir,
+// each output spools the events it can't send.
+func newOutput(options Config) (output.Output, error) {
+	if options.Modes.Benchmark {
+		return output.NewNull(), nil
+	}
+	urls := options.Output
+	if len(urls) == 0 {
+		urls = []string{"honeycomb://"}
+	}
+	options.OutputOptions.MaxRetries = int(options.MaxRetries)
+	options.OutputOptions.RetryBackoff = time.Duration(options.RetryBackoff) * time.Millisecond
+	var outputs []output.Output
+	for _, url := range urls {
+		out, err := newOutputFor(url, options)
+		if err == nil && options.OutputOptions.SpoolDir != "" {
+			var spool *output.Spool
+			spool, err = output.NewSpool(out, url, options.OutputOptions)
+			if err != nil {
+				out.Close()
+			} else {
+				out = spool
+			}
+		}
+		if err != nil {
+			for _, started := range outputs {
+				started.Close()
+			}
+			return nil, err
+		}
+		outputs = append(outputs, out)
+	}
+	if len(outputs) == 1 {
+		return outputs[0], nil
+	}
+	return output.NewFanout(outputs), nil
+}
+
+// newOutputFor returns the output for one --output URL
+func newOutputFor(url string, options Config) (output.Output, error) {
+	switch {
+	case output.IsFileURL(url):
+		return output.NewFile(url, options.Reqs.Dataset, options.OutputOptions)
+	case output.IsKafkaURL(url):
+		return output.NewKafka(url, options.Reqs.Dataset, options.OutputOptions)
+	case output.IsHTTPURL(url):
+		return output.NewHTTP(url, options.Reqs.Dataset, options.OutputOptions)
+	case output.IsOTLPURL(url):
+		return output.NewOTLP(url, options.Reqs.Dataset, options.OutputOptions)
+	}
+	if newPluginOutput := pluginOutput(url); newPluginOutput != nil {
+		return newPluginOutput(url, options.Reqs.Dataset)
+	}
+	transport, err := newTransport(options)
+	if err != nil {
+		return nil, err
+	}
+	// libhoney doesn't try again itself
+	honeycomb, err := output.NewHoneycomb(libhoney.Config{
+		WriteKey:             options.Reqs.WriteKey,
+		Dataset:              output.HoneycombDataset(url, options.Reqs.Dataset),
+		SampleRate:           options.SampleRate,
+		APIHost:              options.APIHost,
+		MaxConcurrentBatches: options.NumSenders,
+		MaxBatchSize:         options.BatchSize,
+		SendFrequency:        time.Duration(options.BatchFrequency) * time.Millisecond,
+		PendingWorkCapacity:  options.PendingWork,
+		Transport:            transport,
+		// block on send should be true so if we can't send fast enough, we slow
+		// down reading the log rather than drop lines, unless dropping them is
+		// what's wanted
+		BlockOnSend: !options.DropWhenFull,
+		// every response is needed to know which events have been sent, so
+		// that positions in the input are only recorded once they're done
+		BlockOnResponse: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.NewRetry(honeycomb, options.OutputOptions), nil
+}
+
+// getEntries starts reading from each of the files and listeners given with
+// --file, from kafka if a topic was given and from docker if asked to. It
+// returns a channel of the lines from each, which is closed once no more
+// inputs can appear. Once ctx is done, every input stops reading, lets go of
+// what it had open and closes its lines, so reading each stream until it's
+// closed means the inputs have stopped. If one of them can't be started, the
+// ones that already have been are stopped before the error is returned.
+func getEntries(ctx context.Context, options Config, tracker *checkpoint.Tracker) (chan tail.FileEntries, error) {
+	// cancel stops the inputs that started if a later one can't; otherwise
+	// they stop along with ctx
+	ctx, cancel := context.WithCancel(ctx)
+	var entries []tail.FileEntries
+	// files matching a glob and containers come and go, so their streams
+	// arrive over time
+	var dynamic []chan tail.FileEntries
+	fail := func(err error) (chan tail.FileEntries, error) {
+		cancel()
+		for _, entry := range entries {
+			for range entry.Lines {
+			}
+		}
+		for _, source := range dynamic {
+			drainStreams(source)
+		}
+		return nil, err
+	}
+
+	if options.Kafka.Topic != "" {
+		lines, err := kafka.GetEntries(ctx, options.Kafka, tracker)
+		if err != nil {
+			return fail(err)
+		}
+		entries = append(entries, tail.FileEntries{Path: "kafka://" + options.Kafka.Topic, Lines: lines})
+	}
+	if options.ListenHTTP != "" {
+		lines, err := httpreceiver.GetEntries(ctx, options.ListenHTTP, options.HTTP)
+		if err != nil {
+			return fail(err)
+		}
+		entries = append(entries, tail.FileEntries{Path: "http://" + options.ListenHTTP, Lines: lines})
+	}
+	var paths []string
+	for _, path := range options.Reqs.LogFiles {
+		var lines chan string
+		var err error
+		switch {
+		case syslog.IsSyslogURL(path):
+			lines, err = syslog.GetEntries(ctx, path, options.Syslog)
+		case journald.IsJournaldURL(path):
+			lines, err = journald.GetEntries(ctx, options.Journald, options.Tail, tracker)
+		case kinesis.IsKinesisURL(path):
+			lines, err = kinesis.GetEntries(ctx, path, options.Kinesis, options.AWS)
+		case cloudwatch.IsCloudWatchURL(path):
+			lines, err = cloudwatch.GetEntries(ctx, path, options.CloudWatch, options.AWS)
+		case pubsub.IsPubSubURL(path):
+			lines, err = pubsub.GetEntries(ctx, path, options.PubSub, options.GCP, tracker)
+		case eventlog.IsEventLogURL(path):
+			lines, err = eventlog.GetEntries(ctx, path, options.EventLog)
+		case unixsocket.IsUnixSocketURL(path):
+			lines, err = unixsocket.GetEntries(ctx, path, options.Unix)
+		default:
+			paths = append(paths, path)
+			continue
+		}
+		if err != nil {
+			return fail(err)
+		}
+		entries = append(entries, tail.FileEntries{Path: path, Lines: lines})
+	}
+	if len(paths) > 0 {
+		tailOptions := options.Tail
+		tailOptions.LineBuffer = options.Pipeline.LineBuffer
+		tailOptions.SaveAtEnd = parsesInParallel(options)
+		files, err := tail.WatchFiles(tail.Config{
+			Paths:    paths,
+			Type:     tail.RotateStyleSyslog,
+			Options:  tailOptions,
+			Context:  ctx,
+			Progress: tracker})
+		if err != nil {
+			return fail(err)
+		}
+		dynamic = append(dynamic, files)
+	}
+	if options.Docker {
+		containers, err := docker.GetEntries(ctx, options.DockerOptions)
+		if err != nil {
+			return fail(err)
+		}
+		dynamic = append(dynamic, containers)
+	}
+	if options.Kubernetes {
+		pods, err := kubernetes.GetEntries(ctx, options.KubernetesOptions)
+		if err != nil {
+			return fail(err)
+		}
+		dynamic = append(dynamic, pods)
+	}
+
+	streams := make(chan tail.FileEntries)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for _, entry := range entries {
+			streams <- entry
+		}
+		wg.Done()
+	}()
+	for _, source := range dynamic {
+		wg.Add(1)
+		go func(source chan tail.FileEntries) {
+			for entry := range source {
+				streams <- entry
+			}
+			wg.Done()
+		}(source)
+	}
+	go func() {
+		wg.Wait()
+		close(streams)
+	}()
+	return streams, nil
+}
+
+// drainStreams reads the streams from an input that's been told to stop
+// until it has closed them all
+func drainStreams(streams chan tail.FileEntries) {
+	for entry := range streams {
+		for range entry.Lines {
+		}
+	}
+}
+
+// addStreamFields adds the fields that come with an input stream (eg the
+// container name) to an event parsed from it. Fields the parser found in the
+// line itself win.
+func addStreamFields(fields map[string]interface{}, ev *event.Event) {
+	for k, v := range fields {
+		if _, ok := ev.Data[k]; !ok {
+			ev.Data[k] = v
+		}
+	}
+}
+
+// pathTemplates returns the --dataset and the --add_field fields that are
+// templates, filled in from the path of the file events come from. The
+// dataset is empty if --dataset isn't a template, and the rest of the
+// --add_field fields are added to every event by modifyEventContents.
+func pathTemplates(options Config, path string, pattern *regexp.Regexp) (string, map[string]interface{}) {
+	vars := pathTemplateVars(path, pattern)
+	var dataset string
+	if isPathTemplate(options.Reqs.Dataset) {
+		dataset = expandPathTemplate(options.Reqs.Dataset, vars)
+		if dataset == "" {
+			logrus.WithFields(logrus.Fields{
+				"dataset": options.Reqs.Dataset,
+				"path":    path,
+			}).Warn("Dataset template is empty for this path, sending its events to the dataset as given")
+		}
+	}
+	fields := make(map[string]interface{})
+	for _, field := range options.AddFields {
+		if !isPathTemplate(field) {
+			continue
+		}
+		// separate the k=v field we got from the command line before filling
+		// it in, so an = from the path doesn't move the split. checkInput
+		// makes sure there's one to split on.
+		splitField := strings.SplitN(field, "=", 2)
+		if len(splitField) != 2 {
+			continue
+		}
+		fields[expandPathTemplate(splitField[0], vars)] = expandPathTemplate(splitField[1], vars)
+	}
+	return dataset, fields
+}
+
+// addPathTemplates sets the event's dataset, if it's not empty, and adds
+// fields to it. Like --add_field, fields replace any of the same name the
+// parser found.
+func addPathTemplates(dataset string, fields map[string]interface{}, ev *event.Event) {
+	if dataset != "" {
+		ev.Dataset = dataset
+	}
+	for k, v := range fields {
+		newFieldPath(k).set(ev.Data, v)
+	}
+}
+
+// inTimeWindow reports whether the event's timestamp is at or after from
+// and not after to. Either may be zero to leave that end open.
+func inTimeWindow(from, to time.Time, ev event.Event) bool {
+	if (!from.IsZero() && ev.Timestamp.Before(from)) || (!to.IsZero() && ev.Timestamp.After(to)) {
+		logrus.WithFields(logrus.Fields{
+			"timestamp": ev.Timestamp,
+		}).Debug("Skipping event outside of the time window")
+		return false
+	}
+	return true
+}
+
+// newParser creates and initializes the parser chosen on the command line for
+// the file at path
+func newParser(options Config, path string) (parsers.Parser, error) {
+	parser, opts := getParserAndOptions(options)
+	if parser == nil {
+		return nil, fmt.Errorf("parser %q not found. Use --list to show valid parsers", options.Reqs.ParserName)
+	}
+	if autoParser, ok := parser.(*auto.Parser); ok {
+		autoParser.Source = path
+	}
+	if err := initParser(parser, opts, options); err != nil {
+		return nil, fmt.Errorf("unable to initialize the %s parser: %s", options.Reqs.ParserName, err)
+	}
+	return parser, nil
+}
+
+// initParser gives parser the settings the run's parsers share, if it takes
+// them, then inits it with its own options
+func initParser(parser parsers.Parser, opts interface{}, options Config) error {
+	if configurable, ok := parser.(parsers.Configurable); ok {
+		loc, unit, err := timestampSettings(options)
+		if err != nil {
+			return err
+		}
+		configurable.Configure(parsers.Settings{
+			Timezone:  loc,
+			EpochUnit: unit,
+			Errors:    options.parseErrors,
+		})
+	}
+	return parser.Init(opts)
+}
+
+// closeParser lets go of what parser holds on to from Init, eg the exec
+// parser's command, for a parser that's been set up but won't be given lines
+func closeParser(parser parsers.Parser) {
+	if closer, ok := parser.(parsers.Closer); ok {
+		closer.Close()
+	}
+}
+
+// autoCandidates lists the parsers --parser auto chooses between, with
+// those that only accept a very specific format ahead of more permissive
+// ones. Parsers that accept nearly anything (stacktrace) or are a superset of
+// another format (cloudflare, fastly) are left out.
+func autoCandidates(options Config) []auto.Candidate {
+	names := []string{
+		"gelf", "json", "mongo", "mysql", "rails", "authlog", "postfix",
+		"phpfpm", "elasticsearch", "cassandra", "clickhouse", "nginx",
+	}
+	candidates := make([]auto.Candidate, len(names))
+	for i, name := range names {
+		candidateOptions := options
+		candidateOptions.Reqs.ParserName = name
+		candidates[i] = auto.Candidate{
+			Name: name,
+			New: func() (parsers.Parser, error) {
+				parser, opts := getParserAndOptions(candidateOptions)
+				return parser, initParser(parser, opts, candidateOptions)
+			},
+		}
+	}
+	return candidates
+}
+
+// getParserOptions takes a parser name and the global options struct
+// it returns the options group for the specified parser
+func getParserAndOptions(options Config) (parsers.Parser, interface{}) {
+	var parser parsers.Parser
+	var opts interface{}
+	switch options.Reqs.ParserName {
+	case "auto":
+		parser = &auto.Parser{Candidates: autoCandidates(options)}
+		opts = &options.Auto
+	case "nginx":
+		parser = &nginx.Parser{}
+		opts = &options.Nginx
+	case "json":
+		parser = &htjson.Parser{}
+		opts = &options.JSON
+	case "mongo", "mongodb":
+		parser = &mongodb.Parser{}
+		opts = &options.Mongo
+	case "mysql":
+		parser = &mysql.Parser{}
+		opts = &options.MySQL
+	case "rails":
+		parser = &rails.Parser{}
+		opts = &options.Rails
+	case "stacktrace":
+		parser = &stacktrace.Parser{}
+		opts = &options.StackTrace
+	case "authlog":
+		parser = &authlog.Parser{}
+		opts = &options.AuthLog
+	case "postfix":
+		parser = &postfix.Parser{}
+		opts = &options.Postfix
+	case "phpfpm", "php-fpm":
+		parser = &phpfpm.Parser{}
+		opts = &options.PHPFPM
+	case "elasticsearch":
+		parser = &elasticsearch.Parser{}
+		opts = &options.Elasticsearch
+	case "cassandra":
+		parser = &cassandra.Parser{}
+		opts = &options.Cassandra
+	case "clickhouse":
+		parser = &clickhouse.Parser{}
+		opts = &options.ClickHouse
+	case "gelf":
+		parser = &gelf.Parser{}
+		opts = &options.GELF
+	case "cloudflare":
+		parser = &cloudflare.Parser{}
+		opts = &options.Cloudflare
+	case "fastly":
+		parser = &fastly.Parser{}
+		opts = &options.Fastly
+	case "exec":
+		parser = &exec.Parser{}
+		opts = &options.Exec
+	default:
+		parser, opts = pluginParser(options.Reqs.ParserName, options.PluginOptions)
+	}
+	parser, _ = parser.(parsers.Parser)
+	return parser, opts
+}
+
+// eventStage is one step of modifyEventContents: it starts passing the events
+// from toBeSent on down the line, changed as its flag says, and returns the
+// channel it sends them on, which it closes once toBeSent is
+type eventStage func(toBeSent chan event.Event) chan event.Event
+
+// newEventStages sets up the transforms options ask for, in the order they're
+// applied, returning the first flag that can't be used. Nothing is started
+// until the stages are run.
+func newEventStages(options Config) (stages []eventStage, err error) {
+	defer func() {
+		// the stages already set up may hold on to something
+		if err != nil {
+			discardEventStages(stages)
+			stages = nil
+		}
+	}()
+	add := func(stage eventStage, err error) error {
+		if err == nil {
+			stages = append(stages, stage)
+		}
+		return err
+	}
+	if options.MaxTimestampPast > 0 || options.MaxTimestampFuture > 0 {
+		stages = append(stages, clampTimestamps(options.MaxTimestampPast, options.MaxTimestampFuture))
+	}
+	// parse embedded payloads first so their fields can be dropped, scrubbed
+	// or parsed further
+	for _, spec := range options.ParseFields {
+		if err := add(parseEventField(spec, options)); err != nil {
+			return stages, err
+		}
+	}
+	if options.LowercaseFields || options.UnderscoreFields || len(options.StripFieldPrefixes) > 0 {
+		stages = append(stages, normalizeFieldNames(options))
+	}
+	// rename next, so everything after works with the new names
+	for _, spec := range options.RenameFields {
+		if err := add(renameEventField(spec)); err != nil {
+			return stages, err
+		}
+	}
+	for _, spec := range options.ExtractFields {
+		if err := add(extractEventField(spec)); err != nil {
+			return stages, err
+		}
+	}
+	if options.RequestShape != "" {
+		if err := add(shapeRequestField(options)); err != nil {
+			return stages, err
+		}
+	}
+	for _, spec := range options.CoerceFields {
+		if err := add(coerceEventField(spec)); err != nil {
+			return stages, err
+		}
+	}
+	for _, spec := range options.NormalizeFields {
+		if err := add(normalizeEventField(spec)); err != nil {
+			return stages, err
+		}
+	}
+	// look up the client before its address might be dropped or scrubbed
+	if options.GeoIPField != "" {
+		if err := add(addGeoIPFields(options)); err != nil {
+			return stages, err
+		}
+	}
+	// derive from the fields as they'll be, before any are dropped
+	for _, spec := range options.DeriveFields {
+		if err := add(deriveEventField(spec)); err != nil {
+			return stages, err
+		}
+	}
+	// route before the field might be dropped or scrubbed
+	if options.DatasetField != "" {
+		if err := add(routeEventDataset(options.DatasetField, options.DatasetRoutes)); err != nil {
+			return stages, err
+		}
+	}
+	for _, field := range options.DropFields {
+		stages = append(stages, dropEventField(field))
+	}
+	if len(options.AllowFields) > 0 {
+		stages = append(stages, allowEventFields(options.AllowFields))
+	}
+	for _, field := range options.ScrubFields {
+		stages = append(stages, scrubEventField(field))
+	}
+	if len(options.RedactPatterns) > 0 {
+		if err := add(redactEventValues(options.RedactPatterns)); err != nil {
+			return stages, err
+		}
+	}
+	if len(options.HostMetadata) > 0 {
+		stages = append(stages, addHostFields(hostMetadata(options)))
+	}
+	for _, field := range options.AddFields {
+		if isPathTemplate(field) {
+			// added with the path of each file in run
+			continue
+		}
+		if err := add(addEventField(field)); err != nil {
+			return stages, err
+		}
+	}
+	// the script has the last word, seeing the fields as they'd be sent
+	if options.Script != "" {
+		if err := add(runEventScript(options.Script)); err != nil {
+			return stages, err
+		}
+	}
+	return stages, nil
+}
+
+// discardEventStages lets go of what stages hold on to, eg a --parse_field
+// parser or the --script, for stages that won't be run
+func discardEventStages(stages []eventStage) {
+	done := make(chan event.Event)
+	close(done)
+	for range modifyEventContents(done, stages) {
+	}
+}
+
+// modifyEventContents takes a channel from which it will read events. It
+// returns a channel on which it will send the munged events.
+// It is responsible for hashing or dropping or adding fields to the events,
+// as each of stages does in turn
+func modifyEventContents(toBeSent chan event.Event, stages []eventStage) chan event.Event {
+	for _, stage := range stages {
+		toBeSent = stage(toBeSent)
+	}
+	return toBeSent
+}
+
+// clampTimestamps gives events with timestamps more than past before now, or
+// more than future after it, the current time instead, keeping the time they
+// had in a timestamp_clamped field, before passing them on down the line to
+// the next consumer. Either may be zero to leave that side alone.
+func clampTimestamps(past, future time.Duration) eventStage {
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				now := time.Now()
+				if (past > 0 && ev.Timestamp.Before(now.Add(-past))) || (future > 0 && ev.Timestamp.After(now.Add(future))) {
+					logrus.WithFields(logrus.Fields{
+						"timestamp": ev.Timestamp,
+					}).Debug("Clamping an event's timestamp to now")
+					ev.Data["timestamp_clamped"] = ev.Timestamp.Format(time.RFC3339Nano)
+					ev.Timestamp = now.UTC()
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}
+}
+
+// parseEventField runs the string value of a field through a second parser
+// and merges the resulting fields into the event before passing the event on
+// down the line to the next consumer
+func parseEventField(spec string, options Config) (eventStage, error) {
+	field, parserName, err := parseParseFieldSpec(spec, options)
+	if err != nil {
+		return nil, err
+	}
+	options.Reqs.ParserName = parserName
+	parser, err := newParser(options, "field "+field)
+	if err != nil {
+		return nil, fmt.Errorf("--parse_field %q: %s", spec, err)
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			defer closeParser(parser)
+			for ev := range toBeSent {
+				if val, ok := ev.Data[field].(string); ok {
+					for k, v := range parseValue(parser, val) {
+						ev.Data[k] = v
+					}
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// parseParseFieldSpec separates the field:parser spec we got from the command
+// line, checking the parser is one there is
+func parseParseFieldSpec(spec string, options Config) (string, string, error) {
+	splitSpec := strings.SplitN(spec, ":", 2)
+	if len(splitSpec) != 2 || splitSpec[0] == "" {
+		return "", "", fmt.Errorf("--parse_field %q isn't a field:parser pair", spec)
+	}
+	options.Reqs.ParserName = splitSpec[1]
+	if parser, _ := getParserAndOptions(options); parser == nil {
+		return "", "", fmt.Errorf("--parse_field %q has a parser that isn't one there is. Use --list to show valid parsers", spec)
+	}
+	return splitSpec[0], splitSpec[1], nil
+}
+
+// parseValue feeds a single value through parser, returning the fields of
+// the resulting event. Values the parser doesn't produce an event for yield no
+// fields.
+func parseValue(parser parsers.Parser, val string) map[string]interface{} {
+	lines := make(chan string, 1)
+	lines <- val
+	close(lines)
+	events := make(chan event.Event)
+	go func() {
+		parser.ProcessLines(lines, events)
+		close(events)
+	}()
+	var data map[string]interface{}
+	for ev := range events {
+		// a single line should only make a single event, but drain the
+		// channel regardless so the parser can finish
+		if data == nil {
+			data = ev.Data
+		}
+	}
+	return data
+}
+
+// routeEventDataset sets the dataset of each event with field to the field's
+// value, or to the dataset routes maps the value to if any routes are given,
+// before passing the event on down the line to the next consumer
+func routeEventDataset(field string, routes []string) (eventStage, error) {
+	// separate the value=dataset routes we got from the command line
+	datasets := make(map[string]string, len(routes))
+	for _, route := range routes {
+		splitRoute := strings.SplitN(route, "=", 2)
+		if len(splitRoute) != 2 || splitRoute[1] == "" {
+			return nil, fmt.Errorf("--dataset_route %q isn't a value=dataset pair", route)
+		}
+		datasets[splitRoute[0]] = splitRoute[1]
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				if val, ok := ev.Data[field]; ok && val != nil {
+					value := fmt.Sprintf("%v", val)
+					if len(datasets) == 0 {
+						ev.Dataset = value
+					} else if dataset, ok := datasets[value]; ok {
+						ev.Dataset = dataset
+					}
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// normalizeFieldNames renames every field, including those nested in
+// objects, stripping the first of the --strip_field_prefix prefixes it has,
+// then lowercasing it with --lowercase_fields and replacing spaces and dashes
+// with underscores with --underscore_fields, before passing the event on down
+// the line to the next consumer. A field whose new name is already taken
+// keeps its old one.
+func normalizeFieldNames(options Config) eventStage {
+	underscores := strings.NewReplacer(" ", "_", "-", "_")
+	rename := func(name string) string {
+		for _, prefix := range options.StripFieldPrefixes {
+			if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+				name = name[len(prefix):]
+				break
+			}
+		}
+		if options.LowercaseFields {
+			name = strings.ToLower(name)
+		}
+		if options.UnderscoreFields {
+			name = underscores.Replace(name)
+		}
+		return name
+	}
+	var normalize func(data map[string]interface{})
+	normalize = func(data map[string]interface{}) {
+		// collect the names first, as renaming adds to the map
+		names := make([]string, 0, len(data))
+		for name := range data {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			val := data[name]
+			if nested, ok := val.(map[string]interface{}); ok {
+				normalize(nested)
+			}
+			newName := rename(name)
+			if newName == name {
+				continue
+			}
+			if _, taken := data[newName]; taken {
+				logrus.WithFields(logrus.Fields{
+					"field":    name,
+					"new_name": newName,
+				}).Debug("not renaming field, its new name is taken")
+				continue
+			}
+			data[newName] = val
+			delete(data, name)
+		}
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				normalize(ev.Data)
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}
+}
+
+// renameEventField moves the value of a field to a new name, replacing any
+// field already called that, before passing the event on down the line to
+// the next consumer
+func renameEventField(spec string) (eventStage, error) {
+	from, to, err := parseRenameSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				if val, ok := ev.Data[from]; ok {
+					delete(ev.Data, from)
+					ev.Data[to] = val
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// parseRenameSpec separates the old=new spec we got from the command line
+func parseRenameSpec(spec string) (string, string, error) {
+	splitSpec := strings.SplitN(spec, "=", 2)
+	if len(splitSpec) != 2 || splitSpec[0] == "" || splitSpec[1] == "" {
+		return "", "", fmt.Errorf("--rename_field %q isn't an old=new pair", spec)
+	}
+	return splitSpec[0], splitSpec[1], nil
+}
+
+// extractEventField matches a regex with named groups against the string
+// value of a field and adds what each group captured as a field of the
+// group's name, before passing the event on down the line to the next
+// consumer. Groups that captured nothing aren't added.
+func extractEventField(spec string) (eventStage, error) {
+	field, re, err := parseExtractSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	names := re.SubexpNames()
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				if val, ok := ev.Data[field].(string); ok {
+					match := re.FindStringSubmatchIndex(val)
+					for i, name := range names {
+						if name != "" && match != nil && match[2*i] >= 0 {
+							ev.Data[name] = val[match[2*i]:match[2*i+1]]
+						}
+					}
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// parseExtractSpec separates the field:regex spec we got from the command
+// line, compiling the regex, which must have a named group
+func parseExtractSpec(spec string) (string, *regexp.Regexp, error) {
+	splitSpec := strings.SplitN(spec, ":", 2)
+	if len(splitSpec) != 2 || splitSpec[0] == "" {
+		return "", nil, fmt.Errorf("--extract_field %q isn't a field:regex pair", spec)
+	}
+	re, err := regexp.Compile(splitSpec[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("--extract_field %q has a regex that doesn't compile: %s", spec, err)
+	}
+	named := false
+	for _, name := range re.SubexpNames() {
+		named = named || name != ""
+	}
+	if !named {
+		return "", nil, fmt.Errorf("--extract_field %q has no named groups, eg (?P<order_id>[0-9]+), to name the fields it extracts", spec)
+	}
+	return splitSpec[0], re, nil
+}
+
+// shapeRequestField breaks down the request in the --request_shape field,
+// adding url_path, url_query and url_shape fields, url_path_<name> for each
+// :name in the --request_pattern it matched, and url_query_<name> for each
+// --request_query_param, then passes the event on down the line to the next
+// consumer
+func shapeRequestField(options Config) (eventStage, error) {
+	shaper, err := urlshape.NewShaper(options.RequestPatterns, options.RequestDropQueryParams)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use provided --request_pattern: %s", err)
+	}
+	allParams := false
+	for _, name := range options.RequestQueryParams {
+		allParams = allParams || name == "*"
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				val, ok := ev.Data[options.RequestShape].(string)
+				if !ok {
+					newSent <- ev
+					continue
+				}
+				shaped, err := shaper.Shape(val)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"request": val,
+						"err":     err,
+					}).Debug("unable to shape request")
+					newSent <- ev
+					continue
+				}
+				ev.Data["url_path"] = shaped.Path
+				ev.Data["url_shape"] = shaped.Shape
+				if shaped.Query != "" {
+					ev.Data["url_query"] = shaped.Query
+				}
+				for name, value := range shaped.PathParams {
+					ev.Data["url_path_"+name] = value
+				}
+				params := options.RequestQueryParams
+				if allParams {
+					params = nil
+					for name := range shaped.QueryParams {
+						params = append(params, name)
+					}
+				}
+				for _, name := range params {
+					if values, ok := shaped.QueryParams[name]; ok {
+						ev.Data["url_query_"+name] = strings.Join(values, ",")
+					}
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// coerceEventField converts the value of a field to the int, float, bool or
+// string type in its field:type spec before passing the event on down the
+// line to the next consumer. Values that can't be converted are left alone.
+func coerceEventField(spec string) (eventStage, error) {
+	field, typ, err := parseCoerceSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				if val, ok := ev.Data[field]; ok && val != nil {
+					newVal, err := coerceValue(val, typ)
+					if err != nil {
+						logrus.WithFields(logrus.Fields{
+							"coerce_field": spec,
+							"value":        val,
+							"err":          err,
+						}).Debug("unable to coerce field")
+					} else {
+						ev.Data[field] = newVal
+					}
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// parseCoerceSpec separates the field:type spec we got from the command line
+func parseCoerceSpec(spec string) (string, string, error) {
+	splitSpec := strings.SplitN(spec, ":", 2)
+	if len(splitSpec) != 2 || splitSpec[0] == "" || !isCoerceType(splitSpec[1]) {
+		return "", "", fmt.Errorf("--coerce_field %q isn't a field:type pair, where type is %s", spec, strings.Join(coerceTypes, ", "))
+	}
+	return splitSpec[0], splitSpec[1], nil
+}
+
+// normalizeEventField adds a <field>_ms or <field>_bytes field with the
+// duration or size in a field converted to a plain number, as its
+// field:kind[:unit] spec says, before passing the event on down the line to
+// the next consumer. The field itself is left as it is.
+func normalizeEventField(spec string) (eventStage, error) {
+	normalizer, err := newUnitNormalizer(spec)
+	if err != nil {
+		return nil, fmt.Errorf("unable to use provided --normalize_field: %s", err)
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				if val, ok := ev.Data[normalizer.field]; ok && val != nil {
+					if n, err := normalizer.normalize(val); err != nil {
+						logrus.WithFields(logrus.Fields{
+							"normalize_field": spec,
+							"value":           val,
+							"err":             err,
+						}).Debug("unable to normalize field")
+					} else {
+						ev.Data[normalizer.target()] = n
+					}
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// deriveEventField sets a field to the result of an expression over the
+// event's other fields, as given in its name=expr spec, before passing the
+// event on down the line to the next consumer. The field isn't set when the
+// expression is null, eg because a field it uses is missing.
+func deriveEventField(spec string) (eventStage, error) {
+	field, e, err := parseDeriveSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				val, err := e.Eval(ev.Data)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"derive_field": spec,
+						"err":          err,
+					}).Debug("unable to derive field")
+				} else if val != nil {
+					ev.Data[field] = val
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// parseDeriveSpec separates the name=expr spec we got from the command line,
+// parsing the expression
+func parseDeriveSpec(spec string) (string, *expr.Expr, error) {
+	splitSpec := strings.SplitN(spec, "=", 2)
+	if len(splitSpec) != 2 || strings.TrimSpace(splitSpec[0]) == "" {
+		return "", nil, fmt.Errorf("--derive_field %q isn't a name=expr pair", spec)
+	}
+	e, err := expr.Parse(splitSpec[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("--derive_field %q has an expression that doesn't parse: %s", spec, err)
+	}
+	return strings.TrimSpace(splitSpec[0]), e, nil
+}
+
+// addGeoIPFields looks up the IP address in the --geoip_field in the
+// --geoip_db databases, adding geo_country, geo_region, geo_city, geo_asn and
+// geo_as_org fields for what they know about it, then passes the event on
+// down the line to the next consumer
+func addGeoIPFields(options Config) (eventStage, error) {
+	dbs, err := openGeoIP(options.GeoIPDBs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open provided --geoip_db: %s", err)
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			defer dbs.Close()
+			for ev := range toBeSent {
+				val, ok := ev.Data[options.GeoIPField].(string)
+				if !ok {
+					newSent <- ev
+					continue
+				}
+				ip := parseClientIP(val)
+				if ip == nil {
+					logrus.WithFields(logrus.Fields{
+						"geoip_field": options.GeoIPField,
+						"value":       val,
+					}).Debug("no IP address to look up")
+					newSent <- ev
+					continue
+				}
+				fields, err := dbs.lookup(ip)
+				if err != nil {
+					logrus.WithFields(logrus.Fields{
+						"ip":  ip.String(),
+						"err": err,
+					}).Debug("unable to look up IP address")
+				}
+				for k, v := range fields {
+					ev.Data[k] = v
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// dropEventField drops any fields that are to be dropped, drop them before
+// passing the event on down the line to the next consumer
+func dropEventField(field string) eventStage {
+	path := newFieldPath(field)
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				path.walk(ev.Data, func(m map[string]interface{}, key string) {
+					delete(m, key)
+				})
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}
+}
+
+// allowEventFields drops every field other than those allowed before passing
+// the event on down the line to the next consumer. The event's timestamp is
+// kept apart from its fields, so it's always sent.
+func allowEventFields(fields []string) eventStage {
+	allowed := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		allowed[field] = true
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				for field := range ev.Data {
+					if !allowed[field] {
+						delete(ev.Data, field)
+					}
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}
+}
+
+// scrubEventField replaces the value for  any fields that are to be scrubbed
+// with a sha256 hash of the value, then passes the event on down the line to
+// the next consumer
+func scrubEventField(field string) eventStage {
+	path := newFieldPath(field)
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				path.walk(ev.Data, func(m map[string]interface{}, key string) {
+					// generate a sha256 hash
+					newVal := sha256.Sum256([]byte(fmt.Sprintf("%v", m[key])))
+					// and use the base16 string version of it
+					m[key] = fmt.Sprintf("%x", newVal)
+				})
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}
+}
+
+// redactEventValues masks whatever the --redact_pattern presets or regexes
+// match in every string value of the event, however deeply nested, then
+// passes the event on down the line to the next consumer
+func redactEventValues(specs []string) (eventStage, error) {
+	var redactors []*redactor
+	for _, spec := range specs {
+		r, err := newRedactor(spec)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use provided --redact_pattern: %s", err)
+		}
+		redactors = append(redactors, r)
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				redactValue(ev.Data, redactors)
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// addHostFields adds the --host_metadata fields to each event before passing
+// it on down the line to the next consumer
+func addHostFields(fields map[string]interface{}) eventStage {
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				for k, v := range fields {
+					ev.Data[k] = v
+				}
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}
+}
+
+// addEventField adds any fields that are to be added to the event before
+// passing the event on down the line to the next consumer
+func addEventField(field string) (eventStage, error) {
+	// separate the k=v field we got from the command line
+	splitField := strings.SplitN(field, "=", 2)
+	if len(splitField) != 2 {
+		return nil, fmt.Errorf("--add_field %q isn't a key=val pair", field)
+	}
+	key := newFieldPath(splitField[0])
+	val := splitField[1]
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			for ev := range toBeSent {
+				key.set(ev.Data, val)
+				newSent <- ev
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// runEventScript runs the --script's transform function over each event
+// before passing it on down the line to the next consumer. Events it drops
+// are still passed on, marked to be dropped, so they're counted as done
+// with when they come to be sent. Events it fails on are sent unchanged,
+// with a warning at most every scriptWarnInterval counting the failures.
+func runEventScript(path string) (eventStage, error) {
+	script, err := newEventScript(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load provided --script: %s", err)
+	}
+	return func(toBeSent chan event.Event) chan event.Event {
+		newSent := make(chan event.Event)
+		go func() {
+			defer script.Close()
+			var failed int
+			var warned time.Time
+			for ev := range toBeSent {
+				keep, err := script.run(&ev)
+				if err != nil {
+					failed++
+					if time.Since(warned) >= scriptWarnInterval {
+						logrus.WithFields(logrus.Fields{
+							"script": path,
+							"err":    err,
+							"failed": failed,
+						}).Warn("--script failed on an event; sending it unchanged")
+						warned = time.Now()
+					}
+				}
+				ev.Drop = !keep
+				newSent <- ev
+			}
+			if failed > 0 {
+				logrus.WithFields(logrus.Fields{
+					"script": path,
+					"failed": failed,
+				}).Warn("--script failed on some events, which were sent unchanged")
+			}
+			close(newSent)
+		}()
+		return newSent
+	}, nil
+}
+
+// eventMetadata is attached to each event sent, to match its response back
+// up with the event
+type eventMetadata struct {
+	id int
+	// position is where the event came in the stream the tracker watched
+	position uint64
+	// timestamp is the event's, to tell how far behind sending is
+	timestamp time.Time
+}
+
+// sendEvents reads from the toBeSent channel and hands the events to out,
+// sending them on their way. Sampling is done here rather than in the output
+// so that events sampled away can be counted as sent straight away; the rest
+// are counted when their results come back. So are the duplicates dedup, if
+// there is one, collapses into the first of them, and the events agg, if
+// there is one, summarises. overload, if there is one, samples more heavily
+// while honeytail can't keep up. replay and limiter, if there are any, pace
+// the events that are sent until ctx is done, after which what's left is sent
+// as fast as it can be.
+func sendEvents(ctx context.Context, toBeSent chan event.Event, out output.Output, tracker *checkpoint.Tracker, sampler *sampler, overload *overloadSampler, dedup *deduper, agg *aggregator, limiter *rateLimiter, replay *replayPacer, doneSending chan bool) {
+	send := func(ev event.Event, sampleRate uint, md eventMetadata) {
+		// only what's left after sampling is paced
+		replay.wait(ctx, ev)
+		limiter.wait(ctx)
+		if err := out.Add(ev, sampleRate, md); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"event": ev,
+				"error": err,
+			}).Error("Unexpected error sending event")
+			tracker.Failed(md.position)
+		}
+	}
+	tick, stop := dedup.tick()
+	defer stop()
+	flush, stopFlush := agg.tick()
+	defer stopFlush()
+	var position uint64
+	for {
+		select {
+		case ev, ok := <-toBeSent:
+			if !ok {
+				for _, held := range dedup.expired(time.Time{}) {
+					send(held.ev, held.sampleRate, held.md)
+				}
+				for _, summary := range agg.flush() {
+					send(summary.ev, 1, summary.md)
+				}
+				doneSending <- true
+				return
+			}
+			position++
+			if ev.Drop {
+				tracker.Sent(position)
+				continue
+			}
+			id := rand.Intn(1000000)
+			sampleRate, keep := sampler.sample(ev)
+			if keep {
+				sampleRate, keep = overload.sample(sampleRate)
+			}
+			if !keep {
+				tracker.Sent(position)
+				continue
+			}
+			md := eventMetadata{id: id, position: position, timestamp: ev.Timestamp}
+			if dedup != nil {
+				// the first of a run of duplicates is sent once the
+				// window's up, the rest are counted against it
+				if !dedup.add(ev, sampleRate, md, time.Now()) {
+					tracker.Sent(position)
+				}
+				continue
+			}
+			if agg != nil {
+				// the event starting a bucket holds its place until the
+				// bucket's summary is sent
+				if !agg.add(ev, sampleRate, md) {
+					tracker.Sent(position)
+				}
+				continue
+			}
+			send(ev, sampleRate, md)
+		case now := <-tick:
+			for _, held := range dedup.expired(now) {
+				send(held.ev, held.sampleRate, held.md)
+			}
+		case <-flush:
+			// summaries count the rate each event was sampled at, so
+			// they're sent unsampled
+			for _, summary := range agg.flush() {
+				send(summary.ev, 1, summary.md)
+			}
+		}
+	}
+}
+
+// handleResponses reads the results from the output, logging them and telling
+// the tracker which events have been sent. Events Honeycomb rejected (other
+// than for being rate limited) won't do any better if they're read again, so
+// they count as sent. It closes done once the output has closed responses.
+func handleResponses(responses chan output.Result, tracker *checkpoint.Tracker, options Config, runStats *runStats, done chan struct{}) {
+	for rsp := range responses {
+		runStats.responses.update(rsp)
+		runStats.countResponse(rsp)
+		md, _ := rsp.Metadata.(eventMetadata)
+		runStats.health.sent(rsp, md.timestamp)
+		logrus.WithFields(logrus.Fields{
+			"event_id":    md.id,
+			"status_code": rsp.StatusCode,
+			"body":        strings.TrimSpace(string(rsp.Body)),
+			"duration":    rsp.Duration,
+			"error":       rsp.Err,
+		}).Debug("event sent")
+		if md.position == 0 {
+			continue
+		}
+		switch {
+		case rsp.Spooled:
+			// it'll be sent from the spool, even after a restart
+			tracker.Sent(md.position)
+		case rsp.Err == output.ErrQueueFull:
+			// --drop_when_full asked for it to be dropped, so there's no
+			// reading it again
+			tracker.Sent(md.position)
+		case rsp.Err == nil && (rsp.StatusCode == 0 || rsp.StatusCode >= 200 && rsp.StatusCode < 300):
+			tracker.Sent(md.position)
+		case rsp.Err == nil && rsp.StatusCode >= 400 && rsp.StatusCode < 500 &&
+			rsp.StatusCode != http.StatusTooManyRequests:
+			logrus.WithFields(logrus.Fields{
+				"status_code": rsp.StatusCode,
+				"body":        strings.TrimSpace(string(rsp.Body)),
+			}).Warn("Event rejected by Honeycomb; it won't be retried")
+			tracker.Sent(md.position)
+		default:
+			tracker.Failed(md.position)
+		}
+	}
+	close(done)
+}
+
+// logStats dumps and resets the stats every interval seconds, until the
+// returned func is called
+func logStats(stats *responseStats, interval uint) func() {
+	logrus.Debugf("Initializing stats reporting. Will print stats once/%d seconds", interval)
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				stats.logAndReset()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(stop)
+	}
+}
+
+// dumpStatsOnSignal dumps the stats, without resetting them, each time
+// honeytail gets a SIGUSR1, until the returned func is called
+func dumpStatsOnSignal(stats *responseStats) func() {
+	signals := make(chan os.Signal, 1)
+	notifyStatusSignal(signals)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				stats.dump()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(stop)
+	}
+}
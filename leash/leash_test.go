@@ -0,0 +1,2398 @@
+package leash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/output"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/htjson"
+	"github.com/honeycombio/honeytail/tail"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// defaultOptions is a fully populated Config with good defaults to start from
+var defaultOptions = Config{
+	// each test will have to populate APIHost with the location of its test server
+	APIHost:    "",
+	SampleRate: 1,
+	NumSenders: 1,
+	Reqs: RequiredOptions{
+		// using the json parser for everything because we're not testing parsers here.
+		ParserName: "json",
+		WriteKey:   "abcabc123123",
+		// each test will specify its own logfile
+		// LogFiles:   []string{tmpdir + ""},
+		Dataset: "pika",
+	},
+	Tail: tail.TailOptions{
+		ReadFrom: "start",
+		Stop:     true,
+	},
+	StatusInterval: 1,
+}
+
+// test testing framework
+func TestHTTPtest(t *testing.T) {
+	ts := &testSetup{}
+	ts.start(t, &Config{})
+	defer ts.close()
+	ts.rsp.responseBody = "whatup pikachu"
+	res, err := http.Get(ts.server.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	greeting, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	testEquals(t, res.StatusCode, 200)
+	testEquals(t, string(greeting), "whatup pikachu")
+	testEquals(t, ts.rsp.reqCounter, 1)
+}
+
+func TestBasicSend(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/first.log"
+	fh, err := os.Create(logFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	fmt.Fprintf(fh, `{"format":"json"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json"}`)
+	teamID := ts.rsp.req.Header.Get("X-Honeycomb-Team")
+	testEquals(t, teamID, "abcabc123123")
+	request_url := ts.rsp.req.URL.Path
+	testEquals(t, request_url, "/1/batch/pika")
+	testEquals(t, ts.rsp.reqSampleRate, uint(1))
+}
+
+func TestAutoParser(t *testing.T) {
+	opts := defaultOptions
+	opts.Reqs.ParserName = "auto"
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/auto.log"
+	fh, err := os.Create(logFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	fmt.Fprintf(fh, `{"format":"json"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json"}`)
+}
+
+func TestDropField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/drop.log"
+	fh, _ := os.Create(logFileName)
+	defer fh.Close()
+	fmt.Fprintf(fh, `{"dropme":"chew","format":"json","reallygone":"notyet"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"dropme":"chew","format":"json","reallygone":"notyet"}`)
+	opts.DropFields = []string{"dropme"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 2)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json","reallygone":"notyet"}`)
+	opts.DropFields = []string{"dropme", "reallygone"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 3)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json"}`)
+}
+
+func TestNormalizeFieldNames(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"X-Request-Id":"abc","app_User Agent":"curl","app_":"kept","Status":200,"status":"taken","Headers":{"Content-Type":"text/html"}}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.JSON.FlattenDepth = 1
+	opts.LowercaseFields = true
+	opts.UnderscoreFields = true
+	opts.StripFieldPrefixes = []string{"app_"}
+	opts.RenameFields = []string{"x_request_id=request_id"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"Status":200,"app_":"kept","headers.content_type":"text/html","request_id":"abc","status":"taken","user_agent":"curl"}`)
+}
+
+func TestAllowField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"time":"2016-08-01T00:00:00Z","keep":1,"internal":2,"also":3,"other":4}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.AllowFields = []string{"keep", "also"}
+	opts.AddFields = []string{"added=yes"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"added":"yes","also":3,"keep":1}`)
+	// the timestamp is kept
+	testEquals(t, ts.rsp.reqTime, "2016-08-01T00:00:00Z")
+}
+
+func TestFieldPath(t *testing.T) {
+	data := map[string]interface{}{
+		"password": "top",
+		"user": map[string]interface{}{
+			"name":     "ann",
+			"password": "nested",
+		},
+		"db.password":        "flattened",
+		"request.headers":    map[string]interface{}{"authorization": "mixed", "host": "example.com"},
+		"request.user_agent": "curl",
+	}
+	newFieldPath("*.password").walk(data, func(m map[string]interface{}, key string) {
+		m[key] = "x"
+	})
+	newFieldPath("request.headers.authorization").walk(data, func(m map[string]interface{}, key string) {
+		delete(m, key)
+	})
+	newFieldPath("request.headers.region").set(data, "us")
+	newFieldPath("user.id").set(data, 1)
+	newFieldPath("new.field").set(data, true)
+	testEquals(t, data, map[string]interface{}{
+		"password": "top",
+		"user": map[string]interface{}{
+			"name":     "ann",
+			"password": "x",
+			"id":       1,
+		},
+		"db.password":        "x",
+		"request.headers":    map[string]interface{}{"host": "example.com", "region": "us"},
+		"request.user_agent": "curl",
+		"new.field":          true,
+	})
+}
+
+func TestDeepFields(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"request":{"headers":{"authorization":"secret","cookie":"c"},"path":"/"},"user":{"password":"hunter2"}}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.JSON.FlattenDepth = 2
+	opts.DropFields = []string{"request.headers.cookie"}
+	opts.ScrubFields = []string{"*.password", "request.headers.authorization"}
+	opts.AddFields = []string{"request.region=us"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, fmt.Sprintf(`{"request.headers.authorization":"%x","request.path":"/","request.region":"us","user.password":"%x"}`,
+		sha256.Sum256([]byte("secret")), sha256.Sum256([]byte("hunter2"))))
+}
+
+func TestRedactPattern(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"msg":"mail ann@example.com, card 4111 1111 1111 1111, order 1234567890123","auth":"Bearer abc.DEF-123","ssn":"078-05-1120","status":200,"key":"sk_live_42"}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.RedactPatterns = []string{"email", "credit_card", "ssn", "bearer_token", `sk_live_\w+`}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	// the order number isn't a card number, failing the Luhn check
+	testEquals(t, ts.rsp.reqBody, `{"auth":"[REDACTED:bearer_token]","key":"[REDACTED]","msg":"mail [REDACTED:email], card [REDACTED:credit_card], order 1234567890123","ssn":"[REDACTED:ssn]","status":200}`)
+}
+
+func TestScrubField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/scrub.log"
+	fh, _ := os.Create(logFileName)
+	defer fh.Close()
+	fmt.Fprintf(fh, `{"format":"json","name":"hidden"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.ScrubFields = []string{"name"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json","name":"e564b4081d7a9ea4b00dada53bdae70c99b87b6fce869f0c3dd4d2bfa1e53e1c"}`)
+}
+
+func TestAddField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/add.log"
+	logfh, _ := os.Create(logFileName)
+	defer logfh.Close()
+	fmt.Fprintf(logfh, `{"format":"json"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.AddFields = []string{`newfield=newval`}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json","newfield":"newval"}`)
+	opts.AddFields = []string{"newfield=newval", "second=new"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json","newfield":"newval","second":"new"}`)
+}
+
+func TestRenameField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"body_bytes_sent":42,"status":200,"keep":"me"}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.RenameFields = []string{"body_bytes_sent=bytes", "status=keep", "missing=other"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"bytes":42,"keep":200}`)
+}
+
+func TestExtractField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"path":"/orders/1234/items/","n":5}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.ExtractFields = []string{
+		`path:^/orders/(?P<order_id>[0-9]+)/(?P<section>\w+)?(?P<missing>x)?`,
+		`n:(?P<nope>.*)`,
+	}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"n":5,"order_id":"1234","path":"/orders/1234/items/","section":"items"}`)
+}
+
+func TestRequestShape(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"request":"GET /orders/42?page=2&token=abc&q=x HTTP/1.1"}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.RequestShape = "request"
+	opts.RequestPatterns = []string{"/orders/:id"}
+	opts.RequestQueryParams = []string{"page", "token"}
+	opts.RequestDropQueryParams = []string{"token"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"request":"GET /orders/42?page=2\u0026token=abc\u0026q=x HTTP/1.1","url_path":"/orders/42","url_path_id":"42","url_query":"page=2\u0026q=x","url_query_page":"2","url_shape":"/orders/:id?page=?\u0026q=?"}`)
+}
+
+func TestCoerceValue(t *testing.T) {
+	for _, tc := range []struct {
+		val      interface{}
+		typ      string
+		expected interface{}
+	}{
+		{"200", "int", int64(200)},
+		{"3.4k", "int", int64(3400)},
+		{"2MiB", "int", int64(2 << 20)},
+		{"512B", "int", int64(512)},
+		{"12ms", "float", 12.0},
+		{"1.5s", "int", int64(1500)},
+		{"0.25", "float", 0.25},
+		{int64(7), "float", 7.0},
+		{"yes", "bool", true},
+		{"false", "bool", false},
+		{0.0, "bool", false},
+		{1234.5, "string", "1234.5"},
+		{int64(42), "string", "42"},
+	} {
+		actual, err := coerceValue(tc.val, tc.typ)
+		if err != nil {
+			t.Errorf("coercing %#v to %s: %s", tc.val, tc.typ, err)
+			continue
+		}
+		testEquals(t, actual, tc.expected, fmt.Sprintf("%#v to %s", tc.val, tc.typ))
+	}
+	for _, bad := range []string{"", "abc", "12q", "1.2.3k"} {
+		if _, err := coerceValue(bad, "int"); err == nil {
+			t.Errorf("expected an error coercing %q to int", bad)
+		}
+	}
+}
+
+func TestCoerceField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"status":"200","duration":"12ms","cached":"true","id":123,"size":"lots"}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.CoerceFields = []string{"status:int", "duration:float", "cached:bool", "id:string", "size:int"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"cached":true,"duration":12,"id":"123","size":"lots","status":200}`)
+}
+
+func TestNormalizeField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"latency":"2.34ms","upstream":"1.2s","request_time":"0.25","sent":"4k","body":"3MB","rows":12}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.NormalizeFields = []string{"latency:duration", "upstream:duration", "request_time:duration:s", "sent:size", "body:size", "rows:size:KiB"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"body":"3MB","body_bytes":3000000,"latency":"2.34ms","latency_ms":2.34,"request_time":"0.25","request_time_ms":250,"rows":12,"rows_bytes":12288,"sent":"4k","sent_bytes":4000,"upstream":"1.2s","upstream_ms":1200}`)
+}
+
+func TestHostMetadata(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	ec2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.URL.Path == "/latest/api/token" {
+			w.Write([]byte("tok"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(map[string]string{
+			"/latest/meta-data/instance-id":                 "i-0abc",
+			"/latest/meta-data/instance-type":               "m5.large",
+			"/latest/meta-data/placement/availability-zone": "us-east-1a",
+			"/latest/meta-data/placement/region":            "us-east-1",
+		}[r.URL.Path]))
+	}))
+	defer ec2.Close()
+	gce := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(map[string]string{
+			"/computeMetadata/v1/instance/id":           "123",
+			"/computeMetadata/v1/instance/name":         "web-1",
+			"/computeMetadata/v1/instance/machine-type": "projects/42/machineTypes/e2-small",
+			"/computeMetadata/v1/instance/zone":         "projects/42/zones/europe-west1-b",
+			"/computeMetadata/v1/project/project-id":    "shop",
+		}[r.URL.Path]))
+	}))
+	defer gce.Close()
+	defer func(ec2URL, gceURL string) {
+		ec2MetadataURL, gceMetadataURL = ec2URL, gceURL
+	}(ec2MetadataURL, gceMetadataURL)
+	ec2MetadataURL = ec2.URL + "/latest"
+	gceMetadataURL = gce.URL + "/computeMetadata/v1"
+	podInfo := filepath.Join(ts.tmpdir, "podinfo")
+	os.MkdirAll(filepath.Join(podInfo, "..data"), 0755)
+	ioutil.WriteFile(filepath.Join(podInfo, "namespace"), []byte("prod\n"), 0644)
+	ioutil.WriteFile(filepath.Join(podInfo, "labels"), []byte("app=\"web\"\ntier=\"frontend\"\n"), 0644)
+
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"msg":"hi"}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.HostMetadata = []string{"ec2", "gce", "kubernetes"}
+	opts.PodInfoDir = podInfo
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"ec2_availability_zone":"us-east-1a","ec2_instance_id":"i-0abc","ec2_instance_type":"m5.large","ec2_region":"us-east-1",`+
+		`"gce_instance_id":"123","gce_instance_name":"web-1","gce_machine_type":"e2-small","gce_project_id":"shop","gce_zone":"europe-west1-b",`+
+		`"k8s_labels.app":"web","k8s_labels.tier":"frontend","k8s_namespace":"prod","msg":"hi"}`)
+
+	hostname, _ := os.Hostname()
+	opts.HostMetadata = []string{"host"}
+	testEquals(t, hostMetadata(opts)["hostname"], hostname)
+}
+
+func TestDeriveField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"total_ms":120,"upstream_ms":"100","status":"503","method":"GET"}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.CoerceFields = []string{"upstream_ms:float"}
+	opts.DeriveFields = []string{
+		"backend_ms=total_ms - upstream_ms",
+		`tier=status >= 500 ? "error" : "ok"`,
+		`label=method + " " + tier`,
+		"missing=nope * 2",
+	}
+	opts.DropFields = []string{"upstream_ms"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"backend_ms":20,"label":"GET error","method":"GET","status":"503","tier":"error","total_ms":120}`)
+}
+
+func TestScript(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"level":"debug","msg":"noisy"}
+{"level":"info","msg":"hello","user":{"id":7},"secret":"x"}
+{"level":"error","msg":"replaced"}
+{"level":"fail","msg":"unchanged"}
+`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.JSON.FlattenDepth = 1
+	opts.Script = ts.tmpdir + "/transform.lua"
+	ioutil.WriteFile(opts.Script, []byte(`
+prefix = "seen "
+
+function transform(fields)
+  if fields.level == "debug" then
+    return false
+  end
+  if fields.level == "error" then
+    return {alert = true, count = 2}
+  end
+  if fields.level == "fail" then
+    error("can't transform this")
+  end
+  fields.msg = prefix .. fields.msg
+  fields.secret = nil
+  fields.words = {"seen", fields.level}
+end
+`), 0644)
+	opts.Output = []string{"file://" + ts.tmpdir + "/events.ndjson"}
+	testRun(t, opts)
+	content, _ := ioutil.ReadFile(ts.tmpdir + "/events.ndjson")
+	events := strings.Split(strings.TrimSpace(string(content)), "\n")
+	testEquals(t, len(events), 3)
+	var data []string
+	for _, line := range events {
+		var ev struct {
+			Data json.RawMessage `json:"data"`
+		}
+		json.Unmarshal([]byte(line), &ev)
+		data = append(data, string(ev.Data))
+	}
+	// the debug event is dropped, and the one the script fails on is sent
+	// as it was
+	testEquals(t, data, []string{
+		`{"level":"info","msg":"seen hello","user.id":7,"words":["seen","info"]}`,
+		`{"alert":true,"count":2}`,
+		`{"level":"fail","msg":"unchanged"}`,
+	})
+}
+
+// writeMMDB writes a MaxMind database of IPv4 addresses to path, with a search
+// tree of one node: addresses with the top bit set map to rec and the rest
+// aren't found
+func writeMMDB(t *testing.T, path, dbType string, rec map[string]interface{}) {
+	const nodeCount = 1
+	var buf bytes.Buffer
+	// 24 bit records, the left one empty and the right pointing at rec
+	buf.Write([]byte{0, 0, nodeCount, 0, 0, nodeCount + 16})
+	buf.Write(make([]byte, 16))
+	buf.Write(mmdbEncode(rec))
+	buf.WriteString("\xAB\xCD\xEFMaxMind.com")
+	buf.Write(mmdbEncode(map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+		"database_type":               dbType,
+		"description":                 map[string]interface{}{},
+		"ip_version":                  uint16(4),
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	}))
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mmdbEncode encodes v in the MaxMind DB data format, for the few types and
+// sizes writeMMDB needs
+func mmdbEncode(v interface{}) []byte {
+	control := func(typ, size int) []byte {
+		var extra []byte
+		if size >= 29 {
+			extra = []byte{byte(size - 29)}
+			size = 29
+		}
+		b := []byte{byte(typ<<5 | size)}
+		if typ > 7 {
+			b = []byte{byte(size), byte(typ - 7)}
+		}
+		return append(b, extra...)
+	}
+	unsigned := func(typ int, n uint64) []byte {
+		var b []byte
+		for ; n > 0; n >>= 8 {
+			b = append([]byte{byte(n)}, b...)
+		}
+		return append(control(typ, len(b)), b...)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case uint16:
+		return unsigned(5, uint64(v))
+	case uint32:
+		return unsigned(6, uint64(v))
+	case uint64:
+		return unsigned(9, v)
+	case []interface{}:
+		b := control(11, len(v))
+		for _, elem := range v {
+			b = append(b, mmdbEncode(elem)...)
+		}
+		return b
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := control(7, len(v))
+		for _, k := range keys {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(v[k])...)
+		}
+		return b
+	}
+	panic(fmt.Sprintf("can't encode %T", v))
+}
+
+func TestGeoIP(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	cityDB := ts.tmpdir + "/city.mmdb"
+	writeMMDB(t, cityDB, "GeoLite2-City", map[string]interface{}{
+		"city":         map[string]interface{}{"names": map[string]interface{}{"en": "London"}},
+		"country":      map[string]interface{}{"iso_code": "GB"},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": "ENG", "names": map[string]interface{}{"en": "England"}}},
+	})
+	asnDB := ts.tmpdir + "/asn.mmdb"
+	writeMMDB(t, asnDB, "GeoLite2-ASN", map[string]interface{}{
+		"autonomous_system_number":       uint32(64496),
+		"autonomous_system_organization": "Example Networks",
+	})
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"remote_addr":"203.0.113.9:5123, 10.0.0.1"}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.GeoIPField = "remote_addr"
+	opts.GeoIPDBs = []string{cityDB, asnDB}
+	opts.ScrubFields = []string{"remote_addr"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"geo_as_org":"Example Networks","geo_asn":64496,"geo_city":"London","geo_country":"GB","geo_region":"England","remote_addr":"`+
+		fmt.Sprintf("%x", sha256.Sum256([]byte("203.0.113.9:5123, 10.0.0.1")))+`"}`)
+
+	// addresses the databases don't know are left alone
+	ioutil.WriteFile(logFileName, []byte(`{"remote_addr":"10.0.0.1"}`), 0644)
+	opts.ScrubFields = nil
+	ts.rsp.reset()
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"remote_addr":"10.0.0.1"}`)
+}
+
+func TestTimestampOptions(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"time":"2016-08-01 12:00:00","a":1}`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.JSON.Format = "2006-01-02 15:04:05"
+	opts.Timezone = "America/New_York"
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	sent, err := time.Parse(time.RFC3339Nano, ts.rsp.reqTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEquals(t, sent.UTC(), time.Date(2016, 8, 1, 16, 0, 0, 0, time.UTC))
+
+	// a day's worth of milliseconds is in 1970, which is clamped to now
+	ioutil.WriteFile(logFileName, []byte(`{"ts":86400000,"a":1}`), 0644)
+	opts.JSON = htjson.Options{TimeFieldName: "ts"}
+	opts.Timezone = ""
+	opts.EpochUnit = "ms"
+	opts.MaxTimestampPast = 24 * time.Hour
+	ts.rsp.reset()
+	before := time.Now()
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"a":1,"timestamp_clamped":"1970-01-02T00:00:00Z"}`)
+	sent, err = time.Parse(time.RFC3339Nano, ts.rsp.reqTime)
+	if err != nil || sent.Before(before.Add(-time.Second)) {
+		t.Errorf("expected the event to be sent with the current time, got %s", sent)
+	}
+}
+
+func TestConcurrentRuns(t *testing.T) {
+	// each run has its own timezone, parse errors and Honeycomb client
+	zones := []string{"America/New_York", "Asia/Tokyo"}
+	expected := []time.Time{
+		time.Date(2016, 8, 1, 16, 0, 0, 0, time.UTC),
+		time.Date(2016, 8, 1, 3, 0, 0, 0, time.UTC),
+	}
+	setups := make([]*testSetup, len(zones))
+	results := make([]Result, len(zones))
+	var wg sync.WaitGroup
+	for i, zone := range zones {
+		opts := defaultOptions
+		ts := &testSetup{}
+		ts.start(t, &opts)
+		defer ts.close()
+		setups[i] = ts
+		logFileName := ts.tmpdir + "/file.log"
+		content := `{"time":"2016-08-01 12:00:00","a":1}` + "\n"
+		if i == 0 {
+			content += "not json\n"
+		}
+		ioutil.WriteFile(logFileName, []byte(content), 0644)
+		opts.Reqs.LogFiles = []string{logFileName}
+		opts.JSON.Format = "2006-01-02 15:04:05"
+		opts.Timezone = zone
+		wg.Add(1)
+		go func(i int, opts Config) {
+			defer wg.Done()
+			results[i], _ = Run(context.Background(), opts)
+		}(i, opts)
+	}
+	wg.Wait()
+	for i, ts := range setups {
+		testEquals(t, ts.rsp.reqCounter, 1)
+		sent, err := time.Parse(time.RFC3339Nano, ts.rsp.reqTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEquals(t, sent.UTC(), expected[i])
+	}
+	testEquals(t, results[0].ParseErrors, int64(1))
+	testEquals(t, results[1].ParseErrors, int64(0))
+}
+
+func TestDynamicSampler(t *testing.T) {
+	opts := defaultOptions
+	opts.SampleRate = 10
+	opts.DynSample = []string{"status", "url_shape"}
+	opts.DynWindowSec = 30
+	s, _ := newSampler(opts)
+	ev := event.Event{Data: map[string]interface{}{"status": float64(500), "url_shape": "/orders/:id"}}
+	testEquals(t, s.dynamicKey(ev), "500_/orders/:id")
+	testEquals(t, s.dynamicKey(event.Event{Data: map[string]interface{}{"url_shape": "/"}}), "_/")
+	// nothing's been counted yet, so the first window's events are all kept
+	for i := 0; i < 100; i++ {
+		rate, keep := s.sample(ev)
+		if rate != 1 || !keep {
+			t.Fatalf("expected the event to be kept at a rate of 1, got %d, %v", rate, keep)
+		}
+	}
+}
+
+func TestSampleRule(t *testing.T) {
+	opts := defaultOptions
+	opts.SampleRate = 1000000
+	opts.SampleRules = []string{"status>=500:1", "path=/healthz:0", "method!=GET:1"}
+	s, err := newSampler(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		data map[string]interface{}
+		rate uint
+		keep bool
+	}{
+		{map[string]interface{}{"status": float64(503), "path": "/healthz"}, 1, true},
+		{map[string]interface{}{"status": "500", "method": "GET"}, 1, true},
+		{map[string]interface{}{"status": float64(200), "path": "/healthz"}, 0, false},
+		{map[string]interface{}{"status": float64(200), "method": "POST"}, 1, true},
+		{map[string]interface{}{"method": "GET"}, 1000000, false},
+	}
+	rand.Seed(1)
+	for _, tc := range testCases {
+		rate, keep := s.sample(event.Event{Data: tc.data})
+		if rate != tc.rate || keep != tc.keep {
+			t.Errorf("sample(%v) = %d, %v, expected %d, %v", tc.data, rate, keep, tc.rate, tc.keep)
+		}
+	}
+	for _, spec := range []string{"status>=500", "status:1", "status>=5xx:1", "path=/:x"} {
+		if _, err := parseSampleRule(spec); err == nil {
+			t.Errorf("expected an error parsing %q", spec)
+		}
+	}
+}
+
+func TestSampleOnField(t *testing.T) {
+	opts := defaultOptions
+	opts.SampleRate = 10
+	opts.SampleField = "request_id"
+	s, _ := newSampler(opts)
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		ev := event.Event{Data: map[string]interface{}{"request_id": fmt.Sprintf("req-%d", i)}}
+		_, keep := s.sample(ev)
+		// the same request id is always kept, or always dropped
+		for j := 0; j < 3; j++ {
+			if _, again := s.sample(ev); again != keep {
+				t.Fatalf("req-%d was kept %v then %v", i, keep, again)
+			}
+		}
+		if keep {
+			kept++
+		}
+	}
+	if kept < 900 || kept > 1100 {
+		t.Errorf("expected about 1000 of 10000 request ids to be kept at a rate of 10, got %d", kept)
+	}
+}
+
+func TestPresampledField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/presampled.log"
+	logfh, _ := os.Create(logFileName)
+	defer logfh.Close()
+	fmt.Fprintf(logfh, `{"path":"/orders","samplerate":5}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.PreSampled = "samplerate"
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"path":"/orders"}`)
+	testEquals(t, ts.rsp.reqSampleRate, uint(5))
+
+	// kept 1 in 4 by honeytail of the 1 in 5 already kept, so 1 in 20
+	opts.SampleRate = 4
+	s, _ := newSampler(opts)
+	var rate uint
+	var keep bool
+	for i := 0; i < 100 && !keep; i++ {
+		rate, keep = s.sample(event.Event{Data: map[string]interface{}{"samplerate": "5"}})
+	}
+	testEquals(t, rate, uint(20))
+}
+
+func TestDedup(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/dedup.log"
+	logfh, _ := os.Create(logFileName)
+	defer logfh.Close()
+	fmt.Fprintln(logfh, `{"error":"timeout","host":"b"}`)
+	for i := 0; i < 3; i++ {
+		fmt.Fprintln(logfh, `{"error":"timeout","host":"a"}`)
+	}
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.DedupFields = []string{"error", "host"}
+	opts.DedupWindow = time.Hour
+	testRun(t, opts)
+	// what's held is sent once the input's done, in the order it was read
+	testEquals(t, ts.rsp.reqCounter, 2)
+	testEquals(t, ts.rsp.reqBody, `{"dedup_count":3,"error":"timeout","host":"a"}`)
+}
+
+func TestDeduperWindow(t *testing.T) {
+	d := newDeduper([]string{"error"}, 10*time.Second)
+	start := time.Now()
+	newEvent := func(err interface{}) event.Event {
+		return event.Event{Data: map[string]interface{}{"error": err}}
+	}
+	testEquals(t, d.add(newEvent("timeout"), 1, eventMetadata{position: 1}, start), true)
+	testEquals(t, d.add(newEvent("timeout"), 1, eventMetadata{position: 2}, start.Add(time.Second)), false)
+	// the same value as a different type, and no value at all, aren't duplicates
+	testEquals(t, d.add(newEvent(float64(1)), 1, eventMetadata{position: 3}, start.Add(2*time.Second)), true)
+	testEquals(t, d.add(newEvent("1"), 1, eventMetadata{position: 4}, start.Add(2*time.Second)), true)
+	testEquals(t, d.add(event.Event{Data: map[string]interface{}{}}, 1, eventMetadata{position: 5}, start.Add(2*time.Second)), true)
+	testEquals(t, len(d.expired(start.Add(9*time.Second))), 0)
+	due := d.expired(start.Add(10 * time.Second))
+	testEquals(t, len(due), 1)
+	testEquals(t, due[0].md.position, uint64(1))
+	testEquals(t, due[0].ev.Data["dedup_count"], 2)
+	// its window's over, so the next starts another
+	testEquals(t, d.add(newEvent("timeout"), 1, eventMetadata{position: 6}, start.Add(11*time.Second)), true)
+	testEquals(t, len(d.expired(time.Time{})), 4)
+}
+
+func TestAggregate(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/aggregate.log"
+	logfh, _ := os.Create(logFileName)
+	defer logfh.Close()
+	fmt.Fprintln(logfh, `{"status":500,"endpoint":"/orders","duration_ms":900}`)
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(logfh, `{"status":200,"endpoint":"/orders","duration_ms":%d,"user":"u%d"}`+"\n", i, i)
+	}
+	fmt.Fprintln(logfh, `{"status":200,"endpoint":"/orders","duration_ms":"slow"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.AggregateBy = []string{"status", "endpoint"}
+	opts.AggregateFields = []string{"duration_ms"}
+	opts.AggregateInterval = time.Hour
+	testRun(t, opts)
+	// the buckets are sent once the input's done, in the order they started
+	testEquals(t, ts.rsp.reqCounter, 2)
+	testEquals(t, ts.rsp.reqBody, `{"count":21,"duration_ms_max":20,"duration_ms_min":1,"duration_ms_p95":19,"duration_ms_sum":210,"endpoint":"/orders","status":200}`)
+	testEquals(t, ts.rsp.reqSampleRate, uint(1))
+}
+
+func TestAggregatorFlush(t *testing.T) {
+	a := newAggregator([]string{"status"}, []string{"duration_ms"}, time.Minute)
+	newEvent := func(status, duration float64) event.Event {
+		return event.Event{Data: map[string]interface{}{"status": status, "duration_ms": duration}}
+	}
+	testEquals(t, a.add(newEvent(200, 10), 4, eventMetadata{position: 1}), true)
+	testEquals(t, a.add(newEvent(200, 30), 1, eventMetadata{position: 2}), false)
+	testEquals(t, a.add(newEvent(500, 5), 1, eventMetadata{position: 3}), true)
+	summaries := a.flush()
+	testEquals(t, len(summaries), 2)
+	testEquals(t, summaries[0].md.position, uint64(1))
+	// the count and sum are weighted by the rate each event was sampled at
+	testEquals(t, summaries[0].ev.Data["count"], uint(5))
+	testEquals(t, summaries[0].ev.Data["duration_ms_sum"], float64(70))
+	testEquals(t, summaries[0].ev.Data["duration_ms_max"], float64(30))
+	testEquals(t, summaries[1].ev.Data["status"], float64(500))
+	// flushing starts the buckets over
+	testEquals(t, len(a.flush()), 0)
+	testEquals(t, a.add(newEvent(200, 10), 1, eventMetadata{position: 4}), true)
+}
+
+func TestValidate(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/validate.log"
+	ioutil.WriteFile(logFileName, []byte(`{"status":500}`+"\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName, "-"}
+	opts.RenameFields = []string{"status=status_code"}
+	opts.DeriveFields = []string{"error=status_code >= 500"}
+	opts.SampleRules = []string{"status_code>=500:1"}
+	opts.Tail.StateDir = ts.tmpdir + "/state"
+	// returns, rather than exiting, for valid options, and leaves the state
+	// and the log file alone
+	if err := Validate(opts, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(opts.Tail.StateDir); !os.IsNotExist(err) {
+		t.Error("expected validating not to create the state directory")
+	}
+	testEquals(t, ts.rsp.reqCounter, 0)
+
+	// a transform flag that can't be used is returned from Validate, and
+	// those that don't parse from CheckConfig too
+	opts.Script = ts.tmpdir + "/missing.lua"
+	if err := Validate(opts, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "--script") {
+		t.Errorf("expected the missing --script to fail validation, got %v", err)
+	}
+	opts.Script = ""
+	for _, bad := range []struct {
+		flag string
+		set  func(o *Config)
+	}{
+		{"--parse_field", func(o *Config) { o.ParseFields = []string{"payload:missing"} }},
+		{"--rename_field", func(o *Config) { o.RenameFields = []string{"status"} }},
+		{"--extract_field", func(o *Config) { o.ExtractFields = []string{"path:/users/([0-9]+)"} }},
+		{"--derive_field", func(o *Config) { o.DeriveFields = []string{"error=status_code >="} }},
+		{"--coerce_field", func(o *Config) { o.CoerceFields = []string{"status:date"} }},
+		{"--normalize_field", func(o *Config) { o.NormalizeFields = []string{"took:weight"} }},
+	} {
+		badOpts := opts
+		bad.set(&badOpts)
+		if err := CheckConfig(badOpts); err == nil || !strings.Contains(err.Error(), bad.flag) {
+			t.Errorf("expected CheckConfig to reject the %s, got %v", bad.flag, err)
+		}
+		if err := Validate(badOpts, ioutil.Discard); err == nil || !strings.Contains(err.Error(), bad.flag) {
+			t.Errorf("expected Validate to reject the %s, got %v", bad.flag, err)
+		}
+	}
+}
+
+func TestSampleLines(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/preview.log"
+	ioutil.WriteFile(logFileName, []byte(`{"time":"2017-01-02T03:04:05Z","user":"pika","cookie":"abc"}`+"\n"+
+		"not json\n"+
+		`{"user":"chu"}`+"\n"+
+		`{"user":"unread"}`+"\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.DropFields = []string{"cookie"}
+	opts.ScrubFields = []string{"user"}
+	opts.Modes.SampleLines = 3
+	var out bytes.Buffer
+	if err := Preview(opts, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"with the json parser: 3 lines",
+		"line 1:\n",
+		"2017-01-02T03:04:05Z, from the line",
+		"dropped:   cookie\n",
+		"changed:   user\n",
+		"lines 2-3:\n  line 2     not json\n",
+		"one event from 2 lines",
+		"as none was found in the line",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected the preview to include %q, got:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "unread") {
+		t.Error("expected the preview to stop after 3 lines")
+	}
+	testEquals(t, ts.rsp.reqCounter, 0)
+}
+
+func TestStatsdMetrics(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/metrics.log"
+	logfh, _ := os.Create(logFileName)
+	for i := 0; i < 9; i++ {
+		fmt.Fprintf(logfh, `{"line":%d}`+"\n", i)
+	}
+	fmt.Fprintln(logfh, "not json")
+	logfh.Close()
+	opts.Reqs.LogFiles = []string{logFileName}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	opts.Statsd.Address = conn.LocalAddr().String()
+	opts.Statsd.Prefix = "honeytail."
+	opts.Statsd.Interval = time.Hour
+	testRun(t, opts)
+
+	// run sends what's left once everything's been sent, so it's all there
+	counts := make(map[string]int)
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		for _, metric := range strings.Split(string(buf[:n]), "\n") {
+			parts := strings.SplitN(metric, ":", 2)
+			value := strings.Split(parts[1], "|")
+			if value[1] == "c" {
+				count, _ := strconv.Atoi(value[0])
+				counts[parts[0]] += count
+			} else {
+				counts[parts[0]]++
+			}
+		}
+	}
+	testEquals(t, counts["honeytail.lines_read"], 10)
+	testEquals(t, counts["honeytail.parse_errors"], 1)
+	testEquals(t, counts["honeytail.events.sent"], 9)
+	testEquals(t, counts["honeytail.events.failed"], 0)
+	testEquals(t, counts["honeytail.send_duration"], 9)
+}
+
+func TestHealth(t *testing.T) {
+	h := newHealth(":0")
+	get := func(path string) (int, healthStatus) {
+		w := httptest.NewRecorder()
+		h.handle(path == "/readyz")(w, httptest.NewRequest("GET", path, nil))
+		var status healthStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, status
+	}
+
+	// nothing's being read yet
+	code, _ := get("/healthz")
+	testEquals(t, code, http.StatusServiceUnavailable)
+
+	lines := make(chan string)
+	watched := h.watchReading(lines)
+	code, status := get("/readyz")
+	testEquals(t, code, http.StatusOK)
+	testEquals(t, status.FilesReading, 1)
+	testEquals(t, status.LastSendOK, true)
+
+	h.sent(output.Result{StatusCode: 202}, time.Now().Add(-time.Minute))
+	code, status = get("/readyz")
+	testEquals(t, code, http.StatusOK)
+	if status.LastSend == nil || status.LagSeconds < 59 || status.LagSeconds > 70 {
+		t.Errorf("expected a send a minute behind, got %+v", status)
+	}
+
+	// a failed send isn't ready, but is still alive
+	h.sent(output.Result{StatusCode: 500}, time.Now())
+	code, status = get("/readyz")
+	testEquals(t, code, http.StatusServiceUnavailable)
+	testEquals(t, status.LastSendError, "Internal Server Error")
+	code, _ = get("/healthz")
+	testEquals(t, code, http.StatusOK)
+
+	// once the file's finished, nothing's being read
+	close(lines)
+	for range watched {
+	}
+	code, status = get("/healthz")
+	testEquals(t, code, http.StatusServiceUnavailable)
+	testEquals(t, status.FilesReading, 0)
+
+	// without --status_listen there's nothing to report
+	var off *health
+	testEquals(t, off == newHealth(""), true)
+	off.sent(output.Result{}, time.Now())
+}
+
+func TestStatusSummary(t *testing.T) {
+	run := &runStats{}
+	stats := newResponseStats(run, "json")
+	var buf bytes.Buffer
+	stats.out = &buf
+	atomic.AddInt64(&run.lines, 5)
+	for i := 1; i <= 4; i++ {
+		stats.update(output.Result{StatusCode: 202, Duration: time.Duration(i) * time.Millisecond})
+	}
+	stats.update(output.Result{StatusCode: 500, Duration: 10 * time.Millisecond})
+
+	// a dump leaves the interval's stats to be counted again
+	for i := 0; i < 2; i++ {
+		stats.dump()
+		var summary statusSummary
+		if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		testEquals(t, summary.Lines, int64(5))
+		testEquals(t, summary.Events, 5)
+		testEquals(t, summary.SendFailures, 1)
+		testEquals(t, summary.StatusCodes, map[int]int{202: 4, 500: 1})
+		testEquals(t, summary.SendLatency, statusLatency{Min: 1, P50: 3, P90: 10, P99: 10, Max: 10})
+		if summary.LinesPerSecond <= 0 || summary.EventsPerSecond <= 0 {
+			t.Errorf("expected rates, got %+v", summary)
+		}
+	}
+
+	// a new interval starts from nothing
+	stats.logAndReset()
+	buf.Reset()
+	stats.dump()
+	var summary statusSummary
+	if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	testEquals(t, summary.Lines, int64(0))
+	testEquals(t, summary.Events, 0)
+	testEquals(t, summary.SendLatency, statusLatency{})
+}
+
+func TestParseErrorLog(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/errors.log"
+	logfh, _ := os.Create(logFileName)
+	fmt.Fprintln(logfh, `{"ok":1}`)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(logfh, "not json %d\n", i)
+	}
+	logfh.Close()
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.ParseErrorLog = ts.tmpdir + "/parse_errors.log"
+	opts.ParseErrorLogRate = 2
+	testRun(t, opts)
+
+	contents, err := ioutil.ReadFile(opts.ParseErrorLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written, skipped int
+	for i, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		var pe parseError
+		if err := json.Unmarshal([]byte(line), &pe); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && (pe.Line != "not json 0" || pe.Error == "") {
+			t.Errorf("expected the first line that failed, with why, got %+v", pe)
+		}
+		if pe.Skipped > 0 {
+			skipped += pe.Skipped
+		} else {
+			written++
+		}
+	}
+	// the lines are read in well under a second, but if they straddle one
+	// more of them are written
+	if written < 2 || written+skipped != 5 {
+		t.Errorf("expected at least 2 of the 5 lines to be written and the rest counted, got %d and %d", written, skipped)
+	}
+
+	// another run, without the log, neither writes to it nor counts the
+	// first run's errors
+	opts.ParseErrorLog = ""
+	stats := testRun(t, opts)
+	after, _ := ioutil.ReadFile(ts.tmpdir + "/parse_errors.log")
+	if string(after) != string(contents) {
+		t.Error("expected lines to stop being written once the run's over")
+	}
+	testEquals(t, stats.parseErrors.Count(), int64(5))
+}
+
+func TestParseField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/parse.log"
+	logfh, _ := os.Create(logFileName)
+	defer logfh.Close()
+	fmt.Fprintf(logfh, `{"format":"json","message":"{\"inner\":\"value\",\"format\":\"nested\"}"}`)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.ParseFields = []string{"message:json"}
+	opts.DropFields = []string{"message"}
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.reqBody, `{"format":"nested","inner":"value"}`)
+}
+
+func TestSampleRate(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	rand.Seed(1)
+	sampleLogFile := ts.tmpdir + "/sample.log"
+	logfh, _ := os.Create(sampleLogFile)
+	defer logfh.Close()
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(logfh, `{"format":"json%d"}`+"\n", i)
+	}
+	opts.Reqs.LogFiles = []string{sampleLogFile}
+	testRun(t, opts)
+	// with no sampling, 1000 lines -> 1000 requests
+	testEquals(t, ts.rsp.reqCounter, 1000)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json999"}`)
+	testEquals(t, ts.rsp.reqSampleRate, uint(1))
+	opts.SampleRate = 20
+	ts.rsp.reset()
+	testRun(t, opts)
+	// setting a sample rate of 20 and a rand seed of 1, 49 requests.
+	testEquals(t, ts.rsp.reqCounter, 49)
+	testEquals(t, ts.rsp.reqBody, `{"format":"json996"}`)
+	testEquals(t, ts.rsp.reqSampleRate, uint(20))
+}
+
+func TestReadFromOffset(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	offsetLogFile := ts.tmpdir + "/offset.log"
+	offsetStateFile := ts.tmpdir + "/offset.leash.state"
+	logfh, _ := os.Create(offsetLogFile)
+	defer logfh.Close()
+	inode, _ := tail.INode(offsetLogFile)
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(logfh, `{"format":"json%d"}`+"\n", i)
+	}
+	opts.Reqs.LogFiles = []string{offsetLogFile}
+	opts.Tail.ReadFrom = "last"
+	osf, _ := os.Create(offsetStateFile)
+	defer osf.Close()
+	fmt.Fprintf(osf, `{"INode":%d,"Offset":38}`, inode)
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 8)
+}
+
+func TestTimeWindow(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/window.log"
+	fh, _ := os.Create(logFileName)
+	defer fh.Close()
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(fh, `{"time":"2016-08-01T00:0%d:00Z","n":%d}`+"\n", i, i)
+	}
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.JSON.TimeFieldName = "time"
+	opts.Tail.ReadFrom = "2016-08-01T00:03:00Z"
+	opts.Tail.StopAt = "2016-08-01T00:05:00Z"
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 3)
+	testEquals(t, ts.rsp.reqBody, `{"n":5}`)
+}
+
+func TestShutdown(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/shutdown.log"
+	contents := "{\"format\":\"json\"}\n{\"format\":\"json2\"}\n"
+	ioutil.WriteFile(logFileName, []byte(contents), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Tail.Stop = false
+	opts.Tail.StateDir = ts.tmpdir + "/state"
+	ctx, shutdown := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		if _, err := Run(ctx, opts); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	for i := 0; i < 100 && ts.rsp.count() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdown()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for honeytail to shut down")
+	}
+	testEquals(t, ts.rsp.reqCounter, 2)
+	// the position reached is saved on the way out, without waiting for the
+	// next periodic save
+	files, _ := ioutil.ReadDir(opts.Tail.StateDir)
+	if len(files) != 1 {
+		t.Fatalf("expected one state file, got %d", len(files))
+	}
+	var state tail.State
+	content, _ := ioutil.ReadFile(filepath.Join(opts.Tail.StateDir, files[0].Name()))
+	json.Unmarshal(content, &state)
+	testEquals(t, state.Offset, int64(len(contents)))
+}
+
+func TestDeadline(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/deadline.log"
+	contents := `{"time":"2016-08-01T00:00:00Z","n":1}` + "\n" +
+		`{"time":"2016-08-01T01:00:00Z","n":2}` + "\n" +
+		`{"time":"2016-08-01T02:00:00Z","n":3}` + "\n"
+	ioutil.WriteFile(logFileName, []byte(contents), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Tail.Stop = false
+	opts.Tail.StateDir = ts.tmpdir + "/state"
+	// replayed in real time the events would take two hours to send, but
+	// once the deadline passes what's been read is sent straight away
+	opts.ReplaySpeed = 1
+	opts.Deadline = 500 * time.Millisecond
+	start := time.Now()
+	if _, err := Run(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected --deadline to stop following the file, took %s", elapsed)
+	}
+	testEquals(t, ts.rsp.reqCounter, 3)
+	files, _ := ioutil.ReadDir(opts.Tail.StateDir)
+	if len(files) != 1 {
+		t.Fatalf("expected one state file, got %d", len(files))
+	}
+	var state tail.State
+	content, _ := ioutil.ReadFile(filepath.Join(opts.Tail.StateDir, files[0].Name()))
+	json.Unmarshal(content, &state)
+	testEquals(t, state.Offset, int64(len(contents)))
+
+	opts.Deadline = -time.Second
+	if _, err := Run(context.Background(), opts); err == nil {
+		t.Error("expected a negative --deadline to be rejected")
+	}
+}
+
+func TestFileOutput(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"time":"2016-08-01T00:00:00Z","format":"json"}`+"\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Output = []string{"file://" + ts.tmpdir + "/events.ndjson"}
+	testRun(t, opts)
+	// nothing goes to Honeycomb
+	testEquals(t, ts.rsp.reqCounter, 0)
+	content, _ := ioutil.ReadFile(ts.tmpdir + "/events.ndjson")
+	testEquals(t, string(content), `{"time":"2016-08-01T00:00:00Z","dataset":"`+opts.Reqs.Dataset+`","samplerate":1,"data":{"format":"json"}}`+"\n")
+}
+
+func TestBackfillWorkers(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	var lines bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&lines, `{"n":%d}`+"\n", i)
+	}
+	// a line that won't parse, as the last of a batch
+	lines.WriteString("not json\n")
+	ioutil.WriteFile(logFileName, lines.Bytes(), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Output = []string{"file://" + ts.tmpdir + "/events.ndjson"}
+	opts.BackfillWorkers = 4
+	if !parsesInParallel(opts) {
+		t.Fatal("expected the json parser to parse a backfill in parallel")
+	}
+	stats := testRun(t, opts)
+	testEquals(t, stats.parseErrors.Count(), int64(1))
+	content, _ := ioutil.ReadFile(ts.tmpdir + "/events.ndjson")
+	events := strings.Split(strings.TrimSpace(string(content)), "\n")
+	testEquals(t, len(events), 2000)
+	// the events come out in the order the lines were read
+	for i, line := range events {
+		var ev struct {
+			Data struct {
+				N int `json:"n"`
+			} `json:"data"`
+		}
+		json.Unmarshal([]byte(line), &ev)
+		if ev.Data.N != i {
+			t.Fatalf("expected event %d to be from line %d, got %d", i, i, ev.Data.N)
+		}
+	}
+}
+
+func TestDatasetField(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"service":"api"}
+{"service":"web"}
+{"other":"field"}
+`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Output = []string{"file://" + ts.tmpdir + "/events.ndjson"}
+	opts.DatasetField = "service"
+	// without routes, the value is the dataset
+	testRun(t, opts)
+	testEquals(t, outputDatasets(t, ts.tmpdir+"/events.ndjson"), []string{"api", "web", opts.Reqs.Dataset})
+
+	// with them, only values with a route are sent elsewhere
+	os.Remove(ts.tmpdir + "/events.ndjson")
+	opts.DatasetRoutes = []string{"api=api-prod"}
+	opts.DropFields = []string{"service"}
+	testRun(t, opts)
+	testEquals(t, outputDatasets(t, ts.tmpdir+"/events.ndjson"), []string{"api-prod", opts.Reqs.Dataset, opts.Reqs.Dataset})
+	// routing happens before the field is dropped
+	content, _ := ioutil.ReadFile(ts.tmpdir + "/events.ndjson")
+	if strings.Contains(string(content), `"service"`) {
+		t.Errorf("expected the service field to be dropped, got %s", content)
+	}
+}
+
+// outputDatasets returns the dataset of each event written to a file output
+func outputDatasets(t *testing.T, path string) []string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var datasets []string
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var record struct {
+			Dataset string
+		}
+		json.Unmarshal([]byte(line), &record)
+		datasets = append(datasets, record.Dataset)
+	}
+	return datasets
+}
+
+func TestPathTemplateVars(t *testing.T) {
+	pattern := regexp.MustCompile(`^/var/log/(?P<service>[^/]+)/(\w+)`)
+	vars := pathTemplateVars("/var/log/api/access.log", pattern)
+	testEquals(t, expandPathTemplate("{{dirname}}-{{basename}}", vars), "api-access")
+	testEquals(t, expandPathTemplate("{{ filename }}", vars), "access.log")
+	testEquals(t, expandPathTemplate("{{service}}/{{2}}", vars), "api/access")
+	// capture groups are empty if the pattern doesn't match
+	vars = pathTemplateVars("/tmp/other.log", pattern)
+	testEquals(t, expandPathTemplate("x{{service}}", vars), "x")
+
+	testEquals(t, checkPathTemplate("{{service}}", pattern), nil)
+	testEquals(t, checkPathTemplate("{{basename}}", nil), nil)
+	if err := checkPathTemplate("{{service}}", nil); err == nil {
+		t.Error("expected an error for a capture group with no --path_pattern")
+	}
+	if err := checkPathTemplate("{{3}}", pattern); err == nil {
+		t.Error("expected an error for a capture group the pattern doesn't have")
+	}
+}
+
+func TestPathTemplates(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	for _, service := range []string{"api", "web"} {
+		os.Mkdir(filepath.Join(ts.tmpdir, service), 0755)
+		ioutil.WriteFile(filepath.Join(ts.tmpdir, service, "app.log"), []byte(`{"a":1}`+"\n"), 0644)
+	}
+	opts.Reqs.LogFiles = []string{ts.tmpdir + "/*/app.log"}
+	opts.Output = []string{"file://" + ts.tmpdir + "/events.ndjson"}
+	opts.Reqs.Dataset = "{{dirname}}"
+	opts.AddFields = []string{"service={{dirname}}", "file={{basename}}", "static=yes"}
+	testRun(t, opts)
+	datasets := outputDatasets(t, ts.tmpdir+"/events.ndjson")
+	sort.Strings(datasets)
+	testEquals(t, datasets, []string{"api", "web"})
+	content, _ := ioutil.ReadFile(ts.tmpdir + "/events.ndjson")
+	for _, service := range []string{"api", "web"} {
+		fields := `"data":{"a":1,"file":"app","service":"` + service + `","static":"yes"}`
+		if !strings.Contains(string(content), fields) {
+			t.Errorf("expected an event with %s, got %s", fields, content)
+		}
+	}
+}
+
+func TestMultipleOutputs(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"time":"2016-08-01T00:00:00Z","format":"json"}`+"\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Output = []string{"honeycomb://other", "file://" + ts.tmpdir + "/events.ndjson"}
+	testRun(t, opts)
+	// the event goes both to Honeycomb, in the dataset given, and to the file
+	testEquals(t, ts.rsp.reqCounter, 1)
+	testEquals(t, ts.rsp.req.URL.Path, "/1/batch/other")
+	testEquals(t, ts.rsp.reqBody, `{"format":"json"}`)
+	content, _ := ioutil.ReadFile(ts.tmpdir + "/events.ndjson")
+	testEquals(t, string(content), `{"time":"2016-08-01T00:00:00Z","dataset":"`+opts.Reqs.Dataset+`","samplerate":1,"data":{"format":"json"}}`+"\n")
+}
+
+func TestDropWhenFull(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	var requests int
+	var lock sync.Mutex
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+	}))
+	defer slow.Close()
+	logFileName := ts.tmpdir + "/file.log"
+	var lines string
+	for i := 0; i < 20; i++ {
+		lines += `{"format":"json"}` + "\n"
+	}
+	ioutil.WriteFile(logFileName, []byte(lines), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.APIHost = slow.URL
+	opts.NumSenders = 1
+	opts.PendingWork = 1
+	opts.DropWhenFull = true
+	// dropped events aren't tried again, so this finishes without sending
+	// everything
+	testRun(t, opts)
+	if requests == 0 || requests >= 20 {
+		t.Errorf("expected some events to be dropped, got %d requests", requests)
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	var lock sync.Mutex
+	var received []string
+	acceptMsgpack := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Content-Encoding") == "zstd" {
+			decoder, _ := zstd.NewReader(nil)
+			body, _ = decoder.DecodeAll(body, nil)
+			decoder.Close()
+		}
+		contentType := r.Header.Get("Content-Type")
+		var batch []map[string]interface{}
+		if contentType == "application/msgpack" {
+			if !acceptMsgpack {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			if err := msgpack.Unmarshal(body, &batch); err != nil {
+				t.Error(err)
+			}
+		} else {
+			json.Unmarshal(body, &batch)
+		}
+		for _, ev := range batch {
+			data, _ := json.Marshal(ev["data"])
+			received = append(received, contentType+" "+string(data))
+		}
+		fmt.Fprintf(w, `[{"status":202}]`)
+	}))
+	defer server.Close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"format":"json","n":3,"f":1.5}`+"\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.APIHost = server.URL
+	opts.Msgpack = true
+	testRun(t, opts)
+	testEquals(t, received, []string{`application/msgpack {"f":1.5,"format":"json","n":3}`})
+
+	// an API that won't take msgpack gets JSON
+	received = nil
+	acceptMsgpack = false
+	testRun(t, opts)
+	testEquals(t, received, []string{`application/json {"f":1.5,"format":"json","n":3}`})
+}
+
+func TestPreflight(t *testing.T) {
+	var status int
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/1/auth" || r.Header.Get("X-Honeycomb-Team") != "abcabc123123" {
+			t.Errorf("unexpected request %s with key %q", r.URL.Path, r.Header.Get("X-Honeycomb-Team"))
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+	opts := defaultOptions
+	opts.APIHost = server.URL + "/"
+	logrus.SetOutput(ioutil.Discard)
+
+	status, body = 200, `{"api_key_access":{"events":true},"team":{"slug":"t"},"environment":{"slug":"e"}}`
+	testEquals(t, Preflight(opts), nil)
+	status, body = 401, `{"error":"unknown API key - check your credentials"}`
+	if err := Preflight(opts); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("expected the key to be rejected, got %v", err)
+	}
+	status, body = 200, `{"api_key_access":{"events":false},"team":{"slug":"t"}}`
+	if err := Preflight(opts); err == nil {
+		t.Error("expected an error for a key that can't send events")
+	}
+	// trouble with the API itself doesn't stop honeytail starting
+	status, body = 503, ""
+	testEquals(t, Preflight(opts), nil)
+	server.Close()
+	testEquals(t, Preflight(opts), nil)
+}
+
+func TestBackfillMarkers(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	var lock sync.Mutex
+	var markers []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/1/markers/") {
+			lock.Lock()
+			defer lock.Unlock()
+			body, _ := ioutil.ReadAll(r.Body)
+			markers = append(markers, r.URL.Path+" "+string(body))
+		}
+	}))
+	defer server.Close()
+	logFileName := ts.tmpdir + "/backfill.log"
+	ioutil.WriteFile(logFileName, []byte(`{"time":"2016-08-01T00:00:10Z","a":1}
+{"time":"2016-08-01T00:00:00Z","a":2}
+{"time":"2016-08-01T00:01:00Z","a":3}
+`), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.APIHost = server.URL
+	opts.BackfillMarkers = true
+	testRun(t, opts)
+	testEquals(t, markers, []string{
+		`/1/markers/pika {"message":"Backfill start: backfill.log","type":"backfill","start_time":1470009600}`,
+		`/1/markers/pika {"message":"Backfill end: backfill.log","type":"backfill","start_time":1470009660}`,
+	})
+}
+
+func TestTelemetry(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	var lock sync.Mutex
+	var events []map[string]interface{}
+	var writeKeys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/1/events/honeytail" {
+			lock.Lock()
+			defer lock.Unlock()
+			var data map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&data)
+			events = append(events, data)
+			writeKeys = append(writeKeys, r.Header.Get("X-Honeycomb-Team"))
+			return
+		}
+		ts.rsp.serveResponse(w, r)
+	}))
+	defer server.Close()
+	logFileName := ts.tmpdir + "/telemetry.log"
+	logfh, _ := os.Create(logFileName)
+	for i := 0; i < 9; i++ {
+		fmt.Fprintf(logfh, `{"line":%d}`+"\n", i)
+	}
+	fmt.Fprintln(logfh, "not json")
+	logfh.Close()
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.APIHost = server.URL
+	opts.TelemetryDataset = "honeytail"
+	opts.TelemetryInterval = time.Hour
+	testRun(t, opts)
+
+	// one last event is sent once everything's been sent
+	if len(events) != 1 {
+		t.Fatalf("expected 1 telemetry event, got %d", len(events))
+	}
+	ev := events[0]
+	testEquals(t, writeKeys[0], opts.Reqs.WriteKey)
+	testEquals(t, ev["lines"], float64(10))
+	testEquals(t, ev["parse_errors"], float64(1))
+	testEquals(t, ev["parse_error_rate"], 0.1)
+	testEquals(t, ev["events"], float64(9))
+	testEquals(t, ev["send_failures"], float64(0))
+	for _, field := range []string{"goroutines", "heap_alloc_bytes", "events_per_second"} {
+		if n, _ := ev[field].(float64); n <= 0 {
+			t.Errorf("expected some %s, got %v", field, ev[field])
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	var proxied []string
+	var lock sync.Mutex
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		proxied = append(proxied, r.URL.Host+" "+r.Header.Get("Proxy-Authorization"))
+	}))
+	defer proxy.Close()
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"format":"json"}`+"\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.APIHost = "http://api.example.invalid/"
+	opts.Proxy = strings.Replace(proxy.URL, "http://", "http://user:secret@", 1)
+	testRun(t, opts)
+	testEquals(t, proxied, []string{"api.example.invalid Basic dXNlcjpzZWNyZXQ="})
+}
+
+func TestTLSCA(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	server := httptest.NewTLSServer(http.HandlerFunc(ts.rsp.serveResponse))
+	defer server.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ioutil.WriteFile(ts.tmpdir+"/ca.pem", ca, 0644)
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte(`{"format":"json"}`+"\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.APIHost = server.URL
+	opts.TLSCA = ts.tmpdir + "/ca.pem"
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 1)
+}
+
+func TestRateLimiter(t *testing.T) {
+	var unlimited *rateLimiter
+	unlimited.wait(context.Background())
+
+	limiter := newRateLimiter(50)
+	start := time.Now()
+	// a second's worth goes straight through, then they're paced
+	for i := 0; i < 50; i++ {
+		limiter.wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected a burst to go straight through, took %s", elapsed)
+	}
+	for i := 0; i < 10; i++ {
+		limiter.wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("expected 10 more events to take 200ms, took %s", elapsed)
+	}
+}
+
+func TestReplayPacer(t *testing.T) {
+	var unpaced *replayPacer
+	unpaced.wait(context.Background(), event.Event{Timestamp: time.Now()})
+
+	pacer := newReplayPacer(10)
+	ts := time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC)
+	start := time.Now()
+	pacer.wait(context.Background(), event.Event{Timestamp: ts})
+	// earlier events and those without timestamps aren't held up
+	pacer.wait(context.Background(), event.Event{Timestamp: ts.Add(-time.Hour)})
+	pacer.wait(context.Background(), event.Event{})
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected no wait, took %s", elapsed)
+	}
+	// two seconds later, at 10x, is 200ms later
+	pacer.wait(context.Background(), event.Event{Timestamp: ts.Add(2 * time.Second)})
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to wait 200ms, took %s", elapsed)
+	}
+	// once shutting down, what's left goes straight away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	pacer.wait(ctx, event.Event{Timestamp: ts.Add(time.Hour)})
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected no wait once ctx is done, took %s", elapsed)
+	}
+}
+
+func TestMaxEventsPerSecond(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/file.log"
+	var lines string
+	for i := 0; i < 30; i++ {
+		lines += `{"format":"json"}` + "\n"
+	}
+	ioutil.WriteFile(logFileName, []byte(lines), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.MaxEventsPerSecond = 20
+	start := time.Now()
+	testRun(t, opts)
+	testEquals(t, ts.rsp.reqCounter, 30)
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Errorf("expected 30 events at 20 a second to take at least half a second, took %s", elapsed)
+	}
+}
+
+func TestEventBuffer(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	for _, tc := range []struct {
+		policy   string
+		buffered uint64
+		expected []float64
+		dropped  int64
+	}{
+		// the parser's left waiting with the third event, after the
+		// one held
+		{whenFullBlock, 3, []float64{0, 1, 2, 3}, 0},
+		{whenFullDropOldest, 2, []float64{3, 4}, 3},
+		{whenFullSpill, 5, []float64{0, 1, 2, 3, 4}, 0},
+	} {
+		stats := &runStats{}
+		buffer, err := newEventBuffer(PipelineOptions{EventBuffer: 2, WhenFull: tc.policy, SpillDir: tmpdir}, stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := make(chan event.Event)
+		out := buffer.pass(in)
+		sending := make(chan struct{})
+		go func() {
+			defer close(sending)
+			for i := 0; i < len(tc.expected)+int(tc.dropped); i++ {
+				in <- event.Event{Data: map[string]interface{}{"i": float64(i)}}
+			}
+		}()
+		if tc.policy != whenFullBlock {
+			<-sending
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if held := buffer.buffered(); held != tc.buffered {
+			t.Errorf("%s: expected %d events buffered, got %d", tc.policy, tc.buffered, held)
+		}
+		var got []float64
+		for len(got) < len(tc.expected) {
+			got = append(got, (<-out).Data["i"].(float64))
+		}
+		<-sending
+		close(in)
+		if _, ok := <-out; ok {
+			t.Errorf("%s: expected nothing more once in was closed", tc.policy)
+		}
+		testEquals(t, got, tc.expected, tc.policy)
+		testEquals(t, stats.bufferDropped, tc.dropped, tc.policy)
+	}
+	if spilled, _ := ioutil.ReadDir(tmpdir); len(spilled) != 0 {
+		t.Errorf("expected the spill file to be removed, found %d files", len(spilled))
+	}
+}
+
+// boilerplate to spin up a httptest server, create tmpdir, etc.
+// to create an environment in which to run these tests
+type testSetup struct {
+	server *httptest.Server
+	rsp    *responder
+	tmpdir string
+}
+
+func (t *testSetup) start(tst *testing.T, opts *Config) {
+	logrus.SetOutput(ioutil.Discard)
+	t.rsp = &responder{}
+	t.server = httptest.NewServer(http.HandlerFunc(t.rsp.serveResponse))
+	tmpdir, err := ioutil.TempDir(os.TempDir(), "test")
+	if err != nil {
+		tst.Fatal(err)
+	}
+	t.tmpdir = tmpdir
+	opts.APIHost = t.server.URL
+	t.rsp.responseCode = 200
+}
+func (t *testSetup) close() {
+	t.server.Close()
+	os.RemoveAll(t.tmpdir)
+}
+
+type responder struct {
+	req           *http.Request // the most recent request answered by the server
+	reqBody       string        // the body sent along with the request, or the data of the last event in a batch
+	reqSampleRate uint          // the sample rate of the last event in a batch
+	reqTime       string        // the time of the last event in a batch
+	reqCounter    int           // the number of requests, or events in batches, answered since last reset
+	responseCode  int           // the http status code with which to respond
+	responseBody  string        // the body to send as the response
+	lock          sync.Mutex
+}
+
+// batchEvent is an event in a batch libhoney sends
+type batchEvent struct {
+	Data       json.RawMessage `json:"data"`
+	SampleRate uint            `json:"samplerate"`
+	Time       string          `json:"time"`
+}
+
+func (r *responder) serveResponse(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.req = req
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if !strings.HasPrefix(req.URL.Path, "/1/batch/") {
+		r.reqCounter += 1
+		r.reqBody = string(body)
+		w.WriteHeader(r.responseCode)
+		fmt.Fprintf(w, r.responseBody)
+		return
+	}
+	if req.Header.Get("Content-Encoding") == "zstd" {
+		decoder, _ := zstd.NewReader(nil)
+		body, _ = decoder.DecodeAll(body, nil)
+		decoder.Close()
+	}
+	var batch []batchEvent
+	json.Unmarshal(body, &batch)
+	for _, ev := range batch {
+		r.reqCounter += 1
+		r.reqBody = string(ev.Data)
+		r.reqSampleRate = ev.SampleRate
+		if r.reqSampleRate == 0 {
+			r.reqSampleRate = 1
+		}
+		r.reqTime = ev.Time
+	}
+	if r.responseCode != http.StatusOK {
+		// libhoney gives every event in the batch the status
+		w.WriteHeader(r.responseCode)
+		fmt.Fprintf(w, r.responseBody)
+		return
+	}
+	statuses := make([]map[string]int, len(batch))
+	for i := range statuses {
+		statuses[i] = map[string]int{"status": http.StatusAccepted}
+	}
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// count returns reqCounter, for reading while requests may still be coming in
+func (r *responder) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reqCounter
+}
+func (r *responder) reset() {
+	r.reqCounter = 0
+	r.responseCode = 200
+}
+
+// testRun runs honeytail with opts, failing the test if it can't start
+func testRun(t testing.TB, opts Config) *runStats {
+	stats, err := run(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+// helper function
+func testEquals(t testing.TB, actual, expected interface{}, msg ...string) {
+	if !reflect.DeepEqual(actual, expected) {
+		message := strings.Join(msg, ", ")
+		_, file, line, _ := runtime.Caller(1)
+
+		t.Errorf(
+			"%s:%d: %s -- actual(%T): %v, expected(%T): %v",
+			filepath.Base(file),
+			line,
+			message,
+			testDeref(actual),
+			testDeref(actual),
+			testDeref(expected),
+			testDeref(expected),
+		)
+	}
+}
+func testDeref(v interface{}) interface{} {
+	switch t := v.(type) {
+	case *string:
+		return fmt.Sprintf("*(%v)", *t)
+	case *int64:
+		return fmt.Sprintf("*(%v)", *t)
+	case *float64:
+		return fmt.Sprintf("*(%v)", *t)
+	case *bool:
+		return fmt.Sprintf("*(%v)", *t)
+	default:
+		return v
+	}
+}
+
+func TestOverloadSampler(t *testing.T) {
+	o := newOverloadSampler(Config{OverloadMaxSampleRate: 20, OverloadLag: time.Minute}, nil, &runStats{})
+	for _, tc := range []struct {
+		lagBytes   int64
+		lagSeconds float64
+		full       float64
+		factor     uint32
+	}{
+		// behind, but not by more than --overload_lag
+		{1000, 30, 0, 1},
+		// behind and falling further behind
+		{2000, 90, 0, 2},
+		{3000, 120, 0, 4},
+		// still behind, but no further
+		{3000, 120, 0, 4},
+		// the buffer filling up
+		{2000, 100, 0.95, 8},
+		{1000, 80, 0.95, 16},
+		// not past the ceiling
+		{1000, 80, 1, 20},
+		// caught up
+		{100, 10, 0, 10},
+		{100, 10, 0.6, 10},
+		{100, 10, 0, 5},
+	} {
+		o.check(tc.lagBytes, tc.lagSeconds, tc.full)
+		testEquals(t, o.factor, tc.factor)
+	}
+
+	// rates are raised up to the ceiling, and not at all past it
+	o.factor = 8
+	for _, tc := range []struct {
+		rate     uint
+		expected uint
+	}{
+		{1, 8},
+		{2, 16},
+		{3, 18},
+		{15, 15},
+		{50, 50},
+	} {
+		kept := 0
+		for i := 0; i < 1000; i++ {
+			rate, keep := o.sample(tc.rate)
+			testEquals(t, rate, tc.expected)
+			if keep {
+				kept++
+			}
+		}
+		if expected := 1000 * tc.rate / tc.expected; kept < int(expected)/2 || kept > int(expected)*2 {
+			t.Errorf("rate %d: expected about %d of 1000 kept, got %d", tc.rate, expected, kept)
+		}
+	}
+	var off *overloadSampler
+	rate, keep := off.sample(5)
+	testEquals(t, rate, uint(5))
+	testEquals(t, keep, true)
+}
+
+func TestMemoryGuard(t *testing.T) {
+	var used uint64
+	m := newMemoryGuard(100)
+	m.usage = func() uint64 { return used << 20 }
+	lines := make(chan string, 1)
+	held := m.holdBack(lines)
+	passed := func() bool {
+		select {
+		case <-held:
+			return true
+		case <-time.After(2 * memoryCheckInterval):
+			return false
+		}
+	}
+
+	used = 50
+	m.check()
+	lines <- "line"
+	testEquals(t, passed(), true, "50MB")
+	// held back past 90%, until it's down to 80%
+	used = 91
+	m.check()
+	lines <- "line"
+	testEquals(t, passed(), false, "91MB")
+	used = 85
+	m.check()
+	testEquals(t, passed(), false, "85MB")
+	used = 79
+	m.check()
+	testEquals(t, passed(), true, "79MB")
+	close(lines)
+	if _, ok := <-held; ok {
+		t.Error("expected nothing more once lines was closed")
+	}
+
+	var off *memoryGuard
+	testEquals(t, off.over(), false)
+	if off.holdBack(lines) != lines {
+		t.Error("expected lines to be passed on as they are without --max_memory_mb")
+	}
+}
+
+func TestRunResult(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/backfill.log"
+	logfh, _ := os.Create(logFileName)
+	for i := 0; i < 9; i++ {
+		fmt.Fprintf(logfh, `{"line":%d}`+"\n", i)
+	}
+	fmt.Fprintln(logfh, "not json")
+	logfh.Close()
+	opts.Reqs.LogFiles = []string{logFileName}
+
+	// 1 line in 10 failing to parse is more than 5% of them
+	opts.FailOnErrorRate = "5%"
+	result, err := Run(context.Background(), opts)
+	testEquals(t, result, Result{Lines: 10, Bytes: 108, ParseErrors: 1, Events: 9})
+	testEquals(t, err, ErrParseErrors)
+	opts.FailOnErrorRate = "10%"
+	_, err = Run(context.Background(), opts)
+	testEquals(t, err, nil)
+	// without --fail_on_error_rate, parse errors don't matter
+	opts.FailOnErrorRate = ""
+	_, err = Run(context.Background(), opts)
+	testEquals(t, err, nil)
+
+	// events Honeycomb rejects won't be sent
+	ts.rsp.responseCode = http.StatusBadRequest
+	result, err = Run(context.Background(), opts)
+	testEquals(t, result.SendFailures, int64(9))
+	testEquals(t, err, ErrSendFailures)
+
+	// nor is anything run with flags that don't make sense
+	opts.Reqs.ParserName = ""
+	if _, err := Run(context.Background(), opts); err == nil {
+		t.Error("expected an error running without a parser")
+	}
+
+	for _, spec := range []string{"5%", "0.5", "100%"} {
+		if _, err := parseErrorRate(spec); err != nil {
+			t.Errorf("expected %q to be a valid --fail_on_error_rate, got %s", spec, err)
+		}
+	}
+	for _, spec := range []string{"five", "-1%", "101%"} {
+		if _, err := parseErrorRate(spec); err == nil {
+			t.Errorf("expected %q not to be a valid --fail_on_error_rate", spec)
+		}
+	}
+}
+
+func TestInputFailsToStart(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/follow.log"
+	ioutil.WriteFile(logFileName, []byte(`{"format":"json"}`+"\n"), 0644)
+	following := opts
+	following.Reqs.LogFiles = []string{logFileName}
+	following.Tail.Stop = false
+	following.Tail.StateDir = ts.tmpdir + "/state"
+	failing := following
+	failing.Pipeline = PipelineOptions{EventBuffer: 1, WhenFull: whenFullSpill, SpillDir: ts.tmpdir + "/missing"}
+	opts.Inputs = []Config{following, failing}
+	done := make(chan error)
+	go func() {
+		_, err := Run(context.Background(), opts)
+		done <- err
+	}()
+	// the input that can't start stops the one following its file
+	select {
+	case err := <-done:
+		if err == nil || !strings.HasPrefix(err.Error(), "input 2: couldn't set up --pipeline.event_buffer") {
+			t.Errorf("expected input 2 not to start, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the other input to stop")
+	}
+}
+
+func TestLaterInputFailsToStart(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	opts.ListenHTTP = addr
+	opts.HTTP.Path = "/"
+	// the log group is missing, so this fails once the HTTP receiver is
+	// already listening
+	opts.Reqs.LogFiles = []string{"cloudwatch://"}
+	_, err = Run(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "must name a log group") {
+		t.Errorf("expected the cloudwatch input not to start, got %v", err)
+	}
+	// the receiver stopped listening before Run returned
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("expected the HTTP receiver to have stopped, got %s", err)
+	}
+	listener.Close()
+}
+
+func TestTransformFailsToStart(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	logFileName := ts.tmpdir + "/script.log"
+	ioutil.WriteFile(logFileName, []byte(`{"format":"json"}`+"\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.RenameFields = []string{"format=kind"}
+	opts.Script = ts.tmpdir + "/missing.lua"
+	// the script can't be loaded, so Run returns before reading anything
+	// rather than exiting
+	_, err := Run(context.Background(), opts)
+	if err == nil || !strings.HasPrefix(err.Error(), "unable to load provided --script") {
+		t.Errorf("expected the missing --script to stop Run, got %v", err)
+	}
+	testEquals(t, ts.rsp.reqCounter, 0)
+
+	opts.Script = ""
+	opts.Reqs.ParserName = "missing"
+	_, err = Run(context.Background(), opts)
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected the missing parser to stop Run, got %v", err)
+	}
+}
+
+// testPluginParser makes an event with a field from each line, named by its
+// --plugin_option field
+type testPluginParser struct {
+	field string
+}
+
+func (p *testPluginParser) Init(options interface{}) error {
+	p.field = options.(map[string]string)["field"]
+	return nil
+}
+
+func (p *testPluginParser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	for line := range lines {
+		send <- event.Event{Timestamp: time.Now(), Data: map[string]interface{}{p.field: line}}
+	}
+}
+
+func (p *testPluginParser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:    "Any line, as a field.",
+		Examples:   []string{"anything"},
+		Timestamps: []string{"now"},
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	opts := defaultOptions
+	ts := &testSetup{}
+	ts.start(t, &opts)
+	defer ts.close()
+	var sent []event.Event
+	err := Register(Plugin{
+		ABI:     PluginABI,
+		Name:    "test",
+		Parsers: map[string]func() parsers.Parser{"testlines": func() parsers.Parser { return &testPluginParser{} }},
+		Outputs: map[string]func(url, dataset string) (output.Output, error){
+			"testout": func(url, dataset string) (output.Output, error) {
+				return &testPluginOutput{sent: &sent, results: make(chan output.Result, 10)}, nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logFileName := ts.tmpdir + "/file.log"
+	ioutil.WriteFile(logFileName, []byte("one\ntwo\n"), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Reqs.ParserName = "testlines"
+	opts.PluginOptions = []string{"field=line"}
+	opts.Output = []string{"testout://somewhere"}
+	testRun(t, opts)
+	testEquals(t, len(sent), 2)
+	testEquals(t, sent[1].Data, map[string]interface{}{"line": "two"})
+
+	for _, tc := range []struct {
+		plugin Plugin
+		err    string
+	}{
+		{Plugin{ABI: PluginABI + 1, Name: "new", Parsers: map[string]func() parsers.Parser{"new": nil}}, "built for plugin ABI 2"},
+		{Plugin{ABI: PluginABI, Name: "empty"}, "has no parsers or outputs"},
+		{Plugin{ABI: PluginABI, Name: "clash", Parsers: map[string]func() parsers.Parser{"nginx": func() parsers.Parser { return nil }}}, "nginx parser has the name of one"},
+		{Plugin{ABI: PluginABI, Name: "clash", Parsers: map[string]func() parsers.Parser{"testlines": func() parsers.Parser { return nil }}}, "testlines parser has the name of one"},
+		{Plugin{ABI: PluginABI, Name: "clash", Outputs: map[string]func(url, dataset string) (output.Output, error){"kafka": func(url, dataset string) (output.Output, error) { return nil, nil }}}, "kafka:// output has the scheme of one"},
+	} {
+		if err := Register(tc.plugin); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected registering the %s plugin to fail with %q, got %v", tc.plugin.Name, tc.err, err)
+		}
+	}
+	if err := LoadPlugin(logFileName); err == nil {
+		t.Error("expected an error loading a plugin that isn't one")
+	}
+}
+
+// testPluginOutput keeps the events it's given
+type testPluginOutput struct {
+	sent    *[]event.Event
+	results chan output.Result
+}
+
+func (o *testPluginOutput) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	*o.sent = append(*o.sent, ev)
+	o.results <- output.Result{Metadata: metadata}
+	return nil
+}
+
+func (o *testPluginOutput) Results() chan output.Result {
+	return o.results
+}
+
+func (o *testPluginOutput) Close() {
+	close(o.results)
+}
+
+func TestDescribeParser(t *testing.T) {
+	var defaults Config
+	if _, err := flag.NewParser(&defaults, flag.None).ParseArgs(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range Parsers {
+		description, err := DescribeParser(name)
+		if err != nil {
+			t.Errorf("expected the %s parser to describe itself, got %s", name, err)
+			continue
+		}
+		if description.Summary == "" || len(description.Timestamps) == 0 {
+			t.Errorf("expected a summary and timestamps for the %s parser", name)
+		}
+
+		// the examples are lines the parser reads, where it can be set up
+		// without more options
+		options := defaults
+		options.Reqs.ParserName = name
+		parser, opts := getParserAndOptions(options)
+		if len(description.Examples) == 0 || parser.Init(opts) != nil {
+			continue
+		}
+		if events := parsePreviewLines(parser, description.Examples); len(events) == 0 {
+			t.Errorf("expected the %s parser to read its examples", name)
+		}
+	}
+	if _, err := DescribeParser("nope"); err == nil {
+		t.Error("expected an error describing a parser that doesn't exist")
+	}
+}
@@ -0,0 +1,166 @@
+package leash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/libhoney-go"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/output"
+)
+
+// backfillRanges are the spans of time covered by the events read in a
+// backfill, by the dataset they went to, for --backfill_markers. Events that
+// weren't routed anywhere in particular are under "".
+type backfillRanges struct {
+	lock   sync.Mutex
+	ranges map[string]*timeRange
+	// files are the paths of the files read
+	files []string
+}
+
+type timeRange struct {
+	start, end time.Time
+}
+
+func newBackfillRanges() *backfillRanges {
+	return &backfillRanges{ranges: make(map[string]*timeRange)}
+}
+
+// addFile records that path is being read
+func (b *backfillRanges) addFile(path string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.files = append(b.files, path)
+}
+
+// watch passes on the events from toBeSent, noting the time each covers
+func (b *backfillRanges) watch(toBeSent chan event.Event) chan event.Event {
+	watched := make(chan event.Event)
+	go func() {
+		defer close(watched)
+		for ev := range toBeSent {
+			if !ev.Timestamp.IsZero() {
+				b.lock.Lock()
+				r, ok := b.ranges[ev.Dataset]
+				if !ok {
+					r = &timeRange{start: ev.Timestamp, end: ev.Timestamp}
+					b.ranges[ev.Dataset] = r
+				}
+				if ev.Timestamp.Before(r.start) {
+					r.start = ev.Timestamp
+				}
+				if ev.Timestamp.After(r.end) {
+					r.end = ev.Timestamp
+				}
+				b.lock.Unlock()
+			}
+			watched <- ev
+		}
+	}()
+	return watched
+}
+
+// marker is a Honeycomb marker, as sent to the markers API
+type marker struct {
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	StartTime int64  `json:"start_time"`
+}
+
+// createMarkers creates markers in Honeycomb at the start and end of the
+// time each dataset's backfilled events cover, labelled with the files read.
+// Markers that can't be created are only logged; the events are already in.
+func (b *backfillRanges) createMarkers(options Config) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.ranges) == 0 {
+		return
+	}
+	transport, err := newTransport(options)
+	if err != nil {
+		logrus.WithField("err", err).Warn("Couldn't create backfill markers")
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	if transport != nil {
+		client.Transport = transport
+	}
+	names := make([]string, len(b.files))
+	for i, path := range b.files {
+		names[i] = filepath.Base(path)
+	}
+	sort.Strings(names)
+	files := strings.Join(names, ", ")
+	for dataset, r := range b.ranges {
+		datasets := []string{dataset}
+		if dataset == "" {
+			datasets = honeycombDatasets(options)
+		}
+		for _, dataset := range datasets {
+			for _, m := range []marker{
+				{Message: "Backfill start: " + files, Type: "backfill", StartTime: r.start.Unix()},
+				{Message: "Backfill end: " + files, Type: "backfill", StartTime: r.end.Unix()},
+			} {
+				if err := createMarker(client, options, dataset, m); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"dataset": dataset,
+						"err":     err,
+					}).Warn("Couldn't create a backfill marker")
+				}
+			}
+		}
+	}
+}
+
+// honeycombDatasets returns the datasets events go to in Honeycomb when they
+// haven't been routed anywhere else
+func honeycombDatasets(options Config) []string {
+	if len(options.Output) == 0 {
+		return []string{options.Reqs.Dataset}
+	}
+	var datasets []string
+	for _, url := range options.Output {
+		if output.IsHoneycombURL(url) {
+			datasets = append(datasets, output.HoneycombDataset(url, options.Reqs.Dataset))
+		}
+	}
+	return datasets
+}
+
+// createMarker creates m in dataset with the markers API
+func createMarker(client *http.Client, options Config, dataset string, m marker) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/1/markers/%s", strings.TrimSuffix(options.APIHost, "/"), dataset)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Honeycomb-Team", options.Reqs.WriteKey)
+	req.Header.Set("User-Agent", libhoney.UserAgentAddition)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%d %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package leash
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// memoryCheckInterval is how often memory use is checked against
+// --max_memory_mb
+const memoryCheckInterval = 250 * time.Millisecond
+
+// memoryGuard watches honeytail's memory use, holding back reading, or
+// spilling events to disk with --pipeline.when_full spill, while it's over
+// 90% of --max_memory_mb, until it's back under 80%. A nil memoryGuard never
+// holds anything back.
+type memoryGuard struct {
+	limit uint64
+	// usage returns how much memory honeytail has from the OS
+	usage func() uint64
+	// overLimit is 1 while memory use is over the limit, changed atomically
+	overLimit int32
+}
+
+// newMemoryGuard returns a memoryGuard for maxMB, or nil if it's 0
+func newMemoryGuard(maxMB uint) *memoryGuard {
+	if maxMB == 0 {
+		return nil
+	}
+	return &memoryGuard{limit: uint64(maxMB) << 20, usage: memoryUsage}
+}
+
+// memoryUsage returns how much memory the Go runtime has from the OS, less
+// what it's given back, as the memory limit counts it
+func memoryUsage() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.Sys - stats.HeapReleased
+}
+
+// watch checks memory use every memoryCheckInterval, until the returned func
+// is called
+func (m *memoryGuard) watch() func() {
+	if m == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(memoryCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.check()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// check notes whether memory use is over the limit
+func (m *memoryGuard) check() {
+	used := m.usage()
+	switch {
+	case !m.over() && used > m.limit/10*9:
+		atomic.StoreInt32(&m.overLimit, 1)
+		logrus.WithFields(logrus.Fields{
+			"memory_mb":     used >> 20,
+			"max_memory_mb": m.limit >> 20,
+		}).Warn("Memory use is near --max_memory_mb; holding back reading until it's down")
+	case m.over() && used < m.limit/10*8:
+		atomic.StoreInt32(&m.overLimit, 0)
+		logrus.WithFields(logrus.Fields{
+			"memory_mb":     used >> 20,
+			"max_memory_mb": m.limit >> 20,
+		}).Info("Memory use is down again; carrying on reading")
+	}
+}
+
+// over reports whether memory use is over the limit
+func (m *memoryGuard) over() bool {
+	return m != nil && atomic.LoadInt32(&m.overLimit) == 1
+}
+
+// holdBack passes on lines, waiting before taking each while memory use is
+// over the limit, so reading slows down rather than running out of memory
+func (m *memoryGuard) holdBack(lines chan string) chan string {
+	if m == nil {
+		return lines
+	}
+	held := make(chan string)
+	go func() {
+		defer close(held)
+		for line := range lines {
+			for m.over() {
+				time.Sleep(memoryCheckInterval)
+			}
+			held <- line
+		}
+	}()
+	return held
+}
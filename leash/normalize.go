@@ -0,0 +1,92 @@
+package leash
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// unitNormalizer adds a field of milliseconds or bytes for a field holding a
+// duration or size with units, as given by a --normalize_field
+type unitNormalizer struct {
+	field string
+	// kind is duration or size
+	kind string
+	// bareScale is what a number without a unit is multiplied by to get
+	// milliseconds or bytes
+	bareScale float64
+}
+
+// newUnitNormalizer makes a unitNormalizer for a field:kind or
+// field:kind:unit spec, where unit is what numbers without one are in,
+// eg request_time:duration:s. They're otherwise taken to be milliseconds
+// or bytes.
+func newUnitNormalizer(spec string) (*unitNormalizer, error) {
+	splitSpec := strings.SplitN(spec, ":", 3)
+	if len(splitSpec) < 2 || splitSpec[0] == "" {
+		return nil, fmt.Errorf("%q isn't a field:kind or field:kind:unit spec", spec)
+	}
+	n := &unitNormalizer{field: splitSpec[0], kind: splitSpec[1], bareScale: 1}
+	var unit string
+	if len(splitSpec) == 3 {
+		unit = splitSpec[2]
+	}
+	switch n.kind {
+	case "duration":
+		if unit != "" {
+			ms, ok := parseDurationMS("1" + unit)
+			if !ok {
+				return nil, fmt.Errorf("%q isn't a unit of time, eg s or ms", unit)
+			}
+			n.bareScale = ms
+		}
+	case "size":
+		if unit != "" {
+			bytes, ok := parseSize("1" + unit)
+			if !ok {
+				return nil, fmt.Errorf("%q isn't a unit of size, eg k or MiB", unit)
+			}
+			n.bareScale = bytes
+		}
+	default:
+		return nil, fmt.Errorf("%q isn't duration or size", n.kind)
+	}
+	return n, nil
+}
+
+// target is the name of the field added, the field with _ms or _bytes on the
+// end
+func (n *unitNormalizer) target() string {
+	if n.kind == "duration" {
+		return n.field + "_ms"
+	}
+	return n.field + "_bytes"
+}
+
+// normalize returns val in milliseconds or bytes
+func (n *unitNormalizer) normalize(val interface{}) (float64, error) {
+	switch v := val.(type) {
+	case float64:
+		return v * n.bareScale, nil
+	case int:
+		return float64(v) * n.bareScale, nil
+	case int64:
+		return float64(v) * n.bareScale, nil
+	case string:
+		s := strings.TrimSpace(v)
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f * n.bareScale, nil
+		}
+		if n.kind == "duration" {
+			if ms, ok := parseDurationMS(s); ok {
+				return ms, nil
+			}
+			return 0, fmt.Errorf("%q isn't a duration, eg 12ms or 1.2s", v)
+		}
+		if bytes, ok := parseSize(s); ok {
+			return bytes, nil
+		}
+		return 0, fmt.Errorf("%q isn't a size, eg 4k or 3MB", v)
+	}
+	return 0, fmt.Errorf("can't make a %s of %v", n.kind, val)
+}
@@ -0,0 +1,124 @@
+package leash
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/statsd"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+// overloadCheckInterval is how often whether honeytail's keeping up is
+// checked, with --overload_max_samplerate
+const overloadCheckInterval = 5 * time.Second
+
+// overloadSampler samples events more heavily while honeytail can't keep up,
+// as --overload_max_samplerate says: while the files are further behind than
+// --overload_lag and falling further behind, or the --pipeline.event_buffer
+// is nearly full, it doubles what sample rates are multiplied by each check,
+// up to the ceiling, and halves it again once it's caught up. A nil
+// overloadSampler leaves rates as they are.
+type overloadSampler struct {
+	ceiling uint
+	lag     float64
+	buffer  *eventBuffer
+	metrics *statsd.Client
+	// factor is what rates are multiplied by now, changed atomically
+	factor uint32
+	// lastLagBytes is how far behind the files were at the last check
+	lastLagBytes int64
+}
+
+// newOverloadSampler returns an overloadSampler watching buffer, reporting
+// the factor to stats' metrics, or nil if there's no --overload_max_samplerate
+func newOverloadSampler(options Config, buffer *eventBuffer, stats *runStats) *overloadSampler {
+	if options.OverloadMaxSampleRate <= 1 {
+		return nil
+	}
+	return &overloadSampler{
+		ceiling: options.OverloadMaxSampleRate,
+		lag:     options.OverloadLag.Seconds(),
+		buffer:  buffer,
+		metrics: stats.metrics,
+		factor:  1,
+	}
+}
+
+// watch checks whether honeytail's keeping up every overloadCheckInterval,
+// until the returned func is called
+func (o *overloadSampler) watch() func() {
+	if o == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(overloadCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				lagBytes, lagSeconds := maxLag(tail.Positions())
+				o.check(lagBytes, lagSeconds, o.buffer.fullness())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// check raises or lowers the factor given how far behind the files are, and
+// how full the event buffer is, from 0 to 1
+func (o *overloadSampler) check(lagBytes int64, lagSeconds float64, full float64) {
+	factor := atomic.LoadUint32(&o.factor)
+	behind := lagSeconds > o.lag && lagBytes > o.lastLagBytes
+	o.lastLagBytes = lagBytes
+	next := factor
+	switch {
+	case behind || full >= 0.9:
+		next = factor * 2
+		if next > uint32(o.ceiling) {
+			next = uint32(o.ceiling)
+		}
+	case lagSeconds <= o.lag && full < 0.5 && factor > 1:
+		next = factor / 2
+	}
+	o.metrics.Gauge("overload.samplerate_factor", float64(next))
+	if next == factor {
+		return
+	}
+	atomic.StoreUint32(&o.factor, next)
+	fields := logrus.Fields{
+		"factor":       next,
+		"lag_bytes":    lagBytes,
+		"lag_seconds":  lagSeconds,
+		"buffer_usage": full,
+	}
+	if next > factor {
+		logrus.WithFields(fields).Warn("Falling behind; raising sample rates to catch up")
+	} else {
+		logrus.WithFields(fields).Info("Catching up; lowering sample rates again")
+	}
+}
+
+// sample returns the rate an event the sampler kept at rate is sent at now,
+// and whether it's still kept. Rates are raised by the factor, but not past
+// the ceiling, and not at all if they're already at or above it.
+func (o *overloadSampler) sample(rate uint) (uint, bool) {
+	if o == nil || rate == 0 {
+		return rate, true
+	}
+	factor := uint(atomic.LoadUint32(&o.factor))
+	if factor <= 1 || rate >= o.ceiling {
+		return rate, true
+	}
+	if rate*factor > o.ceiling {
+		factor = o.ceiling / rate
+	}
+	if factor <= 1 {
+		return rate, true
+	}
+	return rate * factor, rand.Intn(int(factor)) == 0
+}
@@ -0,0 +1,99 @@
+package leash
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// parseErrorLog is the --parse_error_log, where lines that fail to parse are
+// written as they were read, along with why they didn't parse, so there's
+// more to go on than a count of them. Past --parse_error_log_rate lines a
+// second, lines are only counted, and how many were left out is written once
+// the second's up, with the next line, or on Close.
+type parseErrorLog struct {
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+	rate uint
+
+	// second is the second being counted, in which written lines have
+	// been written and skipped left out
+	second  time.Time
+	written uint
+	skipped int
+}
+
+// parseError is a line in the --parse_error_log
+type parseError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+	Line  string    `json:"line,omitempty"`
+	// Skipped is how many lines were left out in the second before, if
+	// that's what this is about
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// newParseErrorLog opens path to add lines that fail to parse to, at no more
+// than rate a second, or any number if rate is 0, or returns nil if there's
+// no path
+func newParseErrorLog(path string, rate uint) (*parseErrorLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open --parse_error_log: %s", err)
+	}
+	return &parseErrorLog{file: file, enc: json.NewEncoder(file), rate: rate}, nil
+}
+
+// write writes line, which didn't parse because of err, unless rate lines
+// have already been written this second
+func (l *parseErrorLog) write(line string, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if second := now.Truncate(time.Second); !second.Equal(l.second) {
+		l.writeSkipped(now)
+		l.second = second
+		l.written = 0
+	}
+	if l.rate > 0 && l.written >= l.rate {
+		l.skipped++
+		return
+	}
+	l.written++
+	reason := "unknown"
+	if err != nil {
+		reason = err.Error()
+	}
+	l.enc.Encode(parseError{Time: now, Error: reason, Line: line})
+}
+
+// writeSkipped notes how many lines were left out, if any were.
+// NOT thread safe.
+func (l *parseErrorLog) writeSkipped(now time.Time) {
+	if l.skipped == 0 {
+		return
+	}
+	l.enc.Encode(parseError{
+		Time:    now,
+		Error:   fmt.Sprintf("%d more lines failed to parse, past --parse_error_log_rate", l.skipped),
+		Skipped: l.skipped,
+	})
+	l.skipped = 0
+}
+
+// Close notes any lines left out, and closes the file
+func (l *parseErrorLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.writeSkipped(time.Now())
+	return l.file.Close()
+}
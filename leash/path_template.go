@@ -0,0 +1,88 @@
+package leash
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// reTemplateVar matches a {{name}} in a --dataset or --add_field that's
+// filled in from the path of the file each event came from
+var reTemplateVar = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+
+// pathVars are the names that can be used in a path template without a
+// --path_pattern
+var pathVars = []string{"path", "dirname", "basename", "filename"}
+
+// isPathTemplate returns true if s has anything to fill in from a path
+func isPathTemplate(s string) bool {
+	return reTemplateVar.MatchString(s)
+}
+
+// checkPathTemplate returns an error if tmpl uses a name that isn't one of
+// pathVars or a capture group in pattern, which may be nil
+func checkPathTemplate(tmpl string, pattern *regexp.Regexp) error {
+	known := make(map[string]bool)
+	for _, name := range pathVars {
+		known[name] = true
+	}
+	if pattern != nil {
+		for i, name := range pattern.SubexpNames() {
+			known[strconv.Itoa(i)] = i > 0
+			if name != "" {
+				known[name] = true
+			}
+		}
+	}
+	for _, match := range reTemplateVar.FindAllStringSubmatch(tmpl, -1) {
+		if !known[match[1]] {
+			return fmt.Errorf("%q uses {{%s}}, which isn't one of %s or a capture group in --path_pattern",
+				tmpl, match[1], strings.Join(pathVars, ", "))
+		}
+	}
+	return nil
+}
+
+// pathTemplateVars returns what each name in a path template stands for, for
+// the file at path:
+//   - path is the path itself
+//   - dirname is the name of the directory the file's in
+//   - basename is the file's name without its extension
+//   - filename is the file's name
+//
+// plus the capture groups of pattern, by number and by name, if it matches.
+func pathTemplateVars(path string, pattern *regexp.Regexp) map[string]string {
+	filename := filepath.Base(path)
+	vars := map[string]string{
+		"path":     path,
+		"dirname":  filepath.Base(filepath.Dir(path)),
+		"basename": strings.TrimSuffix(filename, filepath.Ext(filename)),
+		"filename": filename,
+	}
+	if pattern == nil {
+		return vars
+	}
+	match := pattern.FindStringSubmatch(path)
+	for i, name := range pattern.SubexpNames() {
+		var value string
+		if match != nil {
+			value = match[i]
+		}
+		if i > 0 {
+			vars[strconv.Itoa(i)] = value
+		}
+		if name != "" {
+			vars[name] = value
+		}
+	}
+	return vars
+}
+
+// expandPathTemplate fills in each {{name}} in tmpl from vars
+func expandPathTemplate(tmpl string, vars map[string]string) string {
+	return reTemplateVar.ReplaceAllStringFunc(tmpl, func(v string) string {
+		return vars[reTemplateVar.FindStringSubmatch(v)[1]]
+	})
+}
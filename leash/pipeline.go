@@ -0,0 +1,298 @@
+package leash
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+)
+
+// the --pipeline.when_full policies
+const (
+	whenFullBlock      = "block"
+	whenFullDropOldest = "drop_oldest"
+	whenFullSpill      = "spill"
+)
+
+// PipelineOptions size the buffers between reading, parsing and sending, and
+// say what happens when sending can't keep up
+type PipelineOptions struct {
+	LineBuffer  int    `long:"line_buffer" description:"How many lines read from each file being tailed can wait to be parsed, so reading can carry on while a parser's busy. With a state file, the position saved is from before any lines still waiting"`
+	EventBuffer int    `long:"event_buffer" description:"How many parsed events can wait to be sent, so parsing can carry on while sending's busy. By default, each parser waits for the event before to be taken"`
+	WhenFull    string `long:"when_full" description:"What to do when the --pipeline.event_buffer is full. Values: block (parsers wait for room, slowing down reading), drop_oldest (the oldest event waiting is dropped to make room, counted as buffer_dropped in the summary every --status_interval), spill (events are written to a file in --pipeline.spill_dir, and sent from there in order once there's room)" default:"block"`
+	SpillDir    string `long:"spill_dir" description:"Directory for the file events are spilled to with --pipeline.when_full spill, eg /var/lib/honeytail. It's removed once they've been sent, and isn't read after a restart. Numbers in spilled events are sent as floats"`
+}
+
+// spills reports whether events are spilled to disk when the event buffer's
+// full, or memory use is near --max_memory_mb
+func spills(options PipelineOptions) bool {
+	return options.EventBuffer > 0 && options.WhenFull == whenFullSpill
+}
+
+// eventBuffer holds the events parsers have made until sending takes them,
+// dropping or spilling them to disk when it's full as --pipeline.when_full
+// says. A nil eventBuffer holds nothing, leaving parsers to wait for sending.
+type eventBuffer struct {
+	policy string
+	stats  *runStats
+	// out is the buffer, as a buffered channel, which sending reads from
+	out chan event.Event
+	// spill is where events go with the spill policy when out is full
+	spill *eventSpill
+
+	requests chan chan uint64
+	stopped  chan struct{}
+}
+
+// newEventBuffer returns a buffer as options say, counting the events it
+// drops in stats, or nil if there's to be no buffer
+func newEventBuffer(options PipelineOptions, stats *runStats) (*eventBuffer, error) {
+	if options.EventBuffer <= 0 {
+		return nil, nil
+	}
+	b := &eventBuffer{
+		policy:   options.WhenFull,
+		stats:    stats,
+		out:      make(chan event.Event, options.EventBuffer),
+		requests: make(chan chan uint64),
+		stopped:  make(chan struct{}),
+	}
+	if b.policy == whenFullSpill {
+		spill, err := newEventSpill(options.SpillDir)
+		if err != nil {
+			return nil, err
+		}
+		b.spill = spill
+	}
+	return b, nil
+}
+
+// pass buffers the events from in, returning the channel they come out of
+func (b *eventBuffer) pass(in chan event.Event) chan event.Event {
+	if b == nil {
+		return in
+	}
+	go b.run(in)
+	return b.out
+}
+
+// buffered returns how many events have gone in that haven't come out, for
+// checkpoint.Tracker.WatchBuffered
+func (b *eventBuffer) buffered() uint64 {
+	if b == nil {
+		return 0
+	}
+	reply := make(chan uint64, 1)
+	select {
+	case b.requests <- reply:
+		return <-reply
+	case <-b.stopped:
+		return uint64(len(b.out))
+	}
+}
+
+// discard cleans up a buffer that's never going to be used
+func (b *eventBuffer) discard() {
+	if b == nil {
+		return
+	}
+	b.spill.Close()
+}
+
+// fullness returns how full the buffer is, from 0 to 1
+func (b *eventBuffer) fullness() float64 {
+	if b == nil {
+		return 0
+	}
+	return float64(len(b.out)) / float64(cap(b.out))
+}
+
+// run moves events from in to out until in is closed and everything held
+// has gone out. An event that doesn't fit in out is held in next, and with
+// the spill policy, the ones after it are spilled. So are those that come
+// while memory use is near --max_memory_mb.
+func (b *eventBuffer) run(in chan event.Event) {
+	defer close(b.stopped)
+	defer close(b.out)
+	var next event.Event
+	holding := false
+	for {
+		var from chan event.Event
+		if !holding || b.spill != nil {
+			from = in
+		}
+		var to chan event.Event
+		if holding {
+			to = b.out
+		}
+		if from == nil && to == nil {
+			// in's closed and there's nothing left to send
+			b.spill.Close()
+			return
+		}
+		select {
+		case ev, ok := <-from:
+			if !ok {
+				in = nil
+				continue
+			}
+			if holding {
+				if err := b.spill.write(ev); err != nil {
+					logrus.WithFields(logrus.Fields{"err": err}).Error("Couldn't spill an event to --pipeline.spill_dir; dropping it")
+					atomic.AddInt64(&b.stats.bufferDropped, 1)
+				}
+				continue
+			}
+			if b.spill != nil && b.stats.memory.over() {
+				// hold it as if out were full, so the ones after it
+				// are spilled
+				next, holding = ev, true
+				continue
+			}
+			select {
+			case b.out <- ev:
+				continue
+			default:
+			}
+			if b.policy == whenFullDropOldest {
+				select {
+				case <-b.out:
+					atomic.AddInt64(&b.stats.bufferDropped, 1)
+				default:
+				}
+				// nothing else adds to out, so there's room now
+				b.out <- ev
+				continue
+			}
+			next, holding = ev, true
+		case to <- next:
+			next, holding = b.spill.read()
+		case reply := <-b.requests:
+			held := uint64(len(b.out)) + uint64(b.spill.count())
+			if holding {
+				held++
+			}
+			reply <- held
+		}
+	}
+}
+
+// eventSpill is a file of events waiting for room in an eventBuffer, written
+// at the end and read from the start, as newline delimited JSON. It's emptied
+// each time everything in it has been read. A nil eventSpill holds nothing.
+type eventSpill struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	// source is file opened again to read from
+	source *os.File
+	reader *bufio.Reader
+	// waiting is how many events have been written that haven't been read
+	waiting int
+}
+
+// spilledEvent is an event in the spill file
+type spilledEvent struct {
+	Time    time.Time              `json:"time"`
+	Data    map[string]interface{} `json:"data"`
+	Dataset string                 `json:"dataset,omitempty"`
+}
+
+// newEventSpill creates a file in dir to spill events to
+func newEventSpill(dir string) (*eventSpill, error) {
+	file, err := ioutil.TempFile(dir, "honeytail-spill-")
+	if err != nil {
+		return nil, fmt.Errorf("can't create a file in --pipeline.spill_dir: %s", err)
+	}
+	source, err := os.Open(file.Name())
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("can't read back from --pipeline.spill_dir: %s", err)
+	}
+	return &eventSpill{
+		path:   file.Name(),
+		file:   file,
+		writer: bufio.NewWriter(file),
+		source: source,
+		reader: bufio.NewReader(source),
+	}, nil
+}
+
+// count returns how many events are waiting in the spill
+func (s *eventSpill) count() int {
+	if s == nil {
+		return 0
+	}
+	return s.waiting
+}
+
+// write adds ev to the end of the spill
+func (s *eventSpill) write(ev event.Event) error {
+	line, err := json.Marshal(spilledEvent{Time: ev.Timestamp, Data: ev.Data, Dataset: ev.Dataset})
+	if err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.waiting++
+	return nil
+}
+
+// read takes the event at the start of the spill, or returns false if
+// there's none, emptying the file once they've all been read
+func (s *eventSpill) read() (event.Event, bool) {
+	for s.count() > 0 {
+		if err := s.writer.Flush(); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("Couldn't write events to --pipeline.spill_dir; they're lost")
+			s.empty()
+			return event.Event{}, false
+		}
+		line, err := s.reader.ReadBytes('\n')
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("Couldn't read events back from --pipeline.spill_dir; they're lost")
+			s.empty()
+			return event.Event{}, false
+		}
+		s.waiting--
+		if s.waiting == 0 {
+			s.empty()
+		}
+		var spilled spilledEvent
+		if err := json.Unmarshal(line, &spilled); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("Couldn't read an event back from --pipeline.spill_dir; skipping it")
+			continue
+		}
+		return event.Event{Timestamp: spilled.Time, Data: spilled.Data, Dataset: spilled.Dataset}, true
+	}
+	return event.Event{}, false
+}
+
+// empty starts the file again from nothing
+func (s *eventSpill) empty() {
+	s.waiting = 0
+	s.writer.Reset(s.file)
+	s.file.Truncate(0)
+	s.file.Seek(0, io.SeekStart)
+	s.source.Seek(0, io.SeekStart)
+	s.reader.Reset(s.source)
+}
+
+// Close closes and removes the file
+func (s *eventSpill) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.source.Close()
+	err := s.file.Close()
+	os.Remove(s.path)
+	return err
+}
@@ -0,0 +1,197 @@
+package leash
+
+import (
+	"fmt"
+	"plugin"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/output"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// PluginABI is the version of Plugin, and what's handed to the parsers and
+// outputs it provides. It goes up whenever they change in a way a plugin
+// built for an older honeytail wouldn't work with.
+const PluginABI = 1
+
+// pluginSymbol is the variable a --plugin holds its Plugin in
+const pluginSymbol = "HoneytailPlugin"
+
+// Plugin is the parsers and outputs a --plugin adds to honeytail. A plugin is
+// a Go plugin, built with -buildmode=plugin against the same version of
+// honeytail, holding one in a variable named HoneytailPlugin:
+//
+//	var HoneytailPlugin = leash.Plugin{
+//		ABI:     leash.PluginABI,
+//		Name:    "acme",
+//		Parsers: map[string]func() parsers.Parser{"acme": newParser},
+//	}
+//
+// Programs embedding leash can Register one instead.
+type Plugin struct {
+	// ABI is the PluginABI the plugin was built for
+	ABI int
+	// Name is what the plugin's called in errors and logs
+	Name string
+	// Parsers make the parsers the plugin adds, by their --parser name.
+	// They're given the --plugin_option settings to Init, as a
+	// map[string]string.
+	Parsers map[string]func() parsers.Parser
+	// Outputs make the outputs the plugin adds, by URL scheme, eg acme for
+	// --output acme://somewhere. They're given the --output URL and the
+	// --dataset.
+	Outputs map[string]func(url, dataset string) (output.Output, error)
+}
+
+// builtinOutputSchemes are the --output URL schemes honeytail has itself
+var builtinOutputSchemes = []string{
+	"honeycomb", "file", "kafka", "http", "https", "otlp", "otlps", "otlp+http", "otlp+https",
+}
+
+// plugins is what the plugins registered so far add
+var plugins = struct {
+	sync.Mutex
+	parsers map[string]func() parsers.Parser
+	outputs map[string]func(url, dataset string) (output.Output, error)
+}{
+	parsers: make(map[string]func() parsers.Parser),
+	outputs: make(map[string]func(url, dataset string) (output.Output, error)),
+}
+
+// LoadPlugin opens the Go plugin at path and registers the Plugin in its
+// HoneytailPlugin variable. Go plugins are only supported on Linux, macOS
+// and FreeBSD.
+func LoadPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		if strings.Contains(err.Error(), "different version of package") {
+			return fmt.Errorf("%s needs building again against honeytail %s: %s", path, Version, err)
+		}
+		return err
+	}
+	sym, err := p.Lookup(pluginSymbol)
+	if err != nil {
+		return fmt.Errorf("%s isn't a honeytail plugin: %s", path, err)
+	}
+	hp, ok := sym.(*Plugin)
+	if !ok {
+		return fmt.Errorf("%s isn't a honeytail plugin: its %s is a %T, not a leash.Plugin", path, pluginSymbol, sym)
+	}
+	if err := Register(*hp); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"plugin": hp.Name,
+		"path":   path,
+	}).Debug("Loaded plugin")
+	return nil
+}
+
+// Register adds the parsers and outputs p provides, so they can be used
+// like honeytail's own. None of them may have the name of one honeytail or
+// another plugin already has.
+func Register(p Plugin) error {
+	if p.ABI != PluginABI {
+		return fmt.Errorf("the %s plugin was built for plugin ABI %d, but this honeytail has %d", p.Name, p.ABI, PluginABI)
+	}
+	if len(p.Parsers) == 0 && len(p.Outputs) == 0 {
+		return fmt.Errorf("the %s plugin has no parsers or outputs", p.Name)
+	}
+	plugins.Lock()
+	defer plugins.Unlock()
+	for name, newParser := range p.Parsers {
+		switch {
+		case newParser == nil:
+			return fmt.Errorf("the %s plugin's %s parser can't be made", p.Name, name)
+		case isParser(name):
+			return fmt.Errorf("the %s plugin's %s parser has the name of one honeytail already has", p.Name, name)
+		}
+	}
+	for scheme, newOutput := range p.Outputs {
+		switch {
+		case newOutput == nil:
+			return fmt.Errorf("the %s plugin's %s:// output can't be made", p.Name, scheme)
+		case isOutputScheme(scheme):
+			return fmt.Errorf("the %s plugin's %s:// output has the scheme of one honeytail already has", p.Name, scheme)
+		}
+	}
+	for name, newParser := range p.Parsers {
+		plugins.parsers[name] = newParser
+		Parsers = append(Parsers, name)
+	}
+	for scheme, newOutput := range p.Outputs {
+		plugins.outputs[scheme] = newOutput
+	}
+	return nil
+}
+
+// isParser reports whether honeytail or a plugin already has a parser called
+// name. plugins must be locked.
+func isParser(name string) bool {
+	// the built in parsers' other names
+	if name == "mongodb" || name == "php-fpm" {
+		return true
+	}
+	for _, parser := range Parsers {
+		if parser == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isOutputScheme reports whether honeytail or a plugin already has an output
+// for URLs starting scheme://. plugins must be locked.
+func isOutputScheme(scheme string) bool {
+	for _, builtin := range builtinOutputSchemes {
+		if builtin == scheme {
+			return true
+		}
+	}
+	_, ok := plugins.outputs[scheme]
+	return ok
+}
+
+// pluginParser returns a new one of the plugin parser called name, and the
+// options to Init it with, or nil if no plugin has a parser of that name
+func pluginParser(name string, options []string) (parsers.Parser, interface{}) {
+	plugins.Lock()
+	newParser, ok := plugins.parsers[name]
+	plugins.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	settings := make(map[string]string, len(options))
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) == 2 {
+			settings[kv[0]] = kv[1]
+		}
+	}
+	return newParser(), settings
+}
+
+// pluginOutput returns the plugin output for url, or nil if no plugin
+// has an output for its scheme
+func pluginOutput(url string) func(url, dataset string) (output.Output, error) {
+	i := strings.Index(url, "://")
+	if i < 0 {
+		return nil
+	}
+	plugins.Lock()
+	defer plugins.Unlock()
+	return plugins.outputs[url[:i]]
+}
+
+// validPluginOptions returns true if every --plugin_option is a name=value
+// pair
+func validPluginOptions(options []string) bool {
+	for _, option := range options {
+		if kv := strings.SplitN(option, "=", 2); len(kv) != 2 || kv[0] == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package leash
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/libhoney-go"
+)
+
+// authResponse is what the Honeycomb API says about a write key
+type authResponse struct {
+	APIKeyAccess struct {
+		Events         bool `json:"events"`
+		CreateDatasets bool `json:"createDatasets"`
+	} `json:"api_key_access"`
+	Team struct {
+		Slug string `json:"slug"`
+	} `json:"team"`
+	Environment struct {
+		Slug string `json:"slug"`
+	} `json:"environment"`
+}
+
+// Preflight checks the write key with the Honeycomb API before anything's
+// read, so that a key that won't work fails straight away rather than every
+// event being turned away. Not being able to reach the API isn't an error;
+// events wait for it like they would anyway. Nothing's checked with
+// --skip_preflight, or if events aren't sent to Honeycomb.
+func Preflight(options Config) error {
+	if options.SkipPreflight || !sendsToHoneycomb(options.Output) {
+		return nil
+	}
+	transport, err := newTransport(options)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	if transport != nil {
+		client.Transport = transport
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(options.APIHost, "/")+"/1/auth", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Honeycomb-Team", options.Reqs.WriteKey)
+	req.Header.Set("User-Agent", libhoney.UserAgentAddition)
+	resp, err := client.Do(req)
+	if err != nil {
+		logrus.WithField("err", err).Warn("Couldn't reach the Honeycomb API to check the write key")
+		return nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("the Honeycomb API rejected the write key: %d %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	case resp.StatusCode != http.StatusOK:
+		logrus.WithFields(logrus.Fields{
+			"status_code": resp.StatusCode,
+			"body":        strings.TrimSpace(string(body)),
+		}).Warn("Couldn't check the write key with the Honeycomb API")
+		return nil
+	}
+	var auth authResponse
+	if err := json.Unmarshal(body, &auth); err != nil {
+		logrus.WithField("err", err).Warn("Couldn't make sense of the Honeycomb API's answer about the write key")
+		return nil
+	}
+	if !auth.APIKeyAccess.Events {
+		return fmt.Errorf("the write key for team %s doesn't allow sending events", auth.Team.Slug)
+	}
+	logrus.WithFields(logrus.Fields{
+		"team":        auth.Team.Slug,
+		"environment": auth.Environment.Slug,
+	}).Info("Write key checked")
+	if !auth.APIKeyAccess.CreateDatasets {
+		logrus.Info("The write key can't create datasets, so events only arrive in datasets that already exist")
+	}
+	return nil
+}
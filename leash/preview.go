@@ -0,0 +1,252 @@
+package leash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+// previewEvent is an event parsed by --sample_lines, with the lines it was
+// made from
+type previewEvent struct {
+	// first and last are the line numbers, from 1, of the lines the parser
+	// had read when it made the event. Lines before last that didn't make an
+	// event of their own either failed to parse or are part of this one.
+	first, last int
+	ev          event.Event
+}
+
+// Preview prints what would be sent for the first --sample_lines lines of
+// the first file, without sending anything: each event as it's parsed,
+// where its timestamp came from, any lines that didn't parse, and what the
+// transforms would drop, change and add. Each of the --config file's inputs
+// is previewed in turn.
+func Preview(options Config, out io.Writer) error {
+	inputs := options.Inputs
+	if len(inputs) == 0 {
+		inputs = []Config{options}
+	}
+	for i, input := range inputs {
+		if len(options.Inputs) > 0 {
+			fmt.Fprintf(out, "== input %d\n", i+1)
+		}
+		input.Modes.SampleLines = options.Modes.SampleLines
+		if err := previewInput(input, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// previewInput previews the first file options read
+func previewInput(options Config, out io.Writer) error {
+	var path string
+	for _, file := range options.Reqs.LogFiles {
+		if file == "-" {
+			path = file
+			break
+		}
+		if strings.Contains(file, "://") {
+			continue
+		}
+		if matches, _ := filepath.Glob(file); len(matches) > 0 {
+			path = matches[0]
+			break
+		}
+	}
+	if options.Reqs.ParserName == "" {
+		return errors.New("parser required")
+	}
+	if path == "" {
+		return errors.New("--sample_lines needs a log file, or - for stdin, to read from")
+	}
+	lines, err := tail.FirstLines(path, int(options.Modes.SampleLines), options.Tail)
+	if err != nil {
+		return fmt.Errorf("couldn't read the lines to preview from %s: %s", path, err)
+	}
+	fmt.Fprintf(out, "%s, with the %s parser: %d lines\n", path, options.Reqs.ParserName, len(lines))
+
+	parser, err := newParser(options, path)
+	if err != nil {
+		return err
+	}
+	defer closeParser(parser)
+	stages, err := newEventStages(options)
+	if err != nil {
+		return err
+	}
+	parsed := parsePreviewLines(parser, lines)
+	read := time.Now()
+	// the transforms pass on every event, in order, so what comes out
+	// matches up with what went in
+	before := make([]map[string]interface{}, len(parsed))
+	in := make(chan event.Event, len(parsed))
+	for i, p := range parsed {
+		before[i] = copyValue(p.ev.Data).(map[string]interface{})
+		in <- p.ev
+	}
+	close(in)
+	var sent []event.Event
+	for ev := range modifyEventContents(in, stages) {
+		sent = append(sent, ev)
+	}
+
+	last := 0
+	for i, p := range parsed {
+		if p.first > last+1 {
+			fmt.Fprintf(out, "\n%s: no event\n", lineNumbers(last+1, p.first-1))
+		}
+		last = p.last
+		fmt.Fprintf(out, "\n%s:\n", lineNumbers(p.first, p.last))
+		for n := p.first; n <= p.last; n++ {
+			fmt.Fprintf(out, "  line %-5d %s\n", n, lines[n-1])
+		}
+		if p.last > p.first {
+			fmt.Fprintf(out, "  one event from %d lines: the others didn't parse, or are part of it\n", p.last-p.first+1)
+		}
+		fmt.Fprintf(out, "  parsed:    %s\n", previewJSON(before[i]))
+		fmt.Fprintf(out, "  timestamp: %s\n", previewTimestamp(p.ev.Timestamp, read))
+		if sent[i].Drop {
+			fmt.Fprintf(out, "  sent:      nothing, --script dropped it\n")
+			continue
+		}
+		after := sent[i].Data
+		fmt.Fprintf(out, "  sent:      %s\n", previewJSON(after))
+		dropped, changed, added := diffFields(before[i], after)
+		for _, d := range []struct {
+			name   string
+			fields []string
+		}{{"dropped", dropped}, {"changed", changed}, {"added", added}} {
+			if len(d.fields) > 0 {
+				fmt.Fprintf(out, "  %-10s %s\n", d.name+":", strings.Join(d.fields, ", "))
+			}
+		}
+	}
+	if last < len(lines) {
+		fmt.Fprintf(out, "\n%s: no event\n", lineNumbers(last+1, len(lines)))
+	}
+	return nil
+}
+
+// parsePreviewLines feeds lines through parser, noting how many it had read
+// when it made each event. The parser can't read another line until the
+// event it's sending is taken, so the count is exact.
+func parsePreviewLines(parser parsers.Parser, lines []string) []previewEvent {
+	in := make(chan string)
+	events := make(chan event.Event)
+	go func() {
+		parser.ProcessLines(in, events)
+		close(events)
+	}()
+	var parsed []previewEvent
+	taken, first := 0, 1
+	record := func(ev event.Event) {
+		parsed = append(parsed, previewEvent{first: first, last: taken, ev: ev})
+		first = taken + 1
+	}
+	for taken < len(lines) {
+		select {
+		case in <- lines[taken]:
+			taken++
+		case ev := <-events:
+			record(ev)
+		}
+	}
+	close(in)
+	for ev := range events {
+		// parsers holding on to lines for a multi-line event send it once
+		// there are no more
+		record(ev)
+	}
+	return parsed
+}
+
+// lineNumbers describes the lines from first to last
+func lineNumbers(first, last int) string {
+	if first >= last {
+		return fmt.Sprintf("line %d", last)
+	}
+	return fmt.Sprintf("lines %d-%d", first, last)
+}
+
+// previewTimestamp describes ts and where it came from. Parsers use the time
+// they read a line for lines they don't find a timestamp in.
+func previewTimestamp(ts, read time.Time) string {
+	if ts.IsZero() || ts.Sub(read) > -time.Minute && ts.Sub(read) < time.Minute {
+		return fmt.Sprintf("%s, the time it was read, as none was found in the line", ts.Format(time.RFC3339Nano))
+	}
+	return fmt.Sprintf("%s, from the line", ts.Format(time.RFC3339Nano))
+}
+
+// previewJSON formats data as JSON, with its keys in order
+func previewJSON(data map[string]interface{}) string {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("%v", data)
+	}
+	return string(out)
+}
+
+// diffFields returns the names of the fields, nested ones with dots, that
+// are in before but not after, in both but different, and in after but not
+// before
+func diffFields(before, after map[string]interface{}) (dropped, changed, added []string) {
+	var diff func(prefix string, before, after map[string]interface{})
+	diff = func(prefix string, before, after map[string]interface{}) {
+		for k, b := range before {
+			a, ok := after[k]
+			switch {
+			case !ok:
+				dropped = append(dropped, prefix+k)
+			case !reflect.DeepEqual(a, b):
+				bm, bok := b.(map[string]interface{})
+				am, aok := a.(map[string]interface{})
+				if bok && aok {
+					diff(prefix+k+".", bm, am)
+				} else {
+					changed = append(changed, prefix+k)
+				}
+			}
+		}
+		for k := range after {
+			if _, ok := before[k]; !ok {
+				added = append(added, prefix+k)
+			}
+		}
+	}
+	diff("", before, after)
+	sort.Strings(dropped)
+	sort.Strings(changed)
+	sort.Strings(added)
+	return dropped, changed, added
+}
+
+// copyValue returns a copy of val, with any maps and slices nested in it
+// copied too, so that transforms changing them in place don't change it
+func copyValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for k, nested := range v {
+			copied[k] = copyValue(nested)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, elem := range v {
+			copied[i] = copyValue(elem)
+		}
+		return copied
+	}
+	return val
+}
@@ -0,0 +1,60 @@
+package leash
+
+import (
+	"context"
+	"time"
+)
+
+// rateLimiter is a token bucket holding up to a second's worth of events, for
+// --max_events_per_second. It's only used by one goroutine at a time.
+type rateLimiter struct {
+	perSecond float64
+	tokens    float64
+	last      time.Time
+}
+
+// newRateLimiter returns a limiter letting through perSecond events a second,
+// or nil if perSecond is 0, for no limit
+func newRateLimiter(perSecond uint) *rateLimiter {
+	if perSecond == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		perSecond: float64(perSecond),
+		tokens:    float64(perSecond),
+		last:      time.Now(),
+	}
+}
+
+// wait returns once another event may be sent. Blocking here holds back
+// reading, so backfills are paced and live tailing falls behind rather than
+// going over the limit. Once ctx is done, it returns straight away, so what's
+// already been read is sent without holding up shutting down.
+func (r *rateLimiter) wait(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.perSecond
+	if r.tokens > r.perSecond {
+		r.tokens = r.perSecond
+	}
+	r.last = now
+	if r.tokens < 1 {
+		short := time.Duration((1 - r.tokens) / r.perSecond * float64(time.Second))
+		sleep(ctx, short)
+		r.tokens = 1
+		r.last = now.Add(short)
+	}
+	r.tokens--
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,113 @@
+package leash
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// redactPreset is a kind of value that's redacted by name with
+// --redact_pattern, eg email
+type redactPreset struct {
+	pattern string
+	// valid, if set, checks a match really is one before it's redacted
+	valid func(match string) bool
+}
+
+// redactPresets are the --redact_pattern values that stand for a built in
+// pattern rather than being a regex themselves
+var redactPresets = map[string]redactPreset{
+	"email":        {pattern: `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+	"credit_card":  {pattern: `\b\d(?:[ -]?\d){12,18}\b`, valid: luhnValid},
+	"ssn":          {pattern: `\b\d{3}-\d{2}-\d{4}\b`},
+	"bearer_token": {pattern: `(?i)\bbearer\s+[A-Za-z0-9._~+/-]+=*`},
+}
+
+// redactPresetNames returns the names of the redactPresets, for messages
+func redactPresetNames() string {
+	var names []string
+	for name := range redactPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// redactor replaces whatever a --redact_pattern matches with a mask
+type redactor struct {
+	re    *regexp.Regexp
+	valid func(match string) bool
+	mask  string
+}
+
+// newRedactor makes a redactor for a --redact_pattern, which is either the
+// name of one of the redactPresets or a regex
+func newRedactor(spec string) (*redactor, error) {
+	if preset, ok := redactPresets[spec]; ok {
+		return &redactor{
+			re:    regexp.MustCompile(preset.pattern),
+			valid: preset.valid,
+			mask:  "[REDACTED:" + spec + "]",
+		}, nil
+	}
+	re, err := regexp.Compile(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%q isn't one of %s, or a valid regex: %s", spec, redactPresetNames(), err)
+	}
+	return &redactor{re: re, mask: "[REDACTED]"}, nil
+}
+
+// redact returns s with each match masked
+func (r *redactor) redact(s string) string {
+	return r.re.ReplaceAllStringFunc(s, func(match string) string {
+		if r.valid != nil && !r.valid(match) {
+			return match
+		}
+		return r.mask
+	})
+}
+
+// redactValue masks the matches of each redactor in val, if it's a string, or
+// in each string nested in it, if it's a map or slice
+func redactValue(val interface{}, redactors []*redactor) interface{} {
+	switch v := val.(type) {
+	case string:
+		for _, r := range redactors {
+			v = r.redact(v)
+		}
+		return v
+	case map[string]interface{}:
+		for k, nested := range v {
+			v[k] = redactValue(nested, redactors)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = redactValue(elem, redactors)
+		}
+	}
+	return val
+}
+
+// luhnValid returns true if the digits in s pass the Luhn check that card
+// numbers do, so that other long numbers aren't taken for them
+func luhnValid(s string) bool {
+	sum := 0
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
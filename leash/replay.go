@@ -0,0 +1,45 @@
+package leash
+
+import (
+	"context"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// replayPacer spaces events out by their timestamps, for --replay_speed, so
+// a backfill is sent as the events happened, speed times faster. It's only
+// used by one goroutine at a time.
+type replayPacer struct {
+	speed float64
+	// first is the timestamp of the first event, and start when it was sent
+	first time.Time
+	start time.Time
+}
+
+// newReplayPacer returns a pacer replaying at speed times real time, or nil
+// if speed is 0, to send events as fast as they come
+func newReplayPacer(speed float64) *replayPacer {
+	if speed <= 0 {
+		return nil
+	}
+	return &replayPacer{speed: speed}
+}
+
+// wait returns once it's time to send ev: as long after the first event as
+// ev happened after it, divided by the speed. Events without a timestamp, or
+// from before the first, go straight away, as does everything once ctx is done.
+func (r *replayPacer) wait(ctx context.Context, ev event.Event) {
+	if r == nil || ev.Timestamp.IsZero() {
+		return
+	}
+	if r.first.IsZero() {
+		r.first = ev.Timestamp
+		r.start = time.Now()
+		return
+	}
+	offset := time.Duration(float64(ev.Timestamp.Sub(r.first)) / r.speed)
+	if wait := time.Until(r.start.Add(offset)); wait > 0 {
+		sleep(ctx, wait)
+	}
+}
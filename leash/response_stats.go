@@ -0,0 +1,257 @@
+package leash
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/output"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+// responseStats is a container for collecting statistics about events sent
+// via the output. It counts interesting aspects of the events it gets and
+// presents them for printing whenever it's called.
+//
+// the intent is to periodically print and flush the counters, eg once/minute
+
+type responseStats struct {
+	lock *sync.Mutex
+	// run has the lines read, which are counted on the way in
+	run *runStats
+	// format is the --status_format the stats are printed in, and out
+	// where they're printed as json
+	format string
+	out    io.Writer
+
+	count        int
+	spooled      int
+	dropped      int
+	sendFailures int
+	statusCodes  map[int]int
+	bodies       map[string]int
+	errors       map[string]int
+	maxDuration  time.Duration
+	sumDuration  time.Duration
+	minDuration  time.Duration
+	// latencies has the durations, in milliseconds, for percentiles
+	latencies aggregateStats
+
+	// start is when the stats were last reset, when there had been
+	// startLines lines read, startParseErrors parse errors and
+	// startBufferDropped events dropped from the --pipeline.event_buffer
+	start              time.Time
+	startLines         int64
+	startParseErrors   int64
+	startBufferDropped int64
+	oversizeLines      int64
+	paddedLines        int64
+}
+
+// statusSummary is what --status_format json prints, one per line
+type statusSummary struct {
+	Time            time.Time       `json:"time"`
+	IntervalSeconds float64         `json:"interval_seconds"`
+	Files           []tail.Position `json:"files"`
+	LagBytes        int64           `json:"lag_bytes"`
+	LagSeconds      float64         `json:"lag_seconds"`
+	Lines           int64           `json:"lines"`
+	LinesPerSecond  float64         `json:"lines_per_second"`
+	Events          int             `json:"events"`
+	EventsPerSecond float64         `json:"events_per_second"`
+	Spooled         int             `json:"spooled"`
+	Dropped         int             `json:"dropped"`
+	BufferDropped   int64           `json:"buffer_dropped"`
+	SendFailures    int             `json:"send_failures"`
+	ParseErrors     int64           `json:"parse_errors"`
+	OversizeLines   int64           `json:"oversize_lines"`
+	PaddedLines     int64           `json:"padded_lines"`
+	StatusCodes     map[int]int     `json:"count_per_status"`
+	Errors          map[string]int  `json:"errors"`
+	SendLatency     statusLatency   `json:"send_latency_ms"`
+}
+
+// statusLatency is how long sending events took, in milliseconds
+type statusLatency struct {
+	Min float64 `json:"min"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// newResponseStats initializes the struct's complex data types. Lines are
+// read from run, if it's set, and the stats printed in format.
+func newResponseStats(run *runStats, format string) *responseStats {
+	r := &responseStats{run: run, format: format, out: os.Stdout}
+	r.lock = &sync.Mutex{}
+	r.reset()
+	return r
+}
+
+// update adds a response into the stats container
+func (r *responseStats) update(rsp output.Result) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.count += 1
+	if rsp.Spooled {
+		r.spooled += 1
+	}
+	if rsp.Err == output.ErrQueueFull {
+		r.dropped += 1
+	}
+	r.statusCodes[rsp.StatusCode] += 1
+	r.bodies[strings.TrimSpace(string(rsp.Body))] += 1
+	if rsp.Err != nil {
+		r.errors[rsp.Err.Error()] += 1
+	}
+	if sendFailed(rsp) {
+		r.sendFailures += 1
+	}
+	if r.minDuration == 0 {
+		r.minDuration = rsp.Duration
+	}
+	if rsp.Duration < r.minDuration {
+		r.minDuration = rsp.Duration
+	} else if rsp.Duration > r.maxDuration {
+		r.maxDuration = rsp.Duration
+	}
+	r.sumDuration += rsp.Duration
+	r.latencies.add(float64(rsp.Duration)/float64(time.Millisecond), 1)
+}
+
+// log the current stats and reset them all to zero.
+// thread safe.
+func (r *responseStats) logAndReset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.log()
+	r.reset()
+}
+
+// dump logs the current stats without resetting them, for SIGUSR1.
+// thread safe.
+func (r *responseStats) dump() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.log()
+}
+
+// log the current statistics to logrus, or as json to out.
+// NOT thread safe.
+func (r *responseStats) log() {
+	r.oversizeLines += tail.OversizeLines()
+	r.paddedLines += tail.PaddedLines()
+	if r.format == "json" {
+		json.NewEncoder(r.out).Encode(r.summary(time.Now()))
+		return
+	}
+	var avg time.Duration
+	if r.count != 0 {
+		avg = r.sumDuration / time.Duration(r.count)
+	} else {
+		avg = 0
+	}
+	lagBytes, lagSeconds := maxLag(tail.Positions())
+	bufferDropped := r.bufferDropped()
+	logrus.WithFields(logrus.Fields{
+		"total":            r.count,
+		"slowest":          r.maxDuration,
+		"fastest":          r.minDuration,
+		"avg_duration":     avg,
+		"count_per_status": r.statusCodes,
+		"response_bodies":  r.bodies,
+		"errors":           r.errors,
+		"spooled":          r.spooled,
+		"dropped":          r.dropped,
+		"buffer_dropped":   bufferDropped,
+		"oversize_lines":   r.oversizeLines,
+		"padded_lines":     r.paddedLines,
+		"lag_bytes":        lagBytes,
+		"lag_seconds":      lagSeconds,
+	}).Info("Summary of sent events")
+	if r.dropped > 0 {
+		logrus.WithField("dropped", r.dropped).Warn(
+			"Events were dropped because the queue to Honeycomb was full; raise --pending_work_capacity or --poolsize to keep up")
+	}
+	if bufferDropped > 0 {
+		logrus.WithField("buffer_dropped", bufferDropped).Warn(
+			"Events were dropped because the --pipeline.event_buffer was full; raise it, or --poolsize, to keep up")
+	}
+}
+
+// bufferDropped returns how many events have been dropped from the
+// --pipeline.event_buffer since the stats were reset.
+// NOT thread safe.
+func (r *responseStats) bufferDropped() int64 {
+	if r.run == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&r.run.bufferDropped) - r.startBufferDropped
+}
+
+// summary returns the current statistics as of now.
+// NOT thread safe.
+func (r *responseStats) summary(now time.Time) statusSummary {
+	s := statusSummary{
+		Time:            now,
+		IntervalSeconds: now.Sub(r.start).Seconds(),
+		Files:           tail.Positions(),
+		Events:          r.count,
+		Spooled:         r.spooled,
+		Dropped:         r.dropped,
+		BufferDropped:   r.bufferDropped(),
+		SendFailures:    r.sendFailures,
+		OversizeLines:   r.oversizeLines,
+		PaddedLines:     r.paddedLines,
+		StatusCodes:     r.statusCodes,
+		Errors:          r.errors,
+		SendLatency: statusLatency{
+			Min: float64(r.minDuration) / float64(time.Millisecond),
+			P50: r.latencies.percentile(50),
+			P90: r.latencies.percentile(90),
+			P99: r.latencies.percentile(99),
+			Max: float64(r.maxDuration) / float64(time.Millisecond),
+		},
+	}
+	s.LagBytes, s.LagSeconds = maxLag(s.Files)
+	if r.run != nil {
+		s.Lines = atomic.LoadInt64(&r.run.lines) - r.startLines
+		s.ParseErrors = r.run.parseErrors.Count() - r.startParseErrors
+	}
+	if s.IntervalSeconds > 0 {
+		s.LinesPerSecond = float64(s.Lines) / s.IntervalSeconds
+		s.EventsPerSecond = float64(s.Events) / s.IntervalSeconds
+	}
+	return s
+}
+
+// reset the counters to zero.
+// NOT thread safe
+func (r *responseStats) reset() {
+	r.count = 0
+	r.spooled = 0
+	r.dropped = 0
+	r.sendFailures = 0
+	r.statusCodes = make(map[int]int)
+	r.bodies = make(map[string]int)
+	r.errors = make(map[string]int)
+	r.maxDuration = 0
+	r.sumDuration = 0
+	r.minDuration = 0
+	r.latencies = aggregateStats{}
+	r.start = time.Now()
+	if r.run != nil {
+		r.startLines = atomic.LoadInt64(&r.run.lines)
+		r.startBufferDropped = atomic.LoadInt64(&r.run.bufferDropped)
+		r.startParseErrors = r.run.parseErrors.Count()
+	}
+	r.oversizeLines = 0
+	r.paddedLines = 0
+}
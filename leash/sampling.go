@@ -0,0 +1,242 @@
+package leash
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/dynsampler"
+	"github.com/honeycombio/honeytail/event"
+)
+
+// sampleRuleOps are the comparisons a --sample_rule can make, longest first
+// so that >= isn't taken for >
+var sampleRuleOps = []string{">=", "<=", "!=", "==", "=", ">", "<"}
+
+// sampleRule samples the events whose field compares to a value at a rate
+// of its own, as given by a --sample_rule
+type sampleRule struct {
+	field string
+	op    string
+	value string
+	// number is the value as a number, if it is one
+	number   float64
+	isNumber bool
+	rate     uint
+}
+
+// parseSampleRule parses a field<op>value:rate rule, eg status>=500:1
+func parseSampleRule(spec string) (sampleRule, error) {
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return sampleRule{}, fmt.Errorf("%q has no :rate", spec)
+	}
+	rate, err := strconv.ParseUint(spec[i+1:], 10, 32)
+	if err != nil {
+		return sampleRule{}, fmt.Errorf("%q has a bad rate: %s", spec, err)
+	}
+	cond := spec[:i]
+	for _, op := range sampleRuleOps {
+		j := strings.Index(cond, op)
+		if j <= 0 {
+			continue
+		}
+		r := sampleRule{
+			field: strings.TrimSpace(cond[:j]),
+			op:    op,
+			value: strings.TrimSpace(cond[j+len(op):]),
+			rate:  uint(rate),
+		}
+		if r.op == "==" {
+			r.op = "="
+		}
+		if n, err := strconv.ParseFloat(r.value, 64); err == nil {
+			r.number, r.isNumber = n, true
+		} else if r.op != "=" && r.op != "!=" {
+			return sampleRule{}, fmt.Errorf("%q compares with %s, so needs a number", spec, op)
+		}
+		return r, nil
+	}
+	return sampleRule{}, fmt.Errorf("%q isn't field<op>value:rate, where op is one of %s", spec, strings.Join(sampleRuleOps, " "))
+}
+
+// matches returns true if ev's field compares to the rule's value. Numbers,
+// or strings that are numbers, compare as numbers.
+func (r sampleRule) matches(ev event.Event) bool {
+	val, ok := ev.Data[r.field]
+	if !ok || val == nil {
+		return r.op == "!="
+	}
+	if r.isNumber {
+		var n float64
+		switch v := val.(type) {
+		case float64:
+			n = v
+		case int:
+			n = float64(v)
+		case int64:
+			n = float64(v)
+		default:
+			f, err := strconv.ParseFloat(strings.TrimSpace(fmt.Sprintf("%v", v)), 64)
+			if err != nil {
+				return r.op == "!="
+			}
+			n = f
+		}
+		switch r.op {
+		case "=":
+			return n == r.number
+		case "!=":
+			return n != r.number
+		case ">=":
+			return n >= r.number
+		case "<=":
+			return n <= r.number
+		case ">":
+			return n > r.number
+		default:
+			return n < r.number
+		}
+	}
+	equal := fmt.Sprintf("%v", val) == r.value
+	if r.op == "!=" {
+		return !equal
+	}
+	return equal
+}
+
+// sampler decides the sample rate of each event and whether it's kept
+type sampler struct {
+	// rules come first, the first that matches an event deciding its rate
+	rules []sampleRule
+	// rate is the --samplerate
+	rate uint
+	// dynamic, if set, works out a rate for each combination of the values
+	// of the dynamicFields, aiming for an average of rate
+	dynamic       *dynsampler.Dynamic
+	dynamicFields []string
+	// hashField is the --sample_on_field
+	hashField string
+	// presampledField is the --presampled_field
+	presampledField string
+}
+
+// newSampler returns a sampler for the sampling options
+func newSampler(options Config) (*sampler, error) {
+	s := &sampler{
+		rate:            options.SampleRate,
+		hashField:       options.SampleField,
+		presampledField: options.PreSampled,
+	}
+	for _, spec := range options.SampleRules {
+		rule, err := parseSampleRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.rules = append(s.rules, rule)
+	}
+	if len(options.DynSample) > 0 {
+		s.dynamic = dynsampler.NewDynamic(options.SampleRate, time.Duration(options.DynWindowSec)*time.Second)
+		s.dynamicFields = options.DynSample
+	}
+	return s, nil
+}
+
+// sample returns the rate ev is sampled at and whether it's kept. A rate of
+// 0 from a rule drops every event it matches. The rate of a kept event is
+// multiplied by any it was already sampled at before honeytail read it.
+func (s *sampler) sample(ev event.Event) (uint, bool) {
+	rate, ruled := s.ruleRate(ev)
+	if !ruled {
+		rate = s.rate
+		if s.dynamic != nil {
+			rate = s.dynamic.SampleRate(s.dynamicKey(ev))
+		}
+	}
+	if rate == 0 {
+		return rate, false
+	}
+	if rate > 1 && !s.keep(ev, rate) {
+		return rate, false
+	}
+	return rate * s.presampledRate(ev), true
+}
+
+// presampledRate removes the --presampled_field from ev, returning the rate
+// it says ev was already sampled at, or 1 if it doesn't have a usable one
+func (s *sampler) presampledRate(ev event.Event) uint {
+	if s.presampledField == "" {
+		return 1
+	}
+	val, ok := ev.Data[s.presampledField]
+	if !ok {
+		return 1
+	}
+	delete(ev.Data, s.presampledField)
+	var rate float64
+	switch v := val.(type) {
+	case float64:
+		rate = v
+	case int:
+		rate = float64(v)
+	case int64:
+		rate = float64(v)
+	case string:
+		rate, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	if rate < 1 {
+		logrus.WithFields(logrus.Fields{
+			"presampled_field": s.presampledField,
+			"value":            val,
+		}).Debug("Presampled rate isn't a number of at least 1, taking it as 1")
+		return 1
+	}
+	return uint(rate + 0.5)
+}
+
+// keep returns true for 1 in rate events, chosen by the hash of their
+// --sample_on_field, if they have it, or at random
+func (s *sampler) keep(ev event.Event, rate uint) bool {
+	if s.hashField != "" {
+		if val, ok := ev.Data[s.hashField]; ok && val != nil {
+			return hashKeep(fmt.Sprintf("%v", val), rate)
+		}
+	}
+	return rand.Intn(int(rate)) == 0
+}
+
+// hashKeep returns true for 1 in rate values, going by the first 4 bytes of
+// their SHA1 as other deterministic samplers do, so that they all keep the
+// same ones
+func hashKeep(value string, rate uint) bool {
+	sum := sha1.Sum([]byte(value))
+	return binary.BigEndian.Uint32(sum[:4]) < math.MaxUint32/uint32(rate)
+}
+
+// ruleRate returns the rate of the first rule that matches ev, if any does
+func (s *sampler) ruleRate(ev event.Event) (uint, bool) {
+	for _, rule := range s.rules {
+		if rule.matches(ev) {
+			return rule.rate, true
+		}
+	}
+	return 0, false
+}
+
+// dynamicKey joins the values ev has for the dynamicFields, with an empty
+// value for any it doesn't have
+func (s *sampler) dynamicKey(ev event.Event) string {
+	values := make([]string, len(s.dynamicFields))
+	for i, field := range s.dynamicFields {
+		if val, ok := ev.Data[field]; ok && val != nil {
+			values[i] = fmt.Sprintf("%v", val)
+		}
+	}
+	return strings.Join(values, "_")
+}
@@ -0,0 +1,149 @@
+package leash
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// scriptFunction is the function a --script defines to change each event
+const scriptFunction = "transform"
+
+// scriptWarnInterval is the least time between warnings about the --script
+// failing, so one failing on every event doesn't flood the log
+const scriptWarnInterval = time.Minute
+
+// eventScript is a --script, a Lua file defining a transform(fields)
+// function. It's handed each event's fields as a table, which it can change,
+// and returns false to drop the event, a table to send in its place, or
+// nothing to send the fields it was given.
+type eventScript struct {
+	state     *lua.LState
+	transform lua.LValue
+}
+
+// newEventScript loads the --script at path, running anything it does at
+// the top level once
+func newEventScript(path string) (*eventScript, error) {
+	state := lua.NewState()
+	if err := state.DoFile(path); err != nil {
+		state.Close()
+		return nil, err
+	}
+	transform := state.GetGlobal(scriptFunction)
+	if transform.Type() != lua.LTFunction {
+		state.Close()
+		return nil, fmt.Errorf("%s doesn't define a %s(fields) function", path, scriptFunction)
+	}
+	return &eventScript{state: state, transform: transform}, nil
+}
+
+// run calls the script's transform function with ev's fields, setting them
+// to what it returns. keep is false if it dropped ev. If the function fails,
+// ev is left as it was.
+func (s *eventScript) run(ev *event.Event) (keep bool, err error) {
+	fields := toLua(s.state, ev.Data)
+	if err := s.state.CallByParam(lua.P{Fn: s.transform, NRet: 1, Protect: true}, fields); err != nil {
+		return true, err
+	}
+	ret := s.state.Get(-1)
+	s.state.Pop(1)
+	switch typedRet := ret.(type) {
+	case lua.LBool:
+		if !bool(typedRet) {
+			return false, nil
+		}
+	case *lua.LTable:
+		fields = typedRet
+	}
+	data, ok := fromLua(fields).(map[string]interface{})
+	if !ok {
+		// a list of fields has no names to send them under
+		return true, fmt.Errorf("%s returned a list rather than a table of fields", scriptFunction)
+	}
+	ev.Data = data
+	return true, nil
+}
+
+// Close frees the script's Lua state
+func (s *eventScript) Close() {
+	s.state.Close()
+}
+
+// toLua converts an event's value to Lua, with maps as tables and slices as
+// lists
+func toLua(state *lua.LState, v interface{}) lua.LValue {
+	switch typedVal := v.(type) {
+	case nil:
+		return lua.LNil
+	case string:
+		return lua.LString(typedVal)
+	case bool:
+		return lua.LBool(typedVal)
+	case float64:
+		return lua.LNumber(typedVal)
+	case float32:
+		return lua.LNumber(typedVal)
+	case int:
+		return lua.LNumber(typedVal)
+	case int64:
+		return lua.LNumber(typedVal)
+	case uint64:
+		return lua.LNumber(typedVal)
+	case json.Number:
+		if f, err := typedVal.Float64(); err == nil {
+			return lua.LNumber(f)
+		}
+		return lua.LString(typedVal)
+	case map[string]interface{}:
+		table := state.CreateTable(0, len(typedVal))
+		for k, val := range typedVal {
+			table.RawSetString(k, toLua(state, val))
+		}
+		return table
+	case []interface{}:
+		table := state.CreateTable(len(typedVal), 0)
+		for _, val := range typedVal {
+			table.Append(toLua(state, val))
+		}
+		return table
+	default:
+		return lua.LString(fmt.Sprint(typedVal))
+	}
+}
+
+// fromLua converts a Lua value back for an event. Tables with only the keys
+// 1 to n are lists, and the rest are maps. Functions and the like are sent as
+// what Lua's tostring makes of them.
+func fromLua(v lua.LValue) interface{} {
+	switch typedVal := v.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LString:
+		return string(typedVal)
+	case lua.LBool:
+		return bool(typedVal)
+	case lua.LNumber:
+		return float64(typedVal)
+	case *lua.LTable:
+		keys := 0
+		typedVal.ForEach(func(lua.LValue, lua.LValue) { keys++ })
+		if n := typedVal.MaxN(); n > 0 && n == keys {
+			list := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				list = append(list, fromLua(typedVal.RawGetInt(i)))
+			}
+			return list
+		}
+		m := make(map[string]interface{}, keys)
+		typedVal.ForEach(func(k, val lua.LValue) {
+			m[k.String()] = fromLua(val)
+		})
+		return m
+	default:
+		return typedVal.String()
+	}
+}
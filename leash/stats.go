@@ -0,0 +1,233 @@
+package leash
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeycombio/honeytail/output"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/statsd"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+// the errors Run returns once it's read everything it was given, as in a
+// backfill, for what it couldn't do with it
+var (
+	// ErrSendFailures is returned when some events couldn't be sent
+	ErrSendFailures = errors.New("some events weren't sent")
+	// ErrParseErrors is returned when more of the lines than
+	// --fail_on_error_rate allows failed to parse
+	ErrParseErrors = errors.New("more of the lines than --fail_on_error_rate allows failed to parse")
+)
+
+// Result is what happened to the lines a Run read
+type Result struct {
+	// Lines is how many lines were read, and Bytes how many bytes they
+	// had, counting their newlines. They're only counted for
+	// --fail_on_error_rate, --statsd.address, --status_format json,
+	// --telemetry_dataset or --benchmark.
+	Lines int64
+	Bytes int64
+	// ParseErrors is how many lines parsers couldn't make sense of
+	ParseErrors int64
+	// Events is how many events have been through the output, sent or not
+	Events int64
+	// SendFailures is how many events didn't get sent, after retries
+	SendFailures int64
+}
+
+// runStats counts what happened to what a run read. It's shared by the
+// inputs, so it's only changed atomically.
+type runStats struct {
+	// lines is how many lines were read, and bytes how many bytes they
+	// had, counting their newlines, counted when countsLines says
+	lines int64
+	bytes int64
+	// parseErrors counts the lines parsers couldn't make sense of
+	parseErrors *parsers.ErrorCounter
+	// events is how many events have been through the output, sent or not
+	events int64
+	// sendFailures is how many events didn't get sent, after retries
+	sendFailures int64
+	// bufferDropped is how many events --pipeline.when_full drop_oldest
+	// dropped before they got to sending
+	bufferDropped int64
+
+	// metrics is where what's counted is sent as it happens, if anywhere
+	metrics *statsd.Client
+	// health is what's reported on --status_listen, if it's given
+	health *health
+	// responses summarises the results of sending, every --status_interval
+	responses *responseStats
+	// memory holds back reading while memory use is near --max_memory_mb
+	memory *memoryGuard
+}
+
+// countsLines reports whether the lines read need counting, for
+// --fail_on_error_rate, metrics, --status_format json, telemetry or
+// --benchmark
+func (s *runStats) countsLines(options Config) bool {
+	return options.FailOnErrorRate != "" || s.metrics != nil || options.StatusFormat == "json" || options.TelemetryDataset != "" || options.Modes.Benchmark
+}
+
+// heldLines returns how many lines from each stream runInput passes through
+// stages that hold one, between reading it and the parser
+func (s *runStats) heldLines(options Config) int {
+	held := 0
+	if s.countsLines(options) {
+		held++
+	}
+	if s.health != nil {
+		held++
+	}
+	if s.memory != nil && !spills(options.Pipeline) {
+		held++
+	}
+	return held
+}
+
+// countLines passes on lines, counting them
+func (s *runStats) countLines(lines chan string) chan string {
+	counted := make(chan string)
+	go func() {
+		defer close(counted)
+		for line := range lines {
+			atomic.AddInt64(&s.lines, 1)
+			atomic.AddInt64(&s.bytes, int64(len(line)+1))
+			counted <- line
+		}
+	}()
+	return counted
+}
+
+// countResponse counts rsp if its event wasn't sent. Events spooled to disk
+// will be sent, even after a restart; those dropped by --drop_when_full or
+// rejected or failed after retries won't.
+func (s *runStats) countResponse(rsp output.Result) {
+	atomic.AddInt64(&s.events, 1)
+	if rsp.StatusCode != 0 {
+		s.metrics.Count(fmt.Sprintf("events.status_code.%d", rsp.StatusCode), 1)
+	}
+	switch {
+	case rsp.Spooled:
+		s.metrics.Count("events.spooled", 1)
+		s.metrics.Timing("send_duration", rsp.Duration)
+	case rsp.Err == output.ErrQueueFull:
+		s.metrics.Count("events.dropped", 1)
+		atomic.AddInt64(&s.sendFailures, 1)
+	case sendFailed(rsp):
+		s.metrics.Count("events.failed", 1)
+		s.metrics.Timing("send_duration", rsp.Duration)
+		atomic.AddInt64(&s.sendFailures, 1)
+	default:
+		s.metrics.Count("events.sent", 1)
+		s.metrics.Timing("send_duration", rsp.Duration)
+	}
+}
+
+// sendFailed reports whether rsp's event wasn't sent, or spooled to be sent
+// later
+func sendFailed(rsp output.Result) bool {
+	if rsp.Spooled {
+		return false
+	}
+	return rsp.Err != nil || rsp.StatusCode != 0 && (rsp.StatusCode < 200 || rsp.StatusCode >= 300)
+}
+
+// maxLag returns the most any of positions is behind, in bytes and seconds
+func maxLag(positions []tail.Position) (int64, float64) {
+	var lagBytes int64
+	var lagSeconds float64
+	for _, p := range positions {
+		if p.LagBytes > lagBytes {
+			lagBytes = p.LagBytes
+		}
+		if p.LagSeconds > lagSeconds {
+			lagSeconds = p.LagSeconds
+		}
+	}
+	return lagBytes, lagSeconds
+}
+
+// reportMetrics counts the lines read, those that failed to parse and the
+// events dropped from the --pipeline.event_buffer in s.metrics every interval, along with how far behind the most behind of the
+// files being read sending is, until the returned func is called, when
+// they're counted one last time
+func (s *runStats) reportMetrics(interval time.Duration) func() {
+	if s.metrics == nil {
+		return func() {}
+	}
+	var lines, parseErrors, bufferDropped int64
+	report := func() {
+		n := atomic.LoadInt64(&s.lines)
+		s.metrics.Count("lines_read", n-lines)
+		lines = n
+		n = atomic.LoadInt64(&s.bufferDropped)
+		s.metrics.Count("events.buffer_dropped", n-bufferDropped)
+		bufferDropped = n
+		n = s.parseErrors.Count()
+		s.metrics.Count("parse_errors", n-parseErrors)
+		parseErrors = n
+		lagBytes, lagSeconds := maxLag(tail.Positions())
+		s.metrics.Gauge("lag.bytes", float64(lagBytes))
+		s.metrics.Gauge("lag.seconds", lagSeconds)
+	}
+	parseErrors = s.parseErrors.Count()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-done:
+				report()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// parseErrorRate returns the fraction of lines a --fail_on_error_rate, a
+// percentage such as 5% or 0.5, allows to fail to parse
+func parseErrorRate(spec string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(spec, "%")), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("--fail_on_error_rate must be a percentage between 0%% and 100%%, eg 5%%, not %q", spec)
+	}
+	return percent / 100, nil
+}
+
+// result returns what happened to the lines read, and ErrSendFailures or
+// ErrParseErrors if that's not all it should have been
+func (s *runStats) result(options Config) (Result, error) {
+	r := Result{
+		Lines:        s.lines,
+		Bytes:        s.bytes,
+		ParseErrors:  s.parseErrors.Count(),
+		Events:       s.events,
+		SendFailures: s.sendFailures,
+	}
+	if r.SendFailures > 0 {
+		return r, ErrSendFailures
+	}
+	if options.FailOnErrorRate != "" && r.Lines > 0 {
+		// CheckConfig has made sure it parses
+		rate, _ := parseErrorRate(options.FailOnErrorRate)
+		if float64(r.ParseErrors)/float64(r.Lines) > rate {
+			return r, ErrParseErrors
+		}
+	}
+	return r, nil
+}
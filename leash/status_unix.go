@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package leash
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStatusSignal asks for SIGUSR1 to be sent to signals, to dump the
+// stats on demand
+func notifyStatusSignal(signals chan os.Signal) {
+	signal.Notify(signals, syscall.SIGUSR1)
+}
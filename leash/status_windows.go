@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package leash
+
+import "os"
+
+// notifyStatusSignal does nothing, as Windows has no SIGUSR1
+func notifyStatusSignal(signals chan os.Signal) {}
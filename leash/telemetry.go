@@ -0,0 +1,161 @@
+package leash
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/tail"
+	"github.com/honeycombio/libhoney-go"
+)
+
+// telemetry sends an event of honeytail's own stats to --telemetry_dataset
+// every --telemetry_interval, so honeytail can be watched in Honeycomb like
+// everything else. The events are sent with the events API, apart from the
+// events being read, so they're sent whatever --output is.
+type telemetry struct {
+	options Config
+	stats   *runStats
+	client  *http.Client
+
+	// last is when the last event was sent, when there had been lines lines
+	// read, parseErrors parse errors, events events sent and sendFailures
+	// of them not sent
+	last         time.Time
+	lines        int64
+	parseErrors  int64
+	events       int64
+	sendFailures int64
+}
+
+// startTelemetry starts sending events of stats to --telemetry_dataset, if
+// it's given, until the returned func is called, when one last one is sent
+func startTelemetry(options Config, stats *runStats) func() {
+	if options.TelemetryDataset == "" {
+		return func() {}
+	}
+	transport, err := newTransport(options)
+	if err != nil {
+		logrus.WithField("err", err).Warn("Couldn't start sending telemetry")
+		return func() {}
+	}
+	t := &telemetry{
+		options:     options,
+		stats:       stats,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		last:        time.Now(),
+		parseErrors: stats.parseErrors.Count(),
+	}
+	if transport != nil {
+		t.client.Transport = transport
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(options.TelemetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				t.send(now)
+			case <-done:
+				t.send(time.Now())
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// send sends an event of the stats since the last one, logging why if it
+// can't
+func (t *telemetry) send(now time.Time) {
+	if err := t.sendEvent(now, t.event(now)); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"dataset": t.options.TelemetryDataset,
+			"err":     err,
+		}).Warn("Couldn't send telemetry")
+	}
+}
+
+// event returns the fields of the event for the time since the last one
+func (t *telemetry) event(now time.Time) map[string]interface{} {
+	lines := atomic.LoadInt64(&t.stats.lines)
+	parseErrors := t.stats.parseErrors.Count()
+	events := atomic.LoadInt64(&t.stats.events)
+	sendFailures := atomic.LoadInt64(&t.stats.sendFailures)
+	interval := now.Sub(t.last).Seconds()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	lagBytes, lagSeconds := maxLag(tail.Positions())
+	data := map[string]interface{}{
+		"honeytail_version": Version,
+		"parser":            t.options.Reqs.ParserName,
+		"interval_seconds":  interval,
+		"lines":             lines - t.lines,
+		"parse_errors":      parseErrors - t.parseErrors,
+		"events":            events - t.events,
+		"send_failures":     sendFailures - t.sendFailures,
+		"lag_bytes":         lagBytes,
+		"lag_seconds":       lagSeconds,
+		"goroutines":        runtime.NumGoroutine(),
+		"heap_alloc_bytes":  mem.HeapAlloc,
+		"sys_bytes":         mem.Sys,
+		"num_gc":            mem.NumGC,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		data["hostname"] = hostname
+	}
+	if interval > 0 {
+		data["lines_per_second"] = float64(lines-t.lines) / interval
+		data["events_per_second"] = float64(events-t.events) / interval
+	}
+	if lines > t.lines {
+		data["parse_error_rate"] = float64(parseErrors-t.parseErrors) / float64(lines-t.lines)
+	}
+	if events > t.events {
+		data["send_failure_rate"] = float64(sendFailures-t.sendFailures) / float64(events-t.events)
+	}
+	t.last, t.lines, t.parseErrors, t.events, t.sendFailures = now, lines, parseErrors, events, sendFailures
+	return data
+}
+
+// sendEvent sends data to --telemetry_dataset with the events API
+func (t *telemetry) sendEvent(now time.Time, data map[string]interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/1/events/%s", strings.TrimSuffix(t.options.APIHost, "/"), t.options.TelemetryDataset)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Honeycomb-Team", t.options.Reqs.WriteKey)
+	req.Header.Set("X-Honeycomb-Event-Time", now.UTC().Format(time.RFC3339Nano))
+	req.Header.Set("User-Agent", libhoney.UserAgentAddition)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%d %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package leash
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// newTransport returns the transport for requests to the Honeycomb API, going
+// through --proxy, using the --tls_* options and encoding events as msgpack
+// with --msgpack. It returns nil, so the default is used, if none of them are
+// set.
+func newTransport(options Config) (http.RoundTripper, error) {
+	transport, err := newTLSTransport(options)
+	if err != nil || !options.Msgpack {
+		return transport, err
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &msgpackTransport{next: transport, decoder: decoder}, nil
+}
+
+// newTLSTransport returns a transport for --proxy and the --tls_* options, or
+// nil if none of them are set
+func newTLSTransport(options Config) (http.RoundTripper, error) {
+	if options.Proxy == "" && options.TLSCA == "" && options.TLSCert == "" && !options.TLSInsecure {
+		return nil, nil
+	}
+	proxy := http.ProxyFromEnvironment
+	if options.Proxy != "" {
+		proxyURL, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("--proxy %q isn't a URL: %s", options.Proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("--proxy %q must be an http://, https:// or socks5:// URL", options.Proxy)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.TLSInsecure}
+	if options.TLSCA != "" {
+		pem, err := ioutil.ReadFile(options.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in --tls_ca %s", options.TLSCA)
+		}
+	}
+	if options.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(options.TLSCert, options.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	// the same as http.DefaultTransport, apart from the proxy and TLS
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
+
+// msgpackTransport sends JSON request bodies as msgpack instead. If the API
+// turns away a msgpack request that it takes as JSON, the request is sent
+// as JSON, as is everything after it. Bodies libhoney compressed are sent
+// as msgpack uncompressed.
+type msgpackTransport struct {
+	next     http.RoundTripper
+	decoder  *zstd.Decoder
+	fallback int32
+}
+
+func (m *msgpackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&m.fallback) == 1 || req.Body == nil || req.Header.Get("Content-Type") != "application/json" {
+		return m.next.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	plain := body
+	if req.Header.Get("Content-Encoding") == "zstd" {
+		plain, err = m.decoder.DecodeAll(body, nil)
+	}
+	var packed []byte
+	if err == nil {
+		packed, err = jsonToMsgpack(plain)
+	}
+	if err != nil {
+		// leave anything that won't convert as it is
+		return m.next.RoundTrip(withBody(req, body, "application/json"))
+	}
+	packedReq := withBody(req, packed, "application/msgpack")
+	packedReq.Header.Del("Content-Encoding")
+	resp, err := m.next.RoundTrip(packedReq)
+	if err != nil || (resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusUnsupportedMediaType) {
+		return resp, err
+	}
+	// maybe it's the event that's bad, rather than the encoding
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	resp, err = m.next.RoundTrip(withBody(req, body, "application/json"))
+	if err == nil && resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusUnsupportedMediaType {
+		if atomic.CompareAndSwapInt32(&m.fallback, 0, 1) {
+			logrus.WithField("url", req.URL.String()).Warn("The API doesn't take msgpack, falling back to JSON")
+		}
+	}
+	return resp, err
+}
+
+// withBody returns a copy of req sending body as contentType
+func withBody(req *http.Request, body []byte, contentType string) *http.Request {
+	r := *req
+	r.Header = make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		r.Header[name] = values
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return &r
+}
+
+// jsonToMsgpack re-encodes a JSON document as msgpack, keeping whole numbers
+// as integers
+func jsonToMsgpack(body []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(withNumbers(value))
+}
+
+// withNumbers replaces the json.Numbers in value with int64s or float64s
+func withNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = withNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = withNumbers(elem)
+		}
+	}
+	return value
+}
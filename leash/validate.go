@@ -0,0 +1,67 @@
+package leash
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/tail"
+)
+
+// Validate checks what CheckConfig can't without starting up: that the
+// parser and every --parse_field parser initialise, eg that regexes compile
+// and nginx formats are found, that the transform flags parse, and that
+// state files can be read and written, writing what it's checked to out. It
+// returns the first problem found. Each of the --config file's inputs is
+// checked in turn.
+func Validate(options Config, out io.Writer) error {
+	inputs := options.Inputs
+	if len(inputs) == 0 {
+		inputs = []Config{options}
+	}
+	for i, input := range inputs {
+		if len(options.Inputs) > 0 {
+			logrus.WithFields(logrus.Fields{"input": i + 1}).Info("Validating input")
+		}
+		if err := validateInput(input, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateInput makes the parser, transforms and sampler for options and
+// checks their state files, without reading anything
+func validateInput(options Config, out io.Writer) error {
+	if _, _, err := timestampSettings(options); err != nil {
+		return err
+	}
+	// the parser and transforms are only set up to check they can be
+	parser, err := newParser(options, "")
+	if err != nil {
+		return err
+	}
+	closeParser(parser)
+	// host metadata is left out, as its sources are only looked up
+	options.HostMetadata = nil
+	stages, err := newEventStages(options)
+	if err != nil {
+		return err
+	}
+	discardEventStages(stages)
+	if _, err := newSampler(options); err != nil {
+		return fmt.Errorf("unable to use provided --sample_rule: %s", err)
+	}
+	var files []string
+	for _, path := range options.Reqs.LogFiles {
+		if path != "-" && !strings.Contains(path, "://") {
+			files = append(files, path)
+		}
+	}
+	if err := tail.CheckState(options.Tail, files); err != nil {
+		return fmt.Errorf("state files can't be read and written. Check --tail.statefile or --tail.statedir, or the permissions next to the log files: %s", err)
+	}
+	fmt.Fprintf(out, "%s parser reading %s: OK\n", options.Reqs.ParserName, strings.Join(options.Reqs.LogFiles, ", "))
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/honeycombio/honeytail/leash"
+)
+
+// applyLimits confines honeytail to the CPUs, priority and memory the
+// options give it, so it can run alongside a busy database
+func applyLimits(options leash.Config) error {
+	if options.MaxProcs < 0 {
+		return fmt.Errorf("--max_procs can't be negative")
+	}
+	if options.Nice < -20 || options.Nice > 19 {
+		return fmt.Errorf("--nice must be from -20 to 19")
+	}
+	if options.MaxProcs > 0 {
+		runtime.GOMAXPROCS(options.MaxProcs)
+	}
+	if options.Nice != 0 {
+		if err := setNice(options.Nice); err != nil {
+			return fmt.Errorf("can't set --nice: %s", err)
+		}
+	}
+	if options.MaxMemoryMB > 0 {
+		// the garbage collector works harder as memory use nears the
+		// limit, and leash holds back reading past that
+		debug.SetMemoryLimit(int64(options.MaxMemoryMB) << 20)
+	}
+	return nil
+}
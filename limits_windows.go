@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// setNice sets honeytail's priority class to the nearest to a unix nice
+// value: idle from 10, below normal from 1, and above normal below 0
+func setNice(nice int) error {
+	class := uint32(windows.NORMAL_PRIORITY_CLASS)
+	switch {
+	case nice >= 10:
+		class = windows.IDLE_PRIORITY_CLASS
+	case nice > 0:
+		class = windows.BELOW_NORMAL_PRIORITY_CLASS
+	case nice < 0:
+		class = windows.ABOVE_NORMAL_PRIORITY_CLASS
+	}
+	return windows.SetPriorityClass(windows.CurrentProcess(), class)
+}
@@ -1,19 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/honeycombio/honeytail/parsers/htjson"
-	"github.com/honeycombio/honeytail/parsers/mongodb"
-	"github.com/honeycombio/honeytail/parsers/mysql"
-	"github.com/honeycombio/honeytail/parsers/nginx"
-	"github.com/honeycombio/honeytail/tail"
+	"github.com/honeycombio/honeytail/leash"
 	"github.com/honeycombio/libhoney-go"
 	flag "github.com/jessevdk/go-flags"
 )
@@ -24,63 +21,38 @@ var BuildID string
 // internal version identifier
 var version string
 
-var validParsers = []string{
-	"nginx",
-	"mongo",
-	"json",
-	"mysql",
-}
-
-// GlobalOptions has all the top level CLI flags that honeytail supports
-type GlobalOptions struct {
-	APIHost string `hidden:"true" long:"api_host" description:"Host for the Honeycomb API" default:"https://api.honeycomb.io/"`
-
-	SampleRate     uint `short:"r" long:"samplerate" description:"Only send 1 / N log lines" default:"1"`
-	NumSenders     uint `short:"P" long:"poolsize" description:"Number of concurrent connections to open to Honeycomb" default:"10"`
-	Debug          bool `long:"debug" description:"Print debugging output"`
-	StatusInterval uint `long:"status_interval" description:"how frequently, in seconds, to print out summary info" default:"60"`
-
-	ScrubFields []string `long:"scrub_field" description:"for the field listed, apply a one-way hash to the field content. May be specified multiple times"`
-	DropFields  []string `long:"drop_field" description:"do not send the field to Honeycomb. May be specified multiple times"`
-	AddFields   []string `long:"add_field" description:"add the field to every event. Field should be key=val. May be specified multiple times"`
-
-	Reqs  RequiredOptions `group:"Required Options"`
-	Modes OtherModes      `group:"Other Modes"`
-
-	Tail tail.TailOptions `group:"Tail Options" namespace:"tail"`
-
-	Nginx nginx.Options   `group:"Nginx Parser Options" namespace:"nginx"`
-	JSON  htjson.Options  `group:"JSON Parser Options" namespace:"json"`
-	MySQL mysql.Options   `group:"MySQL Parser Options" namespace:"mysql"`
-	Mongo mongodb.Options `group:"MongoDB Parser Options" namespace:"mongo"`
-}
-
-type RequiredOptions struct {
-	ParserName string   `short:"p" long:"parser" description:"Parser module to use. Use --list to list available options."`
-	WriteKey   string   `short:"k" long:"writekey" description:"Team write key"`
-	LogFiles   []string `short:"f" long:"file" description:"Log file(s) to parse. Use '-' for STDIN, use this flag multiple times to tail multiple files, or use a glob (/path/to/foo-*.log)"`
-	Dataset    string   `short:"d" long:"dataset" description:"Name of the dataset"`
-}
-
-type OtherModes struct {
-	Help        bool `short:"h" long:"help" description:"Show this help message"`
-	ListParsers bool `short:"l" long:"list" description:"List available parsers"`
-	Version     bool `short:"V" long:"version" description:"Show version"`
-
-	WriteManPage bool `hidden:"true" long:"write-man-page" description:"Write out a man page"`
-}
-
 func main() {
-	var options GlobalOptions
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := runInit(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			if flagErr, ok := err.(*flag.Error); ok {
+				// go-flags has already printed it, or the help asked for
+				if flagErr.Type == flag.ErrHelp {
+					os.Exit(0)
+				}
+				os.Exit(1)
+			}
+			logrus.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	var options leash.Config
 	flagParser := flag.NewParser(&options, flag.PrintErrors)
-	flagParser.Usage = "-p <parser> -k <writekey> -f </path/to/logfile> -d <mydata>"
-	if extraArgs, err := flagParser.Parse(); err != nil || len(extraArgs) != 0 {
-		fmt.Println("Error: failed to parse the command line.")
-		if err != nil {
-			fmt.Printf("\t%s\n", err)
-		} else {
-			fmt.Printf("\tUnexpected extra arguments: %s\n", strings.Join(extraArgs, " "))
+	flagParser.Usage = "[tail | backfill | validate] -p <parser> -k <writekey> -f </path/to/logfile> -d <mydata>\n" +
+		"  honeytail init [--config <path>] [--unit <path>] </path/to/logfile>\n" +
+		"  honeytail parsers list\n" +
+		"  honeytail parsers describe <parser>\n" +
+		"  honeytail version"
+	args, err := subcommandArgs(os.Args[1:])
+	if err == nil {
+		var extraArgs []string
+		if extraArgs, err = parseArgs(flagParser, &options, args); err == nil && len(extraArgs) != 0 {
+			err = fmt.Errorf("unexpected extra arguments: %s", strings.Join(extraArgs, " "))
 		}
+	}
+	if err != nil {
+		fmt.Println("Error: failed to parse the command line.")
+		fmt.Printf("\t%s\n", err)
 		os.Exit(1)
 	}
 	rand.Seed(time.Now().UnixNano())
@@ -90,10 +62,61 @@ func main() {
 	}
 
 	setVersion()
+	// plugins' parsers are listed and described with honeytail's own
+	for _, path := range options.Plugins {
+		if err := leash.LoadPlugin(path); err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Fatal("Couldn't load --plugin")
+		}
+	}
 	handleOtherModes(flagParser, options)
-	sanityCheckOptions(options)
+	if options.Modes.SampleLines > 0 {
+		// nothing's sent, so there's no need for a write key or dataset
+		if err := leash.Preview(options, os.Stdout); err != nil {
+			logrus.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	if err := applyLimits(options); err != nil {
+		logrus.Fatal(err)
+	}
+	if options.Modes.Benchmark {
+		// nor is anything sent here
+		if err := benchmark(options, os.Stdout); err != nil {
+			logrus.Fatal(err)
+		}
+		os.Exit(0)
+	}
+	writeKey, err := readWriteKey(options)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Fatal("Couldn't read the write key")
+	}
+	if writeKey != options.Reqs.WriteKey {
+		// read from somewhere shared by every input
+		options.Reqs.WriteKey = writeKey
+		for i := range options.Inputs {
+			options.Inputs[i].Reqs.WriteKey = writeKey
+		}
+	}
+	if err := leash.CheckConfig(options); err != nil {
+		logrus.Fatal(err)
+	}
+	if err := leash.Preflight(options); err != nil {
+		logrus.Fatal(err)
+	}
+	if options.Modes.Validate {
+		if err := leash.Validate(options, os.Stdout); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Println("Configuration is valid")
+		os.Exit(0)
+	}
 
-	run(options)
+	// on SIGTERM or SIGINT, stop reading and send what's already been read
+	ctx, shutdown := context.WithCancel(context.Background())
+	stopHandlingSignals := handleSignals(shutdown, options.ShutdownTimeout)
+	result, err := leash.Run(ctx, options)
+	stopHandlingSignals()
+	os.Exit(exitCode(options, result, err))
 }
 
 // setVersion sets the internal version ID and updates libhoney's user-agent
@@ -103,12 +126,13 @@ func setVersion() {
 	} else {
 		version = BuildID
 	}
+	leash.Version = version
 	libhoney.UserAgentAddition = fmt.Sprintf("honeytail/%s", version)
 }
 
 // handleOtherModes takse care of all flags that say we should just do something
 // and exit rather than actually parsing logs
-func handleOtherModes(fp *flag.Parser, options GlobalOptions) {
+func handleOtherModes(fp *flag.Parser, options leash.Config) {
 	if options.Modes.Version {
 		fmt.Println("Honeytail version", version)
 		os.Exit(0)
@@ -124,33 +148,52 @@ func handleOtherModes(fp *flag.Parser, options GlobalOptions) {
 	}
 
 	if options.Modes.ListParsers {
-		fmt.Println("Available parsers:", strings.Join(validParsers, ", "))
+		fmt.Println("Available parsers:", strings.Join(leash.Parsers, ", "))
 		os.Exit(0)
 	}
+	if options.Modes.DescribeParser != "" {
+		if err := describeParser(fp, options.Modes.DescribeParser, os.Stdout); err != nil {
+			logrus.Fatal(err)
+		}
+		os.Exit(0)
+	}
+}
+
+// subcommands are the modes honeytail can be run in, with the flags that
+// chose them before there were subcommands. Those flags still work on their
+// own, without a subcommand.
+var subcommands = map[string][]string{
+	"tail":      nil,
+	"backfill":  {"--tail.read_from=beginning", "--tail.stop"},
+	"validate":  {"--validate"},
+	"benchmark": {"--benchmark"},
+	"version":   {"--version"},
+	"help":      {"--help"},
 }
 
-func sanityCheckOptions(options GlobalOptions) {
-	switch {
-	case options.Reqs.ParserName == "":
-		logrus.Fatal("parser required")
-	case options.Reqs.WriteKey == "" || options.Reqs.WriteKey == "NULL":
-		logrus.Fatal("write key required")
-	case len(options.Reqs.LogFiles) == 0:
-		logrus.Fatal("log file name or '-' required")
-	case options.Reqs.Dataset == "":
-		logrus.Fatal("dataset name required")
-	case options.Tail.ReadFrom == "end" && options.Tail.Stop:
-		logrus.Fatal("Reading from the end and stopping when we get there. Zero lines to process. Ok, all done! ;)")
-	case len(options.Reqs.LogFiles) > 1 && options.Tail.StateFile != "":
-		logrus.Fatal("Statefile can not be set when tailing from multiple files")
-	case options.Tail.StateFile != "":
-		files, err := filepath.Glob(options.Reqs.LogFiles[0])
-		if err != nil {
-			logrus.Fatalf("Trying to glob log file %s failed: %+v\n",
-				options.Reqs.LogFiles[0], err)
+// subcommandArgs returns args with the subcommand they start with, if they
+// start with one, replaced by the flags it stands for. Flags given after it
+// take precedence over them.
+func subcommandArgs(args []string) ([]string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return args, nil
+	}
+	command, rest := args[0], args[1:]
+	if command == "parsers" {
+		if len(rest) > 0 && rest[0] == "describe" {
+			if len(rest) < 2 || strings.HasPrefix(rest[1], "-") {
+				return nil, errors.New("parsers describe needs the name of a parser, eg honeytail parsers describe nginx")
+			}
+			return append([]string{"--describe_parser=" + rest[1]}, rest[2:]...), nil
 		}
-		if len(files) > 1 {
-			logrus.Fatal("Statefile can not be set when tailing from multiple files")
+		if len(rest) > 0 && rest[0] == "list" {
+			rest = rest[1:]
 		}
+		return append([]string{"--list"}, rest...), nil
+	}
+	flags, ok := subcommands[command]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q: use tail, backfill, validate, benchmark, init, parsers list, parsers describe or version", command)
 	}
+	return append(append([]string{}, flags...), rest...), nil
 }
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/leash"
+	"github.com/honeycombio/honeytail/tail"
+	"github.com/honeycombio/libhoney-go/transmission"
+	flag "github.com/jessevdk/go-flags"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestSetVersion(t *testing.T) {
+	server, _ := testServer(t)
+	defer server.Close()
+	userAgent := func() string {
+		var agent string
+		server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			agent = r.Header.Get("User-Agent")
+			batchEvents(w, r)
+		})
+		testRun(t, server.URL)
+		return agent
+	}
+	libhoneyAgent := "libhoney-go/" + transmission.Version
+	testEquals(t, userAgent(), libhoneyAgent)
+	setVersion()
+	testEquals(t, userAgent(), libhoneyAgent+" honeytail/dev")
+	testEquals(t, leash.Version, "dev")
+	BuildID = "test"
+	setVersion()
+	testEquals(t, userAgent(), libhoneyAgent+" honeytail/test")
+	testEquals(t, leash.Version, "test")
+}
+
+func TestSubcommandArgs(t *testing.T) {
+	testCases := []struct {
+		args     []string
+		expected []string
+		err      bool
+	}{
+		{args: nil, expected: nil},
+		{args: []string{"-p", "json", "-f", "a.log"}, expected: []string{"-p", "json", "-f", "a.log"}},
+		{args: []string{"tail", "-p", "json"}, expected: []string{"-p", "json"}},
+		{args: []string{"backfill", "-p", "json"}, expected: []string{"--tail.read_from=beginning", "--tail.stop", "-p", "json"}},
+		{args: []string{"validate", "-c", "a.conf"}, expected: []string{"--validate", "-c", "a.conf"}},
+		{args: []string{"benchmark", "-p", "json"}, expected: []string{"--benchmark", "-p", "json"}},
+		{args: []string{"parsers", "list"}, expected: []string{"--list"}},
+		{args: []string{"parsers"}, expected: []string{"--list"}},
+		{args: []string{"parsers", "describe", "nginx"}, expected: []string{"--describe_parser=nginx"}},
+		{args: []string{"parsers", "describe"}, err: true},
+		{args: []string{"version"}, expected: []string{"--version"}},
+		{args: []string{"a.log"}, err: true},
+	}
+	for _, tc := range testCases {
+		args, err := subcommandArgs(tc.args)
+		if (err != nil) != tc.err {
+			t.Errorf("unexpected error %v for %v", err, tc.args)
+			continue
+		}
+		if !tc.err && !reflect.DeepEqual(args, tc.expected) {
+			t.Errorf("expected %v for %v, got %v", tc.expected, tc.args, args)
+		}
+	}
+
+	// a backfill reads the files from the start and stops at their end
+	var options leash.Config
+	args, _ := subcommandArgs([]string{"backfill", "-p", "json", "-f", "a.log"})
+	if _, err := parseArgs(flag.NewParser(&options, flag.None), &options, args); err != nil {
+		t.Fatal(err)
+	}
+	testEquals(t, options.Tail.ReadFrom, "beginning")
+	testEquals(t, options.Tail.Stop, true)
+}
+
+func TestDescribeParsers(t *testing.T) {
+	var defaults leash.Config
+	fp := flag.NewParser(&defaults, flag.None)
+	if _, err := fp.ParseArgs(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range leash.Parsers {
+		var out bytes.Buffer
+		if err := describeParser(fp, name, &out); err != nil {
+			t.Errorf("expected the %s parser to describe itself, got %s", name, err)
+			continue
+		}
+		if !strings.HasPrefix(out.String(), name+": ") || !strings.Contains(out.String(), "\nTimestamps:\n") {
+			t.Errorf("expected a summary and timestamps for the %s parser, got:\n%s", name, out.String())
+		}
+	}
+	var out bytes.Buffer
+	describeParser(fp, "nginx", &out)
+	if !strings.Contains(out.String(), "\nOptions:\n  --nginx.conf ") {
+		t.Errorf("expected the nginx parser's options, got:\n%s", out.String())
+	}
+	if err := describeParser(fp, "nope", &out); err == nil {
+		t.Error("expected an error describing a parser that doesn't exist")
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "honeytail-config")
+	defer os.RemoveAll(tmpdir)
+	configFile := tmpdir + "/honeytail.conf"
+	ioutil.WriteFile(configFile, []byte(`
+parser: nginx
+writekey: from-config
+dataset: nginx-access
+file:
+  - /var/log/nginx/access.log
+samplerate: 10
+drop_field: [cookie, authorization]
+debug: true
+backfill_markers: false
+nginx:
+  conf: /etc/nginx/nginx.conf
+  format: main
+tail.read_from: end
+`), 0644)
+	var options leash.Config
+	fp := flag.NewParser(&options, flag.None)
+	extra, err := parseArgs(fp, &options, []string{"--config", configFile, "-k", "from-flag", "--drop_field", "x-api-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEquals(t, len(extra), 0)
+	testEquals(t, options.Reqs.ParserName, "nginx")
+	testEquals(t, options.Reqs.LogFiles, []string{"/var/log/nginx/access.log"})
+	testEquals(t, options.SampleRate, uint(10))
+	testEquals(t, options.Debug, true)
+	testEquals(t, options.Nginx.LogFormatName, "main")
+	testEquals(t, options.Tail.ReadFrom, "end")
+	// the command line wins, even over a list
+	testEquals(t, options.Reqs.WriteKey, "from-flag")
+	testEquals(t, options.DropFields, []string{"x-api-key"})
+	// defaults are still filled in
+	testEquals(t, options.BatchSize, uint(50))
+
+	ioutil.WriteFile(configFile, []byte("no_such_flag: 1\n"), 0644)
+	options = leash.Config{}
+	if _, err := parseArgs(flag.NewParser(&options, flag.None), &options, []string{"-c", configFile}); err == nil {
+		t.Error("expected an error for an unknown flag in the config file")
+	}
+}
+
+func TestConfigInputs(t *testing.T) {
+	var lock sync.Mutex
+	var sent []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, data := range batchEvents(w, r) {
+			sent = append(sent, r.URL.Path+" "+data)
+		}
+	}))
+	defer server.Close()
+	logrus.SetOutput(ioutil.Discard)
+	tmpdir, _ := ioutil.TempDir("", "honeytail-inputs")
+	defer os.RemoveAll(tmpdir)
+	ioutil.WriteFile(tmpdir+"/access.log", []byte(`{"path":"/orders","cookie":"c"}`+"\n"), 0644)
+	ioutil.WriteFile(tmpdir+"/app.log", []byte(`{"msg":"started","cookie":"c"}`+"\n"), 0644)
+	configFile := tmpdir + "/honeytail.conf"
+	ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`
+api_host: %s
+writekey: abcabc123123
+parser: json
+tail:
+  read_from: beginning
+  stop: true
+drop_field: cookie
+inputs:
+  - file: %s/access.log
+    dataset: access
+  - file: %s/app.log
+    dataset: app
+    add_field: service=app
+    drop_field: msg
+`, server.URL, tmpdir, tmpdir)), 0644)
+	var options leash.Config
+	if _, err := parseArgs(flag.NewParser(&options, flag.None), &options, []string{"-c", configFile}); err != nil {
+		t.Fatal(err)
+	}
+	testEquals(t, len(options.Inputs), 2)
+	testEquals(t, options.Inputs[0].Reqs.ParserName, "json")
+	testEquals(t, leash.CheckConfig(options), nil)
+	leash.Run(context.Background(), options)
+	sort.Strings(sent)
+	testEquals(t, sent, []string{
+		`/1/batch/access {"path":"/orders"}`,
+		`/1/batch/app {"cookie":"c","service":"app"}`,
+	})
+
+	options.Inputs[1].Reqs.WriteKey = "another"
+	if err := leash.CheckConfig(options); err == nil || !strings.Contains(err.Error(), "--writekey is shared by every input") {
+		t.Errorf("expected the inputs to need the same write key, got %v", err)
+	}
+}
+
+func TestReadWriteKey(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "honeytail-writekey")
+	defer os.RemoveAll(tmpdir)
+	ioutil.WriteFile(tmpdir+"/writekey", []byte("from-file\n"), 0600)
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/honeytail" || r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(403)
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"writekey":"from-vault","other":"x"},"metadata":{"version":3}}}`))
+	}))
+	defer vault.Close()
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	testCases := []struct {
+		options  leash.Config
+		expected string
+	}{
+		{leash.Config{Reqs: leash.RequiredOptions{WriteKey: "from-flag"}}, "from-flag"},
+		{leash.Config{WriteKeyFile: tmpdir + "/writekey"}, "from-file"},
+		{leash.Config{WriteKeyCommand: "echo from-command"}, "from-command"},
+		{leash.Config{WriteKeySecret: "vault://secret/data/honeytail"}, "from-vault"},
+		{leash.Config{WriteKeySecret: "vault://secret/data/honeytail#other"}, "x"},
+	}
+	for _, tc := range testCases {
+		key, err := readWriteKey(tc.options)
+		if err != nil {
+			t.Errorf("unexpected error %s", err)
+		}
+		testEquals(t, key, tc.expected)
+	}
+	for i, options := range []leash.Config{
+		{Reqs: leash.RequiredOptions{WriteKey: "from-flag"}, WriteKeyFile: tmpdir + "/writekey"},
+		{WriteKeyFile: tmpdir + "/missing"},
+		{WriteKeyCommand: "exit 1"},
+		{WriteKeySecret: "vault://secret/data/other"},
+		{WriteKeySecret: "vault://secret/data/honeytail#missing"},
+		{WriteKeySecret: "keychain://honeytail"},
+	} {
+		if _, err := readWriteKey(options); err == nil {
+			t.Errorf("expected an error reading the write key in case %d", i)
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "init")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	logFileName := tmpdir + "/app.log"
+	ioutil.WriteFile(logFileName, []byte(`{"ts":"2017-01-02T03:04:05Z","duration_ms":12}`+"\n"+
+		`{"ts":"2017-01-02T03:04:06Z","duration_ms":34}`+"\n"), 0644)
+	configFile := tmpdir + "/etc/honeytail.conf"
+	unitFile := tmpdir + "/systemd/honeytail.service"
+	args := []string{"--config", configFile, "--unit", unitFile, logFileName}
+
+	// the write key is asked again until it's given, and the rest take the
+	// suggestions
+	var out bytes.Buffer
+	if err := runInit(args, strings.NewReader("\nabc123\n\n\n\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "look like the json parser's") {
+		t.Errorf("expected the json parser to be suggested, got:\n%s", out.String())
+	}
+	configArgs, _, err := readConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEquals(t, configArgs, []string{
+		"--writekey=abc123", "--dataset=app", "--parser=json", "--file=" + logFileName, "--json.timefield=ts",
+	})
+	if info, _ := os.Stat(configFile); info == nil || info.Mode().Perm() != 0600 {
+		t.Error("expected the config file to only be readable by its owner")
+	}
+	unit, _ := ioutil.ReadFile(unitFile)
+	if !strings.Contains(string(unit), " --config "+configFile+"\n") {
+		t.Errorf("expected the unit to run honeytail with the config file, got:\n%s", unit)
+	}
+
+	// existing files are only replaced if that's alright
+	err = runInit(args, strings.NewReader("abc123\nother\n\n\nn\n"), &out)
+	if err == nil || !strings.Contains(err.Error(), "not replacing") {
+		t.Errorf("expected the config file not to be replaced, got %v", err)
+	}
+	if err := runInit(args, strings.NewReader("abc123\nother\n\n\ny\ny\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	configArgs, _, _ = readConfigFile(configFile)
+	testEquals(t, configArgs[1], "--dataset=other")
+}
+
+func TestExitCode(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	options := leash.Config{FailOnErrorRate: "5%"}
+	testEquals(t, exitCode(options, leash.Result{Lines: 10}, nil), exitCompleted)
+	testEquals(t, exitCode(options, leash.Result{Lines: 10, ParseErrors: 1}, leash.ErrParseErrors), exitParseErrors)
+	testEquals(t, exitCode(options, leash.Result{Lines: 10, SendFailures: 1}, leash.ErrSendFailures), exitSendFailures)
+}
+
+func TestBenchmark(t *testing.T) {
+	server, requests := testServer(t)
+	defer server.Close()
+	tmpdir, _ := ioutil.TempDir("", "benchmark")
+	defer os.RemoveAll(tmpdir)
+	opts := testOptions(server.URL)
+	logFileName := tmpdir + "/file.log"
+	contents := `{"format":"json"}` + "\n" + "not json\n" + `{"format":"json"}` + "\n" + `{"format":"json"}` + "\n"
+	ioutil.WriteFile(logFileName, []byte(contents), 0644)
+	opts.Reqs.LogFiles = []string{logFileName}
+	opts.Tail.ReadFrom = "last"
+	opts.Tail.Stop = false
+	var out bytes.Buffer
+	if err := benchmark(opts, &out); err != nil {
+		t.Fatal(err)
+	}
+	// nothing's sent, nor is any state saved
+	testEquals(t, atomic.LoadInt32(requests), int32(0))
+	if _, err := os.Stat(logFileName + ".leash.state"); !os.IsNotExist(err) {
+		t.Errorf("expected no state file, got %v", err)
+	}
+	for _, expected := range []string{
+		"lines:                 4\n",
+		fmt.Sprintf("MB:                    %.1f\n", float64(len(contents))/(1024*1024)),
+		"events:                3\n",
+		"parse errors:          1 (25.00%)\n",
+		"lines/sec:",
+		"MB/sec:",
+		"CPU sec/million lines:",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in the benchmark's output, got %s", expected, out.String())
+		}
+	}
+}
+
+func TestHandleSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("can't interrupt ourselves on windows")
+	}
+	logrus.SetOutput(ioutil.Discard)
+	ctx, shutdown := context.WithCancel(context.Background())
+	stop := handleSignals(shutdown, 5)
+	defer stop()
+	self, _ := os.FindProcess(os.Getpid())
+	self.Signal(os.Interrupt)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the interrupt to shut down")
+	}
+}
+
+// testServer starts a server standing in for the Honeycomb API, counting
+// the requests it gets
+func testServer(t *testing.T) (*httptest.Server, *int32) {
+	logrus.SetOutput(ioutil.Discard)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		batchEvents(w, r)
+	}))
+	return server, &requests
+}
+
+// batchEvents returns the data of each event in a batch libhoney sent, and
+// answers that they were all accepted
+func batchEvents(w http.ResponseWriter, r *http.Request) []string {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("Content-Encoding") == "zstd" {
+		decoder, _ := zstd.NewReader(nil)
+		body, _ = decoder.DecodeAll(body, nil)
+		decoder.Close()
+	}
+	var batch []struct {
+		Data json.RawMessage `json:"data"`
+	}
+	json.Unmarshal(body, &batch)
+	events := make([]string, len(batch))
+	statuses := make([]string, len(batch))
+	for i, ev := range batch {
+		events[i] = string(ev.Data)
+		statuses[i] = `{"status":202}`
+	}
+	fmt.Fprintf(w, "[%s]", strings.Join(statuses, ","))
+	return events
+}
+
+// testOptions returns options reading a json log once from the start, and
+// sending it to apiHost
+func testOptions(apiHost string) leash.Config {
+	return leash.Config{
+		APIHost:        apiHost,
+		SampleRate:     1,
+		NumSenders:     1,
+		Reqs:           leash.RequiredOptions{ParserName: "json", WriteKey: "abcabc123123", Dataset: "pika"},
+		Tail:           tail.TailOptions{ReadFrom: "start", Stop: true},
+		StatusInterval: 1,
+	}
+}
+
+// testRun sends a line of json to apiHost
+func testRun(t *testing.T, apiHost string) {
+	tmpdir, _ := ioutil.TempDir("", "honeytail")
+	defer os.RemoveAll(tmpdir)
+	ioutil.WriteFile(tmpdir+"/setv.log", []byte(`{"format":"json"}`), 0644)
+	opts := testOptions(apiHost)
+	opts.Reqs.LogFiles = []string{tmpdir + "/setv.log"}
+	if _, err := leash.Run(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// helper function
+func testEquals(t testing.TB, actual, expected interface{}, msg ...string) {
+	if !reflect.DeepEqual(actual, expected) {
+		message := strings.Join(msg, ", ")
+		_, file, line, _ := runtime.Caller(1)
+
+		t.Errorf(
+			"%s:%d: %s -- actual(%T): %v, expected(%T): %v",
+			filepath.Base(file),
+			line,
+			message,
+			actual,
+			actual,
+			expected,
+			expected,
+		)
+	}
+}
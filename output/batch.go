@@ -0,0 +1,47 @@
+package output
+
+import (
+	"time"
+)
+
+// flushInterval is the longest an event waits for its batch to fill before
+// being sent
+const flushInterval = time.Second
+
+// pending is an event waiting to be sent in a batch
+type pending struct {
+	// value is the event as the output sends it
+	value    interface{}
+	metadata interface{}
+}
+
+// batchEvents reads events from queue and calls send with batches of up to
+// size of them, sending a smaller batch if flushInterval passes first. It
+// returns once queue has been closed and the last batch sent. send may keep
+// the batch it's given.
+func batchEvents(queue chan pending, size int, send func([]pending)) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []pending
+	flush := func() {
+		if len(batch) > 0 {
+			send(batch)
+			batch = nil
+		}
+	}
+	for {
+		select {
+		case p, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, p)
+			if len(batch) >= size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package output
+
+import (
+	"sync"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// Fanout sends every event to each of several outputs. An event's result
+// comes once every output has sent it, and is the worst of theirs: an error
+// if any output failed, otherwise the response with the highest status
+// code.
+type Fanout struct {
+	outputs []Output
+	results chan Result
+
+	lock    sync.Mutex
+	nextID  uint64
+	waiting map[uint64]*fanoutEvent
+}
+
+// fanoutEvent is an event still being sent by some of the outputs
+type fanoutEvent struct {
+	metadata  interface{}
+	remaining int
+	result    Result
+}
+
+// NewFanout returns an output sending to each of outputs
+func NewFanout(outputs []Output) *Fanout {
+	f := &Fanout{
+		outputs: outputs,
+		results: make(chan Result),
+		waiting: make(map[uint64]*fanoutEvent),
+	}
+	var wg sync.WaitGroup
+	for _, out := range outputs {
+		wg.Add(1)
+		go func(out Output) {
+			defer wg.Done()
+			for result := range out.Results() {
+				f.collect(result)
+			}
+		}(out)
+	}
+	go func() {
+		wg.Wait()
+		close(f.results)
+	}()
+	return f
+}
+
+// Add gives ev to each output
+func (f *Fanout) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	f.lock.Lock()
+	f.nextID++
+	id := f.nextID
+	f.waiting[id] = &fanoutEvent{metadata: metadata, remaining: len(f.outputs)}
+	f.lock.Unlock()
+	for _, out := range f.outputs {
+		if err := out.Add(ev, sampleRate, id); err != nil {
+			// this output won't have a result for the event
+			f.collect(Result{Metadata: id, Err: err})
+		}
+	}
+	return nil
+}
+
+// collect records one output's result for an event, passing the event's
+// result on once every output has had its say
+func (f *Fanout) collect(result Result) {
+	id, _ := result.Metadata.(uint64)
+	f.lock.Lock()
+	ev, ok := f.waiting[id]
+	if !ok {
+		f.lock.Unlock()
+		return
+	}
+	if ev.remaining == len(f.outputs) || worse(result, ev.result) {
+		duration := ev.result.Duration
+		ev.result = result
+		if duration > result.Duration {
+			ev.result.Duration = duration
+		}
+	} else if result.Duration > ev.result.Duration {
+		ev.result.Duration = result.Duration
+	}
+	ev.remaining--
+	done := ev.remaining == 0
+	if done {
+		delete(f.waiting, id)
+	}
+	f.lock.Unlock()
+	if done {
+		ev.result.Metadata = ev.metadata
+		f.results <- ev.result
+	}
+}
+
+// worse is true if a is a worse outcome than b
+func worse(a, b Result) bool {
+	if (a.Err != nil) != (b.Err != nil) {
+		return a.Err != nil
+	}
+	return a.StatusCode > b.StatusCode
+}
+
+// Results returns the channel the combined outcome of sending each event
+// comes down
+func (f *Fanout) Results() chan Result {
+	return f.results
+}
+
+// Close closes each of the outputs
+func (f *Fanout) Close() {
+	for _, out := range f.outputs {
+		out.Close()
+	}
+}
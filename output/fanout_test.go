@@ -0,0 +1,80 @@
+package output
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// fakeOutput answers every event with result, once it's released
+type fakeOutput struct {
+	result  Result
+	release chan struct{}
+	results chan Result
+}
+
+func newFakeOutput(result Result) *fakeOutput {
+	return &fakeOutput{result: result, release: make(chan struct{}), results: make(chan Result, 10)}
+}
+
+func (f *fakeOutput) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	r := f.result
+	r.Metadata = metadata
+	go func() {
+		<-f.release
+		f.results <- r
+	}()
+	return nil
+}
+
+func (f *fakeOutput) Results() chan Result { return f.results }
+
+func (f *fakeOutput) Close() {
+	// give the result time to come in before closing
+	time.Sleep(10 * time.Millisecond)
+	close(f.results)
+}
+
+func TestFanout(t *testing.T) {
+	ok := newFakeOutput(Result{StatusCode: 200, Duration: time.Second})
+	failed := newFakeOutput(Result{Err: errors.New("nope"), Duration: time.Millisecond})
+	f := NewFanout([]Output{ok, failed})
+	f.Add(event.Event{Data: map[string]interface{}{"a": 1}}, 1, "md")
+
+	// nothing comes back until every output has sent the event
+	close(ok.release)
+	select {
+	case result := <-f.Results():
+		t.Fatalf("unexpected result %+v before every output answered", result)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(failed.release)
+	select {
+	case result := <-f.Results():
+		// the failure wins, taking as long as the slowest output
+		if result.Metadata != "md" || result.Err == nil || result.Duration != time.Second {
+			t.Errorf("unexpected result %+v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the result")
+	}
+	f.Close()
+	if _, ok := <-f.Results(); ok {
+		t.Error("expected results to be closed")
+	}
+}
+
+func TestFanoutWorstStatus(t *testing.T) {
+	ok := newFakeOutput(Result{StatusCode: 200})
+	throttled := newFakeOutput(Result{StatusCode: 429})
+	close(ok.release)
+	close(throttled.release)
+	f := NewFanout([]Output{throttled, ok})
+	f.Add(event.Event{}, 1, nil)
+	if result := <-f.Results(); result.StatusCode != 429 {
+		t.Errorf("expected the 429 to win, got %+v", result)
+	}
+	f.Close()
+}
@@ -0,0 +1,171 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+const fileScheme = "file://"
+
+// fileFlushInterval is how often events written to a file output are flushed
+// and reported as sent
+const fileFlushInterval = time.Second
+
+// IsFileURL returns true if url names a file to write events to
+func IsFileURL(url string) bool {
+	return strings.HasPrefix(url, fileScheme)
+}
+
+// File writes events to a file as newline delimited JSON, rotating it once
+// it gets too big. Events count as sent once they've been flushed to the
+// file, which happens every second and on Close.
+type File struct {
+	path    string
+	dataset string
+	maxSize int64
+	keep    int
+	results chan Result
+	stop    chan struct{}
+	stopped chan struct{}
+
+	lock sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+	// written holds the metadata of the events written since the last flush
+	written []interface{}
+}
+
+// NewFile opens the file named by url, a file:// URL, for appending events.
+// Events are written with dataset as theirs.
+func NewFile(url string, dataset string, options Options) (*File, error) {
+	path := strings.TrimPrefix(url, fileScheme)
+	if path == "" {
+		return nil, fmt.Errorf("no file given in --output %s", url)
+	}
+	f := &File{
+		path:    path,
+		dataset: dataset,
+		maxSize: int64(options.FileMaxMB) * 1024 * 1024,
+		keep:    options.FileKeep,
+		results: make(chan Result),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	go f.flushPeriodically()
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.buf = bufio.NewWriter(file)
+	f.size = info.Size()
+	return nil
+}
+
+// Add writes ev on a line of its own
+func (f *File) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	line, err := marshalRecord(ev, f.dataset, sampleRate)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.buf.Write(line)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	f.written = append(f.written, metadata)
+	return nil
+}
+
+// rotate moves the full file out of the way and starts a new one
+func (f *File) rotate() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	f.file.Close()
+	if f.keep < 1 {
+		os.Remove(f.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", f.path, f.keep))
+		for i := f.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			// carry on with the file we have
+			f.open()
+			return err
+		}
+	}
+	return f.open()
+}
+
+// flush writes out the events written so far and reports how that went.
+// f.lock must be held.
+func (f *File) flush() error {
+	start := time.Now()
+	err := f.buf.Flush()
+	for _, metadata := range f.written {
+		f.results <- Result{Metadata: metadata, Duration: time.Since(start), Err: err}
+	}
+	f.written = nil
+	return err
+}
+
+func (f *File) flushPeriodically() {
+	defer close(f.stopped)
+	ticker := time.NewTicker(fileFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.lock.Lock()
+			f.flush()
+			f.lock.Unlock()
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// Results returns the channel the outcome of writing each event comes down
+func (f *File) Results() chan Result {
+	return f.results
+}
+
+// Close flushes and closes the file
+func (f *File) Close() {
+	close(f.stop)
+	<-f.stopped
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.flush()
+	f.file.Close()
+	close(f.results)
+}
@@ -0,0 +1,99 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	f, err := NewFile("file://"+path, "mydata", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC)
+	if err := f.Add(event.Event{Timestamp: ts, Data: map[string]interface{}{"a": 1}}, 5, "md"); err != nil {
+		t.Fatal(err)
+	}
+	// the event is reported once it's been flushed
+	select {
+	case result := <-f.Results():
+		if result.Metadata != "md" || result.Err != nil {
+			t.Errorf("unexpected result %+v", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the event to be flushed")
+	}
+	f.Close()
+	if _, ok := <-f.Results(); ok {
+		t.Error("expected results to be closed")
+	}
+	content, _ := ioutil.ReadFile(path)
+	expected := `{"time":"2016-08-01T00:00:00Z","dataset":"mydata","samplerate":5,"data":{"a":1}}` + "\n"
+	if string(content) != expected {
+		t.Errorf("expected %q, got %q", expected, content)
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.ndjson")
+
+	f, err := NewFile("file://"+path, "", Options{FileKeep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range f.Results() {
+		}
+	}()
+	// small enough that each event goes in a file of its own
+	f.maxSize = 50
+	for i := 0; i < 4; i++ {
+		f.Add(event.Event{Data: map[string]interface{}{"n": i}}, 1, nil)
+	}
+	f.Close()
+	for suffix, n := range map[string]float64{"": 3, ".1": 2, ".2": 1} {
+		fh, err := os.Open(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(fh)
+		var lines []record
+		for scanner.Scan() {
+			var r record
+			json.Unmarshal(scanner.Bytes(), &r)
+			lines = append(lines, r)
+		}
+		fh.Close()
+		if len(lines) != 1 || lines[0].Data["n"] != n {
+			t.Errorf("expected event %v in events.ndjson%s, got %+v", n, suffix, lines)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Error("expected only 2 rotated files to be kept")
+	}
+}
+
+func TestIsFileURL(t *testing.T) {
+	if !IsFileURL("file://events.ndjson") || IsFileURL("events.ndjson") {
+		t.Error("expected only file:// URLs to be file outputs")
+	}
+}
@@ -0,0 +1,131 @@
+package output
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+const honeycombScheme = "honeycomb://"
+
+// IsHoneycombURL returns true if url names a Honeycomb dataset to send events
+// to, as honeycomb://dataset, or honeycomb:// for the --dataset
+func IsHoneycombURL(url string) bool {
+	return strings.HasPrefix(url, honeycombScheme)
+}
+
+// HoneycombDataset returns the dataset named by a honeycomb:// URL, or
+// fallback if it doesn't name one
+func HoneycombDataset(url string, fallback string) string {
+	if dataset := strings.TrimPrefix(url, honeycombScheme); dataset != "" {
+		return dataset
+	}
+	return fallback
+}
+
+// ErrQueueFull is the error for events libhoney dropped because its queue
+// was full, which only happens if it's not blocking on send
+var ErrQueueFull = errors.New("event dropped because libhoney's queue is full")
+
+// Honeycomb sends events to a dataset in Honeycomb with a libhoney client of
+// its own
+type Honeycomb struct {
+	client  *libhoney.Client
+	dataset string
+	results chan Result
+}
+
+// NewHoneycomb returns an output sending events to conf.Dataset, with a
+// libhoney client set up with conf. Responses are needed for every event, so
+// conf.BlockOnResponse should be set.
+func NewHoneycomb(conf libhoney.Config) (*Honeycomb, error) {
+	// libhoney's defaults, as libhoney.Init would use
+	if conf.MaxBatchSize == 0 {
+		conf.MaxBatchSize = libhoney.DefaultMaxBatchSize
+	}
+	if conf.SendFrequency == 0 {
+		conf.SendFrequency = libhoney.DefaultBatchTimeout
+	}
+	if conf.MaxConcurrentBatches == 0 {
+		conf.MaxConcurrentBatches = libhoney.DefaultMaxConcurrentBatches
+	}
+	if conf.PendingWorkCapacity == 0 {
+		conf.PendingWorkCapacity = libhoney.DefaultPendingWorkCapacity
+	}
+	client, err := libhoney.NewClient(libhoney.ClientConfig{
+		APIKey:     conf.WriteKey,
+		Dataset:    conf.Dataset,
+		SampleRate: conf.SampleRate,
+		APIHost:    conf.APIHost,
+		Transmission: &transmission.Honeycomb{
+			MaxBatchSize:         conf.MaxBatchSize,
+			BatchTimeout:         conf.SendFrequency,
+			MaxConcurrentBatches: conf.MaxConcurrentBatches,
+			PendingWorkCapacity:  conf.PendingWorkCapacity,
+			BlockOnSend:          conf.BlockOnSend,
+			BlockOnResponse:      conf.BlockOnResponse,
+			Transport:            conf.Transport,
+			UserAgentAddition:    libhoney.UserAgentAddition,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	h := &Honeycomb{client: client, dataset: conf.Dataset, results: make(chan Result)}
+	go h.handOutResponses()
+	return h, nil
+}
+
+// handOutResponses passes on each of the client's responses, until it's
+// closed
+func (h *Honeycomb) handOutResponses() {
+	defer close(h.results)
+	for rsp := range h.client.TxResponses() {
+		err, body := rsp.Err, rsp.Body
+		switch {
+		case err != nil && err.Error() == "queue overflow":
+			err = ErrQueueFull
+		case err != nil && rsp.StatusCode != 0:
+			// the API answered, and libhoney's error only says what with, so
+			// it's kept as the body if there isn't one
+			if len(body) == 0 {
+				body = []byte(err.Error())
+			}
+			err = nil
+		}
+		h.results <- Result{
+			Metadata:   rsp.Metadata,
+			StatusCode: rsp.StatusCode,
+			Body:       body,
+			Duration:   rsp.Duration,
+			Err:        err,
+		}
+	}
+}
+
+// Add hands ev to libhoney
+func (h *Honeycomb) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	libhEv := h.client.NewEvent()
+	libhEv.Metadata = metadata
+	libhEv.Timestamp = ev.Timestamp
+	libhEv.Dataset = eventDataset(ev, h.dataset)
+	libhEv.SampleRate = sampleRate
+	if err := libhEv.Add(ev.Data); err != nil {
+		return err
+	}
+	return libhEv.SendPresampled()
+}
+
+// Results returns the responses for this output's events
+func (h *Honeycomb) Results() chan Result {
+	return h.results
+}
+
+// Close tells libhoney to finish up sending events
+func (h *Honeycomb) Close() {
+	h.client.Close()
+}
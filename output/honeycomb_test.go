@@ -0,0 +1,78 @@
+package output
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/honeycombio/libhoney-go"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestHoneycomb(t *testing.T) {
+	var lock sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		paths = append(paths, r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/rejected") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"unknown dataset"}`))
+			return
+		}
+		w.Write([]byte(`[{"status":202}]`))
+	}))
+	defer server.Close()
+
+	newHoneycomb := func(dataset string) *Honeycomb {
+		h, err := NewHoneycomb(libhoney.Config{
+			WriteKey:        "abcabc123123",
+			Dataset:         dataset,
+			APIHost:         server.URL,
+			BlockOnSend:     true,
+			BlockOnResponse: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	// each output has a client of its own, so closing one leaves the other
+	// sending
+	first := newHoneycomb("first")
+	second := newHoneycomb("second")
+	first.Close()
+	for range first.Results() {
+	}
+	second.Add(event.Event{Data: map[string]interface{}{"n": 1}}, 1, "md")
+	if result := <-second.Results(); result.Err != nil || result.StatusCode != 202 || result.Metadata != "md" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	second.Close()
+	for range second.Results() {
+	}
+	lock.Lock()
+	if len(paths) != 1 || paths[0] != "/1/batch/second" {
+		t.Errorf("expected the event to be sent to the second dataset, got %v", paths)
+	}
+	lock.Unlock()
+
+	// a batch the API turns away is a response, not an error, so it isn't
+	// tried again
+	rejected := newHoneycomb("rejected")
+	rejected.Add(event.Event{Data: map[string]interface{}{"n": 1}}, 1, nil)
+	result := <-rejected.Results()
+	if result.Err != nil || result.StatusCode != 400 || !strings.Contains(string(result.Body), "unknown dataset") {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if retryable(result) {
+		t.Error("expected a rejected batch not to be tried again")
+	}
+	rejected.Close()
+	for range rejected.Results() {
+	}
+}
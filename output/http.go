@@ -0,0 +1,179 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// maxResultBody is the most of a response body kept for the results
+const maxResultBody = 1024
+
+// IsHTTPURL returns true if url is an endpoint to POST events to
+func IsHTTPURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// parseHeaders turns "Name: value" strings into headers
+func parseHeaders(headers []string, flag string) (http.Header, error) {
+	parsed := make(http.Header)
+	for _, header := range headers {
+		colon := strings.Index(header, ":")
+		if colon < 1 {
+			return nil, fmt.Errorf("%s %s should be Name: value", flag, header)
+		}
+		parsed.Add(strings.TrimSpace(header[:colon]), strings.TrimSpace(header[colon+1:]))
+	}
+	return parsed, nil
+}
+
+// HTTP POSTs events to an endpoint as newline delimited JSON, in batches,
+// several at once. Batches that fail with a network error, a 5xx or a 429
+// are tried again, and after a 429 no batches are sent until its Retry-After
+// has passed. Every event in a batch gets the batch's response.
+type HTTP struct {
+	url       string
+	dataset   string
+	headers   http.Header
+	batchSize int
+	retries   int
+	backoff   time.Duration
+	client    *http.Client
+	throttle  throttle
+
+	queue   chan pending
+	batches chan []pending
+	results chan Result
+	senders sync.WaitGroup
+}
+
+// NewHTTP starts POSTing events to url. Events are written with dataset as
+// theirs.
+func NewHTTP(url string, dataset string, options Options) (*HTTP, error) {
+	headers, err := parseHeaders(options.HTTPHeaders, "--output.http_header")
+	if err != nil {
+		return nil, err
+	}
+	batchSize := options.HTTPBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	concurrency := options.HTTPConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	h := &HTTP{
+		url:       url,
+		dataset:   dataset,
+		headers:   headers,
+		batchSize: batchSize,
+		retries:   options.MaxRetries,
+		backoff:   options.RetryBackoff,
+		client:    &http.Client{Timeout: time.Duration(options.HTTPTimeout) * time.Second},
+		queue:     make(chan pending, batchSize),
+		batches:   make(chan []pending),
+		results:   make(chan Result),
+	}
+	for i := 0; i < concurrency; i++ {
+		h.senders.Add(1)
+		go func() {
+			defer h.senders.Done()
+			for batch := range h.batches {
+				h.send(batch)
+			}
+		}()
+	}
+	go func() {
+		batchEvents(h.queue, h.batchSize, func(batch []pending) {
+			h.batches <- batch
+		})
+		close(h.batches)
+		h.senders.Wait()
+		close(h.results)
+	}()
+	return h, nil
+}
+
+// Add queues ev to be sent with the next batch
+func (h *HTTP) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	value, err := marshalRecord(ev, h.dataset, sampleRate)
+	if err != nil {
+		return err
+	}
+	h.queue <- pending{value: value, metadata: metadata}
+	return nil
+}
+
+// send POSTs a batch, trying again as many times as it's allowed, and
+// reports how it went
+func (h *HTTP) send(batch []pending) {
+	var body bytes.Buffer
+	for _, p := range batch {
+		body.Write(p.value.([]byte))
+		body.WriteByte('\n')
+	}
+	start := time.Now()
+	var result Result
+	for attempt := 0; ; attempt++ {
+		h.throttle.wait()
+		result = post(h.client, h.url, h.headers, "application/x-ndjson", body.Bytes())
+		if !retryable(result) || attempt >= h.retries {
+			break
+		}
+		wait := retryWait(result, h.backoff, attempt)
+		if result.StatusCode == http.StatusTooManyRequests {
+			// hold back the other senders too
+			h.throttle.hold(wait)
+		} else {
+			time.Sleep(wait)
+		}
+	}
+	result.Duration = time.Since(start)
+	for _, p := range batch {
+		r := result
+		r.Metadata = p.metadata
+		h.results <- r
+	}
+}
+
+// post makes one attempt at POSTing body to url
+func post(client *http.Client, url string, headers http.Header, contentType string, body []byte) Result {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return Result{Err: err}
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return Result{Err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxResultBody))
+	// read the rest so the connection can be used again
+	io.Copy(ioutil.Discard, resp.Body)
+	result := Result{StatusCode: resp.StatusCode, Body: respBody}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		result.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return result
+}
+
+// Results returns the channel the outcome of sending each event comes down
+func (h *HTTP) Results() chan Result {
+	return h.results
+}
+
+// Close sends whatever's still queued, then stops
+func (h *HTTP) Close() {
+	close(h.queue)
+}
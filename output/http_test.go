@@ -0,0 +1,96 @@
+package output
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+func TestHTTP(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		attempts++
+		// the first attempt fails, and is tried again
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL, "mydata", Options{
+		HTTPHeaders:     []string{"Authorization: Bearer secret"},
+		HTTPBatchSize:   2,
+		HTTPConcurrency: 1,
+		MaxRetries:      1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		h.Add(event.Event{Data: map[string]interface{}{"n": i}}, 1, i)
+	}
+	h.Close()
+	var results []Result
+	for result := range h.Results() {
+		results = append(results, result)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected a result for each event, got %+v", results)
+	}
+	for _, result := range results {
+		if result.Err != nil || result.StatusCode != 200 || string(result.Body) != "ok" {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+	// two requests, the first of which was tried twice
+	if attempts != 3 || len(bodies) != 2 {
+		t.Fatalf("expected 3 attempts and 2 bodies, got %d and %q", attempts, bodies)
+	}
+	if lines := strings.Split(strings.TrimSpace(bodies[0]), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"data":{"n":0}`) {
+		t.Errorf("unexpected first batch %q", bodies[0])
+	}
+}
+
+func TestHTTPRejected(t *testing.T) {
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	// a request the endpoint doesn't like isn't tried again
+	h, err := NewHTTP(server.URL, "", Options{HTTPBatchSize: 1, HTTPConcurrency: 1, MaxRetries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Add(event.Event{Data: map[string]interface{}{}}, 1, nil)
+	h.Close()
+	for result := range h.Results() {
+		if result.StatusCode != http.StatusBadRequest {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+	if attempts != 1 {
+		t.Errorf("expected one attempt, got %d", attempts)
+	}
+	if _, err := NewHTTP(server.URL, "", Options{HTTPHeaders: []string{"no colon"}}); err == nil {
+		t.Error("expected an error for a badly formed header")
+	}
+}
@@ -0,0 +1,125 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	kafkago "github.com/segmentio/kafka-go"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+const kafkaScheme = "kafka://"
+
+// IsKafkaURL returns true if url names a kafka topic to produce events to
+func IsKafkaURL(url string) bool {
+	return strings.HasPrefix(url, kafkaScheme)
+}
+
+// parseKafkaURL splits kafka://broker1:9092,broker2:9092/topic into its
+// brokers and topic
+func parseKafkaURL(url string) ([]string, string, error) {
+	rest := strings.TrimPrefix(url, kafkaScheme)
+	slash := strings.LastIndex(rest, "/")
+	if slash < 0 || slash == len(rest)-1 {
+		return nil, "", fmt.Errorf("--output %s needs a topic, eg kafka://broker:9092/topic", url)
+	}
+	var brokers []string
+	for _, broker := range strings.Split(rest[:slash], ",") {
+		if broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, "", fmt.Errorf("--output %s needs at least one broker, eg kafka://broker:9092/topic", url)
+	}
+	return brokers, rest[slash+1:], nil
+}
+
+// Kafka produces events to a kafka topic, one JSON message per event, in
+// batches. An event counts as sent once the brokers have acknowledged it.
+type Kafka struct {
+	writer    *kafkago.Writer
+	dataset   string
+	batchSize int
+	queue     chan pending
+	results   chan Result
+}
+
+// NewKafka starts producing to the topic named by url, a kafka:// URL.
+// Events are written with dataset as theirs.
+func NewKafka(url string, dataset string, options Options) (*Kafka, error) {
+	brokers, topic, err := parseKafkaURL(url)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := options.KafkaBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	k := &Kafka{
+		writer: kafkago.NewWriter(kafkago.WriterConfig{
+			Brokers:   brokers,
+			Topic:     topic,
+			BatchSize: batchSize,
+			// batches are collected here, so hand them straight over
+			BatchTimeout: 10 * time.Millisecond,
+		}),
+		dataset:   dataset,
+		batchSize: batchSize,
+		queue:     make(chan pending, batchSize),
+		results:   make(chan Result),
+	}
+	logrus.WithFields(logrus.Fields{
+		"brokers": brokers,
+		"topic":   topic,
+	}).Info("producing events to kafka")
+	go k.run()
+	return k, nil
+}
+
+// Add queues ev to be produced with the next batch
+func (k *Kafka) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	value, err := marshalRecord(ev, k.dataset, sampleRate)
+	if err != nil {
+		return err
+	}
+	k.queue <- pending{value: value, metadata: metadata}
+	return nil
+}
+
+// run produces batches of queued events until the queue is closed
+func (k *Kafka) run() {
+	defer close(k.results)
+	defer k.writer.Close()
+	batchEvents(k.queue, k.batchSize, k.produce)
+}
+
+// produce produces a batch of events and reports how it went
+func (k *Kafka) produce(batch []pending) {
+	msgs := make([]kafkago.Message, len(batch))
+	for i, p := range batch {
+		msgs[i] = kafkago.Message{Value: p.value.([]byte)}
+	}
+	start := time.Now()
+	// when producing fails there's no telling which messages made it, so
+	// the whole batch has failed
+	err := k.writer.WriteMessages(context.Background(), msgs...)
+	for _, p := range batch {
+		k.results <- Result{Metadata: p.metadata, Duration: time.Since(start), Err: err}
+	}
+}
+
+// Results returns the channel the outcome of producing each event comes down
+func (k *Kafka) Results() chan Result {
+	return k.results
+}
+
+// Close produces whatever's still queued, then closes the connections to the
+// brokers
+func (k *Kafka) Close() {
+	close(k.queue)
+}
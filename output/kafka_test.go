@@ -0,0 +1,31 @@
+package output
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseKafkaURL(t *testing.T) {
+	tsts := []struct {
+		url     string
+		brokers []string
+		topic   string
+		ok      bool
+	}{
+		{"kafka://broker:9092/events", []string{"broker:9092"}, "events", true},
+		{"kafka://b1:9092,b2:9092/events", []string{"b1:9092", "b2:9092"}, "events", true},
+		{"kafka://broker:9092", nil, "", false},
+		{"kafka://broker:9092/", nil, "", false},
+		{"kafka:///events", nil, "", false},
+	}
+	for _, tt := range tsts {
+		brokers, topic, err := parseKafkaURL(tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error %v", tt.url, err)
+			continue
+		}
+		if fmt.Sprint(brokers) != fmt.Sprint(tt.brokers) || topic != tt.topic {
+			t.Errorf("%s: expected %v %q, got %v %q", tt.url, tt.brokers, tt.topic, brokers, topic)
+		}
+	}
+}
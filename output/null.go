@@ -0,0 +1,30 @@
+package output
+
+import "github.com/honeycombio/honeytail/event"
+
+// Null throws events away, reporting each one as sent straight away. It's
+// for --benchmark, which measures everything but sending.
+type Null struct {
+	results chan Result
+}
+
+// NewNull returns an output that sends nothing
+func NewNull() *Null {
+	return &Null{results: make(chan Result, 1000)}
+}
+
+// Add reports ev as sent
+func (n *Null) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	n.results <- Result{Metadata: metadata}
+	return nil
+}
+
+// Results returns the channel the results come down
+func (n *Null) Results() chan Result {
+	return n.results
+}
+
+// Close closes the results channel
+func (n *Null) Close() {
+	close(n.results)
+}
@@ -0,0 +1,312 @@
+package output
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// the schemes for each way of exporting to OTLP
+const (
+	otlpGRPCScheme  = "otlp://"
+	otlpGRPCSScheme = "otlps://"
+	otlpHTTPScheme  = "otlp+http://"
+	otlpHTTPSScheme = "otlp+https://"
+)
+
+// otlpLogsPath is where OTLP/HTTP logs are sent if the URL doesn't say
+const otlpLogsPath = "/v1/logs"
+
+// IsOTLPURL returns true if url names an OpenTelemetry collector to export
+// events to as logs
+func IsOTLPURL(url string) bool {
+	for _, scheme := range []string{otlpGRPCScheme, otlpGRPCSScheme, otlpHTTPScheme, otlpHTTPSScheme} {
+		if strings.HasPrefix(url, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// OTLP exports events as OpenTelemetry log records, in batches, over gRPC
+// (otlp://host:4317, or otlps:// for TLS) or HTTP (otlp+http://host:4318,
+// or otlp+https://). Each event's fields become the record's attributes, and
+// its dataset becomes the service.name of the resource.
+type OTLP struct {
+	// client is set for gRPC, and url for HTTP
+	client    collogspb.LogsServiceClient
+	conn      *grpc.ClientConn
+	url       string
+	http      *http.Client
+	headers   http.Header
+	metadata  metadata.MD
+	dataset   string
+	bodyField string
+	batchSize int
+	retries   int
+	backoff   time.Duration
+	timeout   time.Duration
+
+	queue   chan pending
+	results chan Result
+}
+
+// NewOTLP starts exporting to the collector named by url. Events are
+// exported with dataset as their service.name.
+func NewOTLP(url string, dataset string, options Options) (*OTLP, error) {
+	headers, err := parseHeaders(options.OTLPHeaders, "--output.otlp_header")
+	if err != nil {
+		return nil, err
+	}
+	batchSize := options.OTLPBatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	o := &OTLP{
+		headers:   headers,
+		dataset:   dataset,
+		bodyField: options.OTLPBodyField,
+		batchSize: batchSize,
+		retries:   options.MaxRetries,
+		backoff:   options.RetryBackoff,
+		timeout:   time.Duration(options.HTTPTimeout) * time.Second,
+		queue:     make(chan pending, batchSize),
+		results:   make(chan Result),
+	}
+	switch {
+	case strings.HasPrefix(url, otlpHTTPScheme), strings.HasPrefix(url, otlpHTTPSScheme):
+		o.url = strings.TrimPrefix(url, "otlp+")
+		if !strings.Contains(strings.SplitN(o.url, "://", 2)[1], "/") {
+			o.url += otlpLogsPath
+		}
+		o.http = &http.Client{Timeout: o.timeout}
+	default:
+		creds := insecure.NewCredentials()
+		target := strings.TrimPrefix(url, otlpGRPCScheme)
+		if strings.HasPrefix(url, otlpGRPCSScheme) {
+			creds = credentials.NewTLS(nil)
+			target = strings.TrimPrefix(url, otlpGRPCSScheme)
+		}
+		if target == "" {
+			return nil, fmt.Errorf("--output %s needs a host and port, eg otlp://localhost:4317", url)
+		}
+		conn, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		o.conn = conn
+		o.client = collogspb.NewLogsServiceClient(conn)
+		o.metadata = metadata.MD{}
+		for name, values := range headers {
+			o.metadata.Append(name, values...)
+		}
+	}
+	go func() {
+		defer close(o.results)
+		batchEvents(o.queue, o.batchSize, o.export)
+		if o.conn != nil {
+			o.conn.Close()
+		}
+	}()
+	return o, nil
+}
+
+// otlpRecord is an event waiting to be exported
+type otlpRecord struct {
+	dataset string
+	record  *logspb.LogRecord
+}
+
+// Add queues ev to be exported with the next batch
+func (o *OTLP) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	value := otlpRecord{dataset: eventDataset(ev, o.dataset), record: o.logRecord(ev, sampleRate)}
+	o.queue <- pending{value: value, metadata: metadata}
+	return nil
+}
+
+// logRecord returns ev as a log record
+func (o *OTLP) logRecord(ev event.Event, sampleRate uint) *logspb.LogRecord {
+	record := &logspb.LogRecord{
+		TimeUnixNano:         uint64(ev.Timestamp.UnixNano()),
+		ObservedTimeUnixNano: uint64(time.Now().UnixNano()),
+		Attributes:           attributes(ev.Data, o.bodyField),
+	}
+	if body, ok := ev.Data[o.bodyField]; ok && o.bodyField != "" {
+		record.Body = anyValue(body)
+	}
+	if sampleRate > 1 {
+		record.Attributes = append(record.Attributes, &commonpb.KeyValue{Key: "SampleRate", Value: anyValue(int64(sampleRate))})
+	}
+	return record
+}
+
+// attributes returns the fields in data, other than skip, as attributes
+func attributes(data map[string]interface{}, skip string) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		if key != skip || skip == "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	attrs := make([]*commonpb.KeyValue, len(keys))
+	for i, key := range keys {
+		attrs[i] = &commonpb.KeyValue{Key: key, Value: anyValue(data[key])}
+	}
+	return attrs
+}
+
+// anyValue converts a field's value to an attribute value
+func anyValue(v interface{}) *commonpb.AnyValue {
+	switch v := v.(type) {
+	case nil:
+		return &commonpb.AnyValue{}
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}
+	case int:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v}}
+	case map[string]interface{}:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{
+			KvlistValue: &commonpb.KeyValueList{Values: attributes(v, "")},
+		}}
+	case []interface{}:
+		values := make([]*commonpb.AnyValue, len(v))
+		for i, elem := range v {
+			values[i] = anyValue(elem)
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{
+			ArrayValue: &commonpb.ArrayValue{Values: values},
+		}}
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(v)}}
+}
+
+// resourceLogs groups records by dataset, each dataset becoming a resource
+// with it as the service.name
+func resourceLogs(batch []pending) []*logspb.ResourceLogs {
+	var resources []*logspb.ResourceLogs
+	byDataset := make(map[string]*logspb.ScopeLogs)
+	for _, p := range batch {
+		value := p.value.(otlpRecord)
+		scope, ok := byDataset[value.dataset]
+		if !ok {
+			resource := &resourcepb.Resource{}
+			if value.dataset != "" {
+				resource.Attributes = []*commonpb.KeyValue{{Key: "service.name", Value: anyValue(value.dataset)}}
+			}
+			scope = &logspb.ScopeLogs{Scope: &commonpb.InstrumentationScope{Name: "honeytail"}}
+			resources = append(resources, &logspb.ResourceLogs{
+				Resource:  resource,
+				ScopeLogs: []*logspb.ScopeLogs{scope},
+			})
+			byDataset[value.dataset] = scope
+		}
+		scope.LogRecords = append(scope.LogRecords, value.record)
+	}
+	return resources
+}
+
+// export sends a batch of log records, trying again as many times as it's
+// allowed, and reports how it went
+func (o *OTLP) export(batch []pending) {
+	req := &collogspb.ExportLogsServiceRequest{ResourceLogs: resourceLogs(batch)}
+	start := time.Now()
+	var result Result
+	for attempt := 0; ; attempt++ {
+		if o.client != nil {
+			result = o.exportGRPC(req)
+		} else {
+			result = o.exportHTTP(req)
+		}
+		if !retryable(result) || attempt >= o.retries {
+			break
+		}
+		time.Sleep(retryWait(result, o.backoff, attempt))
+	}
+	result.Duration = time.Since(start)
+	for _, p := range batch {
+		r := result
+		r.Metadata = p.metadata
+		o.results <- r
+	}
+}
+
+func (o *OTLP) exportGRPC(req *collogspb.ExportLogsServiceRequest) Result {
+	ctx := metadata.NewOutgoingContext(context.Background(), o.metadata)
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	resp, err := o.client.Export(ctx, req)
+	if err != nil {
+		return grpcResult(err)
+	}
+	if partial := resp.GetPartialSuccess(); partial.GetRejectedLogRecords() > 0 {
+		logrus.WithFields(logrus.Fields{
+			"rejected": partial.GetRejectedLogRecords(),
+			"message":  partial.GetErrorMessage(),
+		}).Warn("OTLP collector rejected some log records")
+	}
+	return Result{}
+}
+
+// grpcResult turns an error from a gRPC call into a result. Errors for which
+// trying again won't help get the HTTP status code they correspond to, so
+// they're treated like the same response from an HTTP output.
+func grpcResult(err error) Result {
+	st, _ := status.FromError(err)
+	code := map[codes.Code]int{
+		codes.InvalidArgument:   http.StatusBadRequest,
+		codes.Unauthenticated:   http.StatusUnauthorized,
+		codes.PermissionDenied:  http.StatusForbidden,
+		codes.NotFound:          http.StatusNotFound,
+		codes.ResourceExhausted: http.StatusTooManyRequests,
+	}[st.Code()]
+	if code == 0 {
+		return Result{Err: err}
+	}
+	return Result{StatusCode: code, Body: []byte(st.Message())}
+}
+
+func (o *OTLP) exportHTTP(req *collogspb.ExportLogsServiceRequest) Result {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return Result{Err: err}
+	}
+	return post(o.http, o.url, o.headers, "application/x-protobuf", body)
+}
+
+// Results returns the channel the outcome of exporting each event comes down
+func (o *OTLP) Results() chan Result {
+	return o.results
+}
+
+// Close exports whatever's still queued, then stops
+func (o *OTLP) Close() {
+	close(o.queue)
+}
@@ -0,0 +1,151 @@
+package output
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// logsServer is a collector that keeps what it's sent
+type logsServer struct {
+	collogspb.UnimplementedLogsServiceServer
+	lock     sync.Mutex
+	requests []*collogspb.ExportLogsServiceRequest
+	team     []string
+}
+
+func (s *logsServer) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, req)
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.team = md.Get("x-honeycomb-team")
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func exportEvents(t *testing.T, url string) {
+	o, err := NewOTLP(url, "mydata", Options{
+		OTLPHeaders:   []string{"x-honeycomb-team: secret"},
+		OTLPBatchSize: 10,
+		OTLPBodyField: "msg",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC)
+	o.Add(event.Event{Timestamp: ts, Data: map[string]interface{}{
+		"msg":    "hello",
+		"status": float64(200),
+		"user":   map[string]interface{}{"id": "u1"},
+	}}, 4, "md")
+	o.Close()
+	for result := range o.Results() {
+		if result.Err != nil || result.Metadata != "md" {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+}
+
+func checkExported(t *testing.T, req *collogspb.ExportLogsServiceRequest) {
+	rl := req.ResourceLogs[0]
+	if attr := rl.Resource.Attributes[0]; attr.Key != "service.name" || attr.Value.GetStringValue() != "mydata" {
+		t.Errorf("unexpected resource %v", rl.Resource)
+	}
+	record := rl.ScopeLogs[0].LogRecords[0]
+	if record.TimeUnixNano != uint64(time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC).UnixNano()) {
+		t.Errorf("unexpected time %d", record.TimeUnixNano)
+	}
+	if record.Body.GetStringValue() != "hello" {
+		t.Errorf("unexpected body %v", record.Body)
+	}
+	attrs := record.Attributes
+	if len(attrs) != 3 || attrs[0].Key != "status" || attrs[0].Value.GetDoubleValue() != 200 ||
+		attrs[1].Key != "user" || attrs[1].Value.GetKvlistValue().Values[0].Value.GetStringValue() != "u1" ||
+		attrs[2].Key != "SampleRate" || attrs[2].Value.GetIntValue() != 4 {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
+
+func TestOTLPGRPC(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	logs := &logsServer{}
+	collogspb.RegisterLogsServiceServer(server, logs)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	exportEvents(t, "otlp://"+listener.Addr().String())
+	logs.lock.Lock()
+	defer logs.lock.Unlock()
+	if len(logs.requests) != 1 {
+		t.Fatalf("expected one export, got %d", len(logs.requests))
+	}
+	checkExported(t, logs.requests[0])
+	if len(logs.team) != 1 || logs.team[0] != "secret" {
+		t.Errorf("expected the header to be sent as metadata, got %v", logs.team)
+	}
+}
+
+func TestOTLPHTTP(t *testing.T) {
+	var req collogspb.ExportLogsServiceRequest
+	var path, team string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, team = r.URL.Path, r.Header.Get("x-honeycomb-team")
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	exportEvents(t, "otlp+"+server.URL)
+	if path != "/v1/logs" || team != "secret" {
+		t.Errorf("unexpected request to %s with team %q", path, team)
+	}
+	checkExported(t, &req)
+}
+
+func TestResourceLogsByDataset(t *testing.T) {
+	batch := []pending{
+		{value: otlpRecord{dataset: "a", record: &logspb.LogRecord{TimeUnixNano: 1}}},
+		{value: otlpRecord{dataset: "b", record: &logspb.LogRecord{TimeUnixNano: 2}}},
+		{value: otlpRecord{dataset: "a", record: &logspb.LogRecord{TimeUnixNano: 3}}},
+	}
+	resources := resourceLogs(batch)
+	if len(resources) != 2 {
+		t.Fatalf("expected a resource per dataset, got %d", len(resources))
+	}
+	for i, expected := range []struct {
+		dataset string
+		times   []uint64
+	}{{"a", []uint64{1, 3}}, {"b", []uint64{2}}} {
+		rl := resources[i]
+		if name := rl.Resource.Attributes[0].Value.GetStringValue(); name != expected.dataset {
+			t.Errorf("expected service.name %s, got %s", expected.dataset, name)
+		}
+		var times []uint64
+		for _, record := range rl.ScopeLogs[0].LogRecords {
+			times = append(times, record.TimeUnixNano)
+		}
+		if !reflect.DeepEqual(times, expected.times) {
+			t.Errorf("expected %s to have records %v, got %v", expected.dataset, expected.times, times)
+		}
+	}
+}
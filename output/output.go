@@ -0,0 +1,100 @@
+// Package output sends events to where they're going: the Honeycomb API, or
+// one of the alternatives given with --output
+package output
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// Options configure the outputs given with --output, and how events are
+// spooled when they can't be sent
+type Options struct {
+	FileMaxMB int `long:"file_max_mb" description:"Rotate a file output once it reaches this many megabytes; the old file is renamed with .1 on the end, the one before that .2 and so on. 0 never rotates" default:"100"`
+	FileKeep  int `long:"file_keep" description:"How many rotated files to keep alongside a file output" default:"5"`
+
+	KafkaBatchSize int `long:"kafka_batch_size" description:"Most events to produce to a kafka output at once. Smaller batches are produced every second" default:"100"`
+
+	HTTPHeaders     []string `long:"http_header" description:"Header to send with each request to an http output, as Name: value. May be specified multiple times"`
+	HTTPBatchSize   int      `long:"http_batch_size" description:"Most events to send to an http output in one request. Smaller batches are sent every second" default:"100"`
+	HTTPConcurrency int      `long:"http_concurrency" description:"Number of requests to an http output to have going at once, like --poolsize" default:"10"`
+	HTTPTimeout     int      `long:"http_timeout" description:"Seconds to wait for a response from an http or otlp output" default:"30"`
+
+	OTLPHeaders   []string `long:"otlp_header" description:"Header to send with each export to an otlp output, as Name: value, eg x-honeycomb-team: KEY. May be specified multiple times"`
+	OTLPBatchSize int      `long:"otlp_batch_size" description:"Most events to export to an otlp output at once. Smaller batches are exported every second" default:"100"`
+	OTLPBodyField string   `long:"otlp_body_field" description:"Field to use as the body of each log record, rather than an attribute"`
+
+	// MaxRetries and RetryBackoff come from --max_retries and
+	// --retry_backoff, which apply to every output
+	MaxRetries   int           `no-flag:"true"`
+	RetryBackoff time.Duration `no-flag:"true"`
+
+	SpoolDir   string `long:"spool_dir" description:"Directory to save events in when they can't be sent, because of a network error, 5xx or 429, to be sent again with backoff, including after a restart. Spooled events count as sent. Each output spools to a directory of its own in here"`
+	SpoolMaxMB int    `long:"spool_max_mb" description:"Most megabytes to spool for each output; once it's full, events that can't be sent are dropped. 0 for no limit" default:"1024"`
+}
+
+// Output is somewhere to send events. Events are handed over with Add, and
+// how sending each one went comes back on Results.
+type Output interface {
+	// Add queues ev to be sent. It's already been sampled at sampleRate.
+	// metadata comes back with the event's Result. Add blocks when the
+	// output can't keep up.
+	Add(ev event.Event, sampleRate uint, metadata interface{}) error
+	// Results returns the channel the outcome of sending each event comes
+	// down. It's closed once Close has finished sending.
+	Results() chan Result
+	// Close sends whatever's still queued, then stops
+	Close()
+}
+
+// Result is how sending an event went
+type Result struct {
+	// Metadata is what was passed to Add with the event
+	Metadata interface{}
+	// StatusCode and Body are the HTTP response, or its equivalent, for
+	// outputs that make requests; StatusCode is 0 for those that don't
+	StatusCode int
+	Body       []byte
+	// Duration is how long sending took
+	Duration time.Duration
+	// Err is set if the event couldn't be sent
+	Err error
+	// RetryAfter is how long a 429 response asked to be left alone for, if
+	// it said
+	RetryAfter time.Duration
+	// Spooled is set if the event couldn't be sent but has been saved to
+	// --output.spool_dir to be sent again later
+	Spooled bool
+}
+
+// record is how an event is written out by outputs that don't have a format
+// of their own. It's the same shape as an event in a batch sent to the
+// Honeycomb API, with the dataset it would have gone to.
+type record struct {
+	Time       time.Time              `json:"time"`
+	Dataset    string                 `json:"dataset,omitempty"`
+	SampleRate uint                   `json:"samplerate"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// eventDataset returns the dataset ev has been routed to, or dataset if it
+// hasn't been
+func eventDataset(ev event.Event, dataset string) string {
+	if ev.Dataset != "" {
+		return ev.Dataset
+	}
+	return dataset
+}
+
+// marshalRecord returns ev as a record, in dataset unless it's been routed
+// elsewhere
+func marshalRecord(ev event.Event, dataset string, sampleRate uint) ([]byte, error) {
+	return json.Marshal(record{
+		Time:       ev.Timestamp,
+		Dataset:    eventDataset(ev, dataset),
+		SampleRate: sampleRate,
+		Data:       ev.Data,
+	})
+}
@@ -0,0 +1,204 @@
+package output
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// maxBackoff is the longest to wait between attempts, unless a 429's
+// Retry-After asks for longer
+const maxBackoff = 30 * time.Second
+
+// retryable is true if a request that got result may do better next time.
+// Events dropped from a full queue were dropped on purpose, so aren't.
+func retryable(result Result) bool {
+	return result.Err != nil && result.Err != ErrQueueFull || result.StatusCode == http.StatusTooManyRequests || result.StatusCode >= 500
+}
+
+// retryWait is how long to wait before trying again after attempt got
+// result: as long as a 429's Retry-After asked, otherwise base doubled for
+// each attempt so far, up to maxBackoff
+func retryWait(result Result, base time.Duration, attempt int) time.Duration {
+	if result.RetryAfter > 0 {
+		return result.RetryAfter
+	}
+	if attempt > 20 {
+		return maxBackoff
+	}
+	if wait := base << uint(attempt); wait < maxBackoff {
+		return wait
+	}
+	return maxBackoff
+}
+
+// parseRetryAfter returns how long a Retry-After header asks to wait, given
+// either in seconds or as a date, or 0 if it doesn't say
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// throttle holds back sending after a 429, until the destination's had the
+// break it asked for
+type throttle struct {
+	lock  sync.Mutex
+	until time.Time
+}
+
+// hold stops sending for d, unless it's already stopped for longer
+func (t *throttle) hold(d time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if until := time.Now().Add(d); until.After(t.until) {
+		t.until = until
+	}
+}
+
+// wait returns once sending is allowed
+func (t *throttle) wait() {
+	for {
+		t.lock.Lock()
+		wait := time.Until(t.until)
+		t.lock.Unlock()
+		if wait <= 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Retry wraps an output that doesn't try again itself, giving events it
+// fails to send with a network error, 5xx or 429 back to it up to
+// --max_retries times with backoff. After a 429, Add blocks until the wait it
+// asked for has passed, so that reading slows down rather than sending into
+// more 429s.
+type Retry struct {
+	out      Output
+	retries  int
+	backoff  time.Duration
+	results  chan Result
+	throttle throttle
+
+	lock     sync.Mutex
+	nextID   uint64
+	inFlight map[uint64]*retryEvent
+	// waiting counts the events that haven't had their final result, so
+	// out isn't closed while one's waiting to be tried again
+	waiting sync.WaitGroup
+}
+
+// retryEvent is an event given to the wrapped output
+type retryEvent struct {
+	ev         event.Event
+	sampleRate uint
+	metadata   interface{}
+	attempt    int
+	start      time.Time
+}
+
+// NewRetry wraps out, trying events again as options.MaxRetries and
+// options.RetryBackoff say
+func NewRetry(out Output, options Options) *Retry {
+	r := &Retry{
+		out:      out,
+		retries:  options.MaxRetries,
+		backoff:  options.RetryBackoff,
+		results:  make(chan Result),
+		inFlight: make(map[uint64]*retryEvent),
+	}
+	go r.handleResults()
+	return r
+}
+
+// Add hands ev to the wrapped output, once any 429 has been waited out
+func (r *Retry) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	r.waiting.Add(1)
+	err := r.add(&retryEvent{ev: ev, sampleRate: sampleRate, metadata: metadata, start: time.Now()})
+	if err != nil {
+		r.waiting.Done()
+	}
+	return err
+}
+
+func (r *Retry) add(rev *retryEvent) error {
+	r.throttle.wait()
+	r.lock.Lock()
+	r.nextID++
+	id := r.nextID
+	r.inFlight[id] = rev
+	r.lock.Unlock()
+	err := r.out.Add(rev.ev, rev.sampleRate, id)
+	if err != nil {
+		r.lock.Lock()
+		delete(r.inFlight, id)
+		r.lock.Unlock()
+	}
+	return err
+}
+
+// handleResults tries events again while they're allowed to, and passes on
+// the results of the rest
+func (r *Retry) handleResults() {
+	for result := range r.out.Results() {
+		id, _ := result.Metadata.(uint64)
+		r.lock.Lock()
+		rev, ok := r.inFlight[id]
+		delete(r.inFlight, id)
+		r.lock.Unlock()
+		if !ok {
+			continue
+		}
+		if retryable(result) && rev.attempt < r.retries {
+			wait := retryWait(result, r.backoff, rev.attempt)
+			if result.StatusCode == http.StatusTooManyRequests {
+				r.throttle.hold(wait)
+			}
+			rev.attempt++
+			go r.retry(rev, result, wait)
+			continue
+		}
+		result.Metadata = rev.metadata
+		result.Duration = time.Since(rev.start)
+		r.results <- result
+		r.waiting.Done()
+	}
+	close(r.results)
+}
+
+// retry gives rev to the wrapped output again after wait, passing on the
+// result it last got if that fails
+func (r *Retry) retry(rev *retryEvent, last Result, wait time.Duration) {
+	time.Sleep(wait)
+	if err := r.add(rev); err != nil {
+		last.Metadata = rev.metadata
+		last.Duration = time.Since(rev.start)
+		r.results <- last
+		r.waiting.Done()
+	}
+}
+
+// Results returns the channel the outcome of sending each event comes down
+func (r *Retry) Results() chan Result {
+	return r.results
+}
+
+// Close waits for the events still to be tried again, then closes the
+// wrapped output
+func (r *Retry) Close() {
+	r.waiting.Wait()
+	r.out.Close()
+}
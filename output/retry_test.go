@@ -0,0 +1,141 @@
+package output
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// scriptedOutput answers each attempt at sending with the next of its
+// responses, then with 200s
+type scriptedOutput struct {
+	lock      sync.Mutex
+	responses []Result
+	attempts  []time.Time
+	results   chan Result
+}
+
+func (s *scriptedOutput) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	s.lock.Lock()
+	result := Result{StatusCode: 200}
+	if len(s.responses) > 0 {
+		result, s.responses = s.responses[0], s.responses[1:]
+	}
+	s.attempts = append(s.attempts, time.Now())
+	s.lock.Unlock()
+	result.Metadata = metadata
+	go func() { s.results <- result }()
+	return nil
+}
+
+func (s *scriptedOutput) Results() chan Result { return s.results }
+
+func (s *scriptedOutput) Close() {
+	time.Sleep(10 * time.Millisecond)
+	close(s.results)
+}
+
+func TestRetry(t *testing.T) {
+	scripted := &scriptedOutput{
+		responses: []Result{{StatusCode: 503}, {StatusCode: 503}},
+		results:   make(chan Result),
+	}
+	r := NewRetry(scripted, Options{MaxRetries: 3, RetryBackoff: 10 * time.Millisecond})
+	r.Add(event.Event{}, 1, "md")
+	result := <-r.Results()
+	if result.Metadata != "md" || result.StatusCode != 200 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if len(scripted.attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(scripted.attempts))
+	}
+	// waiting twice as long before the second retry
+	if gap := scripted.attempts[2].Sub(scripted.attempts[1]); gap < 20*time.Millisecond {
+		t.Errorf("expected the second retry to back off, waited %s", gap)
+	}
+	r.Close()
+
+	// once out of retries, the last failure is passed on
+	scripted = &scriptedOutput{
+		responses: []Result{{StatusCode: 500}, {StatusCode: 502}},
+		results:   make(chan Result),
+	}
+	r = NewRetry(scripted, Options{MaxRetries: 1})
+	r.Add(event.Event{}, 1, nil)
+	if result := <-r.Results(); result.StatusCode != 502 {
+		t.Errorf("expected the last failure, got %+v", result)
+	}
+	r.Close()
+}
+
+func TestRetryThrottles(t *testing.T) {
+	scripted := &scriptedOutput{
+		responses: []Result{{StatusCode: 429, RetryAfter: 100 * time.Millisecond}},
+		results:   make(chan Result),
+	}
+	r := NewRetry(scripted, Options{MaxRetries: 1})
+	go func() {
+		for range r.Results() {
+		}
+	}()
+	r.Add(event.Event{}, 1, 1)
+	// give the 429 time to come back
+	time.Sleep(20 * time.Millisecond)
+	// the next event is held back as long as the 429 asked, like the retry
+	r.Add(event.Event{}, 1, 2)
+	r.Close()
+	if len(scripted.attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(scripted.attempts))
+	}
+	for _, attempt := range scripted.attempts[1:] {
+		if gap := attempt.Sub(scripted.attempts[0]); gap < 100*time.Millisecond {
+			t.Errorf("expected sending to wait for Retry-After, waited %s", gap)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if wait := parseRetryAfter("3"); wait != 3*time.Second {
+		t.Errorf("expected 3s, got %s", wait)
+	}
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if wait := parseRetryAfter(date); wait < 58*time.Second || wait > time.Minute {
+		t.Errorf("expected about a minute, got %s", wait)
+	}
+	for _, header := range []string{"", "soon", "-1"} {
+		if wait := parseRetryAfter(header); wait != 0 {
+			t.Errorf("expected no wait for %q, got %s", header, wait)
+		}
+	}
+}
+
+func TestHTTPRetryAfter(t *testing.T) {
+	var attempts []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	h, err := NewHTTP(server.URL, "", Options{HTTPBatchSize: 1, HTTPConcurrency: 1, MaxRetries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Add(event.Event{Data: map[string]interface{}{}}, 1, nil)
+	h.Close()
+	for result := range h.Results() {
+		if result.StatusCode != 200 {
+			t.Errorf("unexpected result %+v", result)
+		}
+	}
+	if len(attempts) != 2 || attempts[1].Sub(attempts[0]) < time.Second {
+		t.Errorf("expected the retry to wait for Retry-After, got attempts at %v", attempts)
+	}
+}
@@ -0,0 +1,397 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// spoolSegmentSize is the size at which the segment being written to is
+// closed off and a new one started
+const spoolSegmentSize = 4 * 1024 * 1024
+
+// spoolMaxBackoff is the longest the spool waits between attempts to resend
+// events
+const spoolMaxBackoff = 5 * time.Minute
+
+// unreadablePrefix is put in front of the name of a segment that couldn't be
+// read back, to set it aside
+const unreadablePrefix = "unreadable-"
+
+// reUnsafeName matches what's replaced to turn an output's URL into the name
+// of its spool directory
+var reUnsafeName = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// Spool wraps an output, saving events it can't send because of a network
+// error, 5xx or 429 to disk, and sending them again later with backoff. Saved
+// events count as sent, with Result.Spooled set. The spool is kept in files
+// of newline delimited JSON, one segment at a time being resent, so events
+// left when honeytail stops are sent once it starts again.
+type Spool struct {
+	out     Output
+	dir     string
+	maxSize int64
+	results chan Result
+	stop    chan struct{}
+	stopped chan struct{}
+
+	lock   sync.Mutex
+	nextID uint64
+	// inFlight are the events given to out that haven't had their results
+	inFlight map[uint64]*spoolEvent
+	// size is the total size of the segments on disk
+	size int64
+	// segments are the closed off segments waiting to be resent, oldest first
+	segments []string
+	nextSeq  int
+	// writing is the segment being added to, if there is one
+	writing     *os.File
+	writingName string
+	writingSize int64
+	// resending is how many events from the segment being resent are still
+	// waiting for their results, and failed whether any of them failed again
+	resending int
+	failed    bool
+	resent    chan bool
+}
+
+// spoolEvent is an event given to the wrapped output
+type spoolEvent struct {
+	ev         event.Event
+	sampleRate uint
+	metadata   interface{}
+	// resent is true for events read back from the spool, whose results
+	// aren't passed on
+	resent bool
+}
+
+// NewSpool wraps out, which was made for the --output url, spooling to a
+// directory for it in options.SpoolDir. Events already there from before
+// are sent again.
+func NewSpool(out Output, url string, options Options) (*Spool, error) {
+	dir := filepath.Join(options.SpoolDir, strings.Trim(reUnsafeName.ReplaceAllString(url, "_"), "_"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		out:      out,
+		dir:      dir,
+		maxSize:  int64(options.SpoolMaxMB) * 1024 * 1024,
+		results:  make(chan Result),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		inFlight: make(map[uint64]*spoolEvent),
+	}
+	if err := s.findSegments(); err != nil {
+		return nil, err
+	}
+	go s.handleResults()
+	go s.resendPeriodically()
+	return s, nil
+}
+
+// findSegments picks up the segments left in the spool directory
+func (s *Spool) findSegments() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		var seq int
+		name := strings.TrimPrefix(info.Name(), unreadablePrefix)
+		if _, err := fmt.Sscanf(name, "spool-%d.ndjson", &seq); err != nil {
+			continue
+		}
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+		if name != info.Name() {
+			// set aside, so not sent again, but its name isn't reused
+			continue
+		}
+		// names are zero padded, so they sort oldest first
+		s.segments = append(s.segments, info.Name())
+		s.size += info.Size()
+	}
+	sort.Strings(s.segments)
+	if len(s.segments) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"dir":   s.dir,
+			"bytes": s.size,
+		}).Info("Resending events left in the spool")
+	}
+	return nil
+}
+
+// Add hands ev to the wrapped output
+func (s *Spool) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	return s.add(&spoolEvent{ev: ev, sampleRate: sampleRate, metadata: metadata})
+}
+
+func (s *Spool) add(sev *spoolEvent) error {
+	s.lock.Lock()
+	s.nextID++
+	id := s.nextID
+	s.inFlight[id] = sev
+	s.lock.Unlock()
+	err := s.out.Add(sev.ev, sev.sampleRate, id)
+	if err != nil {
+		s.lock.Lock()
+		delete(s.inFlight, id)
+		s.lock.Unlock()
+	}
+	return err
+}
+
+// handleResults spools the events the wrapped output failed to send and
+// passes on the results of the rest
+func (s *Spool) handleResults() {
+	for result := range s.out.Results() {
+		id, _ := result.Metadata.(uint64)
+		s.lock.Lock()
+		sev, ok := s.inFlight[id]
+		delete(s.inFlight, id)
+		s.lock.Unlock()
+		if !ok {
+			continue
+		}
+		if retryable(result) {
+			if err := s.save(sev); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"dir": s.dir,
+					"err": err,
+				}).Warn("Couldn't spool an event that failed to send")
+			} else {
+				result.Spooled = true
+			}
+		}
+		if sev.resent {
+			s.resendDone(retryable(result))
+			continue
+		}
+		result.Metadata = sev.metadata
+		s.results <- result
+	}
+	s.lock.Lock()
+	if s.writing != nil {
+		s.writing.Close()
+	}
+	s.lock.Unlock()
+	close(s.results)
+}
+
+// save appends an event to the segment being written, if there's room
+func (s *Spool) save(sev *spoolEvent) error {
+	line, err := marshalRecord(sev.ev, "", sev.sampleRate)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize {
+		return fmt.Errorf("the spool is full (%d bytes)", s.size)
+	}
+	if s.writing == nil {
+		s.writingName = fmt.Sprintf("spool-%020d.ndjson", s.nextSeq)
+		s.nextSeq++
+		file, err := os.OpenFile(filepath.Join(s.dir, s.writingName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		s.writing = file
+		s.writingSize = 0
+	}
+	n, err := s.writing.Write(line)
+	s.size += int64(n)
+	s.writingSize += int64(n)
+	if err != nil {
+		return err
+	}
+	if s.writingSize >= spoolSegmentSize {
+		s.closeSegment()
+	}
+	return nil
+}
+
+// closeSegment closes off the segment being written so it can be resent.
+// s.lock must be held.
+func (s *Spool) closeSegment() {
+	if s.writing == nil {
+		return
+	}
+	s.writing.Close()
+	s.writing = nil
+	s.segments = append(s.segments, s.writingName)
+}
+
+// resendPeriodically resends the spooled segments one at a time, backing off
+// while they keep failing, until Close is called
+func (s *Spool) resendPeriodically() {
+	defer close(s.stopped)
+	attempt := 0
+	for {
+		// wait a second between looks at the spool, doubling each time
+		// resending fails
+		wait := spoolMaxBackoff
+		if attempt < 9 {
+			wait = time.Second << uint(attempt)
+		}
+		if wait > spoolMaxBackoff {
+			wait = spoolMaxBackoff
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(wait):
+		}
+		for {
+			failed, ok := s.resend()
+			if !ok {
+				attempt = 0
+				break
+			}
+			if failed {
+				attempt++
+				break
+			}
+			attempt = 0
+		}
+	}
+}
+
+// resend sends the oldest segment again and waits for its events' results,
+// returning whether any failed again. ok is false if there was nothing to
+// send or the spool is stopping.
+func (s *Spool) resend() (failed bool, ok bool) {
+	s.lock.Lock()
+	if len(s.segments) == 0 {
+		s.closeSegment()
+	}
+	if len(s.segments) == 0 {
+		s.lock.Unlock()
+		return false, false
+	}
+	name := s.segments[0]
+	s.segments = s.segments[1:]
+	s.lock.Unlock()
+
+	path := filepath.Join(s.dir, name)
+	events, size, err := readSegment(path)
+	if err != nil {
+		// keep the segment for someone to look at, under a name that isn't
+		// picked up as a segment again
+		aside := filepath.Join(s.dir, unreadablePrefix+name)
+		if renameErr := os.Rename(path, aside); renameErr != nil {
+			aside = path
+		}
+		logrus.WithFields(logrus.Fields{
+			"file": aside,
+			"err":  err,
+		}).Warn("Couldn't read spooled events, leaving them in the spool directory")
+		s.lock.Lock()
+		s.size -= size
+		s.lock.Unlock()
+		return false, true
+	}
+	s.lock.Lock()
+	s.resending = len(events)
+	s.failed = false
+	s.resent = make(chan bool, 1)
+	s.size -= size
+	resent := s.resent
+	s.lock.Unlock()
+	// the events are now held in memory, and go back to the spool if they
+	// fail again
+	os.Remove(path)
+	if len(events) == 0 {
+		return false, true
+	}
+	for i, sev := range events {
+		select {
+		case <-s.stop:
+			// keep what hasn't been handed over yet for next time
+			for _, left := range events[i:] {
+				s.save(left)
+			}
+			return true, false
+		default:
+		}
+		if err := s.add(sev); err != nil {
+			s.save(sev)
+			s.resendDone(true)
+		}
+	}
+	select {
+	case failed = <-resent:
+		return failed, true
+	case <-s.stop:
+		return true, false
+	}
+}
+
+// resendDone records that an event from the segment being resent has been
+// dealt with
+func (s *Spool) resendDone(failed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failed = s.failed || failed
+	s.resending--
+	if s.resending == 0 {
+		s.resent <- s.failed
+	}
+}
+
+// readSegment reads back the events in a spool segment, returning its size
+func readSegment(path string) ([]*spoolEvent, int64, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fh.Close()
+	info, err := fh.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	var events []*spoolEvent
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), spoolSegmentSize)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// most likely a line cut short when honeytail stopped
+			continue
+		}
+		events = append(events, &spoolEvent{
+			ev:         event.Event{Timestamp: rec.Time, Data: rec.Data, Dataset: rec.Dataset},
+			sampleRate: rec.SampleRate,
+			resent:     true,
+		})
+	}
+	return events, info.Size(), scanner.Err()
+}
+
+// Results returns the channel the outcome of sending each event comes down
+func (s *Spool) Results() chan Result {
+	return s.results
+}
+
+// Close stops resending spooled events, then closes the wrapped output.
+// Anything still failing is left in the spool for next time.
+func (s *Spool) Close() {
+	close(s.stop)
+	<-s.stopped
+	s.out.Close()
+}
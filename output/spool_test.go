@@ -0,0 +1,182 @@
+package output
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+// flakyOutput fails to send events until it's told to start working
+type flakyOutput struct {
+	lock    sync.Mutex
+	working bool
+	sent    []event.Event
+	results chan Result
+}
+
+func (f *flakyOutput) Add(ev event.Event, sampleRate uint, metadata interface{}) error {
+	f.lock.Lock()
+	result := Result{Metadata: metadata, StatusCode: 503}
+	if f.working {
+		result.StatusCode = 200
+		f.sent = append(f.sent, ev)
+	}
+	f.lock.Unlock()
+	go func() { f.results <- result }()
+	return nil
+}
+
+func (f *flakyOutput) Results() chan Result { return f.results }
+
+func (f *flakyOutput) Close() {
+	// give the results time to come in before closing
+	time.Sleep(10 * time.Millisecond)
+	close(f.results)
+}
+
+func (f *flakyOutput) setWorking() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.working = true
+}
+
+func (f *flakyOutput) sentEvents() []event.Event {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.sent
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	options := Options{SpoolDir: dir, SpoolMaxMB: 1}
+
+	flaky := &flakyOutput{results: make(chan Result)}
+	s, err := NewSpool(flaky, "http://example.com/events", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC)
+	s.Add(event.Event{Timestamp: ts, Data: map[string]interface{}{"a": "b"}, Dataset: "routed"}, 3, "md")
+	// the event couldn't be sent, but it's been saved so it counts as sent
+	result := <-s.Results()
+	if result.Metadata != "md" || !result.Spooled || result.StatusCode != 503 {
+		t.Errorf("unexpected result %+v", result)
+	}
+	// and it's still there after a restart
+	s.Close()
+	for range s.Results() {
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "http_example.com_events", "spool-*.ndjson"))
+	if len(files) != 1 {
+		t.Fatalf("expected one spool segment, got %v", files)
+	}
+
+	flaky = &flakyOutput{results: make(chan Result), working: true}
+	s, err = NewSpool(flaky, "http://example.com/events", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(flaky.sentEvents()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+	for range s.Results() {
+		t.Error("expected no results for events resent from the spool")
+	}
+	sent := flaky.sentEvents()
+	if len(sent) != 1 || !sent[0].Timestamp.Equal(ts) || sent[0].Data["a"] != "b" || sent[0].Dataset != "routed" {
+		t.Fatalf("expected the spooled event to be resent, got %+v", sent)
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "http_example.com_events", "spool-*.ndjson"))
+	if len(files) != 0 {
+		t.Errorf("expected the spool to be empty once resent, got %v", files)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	flaky := &flakyOutput{results: make(chan Result)}
+	s, err := NewSpool(flaky, "honeycomb://", Options{SpoolDir: dir, SpoolMaxMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// too big to fit
+	big := make([]byte, 2*1024*1024)
+	s.Add(event.Event{Data: map[string]interface{}{"big": string(big)}}, 1, nil)
+	if result := <-s.Results(); result.Spooled || result.StatusCode != 503 {
+		t.Errorf("expected the failure to be passed on, got %+v", result)
+	}
+	s.Close()
+	for range s.Results() {
+	}
+}
+
+func TestSpoolUnreadableSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spoolDir := filepath.Join(dir, "honeycomb")
+	os.MkdirAll(spoolDir, 0755)
+	// a line too long to read back
+	long := make([]byte, spoolSegmentSize+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	name := "spool-00000000000000000003.ndjson"
+	if err := ioutil.WriteFile(filepath.Join(spoolDir, name), long, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	flaky := &flakyOutput{results: make(chan Result), working: true}
+	s, err := NewSpool(flaky, "honeycomb://", Options{SpoolDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aside := filepath.Join(spoolDir, unreadablePrefix+name)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(aside); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the unreadable segment to be set aside")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+	for range s.Results() {
+	}
+	if _, err := os.Stat(filepath.Join(spoolDir, name)); !os.IsNotExist(err) {
+		t.Errorf("expected the segment to have been moved, got %v", err)
+	}
+
+	// a spool started later leaves it alone, and doesn't reuse its name
+	flaky = &flakyOutput{results: make(chan Result)}
+	s, err = NewSpool(flaky, "honeycomb://", Options{SpoolDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.segments) != 0 || s.nextSeq != 4 {
+		t.Errorf("expected no segments and the next to be 4, got %v and %d", s.segments, s.nextSeq)
+	}
+	s.Close()
+	for range s.Results() {
+	}
+}
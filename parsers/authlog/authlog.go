@@ -0,0 +1,216 @@
+// Package authlog parses the Linux auth.log (or secure) log, with particular
+// attention to sshd, sudo and PAM messages.
+package authlog
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// sampleLines are lines of auth.log
+var sampleLines = []string{
+	`Aug  1 12:00:00 web1 sshd[1234]: Accepted publickey for deploy from 10.0.0.5 port 52144 ssh2: RSA SHA256:Wv0Zb3v0ZmRhZmFkc2Zhc2Rm`,
+	`Aug  1 12:00:01 web1 sshd[1235]: Failed password for invalid user admin from 203.0.113.9 port 40022 ssh2`,
+	`Aug  1 12:00:02 web1 sudo:      bob : TTY=pts/0 ; PWD=/home/bob ; USER=root ; COMMAND=/bin/ls`,
+	`Aug  1 12:00:03 web1 sshd[1234]: pam_unix(sshd:session): session opened for user deploy by (uid=0)`,
+}
+
+const (
+	syslogTimeLayout = "Jan _2 15:04:05"
+)
+
+var (
+	// the standard syslog prefix, with either a traditional or RFC3339 timestamp
+	reSyslog = regexp.MustCompile(`^(?P<time>[A-Z][a-z]{2} [ 0-9][0-9] [0-9:]{8}|[0-9]{4}-[0-9]{2}-[0-9]{2}T[^ ]+) (?P<hostname>[^ ]+) (?P<program>[^ :\[]+)(?:\[(?P<pid>[0-9]+)\])?: (?P<message>.*)$`)
+	rePAM    = regexp.MustCompile(`^(?P<pam_module>pam_[a-z_]+)\((?P<pam_service>[^:]+):(?P<pam_type>[^)]+)\): (?P<pam_message>.*)$`)
+	reKV     = regexp.MustCompile(`([a-z]+)=([^ ]*)`)
+)
+
+// messagePattern recognizes one kind of message and names the action it
+// represents
+type messagePattern struct {
+	action string
+	re     *regexp.Regexp
+}
+
+var sshdPatterns = []messagePattern{
+	{"accepted", regexp.MustCompile(`^Accepted (?P<auth_method>[^ ]+) for (?P<user>[^ ]+) from (?P<source_ip>[^ ]+) port (?P<source_port>[0-9]+)(?: [^ :]+)?(?:: (?P<key_type>[^ ]+) (?P<key_fingerprint>[^ ]+))?`)},
+	{"failed", regexp.MustCompile(`^Failed (?P<auth_method>[^ ]+) for (?P<invalid_user>invalid user )?(?P<user>[^ ]*) from (?P<source_ip>[^ ]+) port (?P<source_port>[0-9]+)`)},
+	{"invalid_user", regexp.MustCompile(`^Invalid user (?P<user>[^ ]*) from (?P<source_ip>[^ ]+)(?: port (?P<source_port>[0-9]+))?`)},
+	{"connection_closed", regexp.MustCompile(`^Connection closed by (?:(?:authenticating|invalid) user (?P<user>[^ ]*) )?(?P<source_ip>[^ ]+) port (?P<source_port>[0-9]+)`)},
+	{"disconnected", regexp.MustCompile(`^(?:Received disconnect|Disconnected) from (?:(?:authenticating |invalid )?user (?P<user>[^ ]*) )?(?P<source_ip>[^ ]+) port (?P<source_port>[0-9]+)`)},
+	{"max_auth_tries", regexp.MustCompile(`^(?:error: )?maximum authentication attempts exceeded for (?:invalid user )?(?P<user>[^ ]*) from (?P<source_ip>[^ ]+) port (?P<source_port>[0-9]+)`)},
+}
+
+var sudoPatterns = []messagePattern{
+	{"command", regexp.MustCompile(`^\s*(?P<sudo_user>[^ ]+) : (?:(?P<sudo_error>[^;]+) ; )?TTY=(?P<tty>[^ ]+) ; PWD=(?P<pwd>[^;]+) ; USER=(?P<target_user>[^ ]+) ; (?:[A-Z]+=[^;]* ; )*COMMAND=(?P<command>.*)$`)},
+}
+
+var pamPatterns = []messagePattern{
+	{"session_opened", regexp.MustCompile(`^session opened for user (?P<user>[^ ]+)(?: by (?P<by>.*))?`)},
+	{"session_closed", regexp.MustCompile(`^session closed for user (?P<user>[^ ]+)`)},
+	{"auth_failure", regexp.MustCompile(`^authentication failure;`)},
+	{"check_pass", regexp.MustCompile(`^check pass; user (?P<user>.+)$`)},
+}
+
+// intFields are converted to numbers when found
+var intFields = map[string]bool{
+	"pid":         true,
+	"source_port": true,
+	"uid":         true,
+	"euid":        true,
+}
+
+type Options struct{}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Linux auth.log or secure logs, with the user, source address and action picked out of sshd, sudo and PAM messages.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			syslogTimeLayout + ", in --timezone or local time, in the latest year that isn't in the future",
+			time.RFC3339Nano,
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process auth log line")
+		}
+		ev, err := p.parseLine(line)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("skipping line; failed to parse.")
+			p.CountParseError(line, err)
+			continue
+		}
+		send <- ev
+	}
+	logrus.Debug("lines channel is closed, ending authlog processor")
+}
+
+type parseError struct{}
+
+func (e *parseError) Error() string {
+	return "line is not a syslog formatted line"
+}
+
+func (p *Parser) parseLine(line string) (event.Event, error) {
+	prefix := parsers.SubmatchMap(reSyslog, line)
+	if len(prefix) == 0 {
+		return event.Event{}, &parseError{}
+	}
+	data := make(map[string]interface{})
+	for k, v := range prefix {
+		if k != "time" && v != "" {
+			data[k] = v
+		}
+	}
+	msg := prefix["message"]
+	switch prefix["program"] {
+	case "sshd":
+		matchPatterns(sshdPatterns, msg, data)
+	case "sudo":
+		matchPatterns(sudoPatterns, msg, data)
+	}
+	// PAM messages can come from any program
+	if pam := parsers.SubmatchMap(rePAM, msg); len(pam) != 0 {
+		for k, v := range pam {
+			data[k] = v
+		}
+		matchPatterns(pamPatterns, pam["pam_message"], data)
+		delete(data, "pam_message")
+		if data["action"] == "auth_failure" {
+			// logname= uid=1000 euid=0 tty=/dev/pts/0 ruser=bob rhost=  user=bob
+			for _, kv := range reKV.FindAllStringSubmatch(pam["pam_message"], -1) {
+				if kv[2] != "" {
+					data[kv[1]] = kv[2]
+				}
+			}
+		}
+	}
+	if data["invalid_user"] != nil {
+		data["invalid_user"] = true
+	}
+	for k := range intFields {
+		if s, ok := data[k].(string); ok {
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				data[k] = i
+			}
+		}
+	}
+	return event.Event{
+		Timestamp: p.parseTime(prefix["time"]),
+		Data:      data,
+	}, nil
+}
+
+// matchPatterns adds the fields and action from the first pattern matching msg
+func matchPatterns(patterns []messagePattern, msg string, data map[string]interface{}) {
+	for _, pat := range patterns {
+		if !pat.re.MatchString(msg) {
+			continue
+		}
+		data["action"] = pat.action
+		for k, v := range parsers.SubmatchMap(pat.re, msg) {
+			if v != "" {
+				data[k] = strings.TrimSpace(v)
+			}
+		}
+		return
+	}
+}
+
+// parseTime handles both the traditional (yearless) syslog timestamp and
+// the RFC3339 one written by rsyslog's high precision format
+func (p *Parser) parseTime(raw string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t
+	}
+	t, err := time.ParseInLocation(syslogTimeLayout, raw, p.Location(time.Local))
+	if err != nil {
+		return p.nower.Now()
+	}
+	// traditional syslog timestamps have no year; assume the most recent one
+	// that doesn't put the line in the future
+	now := p.nower.Now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
@@ -0,0 +1,128 @@
+package authlog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2016-08-10T15:04:05Z")
+	return fakeTime
+}
+
+func TestParseLine(t *testing.T) {
+	time.Local = time.UTC
+	t1, _ := time.Parse(time.RFC3339, "2016-08-01T12:00:00Z")
+	testCases := []struct {
+		line     string
+		expected map[string]interface{}
+	}{
+		{
+			line: "Aug  1 12:00:00 web1 sshd[1234]: Accepted publickey for deploy from 10.0.0.5 port 52144 ssh2: RSA SHA256:Wv0Zb3v0ZmRh",
+			expected: map[string]interface{}{
+				"hostname":        "web1",
+				"program":         "sshd",
+				"pid":             int64(1234),
+				"message":         "Accepted publickey for deploy from 10.0.0.5 port 52144 ssh2: RSA SHA256:Wv0Zb3v0ZmRh",
+				"action":          "accepted",
+				"auth_method":     "publickey",
+				"user":            "deploy",
+				"source_ip":       "10.0.0.5",
+				"source_port":     int64(52144),
+				"key_type":        "RSA",
+				"key_fingerprint": "SHA256:Wv0Zb3v0ZmRh",
+			},
+		},
+		{
+			line: "Aug  1 12:00:00 web1 sshd[1235]: Failed password for invalid user admin from 203.0.113.9 port 40022 ssh2",
+			expected: map[string]interface{}{
+				"hostname":     "web1",
+				"program":      "sshd",
+				"pid":          int64(1235),
+				"message":      "Failed password for invalid user admin from 203.0.113.9 port 40022 ssh2",
+				"action":       "failed",
+				"auth_method":  "password",
+				"invalid_user": true,
+				"user":         "admin",
+				"source_ip":    "203.0.113.9",
+				"source_port":  int64(40022),
+			},
+		},
+		{
+			line: "Aug  1 12:00:00 web1 sudo:      bob : TTY=pts/0 ; PWD=/home/bob ; USER=root ; COMMAND=/bin/ls -l",
+			expected: map[string]interface{}{
+				"hostname":    "web1",
+				"program":     "sudo",
+				"message":     "     bob : TTY=pts/0 ; PWD=/home/bob ; USER=root ; COMMAND=/bin/ls -l",
+				"action":      "command",
+				"sudo_user":   "bob",
+				"tty":         "pts/0",
+				"pwd":         "/home/bob",
+				"target_user": "root",
+				"command":     "/bin/ls -l",
+			},
+		},
+		{
+			line: "Aug  1 12:00:00 web1 sshd[1234]: pam_unix(sshd:session): session opened for user deploy by (uid=0)",
+			expected: map[string]interface{}{
+				"hostname":    "web1",
+				"program":     "sshd",
+				"pid":         int64(1234),
+				"message":     "pam_unix(sshd:session): session opened for user deploy by (uid=0)",
+				"pam_module":  "pam_unix",
+				"pam_service": "sshd",
+				"pam_type":    "session",
+				"action":      "session_opened",
+				"user":        "deploy",
+				"by":          "(uid=0)",
+			},
+		},
+		{
+			line: "2016-08-01T12:00:00Z web1 sudo: pam_unix(sudo:auth): authentication failure; logname= uid=1000 euid=0 tty=/dev/pts/0 ruser=bob rhost=  user=bob",
+			expected: map[string]interface{}{
+				"hostname":    "web1",
+				"program":     "sudo",
+				"message":     "pam_unix(sudo:auth): authentication failure; logname= uid=1000 euid=0 tty=/dev/pts/0 ruser=bob rhost=  user=bob",
+				"pam_module":  "pam_unix",
+				"pam_service": "sudo",
+				"pam_type":    "auth",
+				"action":      "auth_failure",
+				"uid":         int64(1000),
+				"euid":        int64(0),
+				"tty":         "/dev/pts/0",
+				"ruser":       "bob",
+				"user":        "bob",
+			},
+		},
+	}
+	p := &Parser{nower: &FakeNower{}}
+	for i, tc := range testCases {
+		ev, err := p.parseLine(tc.line)
+		if err != nil {
+			t.Errorf("case %d: unexpected error %s", i, err)
+			continue
+		}
+		if !ev.Timestamp.Equal(t1) {
+			t.Errorf("case %d: expected time %s, got %s", i, t1, ev.Timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, tc.expected) {
+			t.Errorf("case %d: expected %+v, got %+v", i, tc.expected, ev.Data)
+		}
+	}
+	if _, err := p.parseLine("not a syslog line"); err == nil {
+		t.Error("expected an error for a non-syslog line")
+	}
+}
+
+func TestParseTimeYearRollover(t *testing.T) {
+	time.Local = time.UTC
+	p := &Parser{nower: &FakeNower{}}
+	// December lines read in August must be from last year
+	ts := p.parseTime("Dec 31 23:59:59")
+	if ts.Year() != 2015 {
+		t.Errorf("expected year 2015, got %s", ts)
+	}
+}
@@ -0,0 +1,188 @@
+// Package auto picks a parser for a log by sampling its first lines, running
+// them through each candidate parser and keeping whichever one turns the
+// most lines into events.
+package auto
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+type Options struct {
+	SampleLines int `long:"sample_lines" description:"Number of lines to sample from each file when choosing a parser" default:"50"`
+	SampleWait  int `long:"sample_wait" description:"Seconds to wait for sample_lines lines to arrive before choosing a parser from the lines seen so far" default:"5"`
+}
+
+// Candidate is a parser auto detection may choose
+type Candidate struct {
+	Name string
+	// New returns a freshly initialized instance of the parser. Candidates
+	// that fail to initialize (eg nginx without a config file) are skipped.
+	New func() (parsers.Parser, error)
+}
+
+type Parser struct {
+	// Candidates are tried in order; a later candidate must parse strictly
+	// more of the sample than an earlier one to be chosen over it, so more
+	// specific formats belong ahead of more permissive ones.
+	Candidates []Candidate
+	// Source names the file being parsed in log messages
+	Source string
+
+	conf Options
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	if p.conf.SampleLines <= 0 {
+		p.conf.SampleLines = 50
+	}
+	if len(p.Candidates) == 0 {
+		return errors.New("no candidate parsers to choose from")
+	}
+	return nil
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary: "Any log one of the other parsers reads: the first --auto.sample_lines lines of each file are run through each of them, and the one that makes the most events is used.",
+		Timestamps: []string{
+			"those of the parser chosen",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	sample, more := p.sample(lines)
+	if len(sample) == 0 {
+		logrus.Debug("lines channel is closed, ending auto processor")
+		return
+	}
+
+	chosen, name := p.choose(sample)
+	if chosen == nil {
+		logrus.WithFields(logrus.Fields{
+			"file":    p.Source,
+			"sampled": len(sample),
+		}).Error("Unable to find a parser that understands this log. Skipping it.")
+		for range lines {
+		}
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"file":   p.Source,
+		"parser": name,
+	}).Info("auto detected parser")
+
+	// replay the sample ahead of the rest of the lines
+	replay := make(chan string)
+	go func() {
+		defer close(replay)
+		for _, line := range sample {
+			replay <- line
+		}
+		if !more {
+			return
+		}
+		for line := range lines {
+			replay <- line
+		}
+	}()
+	chosen.ProcessLines(replay, send)
+	logrus.Debug("lines channel is closed, ending auto processor")
+}
+
+// sample collects up to SampleLines lines, giving up on collecting more
+// SampleWait seconds after the first one arrives. more is false if lines was
+// closed while sampling.
+func (p *Parser) sample(lines <-chan string) (sample []string, more bool) {
+	var deadline <-chan time.Time
+	for len(sample) < p.conf.SampleLines {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return sample, false
+			}
+			sample = append(sample, line)
+			if deadline == nil {
+				deadline = time.After(time.Duration(p.conf.SampleWait) * time.Second)
+			}
+		case <-deadline:
+			return sample, true
+		}
+	}
+	return sample, true
+}
+
+// Detect returns the name of the candidate that parses the most of sample,
+// or "" if none of them parse any of it
+func (p *Parser) Detect(sample []string) string {
+	_, name := p.choose(sample)
+	return name
+}
+
+// choose scores each candidate against the sample and returns a fresh
+// instance of the best one, or nil if none of them produced any events
+func (p *Parser) choose(sample []string) (parsers.Parser, string) {
+	bestScore := 0
+	var best Candidate
+	for _, candidate := range p.Candidates {
+		score, err := score(candidate, sample)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"parser": candidate.Name,
+				"err":    err,
+			}).Debug("skipping candidate parser that failed to initialize")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"file":   p.Source,
+			"parser": candidate.Name,
+			"score":  score,
+		}).Debug("scored candidate parser")
+		if score > bestScore {
+			bestScore = score
+			best = candidate
+		}
+	}
+	if bestScore == 0 {
+		return nil, ""
+	}
+	parser, err := best.New()
+	if err != nil {
+		return nil, ""
+	}
+	return parser, best.Name
+}
+
+// score counts the non-empty events a candidate produces from the sample
+func score(candidate Candidate, sample []string) (int, error) {
+	parser, err := candidate.New()
+	if err != nil {
+		return 0, err
+	}
+	lines := make(chan string)
+	events := make(chan event.Event)
+	go func() {
+		defer close(lines)
+		for _, line := range sample {
+			lines <- line
+		}
+	}()
+	go func() {
+		defer close(events)
+		parser.ProcessLines(lines, events)
+	}()
+	var count int
+	for ev := range events {
+		if len(ev.Data) > 0 {
+			count++
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,99 @@
+package auto
+
+import (
+	"testing"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/gelf"
+	"github.com/honeycombio/honeytail/parsers/htjson"
+)
+
+var candidates = []Candidate{
+	{
+		Name: "gelf",
+		New: func() (parsers.Parser, error) {
+			p := &gelf.Parser{}
+			return p, p.Init(&gelf.Options{})
+		},
+	},
+	{
+		Name: "json",
+		New: func() (parsers.Parser, error) {
+			p := &htjson.Parser{}
+			return p, p.Init(&htjson.Options{})
+		},
+	},
+}
+
+func TestChoose(t *testing.T) {
+	testCases := []struct {
+		sample   []string
+		expected string
+	}{
+		{
+			sample: []string{
+				`{"version":"1.1","host":"a","short_message":"hi","_user":"x"}`,
+				`{"version":"1.1","host":"a","short_message":"there"}`,
+			},
+			expected: "gelf",
+		},
+		{
+			sample: []string{
+				`{"a":1}`,
+				`{"version":"1.1","host":"a","short_message":"there"}`,
+				`{"b":2}`,
+			},
+			expected: "json",
+		},
+		{
+			sample:   []string{"plain text", "more plain text"},
+			expected: "",
+		},
+	}
+	p := &Parser{Candidates: candidates}
+	p.Init(&Options{})
+	for _, tc := range testCases {
+		parser, name := p.choose(tc.sample)
+		if name != tc.expected {
+			t.Errorf("expected %q to be chosen for %v, got %q", tc.expected, tc.sample, name)
+		}
+		if (parser == nil) != (tc.expected == "") {
+			t.Errorf("unexpected parser %v for %v", parser, tc.sample)
+		}
+		if detected := p.Detect(tc.sample); detected != name {
+			t.Errorf("expected Detect to agree with choose on %v, got %q", tc.sample, detected)
+		}
+	}
+}
+
+func TestProcessLines(t *testing.T) {
+	input := []string{`{"a":1}`, `{"a":2}`, `{"a":3}`}
+	p := &Parser{Candidates: candidates}
+	p.Init(&Options{SampleLines: 2})
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go func() {
+		for _, line := range input {
+			lines <- line
+		}
+		close(lines)
+	}()
+	go func() {
+		p.ProcessLines(lines, send)
+		close(send)
+	}()
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	// the sampled lines are replayed, so nothing gets lost
+	if len(events) != len(input) {
+		t.Fatalf("expected %d events, got %d", len(input), len(events))
+	}
+	for i, ev := range events {
+		if ev.Data["a"] != float64(i+1) {
+			t.Errorf("expected event %d to have a=%d, got %+v", i, i+1, ev.Data)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package cassandra parses Cassandra's system.log and debug.log, picking out
+// garbage collection pauses and slow query reports.
+package cassandra
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/normalizer"
+)
+
+// sampleLines are lines of system.log and debug.log
+var sampleLines = []string{
+	`INFO  [Service Thread] 2016-08-01 12:00:00,123 GCInspector.java:258 - G1 Young Generation GC in 230ms.  G1 Eden Space: 1234 -> 0;`,
+	`DEBUG [ScheduledTasks:1] 2016-08-01 12:00:05,000 MonitoringTask.java:173 - 2 operations were slow in the last 5000 msecs:`,
+	`<SELECT * FROM ks.tbl WHERE id = 1 LIMIT 100>, time 612 msec - slow timeout 500 msec`,
+	`<SELECT * FROM ks.tbl WHERE name = 'bob' LIMIT 100>, was slow 2 times: avg/min/max 600/550/650 msec - slow timeout 500 msec/cross-node`,
+}
+
+const timeLayout = "2006-01-02 15:04:05.000"
+
+var (
+	reHeader    = regexp.MustCompile(`^(?P<level>[A-Z]+)\s+\[(?P<thread>[^\]]+)\] (?P<time>[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9:,.]+) (?P<source>[^ ]+) - (?P<message>.*)$`)
+	reGC        = regexp.MustCompile(`^(?P<gc_type>.+?) GC in (?P<duration>[0-9]+)ms`)
+	reSlowStart = regexp.MustCompile(`^[0-9]+ operations were slow in the last [0-9]+ msecs:`)
+	reSlowOnce  = regexp.MustCompile(`^<(?P<statement>.*)>, time (?P<duration>[0-9]+) msec - slow timeout (?P<timeout>[0-9]+) msec(?P<cross>/cross-node)?`)
+	reSlowMany  = regexp.MustCompile(`^<(?P<statement>.*)>, was slow (?P<count>[0-9]+) times: avg/min/max (?P<avg>[0-9]+)/(?P<min>[0-9]+)/(?P<max>[0-9]+) msec - slow timeout (?P<timeout>[0-9]+) msec(?P<cross>/cross-node)?`)
+)
+
+type Options struct{}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Cassandra's system.log and debug.log, with garbage collection pauses and each slow query report picked out.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			timeLayout + ", with a comma or a dot before the milliseconds, in --timezone or local time",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	// slow query reports are a header line followed by one line per query;
+	// remember the header so the query lines can inherit its time and thread
+	var slowHeader map[string]string
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process cassandra log line")
+		}
+		if strings.HasPrefix(line, "<") {
+			if slowHeader == nil {
+				continue
+			}
+			if ev, ok := p.parseSlowQuery(slowHeader, line); ok {
+				send <- ev
+			}
+			continue
+		}
+		header := parsers.SubmatchMap(reHeader, line)
+		if len(header) == 0 {
+			slowHeader = nil
+			continue
+		}
+		slowHeader = nil
+		msg := header["message"]
+		switch {
+		case reSlowStart.MatchString(msg):
+			slowHeader = header
+		case reGC.MatchString(msg):
+			gc := parsers.SubmatchMap(reGC, msg)
+			data := baseData(header)
+			data["event_type"] = "gc"
+			data["gc_type"] = gc["gc_type"]
+			data["duration_ms"], _ = strconv.ParseFloat(gc["duration"], 64)
+			data["message"] = msg
+			send <- event.Event{
+				Timestamp: p.parseTime(header["time"]),
+				Data:      data,
+			}
+		default:
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("skipping cassandra log line that is neither a GC nor slow query")
+		}
+	}
+	logrus.Debug("lines channel is closed, ending cassandra processor")
+}
+
+// parseSlowQuery turns one query line of a slow query report into an event
+func (p *Parser) parseSlowQuery(header map[string]string, line string) (event.Event, bool) {
+	data := baseData(header)
+	data["event_type"] = "slow_query"
+	var m map[string]string
+	if m = parsers.SubmatchMap(reSlowOnce, line); len(m) != 0 {
+		data["duration_ms"], _ = strconv.ParseFloat(m["duration"], 64)
+		data["slow_count"] = int64(1)
+	} else if m = parsers.SubmatchMap(reSlowMany, line); len(m) != 0 {
+		data["duration_ms"], _ = strconv.ParseFloat(m["avg"], 64)
+		data["min_ms"], _ = strconv.ParseFloat(m["min"], 64)
+		data["max_ms"], _ = strconv.ParseFloat(m["max"], 64)
+		data["slow_count"], _ = strconv.ParseInt(m["count"], 10, 64)
+	} else {
+		return event.Event{}, false
+	}
+	data["statement"] = m["statement"]
+	data["normalized_statement"] = normalizer.Query(m["statement"])
+	data["slow_timeout_ms"], _ = strconv.ParseFloat(m["timeout"], 64)
+	data["cross_node"] = m["cross"] != ""
+	return event.Event{
+		Timestamp: p.parseTime(header["time"]),
+		Data:      data,
+	}, true
+}
+
+func baseData(header map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"level":  header["level"],
+		"thread": header["thread"],
+		"source": header["source"],
+	}
+}
+
+func (p *Parser) parseTime(raw string) time.Time {
+	t, err := time.ParseInLocation(timeLayout, strings.Replace(raw, ",", ".", 1), p.Location(time.Local))
+	if err != nil {
+		return p.nower.Now()
+	}
+	return t
+}
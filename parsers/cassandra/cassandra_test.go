@@ -0,0 +1,95 @@
+package cassandra
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func TestProcessLines(t *testing.T) {
+	time.Local = time.UTC
+	t1, _ := time.Parse(timeLayout, "2016-08-01 12:00:00.123")
+	t2, _ := time.Parse(timeLayout, "2016-08-01 12:00:05.000")
+	input := []string{
+		"INFO  [Service Thread] 2016-08-01 12:00:00,123 GCInspector.java:258 - G1 Young Generation GC in 230ms.  G1 Eden Space: 1234 -> 0;",
+		"INFO  [main] 2016-08-01 12:00:01,000 StorageService.java:100 - Node is up",
+		"DEBUG [ScheduledTasks:1] 2016-08-01 12:00:05,000 MonitoringTask.java:173 - 2 operations were slow in the last 5000 msecs:",
+		"<SELECT * FROM ks.tbl WHERE id = 1 LIMIT 100>, time 612 msec - slow timeout 500 msec",
+		"<SELECT * FROM ks.tbl WHERE name = 'bob' LIMIT 100>, was slow 2 times: avg/min/max 600/550/650 msec - slow timeout 500 msec/cross-node",
+	}
+	expected := []event.Event{
+		{
+			Timestamp: t1,
+			Data: map[string]interface{}{
+				"level":       "INFO",
+				"thread":      "Service Thread",
+				"source":      "GCInspector.java:258",
+				"event_type":  "gc",
+				"gc_type":     "G1 Young Generation",
+				"duration_ms": float64(230),
+				"message":     "G1 Young Generation GC in 230ms.  G1 Eden Space: 1234 -> 0;",
+			},
+		},
+		{
+			Timestamp: t2,
+			Data: map[string]interface{}{
+				"level":                "DEBUG",
+				"thread":               "ScheduledTasks:1",
+				"source":               "MonitoringTask.java:173",
+				"event_type":           "slow_query",
+				"statement":            "SELECT * FROM ks.tbl WHERE id = 1 LIMIT 100",
+				"normalized_statement": "SELECT * FROM ks.tbl WHERE id = ? LIMIT ?",
+				"duration_ms":          float64(612),
+				"slow_count":           int64(1),
+				"slow_timeout_ms":      float64(500),
+				"cross_node":           false,
+			},
+		},
+		{
+			Timestamp: t2,
+			Data: map[string]interface{}{
+				"level":                "DEBUG",
+				"thread":               "ScheduledTasks:1",
+				"source":               "MonitoringTask.java:173",
+				"event_type":           "slow_query",
+				"statement":            "SELECT * FROM ks.tbl WHERE name = 'bob' LIMIT 100",
+				"normalized_statement": "SELECT * FROM ks.tbl WHERE name = ? LIMIT ?",
+				"duration_ms":          float64(600),
+				"min_ms":               float64(550),
+				"max_ms":               float64(650),
+				"slow_count":           int64(2),
+				"slow_timeout_ms":      float64(500),
+				"cross_node":           true,
+			},
+		},
+	}
+	p := &Parser{nower: &FakeNower{}}
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go func() {
+		for _, line := range input {
+			lines <- line
+		}
+		close(lines)
+	}()
+	go func() {
+		p.ProcessLines(lines, send)
+		close(send)
+	}()
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+}
@@ -0,0 +1,183 @@
+// Package clickhouse parses the ClickHouse server text log, joining each
+// query's executeQuery lines into one event per query.
+package clickhouse
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/normalizer"
+)
+
+// sampleLines are lines of the server log. The {query id} is absent in
+// older versions.
+var sampleLines = []string{
+	`2016.08.01 12:00:00.123456 [ 12 ] {8a1b2c} <Debug> executeQuery: (from 127.0.0.1:54321) SELECT count() FROM hits WHERE id = 5`,
+	`2016.08.01 12:00:00.234567 [ 12 ] {8a1b2c} <Information> executeQuery: Read 100 rows, 1.00 KiB in 0.111 sec., 900 rows/sec., 9.00 KiB/sec.`,
+	`2016.08.01 12:00:01.000000 [ 13 ] {9d8e7f} <Error> executeQuery: Code: 60, e.displayText() = DB::Exception: Table default.x doesn't exist., e.what() = DB::Exception (from 127.0.0.1:54322) (in query: SELECT * FROM x)`,
+}
+
+const (
+	timeLayout = "2006.01.02 15:04:05.999999"
+	// forget queries that never logged a completion line once we're tracking
+	// this many
+	maxPending = 10000
+)
+
+var (
+	reHeader = regexp.MustCompile(`^(?P<time>[0-9]{4}\.[0-9]{2}\.[0-9]{2} [0-9:.]+) \[ *(?P<thread>[0-9]+) *\] (?:\{(?P<query_id>[^}]*)\} )?<(?P<level>[A-Za-z]+)> (?P<component>[^:]+): (?P<message>.*)$`)
+	reQuery  = regexp.MustCompile(`^\(from (?P<client>[^)]+)\)(?: \(comment: [^)]*\))? (?P<statement>.*)$`)
+	reRead   = regexp.MustCompile(`^Read (?P<rows>[0-9]+) rows, (?P<size>[0-9.]+) (?P<unit>[KMGT]?i?B) in (?P<seconds>[0-9.]+) sec\.`)
+	reError  = regexp.MustCompile(`^Code: (?P<code>[0-9]+), e\.displayText\(\) = (?P<exception>.*?)(?:, e\.what\(\) = [^(]*)?(?: \(from (?P<client>[^)]+)\))?(?: \(in query: (?P<statement>.*)\))?(?:, Stack trace.*)?$`)
+	units    = map[string]float64{
+		"B":   1,
+		"KiB": 1 << 10,
+		"MiB": 1 << 20,
+		"GiB": 1 << 30,
+		"TiB": 1 << 40,
+	}
+)
+
+type Options struct{}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// query is a started query waiting for its completion line
+type query struct {
+	timestamp time.Time
+	data      map[string]interface{}
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "The ClickHouse server text log, with each query's executeQuery lines joined into one event per query.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			timeLayout + ", in --timezone or local time",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	pending := make(map[string]*query)
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process clickhouse log line")
+		}
+		header := parsers.SubmatchMap(reHeader, line)
+		if len(header) == 0 || header["component"] != "executeQuery" {
+			continue
+		}
+		// queries are identified by their id when the server logs one,
+		// otherwise by the thread executing them
+		key := header["query_id"]
+		if key == "" {
+			key = "thread-" + header["thread"]
+		}
+		msg := header["message"]
+		switch {
+		case reQuery.MatchString(msg):
+			m := parsers.SubmatchMap(reQuery, msg)
+			data := baseData(header)
+			data["client"] = m["client"]
+			data["statement"] = m["statement"]
+			data["normalized_statement"] = normalizer.Query(m["statement"])
+			if len(pending) >= maxPending {
+				pending = make(map[string]*query)
+			}
+			pending[key] = &query{
+				timestamp: p.parseTime(header["time"]),
+				data:      data,
+			}
+		case reRead.MatchString(msg):
+			q, ok := pending[key]
+			if !ok {
+				continue
+			}
+			delete(pending, key)
+			m := parsers.SubmatchMap(reRead, msg)
+			q.data["read_rows"], _ = strconv.ParseInt(m["rows"], 10, 64)
+			if size, err := strconv.ParseFloat(m["size"], 64); err == nil {
+				q.data["read_bytes"] = int64(size * units[m["unit"]])
+			}
+			if secs, err := strconv.ParseFloat(m["seconds"], 64); err == nil {
+				q.data["duration_ms"] = secs * 1000
+			}
+			send <- event.Event{
+				Timestamp: q.timestamp,
+				Data:      q.data,
+			}
+		case reError.MatchString(msg):
+			m := parsers.SubmatchMap(reError, msg)
+			data := baseData(header)
+			ts := p.parseTime(header["time"])
+			if q, ok := pending[key]; ok {
+				delete(pending, key)
+				data = q.data
+				ts = q.timestamp
+				data["level"] = header["level"]
+			}
+			data["error_code"], _ = strconv.ParseInt(m["code"], 10, 64)
+			data["exception"] = m["exception"]
+			if m["client"] != "" {
+				data["client"] = m["client"]
+			}
+			if m["statement"] != "" {
+				data["statement"] = m["statement"]
+				data["normalized_statement"] = normalizer.Query(m["statement"])
+			}
+			send <- event.Event{
+				Timestamp: ts,
+				Data:      data,
+			}
+		}
+	}
+	logrus.Debug("lines channel is closed, ending clickhouse processor")
+}
+
+func baseData(header map[string]string) map[string]interface{} {
+	data := map[string]interface{}{
+		"level": header["level"],
+	}
+	data["thread_id"], _ = strconv.ParseInt(header["thread"], 10, 64)
+	if header["query_id"] != "" {
+		data["query_id"] = header["query_id"]
+	}
+	return data
+}
+
+func (p *Parser) parseTime(raw string) time.Time {
+	t, err := time.ParseInLocation(timeLayout, strings.TrimSpace(raw), p.Location(time.Local))
+	if err != nil {
+		return p.nower.Now()
+	}
+	return t
+}
@@ -0,0 +1,77 @@
+package clickhouse
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func TestProcessLines(t *testing.T) {
+	time.Local = time.UTC
+	t1, _ := time.Parse(timeLayout, "2016.08.01 12:00:00.123456")
+	t2, _ := time.Parse(timeLayout, "2016.08.01 12:00:01.000000")
+	input := []string{
+		"2016.08.01 12:00:00.123456 [ 12 ] {8a1b2c} <Debug> executeQuery: (from 127.0.0.1:54321) SELECT count() FROM hits WHERE id = 5",
+		"2016.08.01 12:00:00.200000 [ 12 ] {8a1b2c} <Debug> MergeTreeSelectProcessor: Reading 1 ranges",
+		"2016.08.01 12:00:00.234567 [ 12 ] {8a1b2c} <Information> executeQuery: Read 100 rows, 1.50 KiB in 0.111 sec., 900 rows/sec., 9.00 KiB/sec.",
+		"2016.08.01 12:00:01.000000 [ 13 ] <Debug> executeQuery: (from 127.0.0.1:54322) SELECT * FROM x",
+		"2016.08.01 12:00:01.100000 [ 13 ] <Error> executeQuery: Code: 60, e.displayText() = DB::Exception: Table default.x doesn't exist., e.what() = DB::Exception (from 127.0.0.1:54322) (in query: SELECT * FROM x)",
+	}
+	expected := []event.Event{
+		{
+			Timestamp: t1,
+			Data: map[string]interface{}{
+				"level":                "Debug",
+				"thread_id":            int64(12),
+				"query_id":             "8a1b2c",
+				"client":               "127.0.0.1:54321",
+				"statement":            "SELECT count() FROM hits WHERE id = 5",
+				"normalized_statement": "SELECT count() FROM hits WHERE id = ?",
+				"read_rows":            int64(100),
+				"read_bytes":           int64(1536),
+				"duration_ms":          float64(111),
+			},
+		},
+		{
+			Timestamp: t2,
+			Data: map[string]interface{}{
+				"level":                "Error",
+				"thread_id":            int64(13),
+				"client":               "127.0.0.1:54322",
+				"statement":            "SELECT * FROM x",
+				"normalized_statement": "SELECT * FROM x",
+				"error_code":           int64(60),
+				"exception":            "DB::Exception: Table default.x doesn't exist.",
+			},
+		},
+	}
+	p := &Parser{nower: &FakeNower{}}
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go func() {
+		for _, line := range input {
+			lines <- line
+		}
+		close(lines)
+	}()
+	go func() {
+		p.ProcessLines(lines, send)
+		close(send)
+	}()
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+}
@@ -0,0 +1,158 @@
+// Package cloudflare parses Cloudflare Logpush exports, which are one JSON
+// object per line with timestamps that default to nanoseconds since the
+// epoch.
+package cloudflare
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// sampleLines are lines of the Logpush http_requests dataset. Logpush jobs
+// can also be configured to emit unix seconds or RFC3339 strings for
+// timestamps; all three are understood.
+var sampleLines = []string{
+	`{"ClientIP":"192.0.2.1","ClientRequestHost":"example.com","ClientRequestMethod":"GET","ClientRequestURI":"/index.html","EdgeEndTimestamp":1470052800250000000,"EdgeResponseBytes":1234,"EdgeResponseStatus":200,"EdgeStartTimestamp":1470052800123456789,"RayID":"3a6050bcbe121a87"}`,
+}
+
+const (
+	defaultTimeField = "EdgeStartTimestamp"
+	endTimeField     = "EdgeEndTimestamp"
+)
+
+type Options struct {
+	TimeFieldName string `long:"timefield" description:"Name of the field that contains the event timestamp" default:"EdgeStartTimestamp"`
+}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	if p.conf.TimeFieldName == "" {
+		p.conf.TimeFieldName = defaultTimeField
+	}
+	p.nower = &RealNower{}
+	return nil
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Cloudflare Logpush exports, one JSON object per line.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			"a count since the epoch in s, ms, us or ns, or " + time.RFC3339Nano + ", in --cloudflare.timefield",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process cloudflare log line")
+		}
+		ev, err := p.parseLine(line)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+				"err":  err,
+			}).Debug("skipping line; failed to parse.")
+			p.CountParseError(line, err)
+			continue
+		}
+		send <- ev
+	}
+	logrus.Debug("lines channel is closed, ending cloudflare processor")
+}
+
+func (p *Parser) parseLine(line string) (event.Event, error) {
+	parsed := make(map[string]interface{})
+	// nanosecond timestamps don't fit in a float64, so keep numbers as
+	// their original text until we know what they are
+	dec := json.NewDecoder(bytes.NewReader([]byte(line)))
+	dec.UseNumber()
+	if err := dec.Decode(&parsed); err != nil {
+		return event.Event{}, err
+	}
+	data := make(map[string]interface{}, len(parsed))
+	var start, end time.Time
+	for k, v := range parsed {
+		// --cloudflare.timefield needn't end in Timestamp, eg Datetime
+		if k == p.conf.TimeFieldName {
+			if t, ok := p.parseTime(v); ok {
+				start = t
+				continue
+			}
+		}
+		if strings.HasSuffix(k, "Timestamp") {
+			if t, ok := p.parseTime(v); ok {
+				if k == endTimeField {
+					end = t
+				}
+				data[k] = t.Format(time.RFC3339Nano)
+				continue
+			}
+		}
+		data[k] = convert(v)
+	}
+	if !start.IsZero() && !end.IsZero() {
+		data["duration_ms"] = float64(end.Sub(start)) / float64(time.Millisecond)
+	}
+	if start.IsZero() {
+		start = p.nower.Now()
+	}
+	return event.Event{
+		Timestamp: start,
+		Data:      data,
+	}, nil
+}
+
+// parseTime understands the unixnano, unix and rfc3339 Logpush timestamp
+// formats
+func (p *Parser) parseTime(v interface{}) (time.Time, bool) {
+	if s, ok := v.(string); ok {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t, err == nil
+	}
+	return p.EpochUnit.FromValue(v)
+}
+
+// convert turns json.Numbers into int64s or float64s and re-encodes nested
+// values as JSON strings, the same way the json parser does
+func convert(v interface{}) interface{} {
+	switch typedVal := v.(type) {
+	case bool, string, nil:
+		return typedVal
+	case json.Number:
+		if i, err := typedVal.Int64(); err == nil {
+			return i
+		}
+		f, _ := typedVal.Float64()
+		return f
+	default:
+		rejsoned, _ := json.Marshal(v)
+		return string(rejsoned)
+	}
+}
@@ -0,0 +1,91 @@
+package cloudflare
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func TestParseLine(t *testing.T) {
+	start := time.Date(2016, 8, 1, 12, 0, 0, 123456789, time.UTC)
+	testCases := []struct {
+		line     string
+		ts       time.Time
+		expected map[string]interface{}
+	}{
+		{
+			line: `{"ClientIP":"192.0.2.1","ClientRequestMethod":"GET","EdgeEndTimestamp":1470052800250000000,"EdgeResponseBytes":1234,"EdgeResponseStatus":200,"EdgeStartTimestamp":1470052800123456789,"OriginResponseTime":0.5,"RequestHeaders":{"x-a":"b"}}`,
+			ts:   start,
+			expected: map[string]interface{}{
+				"ClientIP":            "192.0.2.1",
+				"ClientRequestMethod": "GET",
+				"EdgeEndTimestamp":    "2016-08-01T12:00:00.25Z",
+				"EdgeResponseBytes":   int64(1234),
+				"EdgeResponseStatus":  int64(200),
+				"OriginResponseTime":  0.5,
+				"RequestHeaders":      `{"x-a":"b"}`,
+				"duration_ms":         126.543211,
+			},
+		},
+		{
+			line: `{"EdgeStartTimestamp":"2016-08-01T12:00:00Z","RayID":"abc"}`,
+			ts:   start.Truncate(time.Second),
+			expected: map[string]interface{}{
+				"RayID": "abc",
+			},
+		},
+		{
+			line: `{"RayID":"abc"}`,
+			ts:   (&FakeNower{}).Now(),
+			expected: map[string]interface{}{
+				"RayID": "abc",
+			},
+		},
+	}
+	p := &Parser{
+		conf:  Options{TimeFieldName: defaultTimeField},
+		nower: &FakeNower{},
+	}
+	for _, tc := range testCases {
+		ev, err := p.parseLine(tc.line)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %s", tc.line, err)
+			continue
+		}
+		if !ev.Timestamp.Equal(tc.ts) {
+			t.Errorf("expected timestamp %s, got %s", tc.ts, ev.Timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, tc.expected) {
+			t.Errorf("expected %+v, got %+v", tc.expected, ev.Data)
+		}
+	}
+}
+
+func TestParseLineTimeField(t *testing.T) {
+	// firewall events have their time in Datetime
+	p := &Parser{
+		conf:  Options{TimeFieldName: "Datetime"},
+		nower: &FakeNower{},
+	}
+	ev, err := p.parseLine(`{"Datetime":"2016-08-01T12:00:00Z","EdgeStartTimestamp":1470052800123456789,"RayID":"abc"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC); !ev.Timestamp.Equal(ts) {
+		t.Errorf("expected timestamp %s, got %s", ts, ev.Timestamp)
+	}
+	expected := map[string]interface{}{
+		"EdgeStartTimestamp": "2016-08-01T12:00:00.123456789Z",
+		"RayID":              "abc",
+	}
+	if !reflect.DeepEqual(ev.Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, ev.Data)
+	}
+}
@@ -0,0 +1,150 @@
+// Package elasticsearch parses Elasticsearch search and indexing slow logs.
+package elasticsearch
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+	"github.com/honeycombio/honeytail/parsers/normalizer"
+)
+
+// sampleLines are lines of the search and indexing slow logs
+var sampleLines = []string{
+	`[2016-08-01 12:00:00,123][WARN ][index.search.slowlog.query] [node-1] [my_index][2] took[1.4s], took_millis[1400], types[doc], stats[], search_type[QUERY_THEN_FETCH], total_shards[5], source[{"query":{"match":{"name":"bob"}}}], extra_source[],`,
+	`[2016-08-01 12:00:00,456][INFO ][index.indexing.slowlog.index] [node-1] [my_index/AbCdEf] took[2.1ms], took_millis[2], type[doc], id[1], routing[], source[{"name":"bob"}]`,
+}
+
+const timeLayout = "2006-01-02 15:04:05.000"
+
+// errNotSlowLog is why lines that aren't slow log entries didn't parse
+var errNotSlowLog = errors.New("not a search or indexing slow log entry")
+
+var (
+	reHeader = regexp.MustCompile(`^\[(?P<time>[^\]]+)\]\[(?P<level>[A-Z]+) *\]\[(?P<logger>[^\]]+)\] \[(?P<node>[^\]]*)\] \[(?P<index>[^\]/]+)(?:/[^\]]*)?\](?:\[(?P<shard>[0-9]+)\])? (?P<rest>.*)$`)
+	// key[value] pairs; source can contain brackets so it's handled separately
+	reKV     = regexp.MustCompile(`([a-z_]+)\[([^\]]*)\]`)
+	reSource = regexp.MustCompile(`source\[(.*?)\](?:, extra_source\[.*?\])?,?\s*$`)
+)
+
+type Options struct{}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Elasticsearch search and indexing slow logs, with the timings, index and shard of each slow request and the shape of its query.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			timeLayout + ", with a comma or a dot before the milliseconds, in --timezone or local time",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process elasticsearch slow log line")
+		}
+		ev, ok := p.parseLine(line)
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("skipping line; not a slow log entry")
+			p.CountParseError(line, errNotSlowLog)
+			continue
+		}
+		send <- ev
+	}
+	logrus.Debug("lines channel is closed, ending elasticsearch processor")
+}
+
+func (p *Parser) parseLine(line string) (event.Event, bool) {
+	match := reHeader.FindStringSubmatch(line)
+	if match == nil {
+		return event.Event{}, false
+	}
+	header := make(map[string]string)
+	for i, name := range reHeader.SubexpNames() {
+		if name != "" {
+			header[name] = match[i]
+		}
+	}
+	data := map[string]interface{}{
+		"level":  header["level"],
+		"logger": header["logger"],
+		"node":   header["node"],
+		"index":  header["index"],
+	}
+	// index.search.slowlog.query -> query, index.indexing.slowlog.index -> index
+	if i := strings.LastIndex(header["logger"], "."); i != -1 {
+		data["slowlog_type"] = header["logger"][i+1:]
+	}
+	if shard, err := strconv.ParseInt(header["shard"], 10, 64); err == nil {
+		data["shard"] = shard
+	}
+	rest := header["rest"]
+	if m := reSource.FindStringSubmatchIndex(rest); m != nil {
+		source := rest[m[2]:m[3]]
+		if source != "" {
+			data["source"] = source
+			data["normalized_source"] = normalizer.JSON(source)
+		}
+		rest = rest[:m[0]]
+	}
+	for _, kv := range reKV.FindAllStringSubmatch(rest, -1) {
+		key, val := kv[1], kv[2]
+		switch key {
+		case "took":
+			// human readable version of took_millis
+		case "took_millis":
+			if ms, err := strconv.ParseFloat(val, 64); err == nil {
+				data["duration_ms"] = ms
+			}
+		case "total_shards":
+			if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+				data[key] = n
+			}
+		default:
+			if val != "" {
+				data[key] = val
+			}
+		}
+	}
+	ts, err := time.ParseInLocation(timeLayout, strings.Replace(header["time"], ",", ".", 1), p.Location(time.Local))
+	if err != nil {
+		ts = p.nower.Now()
+	}
+	return event.Event{
+		Timestamp: ts,
+		Data:      data,
+	}, true
+}
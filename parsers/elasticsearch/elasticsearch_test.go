@@ -0,0 +1,73 @@
+package elasticsearch
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func TestParseLine(t *testing.T) {
+	time.Local = time.UTC
+	t1, _ := time.Parse(timeLayout, "2016-08-01 12:00:00.123")
+	testCases := []struct {
+		line     string
+		expected map[string]interface{}
+	}{
+		{
+			line: `[2016-08-01 12:00:00,123][WARN ][index.search.slowlog.query] [node-1] [my_index][2] took[1.4s], took_millis[1400], types[doc], stats[], search_type[QUERY_THEN_FETCH], total_shards[5], source[{"query":{"match":{"name":"bob"}}}], extra_source[],`,
+			expected: map[string]interface{}{
+				"level":             "WARN",
+				"logger":            "index.search.slowlog.query",
+				"slowlog_type":      "query",
+				"node":              "node-1",
+				"index":             "my_index",
+				"shard":             int64(2),
+				"duration_ms":       float64(1400),
+				"types":             "doc",
+				"search_type":       "QUERY_THEN_FETCH",
+				"total_shards":      int64(5),
+				"source":            `{"query":{"match":{"name":"bob"}}}`,
+				"normalized_source": `{"query":{"match":{"name":"?"}}}`,
+			},
+		},
+		{
+			line: `[2016-08-01 12:00:00,123][INFO ][index.indexing.slowlog.index] [node-1] [my_index/AbCdEf] took[2.1ms], took_millis[2], type[doc], id[1], routing[], source[{"tags":["a"]}]`,
+			expected: map[string]interface{}{
+				"level":             "INFO",
+				"logger":            "index.indexing.slowlog.index",
+				"slowlog_type":      "index",
+				"node":              "node-1",
+				"index":             "my_index",
+				"duration_ms":       float64(2),
+				"type":              "doc",
+				"id":                "1",
+				"source":            `{"tags":["a"]}`,
+				"normalized_source": `{"tags":["?"]}`,
+			},
+		},
+	}
+	p := &Parser{nower: &FakeNower{}}
+	for i, tc := range testCases {
+		ev, ok := p.parseLine(tc.line)
+		if !ok {
+			t.Errorf("case %d: failed to parse", i)
+			continue
+		}
+		if !ev.Timestamp.Equal(t1) {
+			t.Errorf("case %d: expected time %s, got %s", i, t1, ev.Timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, tc.expected) {
+			t.Errorf("case %d: expected %+v, got %+v", i, tc.expected, ev.Data)
+		}
+	}
+	if _, ok := p.parseLine("[2016-08-01 12:00:00,123][INFO ][node] started"); ok {
+		t.Error("non slow log line should not parse")
+	}
+}
@@ -0,0 +1,124 @@
+// Package epoch converts timestamps expressed as a count since the unix epoch
+// into times, guessing the unit (seconds, milliseconds, microseconds or
+// nanoseconds) from the magnitude of the value, unless it's forced.
+package epoch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Unit is what a count since the epoch counts
+type Unit int
+
+const (
+	// Auto guesses the unit from the magnitude of the count
+	Auto Unit = iota
+	Seconds
+	Milliseconds
+	Microseconds
+	Nanoseconds
+)
+
+// ParseUnit parses auto, s, ms, us or ns
+func ParseUnit(s string) (Unit, error) {
+	switch s {
+	case "", "auto":
+		return Auto, nil
+	case "s":
+		return Seconds, nil
+	case "ms":
+		return Milliseconds, nil
+	case "us":
+		return Microseconds, nil
+	case "ns":
+		return Nanoseconds, nil
+	}
+	return Auto, fmt.Errorf("%q isn't an epoch unit: auto, s, ms, us or ns", s)
+}
+
+// Anything at or above these thresholds is assumed to be in the finer unit.
+// 1e11 seconds is in the year 5138 and 1e11 milliseconds is in 1973, so
+// there's no overlap for any time we're likely to see in a log.
+const (
+	msThreshold = 1e11
+	usThreshold = 1e14
+	nsThreshold = 1e17
+)
+
+// of returns u, or if it's Auto guesses the unit of a count of magnitude abs
+func (u Unit) of(abs float64) Unit {
+	switch {
+	case u != Auto:
+		return u
+	case abs >= nsThreshold:
+		return Nanoseconds
+	case abs >= usThreshold:
+		return Microseconds
+	case abs >= msThreshold:
+		return Milliseconds
+	default:
+		return Seconds
+	}
+}
+
+// FromInt converts an integer count of u since the epoch to a UTC time.
+func (u Unit) FromInt(n int64) time.Time {
+	switch u.of(math.Abs(float64(n))) {
+	case Nanoseconds:
+		return time.Unix(0, n).UTC()
+	case Microseconds:
+		return time.Unix(n/1e6, (n%1e6)*1e3).UTC()
+	case Milliseconds:
+		return time.Unix(n/1e3, (n%1e3)*1e6).UTC()
+	default:
+		return time.Unix(n, 0).UTC()
+	}
+}
+
+// FromFloat converts a possibly fractional count since the epoch to a UTC
+// time. Large values lose precision as floats; prefer FromInt or FromString
+// for nanosecond timestamps.
+func (u Unit) FromFloat(f float64) time.Time {
+	switch u.of(math.Abs(f)) {
+	case Nanoseconds:
+		return time.Unix(0, int64(f)).UTC()
+	case Microseconds:
+		f /= 1e6
+	case Milliseconds:
+		f /= 1e3
+	}
+	whole, frac := math.Modf(f)
+	return time.Unix(int64(whole), int64(frac*1e9)).UTC()
+}
+
+// FromString parses a decimal count since the epoch, such as "1470052800",
+// "1470052800.123" or "1470052800123456789". ok is false if s isn't a number.
+func (u Unit) FromString(s string) (t time.Time, ok bool) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return u.FromInt(n), true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return u.FromFloat(f), true
+	}
+	return time.Time{}, false
+}
+
+// FromValue converts a decoded JSON value (a float64, json.Number or numeric
+// string) to a time. ok is false if v doesn't hold a number.
+func (u Unit) FromValue(v interface{}) (t time.Time, ok bool) {
+	switch typedVal := v.(type) {
+	case int64:
+		return u.FromInt(typedVal), true
+	case float64:
+		return u.FromFloat(typedVal), true
+	case json.Number:
+		return u.FromString(string(typedVal))
+	case string:
+		return u.FromString(typedVal)
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,59 @@
+package epoch
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFromValue(t *testing.T) {
+	expected := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	withMillis := expected.Add(123 * time.Millisecond)
+	testCases := []struct {
+		in       interface{}
+		expected time.Time
+	}{
+		{int64(1470052800), expected},
+		{float64(1470052800.123), withMillis},
+		{float64(1470052800123), withMillis},
+		{"1470052800123456", expected.Add(123456 * time.Microsecond)},
+		{json.Number("1470052800123456789"), expected.Add(123456789 * time.Nanosecond)},
+		{int64(1470052800123456789), expected.Add(123456789 * time.Nanosecond)},
+	}
+	for _, tc := range testCases {
+		ts, ok := Auto.FromValue(tc.in)
+		if !ok {
+			t.Errorf("failed to convert %v", tc.in)
+			continue
+		}
+		// floats aren't exact below the microsecond
+		if d := ts.Sub(tc.expected); d > time.Microsecond || d < -time.Microsecond {
+			t.Errorf("converting %v: expected %s, got %s", tc.in, tc.expected, ts)
+		}
+	}
+	if _, ok := Auto.FromValue("yesterday"); ok {
+		t.Error("expected a non-numeric string to fail")
+	}
+	if _, ok := Auto.FromValue(true); ok {
+		t.Error("expected a bool to fail")
+	}
+}
+
+func TestForcedUnit(t *testing.T) {
+	unit, err := ParseUnit("ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// small enough to be taken for seconds, if the unit weren't forced
+	expected := time.Date(1970, 1, 2, 0, 0, 0, 0, time.UTC)
+	if ts := unit.FromInt(86400000); !ts.Equal(expected) {
+		t.Errorf("expected %s, got %s", expected, ts)
+	}
+	// floats aren't exact below the microsecond
+	if ts := unit.FromFloat(86400000.5); ts.Sub(expected).Round(time.Microsecond) != 500*time.Microsecond {
+		t.Errorf("expected %s, got %s", expected.Add(500*time.Microsecond), ts)
+	}
+	if _, err := ParseUnit("hours"); err == nil {
+		t.Error("expected an unknown unit to fail")
+	}
+}
@@ -0,0 +1,344 @@
+// Package exec hands lines to a command to parse, so logs in formats
+// honeytail doesn't know can be parsed by a script in any language.
+//
+// The command is started once for each file and spoken to in JSON, one
+// message per line. honeytail greets it on stdin with
+//
+//	{"protocol":1}
+//
+// and it must answer on stdout with the same before it's given any lines.
+// Each line is then written as
+//
+//	{"line":"the line as read"}
+//
+// and the command answers each, in order, with
+//
+//	{"events":[{"time":"2006-01-02T15:04:05Z","data":{"field":"value"}}],"error":"why the line couldn't be parsed"}
+//
+// where both events and error may be left out, eg while it holds on to the
+// lines of a multi-line entry. time is RFC3339 or a count since the epoch,
+// and now if it's left out. Once the input has been read, stdin is closed,
+// and the command may write one last answer with anything it held on to
+// before exiting. Each answer must be flushed as it's written, as stdout isn't
+// a terminal, eg with print(..., flush=True) in Python. What the command
+// writes to stderr is passed through to honeytail's.
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	osexec "os/exec"
+	"runtime"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// protocolVersion is the version of the protocol spoken to the command,
+// which goes up if it changes in a way old commands won't understand
+const protocolVersion = 1
+
+// maxPending is how many lines may be written to the command ahead of its
+// answers
+const maxPending = 1000
+
+type Options struct {
+	Command          string        `long:"command" description:"Command to run with the shell to parse lines, eg 'python3 parse.py'. It's given each line on stdin and answers with the events parsed from it on stdout, as honeytail parsers describe exec explains"`
+	HandshakeTimeout time.Duration `long:"handshake_timeout" description:"How long --exec.command has to start up and answer honeytail's greeting" default:"10s"`
+}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	cmd   *osexec.Cmd
+	stdin io.WriteCloser
+	in    *bufio.Writer
+	out   *bufio.Scanner
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// request is what's written to the command: the greeting, then each line
+type request struct {
+	Protocol int     `json:"protocol,omitempty"`
+	Line     *string `json:"line,omitempty"`
+}
+
+// response is what the command answers with: the greeting, then what it
+// made of each line
+type response struct {
+	Protocol int `json:"protocol"`
+	Events   []struct {
+		Time interface{}            `json:"time"`
+		Data map[string]interface{} `json:"data"`
+	} `json:"events"`
+	Error string `json:"error"`
+}
+
+// Init starts the command and waits for it to answer the greeting
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	if p.conf.Command == "" {
+		return errors.New("the exec parser needs --exec.command")
+	}
+	cmd := shellCommand(p.conf.Command)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"command": p.conf.Command,
+	}).Debug("starting the exec parser's command")
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("can't start --exec.command %q: %s", p.conf.Command, err)
+	}
+	p.cmd = cmd
+	p.stdin = stdin
+	p.in = bufio.NewWriter(stdin)
+	p.out = bufio.NewScanner(stdout)
+	// events can be a lot bigger than the lines they're made from
+	p.out.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if err := p.handshake(); err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		p.cmd = nil
+		return fmt.Errorf("--exec.command %q: %s", p.conf.Command, err)
+	}
+	return nil
+}
+
+// shellCommand runs command with the shell, as --writekey_command does
+func shellCommand(command string) *osexec.Cmd {
+	if runtime.GOOS == "windows" {
+		return osexec.Command("cmd", "/C", command)
+	}
+	return osexec.Command("sh", "-c", command)
+}
+
+// handshake greets the command and checks it answers with the same protocol
+// version within --exec.handshake_timeout
+func (p *Parser) handshake() error {
+	// a command that's already exited can't be greeted, which is better
+	// told by there being no answer
+	if err := p.write(request{Protocol: protocolVersion}); err == nil {
+		p.in.Flush()
+	}
+	answered := make(chan error, 1)
+	go func() {
+		if !p.out.Scan() {
+			answered <- fmt.Errorf("exited without answering honeytail's greeting: %v", p.out.Err())
+			return
+		}
+		var answer response
+		if err := json.Unmarshal(p.out.Bytes(), &answer); err != nil {
+			answered <- fmt.Errorf("answered honeytail's greeting with something other than JSON: %q", p.out.Text())
+			return
+		}
+		if answer.Protocol != protocolVersion {
+			answered <- fmt.Errorf("speaks protocol version %d, not %d", answer.Protocol, protocolVersion)
+			return
+		}
+		answered <- nil
+	}()
+	select {
+	case err := <-answered:
+		return err
+	case <-time.After(p.conf.HandshakeTimeout):
+		return errors.New("didn't answer honeytail's greeting within --exec.handshake_timeout")
+	}
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary: "Any logs, parsed by --exec.command. honeytail starts it for each file and writes {\"protocol\":1} to its stdin, which it must answer with the same on stdout. " +
+			"Each line is then written as {\"line\":\"...\"}, and answered in order with {\"events\":[{\"time\":...,\"data\":{...}}],\"error\":\"...\"}, where both may be left out. " +
+			"When the input ends stdin is closed, and the command may write one last answer with any events it held on to.",
+		Timestamps: []string{
+			"RFC3339, or a count since the epoch, in each event's time, or now if it's left out",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	pending := make(chan string, maxPending)
+	answered := make(chan struct{})
+	go func() {
+		defer close(answered)
+		p.readAnswers(pending, send)
+	}()
+	p.writeLines(lines, pending)
+	<-answered
+	if err := p.cmd.Wait(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"command": p.conf.Command,
+			"err":     err,
+		}).Error("the exec parser's command failed")
+	}
+	p.cmd = nil
+	logrus.Debug("lines channel is closed, ending exec processor")
+}
+
+// Close stops the command, for a parser that's been set up, eg to check
+// --exec.command works, but won't be given any lines. Once ProcessLines has
+// returned the command has already exited, and Close does nothing.
+func (p *Parser) Close() error {
+	if p.cmd == nil {
+		return nil
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	// killed, it's expected to fail
+	p.cmd.Wait()
+	p.cmd = nil
+	return nil
+}
+
+// writeLines writes each line to the command, noting it in pending to be
+// matched up with its answer, then closes the command's stdin
+func (p *Parser) writeLines(lines <-chan string, pending chan<- string) {
+	defer close(pending)
+	var failed error
+	for line := range lines {
+		if failed != nil {
+			p.CountParseError(line, failed)
+			continue
+		}
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Handing line to the exec parser's command")
+		}
+		line := line
+		select {
+		case pending <- line:
+		default:
+			// the command's answers are waiting on the lines still to be
+			// written to it
+			p.in.Flush()
+			pending <- line
+		}
+		err := p.write(request{Line: &line})
+		// flush once there's nothing more to write straight away, rather
+		// than for every line
+		if err == nil && len(lines) == 0 {
+			err = p.in.Flush()
+		}
+		if err != nil {
+			failed = fmt.Errorf("can't write to --exec.command: %s", err)
+			logrus.WithFields(logrus.Fields{
+				"command": p.conf.Command,
+				"err":     err,
+			}).Error("the exec parser's command stopped reading lines")
+		}
+	}
+	p.in.Flush()
+	p.stdin.Close()
+}
+
+// write writes one message to the command
+func (p *Parser) write(req request) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if _, err := p.in.Write(b); err != nil {
+		return err
+	}
+	return p.in.WriteByte('\n')
+}
+
+// readAnswers sends the events from each of the command's answers, counting
+// the lines it couldn't parse, until it exits
+func (p *Parser) readAnswers(pending <-chan string, send chan<- event.Event) {
+	for p.out.Scan() {
+		// an answer once the input's been read isn't to any one line
+		line := <-pending
+		var answer response
+		if err := json.Unmarshal(p.out.Bytes(), &answer); err != nil {
+			p.CountParseError(line, fmt.Errorf("--exec.command answered with something other than JSON: %q", p.out.Text()))
+			continue
+		}
+		if answer.Error != "" {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+				"err":  answer.Error,
+			}).Debug("skipping line; failed to parse.")
+			p.CountParseError(line, errors.New(answer.Error))
+		}
+		for _, ev := range answer.Events {
+			ts, err := p.timestamp(ev.Time)
+			if err != nil {
+				p.CountParseError(line, err)
+				continue
+			}
+			data := make(map[string]interface{}, len(ev.Data))
+			for k, v := range ev.Data {
+				data[k] = flatten(v)
+			}
+			send <- event.Event{
+				Timestamp: ts,
+				Data:      data,
+			}
+		}
+	}
+	if err := p.out.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"command": p.conf.Command,
+			"err":     err,
+		}).Error("can't read the exec parser's command's answers")
+	}
+	for line := range pending {
+		p.CountParseError(line, errors.New("--exec.command exited without answering"))
+	}
+}
+
+// timestamp reads an event's time, which is now if it's left out
+func (p *Parser) timestamp(v interface{}) (time.Time, error) {
+	if v == nil {
+		return p.nower.Now(), nil
+	}
+	if s, ok := v.(string); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return ts, nil
+		}
+	}
+	if ts, ok := p.EpochUnit.FromValue(v); ok {
+		return ts, nil
+	}
+	return time.Time{}, fmt.Errorf("--exec.command gave an event a time that's neither RFC3339 nor a count since the epoch: %v", v)
+}
+
+// flatten re-encodes nested values as JSON strings, the same way the json
+// parser does
+func flatten(v interface{}) interface{} {
+	switch typedVal := v.(type) {
+	case bool, string, float64, nil:
+		return typedVal
+	default:
+		rejsoned, _ := json.Marshal(v)
+		return string(rejsoned)
+	}
+}
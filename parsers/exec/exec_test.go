@@ -0,0 +1,217 @@
+package exec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+// helperCommand is a command running this test binary as an exec parser,
+// behaving as mode says
+func helperCommand(mode string) string {
+	return fmt.Sprintf("%q -test.run=TestHelperParser -- %s", os.Args[0], mode)
+}
+
+// TestHelperParser isn't a real test: it's the command the other tests
+// run. It answers lines of key=value pairs with an event of them, "bad" with
+// an error, and holds on to lines starting with a space, sending them with
+// the line before them once the next line or the end of the input comes.
+func TestHelperParser(t *testing.T) {
+	mode := ""
+	for i, arg := range os.Args {
+		if arg == "--" && i+1 < len(os.Args) {
+			mode = os.Args[i+1]
+		}
+	}
+	if mode == "" {
+		return
+	}
+	defer os.Exit(0)
+	in := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+	in.Scan()
+	switch mode {
+	case "mute":
+		time.Sleep(5 * time.Second)
+		return
+	case "old":
+		out.Encode(map[string]int{"protocol": 0})
+		return
+	}
+	out.Encode(map[string]int{"protocol": 1})
+	var held map[string]interface{}
+	answer := func() map[string]interface{} {
+		a := map[string]interface{}{}
+		if held != nil {
+			a["events"] = []interface{}{map[string]interface{}{"time": 1385053862.5, "data": held}}
+			held = nil
+		}
+		return a
+	}
+	for in.Scan() {
+		var req struct{ Line string }
+		json.Unmarshal(in.Bytes(), &req)
+		switch {
+		case mode == "crash":
+			os.Exit(1)
+		case req.Line == "bad":
+			a := answer()
+			a["error"] = "can't parse bad"
+			out.Encode(a)
+		case strings.HasPrefix(req.Line, " ") && held != nil:
+			held["continued"] = strings.TrimSpace(req.Line)
+			out.Encode(map[string]interface{}{})
+		default:
+			a := answer()
+			held = map[string]interface{}{}
+			for _, pair := range strings.Fields(req.Line) {
+				kv := strings.SplitN(pair, "=", 2)
+				held[kv[0]] = kv[1]
+			}
+			if held["nested"] != nil {
+				held["nested"] = map[string]interface{}{"a": 1}
+			}
+			out.Encode(a)
+		}
+	}
+	out.Encode(answer())
+}
+
+func process(t *testing.T, p *Parser, lines ...string) []event.Event {
+	in := make(chan string)
+	out := make(chan event.Event)
+	go func() {
+		for _, line := range lines {
+			in <- line
+		}
+		close(in)
+	}()
+	go func() {
+		p.ProcessLines(in, out)
+		close(out)
+	}()
+	var events []event.Event
+	for ev := range out {
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestProcessLines(t *testing.T) {
+	p := &Parser{}
+	p.Configure(parsers.Settings{Errors: parsers.NewErrorCounter(nil)})
+	if err := p.Init(&Options{Command: helperCommand("parse"), HandshakeTimeout: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	events := process(t, p, "a=1 b=x", " more", "bad", "c=2 nested=y")
+	expected := []map[string]interface{}{
+		{"a": "1", "b": "x", "continued": "more"},
+		{"c": "2", "nested": `{"a":1}`},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %+v", len(expected), events)
+	}
+	for i, ev := range events {
+		if !reflect.DeepEqual(ev.Data, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], ev.Data)
+		}
+		if !ev.Timestamp.Equal(time.Unix(1385053862, 500000000)) {
+			t.Errorf("unexpected timestamp %s", ev.Timestamp)
+		}
+	}
+	if errs := p.Errors.Count(); errs != 1 {
+		t.Errorf("expected the bad line to be a parse error, got %d", errs)
+	}
+}
+
+func TestCommandExits(t *testing.T) {
+	p := &Parser{}
+	p.Configure(parsers.Settings{Errors: parsers.NewErrorCounter(nil)})
+	if err := p.Init(&Options{Command: helperCommand("crash"), HandshakeTimeout: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	lines := make([]string, 50)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("n=%d", i)
+	}
+	if events := process(t, p, lines...); len(events) != 0 {
+		t.Errorf("expected no events, got %+v", events)
+	}
+	if errs := p.Errors.Count(); errs != int64(len(lines)) {
+		t.Errorf("expected every line to be a parse error, got %d", errs)
+	}
+}
+
+func TestClose(t *testing.T) {
+	p := &Parser{}
+	if err := p.Init(&Options{Command: helperCommand("parse"), HandshakeTimeout: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	cmd := p.cmd
+	p.Close()
+	if cmd.ProcessState == nil {
+		t.Error("expected Close to stop the command")
+	}
+	// closing again, or after the lines have been processed, does nothing
+	p.Close()
+	p = &Parser{}
+	if err := p.Init(&Options{Command: helperCommand("parse"), HandshakeTimeout: 10 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	process(t, p, "a=1")
+	p.Close()
+}
+
+func TestHandshake(t *testing.T) {
+	for _, tc := range []struct {
+		command string
+		err     string
+	}{
+		{"", "needs --exec.command"},
+		{helperCommand("old"), "speaks protocol version 0, not 1"},
+		{helperCommand("mute"), "didn't answer honeytail's greeting"},
+		{"exit 3", "exited without answering"},
+	} {
+		p := &Parser{}
+		err := p.Init(&Options{Command: tc.command, HandshakeTimeout: time.Second})
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected %q to fail the handshake with %q, got %v", tc.command, tc.err, err)
+		}
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	p := &Parser{nower: &FakeNower{}}
+	for _, tc := range []struct {
+		in       interface{}
+		expected time.Time
+	}{
+		{nil, p.nower.Now()},
+		{"2013-11-21T17:11:02.25Z", time.Date(2013, 11, 21, 17, 11, 2, 250000000, time.UTC)},
+		{float64(1385053862), time.Unix(1385053862, 0)},
+		{"1385053862000", time.Unix(1385053862, 0)},
+	} {
+		ts, err := p.timestamp(tc.in)
+		if err != nil || !ts.Equal(tc.expected) {
+			t.Errorf("expected %v to be %s, got %s, %v", tc.in, tc.expected, ts, err)
+		}
+	}
+	if _, err := p.timestamp("yesterday"); err == nil {
+		t.Error("expected an error for a time that can't be read")
+	}
+}
@@ -0,0 +1,201 @@
+// Package fastly parses Fastly real-time log streaming output, either the
+// default Apache common log format or a custom JSON log format, with or
+// without the syslog header Fastly prepends to each line.
+package fastly
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// sampleLines are lines of the default and a custom JSON log format. Custom
+// JSON formats often log time.start.usec or similar, so numeric timestamps
+// are converted from whatever epoch unit they're in.
+var sampleLines = []string{
+	`<134>2016-08-01T12:00:00Z cache-sjc3128 logname[12345]: 192.0.2.1 "-" "-" [01/Aug/2016:12:00:00 +0000] "GET /index.html HTTP/1.1" 200 1234`,
+	`<134>2016-08-01T12:00:00Z cache-sjc3128 logname[12345]: {"time_start":1470052800123456,"time_elapsed_usec":5021,"url":"/index.html","status":200}`,
+}
+
+const commonTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// errNotFastly is why lines that aren't Fastly log lines didn't parse
+var errNotFastly = errors.New("not a Fastly log line in the common log format or JSON")
+
+var (
+	reSyslog = regexp.MustCompile(`^<[0-9]+>(?P<time>\S+) (?P<cache_node>\S+) (?P<log_name>[^\[:\s]+)(?:\[[0-9]+\])?: (?P<payload>.*)$`)
+	reCommon = regexp.MustCompile(`^(?P<client_ip>\S+) "?(?P<ident>[^" ]*)"? "?(?P<user>[^" ]*)"? \[(?P<time>[^\]]+)\] "(?P<method>\S+) (?P<url>\S+)(?: (?P<protocol>[^"]+))?" (?P<status>[0-9]{3}) (?P<bytes>\S+)`)
+
+	possibleTimeFieldNames = []string{
+		"timestamp", "time_start", "start_time", "time",
+	}
+)
+
+type Options struct {
+	TimeFieldName string `long:"timefield" description:"Name of the field in a JSON log format that contains the event timestamp"`
+}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Fastly real-time log streaming, in the default Apache common log format or a custom JSON format, with or without the syslog header Fastly adds.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			commonTimeLayout + ", in the common log format",
+			"a count since the epoch in s, ms, us or ns, or " + time.RFC3339Nano + ", in JSON formats' --fastly.timefield or one of " + strings.Join(possibleTimeFieldNames, ", "),
+			time.RFC3339Nano + ", in the syslog header, if the line has no timestamp of its own",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process fastly log line")
+		}
+		ev, ok := p.parseLine(line)
+		if !ok {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("skipping line; failed to parse.")
+			p.CountParseError(line, errNotFastly)
+			continue
+		}
+		send <- ev
+	}
+	logrus.Debug("lines channel is closed, ending fastly processor")
+}
+
+func (p *Parser) parseLine(line string) (event.Event, bool) {
+	var syslogTime time.Time
+	data := make(map[string]interface{})
+	if m := parsers.SubmatchMap(reSyslog, line); len(m) > 0 {
+		syslogTime, _ = time.Parse(time.RFC3339Nano, m["time"])
+		data["cache_node"] = m["cache_node"]
+		data["log_name"] = m["log_name"]
+		line = m["payload"]
+	}
+
+	var ts time.Time
+	if len(line) > 0 && line[0] == '{' {
+		parsed := make(map[string]interface{})
+		// epoch nanoseconds don't fit in a float64, so keep numbers as
+		// their original text until we know what they are
+		dec := json.NewDecoder(bytes.NewReader([]byte(line)))
+		dec.UseNumber()
+		if err := dec.Decode(&parsed); err != nil {
+			return event.Event{}, false
+		}
+		for k, v := range parsed {
+			data[k] = convert(v)
+		}
+		ts = p.getTimestamp(data)
+	} else {
+		m := parsers.SubmatchMap(reCommon, line)
+		if len(m) == 0 {
+			return event.Event{}, false
+		}
+		for _, k := range []string{"client_ip", "ident", "user", "method", "url", "protocol"} {
+			if m[k] != "" && m[k] != "-" {
+				data[k] = m[k]
+			}
+		}
+		data["status"], _ = strconv.ParseInt(m["status"], 10, 64)
+		if b, err := strconv.ParseInt(m["bytes"], 10, 64); err == nil {
+			data["bytes"] = b
+		}
+		ts, _ = time.Parse(commonTimeLayout, m["time"])
+	}
+
+	if ts.IsZero() {
+		ts = syslogTime
+	}
+	if ts.IsZero() {
+		ts = p.nower.Now()
+	}
+	return event.Event{
+		Timestamp: ts,
+		Data:      data,
+	}, true
+}
+
+// getTimestamp pulls the event time out of the configured or a well known
+// time field, removing it from the event when it parses
+func (p *Parser) getTimestamp(data map[string]interface{}) time.Time {
+	fields := possibleTimeFieldNames
+	if p.conf.TimeFieldName != "" {
+		fields = []string{p.conf.TimeFieldName}
+	}
+	for _, field := range fields {
+		v, found := data[field]
+		if !found {
+			continue
+		}
+		var t time.Time
+		var ok bool
+		if s, isString := v.(string); isString {
+			if t, ok = p.EpochUnit.FromString(s); !ok {
+				var err error
+				t, err = time.Parse(time.RFC3339Nano, s)
+				ok = err == nil
+			}
+		} else {
+			t, ok = p.EpochUnit.FromValue(v)
+		}
+		if ok {
+			delete(data, field)
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// convert turns json.Numbers into int64s or float64s and re-encodes nested
+// values as JSON strings, the same way the json parser does
+func convert(v interface{}) interface{} {
+	switch typedVal := v.(type) {
+	case bool, string, nil:
+		return typedVal
+	case json.Number:
+		if i, err := typedVal.Int64(); err == nil {
+			return i
+		}
+		f, _ := typedVal.Float64()
+		return f
+	default:
+		rejsoned, _ := json.Marshal(v)
+		return string(rejsoned)
+	}
+}
@@ -0,0 +1,84 @@
+package fastly
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func TestParseLine(t *testing.T) {
+	start := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		line     string
+		ts       time.Time
+		expected map[string]interface{}
+	}{
+		{
+			line: `<134>2016-08-01T12:00:05Z cache-sjc3128 logname[12345]: 192.0.2.1 "-" "-" [01/Aug/2016:12:00:00 +0000] "GET /index.html HTTP/1.1" 200 1234`,
+			ts:   start,
+			expected: map[string]interface{}{
+				"cache_node": "cache-sjc3128",
+				"log_name":   "logname",
+				"client_ip":  "192.0.2.1",
+				"method":     "GET",
+				"url":        "/index.html",
+				"protocol":   "HTTP/1.1",
+				"status":     int64(200),
+				"bytes":      int64(1234),
+			},
+		},
+		{
+			line: `<134>2016-08-01T12:00:05Z cache-sjc3128 logname[12345]: {"time_start":1470052800123456,"time_elapsed_usec":5021,"url":"/index.html","status":200,"ratio":0.5}`,
+			ts:   start.Add(123456 * time.Microsecond),
+			expected: map[string]interface{}{
+				"cache_node":        "cache-sjc3128",
+				"log_name":          "logname",
+				"time_elapsed_usec": int64(5021),
+				"url":               "/index.html",
+				"status":            int64(200),
+				"ratio":             0.5,
+			},
+		},
+		{
+			// no usable time in the payload falls back to the syslog header
+			line: `<134>2016-08-01T12:00:05Z cache-sjc3128 logname: {"url":"/"}`,
+			ts:   start.Add(5 * time.Second),
+			expected: map[string]interface{}{
+				"cache_node": "cache-sjc3128",
+				"log_name":   "logname",
+				"url":        "/",
+			},
+		},
+		{
+			line: `{"timestamp":"1470052800123456789","url":"/"}`,
+			ts:   start.Add(123456789 * time.Nanosecond),
+			expected: map[string]interface{}{
+				"url": "/",
+			},
+		},
+	}
+	p := &Parser{nower: &FakeNower{}}
+	for _, tc := range testCases {
+		ev, ok := p.parseLine(tc.line)
+		if !ok {
+			t.Errorf("failed to parse %q", tc.line)
+			continue
+		}
+		if !ev.Timestamp.Equal(tc.ts) {
+			t.Errorf("expected timestamp %s, got %s", tc.ts, ev.Timestamp)
+		}
+		if !reflect.DeepEqual(ev.Data, tc.expected) {
+			t.Errorf("expected %+v, got %+v", tc.expected, ev.Data)
+		}
+	}
+	if _, ok := p.parseLine("garbage"); ok {
+		t.Error("expected garbage not to parse")
+	}
+}
@@ -0,0 +1,139 @@
+// Package gelf parses Graylog Extended Log Format messages, one JSON encoded
+// GELF message per line.
+package gelf
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// sampleLines are GELF messages. This one becomes an event at
+// 2013-11-21T17:11:02.3072Z with
+//
+// {"host":"example.org","short_message":"A short message","full_message":"Backtrace here\n\nmore stuff","level":1,"level_name":"alert","user_id":9001,"some_info":"foo"}
+var sampleLines = []string{
+	`{"version":"1.1","host":"example.org","short_message":"A short message","full_message":"Backtrace here\n\nmore stuff","timestamp":1385053862.3072,"level":1,"_user_id":9001,"_some_info":"foo"}`,
+}
+
+// syslog severity names for the GELF level field
+var levelNames = []string{
+	"emergency", "alert", "critical", "error", "warning", "notice", "informational", "debug",
+}
+
+type Options struct {
+	KeepPrefix bool `long:"keep_prefix" description:"Keep the leading underscore on GELF additional fields instead of stripping it"`
+}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Graylog Extended Log Format messages, one JSON encoded message per line, with the leading underscore taken off additional fields and level named.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			"seconds since the epoch, with any fraction of a second, in timestamp",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process gelf log line")
+		}
+		ev, err := p.parseLine(line)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+				"err":  err,
+			}).Debug("skipping line; failed to parse.")
+			p.CountParseError(line, err)
+			continue
+		}
+		send <- ev
+	}
+	logrus.Debug("lines channel is closed, ending gelf processor")
+}
+
+func (p *Parser) parseLine(line string) (event.Event, error) {
+	msg := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return event.Event{}, err
+	}
+	// short_message is the one field every GELF message must have
+	if _, ok := msg["short_message"]; !ok {
+		return event.Event{}, errors.New("not a GELF message: missing short_message")
+	}
+	data := make(map[string]interface{}, len(msg))
+	ts := time.Time{}
+	for k, v := range msg {
+		switch {
+		case k == "version":
+			// the GELF spec version isn't interesting as data
+		case k == "timestamp":
+			// seconds since the epoch with optional decimal places
+			if secs, ok := v.(float64); ok {
+				whole, frac := math.Modf(secs)
+				ts = time.Unix(int64(whole), int64(frac*1e9)).UTC()
+			}
+		case k == "_id":
+			// reserved by the spec; never a real additional field
+		case strings.HasPrefix(k, "_") && !p.conf.KeepPrefix:
+			data[k[1:]] = flatten(v)
+		default:
+			data[k] = flatten(v)
+		}
+	}
+	if level, ok := data["level"].(float64); ok && level >= 0 && int(level) < len(levelNames) {
+		data["level_name"] = levelNames[int(level)]
+	}
+	if ts.IsZero() {
+		ts = p.nower.Now()
+	}
+	return event.Event{
+		Timestamp: ts,
+		Data:      data,
+	}, nil
+}
+
+// flatten re-encodes nested values as JSON strings, the same way the json
+// parser does
+func flatten(v interface{}) interface{} {
+	switch typedVal := v.(type) {
+	case bool, string, float64, nil:
+		return typedVal
+	default:
+		rejsoned, _ := json.Marshal(v)
+		return string(rejsoned)
+	}
+}
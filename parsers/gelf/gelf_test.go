@@ -0,0 +1,58 @@
+package gelf
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func TestParseLine(t *testing.T) {
+	p := &Parser{nower: &FakeNower{}}
+	ev, err := p.parseLine(`{"version":"1.1","host":"example.org","short_message":"A short message","full_message":"Backtrace here","timestamp":1385053862.5,"level":1,"_user_id":9001,"_some_info":"foo","_tags":["a","b"]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"host":          "example.org",
+		"short_message": "A short message",
+		"full_message":  "Backtrace here",
+		"level":         float64(1),
+		"level_name":    "alert",
+		"user_id":       float64(9001),
+		"some_info":     "foo",
+		"tags":          `["a","b"]`,
+	}
+	if !reflect.DeepEqual(ev.Data, expected) {
+		t.Errorf("expected %+v, got %+v", expected, ev.Data)
+	}
+	if !ev.Timestamp.Equal(time.Unix(1385053862, 500000000)) {
+		t.Errorf("unexpected timestamp %s", ev.Timestamp)
+	}
+
+	// no timestamp means now, and prefixes can be kept
+	p.conf.KeepPrefix = true
+	ev, err = p.parseLine(`{"host":"h","short_message":"m","_extra":"x"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ev.Timestamp.Equal(p.nower.Now()) {
+		t.Errorf("expected now, got %s", ev.Timestamp)
+	}
+	if ev.Data["_extra"] != "x" {
+		t.Errorf("expected prefix to be kept, got %+v", ev.Data)
+	}
+
+	if _, err := p.parseLine("not json"); err == nil {
+		t.Error("expected an error for a non-json line")
+	}
+	if _, err := p.parseLine(`{"host":"h","message":"m"}`); err == nil {
+		t.Error("expected an error for json without short_message")
+	}
+}
@@ -0,0 +1,499 @@
+package htjson
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// decoder makes the fields of an event straight from a line of JSON in one
+// pass, without decoding nested values into maps and slices only to encode
+// them again as JSON strings, or reflection. It only handles what it's sure
+// it decodes just as encoding/json would; for anything else, eg strings with
+// invalid UTF-8, duplicate keys in an object being flattened or a flattened
+// name that's also given some other way, it gives up, and the line is
+// decoded with encoding/json instead.
+type decoder struct {
+	data []byte
+	pos  int
+	jlp  *JSONLineParser
+	// buf is where nested values are encoded as JSON strings
+	buf []byte
+}
+
+// member is a key and its value, encoded, in an object being encoded
+type member struct {
+	key   string
+	value []byte
+}
+
+// decode returns the fields line makes, or false if it can't be sure of
+// them
+func (j *JSONLineParser) decode(line []byte) (map[string]interface{}, bool) {
+	d := decoder{data: line, jlp: j}
+	d.skipSpace()
+	processed := make(map[string]interface{})
+	if d.literal("null") {
+		// encoding/json leaves the map empty
+	} else if !d.object(processed, "", j.FlattenDepth) {
+		return nil, false
+	}
+	d.skipSpace()
+	if d.pos != len(d.data) {
+		return nil, false
+	}
+	return processed, true
+}
+
+// object adds the members of the object at pos to processed, with prefix in
+// front of their keys, flattening objects within depth
+func (d *decoder) object(processed map[string]interface{}, prefix string, depth int) bool {
+	if !d.consume('{') {
+		return false
+	}
+	var keys []string
+	flattened := false
+	d.skipSpace()
+	if d.consume('}') {
+		return true
+	}
+	for {
+		d.skipSpace()
+		key, ok := d.string()
+		if !ok {
+			return false
+		}
+		d.skipSpace()
+		if !d.consume(':') {
+			return false
+		}
+		d.skipSpace()
+		// a name made some other way as well is up to flattenAll
+		if _, taken := processed[prefix+key]; taken && !contains(keys, key) {
+			return false
+		}
+		keys = append(keys, key)
+		nested, ok := d.field(processed, prefix+key, depth)
+		if !ok {
+			return false
+		}
+		flattened = flattened || nested
+		d.skipSpace()
+		if d.consume('}') {
+			break
+		}
+		if !d.consume(',') {
+			return false
+		}
+	}
+	// a key given twice replaces the first value, which can't be taken
+	// back once it's been flattened into fields of its own
+	if flattened && hasDuplicates(keys) {
+		return false
+	}
+	return true
+}
+
+// field adds the value at pos to processed as the field key, reporting
+// whether it was flattened into fields of its own
+func (d *decoder) field(processed map[string]interface{}, key string, depth int) (bool, bool) {
+	if d.pos >= len(d.data) {
+		return false, false
+	}
+	switch c := d.data[d.pos]; {
+	case c == '"':
+		s, ok := d.string()
+		processed[key] = s
+		return false, ok
+	case c == 't' || c == 'f':
+		b, ok := d.bool()
+		processed[key] = b
+		return false, ok
+	case c == '-' || c >= '0' && c <= '9':
+		f, ok := d.number()
+		processed[key] = f
+		return false, ok
+	case c == '{' && depth > 0 && !d.emptyObject():
+		return true, d.object(processed, key+".", depth-1)
+	case c == '[' && d.jlp.ArrayFields > 0:
+		if n, ok := d.arrayLength(); ok && n > 0 && n <= d.jlp.ArrayFields {
+			return true, d.array(processed, key, depth)
+		}
+	}
+	// anything else is sent as JSON
+	d.buf = d.buf[:0]
+	encoded, ok := d.encode(d.buf)
+	if !ok {
+		return false, false
+	}
+	d.buf = encoded
+	processed[key] = string(encoded)
+	return false, true
+}
+
+// array adds the elements of the array at pos to processed as key.0, key.1
+// and so on. Arrays don't count towards the depth.
+func (d *decoder) array(processed map[string]interface{}, key string, depth int) bool {
+	d.consume('[')
+	for i := 0; ; i++ {
+		d.skipSpace()
+		name := key + "." + strconv.Itoa(i)
+		if _, taken := processed[name]; taken {
+			return false
+		}
+		if _, ok := d.field(processed, name, depth); !ok {
+			return false
+		}
+		d.skipSpace()
+		if d.consume(']') {
+			return true
+		}
+		if !d.consume(',') {
+			return false
+		}
+	}
+}
+
+// encode appends the value at pos to buf as encoding/json would encode it
+// once decoded: compact, with the keys of objects sorted
+func (d *decoder) encode(buf []byte) ([]byte, bool) {
+	if d.pos >= len(d.data) {
+		return nil, false
+	}
+	switch c := d.data[d.pos]; {
+	case c == '"':
+		s, ok := d.string()
+		if !ok {
+			return nil, false
+		}
+		return appendString(buf, s)
+	case c == 't' || c == 'f':
+		b, ok := d.bool()
+		return strconv.AppendBool(buf, b), ok
+	case c == 'n':
+		return append(buf, "null"...), d.literal("null")
+	case c == '-' || c >= '0' && c <= '9':
+		f, ok := d.number()
+		return appendFloat(buf, f), ok
+	case c == '[':
+		return d.encodeArray(buf)
+	case c == '{':
+		return d.encodeObject(buf)
+	}
+	return nil, false
+}
+
+// encodeArray appends the array at pos to buf
+func (d *decoder) encodeArray(buf []byte) ([]byte, bool) {
+	d.consume('[')
+	buf = append(buf, '[')
+	d.skipSpace()
+	if d.consume(']') {
+		return append(buf, ']'), true
+	}
+	for {
+		d.skipSpace()
+		var ok bool
+		if buf, ok = d.encode(buf); !ok {
+			return nil, false
+		}
+		d.skipSpace()
+		if d.consume(']') {
+			return append(buf, ']'), true
+		}
+		if !d.consume(',') {
+			return nil, false
+		}
+		buf = append(buf, ',')
+	}
+}
+
+// encodeObject appends the object at pos to buf, with its keys sorted and
+// only the last value of any key given twice
+func (d *decoder) encodeObject(buf []byte) ([]byte, bool) {
+	d.consume('{')
+	d.skipSpace()
+	if d.consume('}') {
+		return append(buf, "{}"...), true
+	}
+	var members []member
+	for {
+		d.skipSpace()
+		key, ok := d.string()
+		if !ok {
+			return nil, false
+		}
+		d.skipSpace()
+		if !d.consume(':') {
+			return nil, false
+		}
+		d.skipSpace()
+		value, ok := d.encode(nil)
+		if !ok {
+			return nil, false
+		}
+		members = append(members, member{key: key, value: value})
+		d.skipSpace()
+		if d.consume('}') {
+			break
+		}
+		if !d.consume(',') {
+			return nil, false
+		}
+	}
+	sort.SliceStable(members, func(i, k int) bool { return members[i].key < members[k].key })
+	buf = append(buf, '{')
+	first := true
+	for i, m := range members {
+		if i+1 < len(members) && members[i+1].key == m.key {
+			continue
+		}
+		if !first {
+			buf = append(buf, ',')
+		}
+		first = false
+		var ok bool
+		if buf, ok = appendString(buf, m.key); !ok {
+			return nil, false
+		}
+		buf = append(buf, ':')
+		buf = append(buf, m.value...)
+	}
+	return append(buf, '}'), true
+}
+
+// string decodes the string at pos
+func (d *decoder) string() (string, bool) {
+	if !d.consume('"') {
+		return "", false
+	}
+	start := d.pos
+	escaped, ascii := false, true
+	for ; d.pos < len(d.data); d.pos++ {
+		switch c := d.data[d.pos]; {
+		case c == '"':
+			d.pos++
+			raw := d.data[start : d.pos-1]
+			if !ascii && !utf8.Valid(raw) {
+				// encoding/json would replace what's invalid
+				return "", false
+			}
+			if !escaped {
+				return string(raw), true
+			}
+			// escapes are rare enough to leave to encoding/json
+			var s string
+			if err := json.Unmarshal(d.data[start-1:d.pos], &s); err != nil {
+				return "", false
+			}
+			return s, true
+		case c == '\\':
+			escaped = true
+			d.pos++
+		case c < 0x20:
+			return "", false
+		case c >= utf8.RuneSelf:
+			ascii = false
+		}
+	}
+	return "", false
+}
+
+// number decodes the number at pos, which must be valid JSON
+func (d *decoder) number() (float64, bool) {
+	start := d.pos
+	d.consume('-')
+	if d.consume('0') {
+		// no leading zeros
+	} else if !d.digits() {
+		return 0, false
+	}
+	if d.consume('.') && !d.digits() {
+		return 0, false
+	}
+	if d.consume('e') || d.consume('E') {
+		if !d.consume('+') {
+			d.consume('-')
+		}
+		if !d.digits() {
+			return 0, false
+		}
+	}
+	f, err := strconv.ParseFloat(string(d.data[start:d.pos]), 64)
+	return f, err == nil
+}
+
+// digits skips one or more digits
+func (d *decoder) digits() bool {
+	start := d.pos
+	for d.pos < len(d.data) && d.data[d.pos] >= '0' && d.data[d.pos] <= '9' {
+		d.pos++
+	}
+	return d.pos > start
+}
+
+// bool decodes true or false at pos
+func (d *decoder) bool() (bool, bool) {
+	if d.literal("true") {
+		return true, true
+	}
+	return false, d.literal("false")
+}
+
+// literal skips s if it's at pos
+func (d *decoder) literal(s string) bool {
+	if len(d.data)-d.pos < len(s) || string(d.data[d.pos:d.pos+len(s)]) != s {
+		return false
+	}
+	d.pos += len(s)
+	return true
+}
+
+// emptyObject reports whether the object at pos is {}
+func (d *decoder) emptyObject() bool {
+	ahead := decoder{data: d.data, pos: d.pos + 1}
+	ahead.skipSpace()
+	return ahead.consume('}')
+}
+
+// arrayLength counts the elements of the array at pos, without moving on
+func (d *decoder) arrayLength() (int, bool) {
+	ahead := decoder{data: d.data, pos: d.pos + 1, jlp: d.jlp}
+	ahead.skipSpace()
+	if ahead.consume(']') {
+		return 0, true
+	}
+	for n := 1; ; n++ {
+		ahead.skipSpace()
+		if !ahead.skip() {
+			return 0, false
+		}
+		ahead.skipSpace()
+		if ahead.consume(']') {
+			return n, true
+		}
+		if !ahead.consume(',') {
+			return 0, false
+		}
+	}
+}
+
+// skip moves past the value at pos
+func (d *decoder) skip() bool {
+	var scratch [64]byte
+	_, ok := d.encode(scratch[:0])
+	return ok
+}
+
+// consume skips c if it's at pos
+func (d *decoder) consume(c byte) bool {
+	if d.pos < len(d.data) && d.data[d.pos] == c {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+// skipSpace moves past any whitespace
+func (d *decoder) skipSpace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// contains reports whether key is one of keys
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDuplicates reports whether any of keys is there twice
+func hasDuplicates(keys []string) bool {
+	for i, key := range keys {
+		for _, other := range keys[i+1:] {
+			if key == other {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// appendString appends s to buf as encoding/json encodes strings, giving up
+// on control characters other than newlines and tabs, which not every
+// version of it encodes the same
+func appendString(buf []byte, s string) ([]byte, bool) {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == '\u2028' || r == '\u2029' {
+				buf = append(buf, s[start:i]...)
+				buf = append(buf, `\u202`...)
+				buf = append(buf, hex[r&0xF])
+				start = i + size
+			}
+			i += size
+			continue
+		}
+		var escape string
+		switch c {
+		case '"':
+			escape = `\"`
+		case '\\':
+			escape = `\\`
+		case '\n':
+			escape = `\n`
+		case '\r':
+			escape = `\r`
+		case '\t':
+			escape = `\t`
+		case '<', '>', '&':
+			escape = `\u00` + string(hex[c>>4]) + string(hex[c&0xF])
+		default:
+			if c < 0x20 {
+				return nil, false
+			}
+			i++
+			continue
+		}
+		buf = append(buf, s[start:i]...)
+		buf = append(buf, escape...)
+		i++
+		start = i
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"'), true
+}
+
+// appendFloat appends f to buf as encoding/json encodes float64s
+func appendFloat(buf []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	buf = strconv.AppendFloat(buf, f, format, -1, 64)
+	if format == 'e' {
+		// 1e-07 is written 1e-7
+		n := len(buf)
+		if n >= 4 && buf[n-4] == 'e' && buf[n-3] == '-' && buf[n-2] == '0' {
+			buf[n-2] = buf[n-1]
+			buf = buf[:n-1]
+		}
+	}
+	return buf
+}
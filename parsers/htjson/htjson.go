@@ -4,11 +4,15 @@ package htjson
 
 import (
 	"encoding/json"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
 )
 
 var possibleTimeFieldNames = []string{
@@ -18,12 +22,29 @@ var possibleTimeFieldNames = []string{
 	"datetime", "Datetime", "DateTime",
 }
 
+// timeLayouts are the formats timestamps are tried in, after --json.format
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	time.RFC3339Nano,
+	time.RubyDate,
+	time.UnixDate,
+}
+
+// sampleLines are lines of a JSON log
+var sampleLines = []string{
+	`{"time":"2016-08-01T12:00:00.123Z","method":"GET","path":"/users/1","status":200,"duration_ms":12.5}`,
+	`{"time":"2016-08-01 12:00:01.5 +0000 UTC","level":"error","msg":"timed out","request":{"id":"abc"}}`,
+}
+
 type Options struct {
 	TimeFieldName string `long:"timefield" description:"Name of the field that contains a timestamp"`
 	Format        string `long:"format" description:"Format of the timestamp found in timefield. Please use the reference time Mon Jan 2 15:04:05 -0700 MST 2006"`
+	FlattenDepth  int    `long:"flatten_depth" description:"Flatten nested objects this many levels deep into fields with dotted names, eg 2 for request.headers.host. Objects nested deeper are sent as JSON strings, as they all are with the default of 0"`
+	ArrayFields   int    `long:"array_fields" description:"Explode arrays of up to this many elements into fields named by index, eg tags.0 and tags.1. Longer arrays are sent as JSON strings, as they all are with the default of 0"`
 }
 
 type Parser struct {
+	parsers.Settings
 	conf       Options
 	lineParser LineParser
 	nower      Nower
@@ -43,7 +64,10 @@ func (p *Parser) Init(options interface{}) error {
 	p.conf = *options.(*Options)
 
 	p.nower = &RealNower{}
-	p.lineParser = &JSONLineParser{}
+	p.lineParser = &JSONLineParser{
+		FlattenDepth: p.conf.FlattenDepth,
+		ArrayFields:  p.conf.ArrayFields,
+	}
 	return nil
 }
 
@@ -52,43 +76,134 @@ type LineParser interface {
 }
 
 type JSONLineParser struct {
+	// FlattenDepth is how many levels of nested objects are flattened into
+	// dotted field names
+	FlattenDepth int
+	// ArrayFields is the longest array exploded into indexed field names
+	ArrayFields int
 }
 
 // LineParser will do a complete JSON decode of the line,
 // but then re-encode any value that's not a string as JSON and return
 // it as a string. We don't want nested objects, but it seems silly to
 // balk instead of just pushing json as the value into retriever.
+// Objects within FlattenDepth and arrays of up to ArrayFields elements
+// are flattened instead.
 func (j *JSONLineParser) ParseLine(line string) (map[string]interface{}, error) {
+	buf := linePool.Get().(*[]byte)
+	b := append((*buf)[:0], line...)
+	parsed, err := j.ParseBytes(b)
+	*buf = b[:0]
+	linePool.Put(buf)
+	return parsed, err
+}
+
+// linePool holds the buffers lines are copied into to be decoded, so a new
+// one isn't needed for every line. The decoder copies out what it keeps.
+var linePool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// ParseBytes is ParseLine for a line that's already a []byte. The map
+// returned doesn't refer to line, so it can be reused.
+func (j *JSONLineParser) ParseBytes(line []byte) (map[string]interface{}, error) {
+	if processed, ok := j.decode(line); ok {
+		return processed, nil
+	}
+	// encoding/json has the last word on anything decode isn't sure of,
+	// including lines that aren't JSON at all
 	parsed := make(map[string]interface{})
-	err := json.Unmarshal([]byte(line), &parsed)
+	err := json.Unmarshal(line, &parsed)
 	if err != nil {
 		return nil, err
 	}
-	processed := make(map[string]interface{})
-	for k, v := range parsed {
-		switch typedVal := v.(type) {
-		case bool, string, float64:
-			processed[k] = typedVal
-		default:
-			rejsoned, _ := json.Marshal(v)
-			processed[k] = string(rejsoned)
+	return j.flattenAll(parsed), nil
+}
 
+// flattenAll makes the fields of an event from a decoded line. When
+// flattening makes a name that's also given some other way, eg by
+// {"a":{"b":1},"a.b":2}, the field made from the fewest keys wins, so a key
+// as it's written in the line always does. Among those made from as many,
+// the first in order of their keys wins.
+func (j *JSONLineParser) flattenAll(parsed map[string]interface{}) map[string]interface{} {
+	processed := make(map[string]interface{}, len(parsed))
+	lengths := make(map[string]int, len(parsed))
+	for _, k := range sortedKeys(parsed) {
+		j.flatten(processed, lengths, k, 1, parsed[k], j.FlattenDepth)
+	}
+	return processed
+}
+
+// flatten adds v to processed as the field key, made from length keys,
+// flattening objects depth levels deep and short arrays into key.name and
+// key.index fields. lengths holds the length of each field added so far.
+func (j *JSONLineParser) flatten(processed map[string]interface{}, lengths map[string]int, key string, length int, v interface{}, depth int) {
+	switch typedVal := v.(type) {
+	case map[string]interface{}:
+		if depth > 0 && len(typedVal) > 0 {
+			for _, k := range sortedKeys(typedVal) {
+				j.flatten(processed, lengths, key+"."+k, length+1, typedVal[k], depth-1)
+			}
+			return
 		}
+	case []interface{}:
+		// arrays don't count towards the depth, so their elements are
+		// flattened as far as the array itself would be
+		if len(typedVal) > 0 && len(typedVal) <= j.ArrayFields {
+			for i, elem := range typedVal {
+				j.flatten(processed, lengths, key+"."+strconv.Itoa(i), length+1, elem, depth)
+			}
+			return
+		}
+	}
+	if taken, ok := lengths[key]; ok && taken <= length {
+		return
+	}
+	lengths[key] = length
+	switch v.(type) {
+	case bool, string, float64:
+		processed[key] = v
+	default:
+		rejsoned, _ := json.Marshal(v)
+		processed[key] = string(rejsoned)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	timestamps := append([]string{"--json.format"}, timeLayouts...)
+	timestamps = append(timestamps, "a count since the epoch in s, ms, us or ns")
+	return parsers.Description{
+		Summary: "Logs of one JSON object per line. Nested objects and arrays are sent as JSON strings, or flattened with --json.flatten_depth and --json.array_fields. " +
+			"Timestamps are read from --json.timefield, or the first of " + strings.Join(possibleTimeFieldNames, ", ") + " that a line has.",
+		Examples:   sampleLines,
+		Timestamps: timestamps,
 	}
-	return processed, err
 }
 
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
 	for line := range lines {
-		logrus.WithFields(logrus.Fields{
-			"line": line,
-		}).Debug("Attempting to process json log line")
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process json log line")
+		}
 		parsedLine, err := p.lineParser.ParseLine(line)
 		if err != nil {
 			// skip lines that won't parse
 			logrus.WithFields(logrus.Fields{
 				"line": line,
 			}).Debug("skipping line; failed to parse.")
+			p.CountParseError(line, err)
 			continue
 		}
 		timestamp := p.getTimestamp(parsedLine)
@@ -115,7 +230,7 @@ func (p *Parser) getTimestamp(m map[string]interface{}) time.Time {
 		// remove the timestamp from the body when we stuff it in the header
 		defer delete(m, p.conf.TimeFieldName)
 		if t, found := m[p.conf.TimeFieldName]; found {
-			ts = p.tryTimeFormats(t.(string))
+			ts = p.parseTime(t)
 			if ts.IsZero() {
 				// we found the time field but failed to parse it
 				ts = p.nower.Now()
@@ -133,14 +248,21 @@ func (p *Parser) getTimestamp(m map[string]interface{}) time.Time {
 	// if we succeed, stop looking. Otherwise keep trying
 	for _, timeField := range possibleTimeFieldNames {
 		if t, found := m[timeField]; found {
-			timeStr, found := t.(string)
-			if found {
+			switch typedVal := t.(type) {
+			case string:
 				defer delete(m, timeField)
-				ts = p.tryTimeFormats(timeStr)
-				if !ts.IsZero() {
-					break
+				ts = p.parseTime(typedVal)
+			case float64:
+				// a number is only a timestamp if it's a plausible one,
+				// rather than say a duration in a field called time
+				if epochTS, ok := p.EpochUnit.FromValue(typedVal); ok && epochTS.Year() >= 2000 {
+					defer delete(m, timeField)
+					ts = epochTS
 				}
 			}
+			if !ts.IsZero() {
+				break
+			}
 		}
 	}
 	if ts.IsZero() {
@@ -149,27 +271,39 @@ func (p *Parser) getTimestamp(m map[string]interface{}) time.Time {
 	return ts
 }
 
+// parseTime parses a timestamp in one of the formats tryTimeFormats knows,
+// or a count since the unix epoch, either as a number or a string
+func (p *Parser) parseTime(v interface{}) time.Time {
+	switch typedVal := v.(type) {
+	case string:
+		if ts := p.tryTimeFormats(typedVal); !ts.IsZero() {
+			return ts
+		}
+	}
+	if ts, ok := p.EpochUnit.FromValue(v); ok {
+		return ts
+	}
+	return time.Time{}
+}
+
 func (p *Parser) tryTimeFormats(t string) time.Time {
 	// golang can't parse times with decimal fractional seconds marked by a comma
 	// hack it by just replacing all commas with periods and hope it works out.
 	// https://github.com/golang/go/issues/6189
 	t = strings.Replace(t, ",", ".", -1)
+	// times without a zone are in --timezone, if it's given
+	loc := p.Location(time.UTC)
 	if p.conf.Format != "" {
 		format := strings.Replace(p.conf.Format, ",", ".", -1)
-		if ts, err := time.Parse(format, t); err == nil {
+		if ts, err := time.ParseInLocation(format, t, loc); err == nil {
 			return ts
 		}
 	}
 
-	var ts time.Time
-	if tOther, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", t); err == nil {
-		ts = tOther
-	} else if tOther, err := time.Parse(time.RFC3339Nano, t); err == nil {
-		ts = tOther
-	} else if tOther, err := time.Parse(time.RubyDate, t); err == nil {
-		ts = tOther
-	} else if tOther, err := time.Parse(time.UnixDate, t); err == nil {
-		ts = tOther
+	for _, layout := range timeLayouts {
+		if ts, err := time.ParseInLocation(layout, t, loc); err == nil {
+			return ts
+		}
 	}
-	return ts
+	return time.Time{}
 }
@@ -1,9 +1,14 @@
 package htjson
 
 import (
+	"encoding/json"
+	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/honeycombio/honeytail/event"
 )
 
 type FakeNower struct{}
@@ -57,6 +62,169 @@ func TestParseLine(t *testing.T) {
 	}
 }
 
+func TestParseLineFlattened(t *testing.T) {
+	input := `{"request": {"method": "GET", "headers": {"host": "example.com", "accept": {"type": "json"}}}, "tags": ["a", {"b": 1}], "ids": [1, 2, 3], "empty": {}}`
+	for _, tc := range []struct {
+		jlp      JSONLineParser
+		expected map[string]interface{}
+	}{
+		{ // the default stringifies everything
+			jlp: JSONLineParser{},
+			expected: map[string]interface{}{
+				"request": `{"headers":{"accept":{"type":"json"},"host":"example.com"},"method":"GET"}`,
+				"tags":    `["a",{"b":1}]`,
+				"ids":     "[1,2,3]",
+				"empty":   "{}",
+			},
+		},
+		{
+			jlp: JSONLineParser{FlattenDepth: 2},
+			expected: map[string]interface{}{
+				"request.method":         "GET",
+				"request.headers.host":   "example.com",
+				"request.headers.accept": `{"type":"json"}`,
+				"tags":                   `["a",{"b":1}]`,
+				"ids":                    "[1,2,3]",
+				"empty":                  "{}",
+			},
+		},
+		{
+			jlp: JSONLineParser{FlattenDepth: 1, ArrayFields: 2},
+			expected: map[string]interface{}{
+				"request.method":  "GET",
+				"request.headers": `{"accept":{"type":"json"},"host":"example.com"}`,
+				"tags.0":          "a",
+				"tags.1.b":        float64(1),
+				"ids":             "[1,2,3]",
+				"empty":           "{}",
+			},
+		},
+	} {
+		resp, err := tc.jlp.ParseLine(input)
+		if err != nil {
+			t.Error("jlp.ParseLine unexpectedly returned error ", err)
+		}
+		if !reflect.DeepEqual(resp, tc.expected) {
+			t.Errorf("with %+v, response %+v didn't match expected %+v", tc.jlp, resp, tc.expected)
+		}
+	}
+}
+
+func TestFlattenCollisions(t *testing.T) {
+	jlp := JSONLineParser{FlattenDepth: 3, ArrayFields: 2}
+	for line, expected := range map[string]map[string]interface{}{
+		// a key as written wins, whichever comes first
+		`{"a":{"b":1},"a.b":"x"}`:             {"a.b": "x"},
+		`{"a.b":"x","a":{"b":1}}`:             {"a.b": "x"},
+		`{"a":{"b":{"c":{"d":1}}},"a.b":"x"}`: {"a.b": "x", "a.b.c.d": float64(1)},
+		// then the one made from fewer keys
+		`{"a":{"b.c":1,"b":{"c":2}}}`: {"a.b.c": float64(1)},
+		`{"a":{"b":{"c":2},"b.c":1}}`: {"a.b.c": float64(1)},
+		`{"l":["x"],"l.0":"y"}`:       {"l.0": "y"},
+		// then the first in order of their keys
+		`{"a.b":{"c":1},"a":{"b.c":2}}`: {"a.b.c": float64(2)},
+		`{"a":{"b.c":2},"a.b":{"c":1}}`: {"a.b.c": float64(2)},
+	} {
+		// map order changes from run to run, so one lucky run isn't enough
+		for i := 0; i < 50; i++ {
+			got, err := jlp.ParseLine(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Fatalf("%s: expected %+v, got %+v", line, expected, got)
+			}
+		}
+	}
+}
+
+// decodeWithEncodingJSON is what ParseBytes falls back to
+func decodeWithEncodingJSON(jlp JSONLineParser, line string) (map[string]interface{}, error) {
+	parsed := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(line), &parsed); err != nil {
+		return nil, err
+	}
+	return jlp.flattenAll(parsed), nil
+}
+
+func TestDecodeMatchesEncodingJSON(t *testing.T) {
+	lines := []string{
+		benchLine,
+		`{}`,
+		` { "a" : 1 , "b" : [ ] , "c" : { } } `,
+		`null`,
+		`{"n":-0,"m":1e21,"o":1.5e-7,"p":0.000001,"q":123456789012345678901234,"r":-2.50,"s":1E+2}`,
+		`{"s":"tab\there \"quoted\" \u00e9 \ud83d\ude00","html":"<a href=\"x\">&</a>","sep":"\u2028\u2029","utf8":"héllo ✓"}`,
+		`{"nested":{"html":"<&>","list":[1,"two",null,true,{"z":1,"a":[{}]}],"dup":1,"dup":2}}`,
+		`{"a":{"b":{"c":{"d":1}}},"arr":[[1,2],[3]],"one":[{"k":"v"}]}`,
+		`{"dup":{"x":1},"dup":2}`,
+		`{"esc\u0041key":1,"x":{"esc\"key":2}}`,
+		`{"ctrl":"\b\f"}`,
+		`{"nested":{"ctrl":"\u0001"}}`,
+		// a flattened name that's also a key of its own is left to
+		// encoding/json; see TestFlattenCollisions
+		`{"a":{"b":{"c":{"d":1}}},"a.b":"x","arr":[[1,2],[3]],"one":[{"k":"v"}]}`,
+	}
+	invalid := []string{
+		``, `not json`, `{"a":1}x`, `{"a":01}`, `{"a":1.}`, `{"a":.5}`, `{"a":-}`, `{"a":1e}`,
+		`{"a":tru}`, `{"a":"unterminated}`, `{"a" 1}`, `{"a":1,}`, `{a:1}`, `[1,2]`, `"string"`,
+		`{"a":1e400}`, "{\"a\":\"raw\ttab\"}", `{"a":[1,]}`, `{"a":{"b":1,}}`, `{"a":nul}`,
+		"{\"bad\":\"\xff\"}",
+	}
+	// random lines, encoded by encoding/json, with extra space
+	random := rand.New(rand.NewSource(1))
+	var value func(depth int) interface{}
+	value = func(depth int) interface{} {
+		switch n := random.Intn(8); {
+		case n == 0:
+			return nil
+		case n == 1:
+			return random.Intn(2) == 0
+		case n == 2:
+			return random.NormFloat64() * 1e6
+		case n == 3 && depth > 0:
+			var list []interface{}
+			for i := random.Intn(4); i > 0; i-- {
+				list = append(list, value(depth-1))
+			}
+			return list
+		case n >= 4 && depth > 0:
+			obj := map[string]interface{}{}
+			for i := random.Intn(4); i > 0; i-- {
+				obj[string(rune('a'+random.Intn(5)))] = value(depth - 1)
+			}
+			return obj
+		}
+		return strings.Repeat("<é\n\"", random.Intn(3))
+	}
+	for i := 0; i < 200; i++ {
+		encoded, _ := json.MarshalIndent(value(4), "", " ")
+		if encoded[0] == '{' {
+			lines = append(lines, string(encoded))
+		}
+	}
+
+	for _, jlp := range []JSONLineParser{{}, {FlattenDepth: 1}, {FlattenDepth: 3, ArrayFields: 2}} {
+		for _, line := range append(lines, invalid...) {
+			expected, expectedErr := decodeWithEncodingJSON(jlp, line)
+			got, err := jlp.ParseLine(line)
+			if (err == nil) != (expectedErr == nil) {
+				t.Errorf("with %+v, %q: expected error %v, got %v", jlp, line, expectedErr, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("with %+v, %q: expected %+v, got %+v", jlp, line, expected, got)
+			}
+		}
+	}
+	// the fast path handles typical lines itself
+	for _, line := range lines[:8] {
+		if _, ok := (&JSONLineParser{FlattenDepth: 1}).decode([]byte(line)); !ok {
+			t.Errorf("expected %q to be decoded without encoding/json", line)
+		}
+	}
+}
+
 type testTimestamp struct {
 	format    string                 // the format this test's time is in
 	fieldName string                 // the field in the map containing the time
@@ -117,6 +285,31 @@ func TestGetTimestampInvalid(t *testing.T) {
 	}
 }
 
+func TestGetTimestampEpoch(t *testing.T) {
+	p := &Parser{nower: &FakeNower{}}
+	expected := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	m := map[string]interface{}{"timestamp": float64(1470052800000), "a": 1}
+	if resp := p.getTimestamp(m); !resp.Equal(expected) {
+		t.Errorf("resp time %s didn't match expected time %s", resp, expected)
+	}
+	if _, ok := m["timestamp"]; ok {
+		t.Error("expected the timestamp to be removed")
+	}
+	// a number too small to be a timestamp is left alone
+	m = map[string]interface{}{"time": 0.023}
+	if resp := p.getTimestamp(m); !resp.Equal(p.nower.Now()) {
+		t.Errorf("resp time %s didn't match expected time %s", resp, p.nower.Now())
+	}
+	if _, ok := m["time"]; !ok {
+		t.Error("expected the time field to be kept")
+	}
+	// a named field can be a number or a numeric string
+	p.conf.TimeFieldName = "ts"
+	if resp := p.getTimestamp(map[string]interface{}{"ts": "1470052800"}); !resp.Equal(expected) {
+		t.Errorf("resp time %s didn't match expected time %s", resp, expected)
+	}
+}
+
 func TestGetTimestampCustomFormat(t *testing.T) {
 	weirdFormat := "Mon // 02 ---- Jan ... 06 15:04:05 MST"
 
@@ -194,3 +387,65 @@ func TestCommaInTimestamp(t *testing.T) {
 	}
 
 }
+
+// benchLine is a typical JSON log line
+const benchLine = `{"time":"2016-08-01T12:00:00.123Z","level":"info","msg":"request finished","status":200,"path":"/orders/1234","duration_ms":12.5,"user":{"id":42,"plan":"pro"}}`
+
+func BenchmarkParseLine(b *testing.B) {
+	jlp := JSONLineParser{FlattenDepth: 1}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := jlp.ParseLine(benchLine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseLineEncodingJSON(b *testing.B) {
+	jlp := JSONLineParser{FlattenDepth: 1}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeWithEncodingJSON(jlp, benchLine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchNestedLine has values that are sent as JSON strings
+const benchNestedLine = `{"time":"2016-08-01T12:00:00.123Z","msg":"request finished","request":{"method":"GET","path":"/orders/1234","headers":{"host":"example.com","accept":"*/*"}},"tags":["api","orders"]}`
+
+func BenchmarkParseNestedLine(b *testing.B) {
+	jlp := JSONLineParser{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := jlp.ParseLine(benchNestedLine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseNestedLineEncodingJSON(b *testing.B) {
+	jlp := JSONLineParser{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeWithEncodingJSON(jlp, benchNestedLine); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProcessLines(b *testing.B) {
+	p := &Parser{}
+	if err := p.Init(&Options{}); err != nil {
+		b.Fatal(err)
+	}
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go p.ProcessLines(lines, send)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lines <- benchLine
+		<-send
+	}
+	close(lines)
+}
@@ -7,13 +7,20 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
 	"github.com/tmc/mongologtools/parser"
 )
 
+// sampleLines are lines of a mongod log
+var sampleLines = []string{
+	`Mon Feb 23 03:20:19.670 [TTLMonitor] query admin.system.indexes query: { expireAfterSeconds: { $exists: true } } ntoreturn:0 ntoskip:0 nscanned:0 keyUpdates:0 locks(micros) r:86 nreturned:0 reslen:20 0ms`,
+}
+
 type Options struct {
 }
 
 type Parser struct {
+	parsers.Settings
 	conf       Options
 	lineParser LineParser
 	nower      Nower
@@ -36,15 +43,28 @@ func (p *Parser) Init(_ interface{}) error {
 	return nil
 }
 
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "mongod logs, with the operation, namespace, query and timings of each line.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			"none: events are given a random time in the week before they're read",
+		},
+	}
+}
+
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
 	for line := range lines {
 		values, err := p.lineParser.ParseLogLine(line)
 		// we get a bunch of errors from the parser on mongo logs, skip em
 		if err == nil {
-			logrus.WithFields(logrus.Fields{
-				"line":   line,
-				"values": values,
-			}).Debug("Successfully parsed line")
+			if parsers.Debugging() {
+				logrus.WithFields(logrus.Fields{
+					"line":   line,
+					"values": values,
+				}).Debug("Successfully parsed line")
+			}
 			// for each entry, make a json blob with key/value pairs for each value map
 			e := event.Event{
 				Timestamp: randomTime(p.nower),
@@ -55,6 +75,7 @@ func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
 			logrus.WithFields(logrus.Fields{
 				"line": line,
 			}).Debug("logline didn't parse, skipping.")
+			p.CountParseError(line, err)
 		}
 	}
 	logrus.Debug("lines channel is closed, ending mongo processor")
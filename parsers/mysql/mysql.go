@@ -10,30 +10,29 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
 )
 
-// 3 sample log entries
-//
-// # Time: 2016-04-01T00:31:09.817887Z
-// # User@Host: root[root] @ localhost []  Id:   233
-// # Query_time: 0.008393  Lock_time: 0.000154 Rows_sent: 1  Rows_examined: 357
-// SET timestamp=1459470669;
-// show status like 'Uptime';
-//
-// # Time: 2016-04-01T00:31:09.853523Z
-// # User@Host: root[root] @ localhost []  Id:   233
-// # Query_time: 0.020424  Lock_time: 0.000147 Rows_sent: 494  Rows_examined: 494
-// SET timestamp=1459470669;
-// SHOW /*innotop*/ GLOBAL VARIABLES;
-//
-// # Time: 2016-04-01T00:31:09.856726Z
-// # User@Host: root[root] @ localhost []  Id:   233
-// # Query_time: 0.000021  Lock_time: 0.000000 Rows_sent: 494  Rows_examined: 494
-// SET timestamp=1459470669;
-// # administrator command: Ping;
-//
-// We should ignore the administrator command entry; the stats it presents (eg rows_sent)
-// are actually for the previous command
+// sampleLines are 3 slow query log entries. We should ignore the
+// administrator command entry; the stats it presents (eg rows_sent) are
+// actually for the previous command.
+var sampleLines = []string{
+	`# Time: 2016-04-01T00:31:09.817887Z`,
+	`# User@Host: root[root] @ localhost []  Id:   233`,
+	`# Query_time: 0.008393  Lock_time: 0.000154 Rows_sent: 1  Rows_examined: 357`,
+	`SET timestamp=1459470669;`,
+	`show status like 'Uptime';`,
+	`# Time: 2016-04-01T00:31:09.853523Z`,
+	`# User@Host: root[root] @ localhost []  Id:   233`,
+	`# Query_time: 0.020424  Lock_time: 0.000147 Rows_sent: 494  Rows_examined: 494`,
+	`SET timestamp=1459470669;`,
+	`SHOW /*innotop*/ GLOBAL VARIABLES;`,
+	`# Time: 2016-04-01T00:31:09.856726Z`,
+	`# User@Host: root[root] @ localhost []  Id:   233`,
+	`# Query_time: 0.000021  Lock_time: 0.000000 Rows_sent: 494  Rows_examined: 494`,
+	`SET timestamp=1459470669;`,
+	`# administrator command: Ping;`,
+}
 
 var (
 	reTime       = myRegexp{regexp.MustCompile("^# Time: (?P<time>[^ ]+)Z *$")}
@@ -50,6 +49,7 @@ type Options struct {
 }
 
 type Parser struct {
+	parsers.Settings
 	conf  Options
 	wg    sync.WaitGroup
 	nower Nower
@@ -90,6 +90,17 @@ func (p *Parser) Init(_ interface{}) error {
 	return nil
 }
 
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "The MySQL slow query log, with each query's user, host, timings and row counts.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			"# Time: " + timeFormat + "Z, in --timezone or UTC",
+		},
+	}
+}
+
 func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
 	// start up a goroutine to handle grouped sets of lines
 	rawEvents := make(chan rawEvent)
@@ -150,7 +161,7 @@ func (p *Parser) handleEvent(rawE rawEvent) SlowQuery {
 		switch {
 		case reTime.MatchString(line):
 			matchGroups := reTime.FindStringSubmatchMap(line)
-			sq.Timestamp, err = time.Parse(timeFormat, matchGroups["time"])
+			sq.Timestamp, err = time.ParseInLocation(timeFormat, matchGroups["time"], p.Location(time.UTC))
 			if err != nil {
 				sq.Timestamp = p.nower.Now()
 			}
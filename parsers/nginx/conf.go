@@ -0,0 +1,206 @@
+package nginx
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// combinedFormat is the log_format nginx has built in, used by access_log
+// when it isn't given another
+const combinedFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`
+
+// maxIncludeDepth is how deeply includes may nest before they're taken to
+// include each other
+const maxIncludeDepth = 16
+
+// logFormat is one log_format defined in the nginx config
+type logFormat struct {
+	format string
+	// escape is what nginx escapes in the variables it logs: default, json
+	// or none
+	escape string
+}
+
+// confToken is a word or quoted string from the nginx config, or one of
+// ; { and }, which end directives and blocks
+type confToken struct {
+	text  string
+	punct bool
+}
+
+// findLogFormat reads the nginx config at path, and the files it includes,
+// for the log_format called name. nginx's own combined is found even though
+// it isn't in the config.
+func findLogFormat(path, name string) (logFormat, error) {
+	formats := make(map[string]logFormat)
+	// relative includes are relative to the directory of the main config
+	if err := readLogFormats(path, filepath.Dir(path), formats, 0); err != nil {
+		return logFormat{}, err
+	}
+	if format, ok := formats[name]; ok {
+		return format, nil
+	}
+	if name == "combined" {
+		return logFormat{format: combinedFormat, escape: "default"}, nil
+	}
+	names := make([]string, 0, len(formats))
+	for found := range formats {
+		names = append(names, found)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return logFormat{}, fmt.Errorf("there's no log_format in %s or the files it includes", path)
+	}
+	return logFormat{}, fmt.Errorf("there's no log_format %s in %s or the files it includes; there's %s",
+		name, path, strings.Join(names, ", "))
+}
+
+// readLogFormats adds the log_formats in the config file at path to formats,
+// following its includes, whose globs are relative to dir
+func readLogFormats(path, dir string, formats map[string]logFormat, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s is included more than %d deep; do the nginx config files include each other?", path, maxIncludeDepth)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tokens, err := tokenizeConf(string(content))
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	var directive []string
+	for _, token := range tokens {
+		if !token.punct {
+			directive = append(directive, token.text)
+			continue
+		}
+		if token.text == ";" && len(directive) > 0 {
+			switch directive[0] {
+			case "include":
+				if len(directive) != 2 {
+					return fmt.Errorf("%s: include takes one file or glob", path)
+				}
+				if err := includeConf(directive[1], dir, formats, depth); err != nil {
+					return err
+				}
+			case "log_format":
+				name, format, err := parseLogFormat(directive[1:])
+				if err != nil {
+					return fmt.Errorf("%s: %s", path, err)
+				}
+				formats[name] = format
+			}
+		}
+		// blocks are looked inside, as log_format is only allowed in http
+		// and include is allowed anywhere
+		directive = nil
+	}
+	return nil
+}
+
+// includeConf reads the log_formats from the files matching the include
+// glob pattern. As in nginx, a pattern without wildcards must match a file.
+func includeConf(pattern, dir string, formats map[string]logFormat, depth int) error {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("can't read the nginx include %s: %s", pattern, err)
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return fmt.Errorf("the nginx include %s doesn't exist", pattern)
+	}
+	// nginx reads them in order, so later definitions win the same way
+	sort.Strings(files)
+	for _, file := range files {
+		if err := readLogFormats(file, dir, formats, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLogFormat reads the arguments to a log_format directive: its name, an
+// optional escape=, and the strings that make up the format
+func parseLogFormat(args []string) (string, logFormat, error) {
+	if len(args) < 2 {
+		return "", logFormat{}, fmt.Errorf("log_format needs a name and a format")
+	}
+	name := args[0]
+	format := logFormat{escape: "default"}
+	args = args[1:]
+	if strings.HasPrefix(args[0], "escape=") {
+		format.escape = strings.TrimPrefix(args[0], "escape=")
+		switch format.escape {
+		case "default", "json", "none":
+		default:
+			return "", logFormat{}, fmt.Errorf("log_format %s has escape=%s, not default, json or none", name, format.escape)
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return "", logFormat{}, fmt.Errorf("log_format %s has no format", name)
+	}
+	format.format = strings.Join(args, "")
+	return name, format, nil
+}
+
+// tokenizeConf splits an nginx config into words, quoted strings and the
+// punctuation between them, leaving out comments
+func tokenizeConf(conf string) ([]confToken, error) {
+	var tokens []confToken
+	for i := 0; i < len(conf); {
+		c := conf[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#':
+			for i < len(conf) && conf[i] != '\n' {
+				i++
+			}
+		case c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, confToken{text: string(c), punct: true})
+			i++
+		case c == '"' || c == '\'':
+			var text strings.Builder
+			i++
+			for ; i < len(conf) && conf[i] != c; i++ {
+				if conf[i] == '\\' && i+1 < len(conf) {
+					i++
+					switch conf[i] {
+					case '"', '\'', '\\':
+					case 't':
+						text.WriteByte('\t')
+						continue
+					case 'r':
+						text.WriteByte('\r')
+						continue
+					case 'n':
+						text.WriteByte('\n')
+						continue
+					default:
+						text.WriteByte('\\')
+					}
+				}
+				text.WriteByte(conf[i])
+			}
+			if i == len(conf) {
+				return nil, fmt.Errorf("a %c quoted string isn't closed", c)
+			}
+			i++
+			tokens = append(tokens, confToken{text: text.String()})
+		default:
+			start := i
+			for i < len(conf) && !strings.ContainsRune(" \t\r\n;{}", rune(conf[i])) {
+				i++
+			}
+			tokens = append(tokens, confToken{text: conf[start:i]})
+		}
+	}
+	return tokens, nil
+}
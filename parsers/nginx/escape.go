@@ -0,0 +1,147 @@
+package nginx
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// variablePattern matches the variables in a log_format, as $name or ${name}
+var variablePattern = regexp.MustCompile(`\$(?:([a-zA-Z0-9_]+)|\{([a-zA-Z0-9_]+)\})`)
+
+// upstreamTimeFields are the variables nginx logs a time for each upstream
+// server tried in, eg "0.010, 0.020", with " : " between the upstreams of
+// different internal redirects
+var upstreamTimeFields = []string{"upstream_response_time", "upstream_connect_time", "upstream_header_time"}
+
+// JSONLineParser parses lines of a log_format with escape=json. Quotes in
+// values are escaped with a backslash rather than as \x22, so each value runs
+// to the first unescaped character after its variable, and is unescaped as
+// JSON.
+type JSONLineParser struct {
+	regexp *regexp.Regexp
+}
+
+// newJSONLineParser returns a parser for lines in format, which has
+// escape=json
+func newJSONLineParser(format string) (*JSONLineParser, error) {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	matches := variablePattern.FindAllStringSubmatchIndex(format, -1)
+	last := 0
+	for _, m := range matches {
+		pattern.WriteString(regexp.QuoteMeta(format[last:m[0]]))
+		var name string
+		if m[2] >= 0 {
+			name = format[m[2]:m[3]]
+		} else {
+			name = format[m[4]:m[5]]
+		}
+		last = m[1]
+		if last == len(format) {
+			fmt.Fprintf(&pattern, "(?P<%s>.*)", name)
+			continue
+		}
+		// a value can hold the character that ends it only escaped
+		end := regexp.QuoteMeta(format[last : last+1])
+		fmt.Fprintf(&pattern, `(?P<%s>(?:[^%s\\]|\\.)*)`, name, end)
+	}
+	pattern.WriteString(regexp.QuoteMeta(format[last:]))
+	re, err := regexp.Compile(pattern.String())
+	if err != nil {
+		return nil, fmt.Errorf("can't parse log_format %q: %s", format, err)
+	}
+	return &JSONLineParser{regexp: re}, nil
+}
+
+func (j *JSONLineParser) ParseLine(line string) (map[string]string, error) {
+	values := j.regexp.FindStringSubmatch(line)
+	if values == nil {
+		return nil, fmt.Errorf("access log line %q doesn't match the log_format", line)
+	}
+	fields := make(map[string]string, len(values)-1)
+	for i, name := range j.regexp.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		fields[name] = unescapeJSON(values[i])
+	}
+	return fields, nil
+}
+
+// unescapeJSON undoes the escaping escape=json does, leaving values it can't
+// make sense of as they are
+func unescapeJSON(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var unescaped string
+	if err := json.Unmarshal([]byte(`"`+s+`"`), &unescaped); err != nil {
+		return s
+	}
+	return unescaped
+}
+
+// unescapeDefault undoes the escaping nginx does by default, which writes
+// quotes, backslashes and bytes outside printable ASCII as \xXX
+func unescapeDefault(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if b, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				unescaped.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(s[i])
+	}
+	return unescaped.String()
+}
+
+// splitUpstreamTimes turns lists of times for each upstream tried, as
+// "0.010, 0.020", into a field for each, eg upstream_response_time_1 and
+// upstream_response_time_2, and sets the field itself to the total. Upstreams
+// without a time, logged as -, get no field.
+func splitUpstreamTimes(ev map[string]interface{}) {
+	for _, field := range upstreamTimeFields {
+		list, ok := ev[field].(string)
+		if !ok || !strings.ContainsAny(list, ",:") {
+			continue
+		}
+		times := strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ':' })
+		split := make(map[string]interface{}, len(times))
+		var total float64
+		valid := true
+		for i, t := range times {
+			t = strings.TrimSpace(t)
+			if t == "-" {
+				continue
+			}
+			f, err := strconv.ParseFloat(t, 64)
+			if err != nil {
+				valid = false
+				break
+			}
+			split[fmt.Sprintf("%s_%d", field, i+1)] = f
+			total += f
+		}
+		if !valid {
+			// not a list of times; leave it as it was
+			continue
+		}
+		for k, v := range split {
+			ev[k] = v
+		}
+		if len(split) == 0 {
+			delete(ev, field)
+			continue
+		}
+		ev[field] = total
+	}
+}
@@ -2,14 +2,16 @@
 package nginx
 
 import (
-	"os"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/charity/gonx"
+	"github.com/honeycombio/gonx"
 	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
 	flag "github.com/jessevdk/go-flags"
 )
 
@@ -18,12 +20,22 @@ const (
 	iso8601TimeLayout         = "2006-01-02T15:04:05-07:00"
 )
 
+// sampleLines are lines of an access log in nginx's combined format. Which
+// fields lines have depends on the log_format --nginx.format names.
+var sampleLines = []string{
+	`192.0.2.1 - - [01/Aug/2016:12:00:00 +0000] "GET /users/1 HTTP/1.1" 200 612 "-" "curl/7.47.0"`,
+	`192.0.2.2 - bob [01/Aug/2016:12:00:01 +0000] "POST /login HTTP/1.1" 302 0 "https://example.com/" "Mozilla/5.0"`,
+}
+
 type Options struct {
-	ConfigFile    flag.Filename `long:"conf" description:"Path to Nginx config file"`
-	LogFormatName string        `long:"format" description:"Log format name to look for in the Nginx config file"`
+	ConfigFile    flag.Filename `long:"conf" description:"Path to Nginx config file. The files it includes are read too, so a log_format in conf.d is found"`
+	LogFormatName string        `long:"format" description:"Log format name to look for in the Nginx config file. nginx's own combined format is found even if the config doesn't define it" default:"combined"`
+	FormatString  string        `long:"format_string" description:"The log_format itself, eg '$remote_addr [$time_local] \"$request\" $status', to use instead of finding it in --nginx.conf"`
+	Escape        string        `long:"escape" description:"How the --nginx.format_string escapes values, as log_format's escape= does: default, json or none. Formats found in --nginx.conf say for themselves" default:"default"`
 }
 
 type Parser struct {
+	parsers.Settings
 	conf       Options
 	lineParser LineParser
 	nower      Nower
@@ -32,22 +44,40 @@ type Parser struct {
 func (n *Parser) Init(options interface{}) error {
 	n.conf = *options.(*Options)
 
-	// Verify we've got our config, find our format
-	nginxConfig, err := os.Open(string(n.conf.ConfigFile))
-	if err != nil {
-		return err
-	}
-	defer nginxConfig.Close()
-	// get the nginx log format from the config file
-	// get a nginx log parser
-	parser, err := gonx.NewNginxParser(nginxConfig, n.conf.LogFormatName)
-	if err != nil {
-		return err
+	// find our format, given inline or in the config file
+	format := logFormat{format: n.conf.FormatString, escape: n.conf.Escape}
+	switch {
+	case format.format != "" && n.conf.ConfigFile != "":
+		return errors.New("give the nginx parser one of --nginx.conf and --nginx.format_string, not both")
+	case format.format == "" && n.conf.ConfigFile == "":
+		return errors.New("the nginx parser needs --nginx.conf, or the log_format itself with --nginx.format_string")
+	case format.format == "":
+		name := n.conf.LogFormatName
+		if name == "" {
+			name = "combined"
+		}
+		found, err := findLogFormat(string(n.conf.ConfigFile), name)
+		if err != nil {
+			return err
+		}
+		format = found
 	}
-	gonxParser := &GonxLineParser{
-		parser: parser,
+	switch format.escape {
+	case "json":
+		// gonx would end values at quotes escaped as \"
+		jsonParser, err := newJSONLineParser(format.format)
+		if err != nil {
+			return err
+		}
+		n.lineParser = jsonParser
+	case "", "default", "none":
+		n.lineParser = &GonxLineParser{
+			parser:   gonx.NewParser(format.format),
+			unescape: format.escape != "none",
+		}
+	default:
+		return fmt.Errorf("--nginx.escape must be default, json or none, not %s", format.escape)
 	}
-	n.lineParser = gonxParser
 	n.nower = &RealNower{}
 	return nil
 }
@@ -58,6 +88,8 @@ type LineParser interface {
 
 type GonxLineParser struct {
 	parser *gonx.Parser
+	// unescape undoes the \xXX escaping nginx does by default
+	unescape bool
 }
 
 func (g *GonxLineParser) ParseLine(line string) (map[string]string, error) {
@@ -68,17 +100,38 @@ func (g *GonxLineParser) ParseLine(line string) (map[string]string, error) {
 		}).Debug("failed to parse nginx log line")
 		return nil, err
 	}
+	if g.unescape {
+		for k, v := range gonxEvent.Fields {
+			gonxEvent.Fields[k] = unescapeDefault(v)
+		}
+	}
 	return gonxEvent.Fields, nil
 }
 
+// Describe says what the parser reads, for honeytail parsers describe
+func (n *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary: "nginx access logs, in the log_format named by --nginx.format in the nginx config file --nginx.conf or the files it includes, or given with --nginx.format_string, with a field for each of its variables. " +
+			"Values are unescaped as the log_format's escape= says, - is left out, and lists of $upstream_response_time and the like get a field for each upstream and the total.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			commonLogFormatTimeLayout + ", in $time_local",
+			iso8601TimeLayout + ", in $time_iso8601",
+		},
+	}
+}
+
 func (n *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
 	// parse lines one by one
 	for line := range lines {
-		logrus.WithFields(logrus.Fields{
-			"line": line,
-		}).Debug("Attempting to process nginx log line")
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process nginx log line")
+		}
 		parsedLine, err := n.lineParser.ParseLine(line)
 		if err != nil {
+			n.CountParseError(line, err)
 			continue
 		}
 		// typedEvent, err := typeifyEvent(nginxEvent)
@@ -90,6 +143,7 @@ func (n *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
 			}).Debug("failed to typeify event")
 			continue
 		}
+		splitUpstreamTimes(typedEvent)
 		timestamp := getTimestamp(n.nower, typedEvent)
 
 		e := event.Event{
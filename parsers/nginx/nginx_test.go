@@ -2,7 +2,11 @@ package nginx
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -214,3 +218,140 @@ func TestGetTimestamp(t *testing.T) {
 		}
 	}
 }
+
+func TestFindLogFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "nginx.conf"), []byte(`
+# log_format commented '$nope';
+http {
+    log_format short '$remote_addr $status';
+    include conf.d/*.conf;
+    server {
+        access_log /var/log/nginx/access.log main;
+    }
+}
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "logging.conf"), []byte(`log_format main '$remote_addr - $remote_user [$time_local] "$request" '
+                '$status $body_bytes_sent "$http_referer"; '   # the ; is quoted
+                "\"$http_user_agent\"";
+log_format  json  escape=json  '{"status":"$status"}';
+`), 0644)
+	conf := filepath.Join(dir, "nginx.conf")
+	for _, tc := range []struct {
+		name     string
+		expected logFormat
+	}{
+		{"short", logFormat{format: `$remote_addr $status`, escape: "default"}},
+		{"main", logFormat{format: `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer"; "$http_user_agent"`, escape: "default"}},
+		{"json", logFormat{format: `{"status":"$status"}`, escape: "json"}},
+		{"combined", logFormat{format: combinedFormat, escape: "default"}},
+	} {
+		format, err := findLogFormat(conf, tc.name)
+		if err != nil || format != tc.expected {
+			t.Errorf("expected log_format %s to be %+v, got %+v, %v", tc.name, tc.expected, format, err)
+		}
+	}
+	if _, err := findLogFormat(conf, "commented"); err == nil || !strings.Contains(err.Error(), "there's json, main, short") {
+		t.Errorf("expected an error listing the formats there are, got %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "loop.conf"), []byte(`include loop.conf;`), 0644)
+	if _, err := findLogFormat(filepath.Join(dir, "loop.conf"), "main"); err == nil {
+		t.Error("expected an error for a config that includes itself")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "missing.conf"), []byte(`include nowhere.conf;`), 0644)
+	if _, err := findLogFormat(filepath.Join(dir, "missing.conf"), "main"); err == nil {
+		t.Error("expected an error for an include that doesn't exist")
+	}
+}
+
+func TestFormatString(t *testing.T) {
+	p := &Parser{}
+	if err := p.Init(&Options{FormatString: `$remote_addr [$time_local] "$request" $status`}); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := p.lineParser.ParseLine(`192.0.2.1 [01/Aug/2016:12:00:00 +0000] "GET / HTTP/1.1" 200`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed["request"] != "GET / HTTP/1.1" || parsed["status"] != "200" {
+		t.Errorf("unexpected fields %+v", parsed)
+	}
+	if err := p.Init(&Options{}); err == nil {
+		t.Error("expected an error without --nginx.conf or --nginx.format_string")
+	}
+	if err := p.Init(&Options{ConfigFile: "nginx.conf", FormatString: "$status"}); err == nil {
+		t.Error("expected an error given both --nginx.conf and --nginx.format_string")
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	p := &Parser{}
+	format := `{"addr":"$remote_addr","request":"$request","agent":"$http_user_agent","referer":"${http_referer}"}`
+	if err := p.Init(&Options{FormatString: format, Escape: "json"}); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := p.lineParser.ParseLine(`{"addr":"192.0.2.1","request":"GET /?q=\"x\" HTTP/1.1","agent":"caf\u00e9\\bot","referer":""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"remote_addr": "192.0.2.1", "request": `GET /?q="x" HTTP/1.1`, "http_user_agent": `café\bot`, "http_referer": ""}
+	if !reflect.DeepEqual(parsed, expected) {
+		t.Errorf("expected %+v, got %+v", expected, parsed)
+	}
+
+	if err := p.Init(&Options{FormatString: `$remote_addr "$request"`}); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err = p.lineParser.ParseLine(`192.0.2.1 "GET /\x22caf\xC3\xA9\x22\x5Cx HTTP/1.1"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed["request"] != `GET /"café"\x HTTP/1.1` {
+		t.Errorf("expected the request to be unescaped, got %q", parsed["request"])
+	}
+	if err := p.Init(&Options{FormatString: `$remote_addr`, Escape: "html"}); err == nil {
+		t.Error("expected an error for an escape nginx doesn't have")
+	}
+}
+
+func TestSplitUpstreamTimes(t *testing.T) {
+	for _, tc := range []struct {
+		in       map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			map[string]interface{}{"upstream_response_time": 0.5},
+			map[string]interface{}{"upstream_response_time": 0.5},
+		},
+		{
+			map[string]interface{}{"upstream_response_time": "0.010, 0.020 : 0.5", "upstream_connect_time": "-, 0.001"},
+			map[string]interface{}{
+				"upstream_response_time":   0.53,
+				"upstream_response_time_1": 0.01,
+				"upstream_response_time_2": 0.02,
+				"upstream_response_time_3": 0.5,
+				"upstream_connect_time":    0.001,
+				"upstream_connect_time_2":  0.001,
+			},
+		},
+		{
+			map[string]interface{}{"upstream_header_time": "-, -"},
+			map[string]interface{}{},
+		},
+		{
+			map[string]interface{}{"upstream_response_time": "soon, later"},
+			map[string]interface{}{"upstream_response_time": "soon, later"},
+		},
+	} {
+		splitUpstreamTimes(tc.in)
+		if !reflect.DeepEqual(tc.in, tc.expected) {
+			t.Errorf("expected %+v, got %+v", tc.expected, tc.in)
+		}
+	}
+}
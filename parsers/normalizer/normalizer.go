@@ -0,0 +1,73 @@
+// Package normalizer reduces query statements to their shape by replacing
+// literal values with placeholders, so that queries differing only in their
+// arguments can be grouped together.
+package normalizer
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+const placeholder = "?"
+
+var (
+	reStringLiteral = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.)*"`)
+	reNumber        = regexp.MustCompile(`([^\w.$]|^)-?[0-9]+(?:\.[0-9]+)?(?:[eE][-+]?[0-9]+)?\b`)
+	reInList        = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+	reWhitespace    = regexp.MustCompile(`\s+`)
+)
+
+// Query normalizes a SQL-like (SQL, CQL) statement: string and numeric
+// literals become ?, lists of literals collapse to a single ?, and runs of
+// whitespace collapse to a single space.
+//
+// SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'bob'
+// becomes
+// SELECT * FROM t WHERE id IN (?) AND name = ?
+func Query(q string) string {
+	q = reStringLiteral.ReplaceAllString(q, placeholder)
+	q = reNumber.ReplaceAllString(q, "${1}"+placeholder)
+	q = reInList.ReplaceAllString(q, "("+placeholder+")")
+	q = reWhitespace.ReplaceAllString(q, " ")
+	return strings.TrimSpace(q)
+}
+
+// JSON normalizes a JSON document (such as an Elasticsearch query source) by
+// replacing every scalar value with ? while keeping the keys and structure.
+// Arrays of scalars collapse to a single ?. If the document can't be parsed it
+// is normalized as a Query instead.
+func JSON(doc string) string {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(doc), &parsed); err != nil {
+		return Query(doc)
+	}
+	out, err := json.Marshal(shapeOf(parsed))
+	if err != nil {
+		return Query(doc)
+	}
+	return string(out)
+}
+
+func shapeOf(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case map[string]interface{}:
+		shaped := make(map[string]interface{}, len(typed))
+		for k, val := range typed {
+			shaped[k] = shapeOf(val)
+		}
+		return shaped
+	case []interface{}:
+		shaped := make([]interface{}, 0, len(typed))
+		for _, val := range typed {
+			s := shapeOf(val)
+			if s == placeholder && len(shaped) > 0 && shaped[len(shaped)-1] == placeholder {
+				continue
+			}
+			shaped = append(shaped, s)
+		}
+		return shaped
+	default:
+		return placeholder
+	}
+}
@@ -0,0 +1,38 @@
+package normalizer
+
+import "testing"
+
+func TestQuery(t *testing.T) {
+	testCases := []struct {
+		in, out string
+	}{
+		{
+			in:  "SELECT * FROM t WHERE id IN (1, 2, 3) AND name = 'bob'",
+			out: "SELECT * FROM t WHERE id IN (?) AND name = ?",
+		},
+		{
+			in:  "select  a1,\n b FROM ks.tbl where x=-4.5 LIMIT 100",
+			out: "select a1, b FROM ks.tbl where x=? LIMIT ?",
+		},
+		{
+			in:  `INSERT INTO t (a, b) VALUES ("it\"s", 'o''clock')`,
+			out: "INSERT INTO t (a, b) VALUES (?)",
+		},
+	}
+	for _, tc := range testCases {
+		if res := Query(tc.in); res != tc.out {
+			t.Errorf("Query(%q): expected %q, got %q", tc.in, tc.out, res)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	in := `{"query":{"terms":{"id":[1,2,3]},"match":{"name":"bob"}},"size":10}`
+	expected := `{"query":{"match":{"name":"?"},"terms":{"id":["?"]}},"size":"?"}`
+	if res := JSON(in); res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+	if res := JSON("not json 42"); res != "not json ?" {
+		t.Errorf("expected fallback to query normalization, got %s", res)
+	}
+}
@@ -5,6 +5,10 @@
 package parsers
 
 import (
+	"regexp"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
 	"github.com/honeycombio/honeytail/event"
 )
 
@@ -15,3 +19,88 @@ type Parser interface {
 	// and sends log events to the send channel
 	ProcessLines(lines <-chan string, send chan<- event.Event)
 }
+
+// Debugging reports whether debug logging is on. Parsers check it before
+// logging each line, so the fields for logs that won't be written aren't
+// made for every line.
+func Debugging() bool {
+	return logrus.GetLevel() >= logrus.DebugLevel
+}
+
+// ErrorCounter counts the lines parsers couldn't parse. A nil ErrorCounter
+// counts nothing.
+type ErrorCounter struct {
+	count int64
+	// onError, if it's set, is given each line that couldn't be parsed and
+	// why, as for --parse_error_log
+	onError func(line string, err error)
+}
+
+// NewErrorCounter returns an ErrorCounter that hands each line to onError,
+// if it isn't nil, as well as counting it
+func NewErrorCounter(onError func(line string, err error)) *ErrorCounter {
+	return &ErrorCounter{onError: onError}
+}
+
+// Add counts line as failing to parse because of err. It's called from the
+// parsers' goroutines.
+func (c *ErrorCounter) Add(line string, err error) {
+	if c == nil {
+		return
+	}
+	atomic.AddInt64(&c.count, 1)
+	if c.onError != nil {
+		c.onError(line, err)
+	}
+}
+
+// Count returns how many lines have failed to parse
+func (c *ErrorCounter) Count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.count)
+}
+
+// Closer is implemented by parsers that hold on to something from Init, eg
+// a command they started, until ProcessLines returns. Close lets go of it for
+// a parser that's been set up but won't be given any lines.
+type Closer interface {
+	Close() error
+}
+
+// Describer is implemented by parsers that can say what the logs they read
+// look like, for honeytail parsers describe. It's called without Init.
+type Describer interface {
+	Describe() Description
+}
+
+// Description is what a parser says about the logs it reads
+type Description struct {
+	// Summary is a sentence or two on what the logs are and what the parser
+	// picks out of them
+	Summary string
+	// Examples are lines of the logs, in order, making one or more events
+	Examples []string
+	// Timestamps are the formats the parser reads timestamps in, as Go
+	// reference time layouts, eg "02/Jan/2006:15:04:05 -0700", or in words
+	// for those that aren't layouts, eg seconds since the epoch
+	Timestamps []string
+}
+
+// SubmatchMap returns the named capture groups of re matched against s, or
+// an empty map if re doesn't match
+func SubmatchMap(re *regexp.Regexp, s string) map[string]string {
+	captures := make(map[string]string)
+	match := re.FindStringSubmatch(s)
+	if match == nil {
+		return captures
+	}
+	for i, name := range re.SubexpNames() {
+		if i == 0 || name == "" {
+			continue
+		}
+		captures[name] = match[i]
+	}
+	return captures
+}
@@ -0,0 +1,184 @@
+// Package phpfpm parses PHP-FPM's slow log (one multi-line stack dump per
+// slow request) and its error log. Only the error log says how long a slow
+// request took, and each file has its own parser, so the stack dump events
+// don't get an execution_time.
+package phpfpm
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// sampleLines are a slow log entry followed by error log lines
+var sampleLines = []string{
+	`[01-Aug-2016 12:00:00]  [pool www] pid 1234`,
+	`script_filename = /var/www/index.php`,
+	`[0x00007f0c2a8d6d10] curl_exec() /var/www/lib/http.php:42`,
+	`[0x00007f0c2a8d6c00] fetch() /var/www/index.php:10`,
+	`[01-Aug-2016 12:00:00] WARNING: [pool www] child 1234, script '/var/www/index.php' (request: "GET /index.php") executing too slow (5.123456 sec), logging`,
+	`[01-Aug-2016 12:00:30] WARNING: [pool www] child 1234, script '/var/www/index.php' (request: "GET /index.php") execution timed out (30.000000 sec), terminating`,
+	`[01-Aug-2016 12:00:31] NOTICE: [pool www] child 1235 started`,
+}
+
+const timeLayout = "02-Jan-2006 15:04:05"
+
+// errUnrecognized is why lines that are neither part of a slow log entry nor
+// an error log line didn't parse
+var errUnrecognized = errors.New("not a slow log or error log line")
+
+var (
+	reSlowHeader = regexp.MustCompile(`^\[(?P<time>[^\]]+)\]\s+\[pool (?P<pool>[^\]]+)\] pid (?P<pid>[0-9]+)\s*$`)
+	reScript     = regexp.MustCompile(`^script_filename = (?P<script_filename>.*)$`)
+	reFrame      = regexp.MustCompile(`^\[0x[0-9a-f]+\] (?P<function>[^ ]+) (?P<file>.*?)(?::(?P<line>[0-9]+))?$`)
+	reError      = regexp.MustCompile(`^\[(?P<time>[^\]]+)\] (?P<level>[A-Z]+): (?:\[pool (?P<pool>[^\]]+)\] )?(?P<message>.*)$`)
+	reChild      = regexp.MustCompile(`^child (?P<pid>[0-9]+)`)
+	reSlowScript = regexp.MustCompile(`script '(?P<script_filename>[^']*)'(?: \(request: "(?P<request_method>[A-Z]+) (?P<request_uri>[^"]*)"\))?`)
+	reExecTime   = regexp.MustCompile(`\((?P<execution_time>[0-9.]+) sec\)`)
+)
+
+type Options struct{}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// slowEntry accumulates a slow log stack dump
+type slowEntry struct {
+	timestamp time.Time
+	data      map[string]interface{}
+	frames    []string
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "PHP-FPM's slow log, with each slow request's stack dump as one event, and its error log. execution_time is only on the error log's \"executing too slow\" and \"execution timed out\" warnings; the stack dump events don't have it, as the two logs are usually separate files. Match them up on pool and pid.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			timeLayout + ", in --timezone or local time",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	var cur *slowEntry
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		cur.data["stack_depth"] = len(cur.frames)
+		if len(cur.frames) > 0 {
+			cur.data["stack_trace"] = strings.Join(cur.frames, "\n")
+		}
+		send <- event.Event{
+			Timestamp: cur.timestamp,
+			Data:      cur.data,
+		}
+		cur = nil
+	}
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process php-fpm log line")
+		}
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			// slow log entries are separated by blank lines
+			flush()
+		case reSlowHeader.MatchString(line):
+			flush()
+			m := parsers.SubmatchMap(reSlowHeader, line)
+			cur = &slowEntry{
+				timestamp: p.parseTime(m["time"]),
+				data: map[string]interface{}{
+					"log_type": "slow",
+					"pool":     m["pool"],
+				},
+			}
+			cur.data["pid"], _ = strconv.ParseInt(m["pid"], 10, 64)
+		case cur != nil && reScript.MatchString(line):
+			cur.data["script_filename"] = parsers.SubmatchMap(reScript, line)["script_filename"]
+		case cur != nil && reFrame.MatchString(line):
+			if len(cur.frames) == 0 {
+				// the innermost frame is where the request was stuck
+				m := parsers.SubmatchMap(reFrame, line)
+				cur.data["top_function"] = m["function"]
+				cur.data["top_file"] = m["file"]
+			}
+			cur.frames = append(cur.frames, line)
+		case reError.MatchString(line):
+			flush()
+			send <- p.parseError(line)
+		default:
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("skipping unrecognized php-fpm log line")
+			p.CountParseError(line, errUnrecognized)
+		}
+	}
+	flush()
+	logrus.Debug("lines channel is closed, ending php-fpm processor")
+}
+
+// parseError turns an error log line into an event
+func (p *Parser) parseError(line string) event.Event {
+	m := parsers.SubmatchMap(reError, line)
+	data := map[string]interface{}{
+		"log_type": "error",
+		"level":    m["level"],
+		"message":  m["message"],
+	}
+	if m["pool"] != "" {
+		data["pool"] = m["pool"]
+	}
+	if child := parsers.SubmatchMap(reChild, m["message"]); len(child) != 0 {
+		data["pid"], _ = strconv.ParseInt(child["pid"], 10, 64)
+	}
+	for k, v := range parsers.SubmatchMap(reSlowScript, m["message"]) {
+		if v != "" {
+			data[k] = v
+		}
+	}
+	if et := parsers.SubmatchMap(reExecTime, m["message"]); len(et) != 0 {
+		data["execution_time"], _ = strconv.ParseFloat(et["execution_time"], 64)
+	}
+	return event.Event{
+		Timestamp: p.parseTime(m["time"]),
+		Data:      data,
+	}
+}
+
+func (p *Parser) parseTime(raw string) time.Time {
+	t, err := time.ParseInLocation(timeLayout, raw, p.Location(time.Local))
+	if err != nil {
+		return p.nower.Now()
+	}
+	return t
+}
@@ -0,0 +1,88 @@
+package phpfpm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func TestProcessLines(t *testing.T) {
+	time.Local = time.UTC
+	t1, _ := time.Parse(timeLayout, "01-Aug-2016 12:00:00")
+	input := []string{
+		"",
+		"[01-Aug-2016 12:00:00]  [pool www] pid 1234",
+		"script_filename = /var/www/index.php",
+		"[0x00007f0c2a8d6d10] curl_exec() /var/www/lib/http.php:42",
+		"[0x00007f0c2a8d6c00] fetch() /var/www/index.php:10",
+		"",
+		`[01-Aug-2016 12:00:00] WARNING: [pool www] child 1234, script '/var/www/index.php' (request: "GET /index.php") executing too slow (5.123456 sec), logging`,
+		"[01-Aug-2016 12:00:00] NOTICE: fpm is running, pid 1",
+	}
+	expected := []event.Event{
+		{
+			Timestamp: t1,
+			Data: map[string]interface{}{
+				"log_type":        "slow",
+				"pool":            "www",
+				"pid":             int64(1234),
+				"script_filename": "/var/www/index.php",
+				"top_function":    "curl_exec()",
+				"top_file":        "/var/www/lib/http.php",
+				"stack_depth":     2,
+				"stack_trace":     "[0x00007f0c2a8d6d10] curl_exec() /var/www/lib/http.php:42\n[0x00007f0c2a8d6c00] fetch() /var/www/index.php:10",
+			},
+		},
+		{
+			Timestamp: t1,
+			Data: map[string]interface{}{
+				"log_type":        "error",
+				"level":           "WARNING",
+				"message":         `child 1234, script '/var/www/index.php' (request: "GET /index.php") executing too slow (5.123456 sec), logging`,
+				"pool":            "www",
+				"pid":             int64(1234),
+				"script_filename": "/var/www/index.php",
+				"request_method":  "GET",
+				"request_uri":     "/index.php",
+				"execution_time":  5.123456,
+			},
+		},
+		{
+			Timestamp: t1,
+			Data: map[string]interface{}{
+				"log_type": "error",
+				"level":    "NOTICE",
+				"message":  "fpm is running, pid 1",
+			},
+		},
+	}
+	p := &Parser{nower: &FakeNower{}}
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go func() {
+		for _, line := range input {
+			lines <- line
+		}
+		close(lines)
+	}()
+	go func() {
+		p.ProcessLines(lines, send)
+		close(send)
+	}()
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+}
@@ -0,0 +1,210 @@
+// Package postfix parses Postfix mail logs, stitching together the lines
+// logged for each queue id into one event per delivery attempt.
+package postfix
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// sampleLines are the lines logged for a single message. Each to= line
+// becomes an event carrying everything we learned about the message from the
+// earlier lines.
+var sampleLines = []string{
+	`Aug  1 12:00:00 mail postfix/smtpd[123]: 3F2A1B2C3D: client=unknown[10.0.0.1]`,
+	`Aug  1 12:00:00 mail postfix/cleanup[124]: 3F2A1B2C3D: message-id=<abc@example.com>`,
+	`Aug  1 12:00:00 mail postfix/qmgr[125]: 3F2A1B2C3D: from=<a@example.com>, size=1234, nrcpt=1 (queue active)`,
+	`Aug  1 12:00:01 mail postfix/smtp[126]: 3F2A1B2C3D: to=<b@example.org>, relay=mx.example.org[192.0.2.1]:25, delay=1.2, delays=0.1/0.01/0.5/0.59, dsn=2.0.0, status=sent (250 2.0.0 OK)`,
+	`Aug  1 12:00:01 mail postfix/qmgr[125]: 3F2A1B2C3D: removed`,
+}
+
+const (
+	syslogTimeLayout = "Jan _2 15:04:05"
+	// queue ids we haven't seen a line for in this long are forgotten
+	maxQueueIdle = time.Hour
+	// only bother looking for idle queue ids once we're tracking this many
+	cleanupThreshold = 10000
+)
+
+var (
+	reSyslog  = regexp.MustCompile(`^(?P<time>[A-Z][a-z]{2} [ 0-9][0-9] [0-9:]{8}|[0-9]{4}-[0-9]{2}-[0-9]{2}T[^ ]+) (?P<hostname>[^ ]+) (?P<program>postfix[^ :\[]*)(?:\[(?P<pid>[0-9]+)\])?: (?P<queue_id>[0-9A-Za-z]+): (?P<message>.*)$`)
+	reKV      = regexp.MustCompile(`([a-z_-]+)=(<[^>]*>|[^, ]*)`)
+	reStatus  = regexp.MustCompile(`status=[a-z]+ \((?P<detail>.*)\)$`)
+	reClient  = regexp.MustCompile(`^(?P<host>[^\[]*)\[(?P<ip>[^\]]*)\](?::(?P<port>[0-9]+))?$`)
+	delayKeys = []string{"delay_before_queue", "delay_in_queue", "delay_connection", "delay_transmission"}
+)
+
+type Options struct{}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// message is what we know so far about a single queue id
+type message struct {
+	fields   map[string]interface{}
+	lastSeen time.Time
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Postfix mail logs, with the lines logged for each queue id joined into one event per delivery attempt.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			syslogTimeLayout + ", in --timezone or local time, in the latest year that isn't in the future",
+			time.RFC3339Nano,
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	queue := make(map[string]*message)
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process postfix log line")
+		}
+		prefix := parsers.SubmatchMap(reSyslog, line)
+		if len(prefix) == 0 {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("skipping line without a postfix queue id")
+			continue
+		}
+		ts := p.parseTime(prefix["time"])
+		qid := prefix["queue_id"]
+		msg, ok := queue[qid]
+		if !ok {
+			msg = &message{fields: map[string]interface{}{
+				"queue_id": qid,
+				"hostname": prefix["hostname"],
+			}}
+			queue[qid] = msg
+		}
+		msg.lastSeen = ts
+
+		body := prefix["message"]
+		if body == "removed" {
+			delete(queue, qid)
+			continue
+		}
+		fields := parseKV(body)
+		if _, ok := fields["to"]; ok {
+			// a delivery attempt; send it along with everything we know
+			data := make(map[string]interface{}, len(msg.fields)+len(fields))
+			for k, v := range msg.fields {
+				data[k] = v
+			}
+			for k, v := range fields {
+				data[k] = v
+			}
+			data["program"] = prefix["program"]
+			if m := parsers.SubmatchMap(reStatus, body); len(m) != 0 {
+				data["status_detail"] = m["detail"]
+			}
+			send <- event.Event{
+				Timestamp: ts,
+				Data:      data,
+			}
+			continue
+		}
+		// otherwise it's information about the message to remember
+		for k, v := range fields {
+			msg.fields[k] = v
+		}
+		if len(queue) > cleanupThreshold {
+			for id, m := range queue {
+				if ts.Sub(m.lastSeen) > maxQueueIdle {
+					delete(queue, id)
+				}
+			}
+		}
+	}
+	logrus.Debug("lines channel is closed, ending postfix processor")
+}
+
+// parseKV pulls the key=value pairs out of a postfix message and types them
+func parseKV(body string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, kv := range reKV.FindAllStringSubmatch(body, -1) {
+		key := strings.Replace(kv[1], "-", "_", -1)
+		val := strings.Trim(kv[2], "<>")
+		switch key {
+		case "delays":
+			for i, part := range strings.Split(val, "/") {
+				if i >= len(delayKeys) {
+					break
+				}
+				if f, err := strconv.ParseFloat(part, 64); err == nil {
+					fields[delayKeys[i]] = f
+				}
+			}
+		case "delay":
+			if f, err := strconv.ParseFloat(val, 64); err == nil {
+				fields[key] = f
+			}
+		case "size", "nrcpt":
+			if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+				fields[key] = i
+			}
+		case "client", "relay":
+			fields[key] = val
+			if m := parsers.SubmatchMap(reClient, val); len(m) != 0 {
+				fields[key+"_host"] = m["host"]
+				fields[key+"_ip"] = m["ip"]
+				if port, err := strconv.ParseInt(m["port"], 10, 64); err == nil {
+					fields[key+"_port"] = port
+				}
+			}
+		default:
+			fields[key] = val
+		}
+	}
+	return fields
+}
+
+// parseTime handles both the traditional (yearless) syslog timestamp and
+// the RFC3339 one written by rsyslog's high precision format
+func (p *Parser) parseTime(raw string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+		return t
+	}
+	t, err := time.ParseInLocation(syslogTimeLayout, raw, p.Location(time.Local))
+	if err != nil {
+		return p.nower.Now()
+	}
+	// traditional syslog timestamps have no year; assume the most recent one
+	// that doesn't put the line in the future
+	now := p.nower.Now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
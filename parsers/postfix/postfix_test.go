@@ -0,0 +1,104 @@
+package postfix
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2016-08-10T15:04:05Z")
+	return fakeTime
+}
+
+func TestProcessLines(t *testing.T) {
+	time.Local = time.UTC
+	t1, _ := time.Parse(time.RFC3339, "2016-08-01T12:00:01Z")
+	input := []string{
+		"Aug  1 12:00:00 mail postfix/smtpd[123]: 3F2A1B2C3D: client=unknown[10.0.0.1]",
+		"Aug  1 12:00:00 mail postfix/cleanup[124]: 3F2A1B2C3D: message-id=<abc@example.com>",
+		"Aug  1 12:00:00 mail postfix/smtpd[123]: connect from unknown[10.0.0.2]",
+		"Aug  1 12:00:00 mail postfix/qmgr[125]: 3F2A1B2C3D: from=<a@example.com>, size=1234, nrcpt=1 (queue active)",
+		"Aug  1 12:00:01 mail postfix/smtp[126]: 3F2A1B2C3D: to=<b@example.org>, relay=mx.example.org[192.0.2.1]:25, delay=1.2, delays=0.1/0.01/0.5/0.59, dsn=2.0.0, status=sent (250 2.0.0 OK)",
+		"Aug  1 12:00:01 mail postfix/qmgr[125]: 3F2A1B2C3D: removed",
+		"Aug  1 12:00:02 mail postfix/smtp[126]: 3F2A1B2C3D: to=<c@example.org>, relay=none, delay=0.5, delays=0.5/0/0/0, dsn=4.4.1, status=deferred (connect refused)",
+	}
+	expected := []event.Event{
+		{
+			Timestamp: t1,
+			Data: map[string]interface{}{
+				"queue_id":           "3F2A1B2C3D",
+				"hostname":           "mail",
+				"program":            "postfix/smtp",
+				"client":             "unknown[10.0.0.1]",
+				"client_host":        "unknown",
+				"client_ip":          "10.0.0.1",
+				"message_id":         "abc@example.com",
+				"from":               "a@example.com",
+				"size":               int64(1234),
+				"nrcpt":              int64(1),
+				"to":                 "b@example.org",
+				"relay":              "mx.example.org[192.0.2.1]:25",
+				"relay_host":         "mx.example.org",
+				"relay_ip":           "192.0.2.1",
+				"relay_port":         int64(25),
+				"delay":              1.2,
+				"delay_before_queue": 0.1,
+				"delay_in_queue":     0.01,
+				"delay_connection":   0.5,
+				"delay_transmission": 0.59,
+				"dsn":                "2.0.0",
+				"status":             "sent",
+				"status_detail":      "250 2.0.0 OK",
+			},
+		},
+		{
+			// the queue id was removed, so this attempt stands alone
+			Timestamp: t1.Add(time.Second),
+			Data: map[string]interface{}{
+				"queue_id":           "3F2A1B2C3D",
+				"hostname":           "mail",
+				"program":            "postfix/smtp",
+				"to":                 "c@example.org",
+				"relay":              "none",
+				"delay":              0.5,
+				"delay_before_queue": 0.5,
+				"delay_in_queue":     float64(0),
+				"delay_connection":   float64(0),
+				"delay_transmission": float64(0),
+				"dsn":                "4.4.1",
+				"status":             "deferred",
+				"status_detail":      "connect refused",
+			},
+		},
+	}
+	p := &Parser{nower: &FakeNower{}}
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go func() {
+		for _, line := range input {
+			lines <- line
+		}
+		close(lines)
+	}()
+	go func() {
+		p.ProcessLines(lines, send)
+		close(send)
+	}()
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected), len(events), events)
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(events[i], expected[i]) {
+			t.Errorf("event %d: expected %+v, got %+v", i, expected[i], events[i])
+		}
+	}
+}
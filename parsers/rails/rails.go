@@ -0,0 +1,236 @@
+// Package rails parses Rails request logs. It understands both the classic
+// multi-line format (Started / Processing / Completed) and the single-line
+// key=value output of lograge.
+package rails
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// sampleLines are a classic log entry followed by a lograge one. Classic
+// entries may be prefixed by the default Ruby Logger formatter or by tagged
+// logging ([request_id] etc.)
+var sampleLines = []string{
+	`Started GET "/users/1" for 127.0.0.1 at 2016-08-01 12:00:00 -0700`,
+	`Processing by UsersController#show as HTML`,
+	`  Parameters: {"id"=>"1"}`,
+	`  Rendered users/show.html.erb within layouts/application (1.2ms)`,
+	`Completed 200 OK in 58ms (Views: 40.4ms | ActiveRecord: 15.3ms)`,
+	`method=GET path=/users/1 format=html controller=UsersController action=show status=200 duration=58.33 view=40.43 db=15.26`,
+}
+
+const (
+	startedTimeLayout = "2006-01-02 15:04:05 -0700"
+	loggerTimeLayout  = "2006-01-02T15:04:05.999999"
+)
+
+var (
+	// I, [2016-08-01T12:00:00.123456 #1234]  INFO -- : message
+	reLoggerPrefix = regexp.MustCompile(`^[A-Z], \[(?P<time>[^ \]]+) #(?P<pid>[0-9]+)\] +[A-Z]+ -- [^:]*: ?`)
+	reTags         = regexp.MustCompile(`^(?:\[[^\]]*\] ?)+`)
+	reStarted      = regexp.MustCompile(`^Started (?P<method>[A-Z]+) "(?P<path>[^"]*)" for (?P<remote_addr>[^ ]+) at (?P<time>.+)$`)
+	reProcessing   = regexp.MustCompile(`^Processing by (?P<controller>[^#]+)#(?P<action>[^ ]+) as (?P<format>[^ ]+)`)
+	reCompleted    = regexp.MustCompile(`^Completed (?P<status>[0-9]{3}) .*?in (?P<duration>[0-9.]+)ms(?: \((?P<timings>.*)\))?`)
+	reTiming       = regexp.MustCompile(`^(?P<name>[A-Za-z ]+): (?P<value>[0-9.]+)(?:ms)?$`)
+	reLogrageKV    = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_.]*)=("(?:[^"\\]|\\.)*"|[^ ]*)`)
+)
+
+// timingNames maps the labels in the Completed line's parenthetical onto the
+// field names lograge uses for the same values
+var timingNames = map[string]string{
+	"Views":        "view",
+	"ActiveRecord": "db",
+	"Allocations":  "allocations",
+}
+
+type Options struct{}
+
+type Parser struct {
+	parsers.Settings
+	conf  Options
+	nower Nower
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	p.nower = &RealNower{}
+	return nil
+}
+
+// request accumulates the pieces of a classic multi-line request
+type request struct {
+	timestamp time.Time
+	data      map[string]interface{}
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Rails request logs, either the classic Started, Processing and Completed lines joined into one event per request or lograge's key=value lines.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			startedTimeLayout + ", in Started lines",
+			loggerTimeLayout + ", in the Ruby Logger prefix, in --timezone or UTC",
+			time.RFC3339Nano + ", in lograge's time",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	// in-flight classic requests, keyed by whatever identifies the worker
+	// that wrote them (pid or tags). Untagged logs all share the "" key.
+	inFlight := make(map[string]*request)
+	for line := range lines {
+		if parsers.Debugging() {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("Attempting to process rails log line")
+		}
+		key, prefixTime, msg := p.splitPrefix(line)
+		msg = strings.TrimSpace(msg)
+
+		if isLograge(msg) {
+			send <- p.parseLograge(msg, prefixTime)
+			continue
+		}
+
+		switch {
+		case reStarted.MatchString(msg):
+			if req, ok := inFlight[key]; ok {
+				// never saw the Completed line for the previous request
+				send <- p.finish(req)
+			}
+			matches := parsers.SubmatchMap(reStarted, msg)
+			req := &request{data: make(map[string]interface{})}
+			req.data["method"] = matches["method"]
+			req.data["path"] = matches["path"]
+			req.data["remote_addr"] = matches["remote_addr"]
+			if ts, err := time.Parse(startedTimeLayout, matches["time"]); err == nil {
+				req.timestamp = ts
+			} else {
+				req.timestamp = prefixTime
+			}
+			inFlight[key] = req
+		case reProcessing.MatchString(msg):
+			req, ok := inFlight[key]
+			if !ok {
+				continue
+			}
+			for k, v := range parsers.SubmatchMap(reProcessing, msg) {
+				req.data[k] = v
+			}
+		case reCompleted.MatchString(msg):
+			req, ok := inFlight[key]
+			if !ok {
+				req = &request{data: make(map[string]interface{}), timestamp: prefixTime}
+			}
+			delete(inFlight, key)
+			matches := parsers.SubmatchMap(reCompleted, msg)
+			req.data["status"], _ = strconv.ParseInt(matches["status"], 10, 64)
+			req.data["duration"], _ = strconv.ParseFloat(matches["duration"], 64)
+			for _, timing := range strings.Split(matches["timings"], "|") {
+				tm := parsers.SubmatchMap(reTiming, strings.TrimSpace(timing))
+				name, ok := timingNames[tm["name"]]
+				if !ok {
+					continue
+				}
+				if f, err := strconv.ParseFloat(tm["value"], 64); err == nil {
+					req.data[name] = f
+				}
+			}
+			send <- p.finish(req)
+		default:
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("skipping rails log line that is not part of a request summary")
+		}
+	}
+	for _, req := range inFlight {
+		send <- p.finish(req)
+	}
+	logrus.Debug("lines channel is closed, ending rails processor")
+}
+
+// finish turns an accumulated request into an event
+func (p *Parser) finish(req *request) event.Event {
+	if req.timestamp.IsZero() {
+		req.timestamp = p.nower.Now()
+	}
+	return event.Event{
+		Timestamp: req.timestamp,
+		Data:      req.data,
+	}
+}
+
+// splitPrefix strips any Logger formatter prefix and tags from the line,
+// returning a key identifying the writer, the prefix's timestamp (if any), and
+// the remaining message
+func (p *Parser) splitPrefix(line string) (string, time.Time, string) {
+	var key string
+	var ts time.Time
+	if loc := reLoggerPrefix.FindStringSubmatchIndex(line); loc != nil {
+		prefix := parsers.SubmatchMap(reLoggerPrefix, line)
+		key = prefix["pid"]
+		ts, _ = time.ParseInLocation(loggerTimeLayout, prefix["time"], p.Location(time.UTC))
+		line = line[loc[1]:]
+	}
+	if tags := reTags.FindString(line); tags != "" {
+		key += strings.TrimSpace(tags)
+		line = line[len(tags):]
+	}
+	return key, ts, line
+}
+
+// isLograge guesses whether a message is a lograge key=value summary
+func isLograge(msg string) bool {
+	return strings.HasPrefix(msg, "method=") ||
+		(strings.Contains(msg, "controller=") && strings.Contains(msg, "status="))
+}
+
+func (p *Parser) parseLograge(msg string, ts time.Time) event.Event {
+	data := make(map[string]interface{})
+	for _, kv := range reLogrageKV.FindAllStringSubmatch(msg, -1) {
+		key, val := kv[1], kv[2]
+		if unquoted, err := strconv.Unquote(val); err == nil {
+			data[key] = unquoted
+			continue
+		}
+		if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+			data[key] = i
+		} else if f, err := strconv.ParseFloat(val, 64); err == nil {
+			data[key] = f
+		} else {
+			data[key] = val
+		}
+	}
+	if raw, ok := data["time"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+			ts = t
+			delete(data, "time")
+		}
+	}
+	if ts.IsZero() {
+		ts = p.nower.Now()
+	}
+	return event.Event{
+		Timestamp: ts,
+		Data:      data,
+	}
+}
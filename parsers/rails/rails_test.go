@@ -0,0 +1,124 @@
+package rails
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func processLines(input []string) []event.Event {
+	p := &Parser{nower: &FakeNower{}}
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go func() {
+		for _, line := range input {
+			lines <- line
+		}
+		close(lines)
+	}()
+	go func() {
+		p.ProcessLines(lines, send)
+		close(send)
+	}()
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestClassicRequest(t *testing.T) {
+	t1, _ := time.Parse(startedTimeLayout, "2016-08-01 12:00:00 -0700")
+	events := processLines([]string{
+		`Started GET "/users/1" for 127.0.0.1 at 2016-08-01 12:00:00 -0700`,
+		`Processing by UsersController#show as HTML`,
+		`  Parameters: {"id"=>"1"}`,
+		`  Rendered users/show.html.erb within layouts/application (1.2ms)`,
+		`Completed 200 OK in 58ms (Views: 40.4ms | ActiveRecord: 15.3ms)`,
+	})
+	expected := []event.Event{
+		{
+			Timestamp: t1,
+			Data: map[string]interface{}{
+				"method":      "GET",
+				"path":        "/users/1",
+				"remote_addr": "127.0.0.1",
+				"controller":  "UsersController",
+				"action":      "show",
+				"format":      "HTML",
+				"status":      int64(200),
+				"duration":    float64(58),
+				"view":        40.4,
+				"db":          15.3,
+			},
+		},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+}
+
+func TestInterleavedTaggedRequests(t *testing.T) {
+	events := processLines([]string{
+		`I, [2016-08-01T12:00:00.100000 #11]  INFO -- : Started GET "/a" for 10.0.0.1 at 2016-08-01 12:00:00 -0700`,
+		`I, [2016-08-01T12:00:00.110000 #22]  INFO -- : Started POST "/b" for 10.0.0.2 at 2016-08-01 12:00:00 -0700`,
+		`I, [2016-08-01T12:00:00.120000 #22]  INFO -- : Completed 500 Internal Server Error in 3ms`,
+		`I, [2016-08-01T12:00:00.130000 #11]  INFO -- : Completed 404 Not Found in 7.5ms (ActiveRecord: 1.0ms)`,
+	})
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d: %+v", len(events), events)
+	}
+	if events[0].Data["path"] != "/b" || events[0].Data["status"] != int64(500) {
+		t.Errorf("first completed request wrong: %+v", events[0].Data)
+	}
+	if events[1].Data["path"] != "/a" || events[1].Data["db"] != 1.0 {
+		t.Errorf("second completed request wrong: %+v", events[1].Data)
+	}
+}
+
+func TestLograge(t *testing.T) {
+	t1, _ := time.Parse(time.RFC3339, "2016-08-01T19:00:00Z")
+	events := processLines([]string{
+		`method=GET path=/jobs/833552.json format=json controller=JobsController action=show status=200 duration=58.33 view=40.43 db=15.26`,
+		`[abc-123] method=POST path="/a b" controller=AController action=create status=302 duration=1.5 time=2016-08-01T19:00:00Z`,
+	})
+	expected := []event.Event{
+		{
+			Timestamp: (&FakeNower{}).Now(),
+			Data: map[string]interface{}{
+				"method":     "GET",
+				"path":       "/jobs/833552.json",
+				"format":     "json",
+				"controller": "JobsController",
+				"action":     "show",
+				"status":     int64(200),
+				"duration":   58.33,
+				"view":       40.43,
+				"db":         15.26,
+			},
+		},
+		{
+			Timestamp: t1,
+			Data: map[string]interface{}{
+				"method":     "POST",
+				"path":       "/a b",
+				"controller": "AController",
+				"action":     "create",
+				"status":     int64(302),
+				"duration":   1.5,
+			},
+		},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+}
@@ -0,0 +1,49 @@
+package parsers
+
+import (
+	"time"
+
+	"github.com/honeycombio/honeytail/parsers/epoch"
+)
+
+// Settings are what the parsers in a run of honeytail share, rather than
+// each having its own option for. The zero value keeps to each parser's
+// defaults and doesn't count parse errors.
+type Settings struct {
+	// Timezone is where timestamps without a zone are taken to be, as set
+	// with --timezone. When it's nil, each parser keeps to its own default:
+	// local time for syslog style timestamps and UTC for the rest.
+	Timezone *time.Location
+	// EpochUnit is what counts since the epoch are taken to count, as set
+	// with --epoch_unit
+	EpochUnit epoch.Unit
+	// Errors counts the lines that couldn't be parsed
+	Errors *ErrorCounter
+}
+
+// Configurable is implemented by parsers that use Settings, which they're
+// given before Init. Parsers embedding Settings implement it.
+type Configurable interface {
+	Configure(settings Settings)
+}
+
+// Configure replaces s with settings
+func (s *Settings) Configure(settings Settings) {
+	*s = settings
+}
+
+// Location returns Timezone if it's set, and def otherwise, for parsing a
+// timestamp that may not have a zone
+func (s *Settings) Location(def *time.Location) *time.Location {
+	if s.Timezone != nil {
+		return s.Timezone
+	}
+	return def
+}
+
+// CountParseError notes that a parser couldn't parse line, because of err.
+// Lines a parser skips on purpose, eg those that aren't part of a request
+// summary, aren't errors.
+func (s *Settings) CountParseError(line string, err error) {
+	s.Errors.Add(line, err)
+}
@@ -0,0 +1,263 @@
+// Package stacktrace parses plain application logs that may contain multi-line
+// Python tracebacks or Java exception stack traces. Each stack is folded into
+// a single event and, when possible, attached to the event for the log line
+// that preceded it.
+package stacktrace
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/event"
+	"github.com/honeycombio/honeytail/parsers"
+)
+
+// sampleLines are a python traceback followed by a java stack trace
+var sampleLines = []string{
+	`2016-08-01 12:00:00,123 ERROR app request failed`,
+	`Traceback (most recent call last):`,
+	`  File "app.py", line 10, in handler`,
+	`    do_thing()`,
+	`  File "app.py", line 5, in do_thing`,
+	`    raise ValueError("bad value")`,
+	`ValueError: bad value`,
+	`2016-08-01 12:00:00,123 ERROR [main] c.e.App - request failed`,
+	`java.lang.IllegalStateException: bad state`,
+	`        at com.example.App.doThing(App.java:5)`,
+	`        at com.example.App.main(App.java:10)`,
+	`Caused by: java.io.IOException: disk full`,
+	`        at com.example.Disk.write(Disk.java:42)`,
+	`        ... 2 more`,
+}
+
+var (
+	rePythonStart    = regexp.MustCompile(`^Traceback \(most recent call last\):\s*$`)
+	rePythonFrame    = regexp.MustCompile(`^\s+File "`)
+	rePythonChain    = regexp.MustCompile(`^(During handling of the above exception|The above exception was the direct cause)`)
+	rePythonExc      = regexp.MustCompile(`^(?P<class>[A-Za-z_][\w.]*)(?::\s*(?P<message>.*))?$`)
+	reJavaStart      = regexp.MustCompile(`^(?:Exception in thread "[^"]*" )?(?P<class>(?:[a-zA-Z_$][\w$]*\.)+[\w$]*(?:Exception|Error|Throwable)[\w$]*)(?::\s*(?P<message>.*))?$`)
+	reJavaFrame      = regexp.MustCompile(`^\s+at `)
+	reJavaContinue   = regexp.MustCompile(`^(?:\s+\.\.\. \d+ (?:more|common frames omitted)|\s*Caused by: |\s*Suppressed: )`)
+	defaultFlushWait = time.Second
+)
+
+type Options struct {
+	LineRegex     string `long:"line_regex" description:"Regular expression with named groups used to parse lines that are not part of a stack trace. Defaults to putting the whole line in the 'message' field"`
+	TimeFieldName string `long:"timefield" description:"Name of the line_regex group that contains a timestamp"`
+	Format        string `long:"format" description:"Format of the timestamp found in timefield. Please use the reference time Mon Jan 2 15:04:05 -0700 MST 2006"`
+}
+
+type Parser struct {
+	parsers.Settings
+	conf      Options
+	lineRegex *regexp.Regexp
+	nower     Nower
+	// flushWait is how long to hold a pending event waiting for a stack trace
+	// to follow it before sending it on its own
+	flushWait time.Duration
+}
+
+type Nower interface {
+	Now() time.Time
+}
+
+type RealNower struct{}
+
+func (r *RealNower) Now() time.Time {
+	return time.Now().UTC()
+}
+
+func (p *Parser) Init(options interface{}) error {
+	p.conf = *options.(*Options)
+	if p.conf.LineRegex != "" {
+		re, err := regexp.Compile(p.conf.LineRegex)
+		if err != nil {
+			return err
+		}
+		p.lineRegex = re
+	}
+	p.nower = &RealNower{}
+	p.flushWait = defaultFlushWait
+	return nil
+}
+
+// trace accumulates the lines of a single stack trace
+type trace struct {
+	python  bool
+	lines   []string
+	class   string
+	message string
+	depth   int
+	// done is set once a python trace has seen its exception line; only a
+	// chained traceback may follow it
+	done bool
+}
+
+func (t *trace) fields() map[string]interface{} {
+	return map[string]interface{}{
+		"exception_class":   t.class,
+		"exception_message": t.message,
+		"stack_depth":       t.depth,
+		"stack_trace":       strings.Join(t.lines, "\n"),
+	}
+}
+
+// Describe says what the parser reads, for honeytail parsers describe
+func (p *Parser) Describe() parsers.Description {
+	return parsers.Description{
+		Summary:  "Plain application logs with multi-line Python tracebacks or Java stack traces, each folded into one event with the line before it. Other lines are parsed with --stacktrace.line_regex, or sent whole as message.",
+		Examples: sampleLines,
+		Timestamps: []string{
+			"--stacktrace.format, in the --stacktrace.timefield group of --stacktrace.line_regex, in --timezone or UTC",
+		},
+	}
+}
+
+func (p *Parser) ProcessLines(lines <-chan string, send chan<- event.Event) {
+	// pending is the most recent non-stack event, held back briefly so that a
+	// stack trace following it can be attached
+	var pending *event.Event
+	var cur *trace
+	flush := func() {
+		if cur != nil {
+			if pending == nil {
+				pending = &event.Event{
+					Timestamp: p.nower.Now(),
+					Data:      make(map[string]interface{}),
+				}
+			}
+			for k, v := range cur.fields() {
+				pending.Data[k] = v
+			}
+			cur = nil
+		}
+		if pending != nil {
+			send <- *pending
+			pending = nil
+		}
+	}
+	for {
+		var line string
+		var ok bool
+		if pending == nil && cur == nil {
+			line, ok = <-lines
+		} else {
+			select {
+			case line, ok = <-lines:
+			case <-time.After(p.flushWait):
+				flush()
+				continue
+			}
+		}
+		if !ok {
+			break
+		}
+		if cur != nil {
+			if cur.consume(line) {
+				continue
+			}
+			// the line doesn't belong to the trace; the trace is over
+			flush()
+		}
+		if t := startTrace(line); t != nil {
+			cur = t
+			continue
+		}
+		// an ordinary log line
+		if pending != nil {
+			flush()
+		}
+		pending = p.parseLine(line)
+	}
+	flush()
+	logrus.Debug("lines channel is closed, ending stacktrace processor")
+}
+
+// startTrace returns a new trace if line begins one
+func startTrace(line string) *trace {
+	if rePythonStart.MatchString(line) {
+		return &trace{python: true, lines: []string{line}}
+	}
+	if m := reJavaStart.FindStringSubmatch(line); m != nil {
+		return &trace{lines: []string{line}, class: m[1], message: m[2]}
+	}
+	return nil
+}
+
+// consume adds line to the trace if it belongs there, returning false if it
+// does not
+func (t *trace) consume(line string) bool {
+	if t.python {
+		switch {
+		case line == "", rePythonChain.MatchString(line), rePythonStart.MatchString(line):
+			// chained exceptions; keep going, the last one raised wins
+			t.done = false
+		case t.done:
+			return false
+		case rePythonFrame.MatchString(line):
+			t.depth++
+		case strings.HasPrefix(line, " "), strings.HasPrefix(line, "\t"):
+			// source line of the frame above
+		default:
+			m := rePythonExc.FindStringSubmatch(line)
+			if m == nil {
+				return false
+			}
+			t.class = m[1]
+			t.message = m[2]
+			t.done = true
+		}
+		t.lines = append(t.lines, line)
+		return true
+	}
+	switch {
+	case reJavaFrame.MatchString(line):
+		t.depth++
+	case reJavaContinue.MatchString(line):
+	default:
+		return false
+	}
+	t.lines = append(t.lines, line)
+	return true
+}
+
+// parseLine turns an ordinary log line into an event
+func (p *Parser) parseLine(line string) *event.Event {
+	data := make(map[string]interface{})
+	ts := time.Time{}
+	if p.lineRegex == nil {
+		data["message"] = line
+	} else {
+		match := p.lineRegex.FindStringSubmatch(line)
+		if match == nil {
+			logrus.WithFields(logrus.Fields{
+				"line": line,
+			}).Debug("line_regex didn't match; using the whole line as the message")
+			data["message"] = line
+		}
+		for i, name := range p.lineRegex.SubexpNames() {
+			if i == 0 || name == "" || match == nil {
+				continue
+			}
+			data[name] = match[i]
+		}
+	}
+	if raw, ok := data[p.conf.TimeFieldName].(string); ok && p.conf.Format != "" {
+		// tolerate comma separated fractional seconds, as python's logging emits
+		raw = strings.Replace(raw, ",", ".", -1)
+		format := strings.Replace(p.conf.Format, ",", ".", -1)
+		if t, err := time.ParseInLocation(format, raw, p.Location(time.UTC)); err == nil {
+			ts = t
+			delete(data, p.conf.TimeFieldName)
+		}
+	}
+	if ts.IsZero() {
+		ts = p.nower.Now()
+	}
+	return &event.Event{
+		Timestamp: ts,
+		Data:      data,
+	}
+}
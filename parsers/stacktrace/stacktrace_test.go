@@ -0,0 +1,133 @@
+package stacktrace
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeytail/event"
+)
+
+type FakeNower struct{}
+
+func (f *FakeNower) Now() time.Time {
+	fakeTime, _ := time.Parse(time.RFC3339, "2010-06-21T15:04:05Z")
+	return fakeTime
+}
+
+func processLines(p *Parser, input []string) []event.Event {
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go func() {
+		for _, line := range input {
+			lines <- line
+		}
+		close(lines)
+	}()
+	go func() {
+		p.ProcessLines(lines, send)
+		close(send)
+	}()
+	var events []event.Event
+	for ev := range send {
+		events = append(events, ev)
+	}
+	return events
+}
+
+func newTestParser(opts Options) *Parser {
+	p := &Parser{}
+	p.Init(&opts)
+	p.nower = &FakeNower{}
+	return p
+}
+
+func TestPythonTraceback(t *testing.T) {
+	p := newTestParser(Options{
+		LineRegex:     `^(?P<time>\S+ \S+) (?P<level>\w+) (?P<message>.*)$`,
+		TimeFieldName: "time",
+		Format:        "2006-01-02 15:04:05,000",
+	})
+	t1, _ := time.Parse("2006-01-02 15:04:05.000", "2016-08-01 12:00:00.123")
+	events := processLines(p, []string{
+		"2016-08-01 12:00:00,123 ERROR request failed",
+		"Traceback (most recent call last):",
+		`  File "app.py", line 10, in handler`,
+		"    do_thing()",
+		`  File "app.py", line 5, in do_thing`,
+		`    raise ValueError("bad value")`,
+		"ValueError: bad value",
+		"2016-08-01 12:00:00,123 INFO all better",
+	})
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d: %+v", len(events), events)
+	}
+	expected := event.Event{
+		Timestamp: t1,
+		Data: map[string]interface{}{
+			"level":             "ERROR",
+			"message":           "request failed",
+			"exception_class":   "ValueError",
+			"exception_message": "bad value",
+			"stack_depth":       2,
+			"stack_trace": `Traceback (most recent call last):
+  File "app.py", line 10, in handler
+    do_thing()
+  File "app.py", line 5, in do_thing
+    raise ValueError("bad value")
+ValueError: bad value`,
+		},
+	}
+	if !reflect.DeepEqual(events[0], expected) {
+		t.Errorf("expected %+v, got %+v", expected, events[0])
+	}
+	if events[1].Data["message"] != "all better" {
+		t.Errorf("unexpected second event %+v", events[1])
+	}
+}
+
+func TestJavaException(t *testing.T) {
+	p := newTestParser(Options{})
+	events := processLines(p, []string{
+		"java.lang.IllegalStateException: bad state",
+		"\tat com.example.App.doThing(App.java:5)",
+		"\tat com.example.App.main(App.java:10)",
+		"Caused by: java.io.IOException: disk full",
+		"\tat com.example.Disk.write(Disk.java:42)",
+		"\t... 2 more",
+		"next line",
+	})
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events, got %d: %+v", len(events), events)
+	}
+	ev := events[0]
+	if ev.Data["exception_class"] != "java.lang.IllegalStateException" ||
+		ev.Data["exception_message"] != "bad state" ||
+		ev.Data["stack_depth"] != 3 {
+		t.Errorf("unexpected trace fields %+v", ev.Data)
+	}
+	if _, ok := ev.Data["message"]; ok {
+		t.Errorf("trace with no preceding line should stand alone: %+v", ev.Data)
+	}
+	if events[1].Data["message"] != "next line" {
+		t.Errorf("unexpected second event %+v", events[1])
+	}
+}
+
+func TestPendingEventFlushesWhenIdle(t *testing.T) {
+	p := newTestParser(Options{})
+	p.flushWait = time.Millisecond
+	lines := make(chan string)
+	send := make(chan event.Event)
+	go p.ProcessLines(lines, send)
+	lines <- "just one line"
+	select {
+	case ev := <-send:
+		if ev.Data["message"] != "just one line" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Error("pending event was never flushed")
+	}
+	close(lines)
+}
@@ -0,0 +1,308 @@
+// Package pubsub implements consuming log lines from a Google Cloud Pub/Sub
+// subscription.
+//
+// pubsub pulls messages from a subscription and provides a channel on which
+// each log line will be sent as a string, the same way the tail package does
+// for lines of a file. Messages delivered by a Cloud Logging sink (LogEntry
+// JSON) are unwrapped into a line of JSON holding the entry's payload along
+// with its severity, timestamp and resource and labels; any other message is
+// split into lines. Messages are only acknowledged once the events made from
+// them have been sent, so ones that take longer than the subscription's ack
+// deadline may be delivered again.
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/honeycombio/honeytail/gcp"
+)
+
+const (
+	scheme   = "pubsub://"
+	endpoint = "https://pubsub.googleapis.com/v1/"
+	// ackInterval is how often finished messages are acknowledged when no
+	// new messages are arriving
+	ackInterval = time.Second
+)
+
+type Options struct {
+	MaxMessages  int `long:"max_messages" description:"Most messages to pull at a time" default:"100"`
+	PollInterval int `long:"poll_interval" description:"Milliseconds to wait between pulls that returned no messages" default:"1000"`
+}
+
+// Progress lets the consumer find out when the events made from the
+// messages it has handed out have been sent. checkpoint.Tracker implements
+// it.
+type Progress interface {
+	// Mark returns a position covering every event made so far
+	Mark() uint64
+	// Reached reports whether every event up to mark has been sent
+	Reached(mark uint64) bool
+	// OnFinish registers f to be called once every event has been sent
+	OnFinish(f func())
+}
+
+// IsPubSubURL returns true if path names a pub/sub subscription rather than a
+// file
+func IsPubSubURL(path string) bool {
+	return strings.HasPrefix(path, scheme)
+}
+
+type pullResponse struct {
+	ReceivedMessages []struct {
+		AckID   string `json:"ackId"`
+		Message struct {
+			Data []byte `json:"data"`
+		} `json:"message"`
+	} `json:"receivedMessages"`
+}
+
+// GetEntries starts pulling from the subscription named in url (eg
+// pubsub://my-project/my-subscription). It sends one line at a time down the
+// returned channel, until ctx is done, when it closes the channel.
+func GetEntries(ctx context.Context, url string, options Options, gcpOptions gcp.Options, progress Progress) (chan string, error) {
+	parts := strings.Split(strings.TrimPrefix(url, scheme), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("pubsub url must name a project and subscription, eg pubsub://my-project/my-subscription")
+	}
+	if options.MaxMessages <= 0 {
+		options.MaxMessages = 100
+	}
+	client, err := gcp.NewClient(gcpOptions)
+	if err != nil {
+		return nil, err
+	}
+	subscription := endpoint + "projects/" + parts[0] + "/subscriptions/" + parts[1]
+	// make sure we can see the subscription before we claim to be reading it
+	if err := client.CallContext(ctx, "GET", subscription, nil, nil); err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"project":      parts[0],
+		"subscription": parts[1],
+	}).Info("pulling from pub/sub")
+
+	lines := make(chan string)
+	acks := &pendingAcks{progress: progress}
+	stop := make(chan struct{})
+	go acks.ackPeriodically(client, subscription, stop)
+	// messages keep being acknowledged while the pipeline drains after ctx
+	// is done, and the last of them once it's finished
+	progress.OnFinish(func() {
+		close(stop)
+		acks.ackReached(client, subscription)
+	})
+	go func() {
+		defer close(lines)
+		pollInterval := time.Duration(options.PollInterval) * time.Millisecond
+		sleep := func() bool {
+			select {
+			case <-time.After(pollInterval):
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		// waiting holds the messages whose lines have all been handed out but
+		// which the parser may still be working on
+		var waiting []string
+		for {
+			var out pullResponse
+			err := client.CallContext(ctx, "POST", subscription+":pull", map[string]interface{}{
+				"maxMessages": options.MaxMessages,
+			}, &out)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Warn("failed to pull pub/sub messages")
+				if !sleep() {
+					return
+				}
+				continue
+			}
+			for _, received := range out.ReceivedMessages {
+				for _, line := range MessageLines(received.Message.Data) {
+					select {
+					case lines <- line:
+					case <-ctx.Done():
+						// unacknowledged messages are delivered again
+						return
+					}
+					// the parser only asks for this line once it's done with
+					// the previous one, so the waiting messages' events have
+					// all been made by now
+					if len(waiting) > 0 {
+						acks.add(waiting)
+						waiting = nil
+					}
+				}
+				waiting = append(waiting, received.AckID)
+			}
+			if len(out.ReceivedMessages) == 0 {
+				// nothing new is coming to prove the parser is done with the
+				// last line, but a whole pull has passed, so it's very likely
+				// done. Leaving the messages unacknowledged would have them
+				// delivered again once their ack deadline passes.
+				if len(waiting) > 0 {
+					acks.add(waiting)
+					waiting = nil
+				}
+				if !sleep() {
+					return
+				}
+			}
+			acks.ackReached(client, subscription)
+		}
+	}()
+	return lines, nil
+}
+
+// pendingAck is a batch of messages waiting for their events to be sent
+type pendingAck struct {
+	ackIDs []string
+	mark   uint64
+}
+
+// pendingAcks holds messages that have been parsed, in the order they were
+// handed out, until their events have been sent
+type pendingAcks struct {
+	sync.Mutex
+	progress Progress
+	pending  []pendingAck
+}
+
+func (p *pendingAcks) add(ackIDs []string) {
+	mark := p.progress.Mark()
+	p.Lock()
+	p.pending = append(p.pending, pendingAck{ackIDs: ackIDs, mark: mark})
+	p.Unlock()
+}
+
+// reached removes and returns the ack IDs of messages whose events have all
+// been sent
+func (p *pendingAcks) reached() []string {
+	p.Lock()
+	defer p.Unlock()
+	var done []string
+	for len(p.pending) > 0 && p.progress.Reached(p.pending[0].mark) {
+		done = append(done, p.pending[0].ackIDs...)
+		p.pending = p.pending[1:]
+	}
+	return done
+}
+
+func (p *pendingAcks) ackReached(client *gcp.Client, subscription string) {
+	done := p.reached()
+	if len(done) == 0 {
+		return
+	}
+	err := client.Call("POST", subscription+":acknowledge", map[string]interface{}{
+		"ackIds": done,
+	}, nil)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err":      err,
+			"messages": len(done),
+		}).Warn("failed to acknowledge pub/sub messages. They will be delivered again.")
+	}
+}
+
+func (p *pendingAcks) ackPeriodically(client *gcp.Client, subscription string, stop chan struct{}) {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.ackReached(client, subscription)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// logEntry is the Cloud Logging LogEntry a logging sink publishes
+type logEntry struct {
+	LogName     string                 `json:"logName"`
+	InsertID    string                 `json:"insertId"`
+	Timestamp   string                 `json:"timestamp"`
+	Severity    string                 `json:"severity"`
+	Trace       string                 `json:"trace"`
+	SpanID      string                 `json:"spanId"`
+	TextPayload *string                `json:"textPayload"`
+	JSONPayload map[string]interface{} `json:"jsonPayload"`
+	// protoPayload is used by audit logs
+	ProtoPayload map[string]interface{} `json:"protoPayload"`
+	Resource     struct {
+		Type   string            `json:"type"`
+		Labels map[string]string `json:"labels"`
+	} `json:"resource"`
+	Labels      map[string]string      `json:"labels"`
+	HTTPRequest map[string]interface{} `json:"httpRequest"`
+}
+
+// MessageLines returns the log lines in a message, unwrapping Cloud Logging
+// entries
+func MessageLines(data []byte) []string {
+	if line, ok := entryLine(data); ok {
+		return []string{line}
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// entryLine turns a LogEntry into a line of JSON. The payload's fields come
+// first, then the entry's metadata, which wins any clashes.
+func entryLine(data []byte) (string, bool) {
+	var entry logEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.LogName == "" || entry.InsertID == "" {
+		return "", false
+	}
+	fields := make(map[string]interface{})
+	for k, v := range entry.JSONPayload {
+		fields[k] = v
+	}
+	for k, v := range entry.ProtoPayload {
+		fields[k] = v
+	}
+	if entry.TextPayload != nil {
+		fields["message"] = *entry.TextPayload
+	}
+	set := func(key, value string) {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	set("log_name", entry.LogName)
+	set("insert_id", entry.InsertID)
+	set("timestamp", entry.Timestamp)
+	set("severity", entry.Severity)
+	set("trace", entry.Trace)
+	set("span_id", entry.SpanID)
+	set("resource.type", entry.Resource.Type)
+	for k, v := range entry.Resource.Labels {
+		set("resource.labels."+k, v)
+	}
+	for k, v := range entry.Labels {
+		set("labels."+k, v)
+	}
+	for k, v := range entry.HTTPRequest {
+		fields["http_request."+k] = v
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return "", false
+	}
+	return string(out), true
+}
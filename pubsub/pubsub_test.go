@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type fakeProgress struct {
+	made, sent uint64
+}
+
+func (f *fakeProgress) Mark() uint64             { return f.made }
+func (f *fakeProgress) Reached(mark uint64) bool { return f.sent >= mark }
+func (f *fakeProgress) OnFinish(func())          {}
+
+func TestPendingAcks(t *testing.T) {
+	progress := &fakeProgress{}
+	acks := &pendingAcks{progress: progress}
+
+	progress.made = 2
+	acks.add([]string{"a", "b"})
+	progress.made = 3
+	acks.add([]string{"c"})
+
+	if done := acks.reached(); len(done) != 0 {
+		t.Errorf("expected nothing to acknowledge before events were sent, got %v", done)
+	}
+	progress.sent = 3
+	if done := acks.reached(); !reflect.DeepEqual(done, []string{"a", "b", "c"}) {
+		t.Errorf("expected every message to be acknowledged, got %v", done)
+	}
+	if done := acks.reached(); len(done) != 0 {
+		t.Errorf("expected messages to only be acknowledged once, got %v", done)
+	}
+}
+
+func TestMessageLines(t *testing.T) {
+	tsts := []struct {
+		data     string
+		expected []map[string]interface{}
+	}{
+		{
+			`{"insertId":"abc","logName":"projects/p/logs/stdout","textPayload":"GET / 200",` +
+				`"timestamp":"2017-03-02T22:14:10.123Z","severity":"INFO",` +
+				`"resource":{"type":"k8s_container","labels":{"pod_name":"web-1","namespace_name":"default"}},` +
+				`"labels":{"compute.googleapis.com/resource_name":"node-1"}}`,
+			[]map[string]interface{}{{
+				"message":                        "GET / 200",
+				"insert_id":                      "abc",
+				"log_name":                       "projects/p/logs/stdout",
+				"timestamp":                      "2017-03-02T22:14:10.123Z",
+				"severity":                       "INFO",
+				"resource.type":                  "k8s_container",
+				"resource.labels.pod_name":       "web-1",
+				"resource.labels.namespace_name": "default",
+				"labels.compute.googleapis.com/resource_name": "node-1",
+			}},
+		},
+		{
+			`{"insertId":"def","logName":"projects/p/logs/app","jsonPayload":{"msg":"hi","duration_ms":12},` +
+				`"severity":"ERROR","trace":"projects/p/traces/123","httpRequest":{"status":500}}`,
+			[]map[string]interface{}{{
+				"msg":                 "hi",
+				"duration_ms":         float64(12),
+				"insert_id":           "def",
+				"log_name":            "projects/p/logs/app",
+				"severity":            "ERROR",
+				"trace":               "projects/p/traces/123",
+				"http_request.status": float64(500),
+			}},
+		},
+		{
+			`{"level":"info","msg":"not a log entry"}` + "\n" + `{"level":"warn"}`,
+			[]map[string]interface{}{{"level": "info", "msg": "not a log entry"}, {"level": "warn"}},
+		},
+	}
+	for _, tt := range tsts {
+		lines := MessageLines([]byte(tt.data))
+		if len(lines) != len(tt.expected) {
+			t.Errorf("expected %d lines, got %d: %v", len(tt.expected), len(lines), lines)
+			continue
+		}
+		for i, line := range lines {
+			var actual map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &actual); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(actual, tt.expected[i]) {
+				t.Errorf("expected %+v, got %+v", tt.expected[i], actual)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// handleSignals calls shutdown on SIGTERM or SIGINT, cancelling the context
+// leash.Run was given, so that it stops reading and sends what it's already
+// read. If that takes more than timeout
+// seconds, or a second signal arrives, it exits without waiting any longer.
+// The returned function stops handling signals.
+func handleSignals(shutdown context.CancelFunc, timeout uint) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			logrus.WithFields(logrus.Fields{
+				"signal":  sig,
+				"timeout": timeout,
+			}).Info("Shutting down. Sending the events already read")
+		case <-finished:
+			return
+		}
+		shutdown()
+		select {
+		case <-signals:
+			logrus.Warn("Got another signal. Exiting without sending the remaining events")
+		case <-time.After(time.Duration(timeout) * time.Second):
+			logrus.WithFields(logrus.Fields{
+				"timeout": timeout,
+			}).Error("Timed out sending the events already read. Exiting")
+		case <-finished:
+			return
+		}
+		os.Exit(1)
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(finished)
+	}
+}
@@ -0,0 +1,155 @@
+// Package statsd sends honeytail's own counters and timers to a statsd
+// server, or a DogStatsD agent if they're to be tagged, for those watching
+// honeytail with something other than its logs.
+//
+// Metrics are buffered and sent over UDP in packets of as many as fit, so
+// counting each event sent costs next to nothing. Like any statsd client, it
+// doesn't find out whether they arrive.
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// maxPacketBytes is the most put in one packet, small enough not to be
+// fragmented on an ethernet network
+const maxPacketBytes = 1432
+
+// Options configure where honeytail's own metrics are sent, if anywhere
+type Options struct {
+	Address  string        `long:"address" description:"host:port of a statsd server, or DogStatsD agent, to send honeytail's own metrics to, eg localhost:8125: counts of lines read, parse errors and events sent, spooled, dropped or failed, by status code, how long sending took, and how far behind the end of the files being read sending is, in bytes and seconds. Off by default"`
+	Prefix   string        `long:"prefix" description:"Put this in front of the name of each metric" default:"honeytail."`
+	Tags     []string      `long:"tag" description:"Tag every metric with this, eg env:prod, in DogStatsD's format, which plain statsd servers don't understand. May be specified multiple times"`
+	Interval time.Duration `long:"interval" description:"How often to send the metrics collected since the last time, eg 10s" default:"10s"`
+}
+
+// Client sends metrics to the statsd server at Options.Address. A nil Client
+// sends nothing, so callers needn't check whether metrics are wanted.
+type Client struct {
+	conn   net.Conn
+	prefix string
+	// tags is what goes on the end of each metric, |#tag1,tag2, or nothing
+	tags string
+
+	lock sync.Mutex
+	buf  bytes.Buffer
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a Client sending to options.Address every options.Interval, or
+// nil if no address is given
+func New(options Options) (*Client, error) {
+	if options.Address == "" {
+		return nil, nil
+	}
+	if options.Interval <= 0 {
+		return nil, fmt.Errorf("--statsd.interval must be more than 0, not %s", options.Interval)
+	}
+	conn, err := net.Dial("udp", options.Address)
+	if err != nil {
+		return nil, fmt.Errorf("can't send metrics to --statsd.address %s: %s", options.Address, err)
+	}
+	c := &Client{
+		conn:   conn,
+		prefix: options.Prefix,
+		done:   make(chan struct{}),
+	}
+	if len(options.Tags) > 0 {
+		c.tags = "|#" + strings.Join(options.Tags, ",")
+	}
+	c.wg.Add(1)
+	go c.flushEvery(options.Interval)
+	return c, nil
+}
+
+// Count adds value to the counter name
+func (c *Client) Count(name string, value int64) {
+	if c == nil {
+		return
+	}
+	c.add(fmt.Sprintf("%s%s:%d|c%s\n", c.prefix, name, value, c.tags))
+}
+
+// Gauge sets the gauge name to value
+func (c *Client) Gauge(name string, value float64) {
+	if c == nil {
+		return
+	}
+	c.add(fmt.Sprintf("%s%s:%g|g%s\n", c.prefix, name, value, c.tags))
+}
+
+// Timing records d, in milliseconds, with the timer name
+func (c *Client) Timing(name string, d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.add(fmt.Sprintf("%s%s:%g|ms%s\n", c.prefix, name, float64(d)/float64(time.Millisecond), c.tags))
+}
+
+// Close sends what's left to be sent, and stops sending
+func (c *Client) Close() error {
+	if c == nil {
+		return nil
+	}
+	close(c.done)
+	c.wg.Wait()
+	c.Flush()
+	return c.conn.Close()
+}
+
+// Flush sends the metrics collected so far
+func (c *Client) Flush() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.flush()
+}
+
+// add buffers metric, sending what's already buffered first if it wouldn't
+// fit in the same packet
+func (c *Client) add(metric string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.buf.Len()+len(metric) > maxPacketBytes {
+		c.flush()
+	}
+	c.buf.WriteString(metric)
+}
+
+// flush sends what's buffered, without the final newline.
+// NOT thread safe.
+func (c *Client) flush() {
+	if c.buf.Len() == 0 {
+		return
+	}
+	packet := bytes.TrimSuffix(c.buf.Bytes(), []byte("\n"))
+	if _, err := c.conn.Write(packet); err != nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Debug("Couldn't send metrics to statsd")
+	}
+	c.buf.Reset()
+}
+
+// flushEvery flushes once every interval until the client's closed
+func (c *Client) flushEvery(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.done:
+			return
+		}
+	}
+}
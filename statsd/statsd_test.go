@@ -0,0 +1,100 @@
+package statsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen returns a UDP address to send metrics to, and a func returning the
+// packets sent to it so far
+func listen(t *testing.T) (string, func() []string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := func() []string {
+		var received []string
+		buf := make([]byte, 65536)
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return received
+			}
+			received = append(received, string(buf[:n]))
+		}
+	}
+	return conn.LocalAddr().String(), packets
+}
+
+func TestClient(t *testing.T) {
+	addr, packets := listen(t)
+	c, err := New(Options{Address: addr, Prefix: "honeytail.", Tags: []string{"env:test", "canary"}, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Count("events.sent", 3)
+	c.Timing("send_duration", 1500*time.Microsecond)
+	c.Gauge("lag.seconds", 2.5)
+	// nothing's sent until the interval's up or the client's closed
+	if received := packets(); len(received) != 0 {
+		t.Errorf("expected nothing to be sent yet, got %q", received)
+	}
+	c.Close()
+	expected := "honeytail.events.sent:3|c|#env:test,canary\nhoneytail.send_duration:1.5|ms|#env:test,canary\nhoneytail.lag.seconds:2.5|g|#env:test,canary"
+	received := packets()
+	if len(received) != 1 || received[0] != expected {
+		t.Errorf("expected one packet, %q, got %q", expected, received)
+	}
+}
+
+func TestClientPackets(t *testing.T) {
+	addr, packets := listen(t)
+	c, err := New(Options{Address: addr, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		c.Count("lines_read", 1)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	received := packets()
+	if len(received) < 2 {
+		t.Errorf("expected the metrics to take several packets, got %d", len(received))
+	}
+	metrics := 0
+	for _, packet := range received {
+		if len(packet) > maxPacketBytes {
+			t.Errorf("expected packets of at most %d bytes, got %d", maxPacketBytes, len(packet))
+		}
+		for _, metric := range strings.Split(packet, "\n") {
+			if metric != "lines_read:1|c" {
+				t.Errorf("unexpected metric %q", metric)
+			}
+			metrics++
+		}
+	}
+	if metrics != 1000 {
+		t.Errorf("expected 1000 metrics, got %d", metrics)
+	}
+}
+
+func TestNilClient(t *testing.T) {
+	c, err := New(Options{})
+	if c != nil || err != nil {
+		t.Fatalf("expected no client without an address, got %v, %v", c, err)
+	}
+	// a nil client sends nothing, without complaint
+	c.Count("events.sent", 1)
+	c.Timing("send_duration", time.Second)
+	c.Flush()
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := New(Options{Address: "localhost:8125"}); err == nil {
+		t.Error("expected an error without an interval")
+	}
+}
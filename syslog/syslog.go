@@ -0,0 +1,271 @@
+// Package syslog implements receiving log lines from the network as a syslog
+// server.
+//
+// syslog listens on a UDP and/or TCP port and provides a channel on which
+// each received message will be sent as a string, the same way the tail
+// package does for lines of a file.
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// URL schemes accepted as a --file argument. syslog:// listens on both UDP
+// and TCP.
+const (
+	scheme    = "syslog://"
+	udpScheme = "syslog+udp://"
+	tcpScheme = "syslog+tcp://"
+)
+
+// maxOctetCountDigits is the most digits an octet count may have, enough for
+// messages of up to a gigabyte, which are truncated to --syslog.max_message_bytes
+const maxOctetCountDigits = 9
+
+// rePriority matches the <PRI> header, and the version of RFC 5424 messages
+var rePriority = regexp.MustCompile(`^<[0-9]{1,3}>(?:1 )?`)
+
+type Options struct {
+	KeepPriority    bool `long:"keep_priority" description:"Keep the <PRI> header at the start of received messages. By default it is stripped so messages look like those syslog daemons write to files"`
+	MaxMessageBytes int  `long:"max_message_bytes" description:"Largest message accepted; longer messages are truncated" default:"65536"`
+}
+
+// IsSyslogURL returns true if path names a syslog listener rather than a file
+func IsSyslogURL(path string) bool {
+	return strings.HasPrefix(path, scheme) ||
+		strings.HasPrefix(path, udpScheme) ||
+		strings.HasPrefix(path, tcpScheme)
+}
+
+// GetEntries starts listening on the address in url (eg
+// syslog://0.0.0.0:5140). It sends one message at a time down the returned
+// channel. Once ctx is done, it stops listening and closes the connections
+// it's reading from, and then the channel.
+func GetEntries(ctx context.Context, url string, options Options) (chan string, error) {
+	if options.MaxMessageBytes <= 0 {
+		options.MaxMessageBytes = 65536
+	}
+	var addr string
+	var udp, tcp bool
+	switch {
+	case strings.HasPrefix(url, udpScheme):
+		addr, udp = strings.TrimPrefix(url, udpScheme), true
+	case strings.HasPrefix(url, tcpScheme):
+		addr, tcp = strings.TrimPrefix(url, tcpScheme), true
+	case strings.HasPrefix(url, scheme):
+		addr, udp, tcp = strings.TrimPrefix(url, scheme), true, true
+	default:
+		return nil, fmt.Errorf("not a syslog url: %s", url)
+	}
+	if addr == "" {
+		return nil, errors.New("syslog url must include an address to listen on, eg syslog://0.0.0.0:5140")
+	}
+
+	lines := make(chan string)
+	// readers waits for the listeners and connections to be closed
+	var readers sync.WaitGroup
+	var conn net.PacketConn
+	if udp {
+		var err error
+		if conn, err = net.ListenPacket("udp", addr); err != nil {
+			return nil, err
+		}
+	}
+	if tcp {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{"addr": listener.Addr()}).Info("listening for syslog over TCP")
+		readers.Add(1)
+		go acceptTCP(ctx, listener, lines, options, &readers)
+	}
+	if conn != nil {
+		logrus.WithFields(logrus.Fields{"addr": conn.LocalAddr()}).Info("listening for syslog over UDP")
+		readers.Add(1)
+		go readUDP(ctx, conn, lines, options, &readers)
+	}
+	go func() {
+		readers.Wait()
+		close(lines)
+	}()
+	return lines, nil
+}
+
+// readUDP sends each line of each datagram received on conn to lines, until
+// ctx is done
+func readUDP(ctx context.Context, conn net.PacketConn, lines chan string, options Options, readers *sync.WaitGroup) {
+	defer readers.Done()
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, options.MaxMessageBytes)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Error("syslog UDP listener failed")
+			}
+			return
+		}
+		for _, msg := range strings.Split(string(buf[:n]), "\n") {
+			if msg = strings.TrimRight(msg, "\r\x00"); msg != "" {
+				if !send(ctx, lines, cleanMessage(msg, options)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// acceptTCP reads messages from each connection made to listener, until ctx
+// is done
+func acceptTCP(ctx context.Context, listener net.Listener, lines chan string, options Options, readers *sync.WaitGroup) {
+	defer readers.Done()
+	defer listener.Close()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Error("syslog TCP listener failed")
+			}
+			return
+		}
+		readers.Add(1)
+		go readTCP(ctx, conn, lines, options, readers)
+	}
+}
+
+// readTCP sends each message received on conn to lines, handling both the
+// newline delimited and octet counted framing of RFC 6587. The connection is
+// closed once ctx is done.
+func readTCP(ctx context.Context, conn net.Conn, lines chan string, options Options, readers *sync.WaitGroup) {
+	defer readers.Done()
+	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-closed:
+		}
+	}()
+	reader := bufio.NewReaderSize(conn, options.MaxMessageBytes)
+	for {
+		msg, err := readFrame(reader, options.MaxMessageBytes)
+		if msg != "" && !send(ctx, lines, cleanMessage(msg, options)) {
+			return
+		}
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{
+					"remote": conn.RemoteAddr(),
+					"err":    err,
+				}).Debug("closing syslog TCP connection")
+			}
+			return
+		}
+	}
+}
+
+// send sends msg to lines, unless ctx is done first. It returns false if it
+// was.
+func send(ctx context.Context, lines chan string, msg string) bool {
+	select {
+	case lines <- msg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// readFrame reads one message, keeping no more than maxBytes of it. Octet
+// counted messages start with their length in bytes, which syslog's <PRI>
+// header never does.
+func readFrame(reader *bufio.Reader, maxBytes int) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		msgLen, err := readOctetCount(reader)
+		if err != nil {
+			return "", err
+		}
+		keep := msgLen
+		if keep > maxBytes {
+			keep = maxBytes
+		}
+		buf := make([]byte, keep)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return "", err
+		}
+		// the rest of a message that's too long is skipped
+		if _, err := io.CopyN(ioutil.Discard, reader, int64(msgLen-keep)); err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+	// a line longer than the reader's buffer comes in pieces, of which only
+	// the first is kept
+	slice, err := reader.ReadSlice('\n')
+	line := string(slice)
+	for err == bufio.ErrBufferFull {
+		_, err = reader.ReadSlice('\n')
+	}
+	if len(line) > maxBytes {
+		line = line[:maxBytes]
+	}
+	return strings.TrimRight(line, "\r\n\x00"), err
+}
+
+// readOctetCount reads the length at the start of an octet counted message,
+// and the space after it. Longer counts than maxOctetCountDigits are taken to
+// be garbage rather than read on and on.
+func readOctetCount(reader *bufio.Reader) (int, error) {
+	var count []byte
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c == ' ' {
+			break
+		}
+		if c < '0' || c > '9' || len(count) == maxOctetCountDigits {
+			return 0, fmt.Errorf("invalid octet count %q", append(count, c))
+		}
+		count = append(count, c)
+	}
+	return strconv.Atoi(string(count))
+}
+
+// cleanMessage strips the <PRI> header unless we were asked to keep it
+func cleanMessage(msg string, options Options) string {
+	if options.KeepPriority {
+		return msg
+	}
+	return rePriority.ReplaceAllString(msg, "")
+}
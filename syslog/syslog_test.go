@@ -0,0 +1,173 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadFrame(t *testing.T) {
+	octetCounted := "<13>1 2003-10-11T22:14:15.003Z host app - - hi"
+	input := "<34>Oct 11 22:14:15 mymachine su: 'su root' failed\n" +
+		fmt.Sprintf("%d %s", len(octetCounted), octetCounted) +
+		"<13>Oct 11 22:14:16 mymachine last line without newline"
+	expected := []string{
+		"<34>Oct 11 22:14:15 mymachine su: 'su root' failed",
+		octetCounted,
+		"<13>Oct 11 22:14:16 mymachine last line without newline",
+	}
+	reader := bufio.NewReader(strings.NewReader(input))
+	var msgs []string
+	for {
+		msg, err := readFrame(reader, 1024)
+		if msg != "" {
+			msgs = append(msgs, msg)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(msgs) != len(expected) {
+		t.Fatalf("expected %d messages, got %d: %q", len(expected), len(msgs), msgs)
+	}
+	for i := range expected {
+		if msgs[i] != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], msgs[i])
+		}
+	}
+}
+
+func TestReadFrameTooLong(t *testing.T) {
+	// messages longer than the limit are truncated, and the rest of them
+	// skipped, without reading them into memory
+	long := "<13>" + strings.Repeat("a", 100)
+	input := fmt.Sprintf("%d %s", len(long), long) + long + "\n" + "<13>short\n"
+	reader := bufio.NewReaderSize(strings.NewReader(input), 16)
+	for _, expected := range []string{"<13>aaaaaaaaaaaa", "<13>aaaaaaaaaaaa", "<13>short"} {
+		msg, err := readFrame(reader, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg != expected {
+			t.Errorf("expected %q, got %q", expected, msg)
+		}
+	}
+
+	// an octet count too long to be real is an error, rather than a huge
+	// buffer
+	reader = bufio.NewReader(strings.NewReader("99999999999999999999 <13>hi"))
+	if msg, err := readFrame(reader, 1024); err == nil {
+		t.Errorf("expected the octet count to be rejected, got %q", msg)
+	}
+}
+
+func TestCleanMessage(t *testing.T) {
+	testCases := []struct {
+		in, expected string
+	}{
+		{"<34>Oct 11 22:14:15 mymachine su: failed", "Oct 11 22:14:15 mymachine su: failed"},
+		{"<13>1 2003-10-11T22:14:15.003Z host app - - hi", "2003-10-11T22:14:15.003Z host app - - hi"},
+		{"no header", "no header"},
+	}
+	for _, tc := range testCases {
+		if actual := cleanMessage(tc.in, Options{}); actual != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, actual)
+		}
+		if actual := cleanMessage(tc.in, Options{KeepPriority: true}); actual != tc.in {
+			t.Errorf("expected %q to be kept, got %q", tc.in, actual)
+		}
+	}
+}
+
+func TestIsSyslogURL(t *testing.T) {
+	for _, url := range []string{"syslog://:5140", "syslog+udp://0.0.0.0:514", "syslog+tcp://[::]:514"} {
+		if !IsSyslogURL(url) {
+			t.Errorf("expected %s to be a syslog url", url)
+		}
+	}
+	for _, path := range []string{"/var/log/syslog", "-", "syslog.log"} {
+		if IsSyslogURL(path) {
+			t.Errorf("expected %s not to be a syslog url", path)
+		}
+	}
+}
+
+// freePort returns a local address with a port that's not in use
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestGetEntriesStops(t *testing.T) {
+	addr := freePort(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	lines, err := GetEntries(ctx, "syslog://"+addr, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("<34>hello\n"))
+	select {
+	case line := <-lines:
+		if line != "hello" {
+			t.Errorf("expected hello, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+
+	// once ctx is done, the address can be listened on again, as a second
+	// run in the same process does
+	cancel()
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := GetEntries(ctx, "syslog://"+addr, Options{})
+		cancel()
+		if err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected to listen again once ctx was done, got %s", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the connection open when ctx was done is closed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the connection to be closed once ctx was done")
+	}
+}
+
+func TestGetEntriesTCPFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	addr := listener.Addr().String()
+	if _, err := GetEntries(context.Background(), "syslog://"+addr, Options{}); err == nil {
+		t.Fatal("expected an error listening on a TCP address in use")
+	}
+	// the UDP socket opened first isn't left behind
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("expected the UDP address to be free again, got %s", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,100 @@
+package tail
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/klauspost/compress/zstd"
+)
+
+// magic numbers at the start of each compressed format we understand
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// isCompressed returns true if file looks like a compressed file, either by
+// its name or by the first few bytes of its contents
+func isCompressed(file string) bool {
+	for _, ext := range []string{".gz", ".bz2", ".zst"} {
+		if strings.HasSuffix(file, ext) {
+			return true
+		}
+	}
+	fh, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	header := make([]byte, len(zstdMagic))
+	n, _ := io.ReadFull(fh, header)
+	return compressionOf(header[:n]) != ""
+}
+
+func compressionOf(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return "gzip"
+	case bytes.HasPrefix(header, bzip2Magic):
+		return "bzip2"
+	case bytes.HasPrefix(header, zstdMagic):
+		return "zstd"
+	}
+	return ""
+}
+
+// decompress returns a reader of the decompressed contents of r if r starts
+// with the magic number of a compressed format, otherwise r as it is
+func decompress(r *bufio.Reader) (io.Reader, error) {
+	// Peek returns what it can along with an error on short input; a short
+	// header just means the input isn't compressed
+	header, _ := r.Peek(len(zstdMagic))
+	switch compressionOf(header) {
+	case "gzip":
+		return gzip.NewReader(r)
+	case "bzip2":
+		return bzip2.NewReader(r), nil
+	case "zstd":
+		return zstd.NewReader(r)
+	}
+	return r, nil
+}
+
+// readCompressedFile sends each line of a compressed file down the returned
+// channel. Compressed files are typically rotated logs that won't change, so
+// they are read once from start to end rather than tailed.
+func readCompressedFile(file string, options TailOptions) (chan string, error) {
+	b, err := newLineBuilder(options)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := decompress(bufio.NewReader(fh))
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"file": file}).Debug("reading compressed file")
+	lines := make(chan string)
+	go func() {
+		defer fh.Close()
+		defer close(lines)
+		if err := readLines(bufio.NewReader(contents), lines, b); err != io.EOF {
+			logrus.WithFields(logrus.Fields{
+				"file": file,
+				"err":  err,
+			}).Warn("failed to read compressed file to the end")
+		}
+	}()
+	return lines, nil
+}
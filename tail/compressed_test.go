@@ -0,0 +1,82 @@
+package tail
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const plainContents = "first line\nsecond line\n"
+
+// bzip2Contents is plainContents compressed with bzip2, which the standard
+// library can only decompress
+var bzip2Contents = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x8b, 0x13, 0xe1, 0x84, 0x00, 0x00,
+	0x04, 0xd1, 0x80, 0x00, 0x10, 0x40, 0x00, 0x0f, 0x25, 0x9c, 0x00, 0x20, 0x00, 0x21, 0xa1, 0x32,
+	0x31, 0x94, 0x20, 0x1a, 0x00, 0x91, 0x2a, 0x31, 0x95, 0x68, 0xcb, 0x04, 0x82, 0xfd, 0x57, 0xf1,
+	0x77, 0x24, 0x53, 0x85, 0x09, 0x08, 0xb1, 0x3e, 0x18, 0x40,
+}
+
+func TestReadCompressedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compressed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(plainContents))
+	gz.Close()
+	var zstded bytes.Buffer
+	zw, err := zstd.NewWriter(&zstded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write([]byte(plainContents))
+	zw.Close()
+
+	tsts := []struct {
+		name       string
+		contents   []byte
+		compressed bool
+	}{
+		{"access.log.2.gz", gzipped.Bytes(), true},
+		{"access.log.3.bz2", bzip2Contents, true},
+		{"access.log.4.zst", zstded.Bytes(), true},
+		// detected by the magic number rather than the name
+		{"access.log.5", gzipped.Bytes(), true},
+		{"access.log", []byte(plainContents), false},
+	}
+	for _, tt := range tsts {
+		file := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(file, tt.contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if isCompressed(file) != tt.compressed {
+			t.Errorf("%s: expected isCompressed to be %v", tt.name, tt.compressed)
+			continue
+		}
+		if !tt.compressed {
+			continue
+		}
+		lines, err := readCompressedFile(file, TailOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actual []string
+		for line := range lines {
+			actual = append(actual, line)
+		}
+		expected := []string{"first line", "second line"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %q, got %q", tt.name, expected, actual)
+		}
+	}
+}
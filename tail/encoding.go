@@ -0,0 +1,120 @@
+package tail
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// encodings are the values for --tail.encoding other than utf-8
+var encodings = map[string]struct {
+	enc encoding.Encoding
+	// newline is how a newline is written; lines are split on it before
+	// they're converted, so offsets in the file stay accurate
+	newline []byte
+}{
+	"utf-16le":  {unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), []byte("\n\x00")},
+	"utf-16be":  {unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), []byte("\x00\n")},
+	"latin-1":   {charmap.ISO8859_1, []byte("\n")},
+	"shift-jis": {japanese.ShiftJIS, []byte("\n")},
+}
+
+// newline is how lines end in UTF-8, kept so it isn't allocated for every
+// line
+var newline = []byte("\n")
+
+// ansiEscape matches terminal escape sequences, eg those setting colors
+var ansiEscape = regexp.MustCompile(`\x1b(?:\[[0-9;?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[@-Z\\-_])`)
+
+// lineEncoding converts lines to plain UTF-8 as set by --tail.encoding and
+// --tail.strip_ansi. A nil lineEncoding leaves them alone.
+type lineEncoding struct {
+	decoder   *encoding.Decoder
+	newline   []byte
+	stripANSI bool
+}
+
+// newLineEncoding returns the conversion asked for, or nil if lines are used
+// as they are
+func newLineEncoding(options TailOptions) (*lineEncoding, error) {
+	name := strings.ToLower(options.Encoding)
+	if (name == "" || name == "utf-8" || name == "utf8") && !options.StripANSI {
+		return nil, nil
+	}
+	e := &lineEncoding{newline: newline, stripANSI: options.StripANSI}
+	switch name {
+	case "", "utf-8", "utf8":
+	default:
+		known, ok := encodings[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown option to --tail.encoding: %s", options.Encoding)
+		}
+		e.decoder = known.enc.NewDecoder()
+		e.newline = known.newline
+	}
+	return e, nil
+}
+
+// read reads the next piece of a line, like ReadSlice('\n'). Encodings with
+// two byte newlines are read a character at a time, so that a newline byte
+// that's half of some other character isn't taken for a newline.
+func (e *lineEncoding) read(r *bufio.Reader) ([]byte, error) {
+	if e == nil || len(e.newline) == 1 {
+		return r.ReadSlice('\n')
+	}
+	var chunk []byte
+	for len(chunk) < r.Size() {
+		first, err := r.ReadByte()
+		if err != nil {
+			return chunk, err
+		}
+		second, err := r.ReadByte()
+		if err != nil {
+			// wait for the rest of the character
+			r.UnreadByte()
+			return chunk, err
+		}
+		chunk = append(chunk, first, second)
+		if first == e.newline[0] && second == e.newline[1] {
+			return chunk, nil
+		}
+	}
+	return chunk, bufio.ErrBufferFull
+}
+
+// terminator returns how a line ends
+func (e *lineEncoding) terminator() []byte {
+	if e == nil {
+		return newline
+	}
+	return e.newline
+}
+
+// convert returns line, without its newline, as UTF-8 with escape sequences
+// stripped if asked
+func (e *lineEncoding) convert(line []byte) []byte {
+	if e == nil {
+		return line
+	}
+	if e.decoder != nil {
+		decoded, err := e.decoder.Bytes(line)
+		if err != nil {
+			// the decoders replace what they can't convert, so this
+			// shouldn't happen; keep what we can of the line if it does
+			decoded = bytes.ToValidUTF8(line, []byte("\uFFFD"))
+		}
+		// a byte order mark at the start of the file isn't part of the line
+		line = bytes.TrimPrefix(decoded, []byte("\uFEFF"))
+	}
+	if e.stripANSI {
+		line = ansiEscape.ReplaceAll(line, nil)
+	}
+	return line
+}
@@ -0,0 +1,106 @@
+package tail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// utf16le encodes s as UTF-16LE
+func utf16le(s string) []byte {
+	var b bytes.Buffer
+	for _, unit := range utf16.Encode([]rune(s)) {
+		b.WriteByte(byte(unit))
+		b.WriteByte(byte(unit >> 8))
+	}
+	return b.Bytes()
+}
+
+func readAll(t *testing.T, options TailOptions, input []byte) []string {
+	b, err := newLineBuilder(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string)
+	go func() {
+		readLines(bufio.NewReaderSize(bytes.NewReader(input), 16), lines, b)
+		close(lines)
+	}()
+	var actual []string
+	for line := range lines {
+		actual = append(actual, line)
+	}
+	return actual
+}
+
+func TestEncodings(t *testing.T) {
+	tsts := []struct {
+		encoding string
+		input    []byte
+		expected []string
+	}{
+		// Ċ is 0x0A 0x01, which mustn't be taken for a newline
+		{"utf-16le", utf16le("\uFEFFfirst Ċ line\r\nsecond\r\nno newline"), []string{"first Ċ line", "second", "no newline"}},
+		{"utf-16be", []byte("\x00h\x00i\x00\n\x01\x0a\x00\n"), []string{"hi", "Ċ"}},
+		{"latin-1", []byte("caf\xe9\nna\xefve\n"), []string{"café", "naïve"}},
+		{"shift-jis", []byte("\x93\xfa\x96\x7b\x8c\xea\nok\n"), []string{"日本語", "ok"}},
+		{"UTF-8", []byte("plain\n"), []string{"plain"}},
+	}
+	for _, tt := range tsts {
+		actual := readAll(t, TailOptions{Encoding: tt.encoding}, tt.input)
+		if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", tt.expected) {
+			t.Errorf("%s: expected %q, got %q", tt.encoding, tt.expected, actual)
+		}
+	}
+	if _, err := newLineEncoding(TailOptions{Encoding: "ebcdic"}); err == nil {
+		t.Error("expected an error for an unknown encoding")
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	input := []byte("\x1b[1;31mERROR\x1b[0m something \x1b]0;title\x07broke\n\x1b[32minfo\x1b[m\n")
+	actual := readAll(t, TailOptions{StripANSI: true}, input)
+	expected := []string{"ERROR something broke", "info"}
+	if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", expected) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestFollowUTF16(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encoding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	contents := utf16le("\uFEFFone\r\n")
+	ioutil.WriteFile(path, contents, 0644)
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{Encoding: "utf-16le", Poll: true, PollInterval: 10}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, "one")
+
+	// a line written in two halves, split in the middle of a character
+	more := utf16le("twö\r\n")
+	appendTo(t, path, string(more[:5]))
+	time.Sleep(50 * time.Millisecond)
+	appendTo(t, path, string(more[5:]))
+	expectLines(t, f.lines, "twö")
+	expected := int64(len(contents) + len(more))
+	for i := 0; i < 100 && f.state().Offset != expected; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if offset := f.state().Offset; offset != expected {
+		t.Errorf("expected offset %d, got %d", expected, offset)
+	}
+}
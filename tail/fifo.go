@@ -0,0 +1,50 @@
+package tail
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// isFIFO returns true if file is a named pipe
+func isFIFO(file string) bool {
+	info, err := os.Stat(file)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// readFIFO sends each line written to a named pipe down the returned channel.
+// When the writer closes its end the pipe is opened again to wait for the
+// next writer, unless --tail.stop is set.
+func readFIFO(file string, options TailOptions) chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			// opening blocks until something opens the pipe for writing
+			fh, err := os.Open(file)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"file": file,
+					"err":  err,
+				}).Error("failed to open named pipe")
+				return
+			}
+			b, _ := newLineBuilder(options)
+			err = readLines(bufio.NewReader(fh), lines, b)
+			fh.Close()
+			if err != io.EOF {
+				logrus.WithFields(logrus.Fields{
+					"file": file,
+					"err":  err,
+				}).Warn("failed to read named pipe")
+			}
+			if options.Stop {
+				return
+			}
+			logrus.WithFields(logrus.Fields{"file": file}).Debug("named pipe writer closed; reopening")
+		}
+	}()
+	return lines
+}
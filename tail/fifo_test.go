@@ -0,0 +1,53 @@
+//go:build !windows
+// +build !windows
+
+package tail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadFIFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fifo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "app.pipe")
+	if err := unix.Mkfifo(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if !isFIFO(file) {
+		t.Fatal("expected the pipe to be detected as a FIFO")
+	}
+
+	lines := readFIFO(file, TailOptions{})
+	// each writer opens and closes the pipe; lines from both should arrive
+	for _, contents := range []string{"first\n", "second\nthird\n"} {
+		fh, err := os.OpenFile(file, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fh.WriteString(contents)
+		fh.Close()
+	}
+	var received []string
+	for len(received) < 3 {
+		select {
+		case line := <-lines:
+			received = append(received, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after receiving %q", received)
+		}
+	}
+	if expected := []string{"first", "second", "third"}; !reflect.DeepEqual(received, expected) {
+		t.Errorf("expected %q, got %q", expected, received)
+	}
+}
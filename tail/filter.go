@@ -0,0 +1,67 @@
+package tail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileFilter picks out the files matching the --file globs that shouldn't be
+// read, set by --tail.exclude and --tail.ignore_older
+type fileFilter struct {
+	exclude []string
+	maxAge  time.Duration
+}
+
+// newFileFilter returns the filter for the --tail options
+func newFileFilter(options TailOptions) (*fileFilter, error) {
+	for _, pattern := range options.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern for --tail.exclude %s: %s", pattern, err)
+		}
+	}
+	maxAge, err := parseAge(options.IgnoreOlder)
+	if err != nil {
+		return nil, fmt.Errorf("--tail.ignore_older must be a duration like 24h or 7d: %s", err)
+	}
+	return &fileFilter{exclude: options.Exclude, maxAge: maxAge}, nil
+}
+
+// parseAge parses a duration, also allowing a number of days like 7d
+func parseAge(age string) (time.Duration, error) {
+	if age == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(age, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(age, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(age)
+}
+
+// skip returns why file shouldn't be read, or "" if it should. Patterns are
+// matched against both the whole path and the file's name, so *.gz excludes
+// compressed files in any directory.
+func (f *fileFilter) skip(file string) string {
+	for _, pattern := range f.exclude {
+		if matched, _ := filepath.Match(pattern, file); matched {
+			return "excluded by " + pattern
+		}
+		if matched, _ := filepath.Match(pattern, filepath.Base(file)); matched {
+			return "excluded by " + pattern
+		}
+	}
+	if f.maxAge > 0 {
+		info, err := os.Stat(file)
+		if err == nil && time.Since(info.ModTime()) > f.maxAge {
+			return "not modified within " + f.maxAge.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+package tail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"app.log", "app.log.gz", ".app.log.swp", "old.log"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("line\n"), 0644)
+	}
+	weekAgo := time.Now().Add(-7 * 24 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "old.log"), weekAgo, weekAgo)
+
+	conf := Config{
+		Paths: []string{filepath.Join(dir, "*")},
+		Options: TailOptions{
+			ReadFrom:    "end",
+			StateDir:    dir,
+			Exclude:     []string{"*.gz", "*.swp", filepath.Join(dir, "*.state")},
+			IgnoreOlder: "1d",
+		},
+	}
+	entries, _, err := getEntriesByFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != filepath.Join(dir, "app.log") {
+		t.Errorf("expected only app.log to be read, got %+v", entries)
+	}
+
+	// a file written to since it was ignored is picked up by the next scan
+	filter, _ := newFileFilter(conf.Options)
+	if reason := filter.skip(filepath.Join(dir, "old.log")); reason == "" {
+		t.Error("expected old.log to be skipped")
+	}
+	os.Chtimes(filepath.Join(dir, "old.log"), time.Now(), time.Now())
+	if reason := filter.skip(filepath.Join(dir, "old.log")); reason != "" {
+		t.Errorf("expected old.log to be read once it's written to, got %s", reason)
+	}
+
+	for _, options := range []TailOptions{{Exclude: []string{"[oops"}}, {IgnoreOlder: "a week"}} {
+		if _, err := newFileFilter(options); err == nil {
+			t.Errorf("expected an error for %+v", options)
+		}
+	}
+}
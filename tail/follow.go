@@ -0,0 +1,678 @@
+package tail
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"gopkg.in/fsnotify.v1"
+)
+
+// pollInterval is how long to wait at the end of a file before looking for
+// more lines, truncation or rotation, unless --tail.poll_interval says
+// otherwise
+const pollInterval = 250 * time.Millisecond
+
+// markInterval is the least time between the positions a follower asks
+// to be told have been sent, so it isn't asking for every line
+const markInterval = 100 * time.Millisecond
+
+// backfillReadBytes is how much is read at a time from a file that's read to
+// the end once, with --tail.stop, rather than followed. Reading further ahead
+// means fewer reads of big files.
+const backfillReadBytes = 1024 * 1024
+
+// notifiedCheckInterval is how often a file is checked even when no
+// notifications for it have arrived, in case some were missed
+const notifiedCheckInterval = 5 * time.Second
+
+// location is where to start reading a file
+type location struct {
+	offset int64
+	whence int
+}
+
+// follower reads lines from a file as they're written, like tail -F. It
+// follows the file through both kinds of log rotation: when the file is
+// renamed and a new one created in its place, it finishes reading the old
+// file before switching to the new one; when the file is copied and then
+// truncated (logrotate's copytruncate), it notices the file shrink and starts
+// again from the top. If path is a symlink, as with a current link to the
+// latest log, the file it points to is read, switching files when the link
+// is changed.
+type follower struct {
+	path string
+	// target is the file path's symlink points to, or "" if it isn't one
+	target string
+	// follow is false to stop at the end of the file rather than waiting
+	// for more lines
+	follow bool
+	// stopAt, if set, stops reading once lines are well past this time
+	stopAt time.Time
+	lines  chan string
+	// ctx is done once the follower's to stop reading, and cancel stops it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// done is closed once reading has stopped
+	done chan struct{}
+
+	// interval is how long to wait at the end of the file before looking
+	// again
+	interval time.Duration
+	// notify wakes the follower when something changes in the file's
+	// directory. It's nil when polling.
+	notify *fsnotify.Watcher
+	// targetDir is the directory of target being watched, if it's not the
+	// same as path's
+	targetDir string
+
+	file   *os.File
+	reader *bufio.Reader
+	// partial holds the start of a line whose newline hasn't been written yet
+	partial *lineBuilder
+
+	// replaced is set once the file at path is found to be a new one, so
+	// the old one gets one more poll for lines its writer hadn't yet moved
+	// over
+	replaced bool
+
+	lock sync.Mutex
+	// inode and offset locate the end of the last complete line read
+	inode  uint64
+	offset int64
+	// pending holds positions read, oldest first, waiting for the events
+	// made from the lines before them to be sent
+	pending  []pendingState
+	lastMark time.Time
+	// saveAtEnd is set when the lines may be parsed out of order, so a
+	// position is only saved once everything read has been sent
+	saveAtEnd bool
+	// sentLines counts the lines sent on
+	sentLines uint64
+	// held is how many lines taken may be held on their way to the parser
+	held int
+	// joiner, if set, joins the lines sent into the ones the parser takes,
+	// and joined counts those it's done with
+	joiner *joiner
+	joined *joinProgress
+	// unparsed holds the positions before the lines most recently sent,
+	// oldest first, enough to go back past those the parser may not have
+	// finished with, and remember is how many that is
+	unparsed []unparsedState
+	remember int
+	// sent is the latest of the pending positions whose events have all
+	// been sent
+	sent State
+
+	// store, if set, is where the follower saves how far it's read
+	store     stateStore
+	progress  Progress
+	saveLock  sync.Mutex
+	lastSaved State
+}
+
+// unparsedState is the position before the line sent
+type unparsedState struct {
+	state State
+	line  uint64
+}
+
+// pendingState is a position in the file that can be saved once mark is
+// reached
+type pendingState struct {
+	state State
+	mark  uint64
+}
+
+// followFile opens path, seeks to loc (the beginning if nil) and starts
+// sending its lines down the follower's lines channel, until ctx is done or
+// it's stopped. If store is set, the
+// position reached is saved to it every second. Without progress, that's the
+// position read up to, saved once more when reading stops, before the lines
+// channel is closed. With progress, it's the position up to which the events
+// made from the lines have been sent, saved once more when progress finishes.
+func followFile(ctx context.Context, path string, loc *location, options TailOptions, store stateStore, progress Progress) (*follower, error) {
+	_, stopAt, err := TimeWindow(options)
+	if err != nil {
+		return nil, err
+	}
+	f := &follower{
+		path:      path,
+		follow:    !options.Stop,
+		stopAt:    stopAt,
+		lines:     make(chan string, options.LineBuffer),
+		saveAtEnd: options.SaveAtEnd,
+		held:      options.HeldLines,
+		done:      make(chan struct{}),
+		store:     store,
+		progress:  progress,
+		interval:  time.Duration(options.PollInterval) * time.Millisecond,
+	}
+	if f.interval <= 0 {
+		f.interval = pollInterval
+	}
+	if f.partial, err = newLineBuilder(options); err != nil {
+		return nil, err
+	}
+	if f.joiner, err = newJoiner(options); err != nil {
+		return nil, err
+	}
+	// besides those held, the lines still waiting in the channel and the
+	// one the parser has may not have been parsed yet
+	f.remember = cap(f.lines) + 1 + f.held
+	if f.joiner != nil {
+		f.joined = &joinProgress{held: f.held}
+		f.remember = cap(f.lines) + f.joiner.limit(f.held)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	if loc != nil {
+		offset, err := f.file.Seek(loc.offset, loc.whence)
+		if err != nil {
+			f.file.Close()
+			return nil, err
+		}
+		f.offset = offset
+		f.reader.Reset(f.file)
+	}
+	// nothing before where reading starts is waiting to be sent, nor needs
+	// saving again
+	f.sent = State{INode: f.inode, Offset: f.offset}
+	f.lastSaved = f.sent
+	if f.follow && !options.Poll {
+		f.watch()
+	}
+	if store != nil {
+		go f.updateState()
+		if progress != nil {
+			progress.OnFinish(f.saveFinalState)
+		}
+	}
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	startFollowing(f)
+	go f.run()
+	return f, nil
+}
+
+// watch asks to be notified of changes to the file. The directory is watched
+// rather than the file so that a new file created in its place by log
+// rotation is noticed too. If notifications aren't available (eg too many
+// files are already being watched), the file is polled instead.
+func (f *follower) watch() {
+	notify, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = notify.Add(filepath.Dir(f.path))
+		if err != nil {
+			notify.Close()
+		}
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file":  f.path,
+			"error": err,
+		}).Info("Can't be notified of changes to file; polling it instead")
+		return
+	}
+	f.notify = notify
+	f.watchTarget()
+}
+
+// watchTarget watches the directory of the file a symlink points to as well,
+// since writes to the file don't show up as changes to the link. Changes to
+// the link itself show up in path's directory.
+func (f *follower) watchTarget() {
+	if f.notify == nil {
+		return
+	}
+	dir := ""
+	if f.target != "" && filepath.Dir(f.target) != absDir(f.path) {
+		dir = filepath.Dir(f.target)
+	}
+	if dir == f.targetDir {
+		return
+	}
+	if f.targetDir != "" {
+		f.notify.Remove(f.targetDir)
+	}
+	f.targetDir = ""
+	if dir == "" {
+		return
+	}
+	if err := f.notify.Add(dir); err != nil {
+		// checking every notifiedCheckInterval will still find new lines
+		logrus.WithFields(logrus.Fields{
+			"file":   f.path,
+			"target": f.target,
+			"error":  err,
+		}).Info("Can't be notified of changes to symlinked file")
+		return
+	}
+	f.targetDir = dir
+}
+
+// resolve returns the file path's symlink points to, or "" if it isn't one
+func (f *follower) resolve() string {
+	if info, err := os.Lstat(f.path); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return ""
+	}
+	target, err := filepath.EvalSymlinks(f.path)
+	if err != nil {
+		return ""
+	}
+	if abs, err := filepath.Abs(target); err == nil {
+		target = abs
+	}
+	return target
+}
+
+// absDir returns the absolute path of path's directory
+func absDir(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return filepath.Dir(abs)
+	}
+	return filepath.Dir(path)
+}
+
+// open (re)opens the file at path, ready to read from its beginning
+func (f *follower) open() error {
+	// resolve the link first; if it changes again before the file is
+	// opened, the inode won't match and the file is opened again later
+	target := f.resolve()
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	inode, err := INode(f.path)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if f.file != nil {
+		f.file.Close()
+	}
+	f.file = file
+	if f.follow {
+		f.reader = bufio.NewReader(file)
+	} else {
+		f.reader = bufio.NewReaderSize(file, backfillReadBytes)
+	}
+	f.partial.discard()
+	f.replaced = false
+	f.target = target
+	f.watchTarget()
+	f.lock.Lock()
+	f.inode = inode
+	f.offset = 0
+	f.lock.Unlock()
+	return nil
+}
+
+// state returns the inode of the file being read and the offset just past
+// the last complete line read from it
+func (f *follower) state() State {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return State{INode: f.inode, Offset: f.offset}
+}
+
+// Stop stops reading; the lines channel is closed soon after
+func (f *follower) Stop() {
+	f.cancel()
+}
+
+func (f *follower) run() {
+	defer f.cancel()
+	defer close(f.lines)
+	defer stopFollowing(f)
+	defer func() {
+		if f.progress == nil {
+			f.saveState(true)
+		}
+	}()
+	defer close(f.done)
+	defer func() { f.file.Close() }()
+	if f.notify != nil {
+		defer f.notify.Close()
+	}
+	for {
+		if !f.readToEOF() {
+			return
+		}
+		if !f.follow {
+			// a final line without a newline may still be being written,
+			// so give it a moment to be finished
+			if !f.partial.empty() && !f.partial.padding() {
+				select {
+				case <-f.ctx.Done():
+					return
+				case <-time.After(f.interval):
+				}
+				if !f.readToEOF() {
+					return
+				}
+			}
+			// a final line without a newline is still a line
+			f.flushPartial()
+			return
+		}
+		if f.checkRotation() {
+			// read the new file, or the file again, straight away
+			continue
+		}
+		if !f.wait() {
+			return
+		}
+	}
+}
+
+// wait returns once there may be more to read: when notified of a change to
+// the file, or after the poll interval. It returns false if the follower was
+// stopped.
+func (f *follower) wait() bool {
+	if f.notify == nil || f.replaced {
+		// a replaced file is written to at another path, so it's polled
+		// until it's been switched from
+		select {
+		case <-f.ctx.Done():
+			return false
+		case <-time.After(f.interval):
+			return true
+		}
+	}
+	timeout := time.After(notifiedCheckInterval)
+	for {
+		select {
+		case <-f.ctx.Done():
+			return false
+		case <-timeout:
+			return true
+		case ev, ok := <-f.notify.Events:
+			if !ok {
+				return true
+			}
+			// the directory may hold other busy files
+			if filepath.Clean(ev.Name) == filepath.Clean(f.path) {
+				return true
+			}
+			if f.target != "" {
+				if name, err := filepath.Abs(ev.Name); err == nil && name == f.target {
+					return true
+				}
+			}
+		case err, ok := <-f.notify.Errors:
+			if !ok {
+				return true
+			}
+			logrus.WithFields(logrus.Fields{
+				"file":  f.path,
+				"error": err,
+			}).Debug("Error watching file")
+		}
+	}
+}
+
+// readToEOF sends every complete line up to the end of the file. It returns
+// false if the follower was stopped.
+func (f *follower) readToEOF() bool {
+	for {
+		chunk, err := f.partial.read(f.reader)
+		// parts of a line being split are sent as they're read
+		for _, part := range f.partial.add(chunk) {
+			if !f.send(part) {
+				return false
+			}
+			f.advance(int64(len(part)), true)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			f.rewindPadding()
+			return true
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file":  f.path,
+				"error": err,
+			}).Warn("Error reading file")
+			return true
+		}
+		consumed := f.partial.size
+		line, ok := f.partial.take()
+		if f.pastStopAt(line) {
+			logrus.WithFields(logrus.Fields{"file": f.path}).Info("Reached --tail.stop_at; done reading file")
+			return false
+		}
+		if ok && !f.send(line) {
+			return false
+		}
+		f.advance(consumed, ok)
+	}
+}
+
+// advance moves the position read past a line, which has just been sent on
+// if sent is set. Every so often it also notes the position before the first
+// line the parser may not be done with, to be saved once the events made
+// from the lines before it have been sent.
+//
+// The parser only takes a line once it's done with the one before, so the
+// lines it's done with are those sent, less the ones still waiting in the
+// lines channel, those held on the way to it and the one it has. Joined
+// lines are counted as they're taken instead. The events from those lines
+// have all been handed on, so a mark taken after counting them covers them.
+func (f *follower) advance(consumed int64, sent bool) {
+	f.lock.Lock()
+	state := State{INode: f.inode, Offset: f.offset}
+	f.offset += consumed
+	f.lock.Unlock()
+	if !sent {
+		// the position after a line that's dropped is as safe to save as
+		// the one before it, and the next line sent notes it
+		return
+	}
+	f.unparsed = append(f.unparsed, unparsedState{state: state, line: f.sentLines})
+	if len(f.unparsed) > f.remember {
+		f.unparsed = f.unparsed[1:]
+	}
+	if f.progress == nil || f.saveAtEnd || time.Since(f.lastMark) < markInterval {
+		return
+	}
+	state, ok := f.parsedState()
+	if !ok {
+		return
+	}
+	mark := f.progress.Mark()
+	f.lastMark = time.Now()
+	f.lock.Lock()
+	f.pending = append(f.pending, pendingState{state: state, mark: mark})
+	f.lock.Unlock()
+}
+
+// parsedState returns the position before the first line the parser may not
+// be done with. It returns false if that's further back than the positions
+// remembered, eg because lines split in pieces take more than one place in
+// the lines channel.
+func (f *follower) parsedState() (State, bool) {
+	var parsed uint64
+	if f.joined != nil {
+		parsed = f.joined.parsedLines()
+	} else {
+		unparsed := uint64(len(f.lines) + 1 + f.held)
+		if f.sentLines < unparsed {
+			return State{}, false
+		}
+		parsed = f.sentLines - unparsed
+	}
+	// lines flushed without advancing past them have no position of
+	// their own, so take the latest position not past the first unparsed
+	// line
+	for i := len(f.unparsed) - 1; i >= 0; i-- {
+		if f.unparsed[i].line <= parsed+1 {
+			return f.unparsed[i].state, true
+		}
+	}
+	return State{}, false
+}
+
+// rewindPadding goes back to the start of NUL padding at the end of the file,
+// so that it's read again next time in case lines are written over it
+func (f *follower) rewindPadding() {
+	if !f.follow || !f.partial.padding() || f.partial.size > maxRetryPadding {
+		return
+	}
+	offset := f.state().Offset
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	f.reader.Reset(f.file)
+	f.partial.discard()
+}
+
+// send sends line on. It returns false if the follower was stopped.
+func (f *follower) send(line []byte) bool {
+	select {
+	case f.lines <- string(line):
+		f.sentLines++
+		return true
+	case <-f.ctx.Done():
+		return false
+	}
+}
+
+// pastStopAt reports whether line is far enough past --tail.stop_at that
+// the rest of the file can be skipped
+func (f *follower) pastStopAt(line []byte) bool {
+	if f.stopAt.IsZero() {
+		return false
+	}
+	t, ok := lineTime(string(line))
+	return ok && t.After(f.stopAt.Add(stopAtSlack))
+}
+
+func (f *follower) flushPartial() {
+	if !f.partial.empty() {
+		if line, ok := f.partial.take(); ok {
+			f.send(line)
+		}
+	}
+}
+
+// checkRotation looks for the file having been truncated or replaced since
+// it was opened, and reopens it if so. It returns true if there's a new file
+// or new start to read from.
+func (f *follower) checkRotation() bool {
+	info, err := f.file.Stat()
+	if err == nil && info.Size() < f.state().Offset+f.partial.size {
+		logrus.WithFields(logrus.Fields{"file": f.path}).Info("File was truncated; reading from the beginning")
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return false
+		}
+		f.reader.Reset(f.file)
+		f.partial.discard()
+		f.lock.Lock()
+		f.offset = 0
+		f.lock.Unlock()
+		return true
+	}
+	inode, err := INode(f.path)
+	if err != nil || inode == f.state().INode {
+		// either nothing's changed, or the file has been moved away and
+		// not yet replaced; keep reading the old one until it is
+		return false
+	}
+	// the file's been replaced. Anything written to the old one before the
+	// writer switched over is still to be read, so wait one more poll
+	// before switching.
+	if !f.replaced {
+		f.replaced = true
+		return false
+	}
+	f.flushPartial()
+	if err := f.open(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file":  f.path,
+			"error": err,
+		}).Warn("Failed to open rotated file; will try again")
+		return false
+	}
+	fields := logrus.Fields{"file": f.path}
+	if f.target != "" {
+		fields["target"] = f.target
+	}
+	logrus.WithFields(fields).Info("File was rotated; reading the new one")
+	return true
+}
+
+// updateState saves the position reached once a second until reading stops
+func (f *follower) updateState() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.saveState(false)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// sentState returns the latest position whose events have all been sent
+func (f *follower) sentState() State {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.pending) > 0 && f.progress.Reached(f.pending[0].mark) {
+		f.sent = f.pending[0].state
+		f.pending = f.pending[1:]
+	}
+	return f.sent
+}
+
+// saveFinalState is called once sending has finished. If everything was
+// sent, the whole file has been dealt with up to where it was read.
+func (f *follower) saveFinalState() {
+	if f.progress.Reached(f.progress.Mark()) {
+		f.lock.Lock()
+		f.pending = append(f.pending, pendingState{state: State{INode: f.inode, Offset: f.offset}})
+		f.lock.Unlock()
+	}
+	f.saveState(true)
+}
+
+// saveState saves the inode of the file being read and the offset reached in
+// it, or with progress, the offset up to which lines have been sent, if
+// they've changed since they were last saved. flush makes sure it's written
+// out straight away.
+func (f *follower) saveState(flush bool) {
+	f.saveLock.Lock()
+	defer f.saveLock.Unlock()
+	if f.store == nil {
+		return
+	}
+	state := f.state()
+	if f.progress != nil {
+		state = f.sentState()
+	}
+	if state == f.lastSaved {
+		return
+	}
+	err := f.store.save(f.path, state)
+	if err == nil && flush {
+		err = f.store.flush()
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"logfile": f.path,
+			"error":   err,
+		}).Warn("Failed to save state. File location will not be saved.")
+		f.store = nil
+		return
+	}
+	f.lastSaved = state
+}
@@ -0,0 +1,379 @@
+package tail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func expectLines(t *testing.T, lines chan string, expected ...string) {
+	for _, want := range expected {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Errorf("expected %q, got %q", want, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func appendTo(t *testing.T, path, text string) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString(text)
+	fh.Close()
+}
+
+func TestFollowRenameRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "one\n")
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, "one")
+
+	// the writer still has the old file open after it's renamed, and a
+	// partial line is finished off before it switches
+	old, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	old.WriteString("tw")
+	os.Rename(path, path+".1")
+	appendTo(t, path, "three\n")
+	old.WriteString("o\n")
+	old.Close()
+	expectLines(t, f.lines, "two", "three")
+
+	// the offset moves on just after the line is sent
+	inode, _ := INode(path)
+	expected := State{INode: inode, Offset: 6}
+	for i := 0; i < 100 && f.state() != expected; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := f.state(); state != expected {
+		t.Errorf("expected to be at the end of the new file, got %+v", state)
+	}
+}
+
+func TestFollowCopyTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "first line\nsecond line\n")
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, "first line", "second line")
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * pollInterval)
+	appendTo(t, path, "after\n")
+	expectLines(t, f.lines, "after")
+}
+
+func TestFollowStopAtEOF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "one\r\ntwo\nno newline")
+
+	f, err := followFile(context.Background(), path, &location{offset: 5}, TailOptions{Stop: true}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for line := range f.lines {
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[0] != "two" || lines[1] != "no newline" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+}
+
+func TestFollowNotified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "one\n")
+
+	// new lines arrive long before the poll interval is up
+	f, err := followFile(context.Background(), path, nil, TailOptions{PollInterval: 60000}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	if f.notify == nil {
+		t.Skip("notifications aren't available here")
+	}
+	expectLines(t, f.lines, "one")
+	time.Sleep(100 * time.Millisecond)
+	appendTo(t, path, "two\n")
+	select {
+	case line := <-f.lines:
+		if line != "two" {
+			t.Errorf("expected %q, got %q", "two", line)
+		}
+	case <-time.After(notifiedCheckInterval / 2):
+		t.Error("timed out waiting to be notified of a new line")
+	}
+}
+
+func TestFollowPoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "one\n")
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{Poll: true, PollInterval: 10}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	if f.notify != nil {
+		t.Error("expected to poll rather than be notified")
+	}
+	expectLines(t, f.lines, "one")
+	appendTo(t, path, "two\n")
+	expectLines(t, f.lines, "two")
+}
+
+func TestFollowSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the logs are written elsewhere, with a current link to the latest
+	logs := filepath.Join(dir, "logs")
+	os.Mkdir(logs, 0755)
+	first := filepath.Join(logs, "app-20160801.log")
+	appendTo(t, first, "one\n")
+	path := filepath.Join(dir, "current")
+	if err := os.Symlink(first, path); err != nil {
+		t.Skip("can't create symlinks here:", err)
+	}
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{PollInterval: 10}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, "one")
+	appendTo(t, first, "two\n")
+	expectLines(t, f.lines, "two")
+
+	// pointing the link at a new file switches to it
+	second := filepath.Join(logs, "app-20160802.log")
+	appendTo(t, second, "three\n")
+	os.Symlink(second, path+".new")
+	os.Rename(path+".new", path)
+	expectLines(t, f.lines, "three")
+	appendTo(t, second, "four\n")
+	expectLines(t, f.lines, "four")
+}
+
+// fakeProgress counts a mark for each line, and has reached the marks up to
+// sent
+type fakeProgress struct {
+	lock      sync.Mutex
+	marks     uint64
+	sent      uint64
+	finishers []func()
+}
+
+func (p *fakeProgress) Mark() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.marks++
+	return p.marks
+}
+
+func (p *fakeProgress) Reached(mark uint64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return mark <= p.sent
+}
+
+func (p *fakeProgress) OnFinish(f func()) {
+	p.finishers = append(p.finishers, f)
+}
+
+func (p *fakeProgress) send(mark uint64) {
+	p.lock.Lock()
+	p.sent = mark
+	p.lock.Unlock()
+}
+
+// waitForOffset waits until f has read up to offset
+func waitForOffset(t *testing.T, f *follower, offset int64) {
+	t.Helper()
+	for i := 0; f.state().Offset < offset; i++ {
+		if i == 100 {
+			t.Fatalf("timed out reading up to %d", offset)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollowSavesSentState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "one\ntwo\n")
+	store, err := newSharedStateFile(filepath.Join(dir, "honeytail.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := &fakeProgress{}
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{}, store, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, "one")
+	time.Sleep(markInterval)
+	expectLines(t, f.lines, "two")
+	appendTo(t, path, "three\n")
+	expectLines(t, f.lines, "three")
+
+	// nothing's saved until the events from the lines have been sent
+	f.saveState(false)
+	if _, err := store.load(path); err == nil {
+		t.Error("expected no state saved before any events were sent")
+	}
+	// once the events from "one" are sent, the position after it is saved
+	progress.send(2)
+	f.saveState(false)
+	inode, _ := INode(path)
+	if state, err := store.load(path); err != nil || state != (State{INode: inode, Offset: 4}) {
+		t.Errorf("unexpected state after one line was sent: %+v, %v", state, err)
+	}
+	// when sending finishes with everything sent, the position read is saved
+	waitForOffset(t, f, 14)
+	progress.send(10)
+	for _, finish := range progress.finishers {
+		finish()
+	}
+	if state, err := store.load(path); err != nil || state != (State{INode: inode, Offset: 14}) {
+		t.Errorf("unexpected state once everything was sent: %+v, %v", state, err)
+	}
+}
+
+func TestAdvanceWithLineBuffer(t *testing.T) {
+	f := &follower{lines: make(chan string, 2), progress: &fakeProgress{}, inode: 1, remember: 3}
+	// sendLine puts line in the channel and advances past it, as if it had
+	// just been read and sent
+	sendLine := func(line string) {
+		f.lines <- line
+		f.sentLines++
+		f.lastMark = time.Time{}
+		f.advance(int64(len(line)+1), true)
+	}
+	expectPending := func(offsets ...int64) {
+		t.Helper()
+		var got []int64
+		for _, p := range f.pending {
+			got = append(got, p.state.Offset)
+		}
+		if !reflect.DeepEqual(got, offsets) {
+			t.Errorf("expected pending offsets %v, got %v", offsets, got)
+		}
+	}
+
+	// while every line read is still waiting, there's no position before
+	// them to save
+	sendLine("one")
+	sendLine("two")
+	expectPending()
+	// once the parser's taken "one", the lines after it are still waiting,
+	// so only the start of the file is safe to save
+	<-f.lines
+	sendLine("three")
+	expectPending(0)
+	// the parser's taken "two" and "three", so it's done with "two"
+	<-f.lines
+	<-f.lines
+	sendLine("four")
+	expectPending(0, 8)
+}
+
+func TestFollowSavesJoinedState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "follow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "one\n  more\ntwo\n")
+	options := TailOptions{MultilineStart: `^\S`}
+
+	f, err := followFile(context.Background(), path, nil, options, nil, &fakeProgress{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	lines := f.joiner.join(f.lines, f.joined)
+	// latest returns the latest position noted to save
+	latest := func() int64 {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if len(f.pending) == 0 {
+			return -1
+		}
+		return f.pending[len(f.pending)-1].state.Offset
+	}
+
+	expectLines(t, lines, "one\n  more")
+	time.Sleep(markInterval)
+	appendTo(t, path, "three\n")
+	waitForOffset(t, f, 21)
+	// "two" is still being joined and the parser has "one" and "more", so
+	// nothing past the start of the file is safe to save
+	if offset := latest(); offset != 0 {
+		t.Errorf("expected the start of the file to be saved while the parser has the first event, got %d", offset)
+	}
+	expectLines(t, lines, "two")
+	time.Sleep(markInterval)
+	appendTo(t, path, "four\n")
+	waitForOffset(t, f, 26)
+	// the parser's taken "two", so it's done with "one" and "more"
+	if offset := latest(); offset != 11 {
+		t.Errorf("expected the position before \"two\" to be saved, got %d", offset)
+	}
+}
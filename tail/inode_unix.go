@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package tail
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// INode returns the inode number of file, which stays the same while the file
+// is written to but changes when it's rotated out and replaced
+func INode(file string) (uint64, error) {
+	logStat := unix.Stat_t{}
+	if err := unix.Stat(file, &logStat); err != nil {
+		return 0, err
+	}
+	return uint64(logStat.Ino), nil
+}
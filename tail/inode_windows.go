@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package tail
+
+import (
+	"syscall"
+)
+
+// INode returns the NTFS file index of file, which plays the part of an inode
+// number: it stays the same while the file is written to but changes when
+// it's rotated out and replaced
+func INode(file string) (uint64, error) {
+	name, err := syscall.UTF16PtrFromString(file)
+	if err != nil {
+		return 0, err
+	}
+	// share everything so we don't get in the way of the process writing
+	// the log or of whatever rotates it
+	h, err := syscall.CreateFile(name, 0,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.CloseHandle(h)
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(h, &info); err != nil {
+		return 0, err
+	}
+	return uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
@@ -0,0 +1,119 @@
+package tail
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lastLinesPrefix starts a --tail.read_from asking for the last N lines
+const lastLinesPrefix = "last:"
+
+// LastLines returns N from --tail.read_from last:N, or 0 if read_from isn't
+// of that form
+func LastLines(options TailOptions) (int, error) {
+	if !strings.HasPrefix(options.ReadFrom, lastLinesPrefix) {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(options.ReadFrom, lastLinesPrefix))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("--tail.read_from %s must be last: followed by a number of lines, eg last:1000", options.ReadFrom)
+	}
+	return n, nil
+}
+
+// lastLinesOffset returns the offset of the start of the nth line from the
+// end of path, or 0 if it has n lines or fewer. A final line without a
+// newline counts as a line.
+func lastLinesOffset(path string, n int) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := info.Size()
+	buf := make([]byte, 64*1024)
+	// the newline ending the last line doesn't start another line after it
+	skipLast := true
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' {
+				skipLast = false
+				continue
+			}
+			if skipLast {
+				skipLast = false
+				continue
+			}
+			n--
+			if n == 0 {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// FirstLines returns the first n lines of path, or of stdin for -, as they'd
+// be tailed: decompressed, decoded and joined into multi-line events as
+// options say
+func FirstLines(path string, n int, options TailOptions) ([]string, error) {
+	file := os.Stdin
+	if path != "-" {
+		var err error
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	b, err := newLineBuilder(options)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	joiner, err := newJoiner(options)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	contents, err := decompress(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	raw := make(chan string)
+	go func() {
+		defer close(raw)
+		readLines(bufio.NewReader(contents), raw, b)
+	}()
+	joined := joiner.join(raw, nil)
+	var lines []string
+	for line := range joined {
+		lines = append(lines, line)
+		if len(lines) == n {
+			break
+		}
+	}
+	// closing the file stops the reading, once what's been read is drained
+	file.Close()
+	go func() {
+		for range joined {
+		}
+	}()
+	return lines, nil
+}
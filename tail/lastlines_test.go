@@ -0,0 +1,124 @@
+package tail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLastLines(t *testing.T) {
+	tsts := []struct {
+		readFrom string
+		expected int
+		err      bool
+	}{
+		{"last", 0, false},
+		{"end", 0, false},
+		{"last:1000", 1000, false},
+		{"last:", 0, true},
+		{"last:0", 0, true},
+		{"last:lots", 0, true},
+	}
+	for _, tt := range tsts {
+		n, err := LastLines(TailOptions{ReadFrom: tt.readFrom})
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error %v, got %v", tt.readFrom, tt.err, err)
+		}
+		if n != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.readFrom, tt.expected, n)
+		}
+	}
+}
+
+func TestLastLinesOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastlines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+
+	// enough lines to span several of the chunks read from the end
+	var lines []string
+	for i := 0; i < 10000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d %s", i, strings.Repeat("x", 20)))
+	}
+	tsts := []struct {
+		contents string
+		n        int
+		expected string
+	}{
+		{strings.Join(lines, "\n") + "\n", 3, strings.Join(lines[9997:], "\n") + "\n"},
+		{strings.Join(lines, "\n") + "\n", 5000, strings.Join(lines[5000:], "\n") + "\n"},
+		{strings.Join(lines, "\n"), 2, strings.Join(lines[9998:], "\n")},
+		{"a\nb\n", 5, "a\nb\n"},
+		{"", 5, ""},
+	}
+	for _, tt := range tsts {
+		ioutil.WriteFile(path, []byte(tt.contents), 0644)
+		offset, err := lastLinesOffset(path, tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := tt.contents[offset:]; actual != tt.expected {
+			t.Errorf("last %d lines: expected %.40q..., got %.40q...", tt.n, tt.expected, actual)
+		}
+	}
+}
+
+func TestTailLastLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lastlines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("one\ntwo\nthree\nfour\n"), 0644)
+
+	conf := Config{
+		Paths:   []string{path},
+		Options: TailOptions{ReadFrom: "last:2", Stop: true},
+	}
+	lines, err := GetEntries(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for line := range lines {
+		actual = append(actual, line)
+	}
+	if strings.Join(actual, ",") != "three,four" {
+		t.Errorf("expected the last two lines, got %q", actual)
+	}
+}
+
+func TestFirstLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firstlines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte("one\ntwo\n  continued\nthree\nfour\n"), 0644)
+	lines, err := FirstLines(path, 3, TailOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, "|") != "one|two|  continued" {
+		t.Errorf("unexpected lines %q", lines)
+	}
+	lines, err = FirstLines(path, 3, TailOptions{MultilineContinue: `^\s`, MultilineMaxLines: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(lines, "|") != "one|two\n  continued|three" {
+		t.Errorf("unexpected joined lines %q", lines)
+	}
+	lines, err = FirstLines(path, 10, TailOptions{})
+	if err != nil || len(lines) != 5 {
+		t.Errorf("expected every line of a short file, got %q, %v", lines, err)
+	}
+}
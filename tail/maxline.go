@@ -0,0 +1,197 @@
+package tail
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// what to do with lines longer than --tail.max_line_bytes
+const (
+	oversizeTruncate = "truncate"
+	oversizeDrop     = "drop"
+	oversizeSplit    = "split"
+)
+
+// oversizeLines counts the lines longer than --tail.max_line_bytes
+var oversizeLines int64
+
+// OversizeLines returns how many lines longer than --tail.max_line_bytes have
+// been read since it was last called
+func OversizeLines() int64 {
+	return atomic.SwapInt64(&oversizeLines, 0)
+}
+
+// lineLimit caps the length of lines, so one enormous line can't use up
+// memory or make an event too big to send
+type lineLimit struct {
+	max    int
+	policy string
+}
+
+// newLineLimit returns the limit set by --tail.max_line_bytes and
+// --tail.oversize_policy, or nil if lines may be any length
+func newLineLimit(options TailOptions) (*lineLimit, error) {
+	switch options.OversizePolicy {
+	case oversizeTruncate, oversizeDrop, oversizeSplit:
+	case "":
+		options.OversizePolicy = oversizeTruncate
+	default:
+		return nil, fmt.Errorf("unknown option to --tail.oversize_policy: %s", options.OversizePolicy)
+	}
+	if options.MaxLineBytes <= 0 {
+		return nil, nil
+	}
+	return &lineLimit{max: options.MaxLineBytes, policy: options.OversizePolicy}, nil
+}
+
+// maxReusedLineBytes is the largest line buffer kept to read the next line
+// into; those grown bigger for a long line are let go
+const maxReusedLineBytes = 64 * 1024
+
+// lineBuilder collects a line read in pieces, keeping no more of it than the
+// limit allows, and converts it to UTF-8. Each file being read needs its own.
+type lineBuilder struct {
+	// limit is nil to keep lines of any length
+	limit *lineLimit
+	// enc is nil to leave lines as they are
+	enc *lineEncoding
+	// line holds the line read so far, without its newline
+	line []byte
+	// size counts the bytes read towards the line, including any thrown
+	// away and the newline
+	size int64
+	// oversize is set once the line has gone over the limit
+	oversize bool
+	// complete is set once the line's newline has been read
+	complete bool
+	// padded is set once NUL padding has been left out of the line
+	padded bool
+}
+
+// newLineBuilder returns a lineBuilder for the --tail options
+func newLineBuilder(options TailOptions) (*lineBuilder, error) {
+	limit, err := newLineLimit(options)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newLineEncoding(options)
+	if err != nil {
+		return nil, err
+	}
+	return &lineBuilder{limit: limit, enc: enc}, nil
+}
+
+// read reads the next piece of a line from r, to be passed to add
+func (b *lineBuilder) read(r *bufio.Reader) ([]byte, error) {
+	return b.enc.read(r)
+}
+
+// add appends a piece of the line. When splitting long lines, it returns the
+// parts that are ready to send; the bytes they take up are no longer counted
+// in size.
+func (b *lineBuilder) add(chunk []byte) [][]byte {
+	b.size += int64(len(chunk))
+	if terminator := b.enc.terminator(); bytes.HasSuffix(chunk, terminator) {
+		chunk = chunk[:len(chunk)-len(terminator)]
+		b.complete = true
+	}
+	if len(b.line) == 0 {
+		// padding before the line is skipped as it's read, so a long run
+		// of it doesn't pile up
+		trimmed := trimPadding(chunk, len(b.enc.terminator()))
+		b.padded = b.padded || len(trimmed) < len(chunk)
+		chunk = trimmed
+	}
+	b.line = append(b.line, chunk...)
+	if b.limit == nil || len(b.line) <= b.limit.max {
+		return nil
+	}
+	if !b.oversize {
+		b.oversize = true
+		atomic.AddInt64(&oversizeLines, 1)
+	}
+	// don't cut a two byte character in half
+	max := b.limit.max
+	if width := len(b.enc.terminator()); max >= width {
+		max -= max % width
+	} else {
+		max = width
+	}
+	if b.limit.policy != oversizeSplit {
+		b.line = b.line[:max]
+		return nil
+	}
+	var parts [][]byte
+	for len(b.line) > max {
+		parts = append(parts, b.enc.convert(b.line[:max]))
+		b.line = b.line[max:]
+		b.size -= int64(max)
+	}
+	return parts
+}
+
+// take returns the line, converted, and starts the next one. ok is false if
+// the line is to be dropped for being too long, or for being nothing but NUL
+// padding. The line may share its bytes with the next one, so it has to be
+// copied, as sending it as a string does, before anything more is added.
+func (b *lineBuilder) take() (line []byte, ok bool) {
+	line, ok = b.enc.convert(b.line), !(b.oversize && b.limit.policy == oversizeDrop)
+	if b.complete && len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	line, stripped := stripNULs(line)
+	if b.padded || stripped {
+		atomic.AddInt64(&paddedLines, 1)
+		ok = ok && len(line) > 0
+	}
+	b.discard()
+	return line, ok
+}
+
+// discard throws away what's been read of the line and starts the next one.
+// The next line is read into the same buffer, unless it's grown too big to
+// be worth keeping.
+func (b *lineBuilder) discard() {
+	if cap(b.line) > maxReusedLineBytes {
+		b.line = nil
+	}
+	b.line, b.size, b.oversize, b.complete, b.padded = b.line[:0], 0, false, false, false
+}
+
+// empty is true if nothing of the line has been read yet
+func (b *lineBuilder) empty() bool {
+	return b.size == 0
+}
+
+// padding is true if all that's been read of the line so far is NUL padding
+func (b *lineBuilder) padding() bool {
+	return b.padded && len(b.line) == 0 && !b.complete
+}
+
+// readLines sends each line from input down lines, stitching long lines back
+// together, until it gets an error reading input
+func readLines(input *bufio.Reader, lines chan string, b *lineBuilder) error {
+	for {
+		chunk, err := b.read(input)
+		for _, part := range b.add(chunk) {
+			lines <- string(part)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			// a final line without a newline is still a line
+			if !b.empty() {
+				if line, ok := b.take(); ok {
+					lines <- string(line)
+				}
+			}
+			return err
+		}
+		if line, ok := b.take(); ok {
+			lines <- string(line)
+		}
+	}
+}
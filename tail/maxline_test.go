@@ -0,0 +1,103 @@
+package tail
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLinesLimit(t *testing.T) {
+	input := "short\r\n" + strings.Repeat("x", 10) + "\nalso\n" + strings.Repeat("y", 25)
+	tsts := []struct {
+		policy   string
+		expected []string
+	}{
+		{oversizeTruncate, []string{"short", "xxxxxxxx", "also", "yyyyyyyy"}},
+		{oversizeDrop, []string{"short", "also"}},
+		{oversizeSplit, []string{"short", "xxxxxxxx", "xx", "also", "yyyyyyyy", "yyyyyyyy", "yyyyyyyy", "y"}},
+	}
+	for _, tt := range tsts {
+		b, err := newLineBuilder(TailOptions{MaxLineBytes: 8, OversizePolicy: tt.policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		OversizeLines()
+		lines := make(chan string)
+		go func() {
+			// a buffer smaller than the lines, so they're read in pieces
+			readLines(bufio.NewReaderSize(strings.NewReader(input), 16), lines, b)
+			close(lines)
+		}()
+		var actual []string
+		for line := range lines {
+			actual = append(actual, line)
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(tt.expected) {
+			t.Errorf("%s: expected %q, got %q", tt.policy, tt.expected, actual)
+		}
+		if n := OversizeLines(); n != 2 {
+			t.Errorf("%s: expected 2 oversize lines, counted %d", tt.policy, n)
+		}
+	}
+	if _, err := newLineLimit(TailOptions{MaxLineBytes: 8, OversizePolicy: "shrink"}); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+	if limit, _ := newLineLimit(TailOptions{}); limit != nil {
+		t.Error("expected no limit by default")
+	}
+}
+
+func TestFollowLineLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maxline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	long := strings.Repeat("z", 100*1024)
+	appendTo(t, path, "one\n"+long+"\ntwo\n")
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{MaxLineBytes: 64 * 1024, OversizePolicy: oversizeDrop}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, "one", "two")
+
+	// the dropped line still counts towards the offset
+	appendTo(t, path, "three\n")
+	expectLines(t, f.lines, "three")
+	expected := int64(len("one\n" + long + "\ntwo\nthree\n"))
+	for i := 0; i < 100 && f.state().Offset != expected; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if offset := f.state().Offset; offset != expected {
+		t.Errorf("expected offset %d, got %d", expected, offset)
+	}
+}
+
+// BenchmarkReadLines reads a file's worth of typical log lines
+func BenchmarkReadLines(b *testing.B) {
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&input, `{"time":"2016-08-01T12:00:00Z","status":200,"path":"/orders/%d","duration_ms":12.5}`+"\n", i)
+	}
+	b.SetBytes(int64(input.Len()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		lb, _ := newLineBuilder(TailOptions{MaxLineBytes: 64 * 1024})
+		lines := make(chan string, 100)
+		go func() {
+			readLines(bufio.NewReader(strings.NewReader(input.String())), lines, lb)
+			close(lines)
+		}()
+		for range lines {
+		}
+	}
+}
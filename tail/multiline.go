@@ -0,0 +1,151 @@
+package tail
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// joinedLimit is how many lines a joined event is taken to have at most,
+// for remembering positions, when --tail.multiline_max_lines doesn't say
+const joinedLimit = 500
+
+// joiner assembles consecutive physical lines into one logical line, eg the
+// message and frames of a stack trace, before they reach the parser
+type joiner struct {
+	start    *regexp.Regexp
+	cont     *regexp.Regexp
+	timeout  time.Duration
+	maxLines int
+}
+
+// newJoiner returns a joiner for the --tail.multiline_* options, or nil if
+// lines shouldn't be joined
+func newJoiner(options TailOptions) (*joiner, error) {
+	if options.MultilineStart == "" && options.MultilineContinue == "" {
+		return nil, nil
+	}
+	j := &joiner{
+		timeout:  time.Duration(options.MultilineTimeout) * time.Millisecond,
+		maxLines: options.MultilineMaxLines,
+	}
+	if j.timeout <= 0 {
+		j.timeout = time.Second
+	}
+	var err error
+	if options.MultilineStart != "" {
+		if j.start, err = regexp.Compile(options.MultilineStart); err != nil {
+			return nil, err
+		}
+	}
+	if options.MultilineContinue != "" {
+		if j.cont, err = regexp.Compile(options.MultilineContinue); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// continues reports whether line belongs to the event before it
+func (j *joiner) continues(line string) bool {
+	if j.start != nil && j.start.MatchString(line) {
+		return false
+	}
+	if j.cont != nil {
+		return j.cont.MatchString(line)
+	}
+	return true
+}
+
+// joinProgress counts the physical lines a joiner has sent on whose logical
+// lines the parser is done with, so a follower knows which of its positions
+// are safe to save. The parser only takes a logical line once it's done with
+// the one before, but held more may be on their way to it.
+type joinProgress struct {
+	held int
+
+	lock sync.Mutex
+	// recent holds how many physical lines were in each of the last held+1
+	// logical lines sent, oldest first
+	recent []int
+	// parsed counts the physical lines in the logical lines before them
+	parsed uint64
+}
+
+// sent records that a logical line made from lines physical ones has been
+// taken
+func (p *joinProgress) sent(lines int) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.recent = append(p.recent, lines)
+	if len(p.recent) > p.held+1 {
+		p.parsed += uint64(p.recent[0])
+		p.recent = p.recent[1:]
+	}
+}
+
+// parsedLines returns how many of the physical lines the joiner's read make
+// up logical lines the parser is done with
+func (p *joinProgress) parsedLines() uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.parsed
+}
+
+// limit returns how many physical lines at most a joiner with j's options
+// holds on to or has on their way to the parser
+func (j *joiner) limit(held int) int {
+	max := j.maxLines
+	if max <= 0 {
+		max = joinedLimit
+	}
+	// the one being joined, and the ones sent on
+	return (held + 2) * max
+}
+
+// join reads physical lines from in and sends logical lines, joined with
+// newlines, down the returned channel. An event is sent once the next one
+// starts, once it reaches the most lines allowed, or once no more lines have
+// arrived for the timeout. progress, if set, counts the logical lines taken.
+// A nil joiner passes lines straight through.
+func (j *joiner) join(in chan string, progress *joinProgress) chan string {
+	if j == nil {
+		return in
+	}
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		var pending []string
+		flush := func() {
+			if len(pending) > 0 {
+				out <- strings.Join(pending, "\n")
+				progress.sent(len(pending))
+				pending = nil
+			}
+		}
+		for {
+			var timeout <-chan time.Time
+			if len(pending) > 0 {
+				timeout = time.After(j.timeout)
+			}
+			select {
+			case line, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+				if !j.continues(line) || (j.maxLines > 0 && len(pending) >= j.maxLines) {
+					flush()
+				}
+				pending = append(pending, line)
+			case <-timeout:
+				flush()
+			}
+		}
+	}()
+	return out
+}
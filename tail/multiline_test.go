@@ -0,0 +1,90 @@
+package tail
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestJoin(t *testing.T) {
+	tsts := []struct {
+		options  TailOptions
+		input    []string
+		expected []string
+	}{
+		{
+			TailOptions{MultilineStart: `^\d{4}-`},
+			[]string{
+				"2016-08-01 ERROR request failed",
+				"java.lang.IllegalStateException: bad state",
+				"        at com.example.App.main(App.java:10)",
+				"2016-08-01 INFO next request",
+			},
+			[]string{
+				"2016-08-01 ERROR request failed\njava.lang.IllegalStateException: bad state\n        at com.example.App.main(App.java:10)",
+				"2016-08-01 INFO next request",
+			},
+		},
+		{
+			TailOptions{MultilineContinue: `^\s`},
+			[]string{"first", "  more", "second", "third", "\tmore"},
+			[]string{"first\n  more", "second", "third\n\tmore"},
+		},
+		{
+			TailOptions{MultilineStart: `^START`, MultilineMaxLines: 2},
+			[]string{"START", "a", "b", "c"},
+			[]string{"START\na", "b\nc"},
+		},
+	}
+	for _, tt := range tsts {
+		j, err := newJoiner(tt.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := make(chan string)
+		go func() {
+			for _, line := range tt.input {
+				in <- line
+			}
+			close(in)
+		}()
+		var actual []string
+		for line := range j.join(in, nil) {
+			actual = append(actual, line)
+		}
+		if !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("options %+v: expected %q, got %q", tt.options, tt.expected, actual)
+		}
+	}
+}
+
+func TestJoinTimeout(t *testing.T) {
+	j, _ := newJoiner(TailOptions{MultilineStart: `^START`, MultilineTimeout: 10})
+	in := make(chan string)
+	out := j.join(in, nil)
+	in <- "START"
+	in <- "more"
+	select {
+	case line := <-out:
+		if line != "START\nmore" {
+			t.Errorf("unexpected line %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the pending event to be sent after the timeout")
+	}
+	close(in)
+}
+
+func TestNoJoiner(t *testing.T) {
+	j, err := newJoiner(TailOptions{})
+	if err != nil || j != nil {
+		t.Fatalf("expected no joiner without multiline options, got %v, %v", j, err)
+	}
+	in := make(chan string)
+	if j.join(in, nil) != in {
+		t.Error("expected lines to pass straight through")
+	}
+	if _, err := newJoiner(TailOptions{MultilineStart: "("}); err == nil {
+		t.Error("expected an error for a bad regex")
+	}
+}
@@ -0,0 +1,51 @@
+package tail
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// maxRetryPadding is the most NUL padding at the end of a followed file that
+// is read again on each look for more lines. Some writers extend a file with
+// NULs before filling it in, so the padding may yet turn into lines; beyond
+// this, it's taken to be left over from a crash and skipped.
+const maxRetryPadding = 1024 * 1024
+
+// paddedLines counts the lines that had NUL bytes taken out of them
+var paddedLines int64
+
+// PaddedLines returns how many lines have had NUL bytes taken out of them, or
+// were dropped for having nothing else in them, since it was last called.
+// Filesystems like ext4 can leave runs of NULs in a file after a crash, where
+// blocks were allocated but never written.
+func PaddedLines() int64 {
+	return atomic.SwapInt64(&paddedLines, 0)
+}
+
+// trimPadding returns chunk without the NULs at its start. width is the size
+// of a character, so a NUL byte that's half of a two byte character is kept.
+func trimPadding(chunk []byte, width int) []byte {
+	for len(chunk) >= width && isPadding(chunk[:width]) {
+		chunk = chunk[width:]
+	}
+	return chunk
+}
+
+// isPadding is true if b is nothing but NUL bytes
+func isPadding(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// stripNULs returns line, which has been converted to UTF-8, without any NUL
+// characters
+func stripNULs(line []byte) ([]byte, bool) {
+	if bytes.IndexByte(line, 0) < 0 {
+		return line, false
+	}
+	return bytes.Replace(line, []byte{0}, nil, -1), true
+}
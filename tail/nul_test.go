@@ -0,0 +1,92 @@
+package tail
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLinesPadding(t *testing.T) {
+	nuls := strings.Repeat("\x00", 100)
+	tsts := []struct {
+		encoding string
+		input    []byte
+		expected []string
+		padded   int64
+	}{
+		// a crash left a run of NULs where the next line should have gone
+		{"utf-8", []byte("one\n" + nuls + "two\n\nthree\x00\n" + nuls), []string{"one", "two", "", "three"}, 3},
+		{"utf-8", []byte(nuls + "\n" + nuls + "\n"), nil, 2},
+		// NUL bytes are half of every ASCII character in UTF-16
+		{"utf-16le", append(utf16le("one\n"), append([]byte(nuls), utf16le("two\n")...)...), []string{"one", "two"}, 1},
+	}
+	for _, tt := range tsts {
+		PaddedLines()
+		actual := readAll(t, TailOptions{Encoding: tt.encoding}, tt.input)
+		if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", tt.expected) {
+			t.Errorf("%s: expected %q, got %q", tt.encoding, tt.expected, actual)
+		}
+		if n := PaddedLines(); n != tt.padded {
+			t.Errorf("%s: expected %d padded lines, counted %d", tt.encoding, tt.padded, n)
+		}
+	}
+}
+
+func TestFollowPaddingFilledIn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	// the writer makes room for lines before it writes them
+	appendTo(t, path, "one\n"+strings.Repeat("\x00", 4096))
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{Poll: true, PollInterval: 10}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, "one")
+	fh, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteAt([]byte("two\n"), 4)
+	fh.Close()
+	expectLines(t, f.lines, "two")
+	for i := 0; i < 100 && f.state().Offset != 8; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if offset := f.state().Offset; offset != 8 {
+		t.Errorf("expected to have read up to the padding, got offset %d", offset)
+	}
+}
+
+func TestFollowStopPartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nul")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, `{"a":1}`+"\n"+`{"b":`)
+
+	// the final line is finished off just after it's first read
+	f, err := followFile(context.Background(), path, nil, TailOptions{Stop: true, PollInterval: 500}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, `{"a":1}`)
+	appendTo(t, path, "2}\n")
+	expectLines(t, f.lines, `{"b":2}`)
+	if _, ok := <-f.lines; ok {
+		t.Error("expected no more lines")
+	}
+}
@@ -0,0 +1,127 @@
+package tail
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// lagWindow is how far back from the end of a line is looked at for its
+// timestamp
+const lagWindow = 16 * 1024
+
+// Position is how far through a file being followed honeytail has read, and
+// how far behind the end of it sending is
+type Position struct {
+	Path string `json:"path"`
+	// Offset is just past the last complete line read
+	Offset int64 `json:"offset"`
+	// Size is how big the file at Path is now
+	Size int64 `json:"size"`
+	// SentOffset is just past the last line whose events have all been
+	// sent, as far as is known: it moves on a few times a second
+	SentOffset int64 `json:"sent_offset"`
+	// LagBytes is how much of the file is after SentOffset, and LagSeconds
+	// how much later the timestamp of the last line in the file is than
+	// that of the last line sent, if they both have timestamps
+	LagBytes   int64   `json:"lag_bytes"`
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+var (
+	followingLock sync.Mutex
+	// following holds the followers reading files
+	following = make(map[*follower]bool)
+)
+
+// Positions returns how far through each of the files being followed
+// honeytail has read, in order of their paths
+func Positions() []Position {
+	followingLock.Lock()
+	followers := make([]*follower, 0, len(following))
+	for f := range following {
+		followers = append(followers, f)
+	}
+	followingLock.Unlock()
+	positions := make([]Position, 0, len(followers))
+	for _, f := range followers {
+		positions = append(positions, f.position())
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i].Path < positions[j].Path })
+	return positions
+}
+
+// position returns how far through its file f has read and sent
+func (f *follower) position() Position {
+	read := f.state()
+	sent := read
+	if f.progress != nil {
+		sent = f.sentState()
+	}
+	position := Position{Path: f.path, Offset: read.Offset}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return position
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return position
+	}
+	position.Size = info.Size()
+	// after rotation, until something's sent from the new file, all of it
+	// is still to be sent
+	if sent.INode == read.INode && sent.Offset <= position.Size {
+		position.SentOffset = sent.Offset
+	}
+	position.LagBytes = position.Size - position.SentOffset
+	if position.LagBytes == 0 {
+		return position
+	}
+	newest, ok := lineTimeBefore(file, position.Size)
+	if !ok {
+		return position
+	}
+	if sentTime, ok := lineTimeBefore(file, position.SentOffset); ok && newest.After(sentTime) {
+		position.LagSeconds = newest.Sub(sentTime).Seconds()
+	}
+	return position
+}
+
+// lineTimeBefore returns the timestamp of the last complete line in file
+// before end
+func lineTimeBefore(file *os.File, end int64) (time.Time, bool) {
+	start := end - lagWindow
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, end-start)
+	if _, err := file.ReadAt(buf, start); err != nil && err != io.EOF {
+		return time.Time{}, false
+	}
+	// leave off a line that isn't finished yet, and the newline ending the
+	// one before it
+	i := bytes.LastIndexByte(buf, '\n')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	buf = buf[:i]
+	return lineTime(string(buf[bytes.LastIndexByte(buf, '\n')+1:]))
+}
+
+// startFollowing counts f among the followers reading files until
+// stopFollowing is called
+func startFollowing(f *follower) {
+	followingLock.Lock()
+	defer followingLock.Unlock()
+	following[f] = true
+}
+
+func stopFollowing(f *follower) {
+	followingLock.Lock()
+	defer followingLock.Unlock()
+	delete(following, f)
+}
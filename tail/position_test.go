@@ -0,0 +1,104 @@
+package tail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// positionsIn returns the Positions of the files in dir, leaving out those
+// other tests are still reading
+func positionsIn(dir string) []Position {
+	var positions []Position
+	for _, position := range Positions() {
+		if filepath.Dir(position.Path) == dir {
+			positions = append(positions, position)
+		}
+	}
+	return positions
+}
+
+func TestPositions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "position")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "one\ntwo\n")
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, f.lines, "one")
+
+	// reading has got as far as the line that's been taken
+	// without progress, what's read counts as sent
+	expected := Position{Path: path, Offset: 4, Size: 8, SentOffset: 4, LagBytes: 4}
+	var positions []Position
+	for i := 0; i < 100; i++ {
+		if positions = positionsIn(dir); len(positions) == 1 && positions[0] == expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(positions) != 1 || positions[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, positions)
+	}
+
+	// files stop being counted once they're no longer read
+	f.Stop()
+	for range f.lines {
+	}
+	if positions := positionsIn(dir); len(positions) != 0 {
+		t.Errorf("expected no files to be read, got %+v", positions)
+	}
+}
+
+func TestPositionLag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "position")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	one := "2016-08-01T12:00:00Z one\n"
+	appendTo(t, path, one+"2016-08-01T12:00:30Z two\n")
+	progress := &fakeProgress{}
+
+	f, err := followFile(context.Background(), path, nil, TailOptions{}, nil, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	expectLines(t, f.lines, "2016-08-01T12:00:00Z one")
+	time.Sleep(markInterval)
+	expectLines(t, f.lines, "2016-08-01T12:00:30Z two")
+	appendTo(t, path, "2016-08-01T12:01:00Z three\n")
+	expectLines(t, f.lines, "2016-08-01T12:01:00Z three")
+
+	// nothing's been sent, so the whole file is behind
+	position := f.position()
+	if position.SentOffset != 0 || position.LagBytes != position.Size || position.LagSeconds != 0 {
+		t.Errorf("expected nothing to be sent, got %+v", position)
+	}
+	// once the events from the first line are sent, the rest is behind, by
+	// the minute between it and the last line
+	progress.send(2)
+	position = f.position()
+	expected := Position{
+		Path:       path,
+		Offset:     position.Offset,
+		Size:       position.Size,
+		SentOffset: int64(len(one)),
+		LagBytes:   position.Size - int64(len(one)),
+		LagSeconds: 60,
+	}
+	if position != expected {
+		t.Errorf("expected %+v, got %+v", expected, position)
+	}
+}
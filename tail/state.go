@@ -0,0 +1,310 @@
+package tail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// stateStore remembers how far into each file we've read
+type stateStore interface {
+	// load returns the saved state for file
+	load(file string) (State, error)
+	// save records the state for file
+	save(file string, state State) error
+	// flush makes sure saved states are written out
+	flush() error
+	// close stops anything the store does in the background. States saved
+	// and flushed afterwards are still written out.
+	close()
+}
+
+// newStateStore returns the store described by options: one shared state
+// file, a directory of state files, or a state file next to each log file
+func newStateStore(options TailOptions) (stateStore, error) {
+	switch {
+	case options.StateFile != "":
+		return newSharedStateFile(options.StateFile)
+	case options.StateDir != "":
+		if err := os.MkdirAll(options.StateDir, 0755); err != nil {
+			return nil, err
+		}
+		return &stateFiles{dir: options.StateDir, open: make(map[string]*os.File)}, nil
+	}
+	return &stateFiles{open: make(map[string]*os.File)}, nil
+}
+
+// CheckState returns an error if the state of files, which may be globs,
+// couldn't be read or saved with options. Nothing is written, so it's safe
+// for --validate to call.
+func CheckState(options TailOptions, files []string) error {
+	var paths []string
+	if options.StateFile != "" {
+		paths = append(paths, options.StateFile)
+	} else {
+		s := &stateFiles{dir: options.StateDir}
+		for _, pattern := range files {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return err
+			}
+			if len(matches) == 0 {
+				matches = []string{pattern}
+			}
+			for _, file := range matches {
+				paths = append(paths, s.path(file))
+			}
+		}
+	}
+	for _, path := range paths {
+		if err := checkWritable(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWritable returns an error if path can't be opened to read and write,
+// or, if it doesn't exist yet, created
+func checkWritable(path string) error {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err == nil {
+		return fh.Close()
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	// the nearest directory that's there has to let it, and any directories
+	// it needs, be created
+	dir := filepath.Dir(path)
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	tmp, err := ioutil.TempFile(dir, ".honeytail-validate")
+	if err != nil {
+		return fmt.Errorf("can't create %s: %s", path, err)
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// stateFiles keeps the state of each log file in a file of its own
+type stateFiles struct {
+	// dir holds the state files, or is empty to keep each one next to its
+	// log file
+	dir string
+
+	lock sync.Mutex
+	open map[string]*os.File
+}
+
+// stateFileNames turns path separators into underscores so that the state
+// files for every log file can live in one directory
+var stateFileNames = strings.NewReplacer("/", "_", "\\", "_", ":", "_")
+
+func (s *stateFiles) path(file string) string {
+	if s.dir == "" {
+		return strings.TrimSuffix(file, ".log") + ".leash.state"
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	name := stateFileNames.Replace(strings.TrimLeft(file, "/\\"))
+	return filepath.Join(s.dir, strings.TrimSuffix(name, ".log")+".leash.state")
+}
+
+func (s *stateFiles) load(file string) (State, error) {
+	var state State
+	content, err := ioutil.ReadFile(s.path(file))
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(content, &state)
+	return state, err
+}
+
+func (s *stateFiles) save(file string, state State) error {
+	s.lock.Lock()
+	fh, ok := s.open[file]
+	if !ok {
+		var err error
+		fh, err = os.OpenFile(s.path(file), os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		s.open[file] = fh
+	}
+	s.lock.Unlock()
+	out, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	fh.Truncate(0)
+	out = append(out, '\n')
+	if _, err := fh.WriteAt(out, 0); err != nil {
+		return err
+	}
+	return fh.Sync()
+}
+
+// flush has nothing to do, as each state is written as it's saved
+func (s *stateFiles) flush() error {
+	return nil
+}
+
+// close has nothing to stop
+func (s *stateFiles) close() {}
+
+// sharedStateFile keeps the state of every log file in a single file, as a
+// JSON object keyed by the log file's absolute path
+type sharedStateFile struct {
+	path string
+	// stop stops the states being flushed periodically
+	stop     chan struct{}
+	stopOnce sync.Once
+	// writeLock is held while the file is written and renamed into place,
+	// so that flushes don't write the temporary file at the same time
+	writeLock sync.Mutex
+
+	lock   sync.Mutex
+	states map[string]State
+	dirty  bool
+	// legacy is the state from a statefile written for a single log file,
+	// before states were keyed by path. It's used for whichever file has
+	// its inode.
+	legacy *State
+}
+
+// stateFlushInterval is how often a shared state file is rewritten
+const stateFlushInterval = time.Second
+
+func newSharedStateFile(path string) (*sharedStateFile, error) {
+	s := &sharedStateFile{path: path, states: make(map[string]State), stop: make(chan struct{})}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(content))) > 0 {
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(content, &raw); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"statefile": path,
+				"error":     err,
+			}).Warn("Failed to decode the statefile. Starting without saved positions.")
+		} else if _, ok := raw["INode"]; ok {
+			var legacy State
+			if json.Unmarshal(content, &legacy) == nil {
+				s.legacy = &legacy
+			}
+		} else {
+			for file, encoded := range raw {
+				var state State
+				if json.Unmarshal(encoded, &state) == nil {
+					s.states[file] = state
+				}
+			}
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(stateFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				return
+			}
+			if err := s.flush(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"statefile": path,
+					"error":     err,
+				}).Warn("Failed to write statefile. File locations will not be saved.")
+			}
+		}
+	}()
+	return s, nil
+}
+
+func stateKey(file string) string {
+	if abs, err := filepath.Abs(file); err == nil {
+		return abs
+	}
+	return file
+}
+
+func (s *sharedStateFile) load(file string) (State, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if state, ok := s.states[stateKey(file)]; ok {
+		return state, nil
+	}
+	if s.legacy != nil {
+		if inode, err := INode(file); err == nil && inode == s.legacy.INode {
+			return *s.legacy, nil
+		}
+	}
+	return State{}, os.ErrNotExist
+}
+
+func (s *sharedStateFile) save(file string, state State) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := stateKey(file)
+	if old, ok := s.states[key]; !ok || old != state {
+		s.states[key] = state
+		s.dirty = true
+	}
+	return nil
+}
+
+// flush writes the states out if they've changed, replacing the file in one
+// go so that a crash never leaves it half written
+func (s *sharedStateFile) flush() error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	out, err := json.Marshal(s.states)
+	s.dirty = false
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	err = ioutil.WriteFile(tmp, append(out, '\n'), 0644)
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		// try again next time
+		s.lock.Lock()
+		s.dirty = true
+		s.lock.Unlock()
+	}
+	return err
+}
+
+// close stops the periodic flushes, writing out anything they'd have written
+func (s *sharedStateFile) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	if err := s.flush(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"statefile": s.path,
+			"error":     err,
+		}).Warn("Failed to write statefile. File locations will not be saved.")
+	}
+}
@@ -0,0 +1,192 @@
+package tail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestSharedStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "honeytail.state")
+
+	store, err := newSharedStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.load("a.log"); err == nil {
+		t.Error("expected no state for a file that was never saved")
+	}
+	store.save("a.log", State{INode: 1, Offset: 10})
+	store.save(filepath.Join(dir, "b.log"), State{INode: 2, Offset: 20})
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := newSharedStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := reopened.load("a.log"); err != nil || state != (State{INode: 1, Offset: 10}) {
+		t.Errorf("unexpected state for a.log: %+v, %v", state, err)
+	}
+	if state, err := reopened.load(filepath.Join(dir, "b.log")); err != nil || state != (State{INode: 2, Offset: 20}) {
+		t.Errorf("unexpected state for b.log: %+v, %v", state, err)
+	}
+	store.close()
+	reopened.close()
+}
+
+func TestSharedStateFileConcurrentFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := newSharedStateFile(filepath.Join(dir, "honeytail.state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.close()
+	// each flush writes and renames the same temporary file, so they have to
+	// take turns
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func(i int) {
+			var err error
+			for j := 0; j < 50 && err == nil; j++ {
+				store.save(fmt.Sprintf("%d.log", i), State{Offset: int64(j)})
+				err = store.flush()
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("expected flushes not to clash, got %s", err)
+		}
+	}
+}
+
+func TestLegacyStateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "app.log")
+	otherFile := filepath.Join(dir, "other.log")
+	ioutil.WriteFile(logFile, []byte("line\n"), 0644)
+	ioutil.WriteFile(otherFile, []byte("line\n"), 0644)
+	inode, _ := INode(logFile)
+	path := filepath.Join(dir, "app.leash.state")
+	ioutil.WriteFile(path, []byte(fmt.Sprintf(`{"INode":%d,"Offset":5}`+"\n", inode)), 0644)
+
+	store, err := newSharedStateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := store.load(logFile); err != nil || state.Offset != 5 {
+		t.Errorf("expected the old state to apply to the file it was written for, got %+v, %v", state, err)
+	}
+	if _, err := store.load(otherFile); err == nil {
+		t.Error("expected the old state not to apply to another file")
+	}
+}
+
+func TestStateDirPath(t *testing.T) {
+	s := &stateFiles{dir: "/var/lib/honeytail"}
+	expected := filepath.Join("/var/lib/honeytail", "var_log_app_web.leash.state")
+	if actual := s.path("/var/log/app/web.log"); actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+	s = &stateFiles{}
+	if actual := s.path("/var/log/app/web.log"); actual != "/var/log/app/web.leash.state" {
+		t.Errorf("expected the state file next to the log file, got %s", actual)
+	}
+}
+
+func TestResumeGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.log", "b.log"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(name+" 1\n"+name+" 2\n"), 0644)
+	}
+	stateFile := filepath.Join(dir, "honeytail.state")
+	store, _ := newSharedStateFile(stateFile)
+	// a.log was read up to its second line; b.log not at all
+	inode, _ := INode(filepath.Join(dir, "a.log"))
+	store.save(filepath.Join(dir, "a.log"), State{INode: inode, Offset: 8})
+	inode, _ = INode(filepath.Join(dir, "b.log"))
+	store.save(filepath.Join(dir, "b.log"), State{INode: inode, Offset: 0})
+	if err := store.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := GetEntriesByFile(Config{
+		Paths: []string{filepath.Join(dir, "*.log")},
+		Options: TailOptions{
+			ReadFrom:  "last",
+			Stop:      true,
+			StateFile: stateFile,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, entry := range entries {
+		for line := range entry.Lines {
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	expected := []string{"a.log 2", "b.log 1", "b.log 2"}
+	if fmt.Sprint(lines) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+}
+
+func TestCheckState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.log"), []byte("line\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a.leash.state"), []byte("{}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.log"), []byte("line\n"), 0644)
+	files := []string{filepath.Join(dir, "*.log")}
+	if err := CheckState(TailOptions{}, files); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if err := CheckState(TailOptions{StateDir: filepath.Join(dir, "states", "new")}, files); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "states")); !os.IsNotExist(err) {
+		t.Error("expected checking not to create the state directory")
+	}
+	if os.Getuid() == 0 {
+		// root can write anywhere
+		return
+	}
+	os.Chmod(filepath.Join(dir, "a.leash.state"), 0444)
+	if err := CheckState(TailOptions{}, files); err == nil {
+		t.Error("expected an error for a state file that can't be written")
+	}
+	readOnly := filepath.Join(dir, "readonly")
+	os.Mkdir(readOnly, 0555)
+	if err := CheckState(TailOptions{StateFile: filepath.Join(readOnly, "honeytail.state")}, files); err == nil {
+		t.Error("expected an error for a state file that can't be created")
+	}
+}
@@ -6,20 +6,15 @@ package tail
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
-	"path/filepath"
-	"strings"
 	"sync"
-	"time"
 
 	"github.com/Sirupsen/logrus"
-	"golang.org/x/sys/unix"
-
-	"github.com/hpcloud/tail"
 )
 
 type RotateStyle int
@@ -33,14 +28,41 @@ const (
 )
 
 type TailOptions struct {
-	ReadFrom  string `long:"read_from" description:"Location in the file from which to start reading. Values: beginning, end, last. Last picks up where it left off, if the file has not been rotated, otherwise beginning." default:"last"`
-	Stop      bool   `long:"stop" description:"Stop reading the file after reaching the end rather than continuing to tail."`
-	Poll      bool   `long:"poll" description:"use poll instead of inotify to tail files"`
-	StateFile string `long:"statefile" description:"File in which to store the last read position. Defaults to a file with the same path as the log file and the suffix .leash.state. If tailing multiple files, default is forced."`
+	ReadFrom          string   `long:"read_from" description:"Location in the file from which to start reading. Values: beginning, end, last, last:N, or a time (eg 2016-08-01T00:00:00Z). Last picks up where it left off, if the file has not been rotated, otherwise beginning. last:N starts N lines back from the end, like tail -n. A time starts from the first line at or after it." default:"last"`
+	StopAt            string   `long:"stop_at" description:"Only send events up to this time (eg 2016-08-02T00:00:00Z), and stop reading each file once its lines are past it. With a time for --tail.read_from, backfills a window of time"`
+	Stop              bool     `long:"stop" description:"Stop reading the file after reaching the end rather than continuing to tail."`
+	Poll              bool     `long:"poll" description:"Check files for new lines every --tail.poll_interval rather than being notified of changes. Use for NFS and other filesystems that don't send notifications"`
+	PollInterval      int      `long:"poll_interval" description:"Milliseconds between checks for new lines with --tail.poll, or when notifications aren't available" default:"250"`
+	MultilineStart    string   `long:"multiline_start_regex" description:"Lines matching this regular expression start a new event; lines that don't are joined to the one before with a newline. Use for stack traces and other messages that span several lines"`
+	MultilineContinue string   `long:"multiline_continue_regex" description:"Only lines matching this regular expression are joined to the one before; any other line starts a new event. May be used instead of or along with --tail.multiline_start_regex"`
+	MultilineTimeout  int      `long:"multiline_timeout" description:"Milliseconds to wait for more lines of a multi-line event before sending it on" default:"1000"`
+	MultilineMaxLines int      `long:"multiline_max_lines" description:"Most lines joined into one event; the next line starts a new one" default:"500"`
+	Exclude           []string `long:"exclude" description:"Don't read files matching this glob, eg *.gz. Matched against both the path and the file name. May be specified multiple times"`
+	IgnoreOlder       string   `long:"ignore_older" description:"Don't start reading files last modified longer ago than this, eg 24h or 7d. Files already being read carry on being read"`
+	Rescan            int      `long:"rescan_interval" description:"Seconds between re-expanding the --file globs to start tailing files created since startup and stop tailing deleted ones. 0 disables rescanning" default:"10"`
+	MaxLineBytes      int      `long:"max_line_bytes" description:"Longest line to read, in bytes; longer lines are dealt with according to --tail.oversize_policy. 0 allows lines of any length"`
+	OversizePolicy    string   `long:"oversize_policy" description:"What to do with lines longer than --tail.max_line_bytes. Values: truncate (send the start of the line), drop (skip the line), split (send the line in pieces of at most that many bytes)" default:"truncate"`
+	Encoding          string   `long:"encoding" description:"Character encoding of the files being read. Lines are converted to UTF-8 before being parsed. Values: utf-8, utf-16le, utf-16be, latin-1, shift-jis" default:"utf-8"`
+	StripANSI         bool     `long:"strip_ansi" description:"Remove ANSI escape sequences, eg terminal colors, from lines before they're parsed"`
+	StateFile         string   `long:"statefile" description:"File in which to store the last read position of every file being tailed. Defaults to a file next to each log file with the same path and the suffix .leash.state"`
+	StateDir          string   `long:"statedir" description:"Directory in which to keep a state file for each file being tailed, instead of next to the log files"`
+
+	// LineBuffer is how many lines read from each file being followed can
+	// wait to be taken, from --pipeline.line_buffer
+	LineBuffer int `no-flag:"true"`
+	// SaveAtEnd is set when lines are parsed in batches side by side, so
+	// the events from the lines before one may not have been made when it's
+	// taken. Positions are then only saved once everything read has been
+	// sent.
+	SaveAtEnd bool `no-flag:"true"`
+	// HeldLines is how many lines taken from each file being followed may
+	// be held on their way to the parser, eg by stages counting them.
+	// Positions are only saved from before those too.
+	HeldLines int `no-flag:"true"`
 }
 
 // Statefile mechanics when ReadFrom is 'last'
-// missing statefile => ReadFrom = end
+// missing statefile (or no state for this file in it) => ReadFrom = end
 // empty statefile => ReadFrom = end
 // permission denied => WARN and ReadFrom = end
 // invalid location (aka logfile's been rotated) => ReadFrom = beginning
@@ -52,6 +74,34 @@ type Config struct {
 	Type RotateStyle
 	// Tail specific options
 	Options TailOptions
+	// Context, once it's done, stops reading. Without Progress, files being
+	// followed save how far they got before their lines channels are
+	// closed. Nil reads until the files end, or forever when following.
+	Context context.Context
+	// Progress, if set, means positions in files are only saved once the
+	// events made from the lines before them have been sent
+	Progress Progress
+}
+
+// context returns the Context reading stops with
+func (c Config) context() context.Context {
+	if c.Context == nil {
+		return context.Background()
+	}
+	return c.Context
+}
+
+// Progress lets followers find out when the events made from the lines
+// they've read have been sent. checkpoint.Tracker implements it.
+type Progress interface {
+	// Mark returns a position covering every event the parsers have
+	// finished sending so far, including any held by stages after them
+	Mark() uint64
+	// Reached reports whether every event up to mark has been sent
+	Reached(mark uint64) bool
+	// OnFinish registers a function to call once every event has been
+	// sent or failed to send
+	OnFinish(f func())
 }
 
 // State is what's stored in a statefile
@@ -97,183 +147,197 @@ func shouldSample(sampleRate int) bool {
 	return false
 }
 
+// FileEntries is the stream of lines read from a single file
+type FileEntries struct {
+	// Path of the file the lines came from, or "-" for STDIN
+	Path  string
+	Lines chan string
+	// Fields are added to every event parsed from these lines
+	Fields map[string]interface{}
+}
+
 // GetEntries opens the log file, reading from the end. It sends one line
 // at a time down the returned channel
 func GetEntries(conf Config) (chan string, error) {
-	if conf.Type != RotateStyleSyslog {
-		return nil, errors.New("Only Syslog style rotation currently supported")
+	files, err := GetEntriesByFile(conf)
+	if err != nil {
+		return nil, err
 	}
 	lines := make(chan string)
 	var wg sync.WaitGroup
-	defer func() {
-		go func() {
-			wg.Wait()
-			close(lines)
-		}()
-	}()
-	// handle reading from STDIN
-	if conf.Paths[0] == "-" {
-		return lines, tailStdIn(lines, &wg)
-	}
-	for _, filePath := range conf.Paths {
-		if err := tailMultipleFiles(conf, filePath, lines, &wg); err != nil {
-			return nil, err
-		}
+	for _, file := range files {
+		wg.Add(1)
+		go func(fileLines chan string) {
+			defer wg.Done()
+			for line := range fileLines {
+				lines <- line
+			}
+		}(file.Lines)
 	}
 	// close lines when all processors are done
-
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
 	return lines, nil
 }
 
-func tailMultipleFiles(conf Config, filePath string, lines chan string, wg *sync.WaitGroup) error {
-	files, err := filepath.Glob(filePath)
+// GetEntriesByFile is like GetEntries but keeps the lines from each file
+// (after expanding globs) on a channel of their own
+func GetEntriesByFile(conf Config) ([]FileEntries, error) {
+	entries, _, err := getEntriesByFile(conf)
+	return entries, err
+}
+
+// getEntriesByFile also returns the watcher following the files, or nil when
+// reading STDIN
+func getEntriesByFile(conf Config) ([]FileEntries, *watcher, error) {
+	if conf.Type != RotateStyleSyslog {
+		return nil, nil, errors.New("Only Syslog style rotation currently supported")
+	}
+	joiner, err := newJoiner(conf.Options)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	for _, file := range files {
-		var realStateFile string
-		if conf.Options.StateFile == "" {
-			// force statefile to match globbed file
-			baseName := strings.TrimSuffix(file, ".log")
-			realStateFile = baseName + ".leash.state"
-		}
-		if err := tailSingleFile(conf, file, realStateFile, lines, wg); err != nil {
-			return err
-		}
+	// check the options for reading lines here, rather than for each file
+	if _, err := newLineBuilder(conf.Options); err != nil {
+		return nil, nil, err
+	}
+	// handle reading from STDIN
+	if conf.Paths[0] == "-" {
+		return []FileEntries{{Path: "-", Lines: joiner.join(stopOn(conf.context(), tailStdIn(conf.Options)), nil)}}, nil, nil
+	}
+	store, err := newStateStore(conf.Options)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter, err := newFileFilter(conf.Options)
+	if err != nil {
+		store.close()
+		return nil, nil, err
+	}
+	w := newWatcher(conf, store, joiner, filter)
+	entries, err := w.scan(false)
+	if err != nil {
+		w.stopAll()
+		store.close()
+		return nil, nil, err
+	}
+	// with progress, the last states are saved once sending finishes, and
+	// are flushed as they're saved even after the store is closed
+	if conf.Progress != nil {
+		conf.Progress.OnFinish(store.close)
+	} else {
+		go func() {
+			<-w.ctx.Done()
+			store.close()
+		}()
 	}
-	return nil
+	return entries, w, nil
 }
 
-func tailSingleFile(conf Config, file string, stateFile string, lines chan string, wg *sync.WaitGroup) error {
-	// TODO report some metric to indicate whether we're keeping up with the
-	// front of the file, of if it's being written faster than we can send
-	// events
-
+// tailSingleFile follows file until ctx is done, returning its lines.
+// discovered files appeared after we started, so everything in
+// them is new and they're read from the beginning unless there's saved state.
+func tailSingleFile(ctx context.Context, conf Config, file string, store stateStore, discovered bool) (chan string, error) {
 	// tail a real file
-	var loc *tail.SeekInfo // 0 value means start at beginning
-	var reOpen, follow bool = true, true
+	var loc *location // nil means start at beginning
 	switch conf.Options.ReadFrom {
 	case "start", "beginning":
-		// 0 value for tail.SeekInfo means start at beginning
 	case "end":
-		loc = &tail.SeekInfo{
-			Offset: 0,
-			Whence: 2,
+		if !discovered {
+			loc = &location{offset: 0, whence: io.SeekEnd}
 		}
 	case "last":
-		loc = getStartLocation(stateFile, file)
+		if _, err := store.load(file); err == nil || !discovered {
+			loc = getStartLocation(store, file)
+		}
 	default:
-		errMsg := fmt.Sprintf("unknown option to --read_from: %s",
-			conf.Options.ReadFrom)
-		return errors.New(errMsg)
-	}
-	if conf.Options.Stop {
-		reOpen = false
-		follow = false
-	}
-	tailConf := tail.Config{
-		Location:  loc,
-		ReOpen:    reOpen, // keep reading on rotation, aka tail -F
-		MustExist: true,   // fail if log file doesn't exist
-		Follow:    follow, // don't stop at EOF, aka tail -f
-		Logger:    logrus.New(),
-		Poll:      conf.Options.Poll, // use poll instead of inotify
+		lastLines, err := LastLines(conf.Options)
+		if err != nil {
+			return nil, err
+		}
+		if lastLines > 0 {
+			if discovered {
+				break
+			}
+			offset, err := lastLinesOffset(file, lastLines)
+			if err != nil {
+				return nil, err
+			}
+			loc = &location{offset: offset, whence: io.SeekStart}
+			break
+		}
+		from, _, err := TimeWindow(conf.Options)
+		if err != nil {
+			return nil, err
+		}
+		if from.IsZero() {
+			errMsg := fmt.Sprintf("unknown option to --read_from: %s",
+				conf.Options.ReadFrom)
+			return nil, errors.New(errMsg)
+		}
+		offset, err := findTime(file, from)
+		if err != nil {
+			return nil, err
+		}
+		loc = &location{offset: offset, whence: io.SeekStart}
 	}
 	logrus.WithFields(logrus.Fields{
-		"tailConf":  tailConf,
-		"conf":      conf,
-		"statefile": stateFile,
-		"location":  loc,
-	}).Debug("about to call tail.TailFile")
-	t, err := tail.TailFile(file, tailConf)
-	logrus.WithFields(logrus.Fields{"tail": t}).Debug("finished call to TailFile")
+		"file":     file,
+		"conf":     conf,
+		"location": loc,
+	}).Debug("about to follow file")
+	f, err := followFile(ctx, file, loc, conf.Options, store, conf.Progress)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// TODO this only updates once/sec. On clean shutdown, make sure we write
-	// one last time after stopping reading traffic.
-	go updateStateFile(t, stateFile, file)
-	wg.Add(1)
-	go func() {
-		for line := range t.Lines {
-			if line.Err != nil {
-				// skip errored lines
-				continue
-			}
-			lines <- line.Text
-		}
-		wg.Done()
-	}()
-	return nil
+	return f.joiner.join(f.lines, f.joined), nil
 }
 
 // tailStdIn is a special case to tail STDIN without any of the
 // fancy stuff that the tail module provides
-func tailStdIn(lines chan string, wg *sync.WaitGroup) error {
-	input := bufio.NewReader(os.Stdin)
-	wg.Add(1)
+func tailStdIn(options TailOptions) chan string {
+	lines := make(chan string)
 	go func() {
-		defer wg.Done()
-		for {
-			line, partialLine, err := input.ReadLine()
-			if err != nil {
-				logrus.Debug("stdin is closed")
-				// bail when STDIN closes
-				return
-			}
-			var parts []string
-			parts = append(parts, string(line))
-			for partialLine {
-				line, partialLine, _ = input.ReadLine()
-				parts = append(parts, string(line))
-			}
-			lines <- strings.Join(parts, "")
+		defer close(lines)
+		// compressed input is decompressed on the way through, so that eg
+		// `zcat` isn't needed in front of honeytail
+		input, err := decompress(bufio.NewReader(os.Stdin))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"err": err}).Error("failed to decompress stdin")
+			return
 		}
+		b, _ := newLineBuilder(options)
+		readLines(bufio.NewReader(input), lines, b)
+		// bail when STDIN closes
+		logrus.Debug("stdin is closed")
 	}()
-	return nil
+	return lines
 }
 
-// getStartLocation reads the state file and creates an appropriate start
+// getStartLocation reads the saved state and creates an appropriate start
 // location.  See details at the top of this file on how the loc is chosen.
-func getStartLocation(stateFile string, logfile string) *tail.SeekInfo {
-	beginning := &tail.SeekInfo{}
-	end := &tail.SeekInfo{0, 2}
-	fh, err := os.Open(stateFile)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to open the statefile")
-		return end
-	}
-	defer fh.Close()
-	// read the contents of the state file (JSON)
-	content := make([]byte, 1024)
-	bytesRead, err := fh.Read(content)
+func getStartLocation(store stateStore, logfile string) *location {
+	beginning := &location{}
+	end := &location{offset: 0, whence: io.SeekEnd}
+	state, err := store.load(logfile)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to read the statefile contents")
-		return end
-	}
-	content = content[:bytesRead]
-	// decode the contents of the statefile
-	state := State{}
-	if err := json.Unmarshal(content, &state); err != nil {
-		logrus.WithFields(logrus.Fields{
-			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to json decode the statefile")
+		}).Debug("getStartLocation failed to read the saved state")
 		return end
 	}
 	// get the details of the existing log file
-	logStat := unix.Stat_t{}
-	if err := unix.Stat(logfile, &logStat); err != nil {
+	inode, err := INode(logfile)
+	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"starting at": "end", "error": err,
-		}).Debug("getStartLocation failed to get unix.stat() on the logfile")
+		}).Debug("getStartLocation failed to get the inode of the logfile")
 		return end
 	}
 	// compare inode numbers of the last-seen and existing log files
-	if state.INode != logStat.Ino {
+	if state.INode != inode {
 		logrus.WithFields(logrus.Fields{
 			"starting at": "beginning", "error": err,
 		}).Debug("getStartLocation found a different inode number for the logfile")
@@ -284,41 +348,30 @@ func getStartLocation(stateFile string, logfile string) *tail.SeekInfo {
 		"starting at": state.Offset,
 	}).Debug("getStartLocation seeking to offset in logfile")
 	// we're good; start reading from the remembered state
-	return &tail.SeekInfo{
-		Offset: state.Offset,
-		Whence: 0,
-	}
+	return &location{offset: state.Offset, whence: io.SeekStart}
 }
 
-// updateStateFile updates the state file once per second with the current
-// values for the logfile's inode number and offset
-func updateStateFile(t *tail.Tail, stateFile string, file string) {
-	statefh, err := os.OpenFile(stateFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"logfile":   file,
-			"statefile": stateFile,
-		}).Warn("Failed to open statefile for writing. File location will not be saved.")
-		return
+// stopOn passes lines on until ctx is done, then closes the returned
+// channel. It's for inputs that can't otherwise be stopped part way through.
+func stopOn(ctx context.Context, lines chan string) chan string {
+	done := ctx.Done()
+	if done == nil {
+		return lines
 	}
-	ticker := time.NewTicker(time.Second)
-	state := State{}
-	for _ = range ticker.C {
-		logStat := unix.Stat_t{}
-		unix.Stat(file, &logStat)
-		currentPos, err := t.Tell()
-		if err != nil {
-			continue
-		}
-		state.INode = logStat.Ino
-		state.Offset = currentPos
-		out, err := json.Marshal(state)
-		if err != nil {
-			continue
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				out <- line
+			case <-done:
+				return
+			}
 		}
-		statefh.Truncate(0)
-		out = append(out, '\n')
-		statefh.WriteAt(out, 0)
-		statefh.Sync()
-	}
+	}()
+	return out
 }
@@ -0,0 +1,253 @@
+package tail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// WatchFiles is like GetEntriesByFile, but keeps re-expanding the globs in
+// conf.Paths every --tail.rescan_interval seconds. Files that appear are sent
+// down the returned channel as they're found, and files that have been
+// deleted stop being tailed. The channel is closed once no more files can
+// appear: straight away when reading STDIN, with --tail.stop, or with
+// rescanning disabled, and otherwise once conf.Context is done.
+func WatchFiles(conf Config) (chan FileEntries, error) {
+	initial, w, err := getEntriesByFile(conf)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(chan FileEntries)
+	go func() {
+		defer close(entries)
+		for _, entry := range initial {
+			entries <- entry
+		}
+		if w == nil {
+			return
+		}
+		if conf.Options.Stop || conf.Options.Rescan <= 0 {
+			return
+		}
+		ticker := time.NewTicker(time.Duration(conf.Options.Rescan) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-w.ctx.Done():
+				return
+			}
+			found, _ := w.scan(true)
+			for _, entry := range found {
+				entries <- entry
+			}
+		}
+	}()
+	return entries, nil
+}
+
+// watcher keeps track of the files being tailed for a set of globs
+type watcher struct {
+	conf   Config
+	store  stateStore
+	joiner *joiner
+	filter *fileFilter
+
+	// ctx is done once reading has been stopped, which stops every file
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock sync.Mutex
+	// following holds the files being tailed, by path
+	following map[string]*followedFile
+	// inodes maps every inode seen at a followed path to that path, so that
+	// a file renamed by log rotation to another path matching the glob, or
+	// reached through a symlink as well as by its own name, isn't read twice.
+	// They're forgotten once no matching path has them or their path stops
+	// being followed, so a new file that reuses one is read.
+	inodes map[uint64]string
+}
+
+type followedFile struct {
+	// stop stops tailing the file, or is nil for files that are read once
+	stop func()
+	// missed counts consecutive scans the file was missing from
+	missed int
+}
+
+func newWatcher(conf Config, store stateStore, joiner *joiner, filter *fileFilter) *watcher {
+	ctx, cancel := context.WithCancel(conf.context())
+	return &watcher{
+		ctx:       ctx,
+		cancel:    cancel,
+		conf:      conf,
+		store:     store,
+		joiner:    joiner,
+		filter:    filter,
+		following: make(map[string]*followedFile),
+		inodes:    make(map[uint64]string),
+	}
+}
+
+// scan expands the globs and starts tailing any files not already being
+// tailed. discovered is true for every scan after the first, when new files
+// are read from the beginning. On the first scan a file that can't be tailed
+// is an error; later, it's logged and tried again next time.
+func (w *watcher) scan(discovered bool) ([]FileEntries, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.ctx.Err() != nil {
+		return nil, nil
+	}
+	// a followed symlink may point somewhere new since the last scan
+	for file := range w.following {
+		if inode, err := INode(file); err == nil {
+			w.inodes[inode] = file
+		}
+	}
+	globbed := make([][]string, len(w.conf.Paths))
+	present := make(map[uint64]bool)
+	for i, pattern := range w.conf.Paths {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if inode, err := INode(file); err == nil {
+				present[inode] = true
+			}
+		}
+		globbed[i] = symlinksFirst(files)
+	}
+	for inode := range w.inodes {
+		if !present[inode] {
+			delete(w.inodes, inode)
+		}
+	}
+	matched := make(map[string]bool)
+	var entries []FileEntries
+	for _, files := range globbed {
+		for _, file := range files {
+			matched[file] = true
+			if f, ok := w.following[file]; ok {
+				f.missed = 0
+				continue
+			}
+			if reason := w.filter.skip(file); reason != "" {
+				logrus.WithFields(logrus.Fields{
+					"file":   file,
+					"reason": reason,
+				}).Debug("Skipping file")
+				continue
+			}
+			inode, inodeErr := INode(file)
+			if _, seen := w.inodes[inode]; inodeErr == nil && seen {
+				// a rotated copy of a file we've already read, or the
+				// file a followed symlink points to
+				continue
+			}
+			entry, stop, err := w.start(file, discovered)
+			if err != nil {
+				if !discovered {
+					return nil, err
+				}
+				logrus.WithFields(logrus.Fields{
+					"file":  file,
+					"error": err,
+				}).Warn("Failed to start tailing new file. Will try again.")
+				continue
+			}
+			if discovered {
+				logrus.WithFields(logrus.Fields{"file": file}).Info("Tailing new file")
+			}
+			w.following[file] = &followedFile{stop: stop}
+			if inodeErr == nil {
+				w.inodes[inode] = file
+			}
+			entries = append(entries, entry)
+		}
+	}
+	for file, f := range w.following {
+		if matched[file] {
+			continue
+		}
+		if _, err := os.Stat(file); err == nil {
+			continue
+		}
+		// log rotation briefly leaves no file at the path, so only give up
+		// on files that stay gone for a whole rescan
+		f.missed++
+		if f.missed < 2 {
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"file": file}).Info("File deleted; no longer tailing it")
+		if f.stop != nil {
+			f.stop()
+		}
+		delete(w.following, file)
+		for inode, path := range w.inodes {
+			if path == file {
+				delete(w.inodes, inode)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// symlinksFirst returns files with any symlinks moved to the front. Following
+// a link like current, rather than the file it points to today, carries on
+// through rotations that point it at a new file.
+func symlinksFirst(files []string) []string {
+	var links, others []string
+	for _, file := range files {
+		if info, err := os.Lstat(file); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			links = append(links, file)
+		} else {
+			others = append(others, file)
+		}
+	}
+	return append(links, others...)
+}
+
+// stopAll stops reading every file
+func (w *watcher) stopAll() {
+	w.cancel()
+}
+
+// start begins reading file
+func (w *watcher) start(file string, discovered bool) (FileEntries, func(), error) {
+	var lines chan string
+	var stop context.CancelFunc
+	var err error
+	switch {
+	case isFIFO(file):
+		// check for pipes first; looking inside one to see if it's
+		// compressed would wait for a writer
+		lines = w.joiner.join(readFIFO(file, w.conf.Options), nil)
+	case isCompressed(file):
+		lines, err = readCompressedFile(file, w.conf.Options)
+		lines = w.joiner.join(lines, nil)
+	default:
+		// each followed file has its own context, so it can be stopped
+		// once it's deleted. Its lines are joined as it reads them, so it
+		// knows which have reached the parser.
+		var ctx context.Context
+		ctx, stop = context.WithCancel(w.ctx)
+		lines, err = tailSingleFile(ctx, w.conf, file, w.store, discovered)
+	}
+	if err != nil {
+		if stop != nil {
+			stop()
+		}
+		return FileEntries{}, nil, err
+	}
+	if stop == nil {
+		// anything read once is read to the end unless it's all stopped
+		lines = stopOn(w.ctx, lines)
+	}
+	return FileEntries{Path: file, Lines: lines}, stop, nil
+}
@@ -0,0 +1,169 @@
+package tail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcherScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.log"), []byte("old line\n"), 0644)
+
+	conf := Config{
+		Paths: []string{filepath.Join(dir, "*.log")},
+		Options: TailOptions{
+			ReadFrom: "end",
+			StateDir: dir,
+		},
+	}
+	store, _ := newStateStore(conf.Options)
+	w := newWatcher(conf, store, nil, &fileFilter{})
+	entries, err := w.scan(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected a.log to be tailed, got %+v", entries)
+	}
+	a := entries[0]
+
+	// a file created after startup is read from its beginning, even though
+	// we were asked to start at the end
+	ioutil.WriteFile(filepath.Join(dir, "b.log"), []byte("first line\n"), 0644)
+	entries, _ = w.scan(true)
+	if len(entries) != 1 || entries[0].Path != filepath.Join(dir, "b.log") {
+		t.Fatalf("expected only b.log to be new, got %+v", entries)
+	}
+	select {
+	case line := <-entries[0].Lines:
+		if line != "first line" {
+			t.Errorf("expected the first line of b.log, got %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for b.log's first line")
+	}
+
+	// a rotated copy of a file we're tailing isn't read again
+	os.Rename(filepath.Join(dir, "a.log"), filepath.Join(dir, "a.1.log"))
+	entries, _ = w.scan(true)
+	if len(entries) != 0 {
+		t.Errorf("expected the rotated file to be skipped, got %+v", entries)
+	}
+
+	// a.log is gone for two scans in a row, so it stops being tailed
+	if _, err := w.scan(true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-a.Lines:
+		if ok {
+			t.Error("expected no lines from a.log")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a.log to stop being tailed")
+	}
+}
+
+func TestWatcherSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "app-20160801.log")
+	ioutil.WriteFile(target, []byte("line\n"), 0644)
+	link := filepath.Join(dir, "current.log")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("can't create symlinks here:", err)
+	}
+
+	// the link and the file it points to both match, but the file is only
+	// read once, through the link
+	conf := Config{
+		Paths:   []string{filepath.Join(dir, "*.log")},
+		Options: TailOptions{ReadFrom: "beginning", StateDir: dir},
+	}
+	store, _ := newStateStore(conf.Options)
+	w := newWatcher(conf, store, nil, &fileFilter{})
+	defer w.stopAll()
+	entries, err := w.scan(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != link {
+		t.Fatalf("expected only the link to be tailed, got %+v", entries)
+	}
+
+	// once the link moves on to a new file, that file isn't read again by
+	// its own name either
+	next := filepath.Join(dir, "app-20160802.log")
+	ioutil.WriteFile(next, []byte("line\n"), 0644)
+	os.Remove(link)
+	os.Symlink(next, link)
+	entries, _ = w.scan(true)
+	if len(entries) != 0 {
+		t.Errorf("expected the link's new file to be skipped, got %+v", entries)
+	}
+}
+
+func TestWatcherForgetsInodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := filepath.Join(dir, "a.log")
+	ioutil.WriteFile(a, []byte("line\n"), 0644)
+	conf := Config{
+		Paths:   []string{filepath.Join(dir, "*.log")},
+		Options: TailOptions{ReadFrom: "beginning", StateDir: dir},
+	}
+	store, _ := newStateStore(conf.Options)
+	w := newWatcher(conf, store, nil, &fileFilter{})
+	defer w.stopAll()
+	if _, err := w.scan(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// b.log reuses the inode a.log had, as if a.log was deleted and b.log
+	// created before the next scan
+	os.Remove(a)
+	b := filepath.Join(dir, "b.log")
+	ioutil.WriteFile(b, []byte("line\n"), 0644)
+	inode, err := INode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.lock.Lock()
+	w.inodes[inode] = a
+	w.lock.Unlock()
+	// it looks like a rotated copy while a.log may still come back
+	if entries, _ := w.scan(true); len(entries) != 0 {
+		t.Errorf("expected b.log to be skipped while a.log is followed, got %+v", entries)
+	}
+	// once a.log stops being followed, its inodes are forgotten
+	w.scan(true)
+	entries, _ := w.scan(true)
+	if len(entries) != 1 || entries[0].Path != b {
+		t.Errorf("expected b.log to be read once a.log was given up on, got %+v", entries)
+	}
+
+	// an inode no matching path has any more is forgotten too
+	w.lock.Lock()
+	w.inodes[inode+1] = b
+	w.lock.Unlock()
+	w.scan(true)
+	w.lock.Lock()
+	_, remembered := w.inodes[inode+1]
+	w.lock.Unlock()
+	if remembered {
+		t.Error("expected an inode no file has to be forgotten")
+	}
+}
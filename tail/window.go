@@ -0,0 +1,138 @@
+package tail
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+)
+
+// stopAtSlack is how far past --tail.stop_at a line's time must be before we
+// stop reading the file, so that lines written slightly out of order near
+// the end of the window aren't missed. leash drops the events past the
+// window exactly.
+const stopAtSlack = time.Minute
+
+// searchResolution is how close the search for --tail.read_from's time gets
+// before it starts reading lines
+const searchResolution = 64 * 1024
+
+// TimeWindow returns the times given with --tail.read_from and
+// --tail.stop_at. Either is zero if not given as a time.
+func TimeWindow(options TailOptions) (time.Time, time.Time, error) {
+	var from, to time.Time
+	if t, err := time.Parse(time.RFC3339, options.ReadFrom); err == nil {
+		from = t
+	}
+	if options.StopAt != "" {
+		t, err := time.Parse(time.RFC3339, options.StopAt)
+		if err != nil {
+			return from, to, fmt.Errorf("--tail.stop_at must be a time like 2016-08-01T00:00:00Z: %s", err)
+		}
+		to = t
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, fmt.Errorf("--tail.read_from %s is not before --tail.stop_at %s", options.ReadFrom, options.StopAt)
+	}
+	return from, to, nil
+}
+
+// lineTimeFormats are the timestamps we can find in a line without knowing
+// which parser it's for. The regex finds the timestamp and the layouts parse
+// it; times without a zone are taken to be UTC.
+var lineTimeFormats = []struct {
+	re      *regexp.Regexp
+	layouts []string
+}{
+	{
+		regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`),
+		[]string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999Z0700", "2006-01-02 15:04:05.999999999Z07:00",
+			"2006-01-02 15:04:05.999999999Z0700", "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999"},
+	},
+	{
+		// common log format, as used by nginx and apache
+		regexp.MustCompile(`\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}`),
+		[]string{"02/Jan/2006:15:04:05 -0700"},
+	},
+}
+
+// lineTime returns the first timestamp found in line
+func lineTime(line string) (time.Time, bool) {
+	for _, format := range lineTimeFormats {
+		match := format.re.FindString(line)
+		if match == "" {
+			continue
+		}
+		// some loggers separate milliseconds with a comma
+		if i := len("2006-01-02 15:04:05"); len(match) > i && match[i] == ',' {
+			match = match[:i] + "." + match[i+1:]
+		}
+		for _, layout := range format.layouts {
+			if t, err := time.Parse(layout, match); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// findTime binary searches path, assumed to be in time order, for a line
+// shortly before the first line at or after from. It returns the offset of
+// the start of that line, or 0 if the lines have no times we recognise.
+func findTime(path string, from time.Time) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	lo, hi := int64(0), info.Size()
+	for hi-lo > searchResolution {
+		mid := lo + (hi-lo)/2
+		start, t, ok := timeAfter(file, mid)
+		if !ok || start >= hi {
+			// nothing to go on between mid and hi; narrow from the top
+			hi = mid
+			continue
+		}
+		if t.Before(from) {
+			lo = start
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// timeAfter returns the start and time of the first line with a time that
+// starts after offset
+func timeAfter(file *os.File, offset int64) (int64, time.Time, bool) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, time.Time{}, false
+	}
+	reader := bufio.NewReader(file)
+	// skip the rest of the line offset is in the middle of
+	skipped, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	start := offset + int64(len(skipped))
+	// give up after a few lines so a long run of lines without times (eg a
+	// stack trace) doesn't read the whole file
+	for i := 0; i < 32; i++ {
+		line, err := reader.ReadString('\n')
+		if t, ok := lineTime(line); ok {
+			return start, t, true
+		}
+		if err != nil {
+			break
+		}
+		start += int64(len(line))
+	}
+	return 0, time.Time{}, false
+}
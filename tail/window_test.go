@@ -0,0 +1,121 @@
+package tail
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineTime(t *testing.T) {
+	tsts := []struct {
+		line     string
+		expected string
+	}{
+		{`{"time":"2016-08-01T12:00:00Z","msg":"hi"}`, "2016-08-01T12:00:00Z"},
+		{`2016-08-01 12:00:00,123 ERROR app failed`, "2016-08-01T12:00:00.123Z"},
+		{`2016-08-01T12:00:00.5-07:00 info`, "2016-08-01T19:00:00.5Z"},
+		{`10.0.0.1 - - [01/Aug/2016:12:00:00 +0100] "GET / HTTP/1.1" 200`, "2016-08-01T11:00:00Z"},
+	}
+	for _, tt := range tsts {
+		actual, ok := lineTime(tt.line)
+		if !ok {
+			t.Errorf("expected a time in %q", tt.line)
+			continue
+		}
+		if actual.UTC().Format(time.RFC3339Nano) != tt.expected {
+			t.Errorf("%q: expected %s, got %s", tt.line, tt.expected, actual.UTC().Format(time.RFC3339Nano))
+		}
+	}
+	if _, ok := lineTime("        at com.example.App.main(App.java:10)"); ok {
+		t.Error("expected no time in a stack frame")
+	}
+}
+
+func TestFindTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "window")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	fh, _ := os.Create(path)
+	start := time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC)
+	w := bufio.NewWriter(fh)
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(w, `{"time":"%s","n":%d,"pad":"%s"}`+"\n", start.Add(time.Duration(i)*time.Second).Format(time.RFC3339), i, strings.Repeat("x", 40))
+	}
+	w.Flush()
+	fh.Close()
+
+	from := start.Add(15000 * time.Second)
+	offset, err := findTime(path, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(path)
+	if offset > 0 && contents[offset-1] != '\n' {
+		t.Errorf("expected offset %d to be the start of a line", offset)
+	}
+	first, _ := lineTime(string(contents[offset:]))
+	if first.After(from) {
+		t.Errorf("expected to start at or before %s, started at %s", from, first)
+	}
+	if from.Sub(first) > 30*time.Minute {
+		t.Errorf("expected to start close to %s, started at %s", from, first)
+	}
+
+	// lines without times can't be searched, so are read from the start
+	ioutil.WriteFile(path, []byte(strings.Repeat("no time here\n", 10000)), 0644)
+	if offset, _ := findTime(path, from); offset != 0 {
+		t.Errorf("expected to start from the beginning, got %d", offset)
+	}
+}
+
+func TestFollowStopAt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "window")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(path, []byte(`2016-08-01T00:00:00Z one
+2016-08-01T00:00:30Z two
+  continued
+2016-08-01T00:02:00Z three
+`), 0644)
+	f, err := followFile(context.Background(), path, nil, TailOptions{StopAt: "2016-08-01T00:00:00Z"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for line := range f.lines {
+		lines = append(lines, line)
+	}
+	// lines just past stop_at are still read; leash drops their events
+	expected := []string{"2016-08-01T00:00:00Z one", "2016-08-01T00:00:30Z two", "  continued"}
+	if fmt.Sprint(lines) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, lines)
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	from, to, err := TimeWindow(TailOptions{ReadFrom: "2016-08-01T00:00:00Z", StopAt: "2016-08-02T00:00:00Z"})
+	if err != nil || from.Day() != 1 || to.Day() != 2 {
+		t.Errorf("unexpected window %s - %s, %v", from, to, err)
+	}
+	if from, to, err := TimeWindow(TailOptions{ReadFrom: "last"}); err != nil || !from.IsZero() || !to.IsZero() {
+		t.Errorf("expected no window, got %s - %s, %v", from, to, err)
+	}
+	if _, _, err := TimeWindow(TailOptions{ReadFrom: "2016-08-02T00:00:00Z", StopAt: "2016-08-01T00:00:00Z"}); err == nil {
+		t.Error("expected an error for a window that ends before it starts")
+	}
+	if _, _, err := TimeWindow(TailOptions{StopAt: "tomorrow"}); err == nil {
+		t.Error("expected an error for a bad stop_at")
+	}
+}
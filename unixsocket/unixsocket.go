@@ -0,0 +1,222 @@
+// Package unixsocket implements receiving log lines on a unix domain socket.
+//
+// unixsocket listens on a stream or datagram socket and provides a channel on
+// which each received line will be sent as a string, the same way the tail
+// package does for lines of a file. It lets applications on the same host
+// hand log lines to honeytail without writing them to disk first.
+package unixsocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// URL schemes accepted as a --file argument
+const (
+	streamScheme   = "unix://"
+	datagramScheme = "unixgram://"
+)
+
+type Options struct {
+	Mode            string `long:"mode" description:"Permissions to set on the socket file, in octal" default:"0666"`
+	MaxMessageBytes int    `long:"max_message_bytes" description:"Largest line or datagram accepted; longer ones are truncated" default:"65536"`
+}
+
+// IsUnixSocketURL returns true if path names a unix socket to listen on
+// rather than a file
+func IsUnixSocketURL(path string) bool {
+	return strings.HasPrefix(path, streamScheme) || strings.HasPrefix(path, datagramScheme)
+}
+
+// GetEntries starts listening on the socket in url (eg
+// unix:///var/run/honeytail.sock for a stream socket or
+// unixgram:///var/run/honeytail.sock for a datagram socket). It sends one
+// line at a time down the returned channel. Once ctx is done, it stops
+// listening and closes the connections it's reading from, and then the
+// channel.
+func GetEntries(ctx context.Context, url string, options Options) (chan string, error) {
+	if options.MaxMessageBytes <= 0 {
+		options.MaxMessageBytes = 65536
+	}
+	mode, err := strconv.ParseUint(options.Mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --unix.mode %q: %s", options.Mode, err)
+	}
+	network, path := "unix", strings.TrimPrefix(url, streamScheme)
+	if strings.HasPrefix(url, datagramScheme) {
+		network, path = "unixgram", strings.TrimPrefix(url, datagramScheme)
+	}
+	if path == "" {
+		return nil, errors.New("unix socket url must include a path, eg unix:///var/run/honeytail.sock")
+	}
+	// a socket left behind by an earlier run would stop us from listening
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	lines := make(chan string)
+	// readers waits for the socket and its connections to be closed
+	var readers sync.WaitGroup
+	closeWhenRead := func() {
+		go func() {
+			readers.Wait()
+			close(lines)
+		}()
+	}
+	if network == "unixgram" {
+		conn, err := net.ListenPacket(network, path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{"path": path}).Info("listening on unix datagram socket")
+		readers.Add(1)
+		go readDatagrams(ctx, conn, lines, options, &readers)
+		closeWhenRead()
+		return lines, nil
+	}
+	listener, err := net.Listen(network, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{"path": path}).Info("listening on unix stream socket")
+	readers.Add(1)
+	go acceptStreams(ctx, listener, lines, options, &readers)
+	closeWhenRead()
+	return lines, nil
+}
+
+// readDatagrams sends each line of each datagram received on conn to lines,
+// until ctx is done
+func readDatagrams(ctx context.Context, conn net.PacketConn, lines chan string, options Options, readers *sync.WaitGroup) {
+	defer readers.Done()
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, options.MaxMessageBytes)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Error("unix datagram socket failed")
+			}
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimRight(line, "\r\x00"); line != "" {
+				if !send(ctx, lines, line) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// acceptStreams reads lines from each connection made to listener, until ctx
+// is done
+func acceptStreams(ctx context.Context, listener net.Listener, lines chan string, options Options, readers *sync.WaitGroup) {
+	defer readers.Done()
+	defer listener.Close()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logrus.WithFields(logrus.Fields{"err": err}).Error("unix stream socket failed")
+			}
+			return
+		}
+		readers.Add(1)
+		go readStream(ctx, conn, lines, options, readers)
+	}
+}
+
+// readStream sends each line received on conn to lines. The connection is
+// closed once ctx is done.
+func readStream(ctx context.Context, conn net.Conn, lines chan string, options Options, readers *sync.WaitGroup) {
+	defer readers.Done()
+	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-closed:
+		}
+	}()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), options.MaxMessageBytes)
+	scanner.Split(truncatingLines(options.MaxMessageBytes))
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			if !send(ctx, lines, line) {
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		logrus.WithFields(logrus.Fields{"err": err}).Debug("closing unix socket connection")
+	}
+}
+
+// send sends line to lines, unless ctx is done first. It returns false if it
+// was.
+func send(ctx context.Context, lines chan string, line string) bool {
+	select {
+	case lines <- line:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// truncatingLines is bufio.ScanLines, except that a line longer than maxBytes
+// is cut off at maxBytes and the rest of it discarded rather than failing the
+// whole connection
+func truncatingLines(maxBytes int) bufio.SplitFunc {
+	discarding := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if err != nil || advance > 0 {
+			if discarding {
+				discarding = false
+				return advance, nil, err
+			}
+			if len(token) > maxBytes {
+				token = token[:maxBytes]
+			}
+			return advance, token, err
+		}
+		if len(data) >= maxBytes {
+			// the buffer is full without a newline in sight
+			if discarding {
+				return len(data), nil, nil
+			}
+			discarding = true
+			return len(data), data[:maxBytes], nil
+		}
+		return 0, nil, nil
+	}
+}
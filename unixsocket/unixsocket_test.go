@@ -0,0 +1,88 @@
+package unixsocket
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, lines chan string, n int) []string {
+	var received []string
+	for i := 0; i < n; i++ {
+		select {
+		case line := <-lines:
+			received = append(received, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for line %d", i+1)
+		}
+	}
+	return received
+}
+
+func TestGetEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unixsocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tsts := []struct {
+		scheme  string
+		network string
+	}{
+		{"unix://", "unix"},
+		{"unixgram://", "unixgram"},
+	}
+	for _, tt := range tsts {
+		path := filepath.Join(dir, tt.network+".sock")
+		ctx, cancel := context.WithCancel(context.Background())
+		lines, err := GetEntries(ctx, tt.scheme+path, Options{Mode: "0600", MaxMessageBytes: 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: expected socket with mode 0600, got %v (%v)", tt.network, info, err)
+		}
+		conn, err := net.Dial(tt.network, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("first\nsecond\r\n"))
+		if tt.network == "unix" {
+			conn.Write([]byte(strings.Repeat("x", 40) + "\nthird\n"))
+		}
+		conn.Close()
+
+		expected := []string{"first", "second"}
+		if tt.network == "unix" {
+			expected = append(expected, strings.Repeat("x", 16), "third")
+		}
+		if actual := receive(t, lines, len(expected)); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: expected %q, got %q", tt.network, expected, actual)
+		}
+
+		// once ctx is done, the socket stops listening
+		cancel()
+		for i := 0; ; i++ {
+			if tt.network == "unixgram" {
+				break
+			}
+			conn, err := net.Dial(tt.network, path)
+			if err != nil {
+				break
+			}
+			conn.Close()
+			if i == 100 {
+				t.Errorf("%s: expected the socket to stop listening once ctx was done", tt.network)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
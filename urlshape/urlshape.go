@@ -0,0 +1,132 @@
+// Package urlshape breaks request URLs down into their path, query and
+// shape: the path and query with the parts that vary from request to request
+// replaced with placeholders, so that requests for the same endpoint can be
+// grouped together.
+package urlshape
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const placeholder = "?"
+
+// reVarying matches path segments that are most likely ids: numbers, UUIDs
+// and long runs of hex
+var reVarying = regexp.MustCompile(`^(?:[0-9]+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// Shaper shapes requests, using the patterns it was given for paths they
+// match
+type Shaper struct {
+	patterns []pattern
+	drop     map[string]bool
+}
+
+// pattern is a path like /orders/:id, with :name for segments that vary
+type pattern struct {
+	raw      string
+	segments []string
+}
+
+// Shaped is a request broken down
+type Shaped struct {
+	// Path is the request's path, and Query its query string
+	Path  string
+	Query string
+	// Shape is the path and query with the parts that vary replaced
+	Shape string
+	// QueryParams are the query's parameters
+	QueryParams url.Values
+	// PathParams are the segments matching the :names in the pattern the
+	// path matched, if any
+	PathParams map[string]string
+}
+
+// NewShaper returns a shaper using patterns, like /orders/:id, for the paths
+// they match. Query parameters named in drop are left out of everything.
+func NewShaper(patterns []string, drop []string) (*Shaper, error) {
+	s := &Shaper{drop: make(map[string]bool, len(drop))}
+	for _, raw := range patterns {
+		if !strings.HasPrefix(raw, "/") {
+			return nil, fmt.Errorf("pattern %q should start with /", raw)
+		}
+		s.patterns = append(s.patterns, pattern{raw: raw, segments: strings.Split(raw, "/")})
+	}
+	for _, name := range drop {
+		s.drop[name] = true
+	}
+	return s, nil
+}
+
+// Shape breaks down request, which may be a path, a URL, or an HTTP request
+// line like nginx's $request ("GET /path HTTP/1.1")
+func (s *Shaper) Shape(request string) (*Shaped, error) {
+	target := strings.TrimSpace(request)
+	if fields := strings.Fields(target); len(fields) == 3 && strings.HasPrefix(fields[2], "HTTP/") {
+		target = fields[1]
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	for name := range params {
+		if s.drop[name] {
+			params.Del(name)
+		}
+	}
+	shaped := &Shaped{
+		Path:        u.Path,
+		Query:       params.Encode(),
+		QueryParams: params,
+	}
+	shaped.Shape = s.shapePath(u.Path, shaped)
+	if len(params) > 0 {
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, url.QueryEscape(name)+"="+placeholder)
+		}
+		sort.Strings(names)
+		shaped.Shape += "?" + strings.Join(names, "&")
+	}
+	return shaped, nil
+}
+
+// shapePath returns the shape of path: the first pattern it matches, filling
+// in shaped.PathParams, or otherwise path with any ids replaced
+func (s *Shaper) shapePath(path string, shaped *Shaped) string {
+	segments := strings.Split(path, "/")
+	for _, p := range s.patterns {
+		if params, ok := p.match(segments); ok {
+			shaped.PathParams = params
+			return p.raw
+		}
+	}
+	for i, segment := range segments {
+		if reVarying.MatchString(segment) {
+			segments[i] = placeholder
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// match returns the :name segments of the path split into segments, if it
+// matches the pattern
+func (p pattern) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(p.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, segment := range p.segments {
+		switch {
+		case strings.HasPrefix(segment, ":") && segments[i] != "":
+			params[segment[1:]] = segments[i]
+		case segment != segments[i]:
+			return nil, false
+		}
+	}
+	return params, true
+}
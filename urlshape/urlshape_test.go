@@ -0,0 +1,58 @@
+package urlshape
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShape(t *testing.T) {
+	s, err := NewShaper([]string{"/orders/:id/items/:item"}, []string{"token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		in, path, query, shape string
+		pathParams             map[string]string
+	}{
+		{
+			in:    "GET /users/1234/profile?b=2&a=1&token=secret HTTP/1.1",
+			path:  "/users/1234/profile",
+			query: "a=1&b=2",
+			shape: "/users/?/profile?a=?&b=?",
+		},
+		{
+			in:    "https://example.com/files/6ba7b810-9dad-11d1-80b4-00c04fd430c8/0123456789abcdef0123",
+			path:  "/files/6ba7b810-9dad-11d1-80b4-00c04fd430c8/0123456789abcdef0123",
+			shape: "/files/?/?",
+		},
+		{
+			in:         "/orders/42/items/abc?x=1",
+			path:       "/orders/42/items/abc",
+			query:      "x=1",
+			shape:      "/orders/:id/items/:item?x=?",
+			pathParams: map[string]string{"id": "42", "item": "abc"},
+		},
+		{
+			// too short for the pattern, and words aren't ids
+			in:    "/orders/42/items",
+			path:  "/orders/42/items",
+			shape: "/orders/?/items",
+		},
+	}
+	for _, tc := range testCases {
+		shaped, err := s.Shape(tc.in)
+		if err != nil {
+			t.Errorf("%s: %s", tc.in, err)
+			continue
+		}
+		if shaped.Path != tc.path || shaped.Query != tc.query || shaped.Shape != tc.shape {
+			t.Errorf("%s: expected %q %q %q, got %q %q %q", tc.in, tc.path, tc.query, tc.shape, shaped.Path, shaped.Query, shaped.Shape)
+		}
+		if !reflect.DeepEqual(shaped.PathParams, tc.pathParams) {
+			t.Errorf("%s: expected path params %v, got %v", tc.in, tc.pathParams, shaped.PathParams)
+		}
+	}
+	if _, err := NewShaper([]string{"orders/:id"}, nil); err == nil {
+		t.Error("expected an error for a pattern not starting with /")
+	}
+}
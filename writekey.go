@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeytail/aws"
+	"github.com/honeycombio/honeytail/leash"
+)
+
+// the schemes --writekey_secret understands, naming where the secret is
+const (
+	secretsManagerScheme = "aws-secretsmanager://"
+	ssmScheme            = "aws-ssm://"
+	vaultScheme          = "vault://"
+)
+
+// writeKeySources counts how many of the flags the write key can come from
+// are set
+func writeKeySources(options leash.Config) int {
+	n := 0
+	for _, source := range []string{options.Reqs.WriteKey, options.WriteKeyFile, options.WriteKeyCommand, options.WriteKeySecret} {
+		if source != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// readWriteKey returns the write key from --writekey_file,
+// --writekey_command or --writekey_secret, whichever is set, or --writekey
+// if none of them are
+func readWriteKey(options leash.Config) (string, error) {
+	if writeKeySources(options) > 1 {
+		return "", errors.New("only one of --writekey, --writekey_file, --writekey_command and --writekey_secret may be given")
+	}
+	var key string
+	var err error
+	switch {
+	case options.WriteKeyFile != "":
+		var contents []byte
+		contents, err = ioutil.ReadFile(options.WriteKeyFile)
+		key = string(contents)
+	case options.WriteKeyCommand != "":
+		key, err = writeKeyFromCommand(options.WriteKeyCommand)
+	case options.WriteKeySecret != "":
+		key, err = writeKeyFromSecret(options.WriteKeySecret, options.AWS)
+	default:
+		return options.Reqs.WriteKey, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", errors.New("the write key read was empty")
+	}
+	return key, nil
+}
+
+// writeKeyFromCommand runs command with the shell, returning what it prints
+func writeKeyFromCommand(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%q failed: %s: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// writeKeyFromSecret fetches the secret named by a --writekey_secret URL,
+// picking the field after a # out of it if it's JSON
+func writeKeyFromSecret(spec string, awsOptions aws.Options) (string, error) {
+	name, field := spec, ""
+	if i := strings.LastIndex(spec, "#"); i >= 0 {
+		name, field = spec[:i], spec[i+1:]
+	}
+	switch {
+	case strings.HasPrefix(name, secretsManagerScheme), strings.HasPrefix(name, ssmScheme):
+		client, err := aws.NewClient(awsOptions)
+		if err != nil {
+			return "", err
+		}
+		var secret string
+		if strings.HasPrefix(name, ssmScheme) {
+			secret, err = client.GetParameter(strings.TrimPrefix(name, ssmScheme))
+		} else {
+			secret, err = client.GetSecretValue(strings.TrimPrefix(name, secretsManagerScheme))
+		}
+		if err != nil || field == "" {
+			return secret, err
+		}
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(secret), &values); err != nil {
+			return "", fmt.Errorf("%s isn't JSON to take %s from", name, field)
+		}
+		return secretField(values, field)
+	case strings.HasPrefix(name, vaultScheme):
+		values, err := vaultSecret(strings.TrimPrefix(name, vaultScheme))
+		if err != nil {
+			return "", err
+		}
+		if field == "" {
+			field = "writekey"
+		}
+		return secretField(values, field)
+	}
+	return "", fmt.Errorf("%q isn't a %s, %s or %s URL", spec, secretsManagerScheme, ssmScheme, vaultScheme)
+}
+
+// secretField returns the string in values under field
+func secretField(values map[string]interface{}, field string) (string, error) {
+	value, ok := values[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret has no %s string", field)
+	}
+	return value, nil
+}
+
+// vaultSecret reads the secret at path, eg secret/data/honeytail, from the
+// Vault at $VAULT_ADDR with $VAULT_TOKEN. Secrets from version 2 of the
+// key/value engine have their values nested in another data.
+func vaultSecret(path string) (map[string]interface{}, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, errors.New("VAULT_ADDR must be set to read from Vault")
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %d for %s: %s", resp.StatusCode, path, strings.TrimSpace(string(body)))
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, err
+	}
+	if nested, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return nested, nil
+		}
+	}
+	return secret.Data, nil
+}